@@ -0,0 +1,348 @@
+// accesslog.go
+// Per-Responder Request Logging
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// A Feedback Responder may log each request that it answers to the access
+// log, a file in the log directory separate from the agent log, so that it
+// can be seen which load balancers are polling the agent and how often.
+// Each entry is a line of JSON, giving the time, Responder, client address
+// and latency, along with further details according to the verbosity:
+//
+//   - 'basic': the above, and the status code of HTTP(S) requests.
+//   - 'response' (the default): the feedback response sent as well.
+//   - 'full': the request line of TCP requests, or the method, path, Host
+//     header and user agent of HTTP(S) requests as well.
+//
+// As load balancers may poll every few seconds, the entries may be sampled;
+// a sample rate below 1 logs only that fraction of requests, chosen at
+// random, and a client interval logs at most one request from each client
+// in that time, giving the number of requests sampled since its last entry.
+// The access log is rotated as for the agent log.
+
+const (
+	// Name of the access log file in the log directory.
+	AccessLogFileName = "access.log"
+
+	// Verbosity levels of the access log.
+	AccessLogBasic    = "basic"
+	AccessLogResponse = "response"
+	AccessLogFull     = "full"
+
+	// Number of clients for which a Responder tracks the last entry,
+	// beyond which those outside the client interval are forgotten.
+	MaxAccessLogClients = 1024
+)
+
+// AccessLogConfig holds the access log settings of a Responder. A sample
+// rate of zero logs every request.
+type AccessLogConfig struct {
+	Verbosity      string  `json:"verbosity,omitempty"`
+	SampleRate     float64 `json:"sample-rate,omitempty"`
+	ClientInterval int     `json:"client-interval-s,omitempty"`
+}
+
+// ParseAccessLogVerbosity validates and standardises the name of an access
+// log verbosity level; an empty name gives the default.
+func ParseAccessLogVerbosity(name string) (result string, err error) {
+	result = strings.ToLower(strings.TrimSpace(name))
+	switch result {
+	case "":
+		result = AccessLogResponse
+	case AccessLogBasic, AccessLogResponse, AccessLogFull:
+	default:
+		err = errors.New("invalid access log verbosity '" + name +
+			"'; must be '" + AccessLogBasic + "', '" + AccessLogResponse +
+			"' or '" + AccessLogFull + "'")
+	}
+	return
+}
+
+// Validate checks and standardises the access log settings.
+func (config *AccessLogConfig) Validate() (err error) {
+	verbosity, err := ParseAccessLogVerbosity(config.Verbosity)
+	if err != nil {
+		return
+	}
+	// The default verbosity is left unset in the config.
+	if verbosity == AccessLogResponse {
+		verbosity = ""
+	}
+	config.Verbosity = verbosity
+	if config.SampleRate < 0 || config.SampleRate > 1 {
+		err = errors.New("invalid access log sample rate; must be between " +
+			"0 and 1")
+		return
+	}
+	if config.ClientInterval < 0 {
+		err = errors.New("invalid access log client interval; cannot be " +
+			"negative")
+	}
+	return
+}
+
+// AccessLogEntry is a line of the access log.
+type AccessLogEntry struct {
+	Time      time.Time `json:"time"`
+	Responder string    `json:"responder"`
+	Client    string    `json:"client"`
+	LatencyMS float64   `json:"latency-ms"`
+	Status    int       `json:"status,omitempty"`
+	Requests  int       `json:"requests,omitempty"`
+	Response  string    `json:"response,omitempty"`
+	Request   string    `json:"request,omitempty"`
+	Method    string    `json:"method,omitempty"`
+	Path      string    `json:"path,omitempty"`
+	Host      string    `json:"host,omitempty"`
+	UserAgent string    `json:"user-agent,omitempty"`
+}
+
+// accessSampler holds the sampling state of the access log of a Responder.
+type accessSampler struct {
+	// The time of the last entry for each client, and the number of
+	// requests sampled from it since.
+	lastEntry map[string]time.Time
+	requests  map[string]int
+	mutex     sync.Mutex
+}
+
+// configureAccessLog validates the access log settings of this
+// FeedbackResponder, resetting its sampling. The caller must hold the
+// mutex.
+func (fbr *FeedbackResponder) configureAccessLog() (err error) {
+	fbr.accessSampler = nil
+	if fbr.AccessLog == nil {
+		return
+	}
+	if fbr.ProtocolName != ProtocolTCP && fbr.ProtocolName != ProtocolHTTP &&
+		fbr.ProtocolName != ProtocolHTTPS {
+		err = errors.New("access logging is only supported by TCP and " +
+			"HTTP(S) responders")
+		return
+	}
+	// Copy the settings, as they are shared with the original by Copy().
+	config := *fbr.AccessLog
+	err = config.Validate()
+	if err != nil {
+		return
+	}
+	fbr.AccessLog = &config
+	fbr.accessSampler = &accessSampler{
+		lastEntry: make(map[string]time.Time),
+		requests:  make(map[string]int),
+	}
+	return
+}
+
+// setAccessLog applies the access log settings given by an API request to
+// this FeedbackResponder; setting any of these enables the access log,
+// unless it is disabled by the request. Those not given are unchanged.
+func (fbr *FeedbackResponder) setAccessLog(request *APIRequest) {
+	if request.AccessLog != nil && !*request.AccessLog {
+		fbr.AccessLog = nil
+		return
+	}
+	if request.AccessLog == nil && request.AccessLogVerbosity == nil &&
+		request.AccessLogSampleRate == nil &&
+		request.AccessLogInterval == nil {
+		return
+	}
+	config := AccessLogConfig{}
+	if fbr.AccessLog != nil {
+		config = *fbr.AccessLog
+	}
+	if request.AccessLogVerbosity != nil {
+		config.Verbosity = *request.AccessLogVerbosity
+	}
+	if request.AccessLogSampleRate != nil {
+		config.SampleRate = *request.AccessLogSampleRate
+	}
+	if request.AccessLogInterval != nil {
+		config.ClientInterval = *request.AccessLogInterval
+	}
+	fbr.AccessLog = &config
+}
+
+// logAccess writes an entry for a request answered by this
+// FeedbackResponder to the access log, if it is enabled and the request is
+// sampled. The time, responder and latency are filled in here, from the
+// time at which the request was received.
+func (fbr *FeedbackResponder) logAccess(started time.Time,
+	entry AccessLogEntry) {
+	config, sampler := fbr.AccessLog, fbr.accessSampler
+	if config == nil || sampler == nil {
+		return
+	}
+	entry.Time = time.Now()
+	if config.SampleRate > 0 && rand.Float64() >= config.SampleRate {
+		return
+	}
+	client, _, err := net.SplitHostPort(entry.Client)
+	if err == nil {
+		entry.Client = client
+	}
+	if config.ClientInterval > 0 {
+		entry.Requests = sampler.sample(entry.Client, entry.Time,
+			time.Duration(config.ClientInterval)*time.Second)
+		if entry.Requests == 0 {
+			return
+		}
+	}
+	entry.Responder = fbr.ResponderName
+	entry.LatencyMS = float64(entry.Time.Sub(started).Microseconds()) / 1000
+	if config.Verbosity == AccessLogBasic {
+		entry.Response = ""
+	} else {
+		entry.Response = strings.TrimSpace(entry.Response)
+	}
+	if config.Verbosity != AccessLogFull {
+		entry.Request, entry.Method, entry.Path = "", "", ""
+		entry.Host, entry.UserAgent = "", ""
+	} else {
+		entry.Request = strings.TrimSpace(entry.Request)
+	}
+	fbr.ParentAgent.accessLog.Write(entry)
+}
+
+// sample records a request from a client, returning the number of requests
+// sampled from it since its last entry if it is now due another, or zero
+// if not.
+func (sampler *accessSampler) sample(client string, now time.Time,
+	interval time.Duration) (requests int) {
+	sampler.mutex.Lock()
+	defer sampler.mutex.Unlock()
+	sampler.requests[client]++
+	last, exists := sampler.lastEntry[client]
+	if exists && now.Sub(last) < interval {
+		return
+	}
+	requests = sampler.requests[client]
+	sampler.lastEntry[client] = now
+	sampler.requests[client] = 0
+	// Forget any clients which are no longer polling.
+	if len(sampler.lastEntry) > MaxAccessLogClients {
+		for other, last := range sampler.lastEntry {
+			if now.Sub(last) >= interval {
+				delete(sampler.lastEntry, other)
+				delete(sampler.requests, other)
+			}
+		}
+	}
+	return
+}
+
+// #######################################################################
+// Access Log
+// #######################################################################
+
+// AccessLog writes the access log entries of all Responders to the access
+// log file, which is only opened once an entry is written.
+type AccessLog struct {
+	path     string
+	rotation LogRotationConfig
+	file     *RotatingLogFile
+	// Whether the file could not be opened, which is only reported once.
+	failed bool
+	mutex  sync.Mutex
+}
+
+// Configure sets the path and rotation of the access log file, which is
+// disabled if the path is empty, closing any file already open.
+func (log *AccessLog) Configure(path string, rotation LogRotationConfig) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	if path == log.path && rotation == log.rotation {
+		return
+	}
+	if log.file != nil {
+		_ = log.file.Close()
+		log.file = nil
+	}
+	log.path = path
+	log.rotation = rotation
+	log.failed = false
+}
+
+// Write writes an entry to the access log file, opening it if required.
+func (log *AccessLog) Write(entry AccessLogEntry) {
+	if log == nil {
+		return
+	}
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	if log.path == "" || log.failed {
+		return
+	}
+	if log.file == nil {
+		err := CreateDirectoryIfMissing(filepath.Dir(log.path))
+		var file *RotatingLogFile
+		if err == nil {
+			file, err = NewRotatingLogFile(log.path, log.rotation)
+		}
+		if err != nil {
+			log.failed = true
+			logrus.Error("Failed to open the access log: " + err.Error())
+			return
+		}
+		log.file = file
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	_, err = log.file.Write(append(line, '\n'))
+	if err != nil {
+		logrus.Error("Failed to write to the access log: " + err.Error())
+	}
+}
+
+// UpdateAccessLog applies the log directory and rotation settings of this
+// FeedbackAgent to its access log.
+func (agent *FeedbackAgent) UpdateAccessLog() {
+	if agent.accessLog == nil {
+		return
+	}
+	path := ""
+	if strings.TrimSpace(agent.LogDir) != "" {
+		path = filepath.Join(agent.LogDir, AccessLogFileName)
+	}
+	rotation := DefaultLogRotation()
+	if agent.LogRotation != nil {
+		rotation = agent.LogRotation
+	}
+	agent.accessLog.Configure(path, *rotation)
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
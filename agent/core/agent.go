@@ -23,6 +23,8 @@
 package agent
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -30,7 +32,11 @@ import (
 	"io"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // FeedbackAgent represents the main parent service which runs a configured
@@ -39,14 +45,37 @@ import (
 type FeedbackAgent struct {
 	// Config masthead fields. These were absent prior to v5.3.6 and
 	// must therefore have the omitempty flag set for the JSON.
-	ServiceName string `json:"service-name,omitempty"`
-	Version     string `json:"version,omitempty"`
+	ServiceName   string `json:"service-name,omitempty"`
+	Version       string `json:"version,omitempty"`
+	ConfigVersion int    `json:"config-version,omitempty"`
 
 	// Agent configuration fields
-	LogDir     string                        `json:"log-dir"`
-	APIKey     string                        `json:"api-key,omitempty"`
-	Monitors   map[string]*SystemMonitor     `json:"monitors"`
-	Responders map[string]*FeedbackResponder `json:"responders"`
+	LogDir         string                        `json:"log-dir"`
+	LogFormat      string                        `json:"log-format,omitempty"`
+	LogLevel       string                        `json:"log-level,omitempty"`
+	LogRotation    *LogRotationConfig            `json:"log-rotation,omitempty"`
+	LogTargets     []string                      `json:"log-targets,omitempty"`
+	SyslogFacility string                        `json:"syslog-facility,omitempty"`
+	APIKey         string                        `json:"api-key,omitempty"`
+	WatchConfig    bool                          `json:"watch-config,omitempty"`
+	ConfigBackups  int                           `json:"config-backups,omitempty"`
+	EnableTests    bool                          `json:"enable-test-actions,omitempty"`
+	APIDisabled    []string                      `json:"api-disabled-actions,omitempty"`
+	HistoryStore   *HistoryStoreConfig           `json:"history-store,omitempty"`
+	Recorder       *RecorderConfig               `json:"recorder,omitempty"`
+	Heartbeat      *HeartbeatConfig              `json:"heartbeat,omitempty"`
+	Forwarder      *ForwarderConfig              `json:"metric-forwarder,omitempty"`
+	OTel           *OTelConfig                   `json:"opentelemetry,omitempty"`
+	DebugListener  *DebugListenerConfig          `json:"debug-listener,omitempty"`
+	Cluster        *ClusterConfig                `json:"cluster,omitempty"`
+	Hooks          *HookConfig                   `json:"hooks,omitempty"`
+	Supervisor     *SupervisorConfig             `json:"supervisor,omitempty"`
+	Webhooks       *WebhookConfig                `json:"webhooks,omitempty"`
+	EmailAlerts    *EmailConfig                  `json:"email-alerts,omitempty"`
+	Events         *EventLogConfig               `json:"event-log,omitempty"`
+	Namespaces     map[string]*Namespace         `json:"namespaces,omitempty"`
+	Monitors       map[string]*SystemMonitor     `json:"monitors"`
+	Responders     map[string]*FeedbackResponder `json:"responders"`
 
 	// State parameters for the agent application
 	useLocalPath   bool
@@ -57,6 +86,46 @@ type FeedbackAgent struct {
 	restartSignal  os.Signal
 	quitSignal     os.Signal
 	unsavedChanges bool
+	apiKey         string
+	options        AgentOptions
+	startTime      time.Time
+	analyses       map[string]*SignificanceAnalysis
+	analysisMutex  *sync.Mutex
+	events         *EventLog
+	configWatcher  *ConfigWatcher
+	historyStore   *atomic.Pointer[HistoryStore]
+	recorder       *atomic.Pointer[Recorder]
+	otel           *atomic.Pointer[OTelExporter]
+	heartbeat      *Heartbeat
+	forwarder      *Forwarder
+	webhooks       *atomic.Pointer[WebhookNotifier]
+	emailNotifier  *atomic.Pointer[EmailNotifier]
+	debugListener  *DebugListener
+	cluster        *Cluster
+	virtuals       *virtualRegistry
+	accessLog      *AccessLog
+	supervisor     *serviceSupervisor
+	// Held whilst the maps of monitors and responders are changed, so that
+	// they can be read safely from background goroutines.
+	servicesMutex *sync.RWMutex
+	// Hash of the config file as last loaded or saved by the agent, and
+	// whether unsaved changes have diverged from an external change to it.
+	configHash     [sha256.Size]byte
+	configDiverged *atomic.Bool
+	panics         *atomic.Uint64
+	// The API actions disabled by the config, as '<type> <action>' pairs.
+	disabledActions map[string]bool
+	// Warnings and errors collected for the startup report, if requested.
+	startupLog *startupLogHook
+}
+
+// AgentOptions holds the settings for the agent process specified on the
+// command line when it is launched, which are not saved in the config.
+type AgentOptions struct {
+	NoColor          bool
+	Instance         string
+	AllowInsecureAPI bool
+	JSONStartup      bool
 }
 
 // PanicDebug specifies if a panic should result in termination
@@ -65,13 +134,26 @@ var PanicDebug = false
 
 // LaunchAgentService creates a new [FeedbackAgent] service and runs it.
 func LaunchAgentService() (exitStatus int) {
-	// Print the CLI masthead.
-	fmt.Println(ShellBanner)
+	// Parse any arguments following the 'run-agent' action.
+	options, err := ParseAgentArguments(os.Args[2:])
+	if err != nil {
+		fmt.Println(ShellBanner)
+		fmt.Println("Error: " + err.Error() + ".")
+		exitStatus = ExitStatusError
+		return
+	}
+	// Print the CLI masthead, unless a startup report is to be printed
+	// instead.
+	if !options.JSONStartup {
+		fmt.Println(ShellBanner)
+	}
 	// $$ TO DO: Pass errors from agent.Run() to show success/
 	// failure on the shell (not just in the logs).
 	agent := FeedbackAgent{
-		ServiceName: AppIdentifier,
-		Version:     VersionString,
+		ServiceName:   AppIdentifier,
+		Version:       VersionString,
+		ConfigVersion: CurrentConfigVersion,
+		options:       options,
 	}
 	exitStatus = agent.Run()
 	return
@@ -79,12 +161,30 @@ func LaunchAgentService() (exitStatus int) {
 
 // Run initialises the agent parameters and runs its main function.
 func (agent *FeedbackAgent) Run() (exitStatus int) {
+	agent.startTime = time.Now()
+	agent.analysisMutex = &sync.Mutex{}
+	agent.servicesMutex = &sync.RWMutex{}
+	agent.virtuals = &virtualRegistry{}
+	agent.accessLog = &AccessLog{}
+	agent.supervisor = newServiceSupervisor(agent)
+	agent.events = &EventLog{}
+	agent.historyStore = &atomic.Pointer[HistoryStore]{}
+	agent.recorder = &atomic.Pointer[Recorder]{}
+	agent.otel = &atomic.Pointer[OTelExporter]{}
+	agent.webhooks = &atomic.Pointer[WebhookNotifier]{}
+	agent.emailNotifier = &atomic.Pointer[EmailNotifier]{}
+	agent.configDiverged = &atomic.Bool{}
+	agent.panics = &atomic.Uint64{}
 	agent.isStarting = true
 	agent.useLocalPath = LocalPathMode
 	agent.InitialiseLogger()
+	agent.beginStartupReport()
 	agent.PlatformConfigureSignals()
 	agent.InitialisePaths()
 	logrus.Info("*** [Started] Loadbalancer.org Feedback Agent v" + VersionString)
+	if agent.options.Instance != "" {
+		logrus.Info("Running as instance '" + agent.options.Instance + "'.")
+	}
 	exitStatus = agent.agentMain()
 	logrus.Info("*** [Stopped] The Feedback Agent has terminated.")
 	return
@@ -97,19 +197,25 @@ func (agent *FeedbackAgent) agentMain() (exitStatus int) {
 	err := agent.LoadOrCreateConfig()
 	if err != nil {
 		logrus.Error("Configuration of Feedback Agent services failed.")
+		agent.printStartupReport(false)
 		exitStatus = ExitStatusError
 		return
 	}
-	// Set up file logging for this agent.
-	err = agent.InitialiseFileLogging(agent.LogDir)
-	if err != nil {
-		logrus.Error("cannot log to file; file logging disabled: " + err.Error())
-	}
+	// Apply the configured log level and format, and set up the log targets.
+	agent.ApplyLogLevel()
+	agent.ApplyLogFormat()
+	agent.InitialiseLogTargets()
+	agent.UpdateAccessLog()
+	agent.UpdateEventLog()
+	agent.UpdateHistoryStore()
+	agent.UpdateRecorder()
+	agent.UpdateOTelExporter()
 	// Start the main functions of the agent.
 	err = agent.StartAllServices()
 	agent.isStarting = false
 	if err != nil {
 		// We weren't able to successfully run the agent.
+		agent.printStartupReport(false)
 		logrus.Fatal(
 			"The Feedback Agent failed to launch due to an error. " +
 				"Please review the log output.",
@@ -119,9 +225,39 @@ func (agent *FeedbackAgent) agentMain() (exitStatus int) {
 	}
 	// Otherwise, all seems to be well. Go into the event handle loop.
 	logrus.Info("Startup complete; the Feedback Agent has launched.")
+	agent.WriteRuntimeFile()
+	agent.UpdateConfigWatcher()
+	agent.UpdateHeartbeat()
+	agent.UpdateForwarder()
+	agent.UpdateWebhooks()
+	agent.UpdateEmailNotifier()
+	agent.UpdateDebugListener()
+	agent.UpdateCluster()
+	agent.printStartupReport(true)
+	// All responders are now listening, so tell systemd (if applicable).
+	agent.sdNotify(SdNotifyReady)
+	agent.RunHook(HookPostStart)
 	agent.EventHandleLoop()
 	// If we're here, we've quit.
+	agent.sdNotify(SdNotifyStopping)
+	agent.RunHook(HookPreStop)
+	agent.supervisor.Stop()
+	// Stop the API first, so that the configuration cannot be changed or
+	// saved whilst the other subsystems are stopped.
+	agent.StopAPIResponders()
+	agent.StopConfigWatcher()
+	agent.StopHistoryStore()
+	agent.StopRecorder()
+	agent.StopOTelExporter()
+	agent.StopHeartbeat()
+	agent.StopForwarder()
+	agent.StopWebhooks()
+	agent.StopEmailNotifier()
+	agent.StopDebugListener()
+	agent.StopCluster()
+	agent.RemoveRuntimeFile()
 	err = agent.StopAllServices()
+	agent.events.Close()
 	if err != nil {
 		logrus.Error("Failed to stop all services: " + err.Error() + ".")
 		exitStatus = ExitStatusError
@@ -152,21 +288,76 @@ func (agent *FeedbackAgent) InitialisePaths() {
 	} else {
 		agent.SetDefaultPaths()
 	}
+	// Each named instance has its own config and log directories within
+	// the base directories, so that multiple agents can run on one host.
+	agent.configDir = InstanceDir(agent.configDir, agent.options.Instance)
+	agent.LogDir = InstanceDir(agent.LogDir, agent.options.Instance)
+}
+
+// WriteRuntimeFile writes the details of the running agent process to the
+// runtime file in its config directory, so that the CLI client can find
+// the API if it is listening on an ephemeral port.
+func (agent *FeedbackAgent) WriteRuntimeFile() {
+	info := AgentRuntimeInfo{
+		PID:      os.Getpid(),
+		Instance: agent.options.Instance,
+	}
+	api, err := agent.GetResponderByName(ResponderNameAPI)
+	if err == nil {
+		info.APIAddress = api.ListenAddresses()[0]
+		info.APIPort = api.GetActivePort()
+	}
+	data, err := json.MarshalIndent(info, "", "    ")
+	if err == nil {
+		err = os.WriteFile(path.Join(agent.configDir, RuntimeFileName), data,
+			DefaultFilePermissions)
+	}
+	if err != nil {
+		logrus.Warn("Failed to write runtime file: " + err.Error())
+	}
+}
+
+// RemoveRuntimeFile removes the runtime file when the agent terminates.
+func (agent *FeedbackAgent) RemoveRuntimeFile() {
+	_ = os.Remove(path.Join(agent.configDir, RuntimeFileName))
 }
 
 // EventHandleLoop blocks until a signal is received from the system based on
 // what is registered  for the platform file. In the case of "platform_posix"
-// this will be SIGTERM, SIGINT, etc.
+// this will be SIGTERM, SIGINT, etc. If the systemd watchdog is enabled,
+// keepalives are sent from this loop, so that systemd restarts the agent
+// if it hangs. Failed services are also restarted from this loop when the
+// supervisor schedules it, so that this never coincides with a reload.
 func (agent *FeedbackAgent) EventHandleLoop() {
+	var watchdog <-chan time.Time
+	if interval := SdWatchdogInterval(); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		watchdog = ticker.C
+		logrus.Info("Sending systemd watchdog keepalives every " +
+			interval.String() + ".")
+	}
 	for {
 		// Wait for a signal to occur, and block this goroutine
 		// until then, as there is nothing for us to do.
-		signal := <-agent.systemSignals
+		var signal os.Signal
+		select {
+		case <-watchdog:
+			agent.sdNotify(SdNotifyWatchdog)
+			continue
+		case restart := <-agent.supervisor.restarts:
+			agent.supervisor.restart(restart.serviceType, restart.name)
+			continue
+		case signal = <-agent.systemSignals:
+		}
 		if signal == agent.restartSignal {
-			err := agent.RestartAllServices()
-			if err != nil {
-				break
-			}
+			// Reload the configuration, restarting only the services that
+			// have changed. If the new configuration is invalid, then the
+			// agent continues to run with its current configuration.
+			agent.sdNotify(SdNotifyReloading)
+			_, _ = agent.ReloadConfig()
+			agent.WriteRuntimeFile()
+			agent.sdNotify(SdNotifyReady)
 		} else {
 			break
 		}
@@ -178,15 +369,55 @@ func (agent *FeedbackAgent) SelfSignalQuit() {
 	agent.systemSignals <- agent.quitSignal
 }
 
-// InitialiseLogger sets up logrus to show the timestamp in the correct format.
+// InitialiseLogger sets up logrus for concise console output, coloured by
+// level if the console supports it and colours have not been disabled.
 func (agent *FeedbackAgent) InitialiseLogger() {
 	logrus.SetLevel(logrus.DebugLevel)
-	formatter := &logrus.TextFormatter{
-		TimestampFormat: "2006-01-02 15:04:05",
-		FullTimestamp:   true,
-		ForceColors:     false,
+	logrus.SetOutput(os.Stdout)
+	// The console is kept clear for the startup report, if requested.
+	if agent.options.JSONStartup {
+		logrus.SetOutput(io.Discard)
+	}
+	logrus.SetFormatter(&ConsoleFormatter{
+		EnableColor: !agent.options.NoColor && IsColorTerminal(),
+	})
+}
+
+// ApplyLogLevel sets the logging level to the configured startup level.
+// Until the configuration is loaded, debug logging is used so that any
+// problems with loading it are fully reported.
+func (agent *FeedbackAgent) ApplyLogLevel() {
+	err := agent.SetLogLevel(agent.LogLevel)
+	if err != nil {
+		logrus.Warn(err.Error() + "; using '" + DefaultLogLevel + "'.")
+		_ = agent.SetLogLevel(DefaultLogLevel)
+	}
+}
+
+// SetLogLevel changes the logging level of the running agent, recording
+// it in the configuration.
+func (agent *FeedbackAgent) SetLogLevel(name string) (err error) {
+	name, level, err := ParseLogLevel(name)
+	if err != nil {
+		return
+	}
+	logrus.SetLevel(level)
+	agent.LogLevel = name
+	return
+}
+
+// ApplyLogFormat switches the console output to the configured log format.
+// The JSON format replaces the console rendering entirely, so that the
+// output can be ingested directly by log collectors.
+func (agent *FeedbackAgent) ApplyLogFormat() {
+	format, err := ParseLogFormat(agent.LogFormat)
+	if err != nil {
+		logrus.Warn(err.Error() + "; using '" + LogFormatText + "'.")
+		format = LogFormatText
+	}
+	if format == LogFormatJSON {
+		logrus.SetFormatter(NewFileFormatter(LogFormatJSON))
 	}
-	logrus.SetFormatter(formatter)
 }
 
 // StartAllServices loads the JSON configuration file (or creates a new default file,
@@ -244,16 +475,32 @@ func (agent *FeedbackAgent) StartAllServices() (err error) {
 	return
 }
 
-// StopAllServices signals all FeedbackAgent services to stop.
+// StopAllServices signals all FeedbackAgent services to stop. The
+// Responders are stopped together, so that all stop accepting new
+// connections at once and their in-flight requests are drained in
+// parallel, before the Monitors they use are stopped.
 func (agent *FeedbackAgent) StopAllServices() (err error) {
 	logrus.Info("Stopping all Feedback Agent services.")
-	var currentErr error
+	var wait sync.WaitGroup
+	var errMutex sync.Mutex
 	for _, responder := range agent.Responders {
-		currentErr = responder.Stop()
-		if currentErr != nil {
-			err = errors.Join(err, currentErr)
+		// API Responders may already have been stopped on shutdown.
+		if !responder.IsRunning() {
+			continue
 		}
+		wait.Add(1)
+		go func(responder *FeedbackResponder) {
+			defer wait.Done()
+			stopErr := responder.Stop()
+			if stopErr != nil {
+				errMutex.Lock()
+				err = errors.Join(err, stopErr)
+				errMutex.Unlock()
+			}
+		}(responder)
 	}
+	wait.Wait()
+	var currentErr error
 	for _, monitor := range agent.Monitors {
 		currentErr = monitor.Stop()
 		if currentErr != nil {
@@ -263,6 +510,21 @@ func (agent *FeedbackAgent) StopAllServices() (err error) {
 	return
 }
 
+// StopAPIResponders stops the API Responders of this FeedbackAgent, so
+// that no further requests are accepted whilst it shuts down.
+func (agent *FeedbackAgent) StopAPIResponders() {
+	for name, responder := range agent.Responders {
+		if !responder.IsAPI() || !responder.IsRunning() {
+			continue
+		}
+		err := responder.Stop()
+		if err != nil {
+			logrus.Error("Failed to stop API responder '" + name + "': " +
+				err.Error() + ".")
+		}
+	}
+}
+
 // RestartAllServices restarts all FeedbackAgent services and reloads the configuration.
 func (agent *FeedbackAgent) RestartAllServices() (err error) {
 	logrus.Info("The Feedback Agent is restarting.")
@@ -334,7 +596,8 @@ func (agent *FeedbackAgent) DeleteResponderByName(name string) (err error) {
 	if err != nil {
 		return
 	}
-	delete(agent.Responders, name)
+	agent.removeResponder(name)
+	agent.supervisor.forget(LogFieldResponder, name)
 	return
 }
 
@@ -392,7 +655,8 @@ func (agent *FeedbackAgent) DeleteMonitorByName(name string) (err error) {
 	if err != nil {
 		return
 	}
-	delete(agent.Monitors, name)
+	agent.removeMonitor(name)
+	agent.supervisor.forget(LogFieldMonitor, name)
 	return
 }
 
@@ -410,6 +674,13 @@ func (agent *FeedbackAgent) LoadOrCreateConfig() (err error) {
 		configLoaded, err = agent.LoadAgentConfig(agent.configDir, ConfigFileName)
 		if configLoaded {
 			logrus.Info("Configuration loaded successfully from file: " + fullPath)
+			// Save any corrections made to the config whilst loading it.
+			if agent.unsavedChanges {
+				_, saveErr := agent.SaveAgentConfigToPaths()
+				if saveErr != nil {
+					logrus.Error("Error whilst saving config: " + saveErr.Error())
+				}
+			}
 			return
 		} else if err != nil {
 			logrus.Error("Failed to load configuration: " + err.Error())
@@ -472,6 +743,9 @@ func (agent *FeedbackAgent) LoadAgentConfig(dirPath string, fileName string) (
 	if err != nil {
 		return
 	}
+	if fullPath == path.Join(agent.configDir, ConfigFileName) {
+		agent.recordConfigFile(configData)
+	}
 	err = agent.JSONToConfig(configData)
 	if err != nil {
 		return
@@ -497,32 +771,23 @@ func (agent *FeedbackAgent) SaveAgentConfig(dirPath string, fileName string) (
 		return
 	}
 	fullPath := path.Join(dirPath, fileName)
-	// Attempt to create or truncate the config file.
-	file, err := os.Create(fullPath)
-	// If this doesn't exist, handle the possible reason (e.g. path
-	// does not exist).
+	err = CreateDirectoryIfMissing(dirPath)
 	if err != nil {
-		err = CreateDirectoryIfMissing(dirPath)
-		if err != nil {
-			err = errors.New(
-				"Failed to open directory, and could " +
-					"not create it: " + dirPath,
-			)
-			return
-		}
-		file, err = os.Create(fullPath)
-		if err != nil {
-			err = errors.New(
-				"Failed to open file for writing, and could " +
-					"not create it: " + fullPath,
-			)
-			return
-		} else {
-			logrus.Info("File not found, created: " + fullPath)
-		}
+		err = errors.New(
+			"Failed to open directory, and could " +
+				"not create it: " + dirPath,
+		)
+		return
+	}
+	// Keep a backup of the previous config before replacing it.
+	backupErr := agent.backupConfigFile(fullPath, jsonOutput)
+	if backupErr != nil {
+		logrus.Warn("Failed to back up the previous configuration: " +
+			backupErr.Error())
 	}
-	// Write the JSON config to the new file.
-	_, err = file.Write(jsonOutput)
+	// Write the JSON config to a temporary file and rename it into place,
+	// so that the config file is never left partially written.
+	err = WriteFileAtomic(fullPath, jsonOutput)
 	if err != nil {
 		err = errors.New(
 			"Failed to save agent configuration: " +
@@ -532,12 +797,11 @@ func (agent *FeedbackAgent) SaveAgentConfig(dirPath string, fileName string) (
 	}
 	success = true
 	agent.unsavedChanges = false
-	err = file.Close()
-	if err != nil {
-		err = errors.New(
-			"Failed to close config file: " +
-				err.Error(),
-		)
+	if fullPath == path.Join(agent.configDir, ConfigFileName) {
+		agent.recordConfigFile(jsonOutput)
+	}
+	if agent.configWatcher != nil && fullPath == agent.configWatcher.filePath {
+		agent.configWatcher.Acknowledge(jsonOutput)
 	}
 	return
 }
@@ -584,8 +848,15 @@ func (agent *FeedbackAgent) SetDefaultPaths() {
 
 // SetDefaultServiceConfig sets up the agent with a default configuration
 // consisting of one CPU monitor and one HTTP responder, connected together.
+// For a named instance, ephemeral ports are used so that the defaults do not
+// collide with any other instance; the responder port should then be set.
 func (agent *FeedbackAgent) SetDefaultServiceConfig() (err error) {
 	agent.InitialiseServiceMaps()
+	agent.LogRotation = DefaultLogRotation()
+	apiPort, responderPort := "3334", "3333"
+	if agent.options.Instance != "" {
+		apiPort, responderPort = "0", "0"
+	}
 	err = agent.AddMonitor(
 		"cpu",
 		MetricTypeCPU,
@@ -601,7 +872,7 @@ func (agent *FeedbackAgent) SetDefaultServiceConfig() (err error) {
 		ResponderName:   ResponderNameAPI,
 		ProtocolName:    ProtocolSecureAPI,
 		ListenIPAddress: "127.0.0.1",
-		ListenPort:      "3334",
+		ListenPort:      apiPort,
 		FeedbackSources: nil,
 	}
 	err = agent.AddResponderObject(&apiResponder)
@@ -620,7 +891,7 @@ func (agent *FeedbackAgent) SetDefaultServiceConfig() (err error) {
 		ResponderName:     "default",
 		ProtocolName:      ProtocolTCP,
 		ListenIPAddress:   "*",
-		ListenPort:        "3333",
+		ListenPort:        responderPort,
 		HAProxyCommands:   HAPConfigDefault,
 		FeedbackSources:   defaultSources,
 		CommandInterval:   DefaultCommandInterval,
@@ -633,6 +904,7 @@ func (agent *FeedbackAgent) SetDefaultServiceConfig() (err error) {
 		return
 	}
 	agent.APIKey = RandomHexBytes(16)
+	agent.apiKey = agent.APIKey
 	return
 }
 
@@ -645,6 +917,21 @@ func (agent *FeedbackAgent) ConfigToJSON() (output []byte, err error) {
 // JSONToConfig configures the FeedbackAgent service from a byte stream of JSON
 // configuration data by parsing it.
 func (agent *FeedbackAgent) JSONToConfig(config []byte) (err error) {
+	// Upgrade a config written by an older agent to the current schema.
+	config, fromVersion, changes, err := MigrateConfigJSON(config)
+	if err != nil {
+		err = errors.New("JSON configuration is invalid or corrupted: " +
+			err.Error())
+		return
+	}
+	if fromVersion > CurrentConfigVersion {
+		logrus.Warn("The configuration was written by a newer version of " +
+			"the Feedback Agent (config version " + strconv.Itoa(fromVersion) +
+			"); any settings not supported by this version will be ignored.")
+	}
+	for _, change := range changes {
+		logrus.Info("Configuration migrated from " + change + ".")
+	}
 	parsed := FeedbackAgent{}
 	// Parse the JSON into a FeedbackAgent object.
 	err = json.Unmarshal(config, &parsed)
@@ -652,16 +939,65 @@ func (agent *FeedbackAgent) JSONToConfig(config []byte) (err error) {
 		err = errors.New("JSON configuration is invalid or corrupted")
 		return
 	}
+	// Report any fields which are not recognised, as these would otherwise
+	// be silently discarded when the configuration is next saved.
+	decoder := json.NewDecoder(bytes.NewReader(config))
+	decoder.DisallowUnknownFields()
+	if decodeErr := decoder.Decode(&FeedbackAgent{}); decodeErr != nil {
+		logrus.Warn("Configuration contains an unrecognised setting which " +
+			"will be ignored and not kept when the configuration is next " +
+			"saved: " + decodeErr.Error())
+	}
 	// Set up the services from our parsed configuration.
 	err = agent.configureFromObject(&parsed)
 	if err != nil {
 		return
 	}
+	// Save the migrated configuration in the current schema.
+	if fromVersion < CurrentConfigVersion {
+		agent.unsavedChanges = true
+	}
 	return
 }
 
+// InitialiseLogTargets sets up each of the log targets configured for this
+// FeedbackAgent in addition to the console. A target which cannot be set
+// up is reported and skipped, rather than preventing the agent starting.
+func (agent *FeedbackAgent) InitialiseLogTargets() {
+	targets, err := ParseLogTargets(agent.LogTargets)
+	if err != nil {
+		logrus.Warn(err.Error() + "; using the '" + LogTargetFile + "' target.")
+		targets = []string{LogTargetFile}
+	}
+	format, _ := ParseLogFormat(agent.LogFormat)
+	for _, target := range targets {
+		var hook logrus.Hook
+		switch target {
+		case LogTargetFile:
+			err = agent.InitialiseFileLogging(agent.LogDir)
+			if err != nil {
+				logrus.Error("cannot log to file; file logging disabled: " +
+					err.Error())
+			}
+			continue
+		case LogTargetSyslog:
+			hook, err = PlatformNewSyslogHook(agent.SyslogFacility,
+				NewSyslogFormatter(format))
+		case LogTargetJournald:
+			hook, err = PlatformNewJournaldHook()
+		}
+		if err != nil {
+			logrus.Error("cannot log to " + target + "; disabled: " + err.Error())
+			continue
+		}
+		logrus.AddHook(hook)
+		logrus.Info("Logging to " + target + ".")
+	}
+}
+
 // InitialiseFileLogging sets up file logging given a string specifying the log
 // directory on the local system, disabling it entirely if an empty string is supplied.
+// The log file is rotated according to the log-rotation settings (or defaults).
 func (agent *FeedbackAgent) InitialiseFileLogging(dir string) (err error) {
 	// Switch off if no path provided.
 	if strings.TrimSpace(dir) == "" {
@@ -675,10 +1011,17 @@ func (agent *FeedbackAgent) InitialiseFileLogging(dir string) (err error) {
 		return
 	}
 	fullPath := path.Join(dir, LogFileName)
-	file, err := PlatformOpenLogFile(fullPath)
+	rotation := agent.LogRotation
+	if rotation == nil {
+		rotation = DefaultLogRotation()
+	}
+	file, err := NewRotatingLogFile(fullPath, *rotation)
 	if err == nil {
+		// The log file always uses the machine-readable format,
+		// regardless of how the console output is rendered.
+		format, _ := ParseLogFormat(agent.LogFormat)
+		logrus.AddHook(NewLogWriterHook(file, NewFileFormatter(format)))
 		logrus.Info("Logging to file: " + fullPath)
-		logrus.SetOutput(io.MultiWriter(os.Stdout, file))
 	}
 	return
 }
@@ -688,8 +1031,140 @@ func (agent *FeedbackAgent) InitialiseFileLogging(dir string) (err error) {
 // validation errors will result in an error being returned.
 func (agent *FeedbackAgent) configureFromObject(parsed *FeedbackAgent) (err error) {
 	agent.LogDir = parsed.LogDir
+	agent.LogFormat = parsed.LogFormat
+	agent.LogLevel = parsed.LogLevel
+	agent.LogRotation = parsed.LogRotation
+	agent.LogTargets = parsed.LogTargets
+	agent.SyslogFacility = parsed.SyslogFacility
 	agent.APIKey = parsed.APIKey
-	for name, monitor := range parsed.Monitors {
+	err = agent.resolveAPIKey()
+	if err != nil {
+		return
+	}
+	agent.WatchConfig = parsed.WatchConfig
+	agent.ConfigBackups = parsed.ConfigBackups
+	agent.EnableTests = parsed.EnableTests
+	agent.APIDisabled = parsed.APIDisabled
+	agent.disabledActions, err = ParseDisabledActions(agent.APIDisabled)
+	if err != nil {
+		return
+	}
+	agent.HistoryStore = parsed.HistoryStore
+	if agent.HistoryStore != nil {
+		err = agent.HistoryStore.Validate()
+		if err != nil {
+			return
+		}
+	}
+	agent.Recorder = parsed.Recorder
+	if agent.Recorder != nil {
+		err = agent.Recorder.Validate()
+		if err != nil {
+			return
+		}
+	}
+	agent.Heartbeat = parsed.Heartbeat
+	if agent.Heartbeat != nil {
+		_, err = agent.Heartbeat.Validate()
+		if err != nil {
+			return
+		}
+	}
+	agent.Forwarder = parsed.Forwarder
+	if agent.Forwarder != nil {
+		_, _, err = agent.Forwarder.Validate()
+		if err != nil {
+			return
+		}
+	}
+	agent.Webhooks = parsed.Webhooks
+	if agent.Webhooks != nil {
+		_, _, err = agent.Webhooks.Validate()
+		if err != nil {
+			return
+		}
+	}
+	agent.Events = parsed.Events
+	if agent.Events != nil {
+		err = agent.Events.Validate()
+		if err != nil {
+			return
+		}
+	}
+	agent.EmailAlerts = parsed.EmailAlerts
+	if agent.EmailAlerts != nil {
+		_, _, err = agent.EmailAlerts.Validate()
+		if err != nil {
+			return
+		}
+	}
+	agent.OTel = parsed.OTel
+	if agent.OTel != nil {
+		_, _, err = agent.OTel.Validate()
+		if err != nil {
+			return
+		}
+	}
+	agent.DebugListener = parsed.DebugListener
+	if agent.DebugListener != nil {
+		_, err = agent.DebugListener.Validate()
+		if err != nil {
+			return
+		}
+	}
+	agent.Cluster = parsed.Cluster
+	if agent.Cluster != nil {
+		_, err = agent.Cluster.Validate()
+		if err != nil {
+			return
+		}
+	}
+	agent.Hooks = parsed.Hooks
+	if agent.Hooks != nil {
+		err = agent.Hooks.Validate()
+		if err != nil {
+			return
+		}
+	}
+	agent.Supervisor = parsed.Supervisor
+	if agent.Supervisor != nil {
+		err = agent.Supervisor.Validate()
+		if err != nil {
+			return
+		}
+	}
+	agent.Namespaces, err = ValidateNamespaces(parsed.Namespaces, agent.apiKey)
+	if err != nil {
+		return
+	}
+	// Standardise the names of all services and the monitors referenced
+	// by feedback sources, so that lookups are consistent.
+	monitors, renamedMonitors, err := NormaliseNameMap(parsed.Monitors, "monitor")
+	if err != nil {
+		return
+	}
+	responders, renamedResponders, err := NormaliseNameMap(parsed.Responders,
+		"responder")
+	if err != nil {
+		return
+	}
+	renamedSources := false
+	for name, responder := range responders {
+		var renamed bool
+		responder.FeedbackSources, renamed, err =
+			NormaliseNameMap(responder.FeedbackSources, "source in responder '"+name+"'")
+		if err != nil {
+			return
+		}
+		renamedSources = renamedSources || renamed
+	}
+	if renamedMonitors || renamedResponders || renamedSources {
+		logrus.Warn("Some service names in the configuration were not in " +
+			"standard (lower case) form and have been normalised; the " +
+			"configuration will be saved with the corrected names.")
+		agent.unsavedChanges = true
+	}
+	for name, monitor := range monitors {
 		monitor.Name = name
 		err = agent.AddMonitorObject(monitor)
 		if err != nil {
@@ -697,19 +1172,43 @@ func (agent *FeedbackAgent) configureFromObject(parsed *FeedbackAgent) (err erro
 		}
 	}
 	// Create responders from the parsed config.
-	for name, responder := range parsed.Responders {
+	for name, responder := range responders {
 		responder.ResponderName = name
 		responder.ParentAgent = agent
+		var migrated bool
+		migrated, err = agent.migrateLegacyAPI(responder)
+		if err != nil {
+			err = errors.New("responder '" + name + "': " + err.Error())
+			return
+		}
+		if migrated {
+			logLegacyAPIMigration(name)
+			agent.unsavedChanges = true
+		}
 		err = agent.AddResponderObject(responder)
 		if err != nil {
 			return
 		}
 	}
+	// Check that no two responders would listen on the same address before
+	// any of them are started.
+	err = agent.checkListenCollisions()
 	return
 }
 
 // AddMonitorObject adds a monitor object to this FeedbackAgent.
 func (agent *FeedbackAgent) AddMonitorObject(monitor *SystemMonitor) (err error) {
+	name, err := StandardiseNameIdentifier(monitor.Name)
+	if err != nil {
+		err = errors.New("cannot create monitor: " + err.Error())
+		return
+	}
+	monitor.Name = name
+	monitor.Namespace, err = agent.ParseNamespaceName(monitor.Namespace)
+	if err != nil {
+		err = errors.New("cannot create monitor '" + name + "': " + err.Error())
+		return
+	}
 	_, nameExists := agent.Monitors[monitor.Name]
 	if nameExists {
 		err = errors.New(
@@ -719,16 +1218,27 @@ func (agent *FeedbackAgent) AddMonitorObject(monitor *SystemMonitor) (err error)
 		return
 	}
 	monitor.FilePath = agent.configDir
+	monitor.ParentAgent = agent
 	err = monitor.Initialise()
 	if err != nil {
 		return
 	}
-	agent.Monitors[monitor.Name] = monitor
+	agent.setMonitor(monitor.Name, monitor)
 	return
 }
 
 func (agent *FeedbackAgent) AddResponderObject(responder *FeedbackResponder) (err error) {
-	name := responder.ResponderName
+	name, err := StandardiseNameIdentifier(responder.ResponderName)
+	if err != nil {
+		err = errors.New("cannot create responder: " + err.Error())
+		return
+	}
+	responder.ResponderName = name
+	responder.Namespace, err = agent.ParseNamespaceName(responder.Namespace)
+	if err != nil {
+		err = errors.New("cannot create responder '" + name + "': " + err.Error())
+		return
+	}
 	_, nameExists := agent.Responders[name]
 	if nameExists {
 		err = errors.New(
@@ -742,7 +1252,7 @@ func (agent *FeedbackAgent) AddResponderObject(responder *FeedbackResponder) (er
 	if err != nil {
 		return
 	}
-	agent.Responders[name] = responder
+	agent.setResponder(name, responder)
 	return
 }
 
@@ -751,7 +1261,13 @@ func (agent *FeedbackAgent) AddResponderObject(responder *FeedbackResponder) (er
 func (agent *FeedbackAgent) AddResponder(name string,
 	sources map[string]*FeedbackSource, protocol string, ip string,
 	port string, hapCommands string, thresholdMode string,
-	hapThreshold int, logStateChanges bool) (err error) {
+	hapThreshold int, logStateChanges bool, allowedCIDRs []string,
+	maxConnections int, maxRequestRate int) (err error) {
+	name, err = StandardiseNameIdentifier(name)
+	if err != nil {
+		err = errors.New("cannot create responder: " + err.Error())
+		return
+	}
 	_, nameExists := agent.Responders[name]
 	if nameExists {
 		err = errors.New(
@@ -774,16 +1290,106 @@ func (agent *FeedbackAgent) AddResponder(name string,
 		return
 	}
 	responder.LogStateChanges = logStateChanges
-	agent.Responders[name] = responder
+	responder.AllowedCIDRs, responder.allowedNetworks, err =
+		ParseCIDRList(allowedCIDRs)
+	if err == nil {
+		responder.MaxConnections = maxConnections
+		responder.MaxRequestRate = maxRequestRate
+		err = responder.configureLimiter()
+	}
+	if err != nil {
+		err = errors.New(
+			"cannot create responder '" + name +
+				"': " + err.Error(),
+		)
+		return
+	}
+	agent.setResponder(name, responder)
 	return
 }
 
 // InitialiseServiceMaps clears all configured services from this FeedbackAgent.
 func (agent *FeedbackAgent) InitialiseServiceMaps() {
+	agent.lockServices()
+	defer agent.unlockServices()
 	agent.Monitors = make(map[string]*SystemMonitor)
 	agent.Responders = make(map[string]*FeedbackResponder)
 }
 
+// #######################################################################
+// Service Map Locking
+// #######################################################################
+
+// lockServices obtains the services lock for changing the maps of monitors
+// and responders. An agent which is not running (e.g. one staged to
+// validate a configuration) has no lock, as nothing else can read it.
+func (agent *FeedbackAgent) lockServices() {
+	if agent.servicesMutex != nil {
+		agent.servicesMutex.Lock()
+	}
+}
+
+// unlockServices releases the services lock obtained by lockServices().
+func (agent *FeedbackAgent) unlockServices() {
+	if agent.servicesMutex != nil {
+		agent.servicesMutex.Unlock()
+	}
+}
+
+// setMonitor adds or replaces a monitor in the map of this agent.
+func (agent *FeedbackAgent) setMonitor(name string, monitor *SystemMonitor) {
+	agent.lockServices()
+	defer agent.unlockServices()
+	agent.Monitors[name] = monitor
+}
+
+// removeMonitor removes a monitor from the map of this agent.
+func (agent *FeedbackAgent) removeMonitor(name string) {
+	agent.lockServices()
+	defer agent.unlockServices()
+	delete(agent.Monitors, name)
+}
+
+// setResponder adds or replaces a responder in the map of this agent.
+func (agent *FeedbackAgent) setResponder(name string,
+	responder *FeedbackResponder) {
+	agent.lockServices()
+	defer agent.unlockServices()
+	agent.Responders[name] = responder
+}
+
+// removeResponder removes a responder from the map of this agent.
+func (agent *FeedbackAgent) removeResponder(name string) {
+	agent.lockServices()
+	defer agent.unlockServices()
+	delete(agent.Responders, name)
+}
+
+// servicesSnapshot returns copies of the maps of monitors and responders
+// of this agent, without any nil entries, for use by goroutines which run
+// whilst the services may be changed.
+func (agent *FeedbackAgent) servicesSnapshot() (
+	monitors map[string]*SystemMonitor,
+	responders map[string]*FeedbackResponder) {
+	if agent.servicesMutex != nil {
+		agent.servicesMutex.RLock()
+		defer agent.servicesMutex.RUnlock()
+	}
+	monitors = make(map[string]*SystemMonitor, len(agent.Monitors))
+	for name, monitor := range agent.Monitors {
+		if monitor != nil {
+			monitors[name] = monitor
+		}
+	}
+	responders = make(map[string]*FeedbackResponder, len(agent.Responders))
+	for name, responder := range agent.Responders {
+		if responder != nil {
+			responders[name] = responder
+		}
+	}
+	return
+}
+
 // -------------------------------------------------------------------
 // END OF FILE
 // -------------------------------------------------------------------
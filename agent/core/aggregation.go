@@ -0,0 +1,490 @@
+// aggregation.go
+// Aggregation of Feedback Source Loads
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// By default, the overall load of a Feedback Responder is the mean of the
+// loads of its sources, weighted by their relative significance. This can
+// average away a single saturated resource behind several idle ones, so a
+// Responder may instead aggregate the loads of its sources as follows:
+//
+//   - 'min-headroom': the load of the source with the least headroom, where
+//     the load of each source is scaled by its significance (so a source
+//     with a significance of 0.5 can take at most 50% from availability).
+//   - 'max-load': the highest load of any source, irrespective of its
+//     significance.
+//   - 'expression': the result of an arithmetic expression of the loads
+//     (0-100) of the sources, referred to by name, for example:
+//
+//     max(cpu, 0.5 * ram + 0.5 * [disk-usage])
+//
+// Expressions support numbers, the operators '+', '-', '*' and '/',
+// parentheses, and the functions min(), max() and avg(), which take one or
+// more arguments. Sources whose names contain a '-' or begin with a digit
+// are written in square brackets. The result is limited to 0-100%, and an
+// expression which cannot be evaluated (e.g. dividing by zero) gives a load
+// of 100% so that the Responder fails safe.
+
+// Aggregation functions for the loads of the sources of a Responder.
+const (
+	AggregationWeightedMean = "weighted-mean"
+	AggregationMinHeadroom  = "min-headroom"
+	AggregationMaxLoad      = "max-load"
+	AggregationExpression   = "expression"
+
+	// Maximum length of an aggregation expression.
+	MaxAggregationExpressionLength = 1024
+)
+
+// ParseAggregation validates and standardises the name of an aggregation
+// function, an empty name being the default 'weighted-mean'.
+func ParseAggregation(name string) (result string, err error) {
+	result = strings.ToLower(strings.TrimSpace(name))
+	switch result {
+	case "":
+		result = AggregationWeightedMean
+	case AggregationWeightedMean, AggregationMinHeadroom, AggregationMaxLoad,
+		AggregationExpression:
+	default:
+		err = errors.New("invalid aggregation '" + name + "'; must be '" +
+			AggregationWeightedMean + "', '" + AggregationMinHeadroom +
+			"', '" + AggregationMaxLoad + "' or '" + AggregationExpression +
+			"'")
+	}
+	return
+}
+
+// configureAggregation validates the aggregation function of this
+// FeedbackResponder, and parses its expression if it has one. Setting an
+// expression alone selects the 'expression' aggregation. The caller must
+// hold the mutex.
+func (fbr *FeedbackResponder) configureAggregation() (err error) {
+	aggregation := fbr.Aggregation
+	expression := strings.TrimSpace(fbr.AggregationExpression)
+	if strings.TrimSpace(aggregation) == "" && expression != "" {
+		aggregation = AggregationExpression
+	}
+	aggregation, err = ParseAggregation(aggregation)
+	if err != nil {
+		return
+	}
+	fbr.aggregationExpr = nil
+	if aggregation != AggregationExpression {
+		if expression != "" {
+			err = errors.New("an aggregation expression requires the '" +
+				AggregationExpression + "' aggregation")
+			return
+		}
+	} else {
+		if expression == "" {
+			err = errors.New("no aggregation expression specified")
+			return
+		}
+		var parsed *loadExpression
+		parsed, err = parseLoadExpression(expression)
+		if err != nil {
+			err = errors.New("invalid aggregation expression: " + err.Error())
+			return
+		}
+		sources := make(map[string]bool)
+		for key := range fbr.FeedbackSources {
+			sources[strings.ToLower(strings.TrimSpace(key))] = true
+		}
+		for _, name := range parsed.sources {
+			if !sources[name] {
+				err = errors.New("aggregation expression refers to '" + name +
+					"', which is not a source of this responder")
+				return
+			}
+		}
+		fbr.aggregationExpr = parsed
+	}
+	// The default aggregation is left unset in the config.
+	if aggregation == AggregationWeightedMean {
+		aggregation = ""
+	}
+	fbr.Aggregation = aggregation
+	fbr.AggregationExpression = expression
+	return
+}
+
+// setAggregation applies the aggregation function and expression given by
+// an API request to this FeedbackResponder, either of which may be nil to
+// leave it unchanged. Setting another function clears the expression, and
+// setting an expression alone selects the 'expression' function; the result
+// is validated when the FeedbackResponder is next initialised.
+func (fbr *FeedbackResponder) setAggregation(aggregation *string,
+	expression *string) {
+	if aggregation != nil {
+		fbr.Aggregation = *aggregation
+		if expression == nil && !strings.EqualFold(
+			strings.TrimSpace(*aggregation), AggregationExpression) {
+			fbr.AggregationExpression = ""
+		}
+	}
+	if expression != nil {
+		fbr.AggregationExpression = *expression
+		if aggregation == nil && strings.TrimSpace(*expression) != "" {
+			fbr.Aggregation = AggregationExpression
+		}
+	}
+}
+
+// checkAggregationSource returns an error if a source is referred to by
+// the aggregation expression of this FeedbackResponder, and so cannot be
+// removed. The caller must hold the mutex.
+func (fbr *FeedbackResponder) checkAggregationSource(name string) (err error) {
+	if fbr.aggregationExpr != nil &&
+		slices.Contains(fbr.aggregationExpr.sources, name) {
+		err = errors.New(fbr.getLogHead() + ": source '" + name +
+			"' is referred to by the aggregation expression")
+	}
+	return
+}
+
+// aggregateLoad returns the overall load of this FeedbackResponder from the
+// loads (0-100) of its sources by name, using its aggregation function,
+// along with a description for logging. The caller must hold the mutex.
+func (fbr *FeedbackResponder) aggregateLoad(loads map[string]float64) (
+	load float64, logText string) {
+	switch fbr.Aggregation {
+	case AggregationMinHeadroom:
+		for name, sourceLoad := range loads {
+			if source := fbr.FeedbackSources[name]; source != nil {
+				load = max(load, sourceLoad*source.Significance)
+			}
+		}
+	case AggregationMaxLoad:
+		for _, sourceLoad := range loads {
+			load = max(load, sourceLoad)
+		}
+	case AggregationExpression:
+		var err error
+		load, err = fbr.aggregationExpr.eval(loads)
+		if err != nil || math.IsNaN(load) {
+			logText = "aggregation: expression failed (" +
+				errorText(err, "not a number") + "); treating as fully loaded"
+			return 100, logText
+		}
+	default:
+		for name, sourceLoad := range loads {
+			if source := fbr.FeedbackSources[name]; source != nil {
+				load += sourceLoad * source.RelativeSignificance
+			}
+		}
+	}
+	load = min(max(load, 0), 100)
+	aggregation := fbr.Aggregation
+	if aggregation == "" {
+		aggregation = AggregationWeightedMean
+	}
+	logText = "aggregation: " + aggregation + " load is " +
+		strconv.FormatFloat(load, 'f', 2, 64) + "%"
+	return
+}
+
+// errorText returns the text of an error, or a fallback if it is nil.
+func errorText(err error, fallback string) string {
+	if err != nil {
+		return err.Error()
+	}
+	return fallback
+}
+
+// #######################################################################
+// Load Expressions
+// #######################################################################
+
+// loadFunc evaluates (part of) a load expression for the loads of the
+// sources of a Responder by name.
+type loadFunc func(loads map[string]float64) (float64, error)
+
+// loadExpression is a parsed aggregation expression, along with the names
+// of the sources to which it refers.
+type loadExpression struct {
+	eval    loadFunc
+	sources []string
+}
+
+// loadExpressionFunctions are the functions available to load expressions,
+// each of which takes one or more arguments.
+var loadExpressionFunctions = map[string]func(args []float64) float64{
+	"min": func(args []float64) float64 { return slices.Min(args) },
+	"max": func(args []float64) float64 { return slices.Max(args) },
+	"avg": func(args []float64) (result float64) {
+		for _, arg := range args {
+			result += arg
+		}
+		return result / float64(len(args))
+	},
+}
+
+// exprParser is a recursive descent parser for load expressions.
+type exprParser struct {
+	input   string
+	pos     int
+	sources []string
+}
+
+// parseLoadExpression parses a load expression.
+func parseLoadExpression(text string) (expr *loadExpression, err error) {
+	if len(text) > MaxAggregationExpressionLength {
+		err = errors.New("expression is too long; the maximum is " +
+			strconv.Itoa(MaxAggregationExpressionLength) + " characters")
+		return
+	}
+	p := &exprParser{input: strings.ToLower(text)}
+	eval, err := p.parseSum()
+	if err != nil {
+		return
+	}
+	if p.peek() != 0 {
+		err = p.unexpected()
+		return
+	}
+	expr = &loadExpression{eval: eval, sources: p.sources}
+	return
+}
+
+// peek skips any spaces and returns the next character of the input, or 0
+// at the end of the input.
+func (p *exprParser) peek() byte {
+	for p.pos < len(p.input) && p.input[p.pos] == ' ' {
+		p.pos++
+	}
+	if p.pos >= len(p.input) {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+// unexpected returns an error for the next character of the input.
+func (p *exprParser) unexpected() error {
+	if p.peek() == 0 {
+		return errors.New("unexpected end of expression")
+	}
+	return errors.New("unexpected '" + string(p.input[p.pos]) +
+		"' at position " + strconv.Itoa(p.pos+1))
+}
+
+// parseSum parses terms separated by '+' or '-'.
+func (p *exprParser) parseSum() (fn loadFunc, err error) {
+	fn, err = p.parseProduct()
+	for err == nil && (p.peek() == '+' || p.peek() == '-') {
+		op := p.input[p.pos]
+		p.pos++
+		var rhs loadFunc
+		rhs, err = p.parseProduct()
+		fn = binaryLoadFunc(op, fn, rhs)
+	}
+	return
+}
+
+// parseProduct parses factors separated by '*' or '/'.
+func (p *exprParser) parseProduct() (fn loadFunc, err error) {
+	fn, err = p.parseUnary()
+	for err == nil && (p.peek() == '*' || p.peek() == '/') {
+		op := p.input[p.pos]
+		p.pos++
+		var rhs loadFunc
+		rhs, err = p.parseUnary()
+		fn = binaryLoadFunc(op, fn, rhs)
+	}
+	return
+}
+
+// parseUnary parses a factor, which may be negated.
+func (p *exprParser) parseUnary() (fn loadFunc, err error) {
+	if p.peek() != '-' {
+		return p.parsePrimary()
+	}
+	p.pos++
+	operand, err := p.parseUnary()
+	fn = func(loads map[string]float64) (float64, error) {
+		value, err := operand(loads)
+		return -value, err
+	}
+	return
+}
+
+// parsePrimary parses a number, a source name, a function call or an
+// expression in parentheses.
+func (p *exprParser) parsePrimary() (fn loadFunc, err error) {
+	c := p.peek()
+	switch {
+	case c == '(':
+		p.pos++
+		fn, err = p.parseSum()
+		if err == nil {
+			err = p.expect(')')
+		}
+	case c == '[':
+		p.pos++
+		end := strings.IndexByte(p.input[p.pos:], ']')
+		if end < 0 {
+			err = errors.New("missing ']' after position " +
+				strconv.Itoa(p.pos))
+			return
+		}
+		name := p.input[p.pos : p.pos+end]
+		p.pos += end + 1
+		fn, err = p.sourceLoad(name)
+	case (c >= '0' && c <= '9') || c == '.':
+		start := p.pos
+		for p.pos < len(p.input) && (isExprDigit(p.input[p.pos])) {
+			p.pos++
+		}
+		var value float64
+		value, err = strconv.ParseFloat(p.input[start:p.pos], 64)
+		if err != nil {
+			err = errors.New("invalid number '" + p.input[start:p.pos] + "'")
+			return
+		}
+		fn = func(map[string]float64) (float64, error) { return value, nil }
+	case (c >= 'a' && c <= 'z') || c == '_':
+		start := p.pos
+		for p.pos < len(p.input) && (isExprDigit(p.input[p.pos]) ||
+			(p.input[p.pos] >= 'a' && p.input[p.pos] <= 'z') ||
+			p.input[p.pos] == '_') {
+			p.pos++
+		}
+		name := p.input[start:p.pos]
+		if p.peek() == '(' {
+			fn, err = p.parseCall(name)
+		} else {
+			fn, err = p.sourceLoad(name)
+		}
+	default:
+		err = p.unexpected()
+	}
+	return
+}
+
+// parseCall parses the arguments of a call to a named function.
+func (p *exprParser) parseCall(name string) (fn loadFunc, err error) {
+	function, exists := loadExpressionFunctions[name]
+	if !exists {
+		err = errors.New("unknown function '" + name + "'")
+		return
+	}
+	p.pos++
+	var args []loadFunc
+	for {
+		var arg loadFunc
+		arg, err = p.parseSum()
+		if err != nil {
+			return
+		}
+		args = append(args, arg)
+		if p.peek() != ',' {
+			break
+		}
+		p.pos++
+	}
+	err = p.expect(')')
+	fn = func(loads map[string]float64) (float64, error) {
+		values := make([]float64, len(args))
+		for i, arg := range args {
+			value, err := arg(loads)
+			if err != nil {
+				return 0, err
+			}
+			values[i] = value
+		}
+		return function(values), nil
+	}
+	return
+}
+
+// sourceLoad returns a function giving the load of a named source.
+func (p *exprParser) sourceLoad(name string) (fn loadFunc, err error) {
+	name, err = StandardiseNameIdentifier(name)
+	if err != nil {
+		err = errors.New("source " + err.Error())
+		return
+	}
+	if !slices.Contains(p.sources, name) {
+		p.sources = append(p.sources, name)
+	}
+	fn = func(loads map[string]float64) (float64, error) {
+		load, exists := loads[name]
+		if !exists {
+			return 0, errors.New("no load for source '" + name + "'")
+		}
+		return load, nil
+	}
+	return
+}
+
+// expect consumes the next character of the input, which must be c.
+func (p *exprParser) expect(c byte) (err error) {
+	if p.peek() != c {
+		return p.unexpected()
+	}
+	p.pos++
+	return
+}
+
+// isExprDigit returns whether a character may form part of a number.
+func isExprDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || c == '.'
+}
+
+// binaryLoadFunc returns a function applying an arithmetic operator to the
+// results of two others.
+func binaryLoadFunc(op byte, lhs loadFunc, rhs loadFunc) loadFunc {
+	return func(loads map[string]float64) (result float64, err error) {
+		a, err := lhs(loads)
+		if err != nil {
+			return
+		}
+		b, err := rhs(loads)
+		if err != nil {
+			return
+		}
+		switch op {
+		case '+':
+			result = a + b
+		case '-':
+			result = a - b
+		case '*':
+			result = a * b
+		case '/':
+			if b == 0 {
+				err = errors.New("division by zero")
+				return
+			}
+			result = a / b
+		}
+		return
+	}
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -23,8 +23,16 @@
 package agent
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"maps"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -35,8 +43,18 @@ import (
 // FeedbackAgent via a FeedbackResponder service.
 func (agent *FeedbackAgent) ReceiveAPIRequest(requestJSON string) (
 	responseJSON string, err error, quitAfterResponding bool) {
+	return agent.receiveAPIRequest(requestJSON, false)
+}
+
+// receiveAPIRequest handles an incoming JSON API request, which may be
+// restricted to read-only actions.
+func (agent *FeedbackAgent) receiveAPIRequest(requestJSON string,
+	readOnly bool) (responseJSON string, err error, quitAfterResponding bool) {
 	// Unmarshal into an empty request
 	request, err := UnmarshalAPIRequest(requestJSON)
+	if request != nil {
+		request.readOnly = readOnly
+	}
 	// Get a response object for this request (with or without an error).
 	response, quitAfterResponding := agent.ProcessAPIRequest(request, err)
 	// Marshal the response object into the JSON response.
@@ -67,7 +85,13 @@ func (agent *FeedbackAgent) ValidateAPIRequest(request *APIRequest) (errID strin
 		request.TargetName == "" {
 		errID = "missing-target"
 		errMsg = "no target service name specified"
-	} else if request.APIKey == "" || request.APIKey != agent.APIKey {
+	} else if request.APIKey == "" || request.APIKey != agent.apiKey {
+		// Keys for a namespace grant access only to its own services.
+		namespace, exists := agent.GetNamespaceForKey(request.APIKey)
+		if exists {
+			request.namespace = namespace
+			return
+		}
 		//logrus.Debug("api key mismatch: request = '" + request.APIKey + "', agent = '" + agent.APIKey + "'")
 		errID = "bad-api-key"
 		errMsg = "invalid or missing API key"
@@ -104,11 +128,28 @@ func (agent *FeedbackAgent) ProcessAPIRequest(request *APIRequest, parseErr erro
 	}
 	request.Type = strings.TrimSpace(request.Type)
 	request.Action = strings.TrimSpace(request.Action)
-	request.TargetName = strings.TrimSpace(request.TargetName)
+	// Service names are not case-sensitive, so are always handled in the
+	// standard lower case form.
+	request.TargetName = strings.ToLower(strings.TrimSpace(request.TargetName))
 	response.Error, response.Message = agent.ValidateAPIRequest(request)
 	if response.Error != "" {
 		return
 	}
+	span := agent.startSpan("api "+request.Action, otelSpanKindServer)
+	defer func() {
+		if request.Type != "" {
+			span.setAttribute("lbfeedback.api.type", request.Type)
+		}
+		if request.TargetName != "" {
+			span.setAttribute("lbfeedback.api.target", request.TargetName)
+		}
+		span.setAttribute("lbfeedback.api.request", response.Tag)
+		var err error
+		if !response.Success {
+			err = errors.New(response.Error)
+		}
+		span.end(err)
+	}()
 	// -- The main API command tree.
 	// This default error will be overridden by nil or another error
 	// if a matching part of the tree is reached.
@@ -120,29 +161,44 @@ func (agent *FeedbackAgent) ProcessAPIRequest(request *APIRequest, parseErr erro
 		err = errors.New("invalid action type '" + request.Type + "'")
 	}
 	// Handle any unsaved changes after the API tree.
+	configChanged := agent.unsavedChanges
 	if agent.unsavedChanges {
-		saveSuccess, saveErr := agent.SaveAgentConfigToPaths()
+		saveSuccess, saveErr := agent.SaveRuntimeChanges()
 		if saveSuccess {
 			logrus.Info("Agent configuration successfully saved.")
-		} else {
+		} else if saveErr != nil {
 			logrus.Error("Failed to save agent configuration.")
 		}
 		err = errors.Join(err, saveErr)
 	}
+	response.ConfigDiverged = agent.IsConfigDiverged()
 	apiLogHead := "API request #" + response.Tag + " "
+	apiLogger := logrus.WithFields(logrus.Fields{
+		LogFieldAction:  request.Action,
+		LogFieldType:    request.Type,
+		LogFieldTarget:  request.TargetName,
+		LogFieldRequest: response.Tag,
+	})
 	// Handle any errors that have occurred.
 	if err != nil {
 		response.Error = "api-error"
 		response.Message += "failed: " + desc + ": " + err.Error()
 		if !suppressLog {
-			logrus.Error(apiLogHead + response.Message)
+			apiLogger.Error(apiLogHead + response.Message)
 		}
 	} else {
 		// The request was successful if no errors occurred.
 		response.Success = true
 		response.Message += "succeeded: " + desc
+		applyResponseETag(request, response)
 		if !suppressLog {
-			logrus.Info(apiLogHead + response.Message)
+			apiLogger.Info(apiLogHead + response.Message)
+		}
+		// Changes to the services are replicated to any cluster peers.
+		if configChanged {
+			agent.recordConfigChange("Configuration changed by " +
+				apiLogHead + "(" + desc + ").")
+			agent.replicateRequest(request)
 		}
 	}
 	// Hide API key in confirmation of request to the client
@@ -152,6 +208,20 @@ func (agent *FeedbackAgent) ProcessAPIRequest(request *APIRequest, parseErr erro
 
 func (agent *FeedbackAgent) apiActionTree(request *APIRequest, response *APIResponse) (
 	unknownType bool, suppressLog bool, quitAfterResponding bool, err error) {
+	err = authoriseReadOnlyRequest(request)
+	if err != nil {
+		return
+	}
+	if request.namespace != "" {
+		err = agent.authoriseNamespaceRequest(request)
+		if err != nil {
+			return
+		}
+	}
+	err = agent.authoriseDisabledAction(request)
+	if err != nil {
+		return
+	}
 	switch request.Action {
 	// Service actions
 	case "add", "edit", "delete", "start", "restart", "stop":
@@ -167,6 +237,28 @@ func (agent *FeedbackAgent) apiActionTree(request *APIRequest, response *APIResp
 			err = agent.APIHandleResponderRequest(request)
 		case "source":
 			err = agent.APIHandleSourceRequest(request)
+		case "analysis":
+			switch request.Action {
+			case "start":
+				err = agent.APIHandleStartAnalysis(request)
+			case "stop":
+				err = agent.StopSignificanceAnalysis(request.TargetName)
+			default:
+				unknownType = true
+			}
+		case "flap-test":
+			switch request.Action {
+			case "start":
+				err = agent.APIHandleStartFlapTest(request)
+			case "stop":
+				var res *FeedbackResponder
+				res, err = agent.GetResponderByName(request.TargetName)
+				if err == nil {
+					err = res.StopFlapTest()
+				}
+			default:
+				unknownType = true
+			}
 		case "agent":
 			switch request.Action {
 			case "restart":
@@ -179,13 +271,63 @@ func (agent *FeedbackAgent) apiActionTree(request *APIRequest, response *APIResp
 		default:
 			unknownType = true
 		}
+	case "upsert":
+		request.TargetName = strings.TrimSpace(request.TargetName)
+		if request.TargetName == "" {
+			err = errors.New("no target name specified")
+			return
+		}
+		switch request.Type {
+		case "monitor", "responder", "source":
+			response.UpsertResult, err = agent.APIHandleUpsert(request)
+			response.Output = response.UpsertResult
+		default:
+			unknownType = true
+		}
+	case "apply":
+		switch request.Type {
+		case ApplyTypeRequests:
+			response.BatchResults, err = agent.APIHandleApplyRequests(request)
+			if err == nil {
+				response.Output = strconv.Itoa(len(request.Requests)) +
+					" requests applied"
+			}
+		case ApplyTypeConfig:
+			var summary ReloadSummary
+			response.BatchResults, summary, err =
+				agent.APIHandleApplyConfig(request)
+			if err == nil {
+				response.Output = "services: " + summary.String()
+			}
+		default:
+			unknownType = true
+		}
+	case "put":
+		switch request.Type {
+		case "config":
+			var summary ReloadSummary
+			response.Changes, summary, err = agent.APIHandlePutConfig(request)
+			if err == nil && len(response.Changes) == 0 {
+				response.Output = "no changes"
+			} else if err == nil {
+				response.Output = strconv.Itoa(len(response.Changes)) +
+					" changes; services: " + summary.String()
+			}
+		default:
+			unknownType = true
+		}
 	case "status":
-		response.ServiceStatus = agent.GetServiceStatusArray()
+		response.ServiceStatus = agent.GetServiceStatusArray(request.namespace)
 		suppressLog = true
 	case "get":
 		switch request.Type {
 		case "config":
-			config := agent.APIHandleGetConfig()
+			var config FeedbackAgent
+			if request.namespace != "" {
+				config = agent.GetNamespaceConfig(request.namespace)
+			} else {
+				config = agent.APIHandleGetConfig()
+			}
 			response.AgentConfig = &config
 			suppressLog = true
 		case "feedback":
@@ -196,42 +338,167 @@ func (agent *FeedbackAgent) apiActionTree(request *APIRequest, response *APIResp
 			response.FeedbackSources, err =
 				agent.APIHandleGetSources(request)
 			suppressLog = true
+		case "info":
+			response.AgentInfo = agent.APIHandleGetInfo()
+			suppressLog = true
+		case "stats":
+			response.Stats = agent.GetAgentStats()
+			suppressLog = true
+		case "cluster":
+			response.Cluster, err = agent.GetClusterStatus()
+			suppressLog = true
+		case "headroom":
+			response.Headroom, err =
+				agent.GetHeadroomReports(request.TargetName, request.namespace)
+			suppressLog = true
+		case "events":
+			response.Events, err = agent.APIHandleGetEvents(request)
+			suppressLog = true
+		case "overrides":
+			response.Overrides, err = agent.APIHandleGetOverrides(
+				request.TargetName, request.namespace)
+			suppressLog = true
+		case "history":
+			response.History, response.Output, response.Image, err =
+				agent.APIHandleGetHistory(request)
+			suppressLog = true
+		case "simulate":
+			response.Simulation, err = agent.APIHandleSimulate(request)
+			suppressLog = true
+		case "analysis":
+			if request.TargetName == "" {
+				err = errors.New("no target name specified")
+				return
+			}
+			response.Analysis, err =
+				agent.GetSignificanceReport(request.TargetName)
+			suppressLog = true
 		default:
 			unknownType = true
 		}
 	case "set":
 		switch request.Type {
 		case "commands", "cmd":
-			err = agent.APIHandleSetCommands(request, true)
+			response.Output, err = agent.APIHandleSetCommands(request, true)
 		case "threshold":
 			err = agent.APIHandleSetThreshold(request)
+		case "log-level":
+			err = agent.APIHandleSetLogLevel(request)
+		default:
+			unknownType = true
+		}
+	case "reload":
+		switch request.Type {
+		case "config":
+			var summary ReloadSummary
+			summary, err = agent.ReloadConfig()
+			if err == nil {
+				response.Output = "services: " + summary.String()
+			}
+		default:
+			unknownType = true
+		}
+	case "rollback":
+		switch request.Type {
+		case "config":
+			var restored string
+			restored, err = agent.RollbackConfig()
+			if restored != "" {
+				response.Output = "restored backup '" + path.Base(restored) + "'"
+			}
+		default:
+			unknownType = true
+		}
+	case "export":
+		switch request.Type {
+		case "profile":
+			response.Profile, err = agent.ExportTuningProfile(request.TargetName)
+			suppressLog = true
+		case "bundle":
+			// A bundle may hold the API key, so is never exported through
+			// the legacy API.
+			if request.readOnly {
+				err = errors.New("bundles cannot be exported through the " +
+					"legacy API")
+				return
+			}
+			response.Bundle, err = agent.ExportBundle(
+				request.ExcludeKey != nil && *request.ExcludeKey,
+				request.IncludeModel != nil && *request.IncludeModel)
+		default:
+			unknownType = true
+		}
+	case "import":
+		switch request.Type {
+		case "profile":
+			if len(request.Config) == 0 {
+				err = errors.New("no tuning profile specified")
+				return
+			}
+			var summary ReloadSummary
+			summary, err = agent.ImportTuningProfile(request.Config)
+			if err == nil {
+				response.Output = "services: " + summary.String()
+			}
+		case "bundle":
+			if len(request.Bundle) == 0 {
+				err = errors.New("no bundle specified")
+				return
+			}
+			var summary ReloadSummary
+			var newKey string
+			response.Changes, summary, newKey, err = agent.ImportBundle(
+				request.Bundle,
+				request.RegenerateKey != nil && *request.RegenerateKey)
+			if err == nil {
+				response.Output = strconv.Itoa(len(response.Changes)) +
+					" changes; services: " + summary.String()
+				if newKey != "" {
+					response.Output += "; new API key: " + newKey
+				}
+			}
+		default:
+			unknownType = true
+		}
+	case "validate":
+		switch request.Type {
+		case "config":
+			response.Validation, err = agent.APIHandleValidateConfig(request)
+			suppressLog = true
 		default:
 			unknownType = true
 		}
 	case "send":
 		switch request.Type {
 		case "online":
-			err = agent.APIHandleSetOnlineState(request.TargetName,
-				true, HAPEnumNone)
+			err = agent.APIHandleSetOnlineState(request, true, HAPEnumNone)
 		case "offline":
-			err = agent.APIHandleSetOnlineState(request.TargetName,
-				false, HAPEnumNone)
+			err = agent.APIHandleSetOnlineState(request, false, HAPEnumNone)
 		default:
 			unknownType = true
 		}
 	case "force":
 		switch request.Type {
 		case "halt", "maint":
-			err = agent.APIHandleSetOnlineState(request.TargetName,
-				false, HAPEnumMaintenance)
+			err = agent.APIHandleSetOnlineState(request, false, HAPEnumMaintenance)
 		case "drain":
-			err = agent.APIHandleSetOnlineState(request.TargetName,
-				false, HAPEnumDrain)
+			err = agent.APIHandleSetOnlineState(request, false, HAPEnumDrain)
 		case "online":
-			err = agent.APIHandleSetOnlineState(request.TargetName,
-				true, HAPDefaultOnline)
+			err = agent.APIHandleSetOnlineState(request, true, HAPDefaultOnline)
 		case "save-config":
-			agent.unsavedChanges = true
+			// Save even if the config file has been modified externally.
+			_, err = agent.SaveAgentConfigToPaths()
+			if err == nil {
+				logrus.Info("Agent configuration successfully saved.")
+			}
+		default:
+			unknownType = true
+		}
+	case "cancel":
+		switch request.Type {
+		case "override":
+			response.Output, err = agent.APIHandleCancelOverride(
+				request.TargetName, request.namespace)
 		default:
 			unknownType = true
 		}
@@ -241,6 +508,58 @@ func (agent *FeedbackAgent) apiActionTree(request *APIRequest, response *APIResp
 	return
 }
 
+// applyResponseETag sets an entity tag on a response containing the agent
+// configuration or service status, so that clients polling for changes can
+// detect that nothing has changed. If the tag matches that given in the
+// request, the content itself is omitted from the response. The tag of the
+// service status reflects the state of each service, but not its ever
+// changing connection counters or the times of its last sample or
+// response.
+func applyResponseETag(request *APIRequest, response *APIResponse) {
+	var content any
+	switch {
+	case response.AgentConfig != nil:
+		content = response.AgentConfig
+	case response.ServiceStatus != nil:
+		states := make([]APIServiceStatus, len(response.ServiceStatus))
+		for i, status := range response.ServiceStatus {
+			status.Connections = nil
+			status.LastSample = nil
+			status.LastResponse = nil
+			states[i] = status
+		}
+		sort.Slice(states, func(i, j int) bool {
+			if states[i].ServiceType != states[j].ServiceType {
+				return states[i].ServiceType < states[j].ServiceType
+			}
+			return states[i].ServiceName < states[j].ServiceName
+		})
+		content = states
+	default:
+		return
+	}
+	data, err := json.Marshal(content)
+	if err != nil {
+		return
+	}
+	hash := sha256.Sum256(data)
+	digest := hex.EncodeToString(hash[:16])
+	response.ETag = "\"" + digest + "\""
+	if request.IfNoneMatch == nil {
+		return
+	}
+	// Tags are accepted with or without quotes, for ease of use.
+	for _, tag := range strings.Split(*request.IfNoneMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if strings.Trim(tag, "\"") == digest || tag == "*" {
+			response.NotModified = true
+			response.AgentConfig = nil
+			response.ServiceStatus = nil
+			return
+		}
+	}
+}
+
 func (agent *FeedbackAgent) APIHandleGetConfig() (config FeedbackAgent) {
 	// Shallow-copy the fields from the agent first to avoid overwriting them.
 	config = *agent
@@ -249,20 +568,74 @@ func (agent *FeedbackAgent) APIHandleGetConfig() (config FeedbackAgent) {
 	// Remove duplicated service name and version
 	config.ServiceName = ""
 	config.Version = ""
+	// Hide the API keys of any namespaces, keeping only their names.
+	if agent.Namespaces != nil {
+		config.Namespaces = make(map[string]*Namespace)
+		for name := range agent.Namespaces {
+			config.Namespaces[name] = &Namespace{}
+		}
+	}
+	return
+}
+
+// APIHandleGetInfo gathers the build and runtime details of this agent.
+func (agent *FeedbackAgent) APIHandleGetInfo() (info *APIAgentInfo) {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	uptime := time.Since(agent.startTime).Truncate(time.Second)
+	info = &APIAgentInfo{
+		Version:       VersionString,
+		GoVersion:     runtime.Version(),
+		Platform:      runtime.GOOS + "/" + runtime.GOARCH,
+		ProcessID:     os.Getpid(),
+		StartTime:     agent.startTime,
+		Uptime:        uptime.String(),
+		UptimeSeconds: int64(uptime.Seconds()),
+		ConfigPath:    path.Join(agent.configDir, ConfigFileName),
+		Goroutines:    runtime.NumGoroutine(),
+		MemoryAlloc:   memStats.Alloc,
+		MemorySys:     memStats.Sys,
+		GCCycles:      memStats.NumGC,
+	}
+	info.BuildCommit, info.CommitTime = GetBuildRevision()
+	stat, err := os.Stat(info.ConfigPath)
+	if err == nil {
+		modified := stat.ModTime()
+		info.ConfigModified = &modified
+	}
 	return
 }
 
-// GetServiceStatusArray builds an array of the service status.
-func (agent *FeedbackAgent) GetServiceStatusArray() (array []APIServiceStatus) {
+// GetServiceStatusArray builds an array of the service status, limited to
+// the services within a namespace if one is specified.
+func (agent *FeedbackAgent) GetServiceStatusArray(namespace string) (
+	array []APIServiceStatus) {
 	// Report status of responders
 	for name, responder := range agent.Responders {
+		if namespace != "" && responder.Namespace != namespace {
+			continue
+		}
 		array = AppendToStatusArray(array, "responder", name,
 			ServiceRunningToString(responder.runState))
+		stats := responder.GetConnectionStats()
+		array[len(array)-1].Connections = &stats
+		array[len(array)-1].Port = responder.GetActivePort()
+		array[len(array)-1].Namespace = responder.Namespace
+		responder.fillServiceStatus(&array[len(array)-1])
+		array[len(array)-1].Supervisor =
+			agent.supervisor.status(LogFieldResponder, name)
 	}
 	// Report status of monitors
 	for name, monitor := range agent.Monitors {
+		if namespace != "" && monitor.Namespace != namespace {
+			continue
+		}
 		array = AppendToStatusArray(array, "monitor", name,
 			ServiceRunningToString(monitor.runState))
+		array[len(array)-1].Namespace = monitor.Namespace
+		monitor.fillServiceStatus(&array[len(array)-1])
+		array[len(array)-1].Supervisor =
+			agent.supervisor.status(LogFieldMonitor, name)
 	}
 	return
 }
@@ -348,6 +721,38 @@ func (agent *FeedbackAgent) APIAddMonitor(request *APIRequest) (err error) {
 	if err != nil {
 		return
 	}
+	mon := agent.Monitors[request.TargetName]
+	mon.Namespace, err = agent.getRequestNamespace(request)
+	if err != nil {
+		deleteErr := agent.DeleteMonitorByName(request.TargetName)
+		err = errors.Join(err, deleteErr)
+		return
+	}
+	if request.AnomalyZScore != nil || request.HistorySize != nil ||
+		request.HistoryRetain != nil || request.FailurePolicy != nil ||
+		request.StaleAfter != nil {
+		if request.AnomalyZScore != nil {
+			mon.AnomalyZScore = *request.AnomalyZScore
+		}
+		if request.HistorySize != nil {
+			mon.HistorySize = *request.HistorySize
+		}
+		if request.HistoryRetain != nil {
+			mon.HistoryAge = *request.HistoryRetain
+		}
+		if request.FailurePolicy != nil {
+			mon.FailurePolicy = *request.FailurePolicy
+		}
+		if request.StaleAfter != nil {
+			mon.StaleAfter = *request.StaleAfter
+		}
+		err = mon.Initialise()
+		if err != nil {
+			deleteErr := agent.DeleteMonitorByName(request.TargetName)
+			err = errors.Join(err, deleteErr)
+			return
+		}
+	}
 	// Attempt to start the new monitor.
 	err = agent.StartMonitorByName(request.TargetName)
 	// If this failed, remove the new monitor and concatenate the errors.
@@ -367,19 +772,25 @@ func (agent *FeedbackAgent) APIAddResponder(request *APIRequest) (err error) {
 		err = errors.New("protocol not specified")
 		return
 	}
+	// A virtual responder shares the listener of another, so needs no
+	// address of its own; this is cleared once its listener is set.
 	ipAddress := ""
 	if request.ListenIPAddress != nil {
 		ipAddress = *request.ListenIPAddress
-	} else {
+	} else if request.Listener == nil {
 		err = errors.New("IP address not specified")
 		return
+	} else {
+		ipAddress = "*"
 	}
 	listenPort := ""
 	if request.ListenPort != nil {
 		listenPort = *request.ListenPort
-	} else {
+	} else if request.Listener == nil {
 		err = errors.New("listen port not specified")
 		return
+	} else {
+		listenPort = "0"
 	}
 	hapThreshold := 0
 	if request.ThresholdScore != nil {
@@ -397,6 +808,18 @@ func (agent *FeedbackAgent) APIAddResponder(request *APIRequest) (err error) {
 	if request.LogStateChanges != nil {
 		logStateChanges = *request.LogStateChanges
 	}
+	var allowedCIDRs []string
+	if request.AllowedCIDRs != nil {
+		allowedCIDRs = *request.AllowedCIDRs
+	}
+	maxConnections := 0
+	if request.MaxConnections != nil {
+		maxConnections = *request.MaxConnections
+	}
+	maxRequestRate := 0
+	if request.MaxRequestRate != nil {
+		maxRequestRate = *request.MaxRequestRate
+	}
 	// Try to add this as a new [FeedbackResponder]. The AddResponder() function will
 	// look for and find the object for the [SystemMonitor] if it exists.
 	err = agent.AddResponder(
@@ -409,14 +832,39 @@ func (agent *FeedbackAgent) APIAddResponder(request *APIRequest) (err error) {
 		thresholdMode,
 		hapThreshold,
 		logStateChanges,
+		allowedCIDRs,
+		maxConnections,
+		maxRequestRate,
 	)
 	// If we couldn't add the responder (e.g. because the monitor doesn't exist),
 	// fail out to an error.
 	if err != nil {
 		return
 	}
-	// Attempt to start the new responder.
-	err = agent.StartResponderByName(request.TargetName)
+	// Apply the optional settings of the request and validate the
+	// responder again with these, removing it if they are invalid.
+	responder := agent.Responders[request.TargetName]
+	err = responder.applyAddRequest(request)
+	if err == nil {
+		err = responder.Initialise()
+	}
+	if err == nil && request.Listener != nil {
+		err = agent.checkListener(responder)
+	}
+	if err == nil {
+		responder.Namespace, err = agent.getRequestNamespace(request)
+	}
+	if err != nil {
+		deleteErr := agent.DeleteResponderByName(request.TargetName)
+		err = errors.Join(err, deleteErr)
+		return
+	}
+	// Attempt to start the new responder, unless it would collide with the
+	// listen address of another.
+	err = responder.checkListenCollision(agent.Responders)
+	if err == nil {
+		err = agent.StartResponderByName(request.TargetName)
+	}
 	// If this failed, remove the new responder and concatenate the errors.
 	if err != nil {
 		deleteErr := agent.DeleteResponderByName(request.TargetName)
@@ -427,18 +875,68 @@ func (agent *FeedbackAgent) APIAddResponder(request *APIRequest) (err error) {
 	return
 }
 
-func (agent *FeedbackAgent) APIEditMonitor(request *APIRequest) (err error) {
+// applyAddRequest sets the optional settings given in a request to add
+// this FeedbackResponder, which must then be validated by Initialise().
+func (fbr *FeedbackResponder) applyAddRequest(request *APIRequest) (
+	err error) {
+	if request.CacheFeedback != nil {
+		fbr.CacheFeedback = *request.CacheFeedback
+	}
+	if request.KeepAlive != nil {
+		fbr.KeepAlive = *request.KeepAlive
+	}
+	if request.ReusePort != nil {
+		fbr.ReusePort = *request.ReusePort
+	}
+	if request.FeedbackFormat != nil {
+		fbr.FeedbackFormat = *request.FeedbackFormat
+	}
+	if request.ResponseTemplate != nil {
+		fbr.ResponseTemplate = *request.ResponseTemplate
+	}
+	if request.StatusCodes != nil {
+		fbr.StatusCodes = *request.StatusCodes
+	}
+	fbr.setAggregation(request.Aggregation, request.AggregationExpr)
+	fbr.setWeightCurve(request.WeightCurve, request.WeightCurveFactor,
+		request.WeightPoints)
+	if request.MinWeight != nil {
+		fbr.MinWeight = *request.MinWeight
+	}
+	if request.MaxWeight != nil {
+		fbr.MaxWeight = *request.MaxWeight
+	}
+	if request.DrainMonitor != nil {
+		fbr.DrainMonitor = *request.DrainMonitor
+	}
+	if request.Routes != nil {
+		fbr.Routes = *request.Routes
+	}
+	fbr.setAccessLog(request)
+	if request.Listener != nil {
+		fbr.setVirtual(request)
+	}
+	if request.SNMP != nil {
+		fbr.SNMP = request.SNMP
+	}
+	err = fbr.setTimeouts(request)
+	return
+}
+
+func (agent *FeedbackAgent) APIEditMonitor(request *APIRequest) (
+	changed bool, err error) {
 	name := request.TargetName
 	// Fetch the monitor this request refers to (if any, otherwise error).
 	oldMonitor, err := agent.GetMonitorByName(name)
 	if err != nil {
 		return
 	}
-	changed := false
 	valid := false
 
-	// Copy the old monitor so that we can apply the changes to it.
+	// Copy the old monitor so that we can apply the changes to it, along
+	// with its parameters, which would otherwise be shared.
 	newMonitor := oldMonitor.Copy()
+	newMonitor.Params = maps.Clone(oldMonitor.Params)
 
 	// Handle any changes to the metric type.
 	if request.MetricType != nil {
@@ -467,8 +965,13 @@ func (agent *FeedbackAgent) APIEditMonitor(request *APIRequest) (err error) {
 			value = strings.TrimSpace(value)
 			if key != "" && value != "" {
 				valid = true
-				newMonitor.Params[key] = value
-				changed = true
+				if newMonitor.Params == nil {
+					newMonitor.Params = make(MetricParams)
+				}
+				if newMonitor.Params[key] != value {
+					newMonitor.Params[key] = value
+					changed = true
+				}
 			}
 		}
 	}
@@ -480,6 +983,55 @@ func (agent *FeedbackAgent) APIEditMonitor(request *APIRequest) (err error) {
 			changed = true
 		}
 	}
+	if request.AnomalyZScore != nil {
+		valid = true
+		if *request.AnomalyZScore != oldMonitor.AnomalyZScore {
+			newMonitor.AnomalyZScore = *request.AnomalyZScore
+			changed = true
+		}
+	}
+	if request.HistorySize != nil {
+		valid = true
+		if *request.HistorySize != oldMonitor.HistorySize {
+			newMonitor.HistorySize = *request.HistorySize
+			changed = true
+		}
+	}
+	if request.HistoryRetain != nil {
+		valid = true
+		if *request.HistoryRetain != oldMonitor.HistoryAge {
+			newMonitor.HistoryAge = *request.HistoryRetain
+			changed = true
+		}
+	}
+	if request.FailurePolicy != nil {
+		valid = true
+		newMonitor.FailurePolicy, err = ParseFailurePolicy(
+			*request.FailurePolicy)
+		if err != nil {
+			return
+		}
+		if newMonitor.FailurePolicy != oldMonitor.FailurePolicy {
+			changed = true
+		}
+	}
+	if request.StaleAfter != nil {
+		valid = true
+		if *request.StaleAfter != oldMonitor.StaleAfter {
+			newMonitor.StaleAfter = *request.StaleAfter
+			changed = true
+		}
+	}
+	if request.Namespace != nil {
+		valid = true
+		newMonitor.Namespace, err = agent.getRequestNamespace(request)
+		if err != nil {
+			return
+		}
+		if newMonitor.Namespace != oldMonitor.Namespace {
+			changed = true
+		}
+	}
 	if !changed {
 		if !valid {
 			err = errors.New("no valid fields to change specified")
@@ -491,8 +1043,14 @@ func (agent *FeedbackAgent) APIEditMonitor(request *APIRequest) (err error) {
 	if err != nil {
 		return
 	}
+	// Changes which are normalised away by initialisation (e.g. setting
+	// a parameter to its default) leave the running monitor untouched.
+	if sameServiceConfig(oldMonitor, &newMonitor) {
+		changed = false
+		return
+	}
 	// This is valid, so replace it in the list of monitors.
-	agent.Monitors[request.TargetName] = &newMonitor
+	agent.setMonitor(request.TargetName, &newMonitor)
 	// Preserve the current run state during the swap.
 	wasRunning := oldMonitor.IsRunning()
 	if wasRunning {
@@ -516,7 +1074,8 @@ func (agent *FeedbackAgent) APIEditMonitor(request *APIRequest) (err error) {
 	return
 }
 
-func (agent *FeedbackAgent) APIEditResponder(request *APIRequest) (err error) {
+func (agent *FeedbackAgent) APIEditResponder(request *APIRequest) (
+	changed bool, err error) {
 	// Fetch the responder that this pertains to (otherwise, return the error).
 	oldResponder, err := agent.GetResponderByName(request.TargetName)
 	if err != nil {
@@ -541,11 +1100,9 @@ func (agent *FeedbackAgent) APIEditResponder(request *APIRequest) (err error) {
 	if request.ListenPort != nil {
 		newResponder.ListenPort = *request.ListenPort
 	}
-	if request.RequestTimeout != nil {
-		newResponder.RequestTimeout = time.Duration(*request.RequestTimeout)
-	}
-	if request.ResponseTimeout != nil {
-		newResponder.ResponseTimeout = time.Duration(*request.ResponseTimeout)
+	err = newResponder.setTimeouts(request)
+	if err != nil {
+		return
 	}
 	if request.ThresholdMode != nil {
 		newResponder.ThresholdModeName = *request.ThresholdMode
@@ -553,28 +1110,88 @@ func (agent *FeedbackAgent) APIEditResponder(request *APIRequest) (err error) {
 	if request.ThresholdScore != nil {
 		newResponder.ThresholdScore = *request.ThresholdScore
 	}
+	if request.ThresholdSchedule != nil {
+		newResponder.ThresholdSchedule = *request.ThresholdSchedule
+	}
 	if request.FeedbackSources != nil {
 		newResponder.FeedbackSources = *request.FeedbackSources
 	}
 	if request.LogStateChanges != nil {
 		newResponder.LogStateChanges = *request.LogStateChanges
 	}
+	if request.AllowedCIDRs != nil {
+		newResponder.AllowedCIDRs = *request.AllowedCIDRs
+	}
+	if request.MaxConnections != nil {
+		newResponder.MaxConnections = *request.MaxConnections
+	}
+	if request.MaxRequestRate != nil {
+		newResponder.MaxRequestRate = *request.MaxRequestRate
+	}
+	if request.CacheFeedback != nil {
+		newResponder.CacheFeedback = *request.CacheFeedback
+	}
+	if request.KeepAlive != nil {
+		newResponder.KeepAlive = *request.KeepAlive
+	}
+	if request.ReusePort != nil {
+		newResponder.ReusePort = *request.ReusePort
+	}
+	if request.FeedbackFormat != nil {
+		newResponder.FeedbackFormat = *request.FeedbackFormat
+	}
+	if request.ResponseTemplate != nil {
+		newResponder.ResponseTemplate = *request.ResponseTemplate
+	}
+	if request.StatusCodes != nil {
+		newResponder.StatusCodes = *request.StatusCodes
+	}
+	if request.Routes != nil {
+		newResponder.Routes = *request.Routes
+	}
+	newResponder.setVirtual(request)
+	newResponder.setAccessLog(request)
+	newResponder.setAggregation(request.Aggregation, request.AggregationExpr)
+	newResponder.setWeightCurve(request.WeightCurve, request.WeightCurveFactor,
+		request.WeightPoints)
+	if request.MinWeight != nil {
+		newResponder.MinWeight = *request.MinWeight
+	}
+	if request.MaxWeight != nil {
+		newResponder.MaxWeight = *request.MaxWeight
+	}
+	if request.DrainMonitor != nil {
+		newResponder.DrainMonitor = *request.DrainMonitor
+	}
+	if request.SNMP != nil {
+		newResponder.SNMP = mergeSNMPConfig(newResponder.SNMP, request.SNMP)
+	}
+	if request.Namespace != nil {
+		newResponder.Namespace, err = agent.getRequestNamespace(request)
+		if err != nil {
+			return
+		}
+	}
 	// Attempt to initialise the new responder to validate it, else error.
 	err = newResponder.Initialise()
 	if err != nil {
 		return
 	}
-	// This is valid, so replace it in the list of monitors.
-	agent.Responders[request.TargetName] = &newResponder
-	// Preserve the current run state during the swap.
-	wasRunning := oldResponder.IsRunning()
-	if wasRunning {
-		err = oldResponder.Stop()
-		if err != nil {
-			return
-		}
-		err = newResponder.Start()
+	err = agent.checkListener(&newResponder)
+	if err == nil {
+		err = newResponder.checkListenCollision(agent.Responders)
+	}
+	if err != nil {
+		return
+	}
+	// If nothing has changed, leave the running responder untouched.
+	if sameServiceConfig(oldResponder, &newResponder) {
+		return
 	}
+	changed = true
+	// This is valid, so replace it in the list of responders.
+	err = agent.replaceResponder(request.TargetName, oldResponder,
+		&newResponder)
 	if err != nil {
 		return
 	}
@@ -588,6 +1205,13 @@ func (agent *FeedbackAgent) APIDeleteResponder(request *APIRequest) (
 		err = errors.New("cannot delete the API Responder")
 		return
 	}
+	name := strings.ToLower(strings.TrimSpace(request.TargetName))
+	if virtuals := agent.virtualResponders(name); len(virtuals) > 0 {
+		err = errors.New("responder '" + name + "' cannot be deleted, as " +
+			"its listener is shared by '" + strings.Join(virtuals, "', '") +
+			"'")
+		return
+	}
 	err = agent.DeleteResponderByName(request.TargetName)
 	return
 }
@@ -604,7 +1228,7 @@ func (agent *FeedbackAgent) APIDeleteMonitor(request *APIRequest) (
 	// fail if any currently in use.
 	for _, responder := range agent.Responders {
 		_, exists := responder.FeedbackSources[name]
-		if exists {
+		if exists || responder.DrainMonitor == name {
 			err = errors.New("cannot delete monitor '" + name +
 				"': currently in use by responder '" +
 				responder.ResponderName)
@@ -639,7 +1263,7 @@ func (agent *FeedbackAgent) APIHandleResponderRequest(request *APIRequest) (
 	}
 	switch request.Action {
 	case "edit":
-		err = agent.APIEditResponder(request)
+		_, err = agent.APIEditResponder(request)
 	case "delete":
 		err = agent.APIDeleteResponder(request)
 	case "start":
@@ -647,7 +1271,7 @@ func (agent *FeedbackAgent) APIHandleResponderRequest(request *APIRequest) (
 	case "stop":
 		err = res.Stop()
 	case "restart":
-		err = res.Restart()
+		err = agent.restartResponder(request.TargetName, res)
 	default:
 		err = errors.New("unknown action '" + request.Action + "'")
 	}
@@ -666,8 +1290,7 @@ func (agent *FeedbackAgent) APIHandleMonitorRequest(request *APIRequest) (
 	}
 	switch request.Action {
 	case "edit":
-
-		err = agent.APIEditMonitor(request)
+		_, err = agent.APIEditMonitor(request)
 	case "delete":
 		err = agent.APIDeleteMonitor(request)
 	case "start":
@@ -696,11 +1319,13 @@ func (agent *FeedbackAgent) APIHandleSourceRequest(request *APIRequest) (
 	case "add":
 		err = res.AddFeedbackSource(*request.SourceMonitorName,
 			request.SourceSignificance, request.SourceMaxValue,
-			request.ThresholdScore)
+			request.ThresholdScore, request.SourceRawThreshold,
+			request.SourceAction)
 	case "edit":
-		err = res.EditFeedbackSource(*request.SourceMonitorName,
+		_, err = res.EditFeedbackSource(*request.SourceMonitorName,
 			request.SourceSignificance, request.SourceMaxValue,
-			request.ThresholdScore)
+			request.ThresholdScore, request.SourceRawThreshold,
+			request.SourceAction)
 	case "delete":
 		err = res.DeleteFeedbackSource(*request.SourceMonitorName)
 	default:
@@ -731,26 +1356,144 @@ func (agent *FeedbackAgent) APIHandleGetFeedback(request *APIRequest) (
 	return
 }
 
-func (agent *FeedbackAgent) APIHandleSetOnlineState(name string,
+// APIHandleSetOnlineState forces a command state on a Responder, or on all
+// Responders (within a namespace, if given) if no name is given, which
+// expires after a duration if one is given in the request.
+func (agent *FeedbackAgent) APIHandleSetOnlineState(request *APIRequest,
 	isOnline bool, commandMask int) (err error) {
+	duration := time.Duration(0)
+	if request.Duration != nil {
+		duration, err = ParseOverrideDuration(*request.Duration)
+		if err != nil {
+			return
+		}
+	}
+	targets, err := agent.selectResponders(request.TargetName,
+		request.namespace)
+	if err != nil {
+		return
+	}
+	for _, res := range targets {
+		res.ForceCommandState(isOnline, commandMask, duration)
+	}
+	return
+}
+
+// selectResponders returns the Responder with a name, or all Responders
+// (within a namespace, if given) if no name is given.
+func (agent *FeedbackAgent) selectResponders(name string, namespace string) (
+	targets map[string]*FeedbackResponder, err error) {
 	name = strings.TrimSpace(name)
-	targets := make(map[string]*FeedbackResponder)
+	targets = make(map[string]*FeedbackResponder)
 	if name == "" {
-		targets = agent.Responders
-	} else {
-		var res *FeedbackResponder
-		res, err = agent.GetResponderByName(name)
+		for name, res := range agent.Responders {
+			if namespace == "" || res.Namespace == namespace {
+				targets[name] = res
+			}
+		}
+		return
+	}
+	res, err := agent.GetResponderByName(name)
+	if err != nil {
+		return
+	}
+	targets[name] = res
+	return
+}
+
+// APIHandleStartAnalysis starts a significance analysis for a Responder,
+// correlating its sources against the specified target monitor.
+func (agent *FeedbackAgent) APIHandleStartAnalysis(request *APIRequest) (
+	err error) {
+	if request.SourceMonitorName == nil || *request.SourceMonitorName == "" {
+		err = errors.New("no target monitor specified")
+		return
+	}
+	interval := 0
+	if request.MetricInterval != nil {
+		interval = *request.MetricInterval
+	}
+	err = agent.StartSignificanceAnalysis(request.TargetName,
+		*request.SourceMonitorName, interval)
+	return
+}
+
+// APIHandleGetHistory returns the observation history of a monitor in the
+// requested format: as JSON points (the default), or rendered as a text
+// sparkline, CSV or a PNG graph.
+func (agent *FeedbackAgent) APIHandleGetHistory(request *APIRequest) (
+	points []HistoryPoint, output string, image []byte, err error) {
+	if request.TargetName == "" {
+		err = errors.New("no target monitor specified")
+		return
+	}
+	format := HistoryFormatJSON
+	if request.Format != nil && *request.Format != "" {
+		format = strings.ToLower(strings.TrimSpace(*request.Format))
+	}
+	period := time.Duration(0)
+	if request.Duration != nil && *request.Duration != "" {
+		period, err = time.ParseDuration(strings.TrimSpace(*request.Duration))
+		if err != nil || period <= 0 {
+			err = errors.New("invalid history duration '" +
+				*request.Duration + "'; must be positive, e.g. '10m'")
+			return
+		}
+	}
+	history, err := agent.GetHistory(request.TargetName, period)
+	if err != nil {
+		return
+	}
+	switch format {
+	case HistoryFormatJSON:
+		points = history
+	case HistoryFormatSparkline:
+		output = RenderSparkline(request.TargetName, history)
+	case HistoryFormatCSV:
+		output = RenderHistoryCSV(history)
+	case HistoryFormatPNG:
+		image, err = RenderHistoryPNG(history)
+	default:
+		err = errors.New("invalid history format '" + format + "'")
+	}
+	return
+}
+
+// APIHandleValidateConfig validates the candidate configuration supplied
+// with a request, or the configuration file on disk if none is supplied,
+// without applying it. An error is returned if the config is invalid.
+func (agent *FeedbackAgent) APIHandleValidateConfig(request *APIRequest) (
+	result *ConfigValidation, err error) {
+	data := []byte(request.Config)
+	if len(data) == 0 {
+		data, err = os.ReadFile(path.Join(agent.configDir, ConfigFileName))
 		if err != nil {
 			return
 		}
-		targets[name] = res
 	}
-	for _, res := range targets {
-		res.SetCommandState(isOnline, true, commandMask)
+	result = agent.ValidateConfigJSON(data)
+	if !result.Valid {
+		err = errors.New("configuration is invalid (" +
+			strconv.Itoa(len(result.Errors)) + " errors)")
 	}
 	return
 }
 
+// APIHandleSetLogLevel changes the logging level of the running agent.
+func (agent *FeedbackAgent) APIHandleSetLogLevel(request *APIRequest) (err error) {
+	if request.LogLevel == nil {
+		err = errors.New("no log level specified")
+		return
+	}
+	err = agent.SetLogLevel(*request.LogLevel)
+	if err != nil {
+		return
+	}
+	logrus.Info("Log level changed to '" + agent.LogLevel + "'.")
+	agent.unsavedChanges = true
+	return
+}
+
 // APIHandleSetThreshold processes an API request to set a value or state
 // for applying a threshold to the Feedback Agent output.
 func (agent *FeedbackAgent) APIHandleSetThreshold(request *APIRequest) (
@@ -769,6 +1512,14 @@ func (agent *FeedbackAgent) APIHandleSetThreshold(request *APIRequest) (
 		}
 		changed = true
 	}
+	// Process a change to the threshold schedule, if provided.
+	if request.ThresholdSchedule != nil {
+		err = res.ConfigureThresholdSchedule(*request.ThresholdSchedule)
+		if err != nil {
+			return
+		}
+		changed = true
+	}
 	// Process a change to whether the threshold is enabled, if provided
 	// or triggered by the above code.
 	if request.ThresholdMode != nil {
@@ -789,8 +1540,11 @@ func (agent *FeedbackAgent) APIHandleSetThreshold(request *APIRequest) (
 	return
 }
 
+// APIHandleSetCommands configures the HAProxy commands and command interval
+// of a responder, returning a description of the effective commands and
+// any warnings about them.
 func (agent *FeedbackAgent) APIHandleSetCommands(request *APIRequest,
-	replace bool) (err error) {
+	replace bool) (output string, err error) {
 	res, err := agent.GetResponderByName(request.TargetName)
 	if err != nil {
 		return
@@ -808,6 +1562,11 @@ func (agent *FeedbackAgent) APIHandleSetCommands(request *APIRequest,
 		}
 	}
 	agent.unsavedChanges = true
+	output = "online commands: '" + res.OnlineCommands +
+		"', offline commands: '" + res.OfflineCommands + "'"
+	for _, warning := range res.CommandWarnings() {
+		output += "\nwarning: " + warning
+	}
 	return
 }
 
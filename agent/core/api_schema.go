@@ -20,6 +20,11 @@
 
 package agent
 
+import (
+	"encoding/json"
+	"time"
+)
+
 // APIRequest defines a request received from a client to the agent.
 type APIRequest struct {
 	// Global API request fields that apply to any request.
@@ -34,24 +39,161 @@ type APIRequest struct {
 	ListenIPAddress *string                     `json:"ip,omitempty"`
 	ListenPort      *string                     `json:"port,omitempty"`
 	FeedbackSources *map[string]*FeedbackSource `json:"feedback-sources,omitempty"`
-	RequestTimeout  *int                        `json:"request-timeout,omitempty"`
-	ResponseTimeout *int                        `json:"response-timeout,omitempty"`
+	RequestTimeout  *string                     `json:"request-timeout,omitempty"`
+	ResponseTimeout *string                     `json:"response-timeout,omitempty"`
+	IdleTimeout     *string                     `json:"idle-timeout,omitempty"`
 	CommandList     *string                     `json:"command-list,omitempty"`
 	CommandInterval *int                        `json:"command-interval,omitempty"`
 	ThresholdMode   *string                     `json:"threshold-mode,omitempty"`
 	ThresholdScore  *int                        `json:"threshold-max,omitempty"`
 	SmartShape      *bool                       `json:"smart-shape,omitempty"`
 	LogStateChanges *bool                       `json:"log-state-changes,omitempty"`
+	AllowedCIDRs    *[]string                   `json:"allowed-cidrs,omitempty"`
+	MaxConnections  *int                        `json:"max-connections,omitempty"`
+	MaxRequestRate  *int                        `json:"max-request-rate,omitempty"`
+	DrainTimeout    *string                     `json:"drain-timeout,omitempty"`
+	CacheFeedback   *bool                       `json:"cache-feedback,omitempty"`
+	KeepAlive       *bool                       `json:"keep-alive,omitempty"`
+	ReusePort       *bool                       `json:"reuse-port,omitempty"`
+	FeedbackFormat  *string                     `json:"feedback-format,omitempty"`
+	// Drain timeout in milliseconds, as sent by earlier clients.
+	DrainTimeoutMs *int `json:"drain-timeout-ms,omitempty"`
+	// The aggregation of the loads of the sources, and the expression used
+	// by the 'expression' aggregation.
+	Aggregation     *string `json:"aggregation,omitempty"`
+	AggregationExpr *string `json:"aggregation-expression,omitempty"`
+	// The curve mapping the load to the reported weight, and its factor or
+	// points, as required by the curve.
+	WeightCurve       *string        `json:"weight-curve,omitempty"`
+	WeightCurveFactor *float64       `json:"weight-curve-factor,omitempty"`
+	WeightPoints      *[]WeightPoint `json:"weight-points,omitempty"`
+	// The floor and ceiling on the reported weight.
+	MinWeight *int `json:"min-weight,omitempty"`
+	MaxWeight *int `json:"max-weight,omitempty"`
+	// A 'netconn' monitor watched for the completion of a drain.
+	DrainMonitor *string `json:"drain-monitor,omitempty"`
+	// A Go text/template for the feedback response; '' clears it.
+	ResponseTemplate *string `json:"response-template,omitempty"`
+	// Whether an HTTP(S) Responder gives its state as the status code.
+	StatusCodes *bool `json:"status-codes,omitempty"`
+	// Paths served by an HTTP(S) Responder, replacing any existing routes;
+	// an empty list clears the routes.
+	Routes *[]FeedbackRoute `json:"routes,omitempty"`
+	// For a virtual Responder, the Responder whose listener it shares and
+	// the requests that it selects.
+	Listener   *string `json:"listener,omitempty"`
+	MatchPath  *string `json:"match-path,omitempty"`
+	MatchHost  *string `json:"match-host,omitempty"`
+	MatchToken *string `json:"match-token,omitempty"`
+	// Whether the access log is enabled, and its settings; setting any of
+	// these enables it.
+	AccessLog           *bool    `json:"access-log,omitempty"`
+	AccessLogVerbosity  *string  `json:"access-log-verbosity,omitempty"`
+	AccessLogSampleRate *float64 `json:"access-log-sample-rate,omitempty"`
+	AccessLogInterval   *int     `json:"access-log-client-interval-s,omitempty"`
+	// SNMP settings; for an edit, only those set replace the existing
+	// settings.
+	SNMP *SNMPConfig `json:"snmp,omitempty"`
+	// Time-varying thresholds, replacing any existing schedule; an empty
+	// list clears the schedule.
+	ThresholdSchedule *[]ThresholdWindow `json:"threshold-schedule,omitempty"`
+	// Sequence of states for a flap test.
+	FlapSequence *[]FlapStep `json:"flap-sequence,omitempty"`
+	// ETag from a previous response; if the content is unchanged, it
+	// is omitted from the response.
+	IfNoneMatch *string `json:"if-none-match,omitempty"`
+	// Whether the request has been replicated from a cluster peer, so
+	// is not replicated again.
+	Replicated bool `json:"replicated,omitempty"`
 
 	// API fields for SourceMonitor operations.
 	SourceMonitorName  *string  `json:"monitor,omitempty"`
 	SourceSignificance *float64 `json:"significance,omitempty"`
 	SourceMaxValue     *int64   `json:"max-value,omitempty"`
+	SourceRawThreshold *int64   `json:"raw-threshold,omitempty"`
+	SourceAction       *string  `json:"threshold-action,omitempty"`
 
 	// API fields for SystemMonitor operations.
 	MetricType     *string       `json:"metric-type,omitempty"`
 	MetricInterval *int          `json:"interval-ms,omitempty"`
 	MetricParams   *MetricParams `json:"metric-config,omitempty"`
+	AnomalyZScore  *float64      `json:"anomaly-z-score,omitempty"`
+	HistorySize    *int          `json:"history-size,omitempty"`
+	HistoryRetain  *int          `json:"history-retention-s,omitempty"`
+	FailurePolicy  *string       `json:"failure-policy,omitempty"`
+	StaleAfter     *int          `json:"stale-after-ms,omitempty"`
+
+	// Namespace to which a new or edited monitor or responder belongs.
+	Namespace *string `json:"namespace,omitempty"`
+
+	// API fields for agent settings.
+	LogLevel *string `json:"log-level,omitempty"`
+
+	// Output format for the 'get history' action, and the period up to
+	// now which it covers (e.g. '10m'); the duration also limits a state
+	// forced by the 'force' or 'send' actions.
+	Format   *string `json:"format,omitempty"`
+	Duration *string `json:"duration,omitempty"`
+
+	// Filters for the 'get events' action: the times since and until which
+	// events are returned (e.g. '2h' ago, or '2006-01-02 15:04'), their
+	// types (comma-separated) and the number of most recent events.
+	Since      *string `json:"since,omitempty"`
+	Until      *string `json:"until,omitempty"`
+	EventTypes *string `json:"event-types,omitempty"`
+	Limit      *int    `json:"limit,omitempty"`
+
+	// Source values for the 'get simulate' action, as comma-separated
+	// 'source=value' pairs, and a time from which the recorded values of
+	// any other sources are taken (given as for 'since').
+	Values *string `json:"values,omitempty"`
+	At     *string `json:"at,omitempty"`
+
+	// A candidate agent configuration for the 'validate config' action,
+	// a tuning profile for the 'import profile' action, a fragment of the
+	// configuration for the 'apply config' action, or the desired
+	// configuration for the 'put config' action.
+	Config json.RawMessage `json:"config,omitempty"`
+	// A bundle for the 'import bundle' action, and the options for
+	// exporting and importing bundles.
+	Bundle        []byte `json:"bundle,omitempty"`
+	ExcludeKey    *bool  `json:"exclude-key,omitempty"`
+	IncludeModel  *bool  `json:"include-model,omitempty"`
+	RegenerateKey *bool  `json:"regenerate-key,omitempty"`
+	// API requests making up a batch for the 'apply requests' action.
+	Requests []*APIRequest `json:"requests,omitempty"`
+	// Local file from which the CLI client reads the candidate config or
+	// profile, or to which it writes an exported profile.
+	ConfigFile *string `json:"-"`
+	// Threshold schedule in the CLI format, parsed by the CLI client.
+	ThresholdScheduleText *string `json:"-"`
+	// Weight points in the CLI format, parsed by the CLI client.
+	WeightPointsText *string `json:"-"`
+	// Routes in the CLI format, parsed by the CLI client.
+	RoutesText *string `json:"-"`
+	// Flap test sequence in the CLI format, parsed by the CLI client.
+	FlapSequenceText *string `json:"-"`
+	// SNMPv3 users in the CLI format, parsed by the CLI client.
+	SNMPUsersText *string `json:"-"`
+	// Hosts to which the CLI client sends the request in fleet mode, and
+	// the fleet file in which they are specified.
+	FleetHosts *string `json:"-"`
+	FleetFile  *string `json:"-"`
+	// API of a remote agent to which the CLI client sends the request,
+	// rather than to the local agent, and how its certificate is verified.
+	RemoteHost     *string `json:"-"`
+	RemotePort     *string `json:"-"`
+	RemoteKey      *string `json:"-"`
+	RemoteCAFile   *string `json:"-"`
+	RemoteInsecure *bool   `json:"-"`
+	// Format in which the CLI client writes the response.
+	OutputFormat *string `json:"-"`
+
+	// The namespace of the API key used, if not the main API key.
+	namespace string
+	// Whether the request was received through a legacy API Responder,
+	// permitting only read-only actions.
+	readOnly bool
 }
 
 // APIResponse defines a response to be sent from the agent to a client.
@@ -68,12 +210,180 @@ type APIResponse struct {
 	AgentConfig     *FeedbackAgent             `json:"current-config,omitempty"`
 	ServiceStatus   []APIServiceStatus         `json:"status,omitempty"`
 	FeedbackSources map[string]*FeedbackSource `json:"feedback-sources,omitempty"`
+	AgentInfo       *APIAgentInfo              `json:"agent-info,omitempty"`
+	Stats           *AgentStats                `json:"stats,omitempty"`
+	Analysis        *SignificanceReport        `json:"significance-analysis,omitempty"`
+	Events          []AgentEvent               `json:"events,omitempty"`
+	Cluster         []ClusterNodeStatus        `json:"cluster,omitempty"`
+	Fleet           []FleetResult              `json:"fleet,omitempty"`
+	Headroom        []HeadroomReport           `json:"headroom,omitempty"`
+	Simulation      *SimulationResult          `json:"simulation,omitempty"`
+	Validation      *ConfigValidation          `json:"validation,omitempty"`
+	Check           *SelfCheck                 `json:"check,omitempty"`
+	History         []HistoryPoint             `json:"history,omitempty"`
+	Profile         *TuningProfile             `json:"tuning-profile,omitempty"`
+	Image           []byte                     `json:"image-png,omitempty"`
+	Bundle          []byte                     `json:"bundle,omitempty"`
+	ETag            string                     `json:"etag,omitempty"`
+	NotModified     bool                       `json:"not-modified,omitempty"`
+	UpsertResult    string                     `json:"upsert-result,omitempty"`
+	BatchResults    []BatchResult              `json:"batch-results,omitempty"`
+	Changes         []ConfigChange             `json:"changes,omitempty"`
+	Overrides       []ForcedOverride           `json:"overrides,omitempty"`
+	// Whether changes to the running configuration have not been saved as
+	// the config file has been modified externally.
+	ConfigDiverged bool `json:"config-diverged,omitempty"`
+}
+
+// APIAgentInfo describes the build and runtime environment of the agent.
+type APIAgentInfo struct {
+	Version        string     `json:"version"`
+	BuildCommit    string     `json:"build-commit,omitempty"`
+	CommitTime     string     `json:"commit-time,omitempty"`
+	GoVersion      string     `json:"go-version"`
+	Platform       string     `json:"platform"`
+	ProcessID      int        `json:"pid"`
+	StartTime      time.Time  `json:"start-time"`
+	Uptime         string     `json:"uptime"`
+	UptimeSeconds  int64      `json:"uptime-seconds"`
+	ConfigPath     string     `json:"config-path"`
+	ConfigModified *time.Time `json:"config-modified,omitempty"`
+	Goroutines     int        `json:"goroutines"`
+	MemoryAlloc    uint64     `json:"memory-alloc-bytes"`
+	MemorySys      uint64     `json:"memory-sys-bytes"`
+	GCCycles       uint32     `json:"gc-cycles"`
+}
+
+// SignificanceReport describes the results of a significance analysis for
+// the Feedback Sources of a Responder against a target monitor.
+type SignificanceReport struct {
+	Responder     string                        `json:"responder"`
+	TargetMonitor string                        `json:"target-monitor"`
+	Running       bool                          `json:"running"`
+	StartTime     time.Time                     `json:"start-time"`
+	Interval      int                           `json:"interval-ms"`
+	Samples       int                           `json:"samples"`
+	Message       string                        `json:"message,omitempty"`
+	Sources       map[string]*SourceCorrelation `json:"sources"`
+}
+
+// SourceCorrelation describes the correlation of a single Feedback Source
+// with the target monitor of a significance analysis. The correlation is
+// omitted if either signal has not yet varied.
+type SourceCorrelation struct {
+	Samples               int      `json:"samples"`
+	Correlation           *float64 `json:"correlation,omitempty"`
+	CurrentSignificance   float64  `json:"current-significance"`
+	SuggestedSignificance *float64 `json:"suggested-significance,omitempty"`
+}
+
+// HeadroomReport describes the estimated capacity headroom of a Responder:
+// the additional load (percent) before a threshold trips, and the time
+// until this happens at the current trend, if the load is increasing.
+type HeadroomReport struct {
+	Responder          string               `json:"responder"`
+	ThresholdMode      string               `json:"threshold-mode"`
+	Load               int                  `json:"load"`
+	Headroom           int                  `json:"headroom"`
+	LimitingFactor     string               `json:"limiting-factor"`
+	TrendPerMinute     float64              `json:"trend-per-minute"`
+	SecondsToThreshold *int64               `json:"seconds-to-threshold,omitempty"`
+	Constraints        []HeadroomConstraint `json:"constraints"`
+}
+
+// HeadroomConstraint describes the headroom against a single threshold.
+type HeadroomConstraint struct {
+	Name           string  `json:"name"`
+	Load           int     `json:"load"`
+	Limit          int     `json:"limit"`
+	Headroom       int     `json:"headroom"`
+	TrendPerMinute float64 `json:"trend-per-minute"`
+	SecondsToLimit *int64  `json:"seconds-to-limit,omitempty"`
+}
+
+// SimulationResult describes the feedback a Responder would give for a
+// set of hypothetical or historical source values, without changing its
+// state. A forced state, if one is active, would take precedence over the
+// simulated state, so is reported alongside it.
+type SimulationResult struct {
+	Responder    string                     `json:"responder"`
+	At           *time.Time                 `json:"at,omitempty"`
+	Availability int                        `json:"availability"`
+	Online       bool                       `json:"online"`
+	Commands     string                     `json:"commands,omitempty"`
+	Feedback     string                     `json:"feedback"`
+	ForcedState  string                     `json:"forced-state,omitempty"`
+	Sources      map[string]SimulatedSource `json:"sources"`
+	Evaluation   []string                   `json:"evaluation,omitempty"`
+}
+
+// SimulatedSource describes the value and load of a source in a
+// simulation, and whether the value was given rather than current.
+type SimulatedSource struct {
+	Value     int64 `json:"value"`
+	Load      int   `json:"load"`
+	Breached  bool  `json:"breached"`
+	Simulated bool  `json:"simulated"`
+}
+
+// HistoryPoint describes a single observation in the history of a monitor.
+type HistoryPoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// ConfigValidation describes the result of validating a candidate agent
+// configuration without applying it.
+type ConfigValidation struct {
+	Valid    bool          `json:"valid"`
+	Errors   []ConfigIssue `json:"errors,omitempty"`
+	Warnings []ConfigIssue `json:"warnings,omitempty"`
+}
+
+// ConfigIssue describes a single problem found in a configuration, and
+// the service it relates to, if any.
+type ConfigIssue struct {
+	Service string `json:"service,omitempty"`
+	Message string `json:"message"`
 }
 
 type APIServiceStatus struct {
-	ServiceType   string `json:"type"`
-	ServiceName   string `json:"name"`
-	ServiceStatus string `json:"status"`
+	ServiceType   string        `json:"type"`
+	ServiceName   string        `json:"name"`
+	ServiceStatus string        `json:"status"`
+	Namespace     string        `json:"namespace,omitempty"`
+	Port          string        `json:"port,omitempty"`
+	Connections   *LimiterStats `json:"connections,omitempty"`
+	// The last error of the service, when it was last started (and how
+	// long it has been running since) and how many times it has been
+	// restarted since the agent started.
+	LastError     string     `json:"last-error,omitempty"`
+	StartTime     *time.Time `json:"start-time,omitempty"`
+	UptimeSeconds int64      `json:"uptime-seconds,omitempty"`
+	RestartCount  int        `json:"restart-count,omitempty"`
+	// The addresses on which a responder listens, and its current
+	// availability score and command state (online, offline, drain or
+	// maint), and whether this state is forced.
+	Address      string `json:"address,omitempty"`
+	Availability *int   `json:"availability,omitempty"`
+	CommandState string `json:"command-state,omitempty"`
+	Forced       bool   `json:"forced,omitempty"`
+	// The effective HAProxy commands a responder sends when online and
+	// offline.
+	OnlineCommands  string `json:"online-commands,omitempty"`
+	OfflineCommands string `json:"offline-commands,omitempty"`
+	// When a monitor last took a sample successfully, or a responder last
+	// served a response.
+	LastSample   *time.Time `json:"last-sample,omitempty"`
+	LastResponse *time.Time `json:"last-response,omitempty"`
+	// The current value of a monitor, once it has taken a sample.
+	LastValue *int64 `json:"last-value,omitempty"`
+	// Whether the data of a monitor is stale, because its last sample
+	// failed or it has not taken one within its stale-after time.
+	Stale bool `json:"stale,omitempty"`
+	// The failures of a service which has stopped unexpectedly, and when
+	// it will next be restarted.
+	Supervisor *SupervisorStatus `json:"supervisor,omitempty"`
 }
 
 type APIConfig struct {
@@ -81,3 +391,11 @@ type APIConfig struct {
 	Port      string
 	Key       string
 }
+
+// AgentRuntimeInfo is written to the runtime file by a running agent.
+type AgentRuntimeInfo struct {
+	PID        int    `json:"pid"`
+	Instance   string `json:"instance,omitempty"`
+	APIAddress string `json:"api-ip,omitempty"`
+	APIPort    string `json:"api-port,omitempty"`
+}
@@ -0,0 +1,94 @@
+// apiactions.go
+// Disabling of API Actions by Configuration
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"errors"
+	"strings"
+)
+
+// Each entry in the list of disabled API actions names a service type and
+// an action in the form '<type> <action>' (e.g. 'agent stop' or 'responder
+// delete'), with '*' matching any type or action. An entry of one word
+// disables that action for every type (e.g. 'reload').
+
+// apiTypeAliases maps alternative names accepted for some API types to the
+// name under which they are disabled.
+var apiTypeAliases = map[string]string{
+	"cmd":   "commands",
+	"maint": "halt",
+}
+
+// ParseDisabledActions validates a list of disabled API actions, returning
+// the set of '<type> <action>' pairs which it contains.
+func ParseDisabledActions(entries []string) (disabled map[string]bool,
+	err error) {
+	for _, entry := range entries {
+		words := strings.Fields(strings.ToLower(entry))
+		switch len(words) {
+		case 1:
+			words = []string{"*", words[0]}
+		case 2:
+		default:
+			err = errors.New("disabled API action '" + entry + "' must be " +
+				"in the form '<type> <action>' or '<action>'")
+			return
+		}
+		if words[0] == "*" && words[1] == "*" {
+			err = errors.New("disabled API action '" + entry + "' would " +
+				"disable the entire API")
+			return
+		}
+		if alias, exists := apiTypeAliases[words[0]]; exists {
+			words[0] = alias
+		}
+		if disabled == nil {
+			disabled = make(map[string]bool)
+		}
+		disabled[words[0]+" "+words[1]] = true
+	}
+	return
+}
+
+// authoriseDisabledAction returns an error if the action of an API request
+// has been disabled in the agent configuration.
+func (agent *FeedbackAgent) authoriseDisabledAction(request *APIRequest) (
+	err error) {
+	if len(agent.disabledActions) == 0 {
+		return
+	}
+	requestType := strings.ToLower(request.Type)
+	if alias, exists := apiTypeAliases[requestType]; exists {
+		requestType = alias
+	}
+	action := strings.ToLower(request.Action)
+	if agent.disabledActions[requestType+" "+action] ||
+		agent.disabledActions["* "+action] ||
+		agent.disabledActions[requestType+" *"] {
+		err = errors.New("this action has been disabled in the agent " +
+			"configuration")
+	}
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,288 @@
+// apiclient.go
+// HTTP Client for the Feedback Agent API
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// Default number of further attempts made to connect to the API.
+	DefaultAPIClientRetries = 0
+	// Default delay before retrying a connection, doubled on each retry.
+	DefaultAPIClientRetryDelay = 500 * time.Millisecond
+	// Default time limit for an entire API request.
+	DefaultAPIClientTimeout = 60 * time.Second
+)
+
+// APIClient sends requests to the API of a Feedback Agent, and is used by
+// the CLI client and the client package.
+type APIClient struct {
+	// URL of the API, e.g. "https://127.0.0.1:3334".
+	URL string
+	// API key added to every request.
+	Key string
+	// Number of further attempts made if a connection to the API cannot
+	// be established, and the delay before the first of these (doubled
+	// for each subsequent attempt). Requests are never resent once they
+	// have been delivered, as they may not be safe to repeat.
+	Retries    int
+	RetryDelay time.Duration
+	// Time limit for an entire request, including any retries.
+	Timeout time.Duration
+	// SHA-256 fingerprints (hex) of the public keys accepted from the
+	// API; if empty, the certificate of the API is not verified, as the
+	// agent generates its own self-signed certificates.
+	PinnedKeys []string
+	// Certificate authorities against which the certificate of the API
+	// is verified, along with its host name, if set.
+	RootCAs *x509.CertPool
+
+	httpClient *http.Client
+}
+
+// NewAPIClient creates a client for the API described by an [APIConfig].
+func NewAPIClient(config APIConfig) (client *APIClient) {
+	client = &APIClient{
+		URL:        APIURL(config.IPAddress, config.Port),
+		Key:        config.Key,
+		Retries:    DefaultAPIClientRetries,
+		RetryDelay: DefaultAPIClientRetryDelay,
+		Timeout:    DefaultAPIClientTimeout,
+	}
+	return
+}
+
+// APIURL returns the URL of an API listening on an address (an IP address,
+// which may be IPv6 with a zone, or a hostname) and port. An API listening
+// on all addresses is reached over the loopback interface.
+func APIURL(address string, port string) string {
+	host := address
+	parsed, err := netip.ParseAddr(address)
+	if address == "" || (err == nil && parsed.Is4() && parsed.IsUnspecified()) {
+		host = "127.0.0.1"
+	} else if err == nil && parsed.IsUnspecified() {
+		host = "::1"
+	}
+	// Building the URL from its parts brackets an IPv6 address and escapes
+	// any zone within it.
+	apiURL := url.URL{Scheme: "https", Host: net.JoinHostPort(host, port)}
+	return apiURL.String()
+}
+
+// Send sends a request to the API, returning the parsed response along
+// with the raw JSON received. The API key of the client is added to the
+// request. An error is returned only if the request could not be made or
+// the response could not be read; a response reporting that the request
+// failed is not treated as an error.
+func (client *APIClient) Send(ctx context.Context, request *APIRequest) (
+	response *APIResponse, responseJSON string, err error) {
+	request.APIKey = client.Key
+	requestJSON, err := json.MarshalIndent(request, "", "    ")
+	if err != nil {
+		return
+	}
+	if client.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, client.Timeout)
+		defer cancel()
+	}
+	httpClient := client.getHTTPClient()
+	delay := client.RetryDelay
+	var httpResponse *http.Response
+	for attempt := 0; ; attempt++ {
+		var httpRequest *http.Request
+		httpRequest, err = http.NewRequestWithContext(ctx, http.MethodPost,
+			client.URL, bytes.NewReader(requestJSON))
+		if err != nil {
+			return
+		}
+		httpRequest.Header.Set("Content-Type", "application/json")
+		httpResponse, err = httpClient.Do(httpRequest)
+		if err == nil || attempt >= client.Retries || !isDialError(err) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+	if err != nil {
+		return
+	}
+	defer httpResponse.Body.Close()
+	responseBytes, err := io.ReadAll(httpResponse.Body)
+	if err != nil {
+		return
+	}
+	responseJSON = string(responseBytes)
+	response, err = UnmarshalAPIResponse(responseJSON)
+	return
+}
+
+// Subscribe subscribes to updates from the agent, limited by the query
+// parameters of the subscription path, passing each update received to a
+// handler until the context is cancelled (when no error is returned) or
+// the stream fails. The time limit of the client does not apply.
+func (client *APIClient) Subscribe(ctx context.Context, query url.Values,
+	handle func(update SubscriptionUpdate)) (err error) {
+	subscribeURL := client.URL + SubscribePath
+	if len(query) > 0 {
+		subscribeURL += "?" + query.Encode()
+	}
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		subscribeURL, nil)
+	if err != nil {
+		return
+	}
+	httpRequest.Header.Set("X-API-Key", client.Key)
+	httpResponse, err := client.getHTTPClient().Do(httpRequest)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = nil
+		}
+		return
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(httpResponse.Body, 1024))
+		return errors.New("subscription refused: " +
+			strings.TrimSpace(string(message)))
+	}
+	// Each event is ended by a blank line; its name is also the type of
+	// the update, so only the data is needed.
+	scanner := bufio.NewScanner(httpResponse.Body)
+	data := ""
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "data:") {
+			data += strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		} else if line == "" && data != "" {
+			var update SubscriptionUpdate
+			if json.Unmarshal([]byte(data), &update) == nil {
+				handle(update)
+			}
+			data = ""
+		}
+	}
+	err = scanner.Err()
+	if ctx.Err() != nil {
+		err = nil
+	} else if err == nil {
+		err = errors.New("the subscription was ended by the agent")
+	}
+	return
+}
+
+// getHTTPClient returns the HTTP client for this APIClient, creating it
+// on first use. The transport requests compressed responses, which are
+// decompressed transparently, so large responses are cheaper over slow
+// links.
+func (client *APIClient) getHTTPClient() *http.Client {
+	if client.httpClient != nil {
+		return client.httpClient
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		// The agent uses self-signed certificates, which are checked
+		// against the pinned keys instead, if any.
+		InsecureSkipVerify: client.RootCAs == nil,
+		RootCAs:            client.RootCAs,
+	}
+	if len(client.PinnedKeys) > 0 {
+		transport.TLSClientConfig.VerifyPeerCertificate =
+			client.verifyPinnedKey
+	}
+	client.httpClient = &http.Client{Transport: transport}
+	return client.httpClient
+}
+
+// verifyPinnedKey checks that the certificate presented by the API has
+// one of the pinned public keys.
+func (client *APIClient) verifyPinnedKey(rawCerts [][]byte,
+	_ [][]*x509.Certificate) (err error) {
+	if len(rawCerts) == 0 {
+		return errors.New("no certificate presented by the API")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return
+	}
+	fingerprint := PublicKeyFingerprint(cert)
+	for _, pinned := range client.PinnedKeys {
+		pinned = strings.ToLower(strings.ReplaceAll(pinned, ":", ""))
+		if pinned == fingerprint {
+			return
+		}
+	}
+	return errors.New("the public key of the API certificate (" +
+		fingerprint + ") is not pinned")
+}
+
+// PublicKeyFingerprint returns the SHA-256 fingerprint (hex) of the public
+// key of a certificate, as used for pinning.
+func PublicKeyFingerprint(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(hash[:])
+}
+
+// LoadCAFile loads the PEM certificates of the certificate authorities in
+// a file into a pool, for use as the RootCAs of an [APIClient].
+func LoadCAFile(filePath string) (pool *x509.CertPool, err error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return
+	}
+	pool = x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		err = errors.New("no PEM certificates found in '" + filePath + "'")
+	}
+	return
+}
+
+// isDialError returns whether an error occurred whilst establishing a
+// connection, in which case the request cannot have been delivered.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,336 @@
+// apply.go
+// Transactional Application of Batches of Changes
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// The 'apply' action makes a batch of changes to the configuration as a
+// single transaction, so that a new server can be provisioned in one step
+// rather than with a series of separate requests. Each change is reported
+// individually in the response. The changes may be given as either:
+//
+//   - a list of API requests ('apply requests'), each of which must change
+//     the configuration (e.g. 'add monitor' or 'set threshold'). These are
+//     made in order, and if any fails, those after it are skipped and the
+//     running configuration is restored to that before the batch began.
+//
+//   - a fragment of the configuration file ('apply config'), such as a set
+//     of monitors and responders, each of which is created or replaced
+//     along with any agent settings given. The resulting configuration is
+//     validated before any of it is applied, and only the services which
+//     have changed are restarted.
+//
+// The CLI client reads either from a file (or from stdin), e.g.
+// 'lbfeedback apply -f changes.json', inferring the type from its content.
+
+// Types of the 'apply' action.
+const (
+	ApplyTypeRequests = "requests"
+	ApplyTypeConfig   = "config"
+)
+
+// Results reported for each request in a batch; the changes in a fragment
+// of the configuration are reported with the upsert results.
+const (
+	BatchSucceeded  = "succeeded"
+	BatchFailed     = "failed"
+	BatchRolledBack = "rolled-back"
+	BatchSkipped    = "skipped"
+)
+
+// BatchResult reports the outcome of a single change in a batch.
+type BatchResult struct {
+	Item    string `json:"item"`
+	Result  string `json:"result"`
+	Message string `json:"message,omitempty"`
+}
+
+// isBatchable returns whether a request may be included in a batch, which
+// is limited to those which change the configuration.
+func isBatchable(request *APIRequest) bool {
+	return request != nil && request.Action != "apply" &&
+		isReplicated(request)
+}
+
+// #######################################################################
+// Batches of Requests
+// #######################################################################
+
+// APIHandleApplyRequests makes each of the requests in a batch in turn,
+// returning the result of each. If any request fails, the remainder are
+// skipped and the running configuration is restored to that before the
+// batch, so that either all of the changes are made or none are.
+func (agent *FeedbackAgent) APIHandleApplyRequests(request *APIRequest) (
+	results []BatchResult, err error) {
+	if len(request.Requests) == 0 {
+		err = errors.New("no requests specified")
+		return
+	}
+	for i, item := range request.Requests {
+		if !isBatchable(item) {
+			err = errors.New("request " + strconv.Itoa(i+1) + " does not " +
+				"change the configuration, so cannot be included in a batch")
+			return
+		}
+	}
+	snapshot, err := agent.ConfigToJSON()
+	if err != nil {
+		return
+	}
+	wasUnsaved := agent.unsavedChanges
+	agent.unsavedChanges = false
+	failed := -1
+	for i, item := range request.Requests {
+		if failed >= 0 {
+			results = append(results, BatchResult{
+				Item:   BuildAPIDescription(item),
+				Result: BatchSkipped,
+			})
+			continue
+		}
+		var output string
+		output, err = agent.applyBatchRequest(request, item)
+		result := BatchResult{Item: BuildAPIDescription(item)}
+		if err != nil {
+			failed = i
+			result.Result = BatchFailed
+			result.Message = err.Error()
+		} else {
+			result.Result = BatchSucceeded
+			result.Message = output
+		}
+		results = append(results, result)
+	}
+	if failed < 0 {
+		agent.unsavedChanges = agent.unsavedChanges || wasUnsaved
+		return
+	}
+	for i := 0; i < failed; i++ {
+		results[i].Result = BatchRolledBack
+	}
+	err = errors.New("request " + strconv.Itoa(failed+1) + " failed (" +
+		err.Error() + "), so no changes have been made")
+	// Nothing needs to be restored if no changes had yet been made.
+	if agent.unsavedChanges {
+		_, restoreErr := agent.restoreConfig(snapshot)
+		if restoreErr != nil {
+			err = errors.Join(err, errors.New("failed to roll back the "+
+				"changes: "+restoreErr.Error()))
+		}
+	}
+	agent.unsavedChanges = wasUnsaved
+	return
+}
+
+// applyBatchRequest makes a single request from a batch, with the same
+// authority as the batch itself, returning any output from it.
+func (agent *FeedbackAgent) applyBatchRequest(batch *APIRequest,
+	request *APIRequest) (output string, err error) {
+	request.APIKey = ""
+	request.Action = strings.TrimSpace(request.Action)
+	request.Type = strings.TrimSpace(request.Type)
+	request.TargetName = strings.ToLower(strings.TrimSpace(request.TargetName))
+	request.namespace = batch.namespace
+	request.readOnly = batch.readOnly
+	response := &APIResponse{}
+	unknownType, _, _, err := agent.apiActionTree(request, response)
+	if unknownType {
+		err = errors.New("invalid action type '" + request.Type + "'")
+	}
+	output = response.Output
+	return
+}
+
+// #######################################################################
+// Fragments of the Configuration
+// #######################################################################
+
+// APIHandleApplyConfig merges a fragment of the configuration into the
+// current configuration, creating or replacing each monitor and responder
+// in it and replacing any agent settings in it, then validates, saves and
+// applies the result. The result for each service and setting in the
+// fragment is returned.
+func (agent *FeedbackAgent) APIHandleApplyConfig(request *APIRequest) (
+	results []BatchResult, summary ReloadSummary, err error) {
+	if len(request.Config) == 0 {
+		err = errors.New("no configuration specified")
+		return
+	}
+	fragment := make(map[string]json.RawMessage)
+	err = json.Unmarshal(request.Config, &fragment)
+	if err != nil {
+		err = errors.New("invalid configuration fragment: " + err.Error())
+		return
+	}
+	current, err := agent.ConfigToJSON()
+	if err != nil {
+		return
+	}
+	config := make(map[string]json.RawMessage)
+	err = json.Unmarshal(current, &config)
+	if err != nil {
+		return
+	}
+	// Services are created or replaced individually, and the name of each
+	// is recorded so that its result can be found once applied.
+	created := make(map[string]bool)
+	services := make(map[string]string)
+	for _, key := range sortedKeys(fragment) {
+		serviceType := ""
+		switch key {
+		case "monitors":
+			serviceType = "monitor"
+		case "responders":
+			serviceType = "responder"
+		default:
+			results = append(results, BatchResult{
+				Item:   "setting '" + key + "'",
+				Result: mergedSettingResult(config[key], fragment[key]),
+			})
+			config[key] = fragment[key]
+			continue
+		}
+		var merged, additions map[string]json.RawMessage
+		if len(config[key]) > 0 {
+			err = json.Unmarshal(config[key], &merged)
+			if err != nil {
+				return
+			}
+		}
+		err = json.Unmarshal(fragment[key], &additions)
+		if err == nil {
+			additions, _, err = NormaliseNameMap(additions, serviceType)
+		}
+		if err != nil {
+			err = errors.New("invalid " + key + " in configuration " +
+				"fragment: " + err.Error())
+			return
+		}
+		if merged == nil {
+			merged = make(map[string]json.RawMessage)
+		}
+		for name, service := range additions {
+			item := serviceType + " '" + name + "'"
+			_, exists := merged[name]
+			created[item] = !exists
+			services[item] = serviceType
+			merged[name] = service
+		}
+		config[key], err = json.Marshal(merged)
+		if err != nil {
+			return
+		}
+	}
+	// Round trip the result through the agent configuration, so that it
+	// is saved in the usual form.
+	mergedJSON, err := json.Marshal(config)
+	if err != nil {
+		return
+	}
+	staged := FeedbackAgent{}
+	err = json.Unmarshal(mergedJSON, &staged)
+	if err != nil {
+		err = errors.New("invalid configuration fragment: " + err.Error())
+		return
+	}
+	output, err := staged.ConfigToJSON()
+	if err != nil {
+		return
+	}
+	validation := agent.ValidateConfigJSON(output)
+	if !validation.Valid {
+		issue := validation.Errors[0]
+		if issue.Service != "" {
+			issue.Message = issue.Service + ": " + issue.Message
+		}
+		err = errors.New("configuration fragment cannot be applied: " +
+			issue.Message)
+		return
+	}
+	summary, err = agent.ApplyConfigData(output)
+	restarted := make(map[string]bool)
+	for _, item := range summary.Restarted {
+		restarted[item] = true
+	}
+	for _, item := range sortedKeys(services) {
+		result := BatchResult{Item: item, Result: UpsertUnchanged}
+		if created[item] {
+			result.Result = UpsertCreated
+		} else if restarted[item] {
+			result.Result = UpsertUpdated
+		}
+		results = append(results, result)
+	}
+	return
+}
+
+// mergedSettingResult returns whether replacing the value of an agent
+// setting with another changes it.
+func mergedSettingResult(old json.RawMessage, new json.RawMessage) string {
+	if len(old) == 0 {
+		return UpsertCreated
+	}
+	var oldValue, newValue any
+	if json.Unmarshal(old, &oldValue) == nil &&
+		json.Unmarshal(new, &newValue) == nil &&
+		configJSONEqual(oldValue, newValue) {
+		return UpsertUnchanged
+	}
+	return UpsertUpdated
+}
+
+// #######################################################################
+// CLI Client
+// #######################################################################
+
+// parseCLIApplyFile prepares an 'apply' request from the file read by the
+// CLI client, inferring its type if none was given: a list is taken to be
+// of API requests, and anything else a fragment of the configuration.
+func parseCLIApplyFile(request *APIRequest) (err error) {
+	data := bytes.TrimSpace(request.Config)
+	if request.Type == "" {
+		request.Type = ApplyTypeConfig
+		if bytes.HasPrefix(data, []byte("[")) {
+			request.Type = ApplyTypeRequests
+		}
+	}
+	if request.Type != ApplyTypeRequests {
+		return
+	}
+	err = json.Unmarshal(data, &request.Requests)
+	if err != nil {
+		err = errors.New("the file does not contain a list of API " +
+			"requests: " + err.Error())
+		return
+	}
+	request.Config = nil
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
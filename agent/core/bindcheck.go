@@ -0,0 +1,118 @@
+// bindcheck.go
+// Listen Address Collision Checks
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+)
+
+// Two Responders cannot listen on the same port of the same address, and a
+// Responder listening on all addresses (the wildcard, '0.0.0.0' or '::')
+// takes the port on every address, so overlaps any other listening on it.
+// Rather than one of them failing to start when it binds, such collisions
+// are reported when the configuration is loaded or validated, and when a
+// Responder is added or edited. Ephemeral ports (0) never collide, SNMP
+// Responders listen on UDP rather than TCP, and virtual Responders have no
+// listener of their own.
+
+// #################################
+// LISTEN ADDRESS COLLISIONS
+// #################################
+
+// listenTransport returns the transport protocol on which this Responder
+// listens.
+func (fbr *FeedbackResponder) listenTransport() string {
+	if fbr.ProtocolName == ProtocolSNMP {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// isUnspecifiedAddress returns whether a listen address (as returned by
+// ListenAddresses) binds a port on all addresses.
+func isUnspecifiedAddress(address string) bool {
+	if address == "" {
+		return true
+	}
+	ip, err := netip.ParseAddr(address)
+	return err == nil && ip.IsUnspecified()
+}
+
+// describeListenAddress returns a listen address and port for display.
+func describeListenAddress(address string, port string) string {
+	if address == "" {
+		address = "*"
+	}
+	return net.JoinHostPort(address, port)
+}
+
+// checkListenCollision returns an error if this Responder would listen on
+// an address and port overlapping those of any other of the Responders
+// given, which may include this one.
+func (fbr *FeedbackResponder) checkListenCollision(
+	responders map[string]*FeedbackResponder) (err error) {
+	if fbr.isVirtual() || fbr.ListenPort == "0" {
+		return
+	}
+	for _, name := range sortedKeys(responders) {
+		other := responders[name]
+		if name == fbr.ResponderName || other.isVirtual() ||
+			other.ListenPort != fbr.ListenPort ||
+			other.listenTransport() != fbr.listenTransport() {
+			continue
+		}
+		for _, address := range fbr.ListenAddresses() {
+			for _, otherAddress := range other.ListenAddresses() {
+				if address != otherAddress && !isUnspecifiedAddress(address) &&
+					!isUnspecifiedAddress(otherAddress) {
+					continue
+				}
+				err = errors.New("listen address " +
+					describeListenAddress(address, fbr.ListenPort) +
+					" collides with " +
+					describeListenAddress(otherAddress, other.ListenPort) +
+					" (" + fbr.listenTransport() + ") used by responder '" +
+					name + "'")
+				return
+			}
+		}
+	}
+	return
+}
+
+// checkListenCollisions returns an error for the first Responder of this
+// FeedbackAgent whose listen address collides with that of another.
+func (agent *FeedbackAgent) checkListenCollisions() (err error) {
+	for _, name := range sortedKeys(agent.Responders) {
+		err = agent.Responders[name].checkListenCollision(agent.Responders)
+		if err != nil {
+			err = errors.New("responder '" + name + "': " + err.Error())
+			return
+		}
+	}
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,323 @@
+// bundle.go
+// Migration Bundles of the Agent Configuration and State
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The 'export bundle' action produces a single gzipped tarball holding
+// everything needed to move an agent to a replacement host, which is
+// restored there with 'import bundle'. A bundle holds:
+//
+//   - a manifest describing the bundle and the agent which exported it.
+//   - the configuration file, optionally without the API keys, which are
+//     then kept (or generated) by the agent importing it.
+//   - the SNMP engine boots counter, which must never decrease for SNMPv3
+//     clients to continue to accept the agent's responses.
+//   - optionally, the learned state of the statistics model of each
+//     monitor, so that smart shaping and anomaly detection do not have to
+//     relearn the typical behaviour of each metric.
+//
+// The HTTPS certificates of the API and feedback Responders are generated
+// afresh by the agent each time they start (and renewed automatically), so
+// are not carried over; nor are any files referred to by secret
+// references, which should be provisioned on the new host separately.
+// Importing a bundle replaces the configuration as for 'put config', so
+// only the services which differ are restarted.
+
+const (
+	// Version of the layout of bundles, incremented on incompatible
+	// changes.
+	BundleVersion = 1
+	// Names of the files within a bundle, besides the configuration file
+	// and the SNMP engine boots counter, which have their usual names.
+	BundleManifestName   = "manifest.json"
+	BundleModelStateName = "model-state.json"
+	// Largest size of the files in a bundle, once decompressed.
+	MaxBundleSize = 16 * 1024 * 1024
+)
+
+// BundleManifest describes the contents of a bundle.
+type BundleManifest struct {
+	BundleVersion int       `json:"bundle-version"`
+	AgentVersion  string    `json:"agent-version"`
+	Created       time.Time `json:"created"`
+	Hostname      string    `json:"hostname,omitempty"`
+	KeyExcluded   bool      `json:"api-key-excluded,omitempty"`
+	Files         []string  `json:"files"`
+}
+
+// ExportBundle returns a bundle of the configuration and state of the
+// agent, optionally excluding the API keys and including the learned
+// state of each monitor.
+func (agent *FeedbackAgent) ExportBundle(excludeKey bool,
+	includeModel bool) (bundle []byte, err error) {
+	exported := *agent
+	if excludeKey {
+		exported = agent.APIHandleGetConfig()
+	}
+	config, err := exported.ConfigToJSON()
+	if err != nil {
+		return
+	}
+	files := map[string][]byte{ConfigFileName: config}
+	boots, readErr := os.ReadFile(path.Join(agent.configDir,
+		SNMPEngineBootsFileName))
+	if readErr == nil {
+		files[SNMPEngineBootsFileName] = boots
+	}
+	if includeModel {
+		states := make(map[string]ModelState)
+		for name, monitor := range agent.Monitors {
+			if state, exists := monitor.modelState(); exists {
+				states[name] = state
+			}
+		}
+		files[BundleModelStateName], err = json.MarshalIndent(states, "",
+			"    ")
+		if err != nil {
+			return
+		}
+	}
+	hostname, _ := os.Hostname()
+	manifest := BundleManifest{
+		BundleVersion: BundleVersion,
+		AgentVersion:  VersionString,
+		Created:       time.Now(),
+		Hostname:      hostname,
+		KeyExcluded:   excludeKey,
+		Files:         sortedKeys(files),
+	}
+	manifestJSON, err := json.MarshalIndent(manifest, "", "    ")
+	if err != nil {
+		return
+	}
+	// The manifest is written first, so that it can be read without
+	// unpacking the rest of the bundle.
+	var buffer bytes.Buffer
+	zipper := gzip.NewWriter(&buffer)
+	archive := tar.NewWriter(zipper)
+	for _, name := range append([]string{BundleManifestName},
+		manifest.Files...) {
+		data := manifestJSON
+		if name != BundleManifestName {
+			data = files[name]
+		}
+		err = archive.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0600,
+			Size:    int64(len(data)),
+			ModTime: manifest.Created,
+		})
+		if err == nil {
+			_, err = archive.Write(data)
+		}
+		if err != nil {
+			return
+		}
+	}
+	err = errors.Join(archive.Close(), zipper.Close())
+	if err == nil {
+		bundle = buffer.Bytes()
+	}
+	return
+}
+
+// ImportBundle replaces the configuration and state of the agent with
+// those in a bundle, returning the changes made to the configuration and
+// to the running services. If the API key is to be regenerated, the new
+// key is returned; if it was excluded from the bundle, the current key is
+// kept.
+func (agent *FeedbackAgent) ImportBundle(bundle []byte, regenerateKey bool) (
+	changes []ConfigChange, summary ReloadSummary, newKey string,
+	err error) {
+	files, err := readBundle(bundle)
+	if err != nil {
+		err = errors.New("invalid bundle: " + err.Error())
+		return
+	}
+	manifest := BundleManifest{}
+	err = json.Unmarshal(files[BundleManifestName], &manifest)
+	if err != nil {
+		err = errors.New("invalid bundle manifest: " + err.Error())
+		return
+	}
+	if manifest.BundleVersion > BundleVersion {
+		err = errors.New("bundle version " +
+			strconv.Itoa(manifest.BundleVersion) + " is newer than supported")
+		return
+	}
+	config, exists := files[ConfigFileName]
+	if !exists {
+		err = errors.New("the bundle holds no configuration")
+		return
+	}
+	if regenerateKey {
+		newKey = RandomHexBytes(16)
+		config, err = setConfigField(config, "api-key", newKey)
+		if err != nil {
+			err = errors.New("invalid configuration in bundle: " + err.Error())
+			return
+		}
+	}
+	changes, summary, err = agent.putConfigData(config)
+	if err != nil {
+		return
+	}
+	if boots, exists := files[SNMPEngineBootsFileName]; exists {
+		err = agent.importSNMPEngineBoots(boots)
+	}
+	if states, exists := files[BundleModelStateName]; exists {
+		err = errors.Join(err, agent.importModelState(states))
+	}
+	return
+}
+
+// readBundle returns the contents of each file in a bundle, by name.
+func readBundle(bundle []byte) (files map[string][]byte, err error) {
+	unzipper, err := gzip.NewReader(bytes.NewReader(bundle))
+	if err != nil {
+		return
+	}
+	defer unzipper.Close()
+	// Reading is limited to one byte beyond the limit, to detect it.
+	limited := &io.LimitedReader{R: unzipper, N: MaxBundleSize + 1}
+	archive := tar.NewReader(limited)
+	files = make(map[string][]byte)
+	for {
+		var header *tar.Header
+		header, err = archive.Next()
+		if err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			return
+		}
+		if header.Typeflag != tar.TypeReg ||
+			strings.Contains(header.Name, "/") {
+			continue
+		}
+		files[header.Name], err = io.ReadAll(archive)
+		if err != nil {
+			return
+		}
+	}
+	if limited.N <= 0 {
+		err = errors.New("the bundle exceeds " +
+			strconv.Itoa(MaxBundleSize/1024/1024) + " MiB")
+	} else if _, exists := files[BundleManifestName]; !exists {
+		err = errors.New("no manifest found")
+	}
+	return
+}
+
+// setConfigField sets a top-level field of JSON configuration data.
+func setConfigField(data []byte, name string, value any) (result []byte,
+	err error) {
+	config := make(map[string]json.RawMessage)
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return
+	}
+	config[name], err = json.Marshal(value)
+	if err != nil {
+		return
+	}
+	result, err = json.Marshal(config)
+	return
+}
+
+// importSNMPEngineBoots sets the SNMP engine boots counter to that from
+// another agent, unless this agent's counter is already higher.
+func (agent *FeedbackAgent) importSNMPEngineBoots(data []byte) (err error) {
+	imported, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 32)
+	if err != nil {
+		return errors.New("invalid SNMP engine boots in bundle")
+	}
+	snmpEngineBootsMutex.Lock()
+	defer snmpEngineBootsMutex.Unlock()
+	filePath := path.Join(agent.configDir, SNMPEngineBootsFileName)
+	current, readErr := os.ReadFile(filePath)
+	if readErr == nil {
+		existing, parseErr := strconv.ParseInt(
+			strings.TrimSpace(string(current)), 10, 32)
+		if parseErr == nil && existing >= imported {
+			return
+		}
+	}
+	err = WriteFileAtomic(filePath, []byte(strconv.FormatInt(imported, 10)+
+		"\n"))
+	return
+}
+
+// importModelState restores the learned state of each monitor from that of
+// the monitor of the same name in another agent.
+func (agent *FeedbackAgent) importModelState(data []byte) (err error) {
+	states := make(map[string]ModelState)
+	err = json.Unmarshal(data, &states)
+	if err != nil {
+		return errors.New("invalid model state in bundle: " + err.Error())
+	}
+	for name, state := range states {
+		monitor, exists := agent.Monitors[name]
+		if exists {
+			monitor.restoreModelState(state)
+		}
+	}
+	return
+}
+
+// modelState returns the learned state of the statistics model of this
+// monitor, if it has one.
+func (monitor *SystemMonitor) modelState() (state ModelState, exists bool) {
+	if monitor.mutex == nil || monitor.StatsModel == nil {
+		return
+	}
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	return monitor.StatsModel.State(), true
+}
+
+// restoreModelState replaces the learned state of the statistics model of
+// this monitor.
+func (monitor *SystemMonitor) restoreModelState(state ModelState) {
+	if monitor.mutex == nil || monitor.StatsModel == nil {
+		return
+	}
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	monitor.StatsModel.RestoreState(state)
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,235 @@
+// check.go
+// Local Self-Test of the Agent Configuration
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The 'check' action tests the configuration of the Agent without the
+// Agent running, for use in package installation scripts and in the CI of
+// configuration management. The configuration file is loaded as the Agent
+// would load it, each Monitor and Responder is initialised without being
+// started (so that no ports are bound), and each metric is sampled once.
+// A line is reported for each service and each problem found, and the
+// exit status is non-zero if the Agent would fail to load the
+// configuration or a metric cannot be sampled.
+
+// #################################
+// SELF-CHECK REPORTS
+// #################################
+
+const (
+	SelfCheckPass = "pass"
+	SelfCheckWarn = "warn"
+	SelfCheckFail = "fail"
+)
+
+// SelfCheck is the report of the 'check' action.
+type SelfCheck struct {
+	ConfigFile string            `json:"config-file"`
+	Passed     bool              `json:"passed"`
+	Results    []SelfCheckResult `json:"results"`
+}
+
+// SelfCheckResult is the outcome of checking the configuration, a single
+// service or a problem found in one.
+type SelfCheckResult struct {
+	Service string   `json:"service"`
+	Result  string   `json:"result"`
+	Message string   `json:"message"`
+	Sample  *float64 `json:"sample,omitempty"`
+}
+
+// add records the outcome of a check.
+func (check *SelfCheck) add(service string, result string, message string) {
+	if service == "" {
+		service = "config"
+	}
+	check.Results = append(check.Results, SelfCheckResult{
+		Service: service,
+		Result:  result,
+		Message: message,
+	})
+}
+
+// count returns the number of checks with a given outcome.
+func (check *SelfCheck) count(result string) (count int) {
+	for _, entry := range check.Results {
+		if entry.Result == result {
+			count++
+		}
+	}
+	return
+}
+
+// #################################
+// RUNNING THE CHECK
+// #################################
+
+// RunCheck runs the 'check' action of the CLI, returning the exit status.
+func RunCheck(argv []string) (status int) {
+	outputFormat := findCLIOutputFormat(argv)
+	request, options, err := ParseArgumentsToRequest("check", "", argv)
+	var check *SelfCheck
+	if err == nil {
+		check, err = RunSelfCheck(&request, options)
+	}
+	if outputFormat != "" {
+		format, formatErr := ParseOutputFormat(outputFormat)
+		if formatErr == nil {
+			response := &APIResponse{
+				APIName: AppIdentifier,
+				Version: VersionString,
+				Check:   check,
+			}
+			if check != nil {
+				response.Success = check.Passed
+				response.Message = check.summary()
+			}
+			WriteCLIOutput(os.Stdout, os.Stderr, format, response, "", err)
+		}
+	} else if err != nil {
+		println("Error: " + err.Error() + ".")
+	} else {
+		check.print(os.Stdout)
+	}
+	switch {
+	case err != nil:
+		status = ExitStatusError
+	case !check.Passed:
+		status = ExitStatusFailed
+	default:
+		status = ExitStatusNormal
+	}
+	return
+}
+
+// RunSelfCheck checks the configuration file given by a request (or that
+// of the Agent instance given, if none is) as the Agent would load it,
+// without applying it to a running Agent or binding any ports.
+func RunSelfCheck(request *APIRequest, options AgentOptions) (
+	check *SelfCheck, err error) {
+	agent := FeedbackAgent{options: options}
+	agent.useLocalPath = LocalPathMode
+	agent.InitialisePaths()
+	check = &SelfCheck{
+		ConfigFile: path.Join(agent.configDir, ConfigFileName),
+		Passed:     true,
+	}
+	data := []byte(request.Config)
+	if request.ConfigFile != nil {
+		check.ConfigFile = *request.ConfigFile
+	} else {
+		data, err = os.ReadFile(check.ConfigFile)
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+			check.add("", SelfCheckPass, "no configuration file; the "+
+				"default configuration will be created when the Agent "+
+				"is first started")
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+	// Metrics and services log as they are initialised and sampled, which
+	// is reported here instead.
+	logrus.SetOutput(io.Discard)
+	validation, staged := agent.stageConfigJSON(data)
+	failed := make(map[string]bool)
+	for _, issue := range validation.Errors {
+		check.add(issue.Service, SelfCheckFail, issue.Message)
+		failed[issue.Service] = true
+	}
+	for _, issue := range validation.Warnings {
+		check.add(issue.Service, SelfCheckWarn, issue.Message)
+	}
+	if staged != nil {
+		for _, name := range sortedKeys(staged.Monitors) {
+			service := "monitor '" + name + "'"
+			if !failed[service] {
+				check.sampleMonitor(service, staged.Monitors[name])
+			}
+		}
+		for _, name := range sortedKeys(staged.Responders) {
+			service := "responder '" + name + "'"
+			responder := staged.Responders[name]
+			if !failed[service] {
+				check.add(service, SelfCheckPass, "initialised ("+
+					strings.ToUpper(responder.ProtocolName)+" on "+
+					responder.describeListenAddresses()+")")
+			}
+		}
+	}
+	check.Passed = check.count(SelfCheckFail) == 0
+	return
+}
+
+// sampleMonitor takes a single sample from the metric of a Monitor which
+// has been initialised, recording whether it succeeded.
+func (check *SelfCheck) sampleMonitor(service string,
+	monitor *SystemMonitor) {
+	value, err := monitor.getMetricSample()
+	if err != nil {
+		check.add(service, SelfCheckFail, "failed to sample "+
+			monitor.SysMetric.GetDescription()+": "+err.Error())
+		return
+	}
+	check.add(service, SelfCheckPass, "sampled "+
+		monitor.SysMetric.GetDescription()+": "+
+		strconv.FormatFloat(value, 'f', 2, 64))
+	check.Results[len(check.Results)-1].Sample = &value
+}
+
+// summary returns a single line describing the outcome of the check.
+func (check *SelfCheck) summary() string {
+	outcome := "passed"
+	if !check.Passed {
+		outcome = "failed"
+	}
+	return "check of '" + check.ConfigFile + "' " + outcome + " with " +
+		strconv.Itoa(check.count(SelfCheckFail)) + " errors and " +
+		strconv.Itoa(check.count(SelfCheckWarn)) + " warnings"
+}
+
+// print writes the report of the check for display.
+func (check *SelfCheck) print(w io.Writer) {
+	_, _ = fmt.Fprintln(w, "Checking configuration file '"+
+		check.ConfigFile+"':")
+	for _, entry := range check.Results {
+		_, _ = fmt.Fprintln(w, "  ["+strings.ToUpper(entry.Result)+"] "+
+			entry.Service+": "+entry.Message)
+	}
+	_, _ = fmt.Fprintln(w, "The "+check.summary()+".")
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
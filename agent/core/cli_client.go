@@ -23,15 +23,14 @@
 package agent
 
 import (
-	"bytes"
-	"crypto/tls"
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
+	"path"
 	"strconv"
 	"strings"
 
@@ -49,51 +48,136 @@ const (
 	FlagPort               = "port"
 	FlagRequestTimeout     = "request-timeout"
 	FlagResponseTimeout    = "response-timeout"
+	FlagIdleTimeout        = "idle-timeout"
 	FlagThresholdMode      = "threshold-mode"
 	FlagThresholdMax       = "threshold-max"
 	FlagCommandInterval    = "command-interval"
 	FlagMonitorName        = "monitor"
 	FlagSourceSignificance = "significance"
 	FlagSourceMaxValue     = "max-value"
+	FlagSourceRawThreshold = "raw-threshold"
+	FlagSourceAction       = "threshold-action"
 	FlagMetricType         = "metric-type"
 	FlagMetricInterval     = "interval-ms"
 	FlagSampleTime         = "sampling-ms"
 	FlagScriptName         = "script-name"
 	FlagDiskPath           = "disk-path"
+	FlagLocalPort          = "local-port"
 	FlagShapingEnabled     = "smart-shape"
 	FlagLogState           = "log-state-changes"
+	FlagAllowedCIDRs       = "allowed-cidrs"
+	FlagNoColor            = "no-color"
+	FlagMaxConnections     = "max-connections"
+	FlagMaxRequestRate     = "max-request-rate"
+	FlagInstance           = "instance"
+	FlagLogLevel           = "level"
+	FlagAnomalyZScore      = "anomaly-z-score"
+	FlagFailurePolicy      = "failure-policy"
+	FlagStaleAfter         = "stale-after-ms"
+	FlagHistorySize        = "history-size"
+	FlagHistoryRetention   = "history-retention-s"
+	FlagDuration           = "duration"
+	FlagConfigFile         = "file"
+	FlagConfigFileShort    = "f"
+	FlagNamespace          = "namespace"
+	FlagFormat             = "format"
+	FlagDrainTimeout       = "drain-timeout"
+	FlagThresholdSchedule  = "threshold-schedule"
+	FlagFlapSequence       = "sequence"
+	FlagSamplingMode       = "sampling-mode"
+	FlagIfNoneMatch        = "if-none-match"
+	FlagCacheFeedback      = "cache-feedback"
+	FlagAllowInsecureAPI   = "allow-insecure-api"
+	FlagJSONStartup        = "json-startup"
+	FlagKeepAlive          = "keep-alive"
+	FlagReusePort          = "reuse-port"
+	FlagFeedbackFormat     = "feedback-format"
+	FlagAggregation        = "aggregation"
+	FlagAggregationExpr    = "aggregation-expression"
+	FlagWeightCurve        = "weight-curve"
+	FlagWeightCurveFactor  = "weight-curve-factor"
+	FlagWeightPoints       = "weight-points"
+	FlagMinWeight          = "min-weight"
+	FlagMaxWeight          = "max-weight"
+	FlagDrainMonitor       = "drain-monitor"
+	FlagResponseTemplate   = "response-template"
+	FlagStatusCodes        = "status-codes"
+	FlagRoutes             = "routes"
+	FlagListener           = "listener"
+	FlagMatchPath          = "match-path"
+	FlagMatchHost          = "match-host"
+	FlagMatchToken         = "match-token"
+	FlagAccessLog          = "access-log"
+	FlagAccessLogVerbosity = "access-log-verbosity"
+	FlagAccessLogSample    = "access-log-sample-rate"
+	FlagAccessLogInterval  = "access-log-client-interval"
+	FlagSNMPCommunity      = "snmp-community"
+	FlagSNMPUsers          = "snmp-users"
+	FlagSNMPBaseOID        = "snmp-base-oid"
+	FlagPeers              = "peers"
+	FlagPeerTimeout        = "peer-timeout-ms"
+	FlagHosts              = "hosts"
+	FlagFleetFile          = "fleet-file"
+	FlagAPIHost            = "api-host"
+	FlagAPIPort            = "api-port"
+	FlagAPIKey             = "api-key"
+	FlagCAFile             = "ca-file"
+	FlagInsecure           = "insecure"
+	FlagOutput             = "output"
+	FlagExcludeKey         = "exclude-key"
+	FlagIncludeModel       = "include-model"
+	FlagRegenerateKey      = "regenerate-key"
+	FlagSince              = "since"
+	FlagUntil              = "until"
+	FlagEventTypes         = "event-types"
+	FlagLimit              = "limit"
+	FlagValues             = "values"
+	FlagAt                 = "at"
 )
 
-// List of all flag names for use in processing the arguments.
+// Environment variables which may be used by the CLI client in place of
+// the flags for a remote agent.
+const (
+	EnvAPIHost  = "LBFEEDBACK_API_HOST"
+	EnvAPIPort  = "LBFEEDBACK_API_PORT"
+	EnvAPIKey   = "LBFEEDBACK_API_KEY"
+	EnvCAFile   = "LBFEEDBACK_CA_FILE"
+	EnvInsecure = "LBFEEDBACK_INSECURE"
+)
 
-var FlagList = []string{
-	FlagType,
-	FlagName,
-	FlagCommandList,
-	FlagProtocol,
-	FlagIP,
-	FlagPort,
-	FlagRequestTimeout,
-	FlagResponseTimeout,
-	FlagThresholdMode,
-	FlagThresholdMax,
-	FlagCommandInterval,
-	FlagMonitorName,
-	FlagSourceSignificance,
-	FlagSourceMaxValue,
-	FlagMetricType,
-	FlagMetricInterval,
-	FlagSampleTime,
-	FlagScriptName,
-	FlagDiskPath,
-	FlagShapingEnabled,
-	FlagLogState,
-}
+// DefaultRemoteAPIPort is the API port of a remote agent, if not specified.
+const DefaultRemoteAPIPort = "3334"
 
 // RunClientCLI delivers the client CLI personality of the Feedback Agent.
 func RunClientCLI() (status int) {
-	// Print the CLI masthead.
-	fmt.Println(ShellBanner)
+	// The man page, completion scripts and OpenAPI specification are
+	// output without the masthead so that they can be redirected straight
+	// into a file.
+	if len(os.Args) > 1 && os.Args[1] == "manpage" {
+		fmt.Print(GenerateManPage())
+		status = ExitStatusNormal
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "completion" {
+		status = RunCompletion(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "openapi" {
+		spec, err := GenerateOpenAPISpec()
+		if err != nil {
+			fmt.Println("Error: " + err.Error())
+			status = ExitStatusError
+			return
+		}
+		fmt.Print(string(spec))
+		status = ExitStatusNormal
+		return
+	}
+	// Print the CLI masthead, unless the output is for a script.
+	outputFormat := findCLIOutputFormat(os.Args[1:])
+	if outputFormat == "" {
+		fmt.Println(ShellBanner)
+	}
 	// Suppress any log message output where we are calling
 	// agent functions for loading the configuration.
 	logrus.SetOutput(io.Discard)
@@ -110,19 +194,66 @@ func RunClientCLI() (status int) {
 		return
 	}
 	if os.Args[1] == "help" {
-		PlatformPrintHelpMessage()
+		if argc < 3 {
+			PlatformPrintHelpMessage()
+			status = ExitStatusNormal
+			return
+		}
+		helpText, err := GenerateCommandHelpText(os.Args[2])
+		if err != nil {
+			println("Error: " + err.Error() + ".")
+			status = ExitStatusError
+			return
+		}
+		fmt.Println(helpText)
 		status = ExitStatusNormal
 		return
 	}
+	if os.Args[1] == "shell" {
+		status = RunShell(os.Args[2:])
+		return
+	}
+	if os.Args[1] == "watch" {
+		status = RunWatch(os.Args[2:])
+		return
+	}
+	if os.Args[1] == "check" {
+		status = RunCheck(os.Args[2:])
+		return
+	}
 	// Get the actionName and remaining arguments.
-	actionName := os.Args[1]
-	actionType := ""
-	var actionArgs []string
+	actionName, actionType, actionArgs := SplitCLIArguments(os.Args[1:])
+	// Handle the specified action.
+	responseObject, responseJSON, err := CLIHandleAgentAction(actionName,
+		actionType, actionArgs)
+	status = CLIExitStatus(responseObject, err)
+	if outputFormat != "" {
+		format, formatErr := ParseOutputFormat(outputFormat)
+		if formatErr == nil {
+			WriteCLIOutput(os.Stdout, os.Stderr, format, responseObject,
+				responseJSON, err)
+			return
+		}
+	}
+	// Print any errors that occur.
+	if err != nil {
+		println("Error: " + err.Error() + ".")
+		return
+	}
+	PrintAPIResponse(responseObject)
+	return
+}
+
+// SplitCLIArguments splits CLI arguments into the action, the type (if
+// any) and the remaining arguments, which are flags.
+func SplitCLIArguments(args []string) (actionName string, actionType string,
+	actionArgs []string) {
+	actionName = args[0]
 	// -- Process arguments/flags.
-	// Assume an unadorned third argument is the type field
+	// Assume an unadorned second argument is the type field
 	// unless it is prefixed with "-" as a flag.
-	if argc >= 3 {
-		actionArgs = os.Args[2:]
+	if len(args) >= 2 {
+		actionArgs = args[1:]
 		actionArgs[0] = strings.TrimSpace(actionArgs[0])
 		if !strings.HasPrefix(actionArgs[0], "-") {
 			actionType = actionArgs[0]
@@ -133,23 +264,25 @@ func RunClientCLI() (status int) {
 			}
 		}
 	}
-	// Handle the specified action.
-	responseObject, _, err := CLIHandleAgentAction(actionName, actionType, actionArgs)
-	// Print any errors that occur.
-	if err != nil {
-		println("Error: " + err.Error() + ".")
-		status = ExitStatusError
-		return
-	}
+	return
+}
+
+// PrintAPIResponse pretty-prints a response from the API for the CLI,
+// followed by whether the operation was successful.
+func PrintAPIResponse(responseObject *APIResponse) {
 	// If there is a valid response object, pretty print it.
 	if responseObject != nil {
 		// Remove fields that we want to hide from the object
 		responseObject.Request = nil
 		responseObject.ID = nil
-		// Marshal back again to JSON from the model object to pretty-print it.
+		// Marshal back again to JSON from the model object to pretty-print
+		// it, except for the service status, which is clearer as a table.
 		prettyPrintedJSON, err := json.MarshalIndent(responseObject, "", "    ")
 		if err != nil {
 			println("Error: Failed to format response: " + err.Error())
+		} else if responseObject.Success && responseObject.ServiceStatus != nil {
+			writeStatusTable(os.Stdout, responseObject.ServiceStatus)
+			fmt.Println()
 		} else {
 			println(
 				"JSON response from the Feedback Agent:\n\n" +
@@ -161,6 +294,12 @@ func RunClientCLI() (status int) {
 			if responseObject.Output != "" {
 				println(responseObject.Output)
 			}
+			if responseObject.ConfigDiverged {
+				println("Warning: the configuration file has been modified " +
+					"externally, so changes to the running configuration " +
+					"are not being saved; use 'reload config' or " +
+					"'force save-config'.")
+			}
 		}
 	}
 	resultMsg := "The operation "
@@ -170,88 +309,198 @@ func RunClientCLI() (status int) {
 		resultMsg += "was successful."
 	}
 	println(resultMsg)
-	return
 }
 
 func CLIHandleAgentAction(actionName string, actionType string, argv []string) (
 	responseObject *APIResponse, responseJSON string, err error) {
+	// Check the action and type against the command registry.
+	command, err := GetCLICommand(actionName)
+	if err != nil {
+		return
+	}
+	if command.Local {
+		err = errors.New("action '" + actionName + "' cannot be used here")
+		return
+	}
 	// Parse the CLI arguments into a Feedback Agent request.
-	request, err := ParseArgumentsToRequest(actionName, actionType, argv)
+	request, options, err := ParseArgumentsToRequest(actionName, actionType, argv)
 	if err != nil {
 		return
 	}
-	// $ TO DO: Allow user to specify the API IP, port and key as flags,
-	// or alternatively the config dir and/or the config filename.
-	configDir := DefaultConfigDir
-	configFile := ConfigFileName
-	// If this binary was built in local path mode, use that local path.
-	if LocalPathMode {
-		configDir, _ = os.Getwd()
+	// In fleet mode, the request is sent to the agents on remote hosts.
+	if request.FleetHosts != nil {
+		responseObject, err = CLIHandleFleetAction(&request)
+		return
 	}
-	// Attempt to load the API access settings from the config file.
-	// ip, port, key, err := LoadAPIConfigFromFile(configDir, configFile)
-	config, err := LoadAPIConfigFromFile(configDir, configFile)
+	client, err := NewCLIAPIClient(&request, options.Instance)
 	if err != nil {
 		return
 	}
-	// Set the API key in the new request and build the URL.
-	request.APIKey = config.Key
-	apiURL := "https://" + config.IPAddress + ":" + config.Port
-	// Marshal the request into JSON to send to the agent API.
-	reqBodyJSON, err := json.MarshalIndent(request, "", "    ")
+	responseObject, responseJSON, err = CLISendRequest(client, &request)
+	return
+}
+
+// CLISendRequest sends a request parsed from CLI arguments to the API,
+// writing any exported tuning profile or bundle to the file specified.
+func CLISendRequest(client *APIClient, request *APIRequest) (
+	responseObject *APIResponse, responseJSON string, err error) {
+	// Send the request to the API.
+	responseObject, responseJSON, err = client.Send(context.Background(),
+		request)
+	// Handle any errors in connecting to the Agent.
+	if err != nil && responseJSON == "" {
+		err = &UnreachableError{Err: err}
+	}
 	if err != nil {
 		return
 	}
-	// Create a custom transport object with certificate validation
-	// checking disabled. Really, we should at some point implement
-	// a method for setting a custom CA which is shared between the
-	// agent and the client, but this will have to suffice for now.
-	customTransport := http.DefaultTransport.(*http.Transport).Clone()
-	customTransport.TLSClientConfig = &tls.Config{
-		InsecureSkipVerify: true,
-	}
-	client := &http.Client{
-		Transport: customTransport,
-	}
-	// Send the marshalled JSON to the API via HTTP.
-	httpResponse, err := client.Post(
-		apiURL,
-		"application/json",
-		bytes.NewBuffer(reqBodyJSON),
-	)
-	// Handle any resulting errors.
+	// Write an exported tuning profile to a file, if one was specified.
+	if request.ConfigFile != nil && responseObject.Profile != nil {
+		var profileJSON []byte
+		profileJSON, err = json.MarshalIndent(responseObject.Profile, "", "    ")
+		if err == nil {
+			err = os.WriteFile(*request.ConfigFile, profileJSON,
+				DefaultFilePermissions)
+		}
+		if err != nil {
+			return
+		}
+		responseObject.Profile = nil
+		responseObject.Output = "Tuning profile written to '" +
+			*request.ConfigFile + "'."
+	}
+	// Write an exported bundle to a file, which is required.
+	if responseObject.Bundle != nil {
+		if request.ConfigFile == nil {
+			err = errors.New("no file specified for the bundle")
+			return
+		}
+		err = os.WriteFile(*request.ConfigFile, responseObject.Bundle, 0600)
+		if err != nil {
+			return
+		}
+		responseObject.Bundle = nil
+		responseObject.Output = "Bundle written to '" +
+			*request.ConfigFile + "'."
+	}
+	return
+}
+
+// CLIHandleFleetAction sends a request to the agents on the hosts in a
+// fleet, returning their combined results.
+func CLIHandleFleetAction(request *APIRequest) (responseObject *APIResponse,
+	err error) {
+	if request.ConfigFile != nil && request.Action == "export" {
+		err = errors.New("a file cannot be exported from a fleet")
+		return
+	}
+	fleetFile := DefaultFleetFile()
+	if request.FleetFile != nil {
+		fleetFile = *request.FleetFile
+	}
+	fleet, err := LoadFleetConfig(fleetFile)
 	if err != nil {
-		err = errors.New(
-			err.Error() + "\nThe CLI Client failed to establish " +
-				"an HTTP connection to the Agent." +
-				"\nPlease check that the Agent is running and able to " +
-				"accept API requests",
-		)
 		return
 	}
-	// Read the contents of the response.
-	responseBytes, err := io.ReadAll(httpResponse.Body)
+	hosts, err := fleet.SelectHosts(*request.FleetHosts)
 	if err != nil {
 		return
 	}
-	responseJSON = string(responseBytes)
-	responseObject, err = UnmarshalAPIResponse(responseJSON)
+	results := fleet.Send(context.Background(), hosts, request)
+	responseObject = CombineFleetResults(results)
 	return
 }
 
-func ParseArgumentsToRequest(actionName string, actionType string, argv []string) (request APIRequest, err error) {
+// NewCLIAPIClient creates a client for the API to which the CLI client
+// sends a request. This is the API of the local agent (or of a named
+// instance of it), unless the host of a remote agent is given by a flag or
+// environment variable, in which case its API key must also be given. The
+// port and key of the local agent may also be overridden in the same way.
+//
+// The certificate of a remote agent is verified against the certificate
+// authorities in a CA file, without which the insecure option is required
+// to connect to it; that of the local agent is only verified if a CA file
+// is given, as it is normally self-signed.
+func NewCLIAPIClient(request *APIRequest, instance string) (
+	client *APIClient, err error) {
+	host := cliSetting(request.RemoteHost, EnvAPIHost)
+	port := cliSetting(request.RemotePort, EnvAPIPort)
+	key := cliSetting(request.RemoteKey, EnvAPIKey)
+	caFile := cliSetting(request.RemoteCAFile, EnvCAFile)
+	insecure := request.RemoteInsecure != nil && *request.RemoteInsecure
+	if request.RemoteInsecure == nil {
+		insecure, _ = strconv.ParseBool(os.Getenv(EnvInsecure))
+	}
+	var config APIConfig
+	if host == "" {
+		config, err = LoadLocalAPIConfig(instance)
+		if err != nil {
+			return
+		}
+	} else {
+		if key == "" {
+			err = errors.New("an API key must be specified for a remote " +
+				"agent, using -" + FlagAPIKey + " or " + EnvAPIKey)
+			return
+		}
+		config = APIConfig{IPAddress: host, Port: DefaultRemoteAPIPort}
+	}
+	if port != "" {
+		config.Port = port
+	}
+	if key != "" {
+		config.Key, err = ResolveSecret(key)
+		if err != nil {
+			err = errors.New("cannot resolve API key: " + err.Error())
+			return
+		}
+	}
+	client = NewAPIClient(config)
+	if caFile != "" {
+		client.RootCAs, err = LoadCAFile(caFile)
+		if err != nil {
+			err = errors.New("unable to load CA file: " + err.Error())
+		}
+	} else if host != "" && !insecure {
+		err = errors.New("the certificate of a remote agent cannot be " +
+			"verified without a CA file (-" + FlagCAFile + " or " +
+			EnvCAFile + "); use -" + FlagInsecure + " to connect without " +
+			"verifying it")
+	}
+	return
+}
+
+// cliSetting returns the value of a CLI flag if it was specified, or
+// otherwise that of an environment variable.
+func cliSetting(flagValue *string, envName string) string {
+	if flagValue != nil {
+		return *flagValue
+	}
+	return strings.TrimSpace(os.Getenv(envName))
+}
+
+// ParseArgumentsToRequest parses CLI arguments into an [APIRequest], along
+// with any options (such as the agent instance) that apply to the client.
+func ParseArgumentsToRequest(actionName string, actionType string, argv []string) (
+	request APIRequest, options AgentOptions, err error) {
 	// Define the set of flags available for all actions to
 	// parse from the input arguments. Note that it is the responsibility of
 	// the API to validate that the correct parameters have been supplied.
 	apiArgs := flag.NewFlagSet("", flag.ContinueOnError)
 	apiArgs.Usage = func() {}
-	// Initialise the argMap, which provides a map of flag names and their
-	// resulting value pointers that will be set on parsing by the 'flag'
-	// package.
+	// Initialise the argMap, which provides a map of flag names from the
+	// registry and their resulting value pointers that will be set on
+	// parsing by the 'flag' package.
 	argMap := make(map[string]*string)
 	foundMap := make(map[string]bool)
-	for _, argKey := range FlagList {
-		argMap[argKey] = apiArgs.String(argKey, "", "")
+	for _, cliFlag := range CLIFlags {
+		if cliFlag.IsBool {
+			value := &cliFlagValue{isBool: true}
+			apiArgs.Var(value, cliFlag.Name, "")
+			argMap[cliFlag.Name] = &value.value
+		} else {
+			argMap[cliFlag.Name] = apiArgs.String(cliFlag.Name, "", "")
+		}
 	}
 	// Parse the incoming command line parameters.
 	err = apiArgs.Parse(argv)
@@ -272,70 +521,117 @@ func ParseArgumentsToRequest(actionName string, actionType string, argv []string
 		Type:         actionType,
 		MetricParams: &params,
 	}
-	// Iterate through all the flags and process their values, if specified.
-	for argKey, argString := range argMap {
-		strVal := strings.TrimSpace(*argString)
+	// Iterate through the flags in the registry and apply their values
+	// to the request, if specified.
+	for _, cliFlag := range CLIFlags {
+		strVal := strings.TrimSpace(*argMap[cliFlag.Name])
 		// Skip this key (leaving the JSON field as nil) if it wasn't specified
 		// or its trimmed value consists of an empty string.
-		if !foundMap[argKey] || strVal == "" {
+		if !foundMap[cliFlag.Name] || strVal == "" {
 			continue
 		}
-		// Convert the argument string into our range of possible value types.
-		intVal, _ := strconv.Atoi(strVal)
-		int64Val := int64(intVal)
-		floatVal, _ := strconv.ParseFloat(strVal, 64)
-		boolVal, _ := strconv.ParseBool(strVal)
-
-		// Map this CLI flag into the JSON request object field based on the flag key.
-		switch argKey {
-		case FlagType:
-			request.Type = strVal
-		case FlagName:
-			request.TargetName = strVal
-		case FlagCommandList:
-			request.CommandList = &strVal
-		case FlagProtocol:
-			request.ProtocolName = &strVal
-		case FlagIP:
-			if strVal == "any" {
-				request.ListenIPAddress = StringAddr("*")
-			} else {
-				request.ListenIPAddress = &strVal
+		if cliFlag.applyOption != nil {
+			cliFlag.applyOption(&options, strVal)
+		} else {
+			cliFlag.apply(&request, params, strVal)
+		}
+	}
+	// Validate the instance name, if one was specified.
+	if options.Instance != "" {
+		options.Instance, err = ParseInstanceName(options.Instance)
+		if err != nil {
+			return
+		}
+	}
+	// Read the candidate config or profile, if a file was specified for
+	// anything other than an export.
+	if request.ConfigFile != nil && actionName == "import" &&
+		request.Type == "bundle" {
+		request.Bundle, err = os.ReadFile(*request.ConfigFile)
+		if err != nil {
+			return
+		}
+	} else if request.ConfigFile != nil && actionName != "export" {
+		var data []byte
+		if *request.ConfigFile == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(*request.ConfigFile)
+		}
+		if err != nil {
+			return
+		}
+		if !json.Valid(data) {
+			err = errors.New("file '" + *request.ConfigFile +
+				"' does not contain valid JSON")
+			return
+		}
+		request.Config = data
+		if actionName == "apply" {
+			err = parseCLIApplyFile(&request)
+			if err != nil {
+				return
 			}
-		case FlagPort:
-			request.ListenPort = &strVal
-		case FlagRequestTimeout:
-			request.RequestTimeout = &intVal
-		case FlagResponseTimeout:
-			request.ResponseTimeout = &intVal
-		case FlagThresholdMode:
-			request.ThresholdMode = &strVal
-		case FlagThresholdMax:
-			request.ThresholdScore = &intVal
-		case FlagCommandInterval:
-			request.CommandInterval = &intVal
-		case FlagMonitorName:
-			request.SourceMonitorName = &strVal
-		case FlagSourceSignificance:
-			request.SourceSignificance = &floatVal
-		case FlagSourceMaxValue:
-			request.SourceMaxValue = &int64Val
-		case FlagMetricType:
-			request.MetricType = &strVal
-		case FlagMetricInterval:
-			request.MetricInterval = &intVal
-		case FlagSampleTime:
-			params[ParamKeySampleTime] = strconv.Itoa(intVal)
-		case FlagScriptName:
-			params[ParamKeyScriptName] = strVal
-		case FlagDiskPath:
-			params[ParamKeyDiskPath] = strVal
-		case FlagShapingEnabled:
-			request.SmartShape = &boolVal
-		case FlagLogState:
-			request.LogStateChanges = &boolVal
 		}
 	}
+	// Validate the output format, if one was specified.
+	if request.OutputFormat != nil {
+		*request.OutputFormat, err = ParseOutputFormat(*request.OutputFormat)
+		if err != nil {
+			return
+		}
+	}
+	// Parse the threshold schedule, if one was specified.
+	if request.ThresholdScheduleText != nil {
+		var schedule []ThresholdWindow
+		schedule, err = ParseThresholdSchedule(*request.ThresholdScheduleText)
+		if err != nil {
+			return
+		}
+		request.ThresholdSchedule = &schedule
+	}
+	// Parse the weight points, if any were specified.
+	if request.WeightPointsText != nil {
+		var points []WeightPoint
+		points, err = ParseWeightPoints(*request.WeightPointsText)
+		if err != nil {
+			return
+		}
+		request.WeightPoints = &points
+	}
+	// Parse the routes, if any were specified.
+	if request.RoutesText != nil {
+		var routes []FeedbackRoute
+		routes, err = ParseRoutes(*request.RoutesText)
+		if err != nil {
+			return
+		}
+		request.Routes = &routes
+	}
+	// Parse the flap test sequence, if one was specified.
+	if request.FlapSequenceText != nil {
+		var steps []FlapStep
+		steps, err = ParseFlapSequence(*request.FlapSequenceText)
+		if err != nil {
+			return
+		}
+		request.FlapSequence = &steps
+	}
+	// Parse the SNMPv3 users, if any were specified.
+	if request.SNMPUsersText != nil {
+		var users []SNMPUser
+		users, err = ParseSNMPUsers(*request.SNMPUsersText)
+		if err != nil {
+			return
+		}
+		cliSNMPConfig(&request).Users = users
+	}
+	// Validate the resulting type against the command registry.
+	command, err := GetCLICommand(actionName)
+	if err != nil {
+		return
+	}
+	err = command.ValidateType(request.Type)
 	return
 }
 
@@ -347,6 +643,20 @@ func UnmarshalAPIResponse(responseJSON string) (response *APIResponse, err error
 	return
 }
 
+// LoadLocalAPIConfig loads the API access settings of the agent on this
+// host (or of a named instance of it) from its default config file.
+func LoadLocalAPIConfig(instance string) (config APIConfig, err error) {
+	configDir := DefaultConfigDir
+	// If this binary was built in local path mode, use that local path.
+	if LocalPathMode {
+		configDir, _ = os.Getwd()
+	}
+	// Target the config of a named agent instance, if specified.
+	configDir = InstanceDir(configDir, instance)
+	config, err = LoadAPIConfigFromFile(configDir, ConfigFileName)
+	return
+}
+
 // LoadAPIConfigFromFile attempts to load the API access details from the JSON config.
 func LoadAPIConfigFromFile(dir string, file string) (config APIConfig, err error) {
 	// Try to load a config from the location.
@@ -363,12 +673,36 @@ func LoadAPIConfigFromFile(dir string, file string) (config APIConfig, err error
 	api, err := agentConfig.GetResponderByName("api")
 	if err != nil {
 		err = errors.New("failed to obtain API config: " + err.Error())
+		return
 	}
 	config = APIConfig{
-		IPAddress: api.ListenIPAddress,
+		IPAddress: api.ListenAddresses()[0],
 		Port:      api.ListenPort,
-		Key:       agentConfig.APIKey,
+		Key:       agentConfig.apiKey,
+	}
+	// If the API listens on an ephemeral port, the port actually bound is
+	// only known from the runtime file written by the running agent.
+	if config.Port == "0" {
+		var info AgentRuntimeInfo
+		info, err = LoadRuntimeFile(dir)
+		if err != nil {
+			err = errors.New("the API uses an ephemeral port, but the " +
+				"agent does not appear to be running: " + err.Error())
+			return
+		}
+		config.Port = info.APIPort
+	}
+	return
+}
+
+// LoadRuntimeFile loads the runtime details written by a running agent
+// to the given config directory.
+func LoadRuntimeFile(dir string) (info AgentRuntimeInfo, err error) {
+	data, err := os.ReadFile(path.Join(dir, RuntimeFileName))
+	if err != nil {
+		return
 	}
+	err = json.Unmarshal(data, &info)
 	return
 }
 
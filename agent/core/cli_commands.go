@@ -0,0 +1,1846 @@
+// cli_commands.go
+// Command and Flag Registry for the CLI Shell Interface
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// #######################################################################
+// Registry Types
+// #######################################################################
+
+// CLIFlag defines a parameter flag accepted by the CLI client, along with
+// the documentation for it and the function that maps its value into an
+// API request.
+type CLIFlag struct {
+	Name        string
+	Description string
+	Options     []CLIOption
+	IsBool      bool
+	apply       func(request *APIRequest, params MetricParams, value string)
+	applyOption func(options *AgentOptions, value string)
+}
+
+// CLIOption documents a special value accepted by a [CLIFlag].
+type CLIOption struct {
+	Value       string
+	Description string
+}
+
+// CLICommand defines an action accepted by the CLI client, the types
+// that it can be applied to, and the documentation for it.
+type CLICommand struct {
+	Action      string
+	Summary     string
+	Description string
+	Types       []CLICommandType
+	Flags       []string
+	Examples    []string
+	// Local commands are handled by the binary itself rather than being
+	// sent to the agent API.
+	Local bool
+}
+
+// CLICommandType defines a type (the second CLI argument) for a
+// [CLICommand], and the flags that are relevant to it.
+type CLICommandType struct {
+	Name    string
+	Summary string
+	Flags   []string
+}
+
+// #######################################################################
+// Flag Registry
+// #######################################################################
+
+// CLIFlags is the registry of all flags accepted by the CLI client. It is
+// used both for parsing arguments and for generating help and man pages.
+var CLIFlags = []CLIFlag{
+	{
+		Name:        FlagType,
+		Description: "Action type; an alternative to specifying the type as the second argument.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.Type = v
+		},
+	},
+	{
+		Name: FlagName,
+		Description: "Name identifier of a service. For the 'force' and 'send' HAProxy " +
+			"command actions, omitting this parameter will apply the action to all " +
+			"Feedback Responders for which HAProxy commands are not disabled; see " +
+			"also '-command-list' below.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.TargetName = v
+		},
+	},
+	{
+		Name: FlagCommandList,
+		Description: "List of HAProxy commands to enable, space-separated. These are " +
+			"automatically detected as pertaining to online or offline states; " +
+			"only one of 'down', 'fail' or 'stopped', and one of 'drain' or " +
+			"'maint', may be enabled. Example: -command-list \"up down\"",
+		Options: []CLIOption{
+			{HAPConfigNone, "Disable all HAProxy commands."},
+			{HAPConfigDefault, "Send 'drain' for offline, 'up ready' for online."},
+		},
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.CommandList = &v
+		},
+	},
+	{
+		Name:        FlagProtocol,
+		Description: "Protocol name for a Responder. Options: 'tcp', 'http', 'https', 'snmp', 'grpc'.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.ProtocolName = &v
+		},
+	},
+	{
+		Name: FlagIP,
+		Description: "Listen IP address for a Responder, or a " +
+			"comma-separated list of addresses (IPv4 or IPv6, with an " +
+			"optional zone, e.g. 'fe80::1%eth0') or hostnames, which are " +
+			"resolved to each of their addresses.",
+		Options: []CLIOption{
+			{"any", "Listen on all IP addresses."},
+		},
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			if v == "any" {
+				v = "*"
+			}
+			r.ListenIPAddress = &v
+		},
+	},
+	{
+		Name: FlagPort,
+		Description: "Port to listen on for a Responder; '0' lets the " +
+			"operating system assign a free port, shown by 'status'.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.ListenPort = &v
+		},
+	},
+	{
+		Name: FlagAllowedCIDRs,
+		Description: "List of client IP ranges (CIDR) permitted to connect to a " +
+			"Responder, space-separated. Connections from other addresses are " +
+			"dropped (TCP) or refused (HTTP/API). " +
+			"Example: -allowed-cidrs \"10.0.0.0/8 192.168.1.10\"",
+		Options: []CLIOption{
+			{"any", "Remove all restrictions (the default)."},
+		},
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			cidrList := strings.Fields(v)
+			if v == "any" {
+				cidrList = []string{}
+			}
+			r.AllowedCIDRs = &cidrList
+		},
+	},
+	{
+		Name: FlagMaxConnections,
+		Description: "Maximum number of concurrent connections for a TCP " +
+			"Responder; further clients are refused until others complete. " +
+			"For HTTP(S) Responders, this limits concurrent requests, not " +
+			"connections, so idle keep-alive connections and API " +
+			"subscription streams are not counted. Use 0 for no limit (the default).",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.MaxConnections = cliIntValue(v)
+		},
+	},
+	{
+		Name: FlagMaxRequestRate,
+		Description: "Maximum number of requests per second accepted from each " +
+			"client IP address by a Responder. Use 0 for no limit (the default).",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.MaxRequestRate = cliIntValue(v)
+		},
+	},
+	{
+		Name: FlagRequestTimeout,
+		Description: "Time allowed to receive each request (e.g. '500ms' or " +
+			"'2s', or a number of milliseconds); for TCP Responders this " +
+			"defaults to 5s.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.RequestTimeout = &v
+		},
+	},
+	{
+		Name: FlagResponseTimeout,
+		Description: "Time allowed to send each response (e.g. '500ms' or " +
+			"'2s', or a number of milliseconds); for TCP Responders this " +
+			"defaults to 5s.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.ResponseTimeout = &v
+		},
+	},
+	{
+		Name: FlagIdleTimeout,
+		Description: "Time an idle keep-alive connection is kept open " +
+			"awaiting the next request (e.g. '30s', or a number of " +
+			"milliseconds); for TCP Responders this defaults to 60s.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.IdleTimeout = &v
+		},
+	},
+	{
+		Name: FlagDrainTimeout,
+		Description: "Time allowed for in-flight requests to complete " +
+			"when the Responder is stopped (e.g. '10s', or a number of " +
+			"milliseconds); this defaults to " +
+			DefaultDrainTimeout.String() + ".",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.DrainTimeout = &v
+		},
+	},
+	{
+		Name: FlagCacheFeedback,
+		Description: "Cache the feedback response for up to the shortest " +
+			"interval of the source monitors, rather than recalculating it " +
+			"for every request (true/false; default is false).",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.CacheFeedback = cliBoolValue(v)
+		},
+	},
+	{
+		Name: FlagKeepAlive,
+		Description: "For TCP Responders, keep connections open and answer " +
+			"each newline-terminated poll, rather than closing the connection " +
+			"after a single response (true/false; default is false, as " +
+			"required by ldirectord).",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.KeepAlive = cliBoolValue(v)
+		},
+	},
+	{
+		Name: FlagReusePort,
+		Description: "Bind with SO_REUSEPORT, so that when the Responder is " +
+			"edited or restarted its replacement starts listening before it " +
+			"stops, and the port never refuses connections (true/false; not " +
+			"supported on Windows).",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.ReusePort = cliBoolValue(v)
+		},
+	},
+	{
+		Name: FlagFeedbackFormat,
+		Description: "For TCP and HTTP(S) Responders, the format of the " +
+			"feedback response.",
+		Options: []CLIOption{
+			{FeedbackFormatHAProxy, "HAProxy agent-check commands and " +
+				"availability, e.g. 'up ready 75%' (the default)."},
+			{FeedbackFormatWeight, "A weight from 1 to 100 and a state " +
+				"(up, drain, maint or down) on separate lines, for other " +
+				"load balancers."},
+			{FeedbackFormatJSON, "For HTTP(S) Responders, a JSON report of " +
+				"the availability, source loads, threshold state and " +
+				"commands; also given to any client accepting " +
+				"'application/json'."},
+		},
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.FeedbackFormat = &v
+		},
+	},
+	{
+		Name: FlagAggregation,
+		Description: "How the loads of the Feedback Sources of a Responder " +
+			"are combined into its overall load.",
+		Options: []CLIOption{
+			{AggregationWeightedMean, "The mean load, weighted by the " +
+				"relative significance of each source (the default)."},
+			{AggregationMinHeadroom, "The load of the source with the " +
+				"least headroom, each scaled by its significance."},
+			{AggregationMaxLoad, "The highest load of any source, " +
+				"irrespective of significance."},
+			{AggregationExpression, "The result of the expression set by -" +
+				FlagAggregationExpr + "."},
+		},
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.Aggregation = &v
+		},
+	},
+	{
+		Name: FlagAggregationExpr,
+		Description: "An expression of the loads (0-100) of the Feedback " +
+			"Sources by name, with +, -, *, /, parentheses and min(), max() " +
+			"and avg(), e.g. 'max(cpu, 0.5 * ram + 0.5 * [disk-usage])'; " +
+			"names containing '-' are written in square brackets. Selects " +
+			"the '" + AggregationExpression + "' aggregation.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.AggregationExpr = &v
+		},
+	},
+	{
+		Name: FlagWeightCurve,
+		Description: "How the overall load of a Responder is mapped to the " +
+			"weight (availability) it reports; thresholds still apply to " +
+			"the load.",
+		Options: []CLIOption{
+			{WeightCurveLinear, "The inverse of the load, e.g. 20% at 80% " +
+				"load (the default)."},
+			{WeightCurveExponential, "Falls away exponentially with the " +
+				"load, with a steepness set by -" + FlagWeightCurveFactor +
+				" (default 3, giving 4% at 80% load)."},
+			{WeightCurveStep, "The weight of the last of the -" +
+				FlagWeightPoints + " whose load has been reached."},
+			{WeightCurveBreakpoints, "Interpolated linearly between the -" +
+				FlagWeightPoints + "."},
+		},
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.WeightCurve = &v
+		},
+	},
+	{
+		Name: FlagWeightCurveFactor,
+		Description: "Steepness of the '" + WeightCurveExponential +
+			"' weight curve, greater than 0 up to 20 (default 3).",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			floatVal, _ := strconv.ParseFloat(v, 64)
+			r.WeightCurveFactor = &floatVal
+		},
+	},
+	{
+		Name: FlagWeightPoints,
+		Description: "Points of the '" + WeightCurveStep + "' and '" +
+			WeightCurveBreakpoints + "' weight curves, as a list of " +
+			"'load=weight' percentages in ascending order of load separated " +
+			"by commas, e.g. '50=80,80=20,95=0'. Use 'none' to clear.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.WeightPointsText = &v
+		},
+	},
+	{
+		Name: FlagMinWeight,
+		Description: "Floor on the weight (availability) reported by a " +
+			"Responder, so that a server is never starved of traffic " +
+			"entirely, from 0 to 100 (default 0).",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			intVal, _ := strconv.Atoi(v)
+			r.MinWeight = &intVal
+		},
+	},
+	{
+		Name: FlagMaxWeight,
+		Description: "Ceiling on the weight (availability) reported by a " +
+			"Responder, from 1 to 100; 0 disables the ceiling (the default).",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			intVal, _ := strconv.Atoi(v)
+			r.MaxWeight = &intVal
+		},
+	},
+	{
+		Name: FlagDrainMonitor,
+		Description: "A 'netconn' monitor (e.g. with -" + FlagLocalPort +
+			" set to the balanced port) watched whilst the Responder is " +
+			"draining, raising a '" + EventTypeDrainComplete + "' event " +
+			"once no connections remain. Use 'none' to clear.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			if v == "none" {
+				v = ""
+			}
+			r.DrainMonitor = &v
+		},
+	},
+	{
+		Name: FlagResponseTemplate,
+		Description: "For TCP and HTTP(S) Responders, a Go text/template " +
+			"for the feedback response in place of the default, given the " +
+			"same fields as the JSON report, e.g. " +
+			"'weight={{.Availability}}{{\"\\n\"}}'. Use 'none' to clear.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			if v == "none" {
+				v = ""
+			}
+			r.ResponseTemplate = &v
+		},
+	},
+	{
+		Name: FlagStatusCodes,
+		Description: "For HTTP(S) Responders, answer with status 200 when " +
+			"online and 503 when offline, giving the availability in the '" +
+			AvailabilityHeader + "' header, for plain HTTP health checks " +
+			"(true/false; default is false).",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.StatusCodes = cliBoolValue(v)
+		},
+	},
+	{
+		Name: FlagRoutes,
+		Description: "For HTTP(S) Responders, other paths serving a view " +
+			"of the feedback, as a comma-separated list in the form " +
+			"'path[=source+source][:format]', e.g. " +
+			"'/feedback/cpu=cpu:weight,/healthz:json'; a view of some " +
+			"sources only reports their availability. Use 'none' to clear.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.RoutesText = &v
+		},
+	},
+	{
+		Name: FlagListener,
+		Description: "Make this a virtual Responder sharing the listener " +
+			"of another TCP or HTTP(S) Responder, which hands it the " +
+			"requests it matches; no IP address or port is then required. " +
+			"Use 'none' to clear.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			if v == "none" {
+				v = ""
+			}
+			r.Listener = &v
+		},
+	},
+	{
+		Name: FlagMatchPath,
+		Description: "For virtual HTTP(S) Responders, the path (and any " +
+			"path below it) of the requests to answer. Use 'none' to clear.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			if v == "none" {
+				v = ""
+			}
+			r.MatchPath = &v
+		},
+	},
+	{
+		Name: FlagMatchHost,
+		Description: "For virtual HTTP(S) Responders, the Host header of " +
+			"the requests to answer. Use 'none' to clear.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			if v == "none" {
+				v = ""
+			}
+			r.MatchHost = &v
+		},
+	},
+	{
+		Name: FlagMatchToken,
+		Description: "For virtual TCP Responders, the first word of the " +
+			"request line to answer, e.g. as sent by the HAProxy " +
+			"'agent-send' option.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.MatchToken = &v
+		},
+	},
+	{
+		Name: FlagAccessLog,
+		Description: "For TCP and HTTP(S) Responders, log each request " +
+			"(client, response and latency) to '" + AccessLogFileName +
+			"' in the log directory (true/false; default is false).",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.AccessLog = cliBoolValue(v)
+		},
+	},
+	{
+		Name:        FlagAccessLogVerbosity,
+		Description: "The details given by each access log entry.",
+		Options: []CLIOption{
+			{AccessLogBasic, "The time, client, latency and any HTTP status."},
+			{AccessLogResponse, "The feedback response as well (the " +
+				"default)."},
+			{AccessLogFull, "The TCP request line, or the HTTP method, " +
+				"path, host and user agent as well."},
+		},
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.AccessLogVerbosity = &v
+		},
+	},
+	{
+		Name: FlagAccessLogSample,
+		Description: "The fraction of requests logged to the access log, " +
+			"chosen at random, from 0 to 1 (0 logs every request).",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			floatVal, _ := strconv.ParseFloat(v, 64)
+			r.AccessLogSampleRate = &floatVal
+		},
+	},
+	{
+		Name: FlagAccessLogInterval,
+		Description: "Log at most one request from each client in this " +
+			"time (seconds), giving the number of requests since its last " +
+			"entry (0 for no limit).",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.AccessLogInterval = cliIntValue(v)
+		},
+	},
+	{
+		Name: FlagSNMPCommunity,
+		Description: "For SNMP Responders, the community accepted in SNMPv2c " +
+			"requests; may be a secret reference (e.g. 'env:NAME').",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			cliSNMPConfig(r).Community = v
+		},
+	},
+	{
+		Name: FlagSNMPUsers,
+		Description: "For SNMP Responders, the SNMPv3 users, as a list of " +
+			"'name[:auth:passphrase[:priv:passphrase]]' separated by commas, " +
+			"where auth is 'md5', 'sha' or 'sha256' and priv is 'des' or 'aes'.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.SNMPUsersText = &v
+		},
+	},
+	{
+		Name: FlagSNMPBaseOID,
+		Description: "For SNMP Responders, the OID under which values are " +
+			"exposed (default " + DefaultSNMPBaseOID + ").",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			cliSNMPConfig(r).BaseOID = v
+		},
+	},
+	{
+		Name:        FlagThresholdMax,
+		Description: "Maximum load for an online state (percent).",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.ThresholdScore = cliIntValue(v)
+		},
+	},
+	{
+		Name:        FlagThresholdMode,
+		Description: "Mode for automatic command threshold (default 'none').",
+		Options: []CLIOption{
+			{ThresholdStringNone, "All threshold behaviours are disabled."},
+			{ThresholdStringAny, "Down if any metric or overall relative load " +
+				"exceeds the configured threshold."},
+			{ThresholdStringOverallOnly, "Down if the overall relative load exceeds " +
+				"the configured threshold, ignoring individual metrics."},
+			{ThresholdStringMetricOnly, "Down if any metric exceeds its source " +
+				"or raw threshold, ignoring the overall relative load."},
+		},
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.ThresholdMode = &v
+		},
+	},
+	{
+		Name: FlagThresholdSchedule,
+		Description: "Thresholds replacing the maximum load at certain " +
+			"times (local), as a list of '[days ]HH:MM-HH:MM=threshold' " +
+			"windows separated by ';', where days are e.g. 'mon,tue'; the " +
+			"first matching window applies. Use 'none' to clear.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.ThresholdScheduleText = &v
+		},
+	},
+	{
+		Name: FlagFlapSequence,
+		Description: "States for a flap test, as a list of 'state=duration' " +
+			"steps separated by commas; the states are 'online' and 'offline' " +
+			"(sending the configured commands), 'drain' and 'halt'.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.FlapSequenceText = &v
+		},
+	},
+	{
+		Name: FlagLogState,
+		Description: "Log any changes in threshold state (true/false; default is " +
+			"false). This should usually be disabled in production to avoid " +
+			"excessively large log files being generated.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.LogStateChanges = cliBoolValue(v)
+		},
+	},
+	{
+		Name: FlagCommandInterval,
+		Description: "Time interval to send HAProxy commands for (seconds, default " +
+			strconv.Itoa(DefaultCommandInterval) + "), timed from the first " +
+			"Feedback Request.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.CommandInterval = cliIntValue(v)
+		},
+	},
+	{
+		Name:        FlagMonitorName,
+		Description: "Name identifier of a target Monitor.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.SourceMonitorName = &v
+		},
+	},
+	{
+		Name: FlagSourceSignificance,
+		Description: "Significance value (floating-point; e.g. 1.0). This is " +
+			"converted into a Relative Significance by summing the significance " +
+			"of all sources within a Responder and calculating their ratio.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			floatVal, _ := strconv.ParseFloat(v, 64)
+			r.SourceSignificance = &floatVal
+		},
+	},
+	{
+		Name: FlagShapingEnabled,
+		Description: "Enable Z-score (Gaussian) algorithmic load shaping for a " +
+			"given Monitor (true/false; disabled by default). This feature aims " +
+			"to prevent sudden excursions in weights and therefore improves " +
+			"connection distribution between Real Servers within HAProxy where " +
+			"persistence is enabled.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.SmartShape = cliBoolValue(v)
+		},
+	},
+	{
+		Name: FlagAnomalyZScore,
+		Description: "Z-score beyond which a Monitor observation is reported as " +
+			"an advisory anomaly event, relative to the behaviour learned by " +
+			"the Monitor (e.g. 3.0). Anomalies are logged and shown by 'get " +
+			"events' but do not affect the feedback weight. Use 0 to disable " +
+			"(the default).",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			floatVal, _ := strconv.ParseFloat(v, 64)
+			r.AnomalyZScore = &floatVal
+		},
+	},
+	{
+		Name: FlagFailurePolicy,
+		Description: "What Responders report for a Monitor whose data is " +
+			"stale, because its last sample failed or it has not taken one " +
+			"within its stale-after time.",
+		Options: []CLIOption{
+			{FailurePolicyHold, "Keep reporting the last value sampled " +
+				"(the default)."},
+			{FailurePolicyZeroLoad, "Report the load of the source as 0%."},
+			{FailurePolicyFullLoad, "Report the load of the source as 100%."},
+			{FailurePolicyOffline, "Take each Responder using it offline, " +
+				"as if its threshold was exceeded."},
+		},
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.FailurePolicy = &v
+		},
+	},
+	{
+		Name: FlagStaleAfter,
+		Description: "Time (ms) without a successful sample after which the " +
+			"data of a Monitor is stale, applying its failure policy. Use 0 " +
+			"for only a failed sample to make the data stale (the default).",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.StaleAfter = cliIntValue(v)
+		},
+	},
+	{
+		Name: FlagHistorySize,
+		Description: "Number of observations a Monitor keeps in memory for " +
+			"'get history' (default " + strconv.Itoa(MetricHistorySize) +
+			", maximum " + strconv.Itoa(MaxMetricHistorySize) + ").",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			intVal, _ := strconv.Atoi(v)
+			r.HistorySize = &intVal
+		},
+	},
+	{
+		Name: FlagHistoryRetention,
+		Description: "Time (seconds) for which a Monitor keeps observations " +
+			"in memory for 'get history'. If no history size is given, " +
+			"enough observations are kept to cover this period.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			intVal, _ := strconv.Atoi(v)
+			r.HistoryRetain = &intVal
+		},
+	},
+	{
+		Name: FlagNamespace,
+		Description: "Namespace to which a Monitor or Responder belongs. Each " +
+			"namespace defined in the Agent configuration has its own API key, " +
+			"which can only view and manage the services within it. Use an " +
+			"empty value to remove a service from its namespace.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.Namespace = &v
+		},
+	},
+	{
+		Name: FlagSourceMaxValue,
+		Description: "Maximum value for a given metric against which to scale " +
+			"its availability.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			intVal, _ := strconv.ParseInt(v, 10, 64)
+			r.SourceMaxValue = &intVal
+		},
+	},
+	{
+		Name: FlagSourceRawThreshold,
+		Description: "Maximum raw value of a Feedback Source for an online " +
+			"state, independent of its max value (e.g. a number of " +
+			"connections); checked in the 'metric' and 'any' threshold " +
+			"modes, and disabled if 0.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			intVal, _ := strconv.ParseInt(v, 10, 64)
+			r.SourceRawThreshold = &intVal
+		},
+	},
+	{
+		Name: FlagSourceAction,
+		Description: "HAProxy commands to send when a Feedback Source " +
+			"breaches its threshold, in place of the offline commands of " +
+			"the Responder (e.g. '" + HAPCommandMaintenance + "'); if " +
+			"several sources breach, the most severe action applies. Set " +
+			"to '" + HAPConfigNone + "' to clear.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.SourceAction = &v
+		},
+	},
+	{
+		Name: FlagMetricType,
+		Description: "Type of metric. Options: '" + MetricTypeCPU + "', '" +
+			MetricTypeRAM + "', '" + MetricTypeDiskUsage + "', '" +
+			MetricTypeNetConnections + "', '" + MetricTypeScript + "', '" +
+			MetricTypePeer + "'.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.MetricType = &v
+		},
+	},
+	{
+		Name: FlagMetricInterval,
+		Description: "Sampling interval for a Monitor or a significance analysis, " +
+			"or the refresh interval for 'watch' (ms).",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.MetricInterval = cliIntValue(v)
+		},
+	},
+	{
+		Name:        FlagSampleTime,
+		Description: "For 'cpu' metrics, the sample window duration (ms).",
+		apply: func(_ *APIRequest, p MetricParams, v string) {
+			intVal, _ := strconv.Atoi(v)
+			p[ParamKeySampleTime] = strconv.Itoa(intVal)
+		},
+	},
+	{
+		Name:        FlagSamplingMode,
+		Description: "For 'cpu' metrics, how the usage is sampled.",
+		Options: []CLIOption{
+			{CPUSamplingBlocking, "Measure the usage over the sample window, " +
+				"blocking the Monitor (default)."},
+			{CPUSamplingDelta, "Measure the usage since the previous sample " +
+				"from the CPU time counters, without blocking."},
+		},
+		apply: func(_ *APIRequest, p MetricParams, v string) {
+			p[ParamKeySamplingMode] = v
+		},
+	},
+	{
+		Name: FlagPeers,
+		Description: "For 'peer' metrics, the TCP Feedback Responders of other " +
+			"agents to check, as a list of 'host[:port]' separated by commas " +
+			"(default port " + PeerDefaultPort + "); the load is the " +
+			"percentage which cannot be reached.",
+		apply: func(_ *APIRequest, p MetricParams, v string) {
+			p[ParamKeyPeers] = v
+		},
+	},
+	{
+		Name: FlagPeerTimeout,
+		Description: "For 'peer' metrics, the time allowed for each peer to " +
+			"respond (ms, default " + strconv.Itoa(PeerDefaultTimeout) + ").",
+		apply: func(_ *APIRequest, p MetricParams, v string) {
+			p[ParamKeyPeerTimeout] = v
+		},
+	},
+	{
+		Name: FlagIfNoneMatch,
+		Description: "ETag from a previous response; if the content has not " +
+			"changed since, it is omitted and 'not-modified' is reported.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.IfNoneMatch = &v
+		},
+	},
+	{
+		Name: FlagScriptName,
+		Description: "For 'script' metrics, the name of the script to run from " +
+			"the Feedback Agent configuration directory.",
+		apply: func(_ *APIRequest, p MetricParams, v string) {
+			p[ParamKeyScriptName] = v
+		},
+	},
+	{
+		Name:        FlagLogLevel,
+		Description: "Logging level for the 'set log-level' action.",
+		Options: []CLIOption{
+			{LogLevelDebug, "Log all messages, including diagnostic detail."},
+			{LogLevelInfo, "Log informational messages and above (default)."},
+			{LogLevelWarn, "Log warnings and errors only."},
+			{LogLevelError, "Log errors only."},
+		},
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.LogLevel = &v
+		},
+	},
+	{
+		Name: FlagHosts,
+		Description: "Send the request to the Agents on a comma-separated " +
+			"list of remote hosts named in the fleet file, or to all of " +
+			"them if 'all', rather than to the local Agent. The results " +
+			"from each host are combined.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.FleetHosts = &v
+		},
+	},
+	{
+		Name: FlagFleetFile,
+		Description: "Path of the fleet file naming the remote hosts for " +
+			"-" + FlagHosts + ", with the API address and key of the Agent " +
+			"on each (default '" + FleetFileName + "' in the config " +
+			"directory).",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.FleetFile = &v
+		},
+	},
+	{
+		Name: FlagAPIHost,
+		Description: "Host name or IP address of a remote Agent to which " +
+			"the request is sent, rather than to the local Agent; also " +
+			"set by " + EnvAPIHost + ". The API key must then be given.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.RemoteHost = &v
+		},
+	},
+	{
+		Name: FlagAPIPort,
+		Description: "API port of the Agent (default " + DefaultRemoteAPIPort +
+			" for a remote Agent); also set by " + EnvAPIPort + ".",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.RemotePort = &v
+		},
+	},
+	{
+		Name: FlagAPIKey,
+		Description: "API key of the Agent, which may be a secret reference " +
+			"such as 'file:/path/to/key' to avoid exposing it in the process " +
+			"list; also set by " + EnvAPIKey + ".",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.RemoteKey = &v
+		},
+	},
+	{
+		Name: FlagCAFile,
+		Description: "Path of a PEM file of the certificate authorities " +
+			"against which the API certificate of the Agent is verified; " +
+			"also set by " + EnvCAFile + ".",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.RemoteCAFile = &v
+		},
+	},
+	{
+		Name: FlagInsecure,
+		Description: "Connect to a remote Agent without verifying its API " +
+			"certificate, as is required if it is self-signed and no CA file " +
+			"is given; also set by " + EnvInsecure + ".",
+		IsBool: true,
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.RemoteInsecure = cliBoolValue(v)
+		},
+	},
+	{
+		Name: FlagExcludeKey,
+		Description: "Exclude the API keys from an exported bundle; the " +
+			"Agent importing it keeps its own keys.",
+		IsBool: true,
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.ExcludeKey = cliBoolValue(v)
+		},
+	},
+	{
+		Name: FlagIncludeModel,
+		Description: "Include the learned state of the statistics model of " +
+			"each Monitor in an exported bundle.",
+		IsBool: true,
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.IncludeModel = cliBoolValue(v)
+		},
+	},
+	{
+		Name: FlagRegenerateKey,
+		Description: "Generate a new API key when importing a bundle, " +
+			"rather than using that in the bundle.",
+		IsBool: true,
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.RegenerateKey = cliBoolValue(v)
+		},
+	},
+	{
+		Name: FlagSince,
+		Description: "Show only events since a time, given as a duration " +
+			"before now (e.g. '2h'), 'YYYY-MM-DD HH:MM' (local time) or " +
+			"RFC 3339.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.Since = &v
+		},
+	},
+	{
+		Name: FlagUntil,
+		Description: "Show only events until a time, given as for '" +
+			FlagSince + "'.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.Until = &v
+		},
+	},
+	{
+		Name: FlagEventTypes,
+		Description: "Show only events of these types (comma-separated), " +
+			"e.g. 'threshold-crossed,state-forced'.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.EventTypes = &v
+		},
+	},
+	{
+		Name: FlagLimit,
+		Description: "Maximum number of the most recent events shown " +
+			"(default " + strconv.Itoa(DefaultEventQueryLimit) + "; 0 for all).",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			intVal, _ := strconv.Atoi(v)
+			r.Limit = &intVal
+		},
+	},
+	{
+		Name: FlagValues,
+		Description: "Raw source values to simulate, as comma-separated " +
+			"'source=value' pairs, e.g. 'cpu=80,ram=40'.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.Values = &v
+		},
+	},
+	{
+		Name: FlagAt,
+		Description: "Simulate the sources not given values with those " +
+			"recorded at a time, given as for '" + FlagSince + "'.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.At = &v
+		},
+	},
+	{
+		Name: FlagOutput,
+		Description: "Write only the response, in a format for scripts, " +
+			"rather than the banner and a summary. The exit status is 0 if " +
+			"the request succeeded, " + strconv.Itoa(ExitStatusFailed) +
+			" if the Agent reported that it failed, " +
+			strconv.Itoa(ExitStatusUnreachable) + " if the Agent could not " +
+			"be reached, or " + strconv.Itoa(ExitStatusError) +
+			" for any other error.",
+		Options: []CLIOption{
+			{OutputFormatJSON, "The response as JSON; errors in the client " +
+				"are reported in the same form."},
+			{OutputFormatYAML, "The response as YAML; errors in the client " +
+				"are reported in the same form."},
+			{OutputFormatTable, "The content of the response (e.g. the " +
+				"status of each service) as a table."},
+			{OutputFormatRaw, "The JSON exactly as received from the Agent."},
+		},
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.OutputFormat = &v
+		},
+	},
+	{
+		Name: FlagConfigFile,
+		Description: "Path of a JSON file: a candidate configuration for " +
+			"'validate config' or 'check' (if omitted, the Agent's current " +
+			"configuration file is checked), a tuning profile to read for 'import " +
+			"profile', changes to make for 'apply', or the file to write for " +
+			"'export profile'. A path of '-' reads from standard input.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.ConfigFile = &v
+		},
+	},
+	{
+		Name:        FlagConfigFileShort,
+		Description: "Short form of -" + FlagConfigFile + ".",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.ConfigFile = &v
+		},
+	},
+	{
+		Name:        FlagFormat,
+		Description: "Output format for the 'get history' action.",
+		Options: []CLIOption{
+			{HistoryFormatJSON, "Timestamped observations as JSON (default)."},
+			{HistoryFormatSparkline, "A single-line text graph with a summary."},
+			{HistoryFormatCSV, "Timestamped observations as CSV."},
+			{HistoryFormatPNG, "A line graph as a base64-encoded PNG image, " +
+				"for API clients."},
+		},
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.Format = &v
+		},
+	},
+	{
+		Name: FlagDuration,
+		Description: "Period up to now covered by the 'get history' action, " +
+			"e.g. '90s', '10m' or '2h' (by default, all that is held); for " +
+			"the 'force' and 'send' actions, the time after which the " +
+			"forced state expires (by default, it persists until cancelled); " +
+			"for 'get events', the period up to now which is shown.",
+		apply: func(r *APIRequest, _ MetricParams, v string) {
+			r.Duration = &v
+		},
+	},
+	{
+		Name: FlagInstance,
+		Description: "Name of the agent instance to run or to control, for " +
+			"hosts running several agents. Each instance has its own config " +
+			"and log directories under '" + InstancesDirName + "/<name>' " +
+			"within the default directories.",
+		applyOption: func(o *AgentOptions, v string) {
+			o.Instance = v
+		},
+	},
+	{
+		Name: FlagDiskPath,
+		Description: "For 'disk-usage' metrics, the local filesystem path to " +
+			"monitor for available disk space.",
+		apply: func(_ *APIRequest, p MetricParams, v string) {
+			p[ParamKeyDiskPath] = v
+		},
+	},
+	{
+		Name: FlagLocalPort,
+		Description: "For 'netconn' metrics, only count the connections to " +
+			"this local port (e.g. of the balanced service), excluding " +
+			"listening sockets.",
+		apply: func(_ *APIRequest, p MetricParams, v string) {
+			p[ParamKeyLocalPort] = v
+		},
+	},
+}
+
+// AgentFlags is the registry of flags accepted by the 'run-agent' action,
+// which configure the agent process itself rather than an API request.
+var AgentFlags = []CLIFlag{
+	{
+		Name: FlagAllowInsecureAPI,
+		Description: "Keep any API Responders using the deprecated insecure " +
+			"legacy protocol ('" + ProtocolLegacyAPI + "'), rather than " +
+			"migrating or refusing them; only read-only actions (such as " +
+			"'status' and 'get') are then permitted through them.",
+		IsBool: true,
+		applyOption: func(o *AgentOptions, v string) {
+			o.AllowInsecureAPI = *cliBoolValue(v)
+		},
+	},
+	{
+		Name: FlagJSONStartup,
+		Description: "Print a single line of JSON describing the outcome " +
+			"of startup (the services started, where Responders are " +
+			"listening, the config path and any warnings or errors), " +
+			"instead of the banner and console log output, for " +
+			"orchestration systems which parse the output of the agent. " +
+			"Logging to the configured log targets is unaffected.",
+		IsBool: true,
+		applyOption: func(o *AgentOptions, v string) {
+			o.JSONStartup = *cliBoolValue(v)
+		},
+	},
+	{
+		Name: FlagNoColor,
+		Description: "Disable coloured console output. Colours are also disabled " +
+			"if the output is not a terminal or the NO_COLOR environment variable " +
+			"is set. The log file format is not affected.",
+		IsBool: true,
+		applyOption: func(o *AgentOptions, v string) {
+			o.NoColor = *cliBoolValue(v)
+		},
+	},
+}
+
+// cliIntValue converts a CLI flag string into an integer pointer.
+func cliIntValue(str string) *int {
+	intVal, _ := strconv.Atoi(str)
+	return &intVal
+}
+
+// cliBoolValue converts a CLI flag string into a boolean pointer.
+func cliBoolValue(str string) *bool {
+	boolVal, _ := strconv.ParseBool(str)
+	return &boolVal
+}
+
+// cliSNMPConfig returns the SNMP settings of a request, adding them if
+// they are not yet present.
+func cliSNMPConfig(r *APIRequest) *SNMPConfig {
+	if r.SNMP == nil {
+		r.SNMP = &SNMPConfig{}
+	}
+	return r.SNMP
+}
+
+// #######################################################################
+// Command Registry
+// #######################################################################
+
+// Flag sets shared between several commands in the registry.
+var (
+	monitorFlags = []string{FlagName, FlagMetricType, FlagMetricInterval,
+		FlagShapingEnabled, FlagAnomalyZScore, FlagFailurePolicy,
+		FlagStaleAfter, FlagHistorySize, FlagHistoryRetention, FlagSampleTime,
+		FlagSamplingMode, FlagScriptName, FlagDiskPath, FlagLocalPort,
+		FlagPeers, FlagPeerTimeout, FlagNamespace}
+	responderFlags = []string{FlagName, FlagProtocol, FlagIP, FlagPort,
+		FlagAllowedCIDRs, FlagMaxConnections, FlagMaxRequestRate, FlagRequestTimeout, FlagResponseTimeout,
+		FlagIdleTimeout, FlagDrainTimeout, FlagCommandList, FlagThresholdMode, FlagThresholdMax,
+		FlagThresholdSchedule, FlagLogState, FlagCacheFeedback, FlagKeepAlive,
+		FlagReusePort, FlagFeedbackFormat, FlagAggregation, FlagAggregationExpr,
+		FlagWeightCurve, FlagWeightCurveFactor, FlagWeightPoints, FlagMinWeight,
+		FlagMaxWeight, FlagDrainMonitor, FlagResponseTemplate,
+		FlagStatusCodes, FlagRoutes, FlagListener, FlagMatchPath,
+		FlagMatchHost, FlagMatchToken, FlagAccessLog, FlagAccessLogVerbosity,
+		FlagAccessLogSample, FlagAccessLogInterval,
+		FlagSNMPCommunity, FlagSNMPUsers, FlagSNMPBaseOID,
+		FlagNamespace}
+	sourceFlags = []string{FlagName, FlagMonitorName, FlagSourceSignificance,
+		FlagSourceMaxValue, FlagThresholdMax, FlagSourceRawThreshold,
+		FlagSourceAction}
+)
+
+// CLICommands is the registry of all actions accepted by the CLI client.
+var CLICommands = []CLICommand{
+	{
+		Action:  "run-agent",
+		Summary: "Runs the Agent interactively or from a startup script.",
+		Flags: []string{FlagNoColor, FlagInstance, FlagAllowInsecureAPI,
+			FlagJSONStartup},
+		Local: true,
+	},
+	{
+		Action:  "add",
+		Summary: "Adds a new service to the Agent.",
+		Types: []CLICommandType{
+			{"monitor", "Add a System Monitor for a given metric.", monitorFlags},
+			{"responder", "Add a Feedback Responder.", responderFlags},
+			{"source", "Attach a Monitor to a Responder as a Feedback Source.", sourceFlags},
+		},
+		Examples: []string{
+			"lbfeedback add monitor -name ram -metric-type ram",
+			"lbfeedback add source -name default -monitor ram",
+		},
+	},
+	{
+		Action:  "edit",
+		Summary: "Changes the configuration of an existing service.",
+		Types: []CLICommandType{
+			{"monitor", "Edit a System Monitor.", monitorFlags},
+			{"responder", "Edit a Feedback Responder.", responderFlags},
+			{"source", "Edit a Feedback Source within a Responder.", sourceFlags},
+		},
+		Examples: []string{
+			"lbfeedback edit responder -name default -port 3335",
+			"lbfeedback edit source -name default -monitor netconn " +
+				"-raw-threshold 15000",
+		},
+	},
+	{
+		Action: "upsert",
+		Summary: "Creates a service if it does not exist, or otherwise edits it " +
+			"to match, reporting whether it was created, updated or unchanged.",
+		Types: []CLICommandType{
+			{"monitor", "Create or edit a System Monitor.", monitorFlags},
+			{"responder", "Create or edit a Feedback Responder.", responderFlags},
+			{"source", "Create or edit a Feedback Source within a Responder.", sourceFlags},
+		},
+		Examples: []string{
+			"lbfeedback upsert monitor -name ram -metric-type ram",
+			"lbfeedback upsert source -name default -monitor ram " +
+				"-significance 0.5",
+		},
+	},
+	{
+		Action:  "delete",
+		Summary: "Deletes a service from the Agent.",
+		Types: []CLICommandType{
+			{"monitor", "Delete a System Monitor not in use by any Responder.", []string{FlagName}},
+			{"responder", "Delete a Feedback Responder.", []string{FlagName}},
+			{"source", "Detach a Feedback Source from a Responder.", []string{FlagName, FlagMonitorName}},
+		},
+	},
+	{
+		Action:  "start",
+		Summary: "Starts a stopped service, a significance analysis or a flap test.",
+		Types: []CLICommandType{
+			{"monitor", "Start a System Monitor.", []string{FlagName}},
+			{"responder", "Start a Feedback Responder.", []string{FlagName}},
+			{"analysis", "Start a significance analysis of the Feedback Sources " +
+				"of a Responder, correlating each source with a target Monitor " +
+				"(e.g. one measuring response latency).",
+				[]string{FlagName, FlagMonitorName, FlagMetricInterval}},
+			{"flap-test", "Drive a Responder through a sequence of states " +
+				"to rehearse HAProxy and alerting behaviour, then restore its " +
+				"prior state (requires 'enable-test-actions' in the config).",
+				[]string{FlagName, FlagFlapSequence}},
+		},
+		Examples: []string{
+			"lbfeedback start analysis -name default -monitor latency",
+			"lbfeedback start flap-test -name default " +
+				"-sequence offline=30s,online=1m,drain=30s",
+		},
+	},
+	{
+		Action:  "stop",
+		Summary: "Stops a running service, analysis or flap test, or the Agent itself.",
+		Types: []CLICommandType{
+			{"monitor", "Stop a System Monitor.", []string{FlagName}},
+			{"responder", "Stop a Feedback Responder.", []string{FlagName}},
+			{"analysis", "Stop a significance analysis.", []string{FlagName}},
+			{"flap-test", "Stop a flap test, restoring the prior state.",
+				[]string{FlagName}},
+			{"agent", "Stop the Agent.", nil},
+		},
+	},
+	{
+		Action:  "restart",
+		Summary: "Restarts a service, or all services within the Agent.",
+		Types: []CLICommandType{
+			{"monitor", "Restart a System Monitor.", []string{FlagName}},
+			{"responder", "Restart a Feedback Responder.", []string{FlagName}},
+			{"agent", "Restart all Agent services.", nil},
+		},
+	},
+	{
+		Action:  "status",
+		Summary: "Shows the running status and details of all services.",
+		Flags:   []string{FlagIfNoneMatch},
+		Examples: []string{
+			"lbfeedback status",
+			"lbfeedback status -output json",
+		},
+	},
+	{
+		Action:  "get",
+		Summary: "Retrieves information from the Agent.",
+		Types: []CLICommandType{
+			{"config", "Show the current Agent configuration.",
+				[]string{FlagIfNoneMatch}},
+			{"feedback", "Show the current feedback response for a Responder.", []string{FlagName}},
+			{"sources", "Show the Feedback Sources for a Responder.", []string{FlagName}},
+			{"info", "Show build and runtime details of the running Agent.", nil},
+			{"stats", "Show the internal metrics of the Agent, such as " +
+				"request counts and latencies for each Responder.", nil},
+			{"cluster", "Show the combined status of this Agent and its " +
+				"cluster peers.", nil},
+			{"headroom", "Show the estimated load headroom before thresholds " +
+				"trip, for a Responder or for all Responders.", []string{FlagName}},
+			{"events", "Show recorded events, such as state changes, forced " +
+				"states, configuration changes and Monitor anomalies, " +
+				"optionally for a single service.",
+				[]string{FlagName, FlagSince, FlagUntil, FlagDuration,
+					FlagEventTypes, FlagLimit}},
+			{"overrides", "Show the forced states active on Responders, " +
+				"and when they expire.", []string{FlagName}},
+			{"history", "Show the recent observation history of a Monitor, " +
+				"or the reported availability of a Responder if the history " +
+				"store is enabled.", []string{FlagName, FlagFormat, FlagDuration}},
+			{"analysis", "Show the source correlations and suggested " +
+				"significances from a significance analysis.", []string{FlagName}},
+			{"simulate", "Show the availability and commands a Responder " +
+				"would give for hypothetical source values, or for those " +
+				"recorded at a past time, without changing its state.",
+				[]string{FlagName, FlagValues, FlagAt}},
+		},
+		Examples: []string{
+			"lbfeedback get config",
+			"lbfeedback get history -name cpu -format sparkline",
+			"lbfeedback get history -name cpu -duration 10m",
+			"lbfeedback get events -since \"2025-06-01 03:00\" " +
+				"-until \"2025-06-01 03:30\" -event-types threshold-crossed",
+			"lbfeedback get simulate -name default -values cpu=80,ram=40",
+			"lbfeedback get simulate -name default -at \"2025-06-01 03:00\"",
+		},
+	},
+	{
+		Action:  "set",
+		Summary: "Sets Responder HAProxy command and threshold parameters, or the log level.",
+		Types: []CLICommandType{
+			{"commands", "Set the HAProxy commands and command interval.",
+				[]string{FlagName, FlagCommandList, FlagCommandInterval}},
+			{"threshold", "Set the threshold mode, score and schedule.",
+				[]string{FlagName, FlagThresholdMode, FlagThresholdMax,
+					FlagThresholdSchedule}},
+			{"log-level", "Set the logging level of the running Agent.",
+				[]string{FlagLogLevel}},
+		},
+		Examples: []string{
+			"lbfeedback set log-level -level debug",
+			"lbfeedback set threshold -name default -threshold-schedule " +
+				"\"mon,tue,wed,thu,fri 08:00-18:00=60; 22:00-06:00=90\"",
+		},
+	},
+	{
+		Action:  "force",
+		Summary: "Forces an HAProxy command state, or forces a configuration save.",
+		Types: []CLICommandType{
+			{"halt", "Force maintenance mode.", []string{FlagName, FlagDuration}},
+			{"maint", "Force maintenance mode (as 'halt').",
+				[]string{FlagName, FlagDuration}},
+			{"drain", "Force drain mode.", []string{FlagName, FlagDuration}},
+			{"online", "Force an online state.", []string{FlagName, FlagDuration}},
+			{"save-config", "Save the running configuration to disk, " +
+				"replacing the config file even if it has been modified " +
+				"externally.", nil},
+		},
+		Examples: []string{
+			"lbfeedback force halt -name default",
+			"lbfeedback force drain -name default -hosts web01,web02",
+			"lbfeedback force maint -name default -duration 2h",
+		},
+	},
+	{
+		Action:  "cancel",
+		Summary: "Cancels a forced HAProxy command state.",
+		Description: "The Responder returns to threshold-driven behaviour " +
+			"immediately, as it does when a state forced with a duration " +
+			"expires. If no name is given, all forced states are cancelled.",
+		Types: []CLICommandType{
+			{"override", "Cancel the forced state of a Responder.",
+				[]string{FlagName}},
+		},
+		Examples: []string{
+			"lbfeedback cancel override -name default",
+		},
+	},
+	{
+		Action:  "reload",
+		Summary: "Reloads the configuration file, applying any changes to it.",
+		Description: "Only the services whose configuration has changed " +
+			"are restarted. Any changes to the running configuration which " +
+			"have not been saved, because the file was modified externally, " +
+			"are discarded.",
+		Types: []CLICommandType{
+			{"config", "Reload the configuration file.", nil},
+		},
+	},
+	{
+		Action:  "rollback",
+		Summary: "Restores the previous version of the configuration.",
+		Description: "Each time the configuration is saved, the previous " +
+			"version is kept as a timestamped backup in the '" +
+			ConfigBackupDirName + "' directory. This restores and applies " +
+			"the most recent backup; repeating it restores earlier versions.",
+		Types: []CLICommandType{
+			{"config", "Restore the most recent configuration backup.", nil},
+		},
+	},
+	{
+		Action:  "export",
+		Summary: "Exports the tuning or the whole state of the Agent.",
+		Description: "A tuning profile holds the Feedback Sources, " +
+			"significances, thresholds, HAProxy commands and Monitor " +
+			"settings of the Agent, without any host-specific settings " +
+			"such as listen addresses, so that a tuning proven on one server " +
+			"can be applied to others with 'import profile'. A bundle holds " +
+			"the whole configuration, the SNMP engine state and optionally " +
+			"the learned state of each Monitor, for moving the Agent to a " +
+			"replacement host with 'import bundle'; HTTPS certificates are " +
+			"generated afresh by each Agent, so are not included.",
+		Types: []CLICommandType{
+			{"profile", "Export the tuning of a Responder and its Monitors, " +
+				"or of all services.", []string{FlagName, FlagConfigFile}},
+			{"bundle", "Export the configuration and state of the Agent as " +
+				"a tarball, for migrating it to a replacement host.",
+				[]string{FlagConfigFile, FlagExcludeKey, FlagIncludeModel}},
+		},
+		Examples: []string{
+			"lbfeedback export profile -file /tmp/web-profile.json",
+			"lbfeedback export bundle -file /tmp/agent.tar.gz -include-model",
+		},
+	},
+	{
+		Action:  "import",
+		Summary: "Applies a profile or bundle exported from another Agent.",
+		Description: "Monitors in a profile are added or replaced, and " +
+			"the tuning of each Responder in the profile is applied to the " +
+			"existing Responder of the same name. A bundle replaces the " +
+			"whole configuration, keeping the current API keys if they were " +
+			"excluded from it. The resulting configuration is validated " +
+			"and saved, and only the services which have changed are " +
+			"restarted.",
+		Types: []CLICommandType{
+			{"profile", "Apply a tuning profile from a file.",
+				[]string{FlagConfigFile}},
+			{"bundle", "Replace the configuration and state of the Agent " +
+				"with those from a bundle.",
+				[]string{FlagConfigFile, FlagRegenerateKey}},
+		},
+		Examples: []string{
+			"lbfeedback import profile -file /tmp/web-profile.json",
+			"lbfeedback import bundle -file /tmp/agent.tar.gz",
+		},
+	},
+	{
+		Action:  "apply",
+		Summary: "Applies a batch of changes from a file as one transaction.",
+		Description: "The file holds either a list of API requests which " +
+			"change the configuration (e.g. 'add', 'upsert' or 'set'), which " +
+			"are made in order, or a fragment of the configuration file, " +
+			"such as a set of Monitors and Responders, each of which is " +
+			"created or replaced. If any request fails, or the resulting " +
+			"configuration is invalid, no changes are made. The type is " +
+			"inferred from the file if omitted, and the result of each " +
+			"change is reported.",
+		Types: []CLICommandType{
+			{ApplyTypeRequests, "Make a list of API requests.",
+				[]string{FlagConfigFile}},
+			{ApplyTypeConfig, "Merge a fragment of the configuration.",
+				[]string{FlagConfigFile}},
+		},
+		Examples: []string{
+			"lbfeedback apply -f changes.json",
+			"lbfeedback apply config -f - < services.json",
+		},
+	},
+	{
+		Action:  "put",
+		Summary: "Replaces the configuration with a desired configuration.",
+		Description: "The Agent compares the desired configuration with the " +
+			"running one, and adds, edits or deletes Monitors, Responders, " +
+			"Feedback Sources and settings in dependency order so that they " +
+			"match, reporting each change. Nothing is changed if the " +
+			"configurations already match, so the same file can be applied " +
+			"repeatedly. The API keys are kept if omitted, as they are from " +
+			"'get config'.",
+		Types: []CLICommandType{
+			{"config", "Apply a desired configuration from a file.",
+				[]string{FlagConfigFile}},
+		},
+		Examples: []string{
+			"lbfeedback put config -file desired-config.json",
+		},
+	},
+	{
+		Action:  "validate",
+		Summary: "Checks a configuration for errors without applying it.",
+		Description: "Performs a dry run of loading a configuration, " +
+			"initialising its Monitors and Responders without starting them, " +
+			"and reports any errors and warnings found. The running " +
+			"configuration is not changed.",
+		Types: []CLICommandType{
+			{"config", "Validate a candidate configuration file.", []string{FlagConfigFile}},
+		},
+		Examples: []string{
+			"lbfeedback validate config -file /tmp/agent-config.json",
+		},
+	},
+	{
+		Action:  "check",
+		Summary: "Tests the configuration without the Agent running.",
+		Description: "Loads the configuration file as the Agent would when " +
+			"started, initialises each Monitor and Responder without " +
+			"starting them (so no ports are bound), samples each metric " +
+			"once, and reports whether each passed along with any errors " +
+			"and warnings. The exit status is " +
+			strconv.Itoa(ExitStatusFailed) + " if any check failed, so " +
+			"that it may be used by installation scripts and in CI.",
+		Flags: []string{FlagInstance, FlagConfigFile, FlagOutput},
+		Local: true,
+		Examples: []string{
+			"lbfeedback check",
+			"lbfeedback check -file /tmp/agent-config.json -output json",
+		},
+	},
+	{
+		Action:  "send",
+		Summary: "Sends the configured online or offline HAProxy commands.",
+		Types: []CLICommandType{
+			{"online", "Send the configured online commands.", []string{FlagName}},
+			{"offline", "Send the configured offline commands.", []string{FlagName}},
+		},
+	},
+	{
+		Action:  "watch",
+		Summary: "Shows a continuously updating view of the services.",
+		Description: "The view shows the latest value of each Monitor, the " +
+			"availability and command state of each Responder, and any " +
+			"recent events, updated as they change until Ctrl-C is pressed. " +
+			"If the output is not a terminal, a line is written for each " +
+			"change instead.",
+		Types: []CLICommandType{
+			{"status", "Watch all of the services.", []string{FlagMetricInterval}},
+			{"feedback", "Watch a Responder and the Monitors which are its " +
+				"sources.", []string{FlagName, FlagMetricInterval}},
+		},
+		Local: true,
+		Examples: []string{
+			"lbfeedback watch status",
+			"lbfeedback watch feedback -name default -interval-ms 500",
+		},
+	},
+	{
+		Action:  "shell",
+		Summary: "Opens an interactive shell for entering commands.",
+		Description: "Commands are entered without the program name, and " +
+			"are sent to the same Agent over a single connection. The up and " +
+			"down arrow keys recall the command history, and the tab key " +
+			"completes actions, types, parameters and service names. Enter " +
+			"'exit' or press Ctrl-D to leave the shell.",
+		Flags: []string{FlagInstance, FlagAPIHost, FlagAPIPort, FlagAPIKey,
+			FlagCAFile, FlagInsecure},
+		Local: true,
+		Examples: []string{
+			"lbfeedback shell",
+			"lbfeedback shell -api-host 10.0.0.11 -api-key file:/root/key " +
+				"-insecure",
+		},
+	},
+	{
+		Action:  "help",
+		Summary: "Shows this help, or detailed help for a given action.",
+		Local:   true,
+		Examples: []string{
+			"lbfeedback help add",
+		},
+	},
+	{
+		Action:  "completion",
+		Summary: "Outputs a completion script for a shell.",
+		Description: "The script completes actions, types, parameters and " +
+			"the names of the services of the local Agent, and may be " +
+			"installed in the completion directory of the shell or sourced " +
+			"from its startup file.",
+		Types: []CLICommandType{
+			{CompletionBash, "Output a completion script for bash.", nil},
+			{CompletionZsh, "Output a completion script for zsh.", nil},
+			{CompletionFish, "Output a completion script for fish.", nil},
+		},
+		Local: true,
+		Examples: []string{
+			"lbfeedback completion bash > /etc/bash_completion.d/lbfeedback",
+			"lbfeedback completion fish > ~/.config/fish/completions/lbfeedback.fish",
+		},
+	},
+	{
+		Action:  "manpage",
+		Summary: "Outputs a manual page for this program in troff format.",
+		Local:   true,
+	},
+	{
+		Action: "openapi",
+		Summary: "Outputs the OpenAPI specification of the Agent API in JSON " +
+			"format, as also served by API Responders at '" + OpenAPIPath +
+			"'.",
+		Local: true,
+	},
+}
+
+// GetCLICommand returns the registry entry for a given CLI action.
+func GetCLICommand(action string) (command *CLICommand, err error) {
+	for i := range CLICommands {
+		if CLICommands[i].Action == action {
+			command = &CLICommands[i]
+			return
+		}
+	}
+	err = errors.New("unknown action '" + action + "'; " +
+		"use the 'help' command for syntax")
+	return
+}
+
+// GetCLIFlag returns the registry entry for a given CLI or agent flag name.
+func GetCLIFlag(name string) (flag *CLIFlag) {
+	for i := range CLIFlags {
+		if CLIFlags[i].Name == name {
+			return &CLIFlags[i]
+		}
+	}
+	for i := range AgentFlags {
+		if AgentFlags[i].Name == name {
+			return &AgentFlags[i]
+		}
+	}
+	return
+}
+
+// cliFlagValue is a [flag.Value] for registry flags, which allows boolean
+// flags to be specified without a value (e.g. '--no-color').
+type cliFlagValue struct {
+	value  string
+	isBool bool
+}
+
+func (v *cliFlagValue) String() string {
+	return v.value
+}
+
+func (v *cliFlagValue) Set(str string) error {
+	v.value = str
+	return nil
+}
+
+func (v *cliFlagValue) IsBoolFlag() bool {
+	return v.isBool
+}
+
+// ParseAgentArguments parses the arguments following the 'run-agent'
+// action into a set of [AgentOptions] using the agent flag registry.
+func ParseAgentArguments(argv []string) (options AgentOptions, err error) {
+	agentArgs := flag.NewFlagSet("", flag.ContinueOnError)
+	agentArgs.Usage = func() {}
+	agentArgs.SetOutput(io.Discard)
+	// Agent options may also be set by flags in the client registry which
+	// are shared with the client, such as the instance name.
+	var optionFlags []CLIFlag
+	for _, cliFlag := range CLIFlags {
+		if cliFlag.applyOption != nil {
+			optionFlags = append(optionFlags, cliFlag)
+		}
+	}
+	optionFlags = append(optionFlags, AgentFlags...)
+	values := make(map[string]*cliFlagValue)
+	for _, agentFlag := range optionFlags {
+		values[agentFlag.Name] = &cliFlagValue{isBool: agentFlag.IsBool}
+		agentArgs.Var(values[agentFlag.Name], agentFlag.Name, "")
+	}
+	err = agentArgs.Parse(argv)
+	if err != nil {
+		err = errors.New("one or more agent parameters are invalid; " +
+			"use 'help run-agent' for syntax")
+		return
+	}
+	agentArgs.Visit(func(f *flag.Flag) {
+		for _, agentFlag := range optionFlags {
+			if agentFlag.Name == f.Name {
+				agentFlag.applyOption(&options,
+					strings.TrimSpace(values[f.Name].value))
+			}
+		}
+	})
+	if options.Instance != "" {
+		options.Instance, err = ParseInstanceName(options.Instance)
+	}
+	return
+}
+
+// ValidateType checks that a type is valid for this CLI command.
+func (cmd *CLICommand) ValidateType(actionType string) (err error) {
+	if len(cmd.Types) == 0 {
+		if actionType != "" {
+			err = errors.New("action '" + cmd.Action +
+				"' does not accept a type")
+		}
+		return
+	}
+	for _, t := range cmd.Types {
+		if t.Name == actionType {
+			return
+		}
+	}
+	err = errors.New("invalid type '" + actionType + "' for action '" +
+		cmd.Action + "'; expected one of: " +
+		strings.Join(cmd.TypeNames(), ", "))
+	return
+}
+
+// TypeNames returns the names of all types accepted by this CLI command.
+func (cmd *CLICommand) TypeNames() (names []string) {
+	for _, t := range cmd.Types {
+		names = append(names, t.Name)
+	}
+	return
+}
+
+// FlagNames returns the sorted, de-duplicated set of flag names accepted
+// by this CLI command across all of its types.
+func (cmd *CLICommand) FlagNames() (names []string) {
+	seen := make(map[string]bool)
+	all := append([]string{}, cmd.Flags...)
+	for _, t := range cmd.Types {
+		all = append(all, t.Flags...)
+	}
+	for _, name := range all {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+// #######################################################################
+// Help and Manual Page Generation
+// #######################################################################
+
+const (
+	helpIndent     = 2
+	helpFlagColumn = 22
+	helpWrapWidth  = 78
+)
+
+// GenerateHelpText builds the brief CLI syntax summary from the registry.
+func GenerateHelpText() string {
+	var b strings.Builder
+	b.WriteString("SYNTAX:\n  " + AppIdentifier + " [action] [type] [parameters]\n\n")
+	b.WriteString("ACTIONS:\n")
+	for _, cmd := range CLICommands {
+		b.WriteString("  " + cmd.Action + ": ")
+		if len(cmd.Types) > 0 {
+			b.WriteString(strings.Join(cmd.TypeNames(), ", ") + "\n")
+			b.WriteString(WrapText(cmd.Summary, helpIndent+3, helpWrapWidth) + "\n")
+		} else {
+			b.WriteString(cmd.Summary + "\n")
+		}
+	}
+	b.WriteString("\nNote that the running Agent service will automatically save any " +
+		"configuration\nchanges to its JSON configuration file if they are " +
+		"successful, and no service\nrestart is required as they are applied " +
+		"immediately.\n\n")
+	b.WriteString("PARAMETERS:\n")
+	for _, flag := range CLIFlags {
+		b.WriteString(formatFlagHelp(&flag))
+	}
+	b.WriteString("\nAGENT PARAMETERS (run-agent):\n")
+	for _, flag := range AgentFlags {
+		b.WriteString(formatFlagHelp(&flag))
+	}
+	b.WriteString("\nFor detailed help on an action, use '" + AppIdentifier +
+		" help [action]'.\n\n")
+	b.WriteString("Please note that this is an extremely brief outline of the available\n" +
+		"CLI configuration commands for controlling the Feedback Agent. For\n" +
+		"further information, please consult the accompanying documentation or\n" +
+		"contact Loadbalancer.org Support for assistance.")
+	return b.String()
+}
+
+// GenerateCommandHelpText builds the detailed help for a single CLI action.
+func GenerateCommandHelpText(action string) (text string, err error) {
+	cmd, err := GetCLICommand(action)
+	if err != nil {
+		return
+	}
+	var b strings.Builder
+	b.WriteString("ACTION: " + cmd.Action + "\n")
+	b.WriteString(WrapText(cmd.Summary, helpIndent, helpWrapWidth) + "\n")
+	if cmd.Description != "" {
+		b.WriteString("\n" + WrapText(cmd.Description, helpIndent, helpWrapWidth) + "\n")
+	}
+	b.WriteString("\nSYNTAX:\n  " + AppIdentifier + " " + cmd.Action)
+	if len(cmd.Types) > 0 {
+		b.WriteString(" [" + strings.Join(cmd.TypeNames(), "|") + "]")
+	}
+	if len(cmd.FlagNames()) > 0 {
+		b.WriteString(" [parameters]")
+	}
+	b.WriteString("\n")
+	if len(cmd.Types) > 0 {
+		b.WriteString("\nTYPES:\n")
+		for _, t := range cmd.Types {
+			b.WriteString(formatHelpColumns(t.Name, t.Summary))
+			if len(t.Flags) > 0 {
+				b.WriteString(formatHelpColumns("",
+					"Parameters: -"+strings.Join(t.Flags, ", -")))
+			}
+		}
+	}
+	if len(cmd.FlagNames()) > 0 {
+		b.WriteString("\nPARAMETERS:\n")
+		for _, name := range cmd.FlagNames() {
+			flag := GetCLIFlag(name)
+			if flag != nil {
+				b.WriteString(formatFlagHelp(flag))
+			}
+		}
+	}
+	if len(cmd.Examples) > 0 {
+		b.WriteString("\nEXAMPLES:\n")
+		for _, example := range cmd.Examples {
+			b.WriteString("  " + example + "\n")
+		}
+	}
+	text = strings.TrimRight(b.String(), "\n")
+	return
+}
+
+// formatFlagHelp formats the help text for a single flag and its options.
+func formatFlagHelp(flag *CLIFlag) string {
+	text := formatHelpColumns("-"+flag.Name, flag.Description)
+	for _, opt := range flag.Options {
+		text += formatHelpColumns("", "'"+opt.Value+"' "+opt.Description)
+	}
+	return text
+}
+
+// formatHelpColumns formats a name and description into two columns,
+// wrapping the description to the configured width.
+func formatHelpColumns(name string, description string) string {
+	wrapped := WrapText(description, helpFlagColumn, helpWrapWidth)
+	prefix := strings.Repeat(" ", helpIndent) + name
+	if len(prefix) >= helpFlagColumn {
+		return prefix + "\n" + wrapped + "\n"
+	}
+	return prefix + wrapped[len(prefix):] + "\n"
+}
+
+// GenerateManPage builds a manual page in troff (man macro) format from
+// the command registry.
+func GenerateManPage() string {
+	var b strings.Builder
+	b.WriteString(".TH " + strings.ToUpper(AppIdentifier) + " 1 \"" +
+		time.Now().Format("2006-01-02") + "\" \"" + VersionString +
+		"\" \"" + ApplicationName + "\"\n")
+	b.WriteString(".SH NAME\n" + AppIdentifier + " \\- " + ApplicationName + "\n")
+	b.WriteString(".SH SYNOPSIS\n.B " + AppIdentifier +
+		"\n.I action\n[\\fItype\\fR] [\\fIparameters\\fR]\n")
+	b.WriteString(".SH DESCRIPTION\n" + manEscape(ApplicationName) +
+		" runs as a service reporting system load to load balancers, and " +
+		"acts as a command line client for its API. Configuration changes " +
+		"made through the client are applied immediately and saved to the " +
+		"Agent's JSON configuration file.\n")
+	b.WriteString(".SH ACTIONS\n")
+	for _, cmd := range CLICommands {
+		b.WriteString(".TP\n.B " + cmd.Action + "\n" + manEscape(cmd.Summary) + "\n")
+		for _, t := range cmd.Types {
+			b.WriteString(".RS\n.TP\n.I " + t.Name + "\n" + manEscape(t.Summary) + "\n.RE\n")
+		}
+	}
+	b.WriteString(".SH OPTIONS\n")
+	for _, flag := range append(append([]CLIFlag{}, CLIFlags...), AgentFlags...) {
+		b.WriteString(".TP\n.BI \\-" + manEscape(flag.Name) + " \" value\"\n" +
+			manEscape(flag.Description) + "\n")
+		for _, opt := range flag.Options {
+			b.WriteString(".RS\n.TP\n.B " + manEscape(opt.Value) + "\n" +
+				manEscape(opt.Description) + "\n.RE\n")
+		}
+	}
+	b.WriteString(".SH EXIT STATUS\n" +
+		".TP\n.B " + strconv.Itoa(ExitStatusNormal) + "\nThe request succeeded.\n" +
+		".TP\n.B " + strconv.Itoa(ExitStatusError) + "\nAn error occurred in " +
+		"the client, such as an invalid parameter.\n" +
+		".TP\n.B " + strconv.Itoa(ExitStatusFailed) + "\nThe Agent reported " +
+		"that the request failed.\n" +
+		".TP\n.B " + strconv.Itoa(ExitStatusUnreachable) + "\nThe Agent " +
+		"could not be reached.\n")
+	b.WriteString(".SH EXAMPLES\n")
+	for _, cmd := range CLICommands {
+		for _, example := range cmd.Examples {
+			b.WriteString(".PP\n.nf\n" + manEscape(example) + "\n.fi\n")
+		}
+	}
+	b.WriteString(".SH COPYRIGHT\nCopyright (C) " + CopyrightYear +
+		" Loadbalancer.org Limited. Licensed under the GNU General Public " +
+		"License v3.\n")
+	return b.String()
+}
+
+// manEscape escapes a string for inclusion in a troff document.
+func manEscape(str string) string {
+	str = strings.ReplaceAll(str, "\\", "\\\\")
+	str = strings.ReplaceAll(str, "-", "\\-")
+	if strings.HasPrefix(str, ".") || strings.HasPrefix(str, "'") {
+		str = "\\&" + str
+	}
+	return str
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
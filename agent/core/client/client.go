@@ -0,0 +1,489 @@
+// client.go
+// Go Client Library for the Feedback Agent API
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package client provides typed access to the API of a Loadbalancer.org
+// Feedback Agent, so that Go tooling can drive agents without handling the
+// underlying HTTP and JSON itself.
+//
+//	c, err := client.NewLocal("")
+//	if err != nil {
+//		return err
+//	}
+//	status, err := c.Status(ctx)
+package client
+
+import (
+	"context"
+	"crypto/x509"
+	"net"
+	"strings"
+	"time"
+
+	agent "github.com/loadbalancerorg/lbfeedback/agent/core"
+)
+
+// Request and Response are the API request and response objects.
+type (
+	Request  = agent.APIRequest
+	Response = agent.APIResponse
+)
+
+// APIError is returned when the agent reports that a request has failed.
+type APIError struct {
+	Name     string
+	Message  string
+	Response *Response
+}
+
+func (err *APIError) Error() string {
+	return err.Message
+}
+
+// Client sends requests to the API of a Feedback Agent.
+type Client struct {
+	api *agent.APIClient
+}
+
+// Option configures a [Client].
+type Option func(api *agent.APIClient)
+
+// WithRetries makes a number of further attempts if a connection to the
+// API cannot be established, waiting for a delay before the first of these
+// which is doubled for each subsequent attempt.
+func WithRetries(retries int, delay time.Duration) Option {
+	return func(api *agent.APIClient) {
+		api.Retries = retries
+		api.RetryDelay = delay
+	}
+}
+
+// WithTimeout sets the time limit for each request, including retries.
+func WithTimeout(timeout time.Duration) Option {
+	return func(api *agent.APIClient) {
+		api.Timeout = timeout
+	}
+}
+
+// WithPinnedKeys only accepts an API certificate with one of the public
+// keys given as SHA-256 fingerprints (hex, optionally colon-separated).
+// Note that the agent generates a new key each time it renews its own
+// self-signed certificate, so this is only of use with a fixed
+// certificate.
+func WithPinnedKeys(fingerprints ...string) Option {
+	return func(api *agent.APIClient) {
+		api.PinnedKeys = fingerprints
+	}
+}
+
+// WithCAFile verifies the API certificate, and its host name, against the
+// certificate authorities in a PEM file; if the file cannot be loaded, no
+// certificate is accepted.
+func WithCAFile(filePath string) Option {
+	return func(api *agent.APIClient) {
+		pool, err := agent.LoadCAFile(filePath)
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		api.RootCAs = pool
+	}
+}
+
+// New creates a client for the API at an address ('host:port') using an
+// API key, which may be the main key or that of a namespace.
+func New(address string, key string, options ...Option) (
+	client *Client, err error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return
+	}
+	client = newClient(agent.APIConfig{
+		IPAddress: host,
+		Port:      port,
+		Key:       key,
+	}, options)
+	return
+}
+
+// NewLocal creates a client for the agent on this host, or a named instance
+// of it, reading the API address and key from its configuration file.
+func NewLocal(instance string, options ...Option) (client *Client, err error) {
+	config, err := agent.LoadLocalAPIConfig(instance)
+	if err != nil {
+		return
+	}
+	client = newClient(config, options)
+	return
+}
+
+func newClient(config agent.APIConfig, options []Option) (client *Client) {
+	client = &Client{api: agent.NewAPIClient(config)}
+	for _, option := range options {
+		option(client.api)
+	}
+	return
+}
+
+// Do sends a request to the API, returning an [APIError] if the agent
+// reports that it failed.
+func (client *Client) Do(ctx context.Context, request *Request) (
+	response *Response, err error) {
+	response, _, err = client.api.Send(ctx, request)
+	if err != nil {
+		return
+	}
+	if !response.Success {
+		err = &APIError{
+			Name:     response.Error,
+			Message:  response.Message,
+			Response: response,
+		}
+	}
+	return
+}
+
+// do sends a request with an action, type and target name.
+func (client *Client) do(ctx context.Context, action string, actionType string,
+	name string) (response *Response, err error) {
+	return client.Do(ctx, &Request{
+		Action:     action,
+		Type:       actionType,
+		TargetName: name,
+	})
+}
+
+// #######################################################################
+// Typed Requests
+// #######################################################################
+
+// Status returns the running status of each service.
+func (client *Client) Status(ctx context.Context) (
+	status []agent.APIServiceStatus, err error) {
+	response, err := client.do(ctx, "status", "", "")
+	if err == nil {
+		status = response.ServiceStatus
+	}
+	return
+}
+
+// GetConfig returns the current configuration of the agent.
+func (client *Client) GetConfig(ctx context.Context) (
+	config *agent.FeedbackAgent, err error) {
+	response, err := client.do(ctx, "get", "config", "")
+	if err == nil {
+		config = response.AgentConfig
+	}
+	return
+}
+
+// GetInfo returns the build and runtime details of the agent.
+func (client *Client) GetInfo(ctx context.Context) (
+	info *agent.APIAgentInfo, err error) {
+	response, err := client.do(ctx, "get", "info", "")
+	if err == nil {
+		info = response.AgentInfo
+	}
+	return
+}
+
+// GetStats returns the internal metrics of the agent.
+func (client *Client) GetStats(ctx context.Context) (
+	stats *agent.AgentStats, err error) {
+	response, err := client.do(ctx, "get", "stats", "")
+	if err == nil {
+		stats = response.Stats
+	}
+	return
+}
+
+// GetCluster returns the status of the agent and of each of its cluster
+// peers.
+func (client *Client) GetCluster(ctx context.Context) (
+	nodes []agent.ClusterNodeStatus, err error) {
+	response, err := client.do(ctx, "get", "cluster", "")
+	if err == nil {
+		nodes = response.Cluster
+	}
+	return
+}
+
+// GetFeedback returns the current feedback response of a Responder.
+func (client *Client) GetFeedback(ctx context.Context, responder string) (
+	feedback string, err error) {
+	response, err := client.do(ctx, "get", "feedback", responder)
+	if err == nil {
+		feedback = response.Output
+	}
+	return
+}
+
+// GetHeadroom returns the estimated headroom of a Responder, or of all
+// Responders if no name is given.
+func (client *Client) GetHeadroom(ctx context.Context, responder string) (
+	reports []agent.HeadroomReport, err error) {
+	response, err := client.do(ctx, "get", "headroom", responder)
+	if err == nil {
+		reports = response.Headroom
+	}
+	return
+}
+
+// GetEvents returns the events recently raised within the agent.
+func (client *Client) GetEvents(ctx context.Context) (
+	events []agent.AgentEvent, err error) {
+	response, err := client.do(ctx, "get", "events", "")
+	if err == nil {
+		events = response.Events
+	}
+	return
+}
+
+// QueryEvents returns the recorded events raised by a service (or by any,
+// if no name is given) between two times (either of which may be zero),
+// of the given types (or of any), limited to a number of the most recent
+// (or to the default if zero).
+func (client *Client) QueryEvents(ctx context.Context, name string,
+	since time.Time, until time.Time, types []string, limit int) (
+	events []agent.AgentEvent, err error) {
+	request := &Request{Action: "get", Type: "events", TargetName: name}
+	if !since.IsZero() {
+		value := since.Format(time.RFC3339Nano)
+		request.Since = &value
+	}
+	if !until.IsZero() {
+		value := until.Format(time.RFC3339Nano)
+		request.Until = &value
+	}
+	if len(types) > 0 {
+		value := strings.Join(types, ",")
+		request.EventTypes = &value
+	}
+	if limit > 0 {
+		request.Limit = &limit
+	}
+	response, err := client.Do(ctx, request)
+	if err == nil {
+		events = response.Events
+	}
+	return
+}
+
+// Start, Stop and Restart control a service ("monitor" or "responder").
+func (client *Client) Start(ctx context.Context, serviceType string,
+	name string) (err error) {
+	_, err = client.do(ctx, "start", serviceType, name)
+	return
+}
+
+func (client *Client) Stop(ctx context.Context, serviceType string,
+	name string) (err error) {
+	_, err = client.do(ctx, "stop", serviceType, name)
+	return
+}
+
+func (client *Client) Restart(ctx context.Context, serviceType string,
+	name string) (err error) {
+	_, err = client.do(ctx, "restart", serviceType, name)
+	return
+}
+
+// SetThreshold sets the threshold mode and score of a Responder; an empty
+// mode or a negative score leaves that setting unchanged.
+func (client *Client) SetThreshold(ctx context.Context, responder string,
+	mode string, score int) (err error) {
+	request := &Request{
+		Action:     "set",
+		Type:       "threshold",
+		TargetName: responder,
+	}
+	if mode != "" {
+		request.ThresholdMode = &mode
+	}
+	if score >= 0 {
+		request.ThresholdScore = &score
+	}
+	_, err = client.Do(ctx, request)
+	return
+}
+
+// SetCommands sets the HAProxy commands of a Responder.
+func (client *Client) SetCommands(ctx context.Context, responder string,
+	commands string) (err error) {
+	_, err = client.Do(ctx, &Request{
+		Action:      "set",
+		Type:        "commands",
+		TargetName:  responder,
+		CommandList: &commands,
+	})
+	return
+}
+
+// Send sends the configured online or offline HAProxy commands for a
+// Responder, or for all Responders if no name is given.
+func (client *Client) Send(ctx context.Context, responder string,
+	online bool) (err error) {
+	state := "offline"
+	if online {
+		state = "online"
+	}
+	_, err = client.do(ctx, "send", state, responder)
+	return
+}
+
+// Force forces a state ("halt", "drain" or "online") for a Responder, or
+// for all Responders if no name is given.
+func (client *Client) Force(ctx context.Context, responder string,
+	state string) (err error) {
+	_, err = client.do(ctx, "force", state, responder)
+	return
+}
+
+// ForceFor forces a state for a Responder, or for all Responders if no
+// name is given, which expires after a duration.
+func (client *Client) ForceFor(ctx context.Context, responder string,
+	state string, duration time.Duration) (err error) {
+	period := duration.String()
+	_, err = client.Do(ctx, &Request{
+		Action:     "force",
+		Type:       state,
+		TargetName: responder,
+		Duration:   &period,
+	})
+	return
+}
+
+// GetOverrides returns the forced states active on a Responder, or on all
+// Responders if no name is given.
+func (client *Client) GetOverrides(ctx context.Context, responder string) (
+	overrides []agent.ForcedOverride, err error) {
+	response, err := client.do(ctx, "get", "overrides", responder)
+	if err == nil {
+		overrides = response.Overrides
+	}
+	return
+}
+
+// CancelOverride cancels the forced state of a Responder, or of all
+// Responders if no name is given, returning it to threshold-driven
+// behaviour.
+func (client *Client) CancelOverride(ctx context.Context,
+	responder string) (err error) {
+	_, err = client.do(ctx, "cancel", "override", responder)
+	return
+}
+
+// #######################################################################
+// Watching for Changes
+// #######################################################################
+
+// StatusUpdate is delivered by [Client.WatchStatus] when the status of the
+// services changes, or when it cannot be obtained.
+type StatusUpdate struct {
+	Status []agent.APIServiceStatus
+	Err    error
+}
+
+// WatchStatus polls the status of the services at an interval until the
+// context is cancelled, delivering it initially and whenever it changes
+// thereafter, and closing the channel when done. Only a tag is transferred
+// when nothing has changed.
+func (client *Client) WatchStatus(ctx context.Context,
+	interval time.Duration) <-chan StatusUpdate {
+	updates := make(chan StatusUpdate)
+	go func() {
+		defer close(updates)
+		etag := ""
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			request := &Request{Action: "status"}
+			if etag != "" {
+				request.IfNoneMatch = &etag
+			}
+			response, err := client.Do(ctx, request)
+			if ctx.Err() != nil {
+				return
+			}
+			var update *StatusUpdate
+			if err != nil {
+				update = &StatusUpdate{Err: err}
+			} else if !response.NotModified {
+				etag = response.ETag
+				update = &StatusUpdate{Status: response.ServiceStatus}
+			}
+			if update != nil {
+				select {
+				case updates <- *update:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return updates
+}
+
+// WatchEvents polls the events raised within the agent at an interval until
+// the context is cancelled, delivering each new event once, and closing the
+// channel when done. Errors in polling are skipped.
+func (client *Client) WatchEvents(ctx context.Context,
+	interval time.Duration) <-chan agent.AgentEvent {
+	events := make(chan agent.AgentEvent)
+	go func() {
+		defer close(events)
+		// Only events raised after watching began are delivered.
+		since := time.Now()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			recent, err := client.GetEvents(ctx)
+			if ctx.Err() != nil {
+				return
+			} else if err != nil {
+				continue
+			}
+			for _, event := range recent {
+				if !event.Time.After(since) {
+					continue
+				}
+				since = event.Time
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,344 @@
+// cluster.go
+// Peer Awareness and Configuration Replication between Agents
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Agents on a pool of real servers can be configured as a cluster, each
+// listing the APIs of the others as its peers. Changes made through the API
+// to the monitors, Responders and sources of one agent are then replicated
+// to its peers by sending them the same request, so that their configs
+// remain the same without being edited by hand on each server; the
+// combined status of all agents is shown by 'get cluster'.
+//
+// A replicated request is marked as such, so that it is not replicated
+// again by the peers. Requests are delivered to each peer in order, in the
+// background, and any failure (e.g. if a peer is down, or its config has
+// diverged so that the change cannot be applied) is raised as an event.
+// Replication only covers changes made whilst the agents are running; the
+// config files of the agents should be the same when the cluster is set up.
+
+const (
+	// Default time allowed for each request to a peer.
+	DefaultClusterTimeout = 5 * time.Second
+	// Number of changes which can be waiting for delivery to each peer;
+	// further changes are not replicated to that peer until it catches up.
+	ClusterQueueSize = 256
+	// Types of event raised by the cluster.
+	EventTypeReplicationFailed = "replication-failed"
+)
+
+// ClusterConfig holds the cluster settings, which enable clustering if
+// present in the config. The peers are the API addresses ('host:port') of
+// the other agents; the key is the API key used for them (which may be a
+// secret reference), defaulting to the API key of this agent.
+type ClusterConfig struct {
+	Peers              []string `json:"peers"`
+	Key                string   `json:"key,omitempty"`
+	Timeout            Duration `json:"timeout,omitempty"`
+	DisableReplication bool     `json:"disable-replication,omitempty"`
+}
+
+// Validate checks the cluster settings, returning the resolved key.
+func (config *ClusterConfig) Validate() (key string, err error) {
+	if len(config.Peers) == 0 {
+		err = errors.New("no cluster peers specified")
+		return
+	}
+	for _, peer := range config.Peers {
+		if _, _, splitErr := net.SplitHostPort(peer); splitErr != nil {
+			err = errors.New("invalid cluster peer '" + peer +
+				"'; must be in the form 'host:port'")
+			return
+		}
+	}
+	if config.Timeout < 0 {
+		err = errors.New("cluster timeout cannot be negative")
+		return
+	}
+	key, err = ResolveSecret(config.Key)
+	if err != nil {
+		err = errors.New("cannot resolve cluster key: " + err.Error())
+	}
+	return
+}
+
+// ClusterNodeStatus describes the status of an agent in the cluster.
+type ClusterNodeStatus struct {
+	Node      string             `json:"node"`
+	Local     bool               `json:"local,omitempty"`
+	Reachable bool               `json:"reachable"`
+	Version   string             `json:"version,omitempty"`
+	Error     string             `json:"error,omitempty"`
+	Services  []APIServiceStatus `json:"services,omitempty"`
+	// Number of changes waiting to be replicated to the peer.
+	Pending int `json:"pending-changes,omitempty"`
+}
+
+// #######################################################################
+// Cluster
+// #######################################################################
+
+// Cluster holds the peers of this agent.
+type Cluster struct {
+	config ClusterConfig
+	key    string
+	peers  []*clusterPeer
+	cancel context.CancelFunc
+	wait   sync.WaitGroup
+}
+
+// clusterPeer is another agent in the cluster, with its queue of changes
+// awaiting replication.
+type clusterPeer struct {
+	address string
+	client  *APIClient
+	queue   chan *APIRequest
+}
+
+// StartCluster validates the cluster settings and starts replicating to
+// the peers.
+func (agent *FeedbackAgent) StartCluster(config ClusterConfig) (
+	cluster *Cluster, err error) {
+	key, err := config.Validate()
+	if err != nil {
+		return
+	}
+	if key == "" {
+		key = agent.apiKey
+	}
+	timeout := time.Duration(config.Timeout)
+	if timeout == 0 {
+		timeout = DefaultClusterTimeout
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cluster = &Cluster{config: config, key: key, cancel: cancel}
+	for _, address := range config.Peers {
+		host, port, _ := net.SplitHostPort(address)
+		client := NewAPIClient(APIConfig{IPAddress: host, Port: port,
+			Key: key})
+		client.Timeout = timeout
+		peer := &clusterPeer{
+			address: address,
+			client:  client,
+			queue:   make(chan *APIRequest, ClusterQueueSize),
+		}
+		cluster.peers = append(cluster.peers, peer)
+		cluster.wait.Add(1)
+		go func() {
+			defer cluster.wait.Done()
+			agent.runReplication(ctx, peer)
+		}()
+	}
+	logrus.Info("Clustering with " + strconv.Itoa(len(cluster.peers)) +
+		" peers.")
+	return
+}
+
+// Stop stops replicating to the peers, discarding any changes not yet
+// delivered.
+func (cluster *Cluster) Stop() {
+	cluster.cancel()
+	cluster.wait.Wait()
+}
+
+// runReplication delivers the changes queued for a peer until cancelled.
+func (agent *FeedbackAgent) runReplication(ctx context.Context,
+	peer *clusterPeer) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case request := <-peer.queue:
+			response, _, err := peer.client.Send(ctx, request)
+			if ctx.Err() != nil {
+				return
+			}
+			if err == nil && !response.Success {
+				err = errors.New(response.Message)
+			}
+			if err != nil {
+				agent.raiseReplicationFailure(peer, request, err)
+			}
+		}
+	}
+}
+
+// raiseReplicationFailure raises an event for a change which could not be
+// replicated to a peer.
+func (agent *FeedbackAgent) raiseReplicationFailure(peer *clusterPeer,
+	request *APIRequest, err error) {
+	agent.RaiseEvent(AgentEvent{
+		Type:        EventTypeReplicationFailed,
+		ServiceType: request.Type,
+		ServiceName: request.TargetName,
+		Message: "Failed to replicate '" + request.Action + " " +
+			request.Type + "' for '" + request.TargetName + "' to peer " +
+			peer.address + ": " + err.Error(),
+		Fields: map[string]any{"peer": peer.address},
+	})
+}
+
+// isReplicated returns whether a request changes the config of the
+// services, and so is replicated to the peers if it succeeds.
+func isReplicated(request *APIRequest) bool {
+	switch request.Action {
+	case "add", "edit", "delete", "upsert":
+		switch request.Type {
+		case "monitor", "responder", "source":
+			return true
+		}
+	case "set":
+		switch request.Type {
+		case "commands", "cmd", "threshold":
+			return true
+		}
+	case "apply":
+		return true
+	}
+	return false
+}
+
+// replicateRequest queues a request which has changed the config for
+// delivery to each peer, unless it was itself replicated from a peer.
+func (agent *FeedbackAgent) replicateRequest(request *APIRequest) {
+	if agent.cluster == nil || agent.cluster.config.DisableReplication ||
+		request.Replicated || !isReplicated(request) {
+		return
+	}
+	replica := *request
+	replica.APIKey = ""
+	replica.IfNoneMatch = nil
+	replica.Replicated = true
+	// A service added with a namespace key is placed in that namespace,
+	// which must be given explicitly as the peers use the main key.
+	if request.namespace != "" && replica.Namespace == nil {
+		namespace := request.namespace
+		replica.Namespace = &namespace
+	}
+	for _, peer := range agent.cluster.peers {
+		// Each peer has its own copy, as the key is set when it is sent.
+		peerReplica := replica
+		select {
+		case peer.queue <- &peerReplica:
+		default:
+			agent.raiseReplicationFailure(peer, &peerReplica,
+				errors.New("too many changes are waiting for delivery"))
+		}
+	}
+}
+
+// GetClusterStatus returns the status of this agent and of each of its
+// peers, which are queried concurrently.
+func (agent *FeedbackAgent) GetClusterStatus() (
+	nodes []ClusterNodeStatus, err error) {
+	if agent.cluster == nil {
+		err = errors.New("clustering is not enabled")
+		return
+	}
+	nodes = make([]ClusterNodeStatus, len(agent.cluster.peers)+1)
+	nodes[0] = ClusterNodeStatus{
+		Node:      "local",
+		Local:     true,
+		Reachable: true,
+		Version:   VersionString,
+		Services:  agent.GetServiceStatusArray(""),
+	}
+	wait := sync.WaitGroup{}
+	for i, peer := range agent.cluster.peers {
+		i, peer := i, peer
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			node := ClusterNodeStatus{
+				Node:    peer.address,
+				Pending: len(peer.queue),
+			}
+			response, _, sendErr := peer.client.Send(context.Background(),
+				&APIRequest{Action: "status"})
+			if sendErr == nil && !response.Success {
+				sendErr = errors.New(response.Message)
+			}
+			if sendErr != nil {
+				node.Error = sendErr.Error()
+			} else {
+				node.Reachable = true
+				node.Version = response.Version
+				node.Services = response.ServiceStatus
+			}
+			nodes[i+1] = node
+		}()
+	}
+	wait.Wait()
+	return
+}
+
+// UpdateCluster starts, restarts or stops clustering according to the
+// cluster setting of the agent.
+func (agent *FeedbackAgent) UpdateCluster() {
+	if agent.cluster != nil {
+		// A change to the API key of the agent must also be applied to
+		// the peers if the cluster uses it.
+		if agent.Cluster != nil &&
+			sameServiceConfig(&agent.cluster.config, agent.Cluster) &&
+			(agent.Cluster.Key != "" || agent.cluster.key == agent.apiKey) {
+			return
+		}
+		agent.cluster.Stop()
+		agent.cluster = nil
+		if agent.Cluster == nil {
+			logrus.Info("Stopped clustering.")
+			return
+		}
+	}
+	if agent.Cluster == nil {
+		return
+	}
+	cluster, err := agent.StartCluster(*agent.Cluster)
+	if err != nil {
+		logrus.Error("Failed to start clustering: " + err.Error())
+		return
+	}
+	agent.cluster = cluster
+}
+
+// StopCluster stops clustering when the agent shuts down, leaving the
+// cluster setting unchanged.
+func (agent *FeedbackAgent) StopCluster() {
+	if agent.cluster != nil {
+		agent.cluster.Stop()
+		agent.cluster = nil
+		logrus.Info("Stopped clustering.")
+	}
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,255 @@
+// completion.go
+// Completion of CLI Commands for Shells
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Completion scripts for bash, zsh and fish are output by the 'completion'
+// action, to be installed or sourced in the usual way for each shell, e.g.
+//
+//	lbfeedback completion bash > /etc/bash_completion.d/lbfeedback
+//
+// Rather than listing the actions and flags themselves, the scripts call
+// 'lbfeedback completion complete <words>' with the words of the command
+// line, the last being the word to complete, which prints the completions
+// from the same registries used to parse the arguments, so they cannot
+// drift apart. The names of services are fetched from the local agent (or
+// from the remote agent given by environment variables), and are omitted
+// if it cannot be reached. The interactive shell uses the same completion.
+
+const (
+	CompletionBash = "bash"
+	CompletionZsh  = "zsh"
+	CompletionFish = "fish"
+	// Type of the 'completion' action called by the scripts.
+	completionComplete = "complete"
+	// Time allowed for fetching service names for completion.
+	CompletionTimeout = 2 * time.Second
+)
+
+// RunCompletion runs the 'completion' action, writing a completion script
+// for a shell, or the completions of the words of a command.
+func RunCompletion(argv []string) (status int) {
+	if len(argv) == 0 {
+		println("Error: no shell specified; use 'completion " +
+			CompletionBash + "', '" + CompletionZsh + "' or '" +
+			CompletionFish + "'.")
+		return ExitStatusError
+	}
+	if argv[0] == completionComplete {
+		// Loading the local config must not log into the completions.
+		logrus.SetOutput(io.Discard)
+		for _, candidate := range completeCLIArguments(argv[1:]) {
+			fmt.Println(candidate)
+		}
+		return ExitStatusNormal
+	}
+	script, err := GenerateCompletionScript(argv[0])
+	if err != nil {
+		println("Error: " + err.Error() + ".")
+		return ExitStatusError
+	}
+	fmt.Print(script)
+	return ExitStatusNormal
+}
+
+// GenerateCompletionScript returns the completion script for a shell.
+func GenerateCompletionScript(shell string) (script string, err error) {
+	name := AppIdentifier
+	switch shell {
+	case CompletionBash:
+		script = "# bash completion for " + name + "\n" +
+			"_" + name + "() {\n" +
+			"    local IFS=$'\\n'\n" +
+			"    COMPREPLY=($(" + name + " completion complete " +
+			"\"${COMP_WORDS[@]:1:COMP_CWORD}\" 2>/dev/null))\n" +
+			"}\n" +
+			"complete -F _" + name + " " + name + "\n"
+	case CompletionZsh:
+		script = "#compdef " + name + "\n" +
+			"_" + name + "() {\n" +
+			"    local completions\n" +
+			"    completions=\"$(" + name + " completion complete " +
+			"\"${(@)words[2,CURRENT]}\" 2>/dev/null)\"\n" +
+			"    [[ -n $completions ]] && compadd -- \"${(@f)completions}\"\n" +
+			"}\n" +
+			"if [[ \"${funcstack[1]}\" == \"_" + name + "\" ]]; then\n" +
+			"    _" + name + " \"$@\"\n" +
+			"else\n" +
+			"    compdef _" + name + " " + name + "\n" +
+			"fi\n"
+	case CompletionFish:
+		script = "# fish completion for " + name + "\n" +
+			"function __" + name + "_complete\n" +
+			"    set -l words (commandline -opc)\n" +
+			"    set -e words[1]\n" +
+			"    set -l current (commandline -ct)\n" +
+			"    " + name + " completion complete $words \"$current\" " +
+			"2>/dev/null\n" +
+			"end\n" +
+			"complete -c " + name + " -f -a '(__" + name + "_complete)'\n"
+	default:
+		err = errors.New("unsupported shell '" + shell + "'; expected " +
+			CompletionBash + ", " + CompletionZsh + " or " + CompletionFish)
+	}
+	return
+}
+
+// completeCLIArguments returns the completions of the last of the words
+// of a command given to the CLI client.
+func completeCLIArguments(args []string) (candidates []string) {
+	if len(args) == 0 {
+		args = []string{""}
+	}
+	words, word := args[:len(args)-1], args[len(args)-1]
+	actions := make([]string, 0, len(CLICommands))
+	for _, command := range CLICommands {
+		actions = append(actions, command.Action)
+	}
+	// An instance given earlier in the command is used to fetch names.
+	instance := ""
+	for i, arg := range words {
+		if strings.TrimLeft(arg, "-") == FlagInstance && i+1 < len(words) {
+			instance = words[i+1]
+		}
+	}
+	return CompleteCLIWord(words, word, actions,
+		func(serviceType string) []string {
+			client, err := NewCLIAPIClient(&APIRequest{}, instance)
+			if err != nil {
+				return nil
+			}
+			return fetchServiceNames(client, serviceType)
+		})
+}
+
+// CompleteCLIWord returns the possible completions of a word following
+// the preceding words of a command, which are the actions given, the types
+// of an action, the flags or the values of a flag, from the command and
+// flag registries. The names of services of a type ("monitor",
+// "responder", or all if empty) are fetched by a function.
+func CompleteCLIWord(words []string, word string, actions []string,
+	fetchNames func(serviceType string) []string) (candidates []string) {
+	var options []string
+	switch {
+	case len(words) == 0 || (len(words) == 1 && words[0] == "help"):
+		options = actions
+	case strings.HasPrefix(word, "-"):
+		for _, cliFlag := range CLIFlags {
+			options = append(options, "-"+cliFlag.Name)
+		}
+		if words[0] == "run-agent" {
+			for _, agentFlag := range AgentFlags {
+				options = append(options, "-"+agentFlag.Name)
+			}
+		}
+	case strings.HasPrefix(words[len(words)-1], "-"):
+		options = completeFlagValue(words, fetchNames)
+	case len(words) == 1:
+		command, err := GetCLICommand(words[0])
+		if err == nil {
+			options = command.TypeNames()
+		}
+	}
+	for _, option := range options {
+		if strings.HasPrefix(option, word) {
+			candidates = append(candidates, option)
+		}
+	}
+	sort.Strings(candidates)
+	return
+}
+
+// completeFlagValue returns the possible values of the flag that is the
+// last of the words of a command.
+func completeFlagValue(words []string,
+	fetchNames func(serviceType string) []string) (options []string) {
+	flagName := strings.TrimLeft(words[len(words)-1], "-")
+	cliFlag := GetCLIFlag(flagName)
+	if cliFlag == nil {
+		return
+	}
+	for _, option := range cliFlag.Options {
+		options = append(options, option.Value)
+	}
+	if cliFlag.IsBool {
+		options = append(options, strconv.FormatBool(true),
+			strconv.FormatBool(false))
+	}
+	// For '-name', the type of service is inferred from the command.
+	serviceType := ""
+	switch flagName {
+	case FlagMonitorName:
+		serviceType = "monitor"
+	case FlagName:
+		actionType := ""
+		if len(words) > 1 && !strings.HasPrefix(words[1], "-") {
+			actionType = words[1]
+		}
+		switch {
+		case actionType == "monitor":
+			serviceType = "monitor"
+		case actionType == "responder" || actionType == "source" ||
+			words[0] == "set" || words[0] == "force" || words[0] == "send":
+			serviceType = "responder"
+		}
+	default:
+		return
+	}
+	if fetchNames != nil {
+		options = append(options, fetchNames(serviceType)...)
+	}
+	return
+}
+
+// fetchServiceNames returns the names of the services of a type from an
+// agent, or of all services if the type is empty.
+func fetchServiceNames(client *APIClient, serviceType string) (
+	names []string) {
+	ctx, cancel := context.WithTimeout(context.Background(),
+		CompletionTimeout)
+	defer cancel()
+	response, _, err := client.Send(ctx, &APIRequest{Action: "status"})
+	if err != nil || !response.Success {
+		return
+	}
+	for _, status := range response.ServiceStatus {
+		if serviceType == "" || status.ServiceType == serviceType {
+			names = append(names, status.ServiceName)
+		}
+	}
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
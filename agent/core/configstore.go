@@ -0,0 +1,273 @@
+// configstore.go
+// Atomic Writing, Backup and Rollback of the Agent Configuration File
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Directory within the config directory holding config backups.
+	ConfigBackupDirName = "backups"
+	// Number of backups kept if the config-backups setting is zero.
+	DefaultConfigBackups = 5
+	// Suffix format for config backups, which sorts chronologically.
+	ConfigBackupTimeFormat = "20060102-150405.000"
+	// Suffix of the copy kept of a config replaced by a rollback.
+	ConfigRolledBackSuffix = ".rolled-back"
+	// Event raised when changes to the running configuration cannot be
+	// saved because the config file has been modified externally.
+	EventTypeConfigDiverged = "config-diverged"
+)
+
+// WriteFileAtomic writes data to a file by writing a temporary file in the
+// same directory and renaming it over the original, so that the file is
+// never left partially written. The permissions of an existing file are
+// preserved.
+func WriteFileAtomic(filePath string, data []byte) (err error) {
+	mode := DefaultFilePermissions
+	if info, statErr := os.Stat(filePath); statErr == nil {
+		mode = info.Mode().Perm()
+	}
+	temp, err := os.CreateTemp(path.Dir(filePath), "."+path.Base(filePath)+".tmp-*")
+	if err != nil {
+		return
+	}
+	tempPath := temp.Name()
+	_, err = temp.Write(data)
+	if err == nil {
+		err = temp.Sync()
+	}
+	err = errors.Join(err, temp.Close())
+	if err == nil {
+		err = os.Chmod(tempPath, mode)
+	}
+	if err == nil {
+		err = os.Rename(tempPath, filePath)
+	}
+	if err != nil {
+		_ = os.Remove(tempPath)
+	}
+	return
+}
+
+// backupConfigFile copies the existing config file into the backup
+// directory with a timestamp suffix, unless it is identical to the new
+// contents or to the most recent backup, and then removes the oldest
+// backups beyond the configured limit.
+func (agent *FeedbackAgent) backupConfigFile(filePath string, newData []byte) (
+	err error) {
+	limit := agent.ConfigBackups
+	if limit == 0 {
+		limit = DefaultConfigBackups
+	}
+	if limit < 0 {
+		return
+	}
+	oldData, err := os.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	if bytes.Equal(oldData, newData) {
+		return
+	}
+	backups := listConfigBackups(filePath)
+	if len(backups) > 0 {
+		latest, readErr := os.ReadFile(backups[len(backups)-1])
+		if readErr == nil && bytes.Equal(latest, oldData) {
+			return
+		}
+	}
+	backupDir := path.Join(path.Dir(filePath), ConfigBackupDirName)
+	err = CreateDirectoryIfMissing(backupDir)
+	if err != nil {
+		return
+	}
+	backupPath := path.Join(backupDir, path.Base(filePath)+"."+
+		time.Now().Format(ConfigBackupTimeFormat))
+	err = WriteFileAtomic(backupPath, oldData)
+	if err != nil {
+		return
+	}
+	backups = append(backups, backupPath)
+	for len(backups) > limit {
+		_ = os.Remove(backups[0])
+		backups = backups[1:]
+	}
+	return
+}
+
+// listConfigBackups returns the paths of the backups of a config file,
+// oldest first.
+func listConfigBackups(filePath string) (backups []string) {
+	pattern := path.Join(path.Dir(filePath), ConfigBackupDirName,
+		path.Base(filePath)+".*")
+	matches, _ := filepath.Glob(pattern)
+	for _, match := range matches {
+		if filepath.Ext(match) != ConfigRolledBackSuffix {
+			backups = append(backups, match)
+		}
+	}
+	sort.Strings(backups)
+	return
+}
+
+// RollbackConfig restores the most recent backup of the configuration
+// file and applies it to the running agent. The backup is validated
+// first, and is removed once restored so that a further rollback restores
+// the version before it. The replaced configuration is kept alongside
+// the backups with a '.rolled-back' suffix.
+func (agent *FeedbackAgent) RollbackConfig() (restored string, err error) {
+	filePath := path.Join(agent.configDir, ConfigFileName)
+	backups := listConfigBackups(filePath)
+	if len(backups) == 0 {
+		err = errors.New("no configuration backups are available")
+		return
+	}
+	restored = backups[len(backups)-1]
+	data, err := os.ReadFile(restored)
+	if err != nil {
+		return
+	}
+	validation := agent.ValidateConfigJSON(data)
+	if !validation.Valid {
+		err = errors.New("backup '" + path.Base(restored) +
+			"' is not a valid configuration: " + validation.Errors[0].Message)
+		return
+	}
+	current, err := os.ReadFile(filePath)
+	if err == nil {
+		err = WriteFileAtomic(path.Join(path.Dir(restored),
+			ConfigFileName+ConfigRolledBackSuffix), current)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	err = WriteFileAtomic(filePath, data)
+	if err != nil {
+		return
+	}
+	if agent.configWatcher != nil {
+		agent.configWatcher.Acknowledge(data)
+	}
+	_ = os.Remove(restored)
+	logrus.Info("Configuration rolled back to backup '" +
+		path.Base(restored) + "'.")
+	_, err = agent.ReloadConfig()
+	return
+}
+
+// ApplyConfigData replaces the configuration file with new, validated
+// configuration data, keeping a backup of the previous file, and applies
+// it to the running agent by reloading it.
+func (agent *FeedbackAgent) ApplyConfigData(data []byte) (
+	summary ReloadSummary, err error) {
+	filePath := path.Join(agent.configDir, ConfigFileName)
+	backupErr := agent.backupConfigFile(filePath, data)
+	if backupErr != nil {
+		logrus.Warn("Failed to back up the previous configuration: " +
+			backupErr.Error())
+	}
+	err = WriteFileAtomic(filePath, data)
+	if err != nil {
+		return
+	}
+	if agent.configWatcher != nil {
+		agent.configWatcher.Acknowledge(data)
+	}
+	summary, err = agent.ReloadConfig()
+	return
+}
+
+// #######################################################################
+// Divergence from the Config File
+// #######################################################################
+
+// recordConfigFile records the contents of the config file as matching the
+// running configuration, having just been loaded from or saved to it.
+func (agent *FeedbackAgent) recordConfigFile(data []byte) {
+	agent.configHash = sha256.Sum256(data)
+	agent.unsavedChanges = false
+	if agent.configDiverged != nil {
+		agent.configDiverged.Store(false)
+	}
+}
+
+// configFileModified returns whether the config file has been modified by
+// something other than the agent since it was last loaded or saved. A file
+// which has been removed is not regarded as modified, as nothing would be
+// lost by saving it again.
+func (agent *FeedbackAgent) configFileModified() bool {
+	data, err := os.ReadFile(path.Join(agent.configDir, ConfigFileName))
+	if err != nil {
+		return false
+	}
+	return sha256.Sum256(data) != agent.configHash
+}
+
+// IsConfigDiverged returns whether the running configuration has changes
+// which have not been saved because the config file has been modified
+// externally.
+func (agent *FeedbackAgent) IsConfigDiverged() bool {
+	return agent.configDiverged != nil && agent.configDiverged.Load()
+}
+
+// SaveRuntimeChanges saves changes made to the running configuration (e.g.
+// through the API) to the config file. If the file has been modified
+// externally since it was loaded or last saved, it is not overwritten, so
+// that neither set of changes is silently lost; the configuration is
+// instead marked as diverged until it is either reloaded from the file
+// (discarding the unsaved changes) or saved over it with 'force
+// save-config' (discarding the external changes).
+func (agent *FeedbackAgent) SaveRuntimeChanges() (saved bool, err error) {
+	if !agent.configFileModified() {
+		saved, err = agent.SaveAgentConfigToPaths()
+		return
+	}
+	if agent.configDiverged != nil &&
+		agent.configDiverged.CompareAndSwap(false, true) {
+		agent.RaiseEvent(AgentEvent{
+			Type: EventTypeConfigDiverged,
+			Message: "The configuration file has been modified externally " +
+				"whilst the running configuration has unsaved changes, so " +
+				"these have not been saved. Use 'reload config' to discard " +
+				"them and apply the file, or 'force save-config' to save " +
+				"them over the file.",
+		})
+	}
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
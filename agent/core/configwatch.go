@@ -0,0 +1,186 @@
+// configwatch.go
+// Automatic Reloading of the Agent Configuration File on Change
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"crypto/sha256"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+// ConfigWatchDebounce is the time (ms) to wait after the last change to
+// the config file before reloading it, so that a file being written in
+// several steps is only reloaded once it is complete.
+const ConfigWatchDebounce = 1000
+
+// ConfigWatcher watches the agent configuration file for changes made by
+// external tools, and signals the agent to reload it when it changes.
+// Changes written by the agent itself are ignored.
+type ConfigWatcher struct {
+	agent    *FeedbackAgent
+	watcher  *fsnotify.Watcher
+	filePath string
+	lastHash [sha256.Size]byte
+	timer    *time.Timer
+	mutex    sync.Mutex
+}
+
+// NewConfigWatcher starts watching the configuration file of an agent.
+// The directory containing the file is watched, rather than the file
+// itself, so that files replaced by renaming are still detected.
+func NewConfigWatcher(agent *FeedbackAgent) (cw *ConfigWatcher, err error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return
+	}
+	err = watcher.Add(agent.configDir)
+	if err != nil {
+		_ = watcher.Close()
+		return
+	}
+	cw = &ConfigWatcher{
+		agent:    agent,
+		watcher:  watcher,
+		filePath: path.Join(agent.configDir, ConfigFileName),
+	}
+	// Treat the current contents of the file as already applied.
+	data, readErr := os.ReadFile(cw.filePath)
+	if readErr == nil {
+		cw.Acknowledge(data)
+	}
+	go cw.run()
+	logrus.Info("Watching the configuration file for changes: " + cw.filePath)
+	return
+}
+
+// Acknowledge records the contents of the config file as being applied,
+// so that a change to these contents does not trigger a reload.
+func (cw *ConfigWatcher) Acknowledge(data []byte) {
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+	cw.lastHash = sha256.Sum256(data)
+}
+
+// Close stops watching the configuration file.
+func (cw *ConfigWatcher) Close() (err error) {
+	cw.mutex.Lock()
+	if cw.timer != nil {
+		cw.timer.Stop()
+	}
+	cw.mutex.Unlock()
+	err = cw.watcher.Close()
+	return
+}
+
+// run receives file system events until the watcher is closed.
+func (cw *ConfigWatcher) run() {
+	for {
+		select {
+		case event, open := <-cw.watcher.Events:
+			if !open {
+				return
+			}
+			if filepath.Base(event.Name) != ConfigFileName ||
+				!event.Has(fsnotify.Write|fsnotify.Create|fsnotify.Rename) {
+				continue
+			}
+			cw.mutex.Lock()
+			if cw.timer != nil {
+				cw.timer.Stop()
+			}
+			cw.timer = time.AfterFunc(ConfigWatchDebounce*time.Millisecond,
+				cw.fileChanged)
+			cw.mutex.Unlock()
+		case err, open := <-cw.watcher.Errors:
+			if !open {
+				return
+			}
+			logrus.Error("Error whilst watching the configuration file: " +
+				err.Error())
+		}
+	}
+}
+
+// fileChanged signals the agent to reload the configuration if the
+// contents of the file differ from those last applied.
+func (cw *ConfigWatcher) fileChanged() {
+	data, err := os.ReadFile(cw.filePath)
+	if err != nil {
+		logrus.Warn("The configuration file changed but could not be " +
+			"read; not reloading: " + err.Error())
+		return
+	}
+	hash := sha256.Sum256(data)
+	cw.mutex.Lock()
+	unchanged := hash == cw.lastHash
+	cw.lastHash = hash
+	cw.mutex.Unlock()
+	if unchanged {
+		return
+	}
+	logrus.Info("The configuration file has been changed externally.")
+	if cw.agent.IsConfigDiverged() {
+		logrus.Warn("Not reloading automatically, as the running " +
+			"configuration has unsaved changes; use 'reload config' or " +
+			"'force save-config'.")
+		return
+	}
+	// Reload from the event loop, exactly as for the reload signal.
+	cw.agent.systemSignals <- cw.agent.restartSignal
+}
+
+// UpdateConfigWatcher starts or stops watching the configuration file
+// according to the watch-config setting of the agent.
+func (agent *FeedbackAgent) UpdateConfigWatcher() {
+	if agent.WatchConfig && agent.configWatcher == nil {
+		watcher, err := NewConfigWatcher(agent)
+		if err != nil {
+			logrus.Error("Failed to watch the configuration file: " +
+				err.Error())
+			return
+		}
+		agent.configWatcher = watcher
+	} else if !agent.WatchConfig && agent.configWatcher != nil {
+		_ = agent.configWatcher.Close()
+		agent.configWatcher = nil
+		logrus.Info("Stopped watching the configuration file for changes.")
+	}
+}
+
+// StopConfigWatcher stops watching the configuration file when the agent
+// shuts down, leaving the watch-config setting unchanged.
+func (agent *FeedbackAgent) StopConfigWatcher() {
+	if agent.configWatcher != nil {
+		_ = agent.configWatcher.Close()
+		agent.configWatcher = nil
+		logrus.Info("Stopped watching the configuration file for changes.")
+	}
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
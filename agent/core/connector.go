@@ -19,6 +19,8 @@
 package agent
 
 import (
+	"bufio"
+	"compress/gzip"
 	"context"
 	"crypto/tls"
 	"errors"
@@ -26,11 +28,13 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
-
-	"github.com/sirupsen/logrus"
 )
 
 // #######################################################################
@@ -39,7 +43,10 @@ import (
 
 type ProtocolConnector interface {
 	Listen(fbr *FeedbackResponder) (err error)
-	Close() (err error)
+	// Shutdown stops accepting new connections and waits up to the drain
+	// timeout for any in-flight requests to complete, after which any
+	// remaining connections are closed.
+	Shutdown(drainTimeout time.Duration) (err error)
 }
 
 // NewFeedbackConnector creates a new connector for a given protocol and (if required)
@@ -48,9 +55,11 @@ func NewFeedbackConnector(protocol string) (conn ProtocolConnector, err error) {
 	switch protocol {
 	case ProtocolTCP:
 		conn = &TCPConnector{}
+	case ProtocolSNMP:
+		conn = &SNMPConnector{}
 	case ProtocolHTTP, ProtocolLegacyAPI:
 		conn = &HTTPConnector{}
-	case ProtocolHTTPS, ProtocolSecureAPI:
+	case ProtocolHTTPS, ProtocolSecureAPI, ProtocolGRPC:
 		conn = &HTTPConnector{
 			enableTLS:              true,
 			generateSelfSignedTLS:  true,
@@ -68,63 +77,492 @@ func NewFeedbackConnector(protocol string) (conn ProtocolConnector, err error) {
 // TCPConnector
 // #################################
 
+const (
+	// Maximum number of connections handled concurrently by a TCP
+	// connector; further connections wait in the listen backlog.
+	TCPWorkerPoolSize = 256
+	// Default time allowed for each TCP request to be received and its
+	// response to be sent before the connection is abandoned, so that slow
+	// clients cannot tie up a worker.
+	TCPConnectionTimeout = 5 * time.Second
+	// Default time for which a keep-alive TCP connection may wait for the
+	// next poll before it is closed, and the maximum length of a poll.
+	TCPKeepAliveIdleTimeout = 60 * time.Second
+	MaxTCPPollLength        = 1024
+	// Smallest request, response or idle timeout that may be configured.
+	MinConnectionTimeout = time.Millisecond
+	// Initial and maximum delays before accepting again after a failure
+	// to accept a connection (e.g. if file descriptors are exhausted).
+	MinAcceptRetryDelay = 5 * time.Millisecond
+	MaxAcceptRetryDelay = 1 * time.Second
+)
+
 type TCPConnector struct {
-	tcpListener net.Listener
-	responder   *FeedbackResponder
+	tcpListeners []net.Listener
+	responder    *FeedbackResponder
+	// In-flight client connections, each marked as busy unless it is a
+	// keep-alive connection waiting for a poll, and whether the connector
+	// is closing.
+	connections map[net.Conn]bool
+	closing     bool
+	drained     chan bool
+	// Holds a token for each connection being handled, limiting these to
+	// the size of the worker pool, which is shared by all listen addresses.
+	workers chan struct{}
+	mutex   sync.Mutex
 }
 
 func (pc *TCPConnector) Listen(fbr *FeedbackResponder) (err error) {
+	pc.mutex.Lock()
 	pc.responder = fbr
-	addressString := strings.TrimSpace(fbr.ListenIPAddress)
-	if addressString == "*" {
-		addressString = ""
-	}
-	addressString = ":" + strings.TrimSpace(fbr.ListenPort)
-	pc.tcpListener, err = net.Listen("tcp", addressString)
+	pc.connections = make(map[net.Conn]bool)
+	pc.closing = false
+	pc.drained = make(chan bool)
+	pc.workers = make(chan struct{}, TCPWorkerPoolSize)
+	pc.mutex.Unlock()
+	listeners, err := listenOnAddresses(fbr)
+	pc.mutex.Lock()
+	pc.tcpListeners = listeners
+	pc.mutex.Unlock()
 	if err != nil {
-		logrus.Error("TCP error: " + err.Error())
+		pc.responder.logger().Error("TCP error: " + err.Error())
 		return
 	}
+	// Accept connections on each additional address in its own goroutine,
+	// and on the first address in this one, until all have stopped.
+	var wg sync.WaitGroup
+	for _, listener := range listeners[1:] {
+		wg.Add(1)
+		go func(listener net.Listener) {
+			defer wg.Done()
+			_ = pc.acceptConnections(listener)
+		}(listener)
+	}
+	err = pc.acceptConnections(listeners[0])
+	wg.Wait()
+	return
+}
+
+// acceptConnections accepts and handles connections from a listener until
+// it is closed.
+func (pc *TCPConnector) acceptConnections(listener net.Listener) (err error) {
 	var conn net.Conn
-	for err == nil {
+	retryDelay := time.Duration(0)
+	for {
+		// Wait for a free worker before accepting, so that a flood of
+		// connections waits in the listen backlog rather than consuming
+		// goroutines and file descriptors.
+		pc.workers <- struct{}{}
 		// Accept() will block here until an error occurs (e.g. if
 		// the listener is closed) or a request is received from a client.
-		conn, err = pc.tcpListener.Accept()
-		if conn != nil {
-			go pc.handleRequest(conn)
+		conn, err = listener.Accept()
+		if err != nil {
+			<-pc.workers
+			if pc.isClosing() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// Any other error is likely to be transient, so retry after
+			// an increasing delay rather than stopping the listener.
+			retryDelay = min(max(retryDelay*2, MinAcceptRetryDelay),
+				MaxAcceptRetryDelay)
+			pc.responder.logger().Warn(pc.responder.getLogHead() +
+				"failed to accept a connection: " + err.Error() +
+				"; retrying in " + retryDelay.String() + ".")
+			time.Sleep(retryDelay)
+			continue
 		}
+		retryDelay = 0
+		// Silently drop any clients outside the allowed ranges, or
+		// exceeding the connection limits, before starting a goroutine.
+		limitErr := pc.responder.AcquireConnection(conn.RemoteAddr().String())
+		if limitErr != nil {
+			pc.responder.logger().Debug(pc.responder.getLogHead() + "dropped connection " +
+				"from " + conn.RemoteAddr().String() + ": " + limitErr.Error())
+			_ = conn.Close()
+			<-pc.workers
+			continue
+		}
+		// Track the connection so that it can be drained on shutdown,
+		// unless shutdown has already begun.
+		pc.mutex.Lock()
+		if pc.closing {
+			pc.mutex.Unlock()
+			pc.responder.ReleaseConnection()
+			_ = conn.Close()
+			<-pc.workers
+			continue
+		}
+		pc.connections[conn] = true
+		pc.mutex.Unlock()
+		go pc.handleRequest(conn)
 	}
-	return
+}
+
+// isClosing returns whether the connector is shutting down.
+func (pc *TCPConnector) isClosing() bool {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	return pc.closing
 }
 
 func (pc *TCPConnector) handleRequest(c net.Conn) {
-	response, _ := pc.responder.GetResponse("")
-	_, err := fmt.Fprintf(c, "%s", response)
-	if err != nil {
-		logrus.Error("Error responding to request: " + err.Error())
+	defer func() { <-pc.workers }()
+	defer pc.responder.ReleaseConnection()
+	defer pc.untrackConnection(c)
+	defer pc.responder.recoverPanic(c)
+	if pc.responder.KeepAlive {
+		pc.serveKeepAlive(c)
+	} else {
+		requestTimeout, responseTimeout, _ := pc.responder.tcpTimeouts()
+		received := time.Now()
+		// A virtual responder sharing this listener may be selected by the
+		// request line, if the client sends one.
+		var line []byte
+		responder := pc.responder
+		if pc.responder.ParentAgent.virtuals.hasTokens(pc.responder) {
+			line = readVirtualToken(c, min(requestTimeout, VirtualTokenTimeout))
+			responder = pc.responder.selectTCPResponder(line)
+		}
+		response, _ := responder.GetResponse("")
+		// Abandon the connection if the client does not accept the
+		// response in time.
+		_ = c.SetWriteDeadline(time.Now().Add(responseTimeout))
+		_, err := fmt.Fprintf(c, "%s", response)
+		responder.logAccess(received, AccessLogEntry{
+			Client:   c.RemoteAddr().String(),
+			Response: response,
+			Request:  string(line),
+		})
+		if err != nil {
+			pc.responder.stats.addError()
+			pc.responder.logger().Error("Error responding to request: " + err.Error())
+		}
 	}
-	// Always force-close the connection after returning the feedback value.
-	// This is to cope with an issue with ldirectord which will hang until the
-	// connection is closed from the server
-	err = c.Close()
+	// Always force-close the connection after returning the feedback value
+	// (unless keep-alive is enabled). This is to cope with an issue with
+	// ldirectord which will hang until the connection is closed from the
+	// server.
+	err := c.Close()
 	if err != nil {
-		logrus.Error("Error closing TCP connection: " + err.Error())
+		pc.responder.logger().Error("Error closing TCP connection: " + err.Error())
+	}
+}
+
+// checkTimeouts validates the request, response and idle timeouts of this
+// FeedbackResponder, which are either unset (0) or at least one millisecond.
+func (fbr *FeedbackResponder) checkTimeouts() (err error) {
+	timeouts := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"request", time.Duration(fbr.RequestTimeout)},
+		{"response", time.Duration(fbr.ResponseTimeout)},
+		{"idle", time.Duration(fbr.IdleTimeout)},
+	}
+	for _, timeout := range timeouts {
+		if timeout.value < 0 {
+			err = errors.New("invalid " + timeout.name +
+				" timeout; cannot be negative")
+			return
+		}
+		if timeout.value > 0 && timeout.value < MinConnectionTimeout {
+			err = errors.New("invalid " + timeout.name +
+				" timeout; must be at least " + MinConnectionTimeout.String())
+			return
+		}
+	}
+	return
+}
+
+// setTimeouts applies the request, response, idle and drain timeouts of an
+// API request (e.g. '500ms', or a number of milliseconds) to this
+// FeedbackResponder, leaving any not given unchanged; they are validated
+// when it is next initialised. The drain timeout may also be given as a
+// number of milliseconds under its earlier key.
+func (fbr *FeedbackResponder) setTimeouts(request *APIRequest) (err error) {
+	timeouts := []struct {
+		value  *string
+		target *Duration
+	}{
+		{request.RequestTimeout, &fbr.RequestTimeout},
+		{request.ResponseTimeout, &fbr.ResponseTimeout},
+		{request.IdleTimeout, &fbr.IdleTimeout},
+		{request.DrainTimeout, &fbr.DrainTimeout},
+	}
+	for _, timeout := range timeouts {
+		if timeout.value == nil {
+			continue
+		}
+		*timeout.target, err = ParseDuration(*timeout.value)
+		if err != nil {
+			return
+		}
+	}
+	if request.DrainTimeout == nil && request.DrainTimeoutMs != nil {
+		fbr.DrainTimeout = Duration(time.Duration(*request.DrainTimeoutMs) *
+			time.Millisecond)
 	}
+	return
 }
 
-func (pc *TCPConnector) Close() (err error) {
-	if pc.tcpListener != nil {
-		// This will unblock listenTCP() as the listener will then
+// tcpTimeouts returns the request, response and idle timeouts enforced on
+// each connection by a TCP connector, using the defaults for any not set.
+func (fbr *FeedbackResponder) tcpTimeouts() (request time.Duration,
+	response time.Duration, idle time.Duration) {
+	request, response, idle = time.Duration(fbr.RequestTimeout),
+		time.Duration(fbr.ResponseTimeout), time.Duration(fbr.IdleTimeout)
+	if request == 0 {
+		request = TCPConnectionTimeout
+	}
+	if response == 0 {
+		response = TCPConnectionTimeout
+	}
+	if idle == 0 {
+		idle = TCPKeepAliveIdleTimeout
+	}
+	return
+}
+
+// serveKeepAlive answers each newline-terminated poll received on a
+// connection with a feedback response, until the client closes it, it is
+// idle for too long, or the connector is closing.
+func (pc *TCPConnector) serveKeepAlive(c net.Conn) {
+	requestTimeout, responseTimeout, idleTimeout := pc.responder.tcpTimeouts()
+	reader := bufio.NewReaderSize(c, MaxTCPPollLength)
+	for {
+		if !pc.setConnectionBusy(c, false) {
+			return
+		}
+		// Wait for up to the idle timeout for a poll to begin, and then for
+		// up to the request timeout for the rest of it to arrive.
+		_ = c.SetReadDeadline(time.Now().Add(idleTimeout))
+		_, err := reader.Peek(1)
+		if err != nil {
+			return
+		}
+		received := time.Now()
+		_ = c.SetReadDeadline(received.Add(requestTimeout))
+		line, err := reader.ReadSlice('\n')
+		if err != nil || !pc.setConnectionBusy(c, true) {
+			return
+		}
+		_ = c.SetWriteDeadline(time.Now().Add(responseTimeout))
+		// Each poll may select a virtual responder sharing this listener.
+		responder := pc.responder.selectTCPResponder(line)
+		response, _ := responder.GetResponse("")
+		_, err = io.WriteString(c, response)
+		responder.logAccess(received, AccessLogEntry{
+			Client:   c.RemoteAddr().String(),
+			Response: response,
+			Request:  string(line),
+		})
+		if err != nil {
+			pc.responder.stats.addError()
+			return
+		}
+	}
+}
+
+// setConnectionBusy marks whether a keep-alive connection is handling a
+// poll, so that it is only closed whilst idle when shutting down. It
+// returns false if the connector is closing, in which case no further
+// polls should be answered.
+func (pc *TCPConnector) setConnectionBusy(c net.Conn, busy bool) bool {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	pc.connections[c] = busy
+	return !pc.closing
+}
+
+// untrackConnection removes a completed connection from those in flight,
+// signalling once all have completed if the connector is closing.
+func (pc *TCPConnector) untrackConnection(c net.Conn) {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	delete(pc.connections, c)
+	if pc.closing && len(pc.connections) == 0 {
+		close(pc.drained)
+	}
+}
+
+func (pc *TCPConnector) Shutdown(drainTimeout time.Duration) (err error) {
+	pc.mutex.Lock()
+	pc.closing = true
+	for _, listener := range pc.tcpListeners {
+		// This will unblock Listen() as the listener will then
 		// return an error having stopped.
-		err = pc.tcpListener.Close()
+		err = errors.Join(err, listener.Close())
+	}
+	// Keep-alive connections waiting for a poll are closed immediately,
+	// and removed by their handlers.
+	for conn, busy := range pc.connections {
+		if !busy {
+			_ = conn.Close()
+		}
+	}
+	inFlight := len(pc.connections)
+	drained := pc.drained
+	pc.mutex.Unlock()
+	if inFlight == 0 {
+		return
+	}
+	select {
+	case <-drained:
+	case <-time.After(drainTimeout):
+		pc.mutex.Lock()
+		remaining := len(pc.connections)
+		for conn := range pc.connections {
+			_ = conn.Close()
+		}
+		pc.mutex.Unlock()
+		err = errors.Join(err, errors.New(strconv.Itoa(remaining)+
+			" connection(s) did not complete within the drain timeout "+
+			"and were closed"))
 	}
 	return
 }
 
+// Time allowed for a hostname given as a listen address to be resolved.
+const ListenResolveTimeout = 10 * time.Second
+
+// listenOnAddresses binds a TCP listener on each of the listen addresses
+// of a Responder. If an ephemeral port was requested, the port assigned for
+// the first address is used for the others, so that all share one port.
+// If ReusePort is enabled, the listeners are bound with SO_REUSEPORT so
+// that a replacement Responder can bind the same port before this one is
+// stopped.
+func listenOnAddresses(fbr *FeedbackResponder) (listeners []net.Listener,
+	err error) {
+	port := strings.TrimSpace(fbr.ListenPort)
+	if port == "" {
+		err = errors.New("invalid port specified")
+		return
+	}
+	addresses, err := resolveListenAddresses(fbr)
+	if err != nil {
+		return
+	}
+	config := getListenConfig(fbr)
+	for _, address := range addresses {
+		var listener net.Listener
+		listener, err = config.Listen(context.Background(), "tcp",
+			net.JoinHostPort(address, port))
+		if err == nil && fbr.ReusePort {
+			err = steerReusePort(listener.(syscall.Conn))
+			if err != nil {
+				_ = listener.Close()
+			}
+		}
+		if err != nil {
+			closeListeners(listeners)
+			listeners = nil
+			return
+		}
+		if len(listeners) == 0 {
+			fbr.SetBoundAddress(listener.Addr())
+			_, port, _ = net.SplitHostPort(listener.Addr().String())
+		}
+		listeners = append(listeners, listener)
+	}
+	return
+}
+
+// listenPacketOnAddresses binds a UDP socket on each of the listen
+// addresses of a Responder, as for listenOnAddresses.
+func listenPacketOnAddresses(fbr *FeedbackResponder) (
+	conns []net.PacketConn, err error) {
+	port := strings.TrimSpace(fbr.ListenPort)
+	if port == "" {
+		err = errors.New("invalid port specified")
+		return
+	}
+	addresses, err := resolveListenAddresses(fbr)
+	if err != nil {
+		return
+	}
+	config := getListenConfig(fbr)
+	for _, address := range addresses {
+		var conn net.PacketConn
+		conn, err = config.ListenPacket(context.Background(), "udp",
+			net.JoinHostPort(address, port))
+		if err == nil && fbr.ReusePort {
+			err = steerReusePort(conn.(syscall.Conn))
+			if err != nil {
+				_ = conn.Close()
+			}
+		}
+		if err != nil {
+			closeListeners(conns)
+			conns = nil
+			return
+		}
+		if len(conns) == 0 {
+			fbr.SetBoundAddress(conn.LocalAddr())
+			_, port, _ = net.SplitHostPort(conn.LocalAddr().String())
+		}
+		conns = append(conns, conn)
+	}
+	return
+}
+
+// resolveListenAddresses returns the addresses on which a Responder binds
+// its sockets, resolving any hostnames to each of their addresses.
+func resolveListenAddresses(fbr *FeedbackResponder) (addresses []string,
+	err error) {
+	for _, address := range fbr.ListenAddresses() {
+		if _, parseErr := netip.ParseAddr(address); parseErr == nil ||
+			address == "" {
+			if !slices.Contains(addresses, address) {
+				addresses = append(addresses, address)
+			}
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(),
+			ListenResolveTimeout)
+		var resolved []net.IPAddr
+		resolved, err = net.DefaultResolver.LookupIPAddr(ctx, address)
+		cancel()
+		if err != nil {
+			err = errors.New("cannot resolve listen address '" + address +
+				"': " + err.Error())
+			return
+		}
+		for _, ip := range resolved {
+			if !slices.Contains(addresses, ip.String()) {
+				addresses = append(addresses, ip.String())
+			}
+		}
+	}
+	return
+}
+
+// getListenConfig returns the settings with which the sockets of a
+// Responder are bound.
+func getListenConfig(fbr *FeedbackResponder) (config net.ListenConfig) {
+	if fbr.ReusePort {
+		config.Control = func(_ string, _ string, conn syscall.RawConn) error {
+			return PlatformSetReusePort(conn)
+		}
+	}
+	return
+}
+
+// closeListeners closes each of a list of listeners or sockets.
+func closeListeners[T io.Closer](listeners []T) {
+	for _, listener := range listeners {
+		_ = listener.Close()
+	}
+}
+
 // #################################
 // HTTPConnector
 // #################################
 
+// Minimum size (bytes) of an HTTP response before it is compressed, for
+// clients which accept compressed responses; smaller responses (such as
+// feedback) are not worth the overhead.
+const MinCompressedResponseSize = 1024
+
 type HTTPConnector struct {
 	httpServer             *http.Server
 	responder              *FeedbackResponder
@@ -135,30 +573,37 @@ type HTTPConnector struct {
 	tlsRenewalWindow       time.Duration
 	tlsWorkerSleepInterval time.Duration
 	tlsCertValidFor        time.Duration
-	mutex                  sync.Mutex
+	// Closed when the server is shut down, to end any gRPC streams.
+	stopping chan struct{}
+	mutex    sync.Mutex
 }
 
 func (pc *HTTPConnector) Listen(fbr *FeedbackResponder) (err error) {
 	pc.mutex.Lock()
 	defer pc.mutex.Unlock()
 	pc.responder = fbr
-	ip := strings.TrimSpace(fbr.ListenIPAddress)
-	if ip == "*" {
-		ip = ""
-	}
-	port := strings.TrimSpace(fbr.ListenPort)
-	if port == "" {
-		err = errors.New("invalid port specified")
+	// Bind the listeners separately from serving, so that the port assigned
+	// can be reported if an ephemeral port was requested.
+	listeners, err := listenOnAddresses(fbr)
+	if err != nil {
+		pc.responder.logger().Error("HTTP error: " + err.Error())
 		return
 	}
 	pc.httpServer = &http.Server{
-		Addr:         ip + ":" + port,
+		Addr:         listeners[0].Addr().String(),
 		Handler:      http.HandlerFunc(pc.handleRequest),
-		ReadTimeout:  fbr.RequestTimeout,
-		WriteTimeout: fbr.ResponseTimeout,
+		ReadTimeout:  time.Duration(fbr.RequestTimeout),
+		WriteTimeout: time.Duration(fbr.ResponseTimeout),
+		IdleTimeout:  time.Duration(fbr.IdleTimeout),
 		ErrorLog:     NewNullLogger(),
 	}
-	// ListenAndServe/ListenAndServeTLS will block here until the server
+	stopping := make(chan struct{})
+	var stopOnce sync.Once
+	pc.stopping = stopping
+	pc.httpServer.RegisterOnShutdown(func() {
+		stopOnce.Do(func() { close(stopping) })
+	})
+	// Serve/ServeTLS will block here until the server
 	// returns an error. As we have unlocked the mutex in the parent Responder,
 	// fbr.Stop will be able to call the method on the HTTP server to tell it to stop.
 	if pc.enableTLS {
@@ -170,11 +615,13 @@ func (pc *HTTPConnector) Listen(fbr *FeedbackResponder) (err error) {
 			err = pc.renewTLSCert()
 			pc.mutex.Lock()
 			if err != nil {
+				closeListeners(listeners)
 				return
 			}
 		} else if pc.tlsCertificate == nil {
 			// Otherwise, one should be preconfigured before Listen() is called.
 			err = errors.New("empty TLS certificate; unable to serve HTTPS")
+			closeListeners(listeners)
 			return
 		}
 		// Set the certificate in the TLS config for the server
@@ -187,41 +634,171 @@ func (pc *HTTPConnector) Listen(fbr *FeedbackResponder) (err error) {
 		if pc.generateSelfSignedTLS {
 			handlerControl := make(chan int)
 			go pc.certRenewalWorker(handlerControl)
-			err = pc.httpServer.ListenAndServeTLS("", "")
+			err = pc.serveAll(listeners, true)
 			handlerControl <- ExitStatusNormal
 			close(handlerControl)
 		} else {
-			err = pc.httpServer.ListenAndServeTLS("", "")
+			err = pc.serveAll(listeners, true)
 		}
 
 	} else {
 		// -- This responder is in HTTP mode.
-		// the TLS config in the server object above, so these are empty.
 		pc.mutex.Unlock()
-		err = pc.httpServer.ListenAndServe()
+		err = pc.serveAll(listeners, false)
 	}
 	pc.mutex.Lock()
 	// Report an error if the result was anything other than the server closing.
 	if err != nil && !errors.Is(err, http.ErrServerClosed) {
-		logrus.Error("HTTP error: " + err.Error())
+		pc.responder.logger().Error("HTTP error: " + err.Error())
+	}
+	return
+}
+
+// serveAll serves HTTP or HTTPS on each of the listeners until the server
+// is stopped, returning the error from the first listener. The mutex must
+// not be held.
+func (pc *HTTPConnector) serveAll(listeners []net.Listener, enableTLS bool) (
+	err error) {
+	serve := func(listener net.Listener) error {
+		if enableTLS {
+			return pc.httpServer.ServeTLS(listener, "", "")
+		}
+		return pc.httpServer.Serve(listener)
+	}
+	var wg sync.WaitGroup
+	for _, listener := range listeners[1:] {
+		wg.Add(1)
+		go func(listener net.Listener) {
+			defer wg.Done()
+			serveErr := serve(listener)
+			if serveErr != nil && !errors.Is(serveErr, http.ErrServerClosed) {
+				pc.responder.logger().Error("HTTP error: " + serveErr.Error())
+			}
+		}(listener)
 	}
+	err = serve(listeners[0])
+	wg.Wait()
 	return
 }
 
 func (pc *HTTPConnector) handleRequest(w http.ResponseWriter, r *http.Request) {
+	received := time.Now()
+	// Reject any clients outside the allowed ranges, or requests exceeding
+	// the connection limits.
+	limitErr := pc.responder.AcquireConnection(r.RemoteAddr)
+	if limitErr != nil {
+		pc.responder.logger().Debug(pc.responder.getLogHead() + "rejected request " +
+			"from " + r.RemoteAddr + ": " + limitErr.Error())
+		if errors.Is(limitErr, ErrClientNotAllowed) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		} else {
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		}
+		return
+	}
+	if pc.responder.IsAPI() && r.Method == http.MethodGet &&
+		r.URL.Path == SubscribePath {
+		// Subscriptions are long-lived, so they count towards the request
+		// rate but do not hold one of the connection slots.
+		pc.responder.ReleaseConnection()
+		pc.handleSubscribe(w, r)
+		return
+	}
+	defer pc.responder.ReleaseConnection()
+	if pc.responder.ProtocolName == ProtocolGRPC {
+		pc.handleGRPC(w, r)
+		pc.responder.markResponded()
+		return
+	} else if pc.responder.IsAPI() && r.Method == http.MethodGet &&
+		r.URL.Path == OpenAPIPath {
+		pc.handleOpenAPI(w, r)
+		return
+	} else if pc.responder.IsAPI() && r.Method == http.MethodGet &&
+		r.URL.Path == MetricsPath {
+		pc.handleMetrics(w, r)
+		return
+	} else if pc.responder.IsAPI() &&
+		strings.HasPrefix(r.URL.Path, RESTPathPrefix) {
+		started := time.Now()
+		pc.handleREST(w, r)
+		pc.responder.markResponded()
+		pc.responder.stats.record(time.Since(started), false)
+		return
+	}
 	// Read in the entire request body.
 	body, err := io.ReadAll(r.Body)
 	// Can't return the error here, since this is a callback from http
 	// $ TO DO: Deal with what happens if we can't read the HTTP body
 	if err != nil {
-		logrus.Error("failed to read HTTP request body: " + err.Error())
+		pc.responder.logger().Error("failed to read HTTP request body: " + err.Error())
 		return
 	}
-	response, quitAfterResponse := pc.responder.GetResponse(string(body))
-	// Send response to writer (and therefore to the client).
-	_, err = fmt.Fprintf(w, "%s", response)
+	// Feedback is given as a JSON report if configured, or if the client
+	// accepts JSON; otherwise, it is given as plain text.
+	var response string
+	var quitAfterResponse bool
+	var state FeedbackState
+	responder := pc.responder
+	if pc.responder.IsAPI() {
+		response, quitAfterResponse = pc.responder.GetResponse(string(body))
+	} else {
+		// A virtual responder sharing this listener may answer the request,
+		// and a route may give another view of the feedback for its path.
+		responder = pc.responder.selectHTTPResponder(r)
+		route := responder.findRoute(r.URL.Path)
+		format := responder.FeedbackFormat
+		if route != nil {
+			format = route.FeedbackFormat
+		}
+		asJSON := format == FeedbackFormatJSON ||
+			acceptsJSON(r.Header.Values("Accept"))
+		response, state = responder.GetHTTPResponse(string(body), route,
+			asJSON)
+		if asJSON {
+			w.Header().Set("Content-Type", "application/json")
+		} else {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		}
+		w.Header().Add("Vary", "Accept")
+	}
+	// With status codes, the state from which the feedback was produced is
+	// also given as the status, so that plain HTTP health checks apply the
+	// threshold.
+	status := http.StatusOK
+	if responder.StatusCodes && !responder.IsAPI() {
+		w.Header().Set(AvailabilityHeader, strconv.Itoa(state.Availability))
+		if !state.Online {
+			status = http.StatusServiceUnavailable
+		}
+	}
+	// Send response to writer (and therefore to the client), compressing
+	// it if it is large and the client accepts this.
+	w.Header().Add("Vary", "Accept-Encoding")
+	if len(response) >= MinCompressedResponseSize &&
+		acceptsGzip(r.Header.Values("Accept-Encoding")) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(status)
+		compressor := gzip.NewWriter(w)
+		_, err = io.WriteString(compressor, response)
+		err = errors.Join(err, compressor.Close())
+	} else {
+		w.WriteHeader(status)
+		_, err = fmt.Fprintf(w, "%s", response)
+	}
+	if !pc.responder.IsAPI() {
+		responder.logAccess(received, AccessLogEntry{
+			Client:    r.RemoteAddr,
+			Status:    status,
+			Response:  response,
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Host:      r.Host,
+			UserAgent: r.UserAgent(),
+		})
+	}
 	if err != nil {
-		logrus.Error("failed to write HTTP response: " + err.Error())
+		pc.responder.stats.addError()
+		pc.responder.logger().Error("failed to write HTTP response: " + err.Error())
 		return
 	}
 	// If this was an API action requiring the agent to now quit, perform it.
@@ -230,13 +807,85 @@ func (pc *HTTPConnector) handleRequest(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (pc *HTTPConnector) Close() (err error) {
+// acceptsGzip returns whether the Accept-Encoding headers of a request
+// allow a gzip-compressed response, either explicitly or by a wildcard.
+func acceptsGzip(headers []string) (accepted bool) {
+	for _, header := range headers {
+		for _, entry := range strings.Split(header, ",") {
+			coding, params, _ := strings.Cut(entry, ";")
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding != "gzip" && coding != "*" {
+				continue
+			}
+			// A quality value of zero means that it is not acceptable.
+			name, value, _ := strings.Cut(params, "=")
+			if strings.TrimSpace(name) == "q" {
+				quality, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				if err == nil && quality <= 0 {
+					if coding == "gzip" {
+						return false
+					}
+					continue
+				}
+			}
+			accepted = true
+		}
+	}
+	return
+}
+
+// acceptsJSON returns whether the Accept headers of a request explicitly
+// allow a JSON response; wildcards are not taken to request JSON.
+func acceptsJSON(headers []string) (accepted bool) {
+	for _, header := range headers {
+		for _, entry := range strings.Split(header, ",") {
+			mediaType, params, _ := strings.Cut(entry, ";")
+			mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+			if mediaType != "application/json" {
+				continue
+			}
+			// A quality value of zero means that it is not acceptable.
+			name, value, _ := strings.Cut(params, "=")
+			if strings.TrimSpace(name) == "q" {
+				quality, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				if err == nil && quality <= 0 {
+					return false
+				}
+			}
+			accepted = true
+		}
+	}
+	return
+}
+
+// getHeaderAPIKey returns the API key given in the headers of an HTTP
+// request (or the metadata of a gRPC call), either as X-API-Key or as a
+// bearer token.
+func getHeaderAPIKey(header http.Header) (key string) {
+	key = header.Get("X-Api-Key")
+	if key == "" {
+		scheme, token, _ := strings.Cut(header.Get("Authorization"), " ")
+		if strings.EqualFold(scheme, "Bearer") {
+			key = strings.TrimSpace(token)
+		}
+	}
+	return
+}
+
+func (pc *HTTPConnector) Shutdown(drainTimeout time.Duration) (err error) {
 	pc.mutex.Lock()
 	defer pc.mutex.Unlock()
-	if pc.httpServer != nil {
-		// This will unblock listenHTTP() as the server will then
-		// return an error having stopped.
-		err = pc.httpServer.Shutdown(context.Background())
+	if pc.httpServer == nil {
+		return
+	}
+	// This will unblock Listen() as the server will then return an error
+	// having stopped, and then waits for in-flight requests to complete.
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	err = pc.httpServer.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = errors.Join(errors.New("in-flight requests did not complete "+
+			"within the drain timeout and were closed"), pc.httpServer.Close())
 	}
 	return
 }
@@ -246,19 +895,20 @@ func (pc *HTTPConnector) Close() (err error) {
 func (pc *HTTPConnector) renewTLSCert() (err error) {
 	pc.mutex.Lock()
 	defer pc.mutex.Unlock()
-	addr := net.ParseIP(pc.responder.ListenIPAddress)
+	ipList, dnsNames := CertificateSubjects(pc.responder.ListenAddresses())
 	pc.tlsCertificate, pc.tlsValidTo, err = CreateNewTLSCertificate(
-		[]net.IP{addr},
+		ipList,
+		dnsNames,
 		pc.tlsCertValidFor,
 	)
 	msgHead := "Responder '" + pc.responder.ResponderName + "': "
 	if err != nil {
-		logrus.Error(msgHead +
+		pc.responder.logger().Error(msgHead +
 			"Failed to generate a new TLS certificate: " +
 			err.Error())
 		return
 	} else {
-		logrus.Info(msgHead +
+		pc.responder.logger().Info(msgHead +
 			"New TLS certificate generated (auto-renewed, expires " +
 			pc.tlsValidTo.Format(time.RFC1123Z) + ").")
 	}
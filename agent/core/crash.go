@@ -0,0 +1,168 @@
+// crash.go
+// Crash Reports for Panics within Services
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// A panic within the goroutine of a Responder or Monitor (a bug, or a
+// metric which misbehaves) is recovered, so that it does not stop the
+// whole agent. Each is logged, written with its stack trace to a crash
+// report in the log directory, and counted in the agent statistics. A
+// panic whilst handling a single request only fails that request, but the
+// worker of a Responder or a Monitor stops, as its state is then unknown,
+// and is restarted by the supervisor. Only the most recent crash reports
+// are kept, so that a service which panics repeatedly does not fill the
+// disk. Panics are not recovered when debugging panics (see PanicDebug).
+
+// #################################
+// CRASH REPORTS
+// #################################
+
+const (
+	CrashReportPrefix    = "crash-"
+	CrashReportExtension = ".txt"
+	CrashReportTimestamp = "20060102-150405.000"
+	MaxCrashReports      = 20
+)
+
+// PanicError describes a panic recovered within a service, and the crash
+// report to which it was written, if any.
+type PanicError struct {
+	Value  any
+	Report string
+}
+
+func (e *PanicError) Error() string {
+	message := "internal error: " + fmt.Sprint(e.Value)
+	if e.Report != "" {
+		message += " (crash report: " + e.Report + ")"
+	}
+	return message
+}
+
+// reportPanic handles a value recovered from a panic within a service,
+// which must be called from the deferred function that recovered it so
+// that the stack trace includes the panic. The returned error is
+// recorded as the last error of the service.
+func (agent *FeedbackAgent) reportPanic(serviceType string, name string,
+	value any) (err *PanicError) {
+	stack := debug.Stack()
+	err = &PanicError{Value: value}
+	head := supervisorKey(serviceType, name) + " "
+	logger := logrus.WithField(serviceType, name)
+	if agent != nil {
+		if agent.panics != nil {
+			agent.panics.Add(1)
+		}
+		report, writeErr := agent.writeCrashReport(serviceType, name,
+			value, stack)
+		if writeErr != nil {
+			logger.Warn(head + "failed to write crash report: " +
+				writeErr.Error() + ".")
+		}
+		err.Report = report
+	}
+	logger.Error(head + "recovered from an " + err.Error() + ".")
+	return
+}
+
+// writeCrashReport writes the details of a panic to a new crash report in
+// the log directory, removing the oldest reports beyond the maximum.
+func (agent *FeedbackAgent) writeCrashReport(serviceType string,
+	name string, value any, stack []byte) (report string, err error) {
+	if agent.LogDir == "" {
+		return
+	}
+	now := time.Now()
+	fileName := CrashReportPrefix + now.Format(CrashReportTimestamp) + "-" +
+		serviceType + "-" + name + CrashReportExtension
+	var text strings.Builder
+	text.WriteString(ApplicationName + " v" + VersionString +
+		" Crash Report\n\n")
+	text.WriteString("Time:     " + now.Format(time.RFC3339Nano) + "\n")
+	text.WriteString("Service:  " + serviceType + " '" + name + "'\n")
+	text.WriteString("Platform: " + runtime.GOOS + "/" + runtime.GOARCH +
+		", " + runtime.Version() + "\n")
+	text.WriteString("Panic:    " + fmt.Sprint(value) + "\n\n")
+	text.Write(stack)
+	path := filepath.Join(agent.LogDir, fileName)
+	err = os.WriteFile(path, []byte(text.String()), DefaultFilePermissions)
+	if err != nil {
+		return
+	}
+	report = path
+	agent.pruneCrashReports()
+	return
+}
+
+// pruneCrashReports removes the oldest crash reports in the log directory,
+// keeping the most recent.
+func (agent *FeedbackAgent) pruneCrashReports() {
+	entries, err := os.ReadDir(agent.LogDir)
+	if err != nil {
+		return
+	}
+	var reports []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && strings.HasPrefix(name, CrashReportPrefix) &&
+			strings.HasSuffix(name, CrashReportExtension) {
+			reports = append(reports, name)
+		}
+	}
+	// Reports are named by time, so sort in order of age.
+	slices.Sort(reports)
+	for len(reports) > MaxCrashReports {
+		_ = os.Remove(filepath.Join(agent.LogDir, reports[0]))
+		reports = reports[1:]
+	}
+}
+
+// recoverPanic is deferred by goroutines handling the requests of this
+// FeedbackResponder, so that a panic only fails the request concerned,
+// closing its connection if given.
+func (fbr *FeedbackResponder) recoverPanic(conn io.Closer) {
+	if PanicDebug {
+		return
+	}
+	if r := recover(); r != nil {
+		fbr.ParentAgent.reportPanic(LogFieldResponder, fbr.ResponderName, r)
+		if conn != nil {
+			_ = conn.Close()
+		}
+	}
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,194 @@
+// debug.go
+// Opt-In Profiling Listener
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// To investigate the behaviour of the agent in production (e.g. high CPU
+// usage or memory growth under load), a separate listener can be enabled
+// which serves the Go runtime profiles (net/http/pprof) and variables
+// (expvar), including the internal metrics of the agent, e.g.:
+//
+//	go tool pprof http://127.0.0.1:6060/debug/pprof/profile?seconds=30
+//
+// This listener is never enabled by default, and as it has no
+// authentication, it may only listen on a loopback address.
+
+const (
+	// Default address on which the debug listener is bound.
+	DefaultDebugListenerAddress = "127.0.0.1"
+	// Time allowed for profiles being served to complete when stopping.
+	DebugListenerStopTimeout = 5 * time.Second
+	// Name under which the internal metrics are published with expvar.
+	DebugStatsVariable = "lbfeedback"
+)
+
+// DebugListenerConfig holds the settings for the debug listener, which is
+// enabled if these are present in the config.
+type DebugListenerConfig struct {
+	Address string `json:"ip,omitempty"`
+	Port    string `json:"port"`
+}
+
+// Validate checks the debug listener settings, returning the address on
+// which to listen.
+func (config *DebugListenerConfig) Validate() (address string, err error) {
+	ip := config.Address
+	if ip == "" {
+		ip = DefaultDebugListenerAddress
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil || !parsed.IsLoopback() {
+		err = errors.New("debug listener address must be a loopback " +
+			"IP address, as it has no authentication")
+		return
+	}
+	port, err := ParseNetworkPort(config.Port)
+	if err != nil {
+		err = errors.New("debug listener: " + err.Error())
+		return
+	}
+	address = net.JoinHostPort(parsed.String(), port)
+	return
+}
+
+// #######################################################################
+// Debug Listener
+// #######################################################################
+
+// DebugListener serves the runtime profiles and variables of the agent.
+type DebugListener struct {
+	config DebugListenerConfig
+	server *http.Server
+}
+
+// The internal metrics can only be published once, as expvar does not
+// allow a variable to be replaced.
+var publishStatsOnce sync.Once
+
+// StartDebugListener validates the debug listener settings and starts
+// serving the profiles.
+func (agent *FeedbackAgent) StartDebugListener(config DebugListenerConfig) (
+	listener *DebugListener, err error) {
+	address, err := config.Validate()
+	if err != nil {
+		return
+	}
+	publishStatsOnce.Do(func() {
+		expvar.Publish(DebugStatsVariable, expvar.Func(func() any {
+			return agent.GetAgentStats()
+		}))
+	})
+	// Handlers are registered on a separate mux, so that nothing is
+	// served by accident from the default mux (to which the pprof and
+	// expvar packages add themselves).
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	socket, err := net.Listen("tcp", address)
+	if err != nil {
+		err = errors.New("debug listener: " + err.Error())
+		return
+	}
+	listener = &DebugListener{
+		config: config,
+		server: &http.Server{
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+	}
+	go func() {
+		serveErr := listener.server.Serve(socket)
+		if serveErr != nil && !errors.Is(serveErr, http.ErrServerClosed) {
+			logrus.Error("Debug listener failed: " + serveErr.Error())
+		}
+	}()
+	logrus.Warn("Debug listener enabled on http://" + socket.Addr().String() +
+		"/debug/pprof/; this should only be used whilst investigating " +
+		"a problem.")
+	return
+}
+
+// Stop stops the debug listener, allowing any profiles being served a
+// short time to complete.
+func (listener *DebugListener) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(),
+		DebugListenerStopTimeout)
+	defer cancel()
+	if listener.server.Shutdown(ctx) != nil {
+		_ = listener.server.Close()
+	}
+}
+
+// UpdateDebugListener starts, restarts or stops the debug listener
+// according to the settings of the agent.
+func (agent *FeedbackAgent) UpdateDebugListener() {
+	if agent.debugListener != nil {
+		if agent.DebugListener != nil &&
+			agent.debugListener.config == *agent.DebugListener {
+			return
+		}
+		agent.debugListener.Stop()
+		agent.debugListener = nil
+		if agent.DebugListener == nil {
+			logrus.Info("Stopped the debug listener.")
+			return
+		}
+	}
+	if agent.DebugListener == nil {
+		return
+	}
+	listener, err := agent.StartDebugListener(*agent.DebugListener)
+	if err != nil {
+		logrus.Error("Failed to start the debug listener: " + err.Error())
+		return
+	}
+	agent.debugListener = listener
+}
+
+// StopDebugListener stops the debug listener when the agent shuts down,
+// leaving the debug-listener setting unchanged.
+func (agent *FeedbackAgent) StopDebugListener() {
+	if agent.debugListener != nil {
+		agent.debugListener.Stop()
+		agent.debugListener = nil
+		logrus.Info("Stopped the debug listener.")
+	}
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
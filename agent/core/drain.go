@@ -0,0 +1,144 @@
+// drain.go
+// Detection of Drain Completion
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// When a Responder is draining, automation usually needs to know when it
+// is safe to take the server down. If a Responder has a drain monitor, a
+// 'netconn' monitor (typically restricted to the local port of the
+// balanced service), this is watched whilst the Responder is draining, and
+// a 'drain-complete' event is raised once when the number of connections
+// reaches zero. The event is logged, recorded in the event log, and sent
+// to webhooks and email alerts. It is raised again the next time that the
+// Responder drains.
+
+const (
+	// Type of the event raised when a draining Responder has no remaining
+	// connections.
+	EventTypeDrainComplete = "drain-complete"
+	// Interval at which the drain monitor of a draining Responder is
+	// checked for remaining connections.
+	DrainCheckInterval = time.Second
+)
+
+// configureDrainMonitor validates the drain monitor of this
+// FeedbackResponder, if set, which must be an existing 'netconn' monitor.
+// The caller must hold the mutex.
+func (fbr *FeedbackResponder) configureDrainMonitor() (err error) {
+	if fbr.DrainMonitor == "" {
+		return
+	}
+	name, err := StandardiseNameIdentifier(fbr.DrainMonitor)
+	if err != nil {
+		err = errors.New("drain monitor " + err.Error())
+		return
+	}
+	if fbr.ParentAgent != nil {
+		monitor, exists := fbr.ParentAgent.Monitors[name]
+		if !exists {
+			err = errors.New("drain monitor '" + name + "' does not exist")
+			return
+		}
+		if monitor.MetricType != MetricTypeNetConnections {
+			err = errors.New("drain monitor '" + name + "' must be a '" +
+				MetricTypeNetConnections + "' monitor")
+			return
+		}
+	}
+	fbr.DrainMonitor = name
+	return
+}
+
+// isDraining returns whether this FeedbackResponder is offline with the
+// 'drain' command, whether by threshold, action or forced override. The
+// caller must hold the mutex.
+func (fbr *FeedbackResponder) isDraining() bool {
+	mask := fbr.configCommandMask
+	if fbr.overrideMask != HAPEnumNone {
+		mask = fbr.overrideMask
+	}
+	return !fbr.onlineState && mask&HAPEnumDrain&HAPMaskCommand != 0
+}
+
+// watchDrain checks the drain monitor of this FeedbackResponder whilst it
+// is draining, raising an event once the number of connections sampled
+// since draining began reaches zero, until the context is cancelled.
+func (fbr *FeedbackResponder) watchDrain(ctx context.Context,
+	monitorName string) {
+	if fbr.ParentAgent == nil {
+		return
+	}
+	ticker := time.NewTicker(DrainCheckInterval)
+	defer ticker.Stop()
+	var drainSince time.Time
+	reported := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		fbr.mutex.Lock()
+		draining := fbr.isDraining()
+		fbr.mutex.Unlock()
+		if !draining {
+			drainSince = time.Time{}
+			reported = false
+			continue
+		}
+		if drainSince.IsZero() {
+			drainSince = time.Now()
+		}
+		monitor := fbr.ParentAgent.Monitors[monitorName]
+		if reported || monitor == nil {
+			continue
+		}
+		connections, sampleTime := monitor.latestSample()
+		if connections > 0 || !sampleTime.After(drainSince) {
+			continue
+		}
+		reported = true
+		seconds := int(time.Since(drainSince).Seconds())
+		fbr.ParentAgent.RaiseEvent(AgentEvent{
+			Type:        EventTypeDrainComplete,
+			Level:       LogLevelInfo,
+			ServiceType: "responder",
+			ServiceName: fbr.ResponderName,
+			Message: fbr.getLogHead() + "has finished draining; no " +
+				"connections remain (monitor '" + monitorName + "', after " +
+				strconv.Itoa(seconds) + "s).",
+			Fields: map[string]any{
+				"monitor":       monitorName,
+				"drain-seconds": seconds,
+			},
+		})
+	}
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
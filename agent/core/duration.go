@@ -0,0 +1,101 @@
+// duration.go
+// Human-Readable Configuration Durations
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Durations in the JSON configuration (such as the timeouts of a
+// Responder) are written as strings such as '500ms' or '2s', rather than
+// as raw numbers of nanoseconds which are easily mistaken for another
+// unit. A string holding only a number (as given to the CLI) is taken as
+// milliseconds, whilst a JSON number is still read as nanoseconds, as
+// written by earlier versions.
+
+// #################################
+// DURATION VALUES
+// #################################
+
+// Duration is a time.Duration which is marshalled as a human-readable
+// string in the JSON configuration.
+type Duration time.Duration
+
+// ParseDuration parses a duration such as '500ms' or '2s', where a number
+// without a unit is taken as milliseconds and an empty string is zero.
+func ParseDuration(value string) (duration Duration, err error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return
+	}
+	milliseconds, intErr := strconv.ParseInt(value, 10, 64)
+	if intErr == nil {
+		duration = Duration(time.Duration(milliseconds) * time.Millisecond)
+		return
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		err = errors.New("invalid duration '" + value + "'; must be a " +
+			"number of milliseconds or have a unit, e.g. '500ms' or '2s'")
+		return
+	}
+	duration = Duration(parsed)
+	return
+}
+
+// String returns the duration in the form accepted by ParseDuration.
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// MarshalJSON encodes the duration as a string, e.g. "1.5s".
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON decodes a duration given as a string, or as a number of
+// nanoseconds for configurations written by earlier versions.
+func (d *Duration) UnmarshalJSON(data []byte) (err error) {
+	var value any
+	err = json.Unmarshal(data, &value)
+	if err != nil {
+		return
+	}
+	switch value := value.(type) {
+	case string:
+		*d, err = ParseDuration(value)
+	case float64:
+		*d = Duration(value)
+	case nil:
+	default:
+		err = errors.New("invalid duration " + string(data) +
+			"; must be a string, e.g. \"500ms\" or \"2s\"")
+	}
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,436 @@
+// email.go
+// Email Alerts of Responder State Changes and Sampling Errors
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Email alerts send a summary to the configured recipients over SMTP when
+// a Responder goes offline or online (by crossing its threshold, or by a
+// forced state being set or ending), or when a monitor has failed to
+// sample for longer than the sampling error delay, and again when it
+// recovers. To prevent storms of email, at most one message is sent per
+// minimum interval; alerts raised in the meantime are gathered into the
+// next message. If a username is given, the password is sent with PLAIN
+// authentication, which net/smtp only permits over TLS or to localhost.
+// The server is connected with STARTTLS where offered, or with TLS from
+// the outset if implicit TLS is set (usually port 465).
+
+const (
+	// Default and minimum intervals between emails.
+	DefaultEmailInterval = 5 * time.Minute
+	MinEmailInterval     = 10 * time.Second
+	// Default time for which a monitor must fail to sample before an
+	// alert is sent (seconds).
+	DefaultEmailSamplingDelay = 60
+	// Time allowed for each connection to the SMTP server.
+	EmailTimeout = 30 * time.Second
+	// Maximum number of alerts held for the next email; the oldest are
+	// discarded beyond this.
+	MaxEmailAlerts = 100
+	// Number of alerts queued for the email notifier before further
+	// alerts are dropped.
+	EmailQueueSize = 256
+)
+
+// emailEventTypes lists the types of event which are sent as email alerts,
+// other than for sampling errors.
+var emailEventTypes = []string{
+	EventTypeThresholdCrossed, EventTypeStateForced,
+	EventTypeOverrideExpired, EventTypeOverrideCancelled,
+	EventTypeDrainComplete,
+}
+
+// EmailConfig holds the settings for email alerts, which are enabled if
+// these settings are present in the config. The username and password may
+// contain secret references, as for the API key.
+type EmailConfig struct {
+	Server        string   `json:"server"`
+	ImplicitTLS   bool     `json:"implicit-tls,omitempty"`
+	Username      string   `json:"username,omitempty"`
+	Password      string   `json:"password,omitempty"`
+	From          string   `json:"from"`
+	To            []string `json:"to"`
+	Interval      Duration `json:"min-interval,omitempty"`
+	SamplingDelay int      `json:"sampling-error-delay-s,omitempty"`
+}
+
+// Validate checks the email settings, returning the resolved username and
+// password.
+func (config *EmailConfig) Validate() (username string, password string,
+	err error) {
+	if _, _, splitErr := net.SplitHostPort(config.Server); splitErr != nil {
+		err = errors.New("email server must be in the form 'host:port'")
+		return
+	}
+	if _, parseErr := mail.ParseAddress(config.From); parseErr != nil {
+		err = errors.New("invalid email sender address '" + config.From + "'")
+		return
+	}
+	if len(config.To) == 0 {
+		err = errors.New("no email recipients specified")
+		return
+	}
+	for _, recipient := range config.To {
+		if _, parseErr := mail.ParseAddress(recipient); parseErr != nil {
+			err = errors.New("invalid email recipient address '" +
+				recipient + "'")
+			return
+		}
+	}
+	if config.Interval != 0 && time.Duration(config.Interval) <
+		MinEmailInterval {
+		err = errors.New("email interval must be at least " +
+			MinEmailInterval.String())
+		return
+	} else if config.SamplingDelay < 0 {
+		err = errors.New("email sampling error delay cannot be negative")
+		return
+	}
+	username, err = ResolveSecret(config.Username)
+	if err != nil {
+		err = errors.New("cannot resolve email username: " + err.Error())
+		return
+	}
+	password, err = ResolveSecret(config.Password)
+	if err != nil {
+		err = errors.New("cannot resolve email password: " + err.Error())
+	}
+	return
+}
+
+// #######################################################################
+// Email Notifier
+// #######################################################################
+
+// EmailNotifier gathers alerts and sends them by email whilst the agent is
+// running.
+type EmailNotifier struct {
+	config        EmailConfig
+	username      string
+	password      string
+	host          string
+	interval      time.Duration
+	samplingDelay time.Duration
+	queue         chan AgentEvent
+	cancel        context.CancelFunc
+	done          chan struct{}
+	// Alerts waiting to be sent, and when an email was last sent.
+	alerts   []AgentEvent
+	lastSent time.Time
+	// Sampling errors of each monitor which have not yet been alerted,
+	// and the monitors for which an alert has been sent.
+	samplingErrors  map[string]AgentEvent
+	samplingAlerted map[string]bool
+	// Whether the last attempt to send failed, so that only changes are
+	// logged.
+	failing bool
+}
+
+// StartEmailNotifier validates the email settings and starts sending
+// alerts.
+func StartEmailNotifier(config EmailConfig) (notifier *EmailNotifier,
+	err error) {
+	username, password, err := config.Validate()
+	if err != nil {
+		return
+	}
+	interval := time.Duration(config.Interval)
+	if interval == 0 {
+		interval = DefaultEmailInterval
+	}
+	samplingDelay := config.SamplingDelay
+	if samplingDelay == 0 {
+		samplingDelay = DefaultEmailSamplingDelay
+	}
+	host, _ := os.Hostname()
+	ctx, cancel := context.WithCancel(context.Background())
+	notifier = &EmailNotifier{
+		config:          config,
+		username:        username,
+		password:        password,
+		host:            host,
+		interval:        interval,
+		samplingDelay:   time.Duration(samplingDelay) * time.Second,
+		queue:           make(chan AgentEvent, EmailQueueSize),
+		cancel:          cancel,
+		done:            make(chan struct{}),
+		samplingErrors:  make(map[string]AgentEvent),
+		samplingAlerted: make(map[string]bool),
+	}
+	go notifier.run(ctx)
+	logrus.Info("Sending email alerts to " +
+		strings.Join(config.To, ", ") + " at most every " +
+		notifier.interval.String() + ".")
+	return
+}
+
+// Stop stops sending alerts, abandoning any not yet sent.
+func (notifier *EmailNotifier) Stop() {
+	notifier.cancel()
+	<-notifier.done
+}
+
+// Notify queues an event to be considered for an alert; if the queue is
+// full, the event is dropped, so this never blocks.
+func (notifier *EmailNotifier) Notify(event AgentEvent) {
+	select {
+	case notifier.queue <- event:
+	default:
+	}
+}
+
+// run gathers alerts and sends them until cancelled.
+func (notifier *EmailNotifier) run(ctx context.Context) {
+	defer close(notifier.done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-notifier.queue:
+			notifier.handle(event)
+		case now := <-ticker.C:
+			notifier.checkSampling(now)
+			if len(notifier.alerts) > 0 &&
+				now.Sub(notifier.lastSent) >= notifier.interval {
+				notifier.send(now)
+			}
+		}
+	}
+}
+
+// handle adds an alert for an event, if it is one of those alerted.
+// Sampling errors are held until they have persisted for the delay.
+func (notifier *EmailNotifier) handle(event AgentEvent) {
+	switch event.Type {
+	case EventTypeSampleFailed:
+		notifier.samplingErrors[event.ServiceName] = event
+	case EventTypeSampleRecovered:
+		delete(notifier.samplingErrors, event.ServiceName)
+		if notifier.samplingAlerted[event.ServiceName] {
+			delete(notifier.samplingAlerted, event.ServiceName)
+			notifier.addAlert(event)
+		}
+	default:
+		for _, eventType := range emailEventTypes {
+			if event.Type == eventType {
+				notifier.addAlert(event)
+			}
+		}
+	}
+}
+
+// checkSampling adds an alert for each sampling error which has persisted
+// for the delay.
+func (notifier *EmailNotifier) checkSampling(now time.Time) {
+	for name, event := range notifier.samplingErrors {
+		if now.Sub(event.Time) < notifier.samplingDelay {
+			continue
+		}
+		delete(notifier.samplingErrors, name)
+		notifier.samplingAlerted[name] = true
+		event.Message += " (failing for over " +
+			notifier.samplingDelay.String() + ")"
+		notifier.addAlert(event)
+	}
+}
+
+// addAlert adds an alert to be sent, discarding the oldest if too many are
+// waiting.
+func (notifier *EmailNotifier) addAlert(event AgentEvent) {
+	notifier.alerts = append(notifier.alerts, event)
+	if excess := len(notifier.alerts) - MaxEmailAlerts; excess > 0 {
+		notifier.alerts = notifier.alerts[excess:]
+	}
+}
+
+// send emails the waiting alerts. If sending fails, they are kept to be
+// retried after the interval.
+func (notifier *EmailNotifier) send(now time.Time) {
+	notifier.lastSent = now
+	message := notifier.composeMessage(now)
+	err := notifier.sendMail(message)
+	if err != nil {
+		if !notifier.failing {
+			logrus.Warn("Failed to send an email alert: " + err.Error())
+		}
+		notifier.failing = true
+		return
+	}
+	if notifier.failing {
+		logrus.Info("Email alerts are being sent successfully again.")
+	}
+	notifier.failing = false
+	logrus.Debug("Sent an email alert with " +
+		strconv.Itoa(len(notifier.alerts)) + " alert(s).")
+	notifier.alerts = nil
+}
+
+// composeMessage returns the message summarising the waiting alerts.
+func (notifier *EmailNotifier) composeMessage(now time.Time) []byte {
+	subject := AppIdentifier + " on " + notifier.host + ": "
+	if len(notifier.alerts) == 1 {
+		subject += notifier.alerts[0].Message
+	} else {
+		subject += strconv.Itoa(len(notifier.alerts)) + " alerts"
+	}
+	// Header values must not span lines.
+	subject = strings.Join(strings.Fields(subject), " ")
+	var builder strings.Builder
+	builder.WriteString("From: " + notifier.config.From + "\r\n")
+	builder.WriteString("To: " + strings.Join(notifier.config.To, ", ") +
+		"\r\n")
+	builder.WriteString("Subject: " + subject + "\r\n")
+	builder.WriteString("Date: " + now.Format(time.RFC1123Z) + "\r\n")
+	builder.WriteString("MIME-Version: 1.0\r\n")
+	builder.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	builder.WriteString("The Feedback Agent on " + notifier.host +
+		" has raised the following alerts:\r\n\r\n")
+	for _, alert := range notifier.alerts {
+		text := strings.ReplaceAll(alert.Message, "\n", "\r\n    ")
+		builder.WriteString(alert.Time.Format(time.DateTime) + "  [" +
+			alert.Level + "] " + text + "\r\n")
+	}
+	return []byte(builder.String())
+}
+
+// sendMail sends a message to the recipients through the SMTP server.
+func (notifier *EmailNotifier) sendMail(message []byte) (err error) {
+	host, _, _ := net.SplitHostPort(notifier.config.Server)
+	tlsConfig := &tls.Config{ServerName: host}
+	dialer := &net.Dialer{Timeout: EmailTimeout}
+	var conn net.Conn
+	if notifier.config.ImplicitTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", notifier.config.Server,
+			tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", notifier.config.Server)
+	}
+	if err != nil {
+		return
+	}
+	_ = conn.SetDeadline(time.Now().Add(EmailTimeout))
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok && !notifier.config.ImplicitTLS {
+		err = client.StartTLS(tlsConfig)
+		if err != nil {
+			return
+		}
+	}
+	if notifier.username != "" {
+		err = client.Auth(smtp.PlainAuth("", notifier.username,
+			notifier.password, host))
+		if err != nil {
+			return
+		}
+	}
+	from, _ := mail.ParseAddress(notifier.config.From)
+	err = client.Mail(from.Address)
+	if err != nil {
+		return
+	}
+	for _, recipient := range notifier.config.To {
+		to, _ := mail.ParseAddress(recipient)
+		err = client.Rcpt(to.Address)
+		if err != nil {
+			return
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return
+	}
+	_, err = writer.Write(message)
+	if err != nil {
+		return
+	}
+	err = writer.Close()
+	if err != nil {
+		return
+	}
+	err = client.Quit()
+	return
+}
+
+// UpdateEmailNotifier starts, restarts or stops sending email alerts
+// according to the email-alerts setting of the agent.
+func (agent *FeedbackAgent) UpdateEmailNotifier() {
+	if agent.emailNotifier == nil {
+		return
+	}
+	current := agent.emailNotifier.Load()
+	if current != nil {
+		if agent.EmailAlerts != nil &&
+			configJSONEqual(current.config, *agent.EmailAlerts) {
+			return
+		}
+		agent.emailNotifier.Store(nil)
+		current.Stop()
+		if agent.EmailAlerts == nil {
+			logrus.Info("Stopped sending email alerts.")
+			return
+		}
+	}
+	if agent.EmailAlerts == nil {
+		return
+	}
+	notifier, err := StartEmailNotifier(*agent.EmailAlerts)
+	if err != nil {
+		logrus.Error("Failed to start email alerts: " + err.Error())
+		return
+	}
+	agent.emailNotifier.Store(notifier)
+}
+
+// StopEmailNotifier stops sending email alerts when the agent shuts down,
+// leaving the email-alerts setting unchanged.
+func (agent *FeedbackAgent) StopEmailNotifier() {
+	if agent.emailNotifier == nil {
+		return
+	}
+	if current := agent.emailNotifier.Swap(nil); current != nil {
+		current.Stop()
+		logrus.Info("Stopped sending email alerts.")
+	}
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,537 @@
+// eventlog.go
+// Persistent Log of Significant Events, with Queries
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The event log records significant events within the agent, so that the
+// reasons for a change in the state of a real server can be established
+// afterwards: advisory events (such as anomalies), threshold changes,
+// forced states, configuration changes, services starting and stopping,
+// and sampling failures. The most recent events are held in memory, and
+// also appended to a file in the config directory (unless memory-only is
+// set), from which they are reloaded when the agent starts. The file is
+// rewritten with only the most recent events once it holds twice as many
+// as are retained. Events can be queried by time, type and service with
+// 'get events'.
+
+// Types of event recorded for state transitions, which are not logged as
+// events as they are already logged (or only logged if requested).
+const (
+	EventTypeThresholdCrossed = "threshold-crossed"
+	EventTypeStateForced      = "state-forced"
+	EventTypeSampleFailed     = "sample-failed"
+	EventTypeSampleRecovered  = "sample-recovered"
+	EventTypeServiceStarted   = "service-started"
+	EventTypeServiceStopped   = "service-stopped"
+	EventTypeServiceFailed    = "service-failed"
+	EventTypeConfigChanged    = "config-changed"
+)
+
+const (
+	// Default number of events retained by the agent.
+	DefaultMaxEvents = 1000
+	// Name of the file in the config directory holding the event log.
+	EventLogFileName = "events.jsonl"
+	// Number of the most recent events returned by a query, unless
+	// otherwise limited.
+	DefaultEventQueryLimit = 100
+)
+
+// EventLogConfig holds the settings for the event log. If these are not
+// present in the config, the default number of events is retained, and
+// written to the event log file.
+type EventLogConfig struct {
+	MaxEvents  int  `json:"max-events,omitempty"`
+	MemoryOnly bool `json:"memory-only,omitempty"`
+}
+
+// Validate checks the event log settings.
+func (config *EventLogConfig) Validate() (err error) {
+	if config.MaxEvents < 0 {
+		err = errors.New("the maximum number of events cannot be negative")
+	}
+	return
+}
+
+// #######################################################################
+// Event Log
+// #######################################################################
+
+// EventLog retains the most recent events recorded within the agent, and
+// writes them to a file if one is configured. Events are written by a
+// background goroutine, so that recording an event never waits for the
+// disk.
+type EventLog struct {
+	events []AgentEvent
+	max    int
+	path   string
+	// Total number of events added, and how many of those have been
+	// passed to the writer goroutine.
+	added   int
+	written int
+	mutex   sync.Mutex
+	// Signals the writer goroutine that there are events to be written,
+	// and is closed once it completes.
+	wake   chan struct{}
+	closed chan struct{}
+	// Held whilst writing the file. This is always acquired before the
+	// mutex when both are held.
+	fileMutex sync.Mutex
+	file      *os.File
+	// Number of events in the file, which is compacted once it holds
+	// twice as many as are retained.
+	fileEvents int
+}
+
+// capacity returns the number of events retained. The caller must hold the
+// mutex.
+func (log *EventLog) capacity() int {
+	if log.max > 0 {
+		return log.max
+	}
+	return DefaultMaxEvents
+}
+
+// Add records a new event, discarding the oldest event if the log is full.
+func (log *EventLog) Add(event AgentEvent) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	if len(log.events) >= log.capacity() {
+		log.events = log.events[len(log.events)-log.capacity()+1:]
+	}
+	log.events = append(log.events, event)
+	log.added++
+	if log.wake == nil {
+		return
+	}
+	// A pending signal already covers this event.
+	select {
+	case log.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Recent returns a copy of the events in the log, oldest first.
+func (log *EventLog) Recent() (events []AgentEvent) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	events = make([]AgentEvent, len(log.events))
+	copy(events, log.events)
+	return
+}
+
+// Configure sets the number of events retained and the file to which they
+// are written, which is none if the path is empty. Any events in the file
+// are loaded ahead of those already recorded (e.g. whilst starting).
+func (log *EventLog) Configure(max int, path string) (err error) {
+	log.fileMutex.Lock()
+	defer log.fileMutex.Unlock()
+	log.mutex.Lock()
+	if max == log.max && path == log.path && (path == "" || log.file != nil) {
+		log.mutex.Unlock()
+		return
+	}
+	changed := path != "" && path != log.path
+	log.mutex.Unlock()
+	var loaded []AgentEvent
+	if changed {
+		loaded, err = readEventLogFile(path)
+		if err != nil {
+			return
+		}
+	}
+	log.mutex.Lock()
+	log.events = append(loaded, log.events...)
+	log.max = max
+	log.path = path
+	if excess := len(log.events) - log.capacity(); excess > 0 {
+		log.events = log.events[excess:]
+	}
+	events := make([]AgentEvent, len(log.events))
+	copy(events, log.events)
+	log.written = log.added
+	if path != "" && log.wake == nil {
+		log.wake = make(chan struct{}, 1)
+		log.closed = make(chan struct{})
+		go log.writeLoop(log.wake, log.closed)
+	}
+	log.mutex.Unlock()
+	log.closeFile()
+	if path != "" {
+		err = log.rewrite(events)
+	}
+	return
+}
+
+// Close writes any remaining events, stops the writer goroutine and closes
+// the event log file, if any.
+func (log *EventLog) Close() {
+	log.mutex.Lock()
+	wake, closed := log.wake, log.closed
+	log.wake = nil
+	log.mutex.Unlock()
+	if wake != nil {
+		close(wake)
+		<-closed
+	}
+	log.flush()
+	log.fileMutex.Lock()
+	defer log.fileMutex.Unlock()
+	log.mutex.Lock()
+	log.path = ""
+	log.mutex.Unlock()
+	log.closeFile()
+}
+
+// writeLoop writes events to the file whenever signalled, until the wake
+// channel is closed.
+func (log *EventLog) writeLoop(wake chan struct{}, closed chan struct{}) {
+	defer close(closed)
+	for range wake {
+		log.flush()
+	}
+}
+
+// flush writes the events added since the last flush to the file, or
+// compacts the file if it has grown too large.
+func (log *EventLog) flush() {
+	log.fileMutex.Lock()
+	defer log.fileMutex.Unlock()
+	log.mutex.Lock()
+	unwritten := log.added - log.written
+	log.written = log.added
+	if log.path == "" || log.file == nil || unwritten == 0 {
+		log.mutex.Unlock()
+		return
+	}
+	// Compact the file if it would grow too large, or if events have been
+	// discarded from memory before they could be written.
+	compact := unwritten > len(log.events) ||
+		log.fileEvents+unwritten >= 2*log.capacity()
+	if compact {
+		unwritten = len(log.events)
+	}
+	events := make([]AgentEvent, unwritten)
+	copy(events, log.events[len(log.events)-unwritten:])
+	log.mutex.Unlock()
+	if compact {
+		err := log.rewrite(events)
+		if err != nil {
+			logrus.Error("Failed to compact the event log: " + err.Error())
+		}
+		return
+	}
+	var data bytes.Buffer
+	for _, event := range events {
+		line, err := json.Marshal(event)
+		if err == nil {
+			data.Write(append(line, '\n'))
+		}
+	}
+	_, err := log.file.Write(data.Bytes())
+	if err != nil {
+		logrus.Error("Failed to write to the event log: " + err.Error())
+		return
+	}
+	log.fileEvents += len(events)
+}
+
+// closeFile closes the event log file, if it is open. The caller must hold
+// the file mutex.
+func (log *EventLog) closeFile() {
+	if log.file != nil {
+		_ = log.file.Close()
+		log.file = nil
+	}
+}
+
+// rewrite replaces the event log file with the given events and reopens it
+// for appending. The caller must hold the file mutex.
+func (log *EventLog) rewrite(events []AgentEvent) (err error) {
+	log.closeFile()
+	var data bytes.Buffer
+	for _, event := range events {
+		line, marshalErr := json.Marshal(event)
+		if marshalErr == nil {
+			data.Write(append(line, '\n'))
+		}
+	}
+	log.mutex.Lock()
+	path := log.path
+	log.mutex.Unlock()
+	err = WriteFileAtomic(path, data.Bytes())
+	if err != nil {
+		return
+	}
+	log.file, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	log.fileEvents = len(events)
+	return
+}
+
+// readEventLogFile reads the events in an event log file, skipping any
+// lines which cannot be parsed (e.g. one left incomplete by a crash). A
+// missing file holds no events.
+func readEventLogFile(path string) (events []AgentEvent, err error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		var event AgentEvent
+		if json.Unmarshal(scanner.Bytes(), &event) == nil {
+			events = append(events, event)
+		}
+	}
+	err = scanner.Err()
+	return
+}
+
+// UpdateEventLog configures the event log according to the event-log
+// setting of the agent.
+func (agent *FeedbackAgent) UpdateEventLog() {
+	if agent.events == nil {
+		return
+	}
+	max := 0
+	path := ""
+	if agent.Events == nil || !agent.Events.MemoryOnly {
+		path = filepath.Join(agent.configDir, EventLogFileName)
+	}
+	if agent.Events != nil {
+		max = agent.Events.MaxEvents
+	}
+	err := agent.events.Configure(max, path)
+	if err != nil {
+		logrus.Error("Failed to open the event log: " + err.Error())
+	}
+}
+
+// #######################################################################
+// Queries
+// #######################################################################
+
+// EventQuery selects events from the event log. Zero values select all.
+type EventQuery struct {
+	Since time.Time
+	Until time.Time
+	Types []string
+	// Name of the service which raised the events.
+	Name string
+	// Maximum number of the most recent matching events returned.
+	Limit int
+}
+
+// Match returns whether an event is selected by the query, other than by
+// its limit.
+func (query *EventQuery) Match(event AgentEvent) bool {
+	return (query.Since.IsZero() || !event.Time.Before(query.Since)) &&
+		(query.Until.IsZero() || !event.Time.After(query.Until)) &&
+		(len(query.Types) == 0 || slices.Contains(query.Types, event.Type)) &&
+		(query.Name == "" || event.ServiceName == query.Name)
+}
+
+// QueryEvents returns the events in the event log selected by a query,
+// oldest first, limited to those raised by services within a namespace if
+// specified.
+func (agent *FeedbackAgent) QueryEvents(query EventQuery, namespace string) (
+	events []AgentEvent) {
+	for _, event := range agent.RecentEvents(namespace) {
+		if query.Match(event) {
+			events = append(events, event)
+		}
+	}
+	if query.Limit > 0 && len(events) > query.Limit {
+		events = events[len(events)-query.Limit:]
+	}
+	return
+}
+
+// ParseEventTime parses the time given for an event query, which is either
+// a time (RFC 3339, or 'YYYY-MM-DD HH:MM[:SS]' in local time) or a duration
+// before now (e.g. '2h').
+func ParseEventTime(value string, now time.Time) (at time.Time, err error) {
+	value = strings.TrimSpace(value)
+	if duration, parseErr := time.ParseDuration(value); parseErr == nil {
+		at = now.Add(-duration)
+		return
+	}
+	at, err = time.Parse(time.RFC3339, value)
+	if err == nil {
+		return
+	}
+	for _, layout := range []string{time.DateTime, "2006-01-02 15:04",
+		"2006-01-02T15:04", time.DateOnly} {
+		at, err = time.ParseInLocation(layout, value, time.Local)
+		if err == nil {
+			return
+		}
+	}
+	err = errors.New("invalid time '" + value + "'; use e.g. '2h' (ago), " +
+		"'2006-01-02 15:04' or RFC 3339")
+	return
+}
+
+// APIHandleGetEvents returns the events selected by the filters of a 'get
+// events' request: the service name, the times since and until which
+// (or the duration up to now), the event types (comma-separated) and the
+// limit on the number of events returned.
+func (agent *FeedbackAgent) APIHandleGetEvents(request *APIRequest) (
+	events []AgentEvent, err error) {
+	now := time.Now()
+	query := EventQuery{
+		Name:  request.TargetName,
+		Limit: DefaultEventQueryLimit,
+	}
+	if request.Since != nil && *request.Since != "" {
+		query.Since, err = ParseEventTime(*request.Since, now)
+	} else if request.Duration != nil && *request.Duration != "" {
+		var duration time.Duration
+		duration, err = time.ParseDuration(strings.TrimSpace(
+			*request.Duration))
+		if err != nil || duration <= 0 {
+			err = errors.New("invalid duration '" + *request.Duration +
+				"'; must be positive, e.g. '10m'")
+		}
+		query.Since = now.Add(-duration)
+	}
+	if err != nil {
+		return
+	}
+	if request.Until != nil && *request.Until != "" {
+		query.Until, err = ParseEventTime(*request.Until, now)
+		if err != nil {
+			return
+		}
+	}
+	if request.EventTypes != nil {
+		for _, eventType := range strings.Split(*request.EventTypes, ",") {
+			if eventType = strings.TrimSpace(eventType); eventType != "" {
+				query.Types = append(query.Types, eventType)
+			}
+		}
+	}
+	if request.Limit != nil {
+		if *request.Limit < 0 {
+			err = errors.New("the event limit cannot be negative")
+			return
+		}
+		query.Limit = *request.Limit
+	}
+	events = agent.QueryEvents(query, request.namespace)
+	return
+}
+
+// #######################################################################
+// Recording State Transitions
+// #######################################################################
+
+// recordThresholdCrossed records an event when a Responder
+// changes state because it has crossed its threshold.
+func (fbr *FeedbackResponder) recordThresholdCrossed(availability int,
+	online bool) {
+	event := AgentEvent{
+		Type:        EventTypeThresholdCrossed,
+		Level:       LogLevelWarn,
+		ServiceType: "responder",
+		ServiceName: fbr.ResponderName,
+		Message: fbr.getLogHead() + "has crossed its threshold and is " +
+			"now offline.",
+		Fields: map[string]any{
+			LogFieldScore:  availability,
+			LogFieldOnline: online,
+		},
+	}
+	if online {
+		event.Level = LogLevelInfo
+		event.Message = fbr.getLogHead() + "has crossed its threshold and " +
+			"is now online."
+	}
+	fbr.ParentAgent.RecordEvent(event)
+}
+
+// recordSamplingEvent records an event when a monitor starts failing to
+// take samples, or recovers.
+func (monitor *SystemMonitor) recordSamplingEvent(eventType string,
+	err error) {
+	event := AgentEvent{
+		Type:        eventType,
+		Level:       LogLevelInfo,
+		ServiceType: LogFieldMonitor,
+		ServiceName: monitor.Name,
+		Message:     monitor.getLogHead() + "sampling has now succeeded.",
+	}
+	if err != nil {
+		event.Level = LogLevelError
+		event.Message = monitor.getLogHead() + "failed to sample metric: " +
+			err.Error()
+	}
+	monitor.ParentAgent.RecordEvent(event)
+}
+
+// recordServiceEvent records an event when a monitor or Responder starts,
+// stops or fails to start.
+func (agent *FeedbackAgent) recordServiceEvent(eventType string,
+	serviceType string, name string, message string) {
+	level := LogLevelInfo
+	if eventType == EventTypeServiceFailed {
+		level = LogLevelError
+	}
+	agent.RecordEvent(AgentEvent{
+		Type:        eventType,
+		Level:       level,
+		ServiceType: serviceType,
+		ServiceName: name,
+		Message:     message,
+	})
+}
+
+// recordConfigChange records an event when the configuration changes.
+func (agent *FeedbackAgent) recordConfigChange(message string) {
+	agent.RecordEvent(AgentEvent{
+		Type:    EventTypeConfigChanged,
+		Level:   LogLevelInfo,
+		Message: message,
+	})
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
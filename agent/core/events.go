@@ -0,0 +1,138 @@
+// events.go
+// Advisory Events Raised by Agent Services
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Types of event raised by agent services.
+const (
+	EventTypeAnomaly        = "anomaly"
+	EventTypeAnomalyCleared = "anomaly-cleared"
+)
+
+// Names of the structured fields attached to events.
+const (
+	EventFieldValue  = "value"
+	EventFieldMean   = "mean"
+	EventFieldZScore = "z-score"
+)
+
+// AgentEvent describes an advisory event raised by a service within the
+// agent. Events are informational only and do not alter the feedback
+// served by any Responder.
+type AgentEvent struct {
+	Time        time.Time      `json:"time"`
+	Type        string         `json:"type"`
+	Level       string         `json:"level"`
+	ServiceType string         `json:"service-type,omitempty"`
+	ServiceName string         `json:"service-name,omitempty"`
+	Message     string         `json:"message"`
+	Fields      map[string]any `json:"fields,omitempty"`
+}
+
+// RaiseEvent records an event raised by a service and writes it to the
+// log at the level of the event (by default, a warning), along with its
+// structured fields.
+func (agent *FeedbackAgent) RaiseEvent(event AgentEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if event.Level == "" {
+		event.Level = LogLevelWarn
+	}
+	var level logrus.Level
+	var err error
+	event.Level, level, err = ParseLogLevel(event.Level)
+	if err != nil {
+		event.Level, level = LogLevelWarn, logrus.WarnLevel
+	}
+	entry := logrus.WithField(LogFieldEvent, event.Type)
+	if event.ServiceType != "" {
+		entry = entry.WithField(event.ServiceType, event.ServiceName)
+	}
+	entry.WithFields(event.Fields).Log(level, event.Message)
+	agent.RecordEvent(event)
+}
+
+// RecordEvent records an event in the event log and sends it to the
+// webhooks and email alerts, without writing it to the log. This is used
+// directly for state transitions which are already logged (or which are
+// only logged if requested, such as threshold changes).
+func (agent *FeedbackAgent) RecordEvent(event AgentEvent) {
+	if agent == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if event.Level == "" {
+		event.Level = LogLevelWarn
+	}
+	if agent.events != nil {
+		agent.events.Add(event)
+	}
+	agent.Notify(event)
+}
+
+// Notify sends an event to the webhooks and email alerts, if they are
+// enabled.
+func (agent *FeedbackAgent) Notify(event AgentEvent) {
+	if agent.webhooks != nil {
+		if notifier := agent.webhooks.Load(); notifier != nil {
+			notifier.Notify(event)
+		}
+	}
+	if agent.emailNotifier != nil {
+		if notifier := agent.emailNotifier.Load(); notifier != nil {
+			notifier.Notify(event)
+		}
+	}
+}
+
+// RecentEvents returns the events most recently raised within the agent,
+// limited to those raised by services within a namespace if specified.
+func (agent *FeedbackAgent) RecentEvents(namespace string) (
+	events []AgentEvent) {
+	if agent.events == nil {
+		return
+	}
+	events = agent.events.Recent()
+	if namespace == "" {
+		return
+	}
+	filtered := []AgentEvent{}
+	for _, event := range events {
+		if agent.ServiceInNamespace(event.ServiceType, event.ServiceName,
+			namespace) {
+			filtered = append(filtered, event)
+		}
+	}
+	events = filtered
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,118 @@
+// feedbackcache.go
+// Caching of Feedback Responses for Feedback Responders
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// Time for which a feedback response is cached if the Responder has
+	// no sources from which to take a monitor interval (ms).
+	DefaultFeedbackCacheInterval = 1000
+)
+
+// feedbackCache holds the last feedback response of a FeedbackResponder,
+// so that it can be served to concurrent health checks without taking the
+// mutex of the Responder or recalculating the availability score. It has
+// its own mutex so that it can be read whilst the Responder is locked.
+type feedbackCache struct {
+	mutex    sync.RWMutex
+	feedback string
+	state    FeedbackState
+	expiry   time.Time
+}
+
+// get returns the cached feedback response and the state from which it was
+// produced, if there is one which has not expired at a given time.
+func (cache *feedbackCache) get(at time.Time) (feedback string,
+	state FeedbackState, cached bool) {
+	if cache == nil {
+		return
+	}
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	if cache.feedback == "" || !at.Before(cache.expiry) {
+		return
+	}
+	feedback = cache.feedback
+	state = cache.state
+	cached = true
+	return
+}
+
+// set caches a feedback response and its state until an expiry time.
+func (cache *feedbackCache) set(feedback string, state FeedbackState,
+	expiry time.Time) {
+	if cache == nil {
+		return
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.feedback = feedback
+	cache.state = state
+	cache.expiry = expiry
+}
+
+// invalidate discards the cached feedback response, which is required
+// whenever a change is made which would alter the response.
+func (cache *feedbackCache) invalidate() {
+	if cache == nil {
+		return
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.feedback = ""
+}
+
+// getCacheExpiry returns the time until which a feedback response generated
+// at a given time may be cached. This is the shortest sampling interval of
+// the source monitors, as the availability score cannot change until one
+// of them takes a new sample, unless a command is currently being sent, in
+// which case it is limited to when the command expires, or a forced
+// override expires. The caller must hold the mutex.
+func (fbr *FeedbackResponder) getCacheExpiry(at time.Time) (expiry time.Time) {
+	interval := 0
+	for _, source := range fbr.FeedbackSources {
+		if source.Monitor == nil {
+			continue
+		}
+		if interval == 0 || source.Monitor.Interval < interval {
+			interval = source.Monitor.Interval
+		}
+	}
+	if interval <= 0 {
+		interval = DefaultFeedbackCacheInterval
+	}
+	expiry = at.Add(time.Duration(interval) * time.Millisecond)
+	if fbr.stateExpiry.After(at) && fbr.stateExpiry.Before(expiry) {
+		expiry = fbr.stateExpiry
+	}
+	if fbr.forceExpiry.After(at) && fbr.forceExpiry.Before(expiry) {
+		expiry = fbr.forceExpiry
+	}
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,315 @@
+// feedbackformat.go
+// Output Formats for Feedback Responses
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// By default, Feedback Responders answer in the HAProxy agent-check format
+// (e.g. "up ready 75%"). For load balancers which instead expect explicit
+// scheduler hints, the 'weight' format answers with an integer weight from
+// 1 to 100 on the first line, and a state keyword on the second:
+//
+//	75
+//	up
+//
+// The state is 'up' whilst the Responder is online; when offline, it is
+// 'maint' or 'drain' if the offline commands include these, or otherwise
+// 'down'. Unlike HAProxy commands, the state is included in every
+// response, irrespective of the command interval.
+//
+// HTTP(S) Responders may also answer with a JSON report, giving the
+// availability along with the load of each source, the threshold state and
+// any HAProxy commands sent. This is used for every request if the 'json'
+// format is configured, or otherwise for requests which accept
+// 'application/json'. JSON reports are never cached.
+//
+// Alternatively, a Responder may define a Go text/template for its
+// response body, to match the exact format expected by another health
+// check consumer. The template is given the same fields as the JSON report
+// (e.g. 'weight={{.Availability}}{{"\n"}}'), with the sources accessed as
+// {{.Sources.cpu.Load}}, or {{(index .Sources "disk-usage").Value}} for
+// names containing a '-'. If the template fails, the default response is
+// sent instead.
+//
+// HTTP(S) Responders may also give their state as the status code, 200 when
+// online and 503 when offline, with the availability in a header, so that
+// plain HTTP health checks without agent-check support apply the threshold.
+
+// Feedback response formats.
+const (
+	FeedbackFormatHAProxy = "haproxy"
+	FeedbackFormatWeight  = "weight"
+	FeedbackFormatJSON    = "json"
+)
+
+// AvailabilityHeader gives the availability in the responses of HTTP(S)
+// Responders using status codes.
+const AvailabilityHeader = "X-Feedback-Availability"
+
+// State keywords for the 'weight' feedback format.
+const (
+	WeightStateUp    = "up"
+	WeightStateDrain = "drain"
+	WeightStateMaint = "maint"
+	WeightStateDown  = "down"
+)
+
+// Range of the weights given by the 'weight' feedback format.
+const (
+	MinFeedbackWeight = 1
+	MaxFeedbackWeight = 100
+)
+
+// ParseFeedbackFormat validates and standardises the name of a feedback
+// format, an empty name being the default 'haproxy' format.
+func ParseFeedbackFormat(name string) (result string, err error) {
+	result = strings.ToLower(strings.TrimSpace(name))
+	switch result {
+	case "":
+		result = FeedbackFormatHAProxy
+	case FeedbackFormatHAProxy, FeedbackFormatWeight, FeedbackFormatJSON:
+	default:
+		err = errors.New("invalid feedback format '" + name + "'; must be '" +
+			FeedbackFormatHAProxy + "', '" + FeedbackFormatWeight + "' or '" +
+			FeedbackFormatJSON + "'")
+	}
+	return
+}
+
+// configureFeedbackFormat validates the feedback format of this
+// FeedbackResponder, which only applies to those answering with a plain
+// text response. The caller must hold the mutex.
+func (fbr *FeedbackResponder) configureFeedbackFormat() (err error) {
+	format, err := ParseFeedbackFormat(fbr.FeedbackFormat)
+	if err != nil {
+		return
+	}
+	if format != FeedbackFormatHAProxy && fbr.ProtocolName != ProtocolTCP &&
+		fbr.ProtocolName != ProtocolHTTP && fbr.ProtocolName != ProtocolHTTPS {
+		err = errors.New("feedback formats are only supported by TCP and " +
+			"HTTP(S) responders")
+		return
+	}
+	if format == FeedbackFormatJSON && fbr.ProtocolName == ProtocolTCP {
+		err = errors.New("the '" + FeedbackFormatJSON + "' feedback format " +
+			"is only supported by HTTP(S) responders")
+		return
+	}
+	if fbr.StatusCodes && fbr.ProtocolName != ProtocolHTTP &&
+		fbr.ProtocolName != ProtocolHTTPS {
+		err = errors.New("status codes are only supported by HTTP(S) " +
+			"responders")
+		return
+	}
+	err = fbr.configureResponseTemplate(format)
+	if err != nil {
+		return
+	}
+	// The default format is left unset in the config.
+	if format == FeedbackFormatHAProxy {
+		format = ""
+	}
+	fbr.FeedbackFormat = format
+	return
+}
+
+// formatFeedback returns a plain text feedback response in a given format
+// for an availability score, along with the HAProxy commands if these are
+// to be sent. The caller must hold the mutex.
+func (fbr *FeedbackResponder) formatFeedback(format string, availability int,
+	commands string, send bool) (feedback string) {
+	// Scheduler hints give the weight and state in every response.
+	if format == FeedbackFormatWeight {
+		feedback = fbr.formatWeightHint(availability)
+		return
+	}
+	feedback = strconv.Itoa(availability) + "%"
+	if send {
+		feedback = commands + " " + feedback
+	}
+	// The HAProxy specs call for a final newline to be sent.
+	feedback += "\n"
+	return
+}
+
+// formatWeightHint returns a feedback response in the 'weight' format for
+// an availability score. The caller must hold the mutex.
+func (fbr *FeedbackResponder) formatWeightHint(availability int) string {
+	weight := min(max(availability, MinFeedbackWeight), MaxFeedbackWeight)
+	state := WeightStateUp
+	if !fbr.onlineState {
+		mask := fbr.configCommandMask
+		if fbr.overrideMask != HAPEnumNone {
+			mask = fbr.overrideMask
+		}
+		switch {
+		case mask&HAPEnumMaintenance&HAPMaskCommand != 0:
+			state = WeightStateMaint
+		case mask&HAPEnumDrain&HAPMaskCommand != 0:
+			state = WeightStateDrain
+		default:
+			state = WeightStateDown
+		}
+	}
+	return strconv.Itoa(weight) + "\n" + state + "\n"
+}
+
+// FeedbackReport is the JSON feedback response of a FeedbackResponder.
+type FeedbackReport struct {
+	Responder     string                        `json:"responder"`
+	Time          time.Time                     `json:"time"`
+	Availability  int                           `json:"availability"`
+	Online        bool                          `json:"online"`
+	Forced        bool                          `json:"forced,omitempty"`
+	ThresholdMode string                        `json:"threshold-mode"`
+	Threshold     int                           `json:"threshold,omitempty"`
+	Commands      string                        `json:"commands,omitempty"`
+	Sources       map[string]FeedbackSourceLoad `json:"sources,omitempty"`
+}
+
+// FeedbackSourceLoad is the load of a source in a FeedbackReport, along
+// with the current raw value of its monitor.
+type FeedbackSourceLoad struct {
+	Load  int   `json:"load"`
+	Value int64 `json:"value"`
+}
+
+// HandleFeedbackJSON answers a feedback request with a FeedbackReport in
+// JSON, updating the command state exactly as for HandleFeedback().
+func (fbr *FeedbackResponder) HandleFeedbackJSON() (feedback string,
+	state FeedbackState) {
+	timestamp := time.Now()
+	fbr.mutex.Lock()
+	defer fbr.mutex.Unlock()
+	availability, commands, send := fbr.updateFeedbackState(timestamp)
+	state = FeedbackState{Availability: availability, Online: fbr.onlineState}
+	report := fbr.newFeedbackReport(timestamp, availability, commands, send)
+	feedback = fbr.encodeFeedbackReport(report)
+	return
+}
+
+// encodeFeedbackReport returns a FeedbackReport as a JSON feedback
+// response, or an empty response if it cannot be encoded.
+func (fbr *FeedbackResponder) encodeFeedbackReport(report FeedbackReport) (
+	feedback string) {
+	encoded, err := json.Marshal(report)
+	if err != nil {
+		fbr.logger().Error(fbr.getLogHead() + "failed to encode feedback: " +
+			err.Error())
+		return
+	}
+	feedback = string(encoded) + "\n"
+	return
+}
+
+// newFeedbackReport returns a FeedbackReport of the current state of this
+// FeedbackResponder. The commands are only included when they are to be
+// sent to HAProxy. The caller must hold the mutex.
+func (fbr *FeedbackResponder) newFeedbackReport(timestamp time.Time,
+	availability int, commands string, send bool) (report FeedbackReport) {
+	report = FeedbackReport{
+		Responder:     fbr.ResponderName,
+		Time:          timestamp,
+		Availability:  availability,
+		Online:        fbr.onlineState,
+		Forced:        fbr.forceCommandState,
+		ThresholdMode: fbr.ThresholdModeName,
+		Sources:       make(map[string]FeedbackSourceLoad),
+	}
+	if fbr.thresholdModeEnum != ThresholdModeNone {
+		report.Threshold, _ = fbr.EffectiveThreshold(timestamp)
+	}
+	if send {
+		report.Commands = commands
+	}
+	for name, source := range fbr.FeedbackSources {
+		report.Sources[name] = FeedbackSourceLoad{
+			Load:  getSourceLoad(source),
+			Value: source.Monitor.StatsModel.GetResult(),
+		}
+	}
+	return
+}
+
+// configureResponseTemplate parses the response template of this
+// FeedbackResponder, if it has one, checking it against a report of its
+// sources so that references to unknown fields are rejected. The caller
+// must hold the mutex.
+func (fbr *FeedbackResponder) configureResponseTemplate(format string) (
+	err error) {
+	fbr.responseTemplate = nil
+	if fbr.ResponseTemplate == "" {
+		return
+	}
+	if fbr.ProtocolName != ProtocolTCP && fbr.ProtocolName != ProtocolHTTP &&
+		fbr.ProtocolName != ProtocolHTTPS {
+		err = errors.New("response templates are only supported by TCP and " +
+			"HTTP(S) responders")
+		return
+	}
+	if format != FeedbackFormatHAProxy {
+		err = errors.New("a response template cannot be used with the '" +
+			format + "' feedback format")
+		return
+	}
+	parsed, err := template.New(fbr.ResponderName).
+		Option("missingkey=error").Parse(fbr.ResponseTemplate)
+	if err != nil {
+		err = errors.New("invalid response template: " + err.Error())
+		return
+	}
+	sample := FeedbackReport{Sources: make(map[string]FeedbackSourceLoad)}
+	for name := range fbr.FeedbackSources {
+		sample.Sources[name] = FeedbackSourceLoad{}
+	}
+	err = parsed.Execute(io.Discard, sample)
+	if err != nil {
+		err = errors.New("invalid response template: " + err.Error())
+		return
+	}
+	fbr.responseTemplate = parsed
+	return
+}
+
+// formatTemplate returns a feedback response from the response template of
+// this FeedbackResponder, or an error if it could not be executed. The
+// caller must hold the mutex.
+func (fbr *FeedbackResponder) formatTemplate(timestamp time.Time,
+	availability int, commands string, send bool) (feedback string,
+	err error) {
+	report := fbr.newFeedbackReport(timestamp, availability, commands, send)
+	var output strings.Builder
+	err = fbr.responseTemplate.Execute(&output, report)
+	feedback = output.String()
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,246 @@
+// flaptest.go
+// Scripted State Flap Tests for Feedback Responders
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Types of event raised by flap tests.
+const (
+	EventTypeFlapTest = "flap-test"
+)
+
+const (
+	// Maximum total duration of the steps of a flap test.
+	MaxFlapTestDuration = 24 * time.Hour
+)
+
+// flapStateMasks maps the states used in flap test steps to their online
+// state and the HAProxy commands sent, where 'online' and 'offline' send
+// the commands configured for the Responder.
+var flapStateMasks = map[string]struct {
+	online bool
+	mask   int
+}{
+	"online":  {true, HAPEnumNone},
+	"offline": {false, HAPEnumNone},
+	"drain":   {false, HAPEnumDrain},
+	"halt":    {false, HAPEnumMaintenance},
+}
+
+// FlapStep is a single step of a flap test, holding a Responder in a
+// state for a period of time.
+type FlapStep struct {
+	State    string `json:"state"`
+	Duration int    `json:"duration-ms"`
+}
+
+// String describes a flap step in the format used by the CLI.
+func (step FlapStep) String() string {
+	return step.State + "=" +
+		(time.Duration(step.Duration) * time.Millisecond).String()
+}
+
+// ValidateFlapSequence checks the steps of a flap test.
+func ValidateFlapSequence(steps []FlapStep) (err error) {
+	if len(steps) == 0 {
+		err = errors.New("no flap sequence specified")
+		return
+	}
+	var total time.Duration
+	for i := range steps {
+		steps[i].State = strings.ToLower(strings.TrimSpace(steps[i].State))
+		if _, exists := flapStateMasks[steps[i].State]; !exists {
+			err = errors.New("invalid flap state '" + steps[i].State +
+				"'; use online, offline, drain or halt")
+			return
+		}
+		if steps[i].Duration <= 0 {
+			err = errors.New("flap step '" + steps[i].State +
+				"' must have a positive duration")
+			return
+		}
+		total += time.Duration(steps[i].Duration) * time.Millisecond
+	}
+	if total > MaxFlapTestDuration {
+		err = errors.New("flap sequence cannot last longer than " +
+			MaxFlapTestDuration.String())
+	}
+	return
+}
+
+// ParseFlapSequence parses a flap sequence from the format used by the
+// CLI, which is a list of steps separated by commas, each in the form
+// 'state=duration'; e.g. "offline=30s,online=1m,drain=10s".
+func ParseFlapSequence(text string) (steps []FlapStep, err error) {
+	for _, entry := range strings.Split(text, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		state, durationText, found := strings.Cut(entry, "=")
+		var duration time.Duration
+		if found {
+			duration, err = time.ParseDuration(strings.TrimSpace(durationText))
+		}
+		if !found || err != nil {
+			err = errors.New("invalid flap step '" + entry +
+				"'; use 'state=duration', e.g. 'offline=30s'")
+			return
+		}
+		steps = append(steps, FlapStep{
+			State:    state,
+			Duration: int(duration.Milliseconds()),
+		})
+	}
+	err = ValidateFlapSequence(steps)
+	return
+}
+
+// StartFlapTest drives this FeedbackResponder through a sequence of forced
+// states, so that the behaviour of HAProxy and any alerting can be
+// rehearsed. Threshold-driven state changes are suspended while the test
+// runs, and the state held before it is restored when it ends.
+func (fbr *FeedbackResponder) StartFlapTest(steps []FlapStep) (err error) {
+	err = ValidateFlapSequence(steps)
+	if err != nil {
+		return
+	}
+	fbr.mutex.Lock()
+	defer fbr.mutex.Unlock()
+	if !fbr.runState {
+		err = errors.New("responder is not running")
+		return
+	}
+	if fbr.flapStop != nil {
+		err = errors.New("a flap test is already running")
+		return
+	}
+	stop := make(chan struct{})
+	fbr.flapStop = stop
+	go fbr.runFlapTest(steps, stop, fbr.onlineState)
+	return
+}
+
+// StopFlapTest cancels the flap test running for this FeedbackResponder.
+func (fbr *FeedbackResponder) StopFlapTest() (err error) {
+	fbr.mutex.Lock()
+	defer fbr.mutex.Unlock()
+	if fbr.flapStop == nil {
+		err = errors.New("no flap test is running")
+		return
+	}
+	close(fbr.flapStop)
+	fbr.flapStop = nil
+	return
+}
+
+// runFlapTest applies each step of a flap test in turn until the sequence
+// is complete or the test is stopped, and then restores the prior state.
+func (fbr *FeedbackResponder) runFlapTest(steps []FlapStep,
+	stop chan struct{}, priorOnline bool) {
+	descriptions := make([]string, len(steps))
+	for i, step := range steps {
+		descriptions[i] = step.String()
+	}
+	fbr.raiseFlapEvent("flap test started: " +
+		strings.Join(descriptions, ", ") + ".")
+	outcome := "completed"
+sequence:
+	for i, step := range steps {
+		state := flapStateMasks[step.State]
+		fbr.SetCommandState(state.online, true, state.mask)
+		fbr.raiseFlapEvent("flap test step " + strconv.Itoa(i+1) + "/" +
+			strconv.Itoa(len(steps)) + ": " + step.State + " for " +
+			(time.Duration(step.Duration) * time.Millisecond).String() + ".")
+		timer := time.NewTimer(time.Duration(step.Duration) * time.Millisecond)
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			outcome = "stopped"
+			break sequence
+		}
+	}
+	fbr.mutex.Lock()
+	if fbr.flapStop == stop {
+		fbr.flapStop = nil
+	}
+	fbr.mutex.Unlock()
+	fbr.SetCommandState(priorOnline, false, HAPEnumNone)
+	prior := "offline"
+	if priorOnline {
+		prior = "online"
+	}
+	fbr.raiseFlapEvent("flap test " + outcome + "; the prior state (" +
+		prior + ") has been restored.")
+}
+
+// raiseFlapEvent raises an informational event for a flap test.
+func (fbr *FeedbackResponder) raiseFlapEvent(message string) {
+	if fbr.ParentAgent == nil {
+		return
+	}
+	fbr.ParentAgent.RaiseEvent(AgentEvent{
+		Type:        EventTypeFlapTest,
+		Level:       LogLevelInfo,
+		ServiceType: "responder",
+		ServiceName: fbr.ResponderName,
+		Message:     fbr.getLogHead() + message,
+	})
+}
+
+// APIHandleStartFlapTest processes an API request to start a flap test,
+// which is only permitted if test actions are enabled in the
+// configuration.
+func (agent *FeedbackAgent) APIHandleStartFlapTest(request *APIRequest) (
+	err error) {
+	if !agent.EnableTests {
+		err = errors.New("test actions are disabled; set " +
+			"'enable-test-actions' in the configuration to enable them")
+		return
+	}
+	if request.FlapSequence == nil {
+		err = errors.New("no flap sequence specified")
+		return
+	}
+	res, err := agent.GetResponderByName(request.TargetName)
+	if err != nil {
+		return
+	}
+	err = res.StartFlapTest(*request.FlapSequence)
+	return
+}
+
+// StopAllFlapTests cancels any flap tests which are running.
+func (agent *FeedbackAgent) StopAllFlapTests() {
+	for _, responder := range agent.Responders {
+		_ = responder.StopFlapTest()
+	}
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,270 @@
+// fleet.go
+// Fleet Mode: Sending API Requests to Many Remote Agents
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// In fleet mode, the CLI client sends a request to the agents on many
+// remote hosts at once, rather than to the local agent, e.g.
+//
+//	lbfeedback force drain -name default -hosts web01,web02
+//
+// The hosts are named in a fleet file (by default 'fleet.json' in the
+// config directory), giving the API address and key of the agent on each:
+//
+//	{
+//	    "hosts": {
+//	        "web01": {"address": "10.0.0.11:3334", "key": "${WEB01_KEY}"},
+//	        "web02": {"address": "10.0.0.12:3334", "key": "file:/root/web02"}
+//	    }
+//	}
+//
+// The keys may be secret references, as for the API key of the agent. The
+// requests are sent concurrently, and the results for each host are
+// combined into a single response, which succeeds only if every host
+// succeeded.
+
+const (
+	// Name of the default fleet file, within the default config directory.
+	FleetFileName = "fleet.json"
+	// Name which selects every host in the fleet file.
+	FleetAllHosts = "all"
+	// Default time allowed for the request to each host.
+	DefaultFleetTimeout = 10 * time.Second
+	// Maximum number of hosts to which requests are sent at once.
+	MaxFleetConcurrency = 16
+)
+
+// FleetConfig holds the hosts of a fleet, as read from a fleet file.
+type FleetConfig struct {
+	Hosts   map[string]*FleetHost `json:"hosts"`
+	Timeout Duration              `json:"timeout,omitempty"`
+	// Timeout in milliseconds, as given in fleet files for earlier
+	// versions; this is used if no timeout is set.
+	TimeoutMs int `json:"timeout-ms,omitempty"`
+}
+
+// FleetHost holds the API address ('host:port') and API key of the agent
+// on a host within a fleet.
+type FleetHost struct {
+	Address string `json:"address"`
+	Key     string `json:"key"`
+}
+
+// FleetResult holds the outcome of a request sent to a host in a fleet.
+type FleetResult struct {
+	Host     string       `json:"host"`
+	Address  string       `json:"address"`
+	Success  bool         `json:"success"`
+	Error    string       `json:"error,omitempty"`
+	Response *APIResponse `json:"response,omitempty"`
+}
+
+// DefaultFleetFile returns the path of the default fleet file.
+func DefaultFleetFile() string {
+	configDir := DefaultConfigDir
+	if LocalPathMode {
+		configDir, _ = os.Getwd()
+	}
+	return path.Join(configDir, FleetFileName)
+}
+
+// LoadFleetConfig loads and validates a fleet file.
+func LoadFleetConfig(filePath string) (config *FleetConfig, err error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		err = errors.New("unable to read fleet file: " + err.Error())
+		return
+	}
+	config = &FleetConfig{}
+	err = json.Unmarshal(data, config)
+	if err != nil {
+		err = errors.New("fleet file '" + filePath +
+			"' is not valid: " + err.Error())
+		return
+	}
+	err = config.Validate()
+	return
+}
+
+// Validate checks the hosts of a fleet, standardising their names.
+func (config *FleetConfig) Validate() (err error) {
+	if len(config.Hosts) == 0 {
+		return errors.New("no hosts are specified in the fleet file")
+	}
+	if config.Timeout == 0 {
+		config.Timeout = Duration(time.Duration(config.TimeoutMs) *
+			time.Millisecond)
+	}
+	if config.Timeout < 0 {
+		return errors.New("fleet timeout cannot be negative")
+	}
+	hosts := make(map[string]*FleetHost)
+	for name, host := range config.Hosts {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || name == FleetAllHosts {
+			return errors.New("invalid fleet host name '" + name + "'")
+		}
+		if host == nil {
+			return errors.New("no settings for fleet host '" + name + "'")
+		}
+		if _, _, splitErr := net.SplitHostPort(host.Address); splitErr != nil {
+			return errors.New("invalid address for fleet host '" + name +
+				"'; must be in the form 'host:port'")
+		}
+		if _, exists := hosts[name]; exists {
+			return errors.New("duplicate fleet host '" + name + "'")
+		}
+		hosts[name] = host
+	}
+	config.Hosts = hosts
+	return
+}
+
+// SelectHosts returns the names of the hosts in a comma-separated list,
+// or of every host in the fleet if the list is 'all'.
+func (config *FleetConfig) SelectHosts(list string) (names []string,
+	err error) {
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || seen[name] {
+			continue
+		}
+		if name == FleetAllHosts {
+			names = names[:0]
+			for hostName := range config.Hosts {
+				names = append(names, hostName)
+			}
+			break
+		}
+		if config.Hosts[name] == nil {
+			err = errors.New("host '" + name +
+				"' is not specified in the fleet file")
+			return
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		err = errors.New("no hosts specified")
+		return
+	}
+	sort.Strings(names)
+	return
+}
+
+// Send sends a request to the agents on the named hosts concurrently,
+// returning the result for each host in the same order.
+func (config *FleetConfig) Send(ctx context.Context, names []string,
+	request *APIRequest) (results []FleetResult) {
+	timeout := time.Duration(config.Timeout)
+	if timeout == 0 {
+		timeout = DefaultFleetTimeout
+	}
+	results = make([]FleetResult, len(names))
+	limit := make(chan struct{}, MaxFleetConcurrency)
+	wait := sync.WaitGroup{}
+	for i, name := range names {
+		i, name := i, name
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			limit <- struct{}{}
+			defer func() { <-limit }()
+			results[i] = config.sendToHost(ctx, name, *request, timeout)
+		}()
+	}
+	wait.Wait()
+	return
+}
+
+// sendToHost sends a copy of a request to the agent on a host.
+func (config *FleetConfig) sendToHost(ctx context.Context, name string,
+	request APIRequest, timeout time.Duration) (result FleetResult) {
+	host := config.Hosts[name]
+	result = FleetResult{Host: name, Address: host.Address}
+	key, err := ResolveSecret(host.Key)
+	if err != nil {
+		result.Error = "cannot resolve key: " + err.Error()
+		return
+	}
+	address, port, _ := net.SplitHostPort(host.Address)
+	client := NewAPIClient(APIConfig{IPAddress: address, Port: port,
+		Key: key})
+	client.Timeout = timeout
+	response, _, err := client.Send(ctx, &request)
+	if err != nil {
+		result.Error = err.Error()
+		return
+	}
+	response.Request = nil
+	response.ID = nil
+	result.Response = response
+	result.Success = response.Success
+	if !response.Success {
+		result.Error = response.Message
+	}
+	return
+}
+
+// CombineFleetResults builds a single response from the results of a
+// request sent to a fleet, which succeeds only if every host succeeded.
+func CombineFleetResults(results []FleetResult) (response *APIResponse) {
+	response = &APIResponse{
+		APIName: AppIdentifier,
+		Version: VersionString,
+		Fleet:   results,
+	}
+	var failed []string
+	for _, result := range results {
+		if !result.Success {
+			failed = append(failed, result.Host)
+		}
+	}
+	succeeded := strconv.Itoa(len(results)-len(failed)) + " of " +
+		strconv.Itoa(len(results)) + " hosts"
+	if len(failed) == 0 {
+		response.Success = true
+		response.Message = "succeeded on " + succeeded
+		return
+	}
+	response.Error = "fleet-error"
+	response.Message = "succeeded on " + succeeded + "; failed on " +
+		strings.Join(failed, ", ")
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,440 @@
+// forwarder.go
+// Forwarding of Metrics to StatsD, InfluxDB and Graphite
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The metric forwarder periodically sends the latest value of each monitor
+// and the availability score of each Responder to an existing metrics
+// system, so that no separate collector needs to run on each real server:
+//
+//   - statsd: gauges over UDP to 'address', e.g.
+//     'lbfeedback.web1.monitor.cpu:12|g'
+//   - graphite: the plaintext protocol over TCP to 'address', e.g.
+//     'lbfeedback.web1.monitor.cpu 12 1700000000'
+//   - influxdb: line protocol, posted to the write endpoint at 'url'
+//     (with an optional token), or otherwise sent over UDP to 'address',
+//     e.g. 'lbfeedback_monitor,host=web1,monitor=cpu value=12 <ns>'
+//
+// The host name of the real server is included in each metric.
+
+const (
+	// Supported forwarder protocols.
+	ForwarderProtocolStatsD   = "statsd"
+	ForwarderProtocolGraphite = "graphite"
+	ForwarderProtocolInfluxDB = "influxdb"
+	// Default and minimum intervals between forwarding metrics.
+	DefaultForwarderInterval = 10 * time.Second
+	MinForwarderInterval     = time.Second
+	// Default prefix of the forwarded metric names.
+	DefaultForwarderPrefix = "lbfeedback"
+	// Time allowed for each connection or request to the endpoint.
+	ForwarderTimeout = 5 * time.Second
+	// Largest UDP payload sent, to avoid fragmentation on most networks.
+	MaxForwarderPacketSize = 1432
+)
+
+// ForwarderConfig holds the settings for forwarding metrics, which is
+// enabled if these settings are present in the config. The URL and token
+// may contain secret references, as for the API key.
+type ForwarderConfig struct {
+	Protocol string   `json:"protocol"`
+	Address  string   `json:"address,omitempty"`
+	URL      string   `json:"url,omitempty"`
+	Token    string   `json:"token,omitempty"`
+	Interval Duration `json:"interval,omitempty"`
+	Prefix   string   `json:"prefix,omitempty"`
+}
+
+// Validate checks the forwarder settings, returning the resolved URL and
+// token for InfluxDB.
+func (config *ForwarderConfig) Validate() (resolvedURL string,
+	token string, err error) {
+	protocol := strings.ToLower(config.Protocol)
+	switch protocol {
+	case ForwarderProtocolStatsD, ForwarderProtocolGraphite:
+		if config.URL != "" || config.Token != "" {
+			err = errors.New("metric forwarder: a URL and token can only " +
+				"be given for InfluxDB")
+			return
+		}
+	case ForwarderProtocolInfluxDB:
+	default:
+		err = errors.New("invalid metric forwarder protocol '" +
+			config.Protocol + "'; must be '" + ForwarderProtocolStatsD +
+			"', '" + ForwarderProtocolGraphite + "' or '" +
+			ForwarderProtocolInfluxDB + "'")
+		return
+	}
+	if config.Interval != 0 && time.Duration(config.Interval) <
+		MinForwarderInterval {
+		err = errors.New("metric forwarder interval must be at least " +
+			MinForwarderInterval.String())
+		return
+	}
+	if protocol == ForwarderProtocolInfluxDB && config.URL != "" {
+		if config.Address != "" {
+			err = errors.New("metric forwarder: give either an address " +
+				"or a URL for InfluxDB, not both")
+			return
+		}
+		resolvedURL, err = ResolveSecret(config.URL)
+		if err != nil {
+			err = errors.New("cannot resolve metric forwarder URL: " +
+				err.Error())
+			return
+		}
+		parsed, parseErr := url.Parse(resolvedURL)
+		if parseErr != nil || (parsed.Scheme != "http" &&
+			parsed.Scheme != "https") || parsed.Host == "" {
+			err = errors.New("metric forwarder URL must be an absolute " +
+				"HTTP(S) URL")
+			return
+		}
+		token, err = ResolveSecret(config.Token)
+		if err != nil {
+			err = errors.New("cannot resolve metric forwarder token: " +
+				err.Error())
+		}
+		return
+	} else if config.Token != "" {
+		err = errors.New("metric forwarder: a token can only be given " +
+			"with a URL")
+		return
+	}
+	if _, _, splitErr := net.SplitHostPort(config.Address); splitErr != nil {
+		err = errors.New("metric forwarder address must be in the form " +
+			"'host:port'")
+	}
+	return
+}
+
+// #######################################################################
+// Forwarder
+// #######################################################################
+
+// Forwarder sends metrics to an endpoint at a regular interval whilst the
+// agent is running.
+type Forwarder struct {
+	config   ForwarderConfig
+	agent    *FeedbackAgent
+	protocol string
+	url      string
+	token    string
+	prefix   string
+	host     string
+	interval time.Duration
+	client   *http.Client
+	cancel   context.CancelFunc
+	// Whether the last attempt failed, so that only changes are logged.
+	failing bool
+}
+
+// forwardedMetric is a single value forwarded for a service.
+type forwardedMetric struct {
+	serviceType string
+	name        string
+	field       string
+	value       float64
+}
+
+// StartForwarder validates the forwarder settings and starts forwarding
+// the metrics of the agent.
+func (agent *FeedbackAgent) StartForwarder(config ForwarderConfig) (
+	forwarder *Forwarder, err error) {
+	resolvedURL, token, err := config.Validate()
+	if err != nil {
+		return
+	}
+	interval := time.Duration(config.Interval)
+	if interval == 0 {
+		interval = DefaultForwarderInterval
+	}
+	prefix := config.Prefix
+	if prefix == "" {
+		prefix = DefaultForwarderPrefix
+	}
+	host, _ := os.Hostname()
+	ctx, cancel := context.WithCancel(context.Background())
+	forwarder = &Forwarder{
+		config:   config,
+		agent:    agent,
+		protocol: strings.ToLower(config.Protocol),
+		url:      resolvedURL,
+		token:    token,
+		prefix:   prefix,
+		host:     host,
+		interval: interval,
+		client:   &http.Client{Timeout: ForwarderTimeout},
+		cancel:   cancel,
+	}
+	go forwarder.run(ctx)
+	logrus.Info("Forwarding metrics (" + forwarder.protocol + ") every " +
+		forwarder.interval.String() + ".")
+	return
+}
+
+// Stop stops forwarding metrics.
+func (forwarder *Forwarder) Stop() {
+	forwarder.cancel()
+}
+
+// run forwards metrics at the configured interval until cancelled.
+func (forwarder *Forwarder) run(ctx context.Context) {
+	ticker := time.NewTicker(forwarder.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := forwarder.send(ctx, forwarder.collect(), time.Now())
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil && !forwarder.failing {
+			logrus.Warn("Failed to forward metrics: " + err.Error())
+		} else if err == nil && forwarder.failing {
+			logrus.Info("Metrics are being forwarded successfully again.")
+		}
+		forwarder.failing = err != nil
+	}
+}
+
+// collect returns the latest value of each monitor which has taken a
+// sample, and the availability score of each feedback Responder.
+func (forwarder *Forwarder) collect() (metrics []forwardedMetric) {
+	monitors, responders := forwarder.agent.servicesSnapshot()
+	for _, name := range sortedKeys(monitors) {
+		value, at := monitors[name].latestSample()
+		if at.IsZero() {
+			continue
+		}
+		metrics = append(metrics, forwardedMetric{"monitor", name, "value",
+			float64(value)})
+	}
+	for _, name := range sortedKeys(responders) {
+		responder := responders[name]
+		if responder.IsAPI() {
+			continue
+		}
+		availability, online, _ := responder.getFeedbackState()
+		onlineValue := 0.0
+		if online {
+			onlineValue = 1
+		}
+		metrics = append(metrics,
+			forwardedMetric{"responder", name, "availability",
+				float64(availability)},
+			forwardedMetric{"responder", name, "online", onlineValue})
+	}
+	return
+}
+
+// send formats the metrics in the configured protocol and sends them.
+func (forwarder *Forwarder) send(ctx context.Context,
+	metrics []forwardedMetric, at time.Time) (err error) {
+	if len(metrics) == 0 {
+		return
+	}
+	lines := make([]string, 0, len(metrics))
+	for _, metric := range metrics {
+		lines = append(lines, forwarder.formatMetric(metric, at))
+	}
+	switch {
+	case forwarder.protocol == ForwarderProtocolGraphite:
+		err = forwarder.sendTCP(ctx, lines)
+	case forwarder.url != "":
+		err = forwarder.sendHTTP(ctx, lines)
+	default:
+		err = forwarder.sendUDP(ctx, lines)
+	}
+	return
+}
+
+// formatMetric formats a metric as a line in the configured protocol.
+func (forwarder *Forwarder) formatMetric(metric forwardedMetric,
+	at time.Time) string {
+	value := strconv.FormatFloat(metric.value, 'f', -1, 64)
+	switch forwarder.protocol {
+	case ForwarderProtocolInfluxDB:
+		return escapeInfluxName(forwarder.prefix+"_"+metric.serviceType) +
+			",host=" + escapeInfluxName(forwarder.host) + "," +
+			metric.serviceType + "=" + escapeInfluxName(metric.name) + " " +
+			metric.field + "=" + value + " " +
+			strconv.FormatInt(at.UnixNano(), 10)
+	case ForwarderProtocolGraphite:
+		return forwarder.metricPath(metric) + " " + value + " " +
+			strconv.FormatInt(at.Unix(), 10)
+	default:
+		return forwarder.metricPath(metric) + ":" + value + "|g"
+	}
+}
+
+// metricPath returns the dotted path of a metric for StatsD and Graphite.
+func (forwarder *Forwarder) metricPath(metric forwardedMetric) string {
+	return forwarder.prefix + "." + sanitiseMetricSegment(forwarder.host) +
+		"." + metric.serviceType + "." + sanitiseMetricSegment(metric.name) +
+		"." + metric.field
+}
+
+// sendUDP sends lines as datagrams, packing as many into each as fit.
+func (forwarder *Forwarder) sendUDP(ctx context.Context,
+	lines []string) (err error) {
+	dialer := net.Dialer{Timeout: ForwarderTimeout}
+	conn, err := dialer.DialContext(ctx, "udp", forwarder.config.Address)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	packet := bytes.Buffer{}
+	flush := func() {
+		if packet.Len() > 0 && err == nil {
+			_, err = conn.Write(packet.Bytes())
+		}
+		packet.Reset()
+	}
+	for _, line := range lines {
+		if packet.Len() > 0 &&
+			packet.Len()+1+len(line) > MaxForwarderPacketSize {
+			flush()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	flush()
+	return
+}
+
+// sendTCP sends lines over a new TCP connection.
+func (forwarder *Forwarder) sendTCP(ctx context.Context,
+	lines []string) (err error) {
+	dialer := net.Dialer{Timeout: ForwarderTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", forwarder.config.Address)
+	if err != nil {
+		return
+	}
+	_ = conn.SetDeadline(time.Now().Add(ForwarderTimeout))
+	_, err = io.WriteString(conn, strings.Join(lines, "\n")+"\n")
+	err = errors.Join(err, conn.Close())
+	return
+}
+
+// sendHTTP posts lines to the InfluxDB write endpoint.
+func (forwarder *Forwarder) sendHTTP(ctx context.Context,
+	lines []string) (err error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		forwarder.url, strings.NewReader(strings.Join(lines, "\n")+"\n"))
+	if err != nil {
+		return
+	}
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	request.Header.Set("User-Agent", AppIdentifier+"/"+VersionString)
+	if forwarder.token != "" {
+		request.Header.Set("Authorization", "Token "+forwarder.token)
+	}
+	response, err := forwarder.client.Do(request)
+	if err != nil {
+		return
+	}
+	_, _ = io.Copy(io.Discard, response.Body)
+	_ = response.Body.Close()
+	if response.StatusCode >= 300 {
+		err = errors.New("HTTP status " + response.Status)
+	}
+	return
+}
+
+// sanitiseMetricSegment replaces any characters which are not safe within
+// a segment of a dotted metric path.
+func sanitiseMetricSegment(segment string) string {
+	return strings.Map(func(char rune) rune {
+		if (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') ||
+			(char >= '0' && char <= '9') || char == '-' || char == '_' {
+			return char
+		}
+		return '_'
+	}, segment)
+}
+
+// escapeInfluxName escapes a measurement name or tag value for the line
+// protocol.
+func escapeInfluxName(name string) string {
+	return strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`).
+		Replace(name)
+}
+
+// UpdateForwarder starts, restarts or stops forwarding metrics according
+// to the metric-forwarder setting of the agent.
+func (agent *FeedbackAgent) UpdateForwarder() {
+	if agent.forwarder != nil {
+		if agent.Forwarder != nil &&
+			agent.forwarder.config == *agent.Forwarder {
+			return
+		}
+		agent.forwarder.Stop()
+		agent.forwarder = nil
+		if agent.Forwarder == nil {
+			logrus.Info("Stopped forwarding metrics.")
+			return
+		}
+	}
+	if agent.Forwarder == nil {
+		return
+	}
+	forwarder, err := agent.StartForwarder(*agent.Forwarder)
+	if err != nil {
+		logrus.Error("Failed to start forwarding metrics: " + err.Error())
+		return
+	}
+	agent.forwarder = forwarder
+}
+
+// StopForwarder stops forwarding metrics when the agent shuts down,
+// leaving the metric-forwarder setting unchanged.
+func (agent *FeedbackAgent) StopForwarder() {
+	if agent.forwarder != nil {
+		agent.forwarder.Stop()
+		agent.forwarder = nil
+		logrus.Info("Stopped forwarding metrics.")
+	}
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
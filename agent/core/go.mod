@@ -3,8 +3,10 @@ module github.com/loadbalancerorg/lbfeedback/agent/core
 go 1.21
 
 require (
+	github.com/fsnotify/fsnotify v1.7.0
 	github.com/shirou/gopsutil/v3 v3.24.5
 	github.com/sirupsen/logrus v1.9.3
+	golang.org/x/sys v0.30.0
 )
 
 require (
@@ -15,5 +17,4 @@ require (
 	github.com/tklauser/go-sysconf v0.3.14 // indirect
 	github.com/tklauser/numcpus v0.9.0 // indirect
 	github.com/yusufpapurcu/wmi v1.2.4 // indirect
-	golang.org/x/sys v0.30.0 // indirect
 )
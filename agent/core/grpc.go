@@ -0,0 +1,486 @@
+// grpc.go
+// gRPC Interface to the Feedback Agent API
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The gRPC API is served by a Responder with the protocol 'grpc' over
+// HTTP/2 with TLS, using an HTTPConnector. It implements the service
+// defined in proto/lbfeedback.proto, with each call translated into a
+// request to the JSON API, so that both have the same behaviour and
+// access controls.
+
+const (
+	// Full name of the gRPC service, which prefixes the path of each call.
+	GRPCServiceName = "lbfeedback.v1.FeedbackAgent"
+	// Maximum size of a gRPC request message (bytes).
+	MaxGRPCMessageSize = 4 * 1024 * 1024
+)
+
+// gRPC status codes, as defined by the gRPC specification.
+const (
+	grpcStatusOK                = 0
+	grpcStatusUnknown           = 2
+	grpcStatusInvalidArgument   = 3
+	grpcStatusNotFound          = 5
+	grpcStatusResourceExhausted = 8
+	grpcStatusUnimplemented     = 12
+	grpcStatusInternal          = 13
+	grpcStatusUnavailable       = 14
+	grpcStatusUnauthenticated   = 16
+)
+
+// grpcError is an error returned by a gRPC method, with the status code to
+// report to the client.
+type grpcError struct {
+	code    int
+	message string
+}
+
+func (err *grpcError) Error() string {
+	return err.message
+}
+
+// grpcCall holds the state of a single gRPC call.
+type grpcCall struct {
+	ctx     context.Context
+	agent   *FeedbackAgent
+	apiKey  string
+	writer  http.ResponseWriter
+	request []protoField
+	// Closed when the Responder is stopping, to end any streams.
+	stopping <-chan struct{}
+	// Whether the agent is to quit once the call has completed.
+	quitAfter bool
+}
+
+// grpcMethods maps the name of each gRPC method to its handler.
+var grpcMethods = map[string]func(call *grpcCall) (err error){
+	"GetStatus":     (*grpcCall).getStatus,
+	"GetFeedback":   (*grpcCall).getFeedback,
+	"GetService":    (*grpcCall).getService,
+	"AddService":    (*grpcCall).addService,
+	"EditService":   (*grpcCall).editService,
+	"DeleteService": (*grpcCall).deleteService,
+	"WatchMetrics":  (*grpcCall).watchMetrics,
+	"Call":          (*grpcCall).callJSON,
+}
+
+// handleGRPC handles a gRPC call received by an HTTPConnector.
+func (pc *HTTPConnector) handleGRPC(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	if r.Method != http.MethodPost || r.ProtoMajor != 2 ||
+		(contentType != "application/grpc" &&
+			!strings.HasPrefix(contentType, "application/grpc+proto")) {
+		http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+		return
+	}
+	// The status is always sent in the trailers, following any messages.
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	call := &grpcCall{
+		ctx:      r.Context(),
+		agent:    pc.responder.ParentAgent,
+		apiKey:   getHeaderAPIKey(r.Header),
+		writer:   w,
+		stopping: pc.stopping,
+	}
+	started := time.Now()
+	service, method, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	err := call.readRequest(r)
+	if err == nil {
+		handler, exists := grpcMethods[method]
+		if service != GRPCServiceName || !exists {
+			err = &grpcError{grpcStatusUnimplemented,
+				"unknown method '" + r.URL.Path + "'"}
+		} else {
+			err = handler(call)
+		}
+	}
+	code := grpcStatusOK
+	message := ""
+	if err != nil {
+		var callErr *grpcError
+		if errors.As(err, &callErr) {
+			code = callErr.code
+		} else {
+			code = grpcStatusInternal
+		}
+		message = err.Error()
+	}
+	// Streams are not counted, as their duration is not a latency.
+	if method != "WatchMetrics" {
+		pc.responder.stats.record(time.Since(started), code == grpcStatusInternal)
+	}
+	// Headers must be sent before the trailers, even if there is no message.
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", encodeGRPCMessage(message))
+	if call.quitAfter {
+		pc.responder.ParentAgent.SelfSignalQuit()
+	}
+}
+
+// encodeGRPCMessage percent-encodes a status message for the Grpc-Message
+// trailer, as required by the gRPC specification.
+func encodeGRPCMessage(message string) string {
+	var encoded strings.Builder
+	for i := 0; i < len(message); i++ {
+		char := message[i]
+		if char >= ' ' && char <= '~' && char != '%' {
+			encoded.WriteByte(char)
+		} else {
+			encoded.WriteString("%" + strings.ToUpper(
+				strconv.FormatUint(uint64(char)|0x100, 16)[1:]))
+		}
+	}
+	return encoded.String()
+}
+
+// readRequest reads the single request message of a call, which must not
+// be compressed, as no compression is offered to clients.
+func (call *grpcCall) readRequest(r *http.Request) (err error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, MaxGRPCMessageSize+6))
+	if err != nil {
+		return &grpcError{grpcStatusInternal,
+			"failed to read request: " + err.Error()}
+	}
+	if len(body) < 5 {
+		return &grpcError{grpcStatusInvalidArgument, "no request message"}
+	}
+	length := binary.BigEndian.Uint32(body[1:5])
+	if body[0] != 0 {
+		return &grpcError{grpcStatusUnimplemented,
+			"compressed messages are not supported"}
+	} else if length > MaxGRPCMessageSize {
+		return &grpcError{grpcStatusResourceExhausted,
+			"request message exceeds " + strconv.Itoa(MaxGRPCMessageSize) +
+				" bytes"}
+	} else if uint64(len(body)) != 5+uint64(length) {
+		return &grpcError{grpcStatusInvalidArgument,
+			"expected a single request message"}
+	}
+	call.request, err = decodeProtoMessage(body[5:])
+	if err != nil {
+		return &grpcError{grpcStatusInvalidArgument,
+			"malformed request message: " + err.Error()}
+	}
+	return
+}
+
+// send sends a response message to the client.
+func (call *grpcCall) send(msg *protoMessage) (err error) {
+	frame := make([]byte, 5, 5+len(msg.data))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg.data)))
+	_, err = call.writer.Write(append(frame, msg.data...))
+	if err == nil {
+		err = http.NewResponseController(call.writer).Flush()
+	}
+	return
+}
+
+// stringField returns the value of a string field of the request message.
+func (call *grpcCall) stringField(number int) (value string) {
+	for _, field := range call.request {
+		if field.number == number {
+			value = field.protoString()
+		}
+	}
+	return
+}
+
+// process sends a request to the JSON API with the API key of the call,
+// returning the response if it succeeded, or otherwise an error with the
+// appropriate status.
+func (call *grpcCall) process(request *APIRequest) (response *APIResponse,
+	err error) {
+	request.APIKey = call.apiKey
+	response, call.quitAfter = call.agent.ProcessAPIRequest(request, nil)
+	if response.Success {
+		return
+	}
+	code := grpcStatusUnknown
+	switch response.Error {
+	case "bad-api-key":
+		code = grpcStatusUnauthenticated
+	case "missing-target":
+		code = grpcStatusInvalidArgument
+	default:
+		// Report services which do not exist (or are outside of the
+		// namespace of the key) as not found.
+		serviceType := request.Type
+		if serviceType == "feedback" {
+			serviceType = "responder"
+		}
+		if (serviceType == "monitor" || serviceType == "responder") &&
+			request.Action != "add" && request.Action != "upsert" &&
+			!call.agent.serviceVisible(serviceType, request.TargetName,
+				request.namespace) {
+			code = grpcStatusNotFound
+		}
+	}
+	err = &grpcError{code, response.Message}
+	return
+}
+
+// #######################################################################
+// Methods
+// #######################################################################
+
+func (call *grpcCall) getStatus() (err error) {
+	response, err := call.process(&APIRequest{Action: "status"})
+	if err != nil {
+		return
+	}
+	reply := &protoMessage{}
+	for _, status := range response.ServiceStatus {
+		reply.addMessage(1, encodeGRPCServiceStatus(status))
+	}
+	reply.addBool(2, response.ConfigDiverged)
+	err = call.send(reply)
+	return
+}
+
+// encodeGRPCServiceStatus encodes the status of a service as a
+// ServiceStatus message.
+func encodeGRPCServiceStatus(status APIServiceStatus) (msg *protoMessage) {
+	msg = &protoMessage{}
+	msg.addString(1, status.ServiceType)
+	msg.addString(2, status.ServiceName)
+	msg.addString(3, status.ServiceStatus)
+	msg.addString(4, status.Namespace)
+	msg.addString(5, status.Port)
+	msg.addString(6, status.LastError)
+	if status.StartTime != nil {
+		msg.addTimestamp(7, *status.StartTime)
+	}
+	msg.addInt(8, int64(status.RestartCount))
+	if status.LastSample != nil {
+		msg.addTimestamp(9, *status.LastSample)
+	}
+	if status.LastResponse != nil {
+		msg.addTimestamp(10, *status.LastResponse)
+	}
+	if status.Connections != nil {
+		connections := &protoMessage{}
+		connections.addInt(1, int64(status.Connections.Active))
+		connections.addUint(2, status.Connections.Accepted)
+		connections.addUint(3, status.Connections.RejectedConnLimit)
+		connections.addUint(4, status.Connections.RejectedRateLimit)
+		msg.addMessage(11, connections)
+	}
+	return
+}
+
+func (call *grpcCall) getFeedback() (err error) {
+	response, err := call.process(&APIRequest{
+		Action:     "get",
+		Type:       "feedback",
+		TargetName: call.stringField(1),
+	})
+	if err != nil {
+		return
+	}
+	reply := &protoMessage{}
+	reply.addString(1, response.Output)
+	err = call.send(reply)
+	return
+}
+
+func (call *grpcCall) getService() (err error) {
+	serviceType := call.stringField(1)
+	if serviceType != "monitor" && serviceType != "responder" {
+		return &grpcError{grpcStatusInvalidArgument,
+			"service type must be 'monitor' or 'responder'"}
+	}
+	return call.sendService(serviceType, call.stringField(2))
+}
+
+// sendService sends the configuration of a monitor or Responder, as
+// visible to the API key of the call.
+func (call *grpcCall) sendService(serviceType string, name string) (
+	err error) {
+	response, err := call.process(&APIRequest{Action: "get", Type: "config"})
+	if err != nil {
+		return
+	}
+	name, _ = StandardiseNameIdentifier(name)
+	var service any
+	switch serviceType {
+	case "monitor":
+		if monitor, exists := response.AgentConfig.Monitors[name]; exists {
+			service = monitor
+		}
+	case "responder":
+		if responder, exists := response.AgentConfig.Responders[name]; exists {
+			service = responder
+		}
+	}
+	if service == nil {
+		return &grpcError{grpcStatusNotFound,
+			serviceType + " '" + name + "' does not exist"}
+	}
+	config, err := json.Marshal(service)
+	if err != nil {
+		return
+	}
+	reply := &protoMessage{}
+	reply.addString(1, serviceType)
+	reply.addString(2, name)
+	reply.addBytes(3, config)
+	err = call.send(reply)
+	return
+}
+
+func (call *grpcCall) addService() (err error) {
+	return call.changeService("add")
+}
+
+func (call *grpcCall) editService() (err error) {
+	return call.changeService("edit")
+}
+
+// changeService adds or edits a service with the settings given as JSON,
+// replying with its resulting configuration.
+func (call *grpcCall) changeService(action string) (err error) {
+	request := &APIRequest{}
+	settings := call.stringField(3)
+	if settings != "" {
+		err = json.Unmarshal([]byte(settings), request)
+		if err != nil {
+			return &grpcError{grpcStatusInvalidArgument,
+				"invalid settings: " + err.Error()}
+		}
+	}
+	request.Action = action
+	request.Type = call.stringField(1)
+	request.TargetName = call.stringField(2)
+	_, err = call.process(request)
+	if err != nil {
+		return
+	}
+	if request.Type != "monitor" && request.Type != "responder" {
+		reply := &protoMessage{}
+		reply.addString(1, request.Type)
+		reply.addString(2, request.TargetName)
+		return call.send(reply)
+	}
+	return call.sendService(request.Type, request.TargetName)
+}
+
+func (call *grpcCall) deleteService() (err error) {
+	_, err = call.process(&APIRequest{
+		Action:     "delete",
+		Type:       call.stringField(1),
+		TargetName: call.stringField(2),
+	})
+	if err == nil {
+		err = call.send(&protoMessage{})
+	}
+	return
+}
+
+// callJSON sends any JSON API request, replying with the JSON response
+// whether or not the request succeeded.
+func (call *grpcCall) callJSON() (err error) {
+	request, parseErr := UnmarshalAPIRequest(call.stringField(1))
+	if request != nil {
+		request.APIKey = call.apiKey
+	}
+	response, quitAfter := call.agent.ProcessAPIRequest(request, parseErr)
+	call.quitAfter = quitAfter
+	output, err := json.Marshal(response)
+	if err != nil {
+		return
+	}
+	reply := &protoMessage{}
+	reply.addBytes(1, output)
+	err = call.send(reply)
+	return
+}
+
+// watchMetrics streams each new sample taken by the monitors visible to
+// the API key of the call, using a subscription to metric updates, until
+// the call is cancelled or the Responder is stopped.
+func (call *grpcCall) watchMetrics() (err error) {
+	var names []string
+	interval := uint64(DefaultSubscribeInterval)
+	for _, field := range call.request {
+		switch field.number {
+		case 1:
+			names = append(names, field.protoString())
+		case 2:
+			interval = max(field.protoUint(), MinSubscribeInterval)
+		}
+	}
+	// Authorise the call, finding the namespace of its key.
+	request := &APIRequest{Action: "status"}
+	_, err = call.process(request)
+	if err != nil {
+		return
+	}
+	sub, err := call.agent.NewSubscription(request.namespace,
+		[]string{UpdateTypeMetric}, names, nil)
+	if err != nil {
+		return &grpcError{grpcStatusInvalidArgument, err.Error()}
+	}
+	// Streams are not subject to the response timeout of the Responder.
+	err = http.NewResponseController(call.writer).SetWriteDeadline(time.Time{})
+	if err != nil {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		for _, update := range sub.Poll() {
+			msg := &protoMessage{}
+			msg.addString(1, update.Monitor)
+			msg.addString(2, update.MetricType)
+			msg.addInt(3, *update.Value)
+			msg.addTimestamp(4, update.Time)
+			err = call.send(msg)
+			if err != nil {
+				return
+			}
+		}
+		select {
+		case <-call.ctx.Done():
+			return call.ctx.Err()
+		case <-call.stopping:
+			return &grpcError{grpcStatusUnavailable, "responder is stopping"}
+		case <-ticker.C:
+		}
+	}
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,199 @@
+// grpc_proto.go
+// Protocol Buffers Wire Encoding for the gRPC API
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Wire types of Protocol Buffers fields; the deprecated group types are
+// not supported.
+const (
+	protoWireVarint  = 0
+	protoWireFixed64 = 1
+	protoWireBytes   = 2
+	protoWireFixed32 = 5
+)
+
+// #######################################################################
+// Encoding
+// #######################################################################
+
+// protoMessage builds an encoded Protocol Buffers message. As in proto3,
+// fields with their default (zero) values are omitted.
+type protoMessage struct {
+	data []byte
+}
+
+func (msg *protoMessage) appendTag(field int, wireType int) {
+	msg.data = binary.AppendUvarint(msg.data, uint64(field)<<3|uint64(wireType))
+}
+
+// addUint adds an unsigned integer (uint32, uint64) or enum field.
+func (msg *protoMessage) addUint(field int, value uint64) {
+	if value == 0 {
+		return
+	}
+	msg.appendTag(field, protoWireVarint)
+	msg.data = binary.AppendUvarint(msg.data, value)
+}
+
+// addInt adds a signed integer (int32, int64) field; negative values are
+// encoded in ten bytes as in the reference implementation.
+func (msg *protoMessage) addInt(field int, value int64) {
+	msg.addUint(field, uint64(value))
+}
+
+func (msg *protoMessage) addBool(field int, value bool) {
+	if value {
+		msg.addUint(field, 1)
+	}
+}
+
+func (msg *protoMessage) addBytes(field int, value []byte) {
+	if len(value) == 0 {
+		return
+	}
+	msg.appendTag(field, protoWireBytes)
+	msg.data = binary.AppendUvarint(msg.data, uint64(len(value)))
+	msg.data = append(msg.data, value...)
+}
+
+func (msg *protoMessage) addString(field int, value string) {
+	msg.addBytes(field, []byte(value))
+}
+
+// addMessage adds an embedded message field, which is present even if the
+// embedded message is empty, as for each element of a repeated field.
+func (msg *protoMessage) addMessage(field int, embedded *protoMessage) {
+	msg.appendTag(field, protoWireBytes)
+	msg.data = binary.AppendUvarint(msg.data, uint64(len(embedded.data)))
+	msg.data = append(msg.data, embedded.data...)
+}
+
+// addTimestamp adds a google.protobuf.Timestamp field, omitted if the time
+// is zero.
+func (msg *protoMessage) addTimestamp(field int, value time.Time) {
+	if value.IsZero() {
+		return
+	}
+	timestamp := &protoMessage{}
+	timestamp.addInt(1, value.Unix())
+	timestamp.addInt(2, int64(value.Nanosecond()))
+	msg.addMessage(field, timestamp)
+}
+
+// #######################################################################
+// Decoding
+// #######################################################################
+
+// protoField is a single field decoded from a Protocol Buffers message;
+// the value of a varint or fixed field is held as an integer, and that of
+// a length-delimited field (string, bytes or embedded message) as bytes.
+type protoField struct {
+	number   int
+	wireType int
+	value    uint64
+	data     []byte
+}
+
+// decodeProtoMessage decodes the fields of a Protocol Buffers message, in
+// the order in which they were encoded.
+func decodeProtoMessage(data []byte) (fields []protoField, err error) {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			err = errors.New("malformed field tag")
+			return
+		}
+		data = data[n:]
+		field := protoField{number: int(tag >> 3), wireType: int(tag & 7)}
+		if field.number <= 0 || tag>>3 > math.MaxInt32 {
+			err = errors.New("invalid field number " +
+				strconv.FormatUint(tag>>3, 10))
+			return
+		}
+		switch field.wireType {
+		case protoWireVarint:
+			field.value, n = binary.Uvarint(data)
+			if n <= 0 {
+				err = errors.New("malformed varint field")
+				return
+			}
+			data = data[n:]
+		case protoWireFixed64:
+			if len(data) < 8 {
+				err = errors.New("truncated fixed64 field")
+				return
+			}
+			field.value = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case protoWireFixed32:
+			if len(data) < 4 {
+				err = errors.New("truncated fixed32 field")
+				return
+			}
+			field.value = uint64(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		case protoWireBytes:
+			var length uint64
+			length, n = binary.Uvarint(data)
+			if n <= 0 || length > uint64(len(data)-n) {
+				err = errors.New("truncated length-delimited field")
+				return
+			}
+			field.data = data[n : n+int(length)]
+			data = data[n+int(length):]
+		default:
+			err = errors.New("unsupported wire type " +
+				strconv.Itoa(field.wireType))
+			return
+		}
+		fields = append(fields, field)
+	}
+	return
+}
+
+// protoString returns the value of a string field, or an empty string if
+// the field is not length-delimited.
+func (field *protoField) protoString() string {
+	if field.wireType != protoWireBytes {
+		return ""
+	}
+	return string(field.data)
+}
+
+// protoUint returns the value of an integer field, or zero if the field is
+// not a varint.
+func (field *protoField) protoUint() uint64 {
+	if field.wireType != protoWireVarint {
+		return 0
+	}
+	return field.value
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,109 @@
+// handover.go
+// Zero-Downtime Replacement of Feedback Responders
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	// Time for which a Responder which has handed over to its replacement
+	// continues to accept connections before closing its listeners, so
+	// that any already queued for it are not reset.
+	HandoverDrainDelay = 100 * time.Millisecond
+)
+
+// canHandOver returns whether a replacement Responder can be started
+// whilst the running Responder that it replaces is still listening, which
+// requires both to bind their listeners with SO_REUSEPORT.
+func canHandOver(oldResponder *FeedbackResponder,
+	newResponder *FeedbackResponder) bool {
+	return oldResponder.ReusePort && newResponder.ReusePort &&
+		oldResponder.IsRunning()
+}
+
+// replaceResponder replaces a Responder with another (e.g. with a new
+// configuration), preserving its run state. If both use reuse-port, the
+// replacement is started before the original is stopped, so that the port
+// does not refuse connections at any point; should the replacement fail to
+// start, the original is left running in its place. Otherwise, the
+// original is stopped before the replacement is started.
+//
+// On Linux, new connections are steered to the replacement as soon as it
+// is listening, and the original then accepts any still queued for it
+// before closing. Elsewhere, the kernel distributes new connections
+// between the listeners until the original closes, so a few connections
+// may be reset during a handover.
+func (agent *FeedbackAgent) replaceResponder(name string,
+	oldResponder *FeedbackResponder, newResponder *FeedbackResponder) (
+	err error) {
+	if canHandOver(oldResponder, newResponder) {
+		err = newResponder.Start()
+		if err != nil {
+			err = errors.New("the replacement responder failed to start, " +
+				"so the original has been kept running: " + err.Error())
+			return
+		}
+		agent.setResponder(name, newResponder)
+		oldResponder.mutex.Lock()
+		oldResponder.handingOver = true
+		oldResponder.mutex.Unlock()
+		err = oldResponder.Stop()
+		if err == nil {
+			oldResponder.logger().Info(oldResponder.getLogHead() +
+				"has handed over to its replacement.")
+		}
+		return
+	}
+	agent.setResponder(name, newResponder)
+	// Preserve the current run state during the swap.
+	if oldResponder.IsRunning() {
+		err = oldResponder.Stop()
+		if err != nil {
+			return
+		}
+		err = newResponder.Start()
+	}
+	return
+}
+
+// restartResponder restarts a Responder. If it uses reuse-port, it is
+// replaced by a copy of itself, so that the port does not refuse
+// connections whilst it restarts.
+func (agent *FeedbackAgent) restartResponder(name string,
+	responder *FeedbackResponder) (err error) {
+	if !responder.ReusePort || !responder.IsRunning() {
+		err = responder.Restart()
+		return
+	}
+	replacement := responder.Copy()
+	err = replacement.Initialise()
+	if err != nil {
+		return
+	}
+	err = agent.replaceResponder(name, responder, &replacement)
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,246 @@
+// headroom.go
+// Capacity Headroom Estimation for Feedback Responders
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Number of recent monitor results used to estimate the load trend.
+	TrendWindowSize = 30
+	// Minimum number of results required before a trend is estimated.
+	MinTrendSamples = 3
+)
+
+// #######################################################################
+// LoadTrend
+// #######################################################################
+
+// LoadTrend estimates the rate of change of the results of a monitor by
+// a least-squares linear fit over a window of recent observations.
+type LoadTrend struct {
+	times  [TrendWindowSize]float64
+	values [TrendWindowSize]float64
+	count  int
+	next   int
+	origin time.Time
+	mutex  sync.Mutex
+}
+
+// Add records a new observation at the given time.
+func (trend *LoadTrend) Add(at time.Time, value float64) {
+	trend.mutex.Lock()
+	defer trend.mutex.Unlock()
+	if trend.count == 0 {
+		trend.origin = at
+	}
+	trend.times[trend.next] = at.Sub(trend.origin).Seconds()
+	trend.values[trend.next] = value
+	trend.next = (trend.next + 1) % TrendWindowSize
+	if trend.count < TrendWindowSize {
+		trend.count++
+	}
+}
+
+// Reset discards all observations.
+func (trend *LoadTrend) Reset() {
+	trend.mutex.Lock()
+	defer trend.mutex.Unlock()
+	trend.count = 0
+	trend.next = 0
+}
+
+// Slope returns the estimated change in value per second. If there are
+// too few observations to estimate this, valid is false.
+func (trend *LoadTrend) Slope() (slope float64, valid bool) {
+	trend.mutex.Lock()
+	defer trend.mutex.Unlock()
+	if trend.count < MinTrendSamples {
+		return
+	}
+	// Formula:
+	//
+	// b = (n * s_xy - s_x * s_y) / (n * s_xx - s_x ^ 2)
+	//
+	// where x is the time of each observation and y is its value.
+	n := float64(trend.count)
+	sumX, sumY, sumXX, sumXY := 0.0, 0.0, 0.0, 0.0
+	for i := 0; i < trend.count; i++ {
+		x, y := trend.times[i], trend.values[i]
+		sumX += x
+		sumY += y
+		sumXX += x * x
+		sumXY += x * y
+	}
+	denominator := n*sumXX - sumX*sumX
+	if denominator <= 0 {
+		return
+	}
+	slope = (n*sumXY - sumX*sumY) / denominator
+	valid = true
+	return
+}
+
+// #######################################################################
+// Headroom Estimation
+// #######################################################################
+
+// GetHeadroom estimates how much additional load this Responder can take
+// before any of its enabled thresholds trip, and how long this is likely
+// to take at the current trend of each source. If no thresholds are
+// enabled, the headroom is measured against a fully loaded (100%) state.
+func (fbr *FeedbackResponder) GetHeadroom() (report HeadroomReport) {
+	fbr.mutex.Lock()
+	defer fbr.mutex.Unlock()
+	report = HeadroomReport{
+		Responder:     fbr.ResponderName,
+		ThresholdMode: fbr.ThresholdModeName,
+	}
+	threshold, _ := fbr.EffectiveThreshold(time.Now())
+	overallLoad, overallTrend := 0.0, 0.0
+	loads := make(map[string]float64, len(fbr.FeedbackSources))
+	trended := make(map[string]float64, len(fbr.FeedbackSources))
+	names := make([]string, 0, len(fbr.FeedbackSources))
+	for name := range fbr.FeedbackSources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		source := fbr.FeedbackSources[name]
+		if source.Monitor == nil || source.MaxValue <= 0 {
+			continue
+		}
+		load := getSourceLoad(source)
+		// Convert the trend of the raw value into load percent.
+		trend := 0.0
+		if slope, valid := source.Monitor.trend.Slope(); valid {
+			trend = slope / float64(source.MaxValue) * 100
+		}
+		overallLoad += float64(load) * source.RelativeSignificance
+		overallTrend += trend * source.RelativeSignificance
+		loads[name] = float64(load)
+		trended[name] = float64(load) + trend
+		if fbr.isMetricThresholdEnabled() && source.Threshold > 0 {
+			report.addConstraint("source '"+name+"'", load,
+				int(source.Threshold), trend)
+		}
+		if fbr.isAnyThresholdEnabled() && threshold > 0 {
+			report.addConstraint("any: source '"+name+"'", load,
+				threshold, trend)
+		}
+	}
+	// For any other aggregation function, the overall trend is the change
+	// in the aggregated load after a second at the trend of each source.
+	if fbr.Aggregation != "" {
+		overallLoad, _ = fbr.aggregateLoad(loads)
+		trendedLoad, _ := fbr.aggregateLoad(trended)
+		overallTrend = trendedLoad - overallLoad
+	}
+	report.Load = int(overallLoad)
+	report.TrendPerMinute = roundTrend(overallTrend)
+	if fbr.isOverallThresholdEnabled() && threshold > 0 {
+		report.addConstraint("overall", report.Load, threshold,
+			overallTrend)
+	}
+	if len(report.Constraints) == 0 {
+		report.addConstraint("overall (no threshold)", report.Load, 100,
+			overallTrend)
+	}
+	// The headroom is that of the most constrained threshold, and the
+	// time to threshold is the shortest time for any to trip.
+	for i, constraint := range report.Constraints {
+		if i == 0 || constraint.Headroom < report.Headroom {
+			report.Headroom = constraint.Headroom
+			report.LimitingFactor = constraint.Name
+		}
+		if constraint.SecondsToLimit != nil &&
+			(report.SecondsToThreshold == nil ||
+				*constraint.SecondsToLimit < *report.SecondsToThreshold) {
+			report.SecondsToThreshold = constraint.SecondsToLimit
+		}
+	}
+	return
+}
+
+// addConstraint adds a threshold to a headroom report, estimating the
+// time until it is reached if the load is currently increasing.
+func (report *HeadroomReport) addConstraint(name string, load int,
+	limit int, trend float64) {
+	constraint := HeadroomConstraint{
+		Name:           name,
+		Load:           load,
+		Limit:          limit,
+		Headroom:       limit - load,
+		TrendPerMinute: roundTrend(trend),
+	}
+	if constraint.Headroom <= 0 {
+		seconds := int64(0)
+		constraint.SecondsToLimit = &seconds
+	} else if trend > 0 {
+		seconds := int64(math.Ceil(float64(constraint.Headroom) / trend))
+		constraint.SecondsToLimit = &seconds
+	}
+	report.Constraints = append(report.Constraints, constraint)
+}
+
+// roundTrend converts a trend in load percent per second into load
+// percent per minute, rounded for reporting.
+func roundTrend(perSecond float64) float64 {
+	return math.Round(perSecond*60*100) / 100
+}
+
+// GetHeadroomReports estimates the headroom of the named Responder, or of
+// all Responders (within a namespace, if specified) if no name is given.
+func (agent *FeedbackAgent) GetHeadroomReports(name string, namespace string) (
+	reports []HeadroomReport, err error) {
+	if name != "" {
+		var responder *FeedbackResponder
+		responder, err = agent.GetResponderByName(name)
+		if err != nil {
+			return
+		}
+		reports = append(reports, responder.GetHeadroom())
+		return
+	}
+	names := make([]string, 0, len(agent.Responders))
+	for name := range agent.Responders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		responder := agent.Responders[name]
+		if namespace != "" && responder.Namespace != namespace {
+			continue
+		}
+		if len(responder.FeedbackSources) > 0 {
+			reports = append(reports, responder.GetHeadroom())
+		}
+	}
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
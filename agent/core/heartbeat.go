@@ -0,0 +1,206 @@
+// heartbeat.go
+// Outgoing Heartbeats to an External Dead Man's Switch
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Default and minimum intervals between heartbeats.
+	DefaultHeartbeatInterval = 60 * time.Second
+	MinHeartbeatInterval     = 5 * time.Second
+	// Default time allowed for each heartbeat request.
+	DefaultHeartbeatTimeout = 10 * time.Second
+)
+
+// HeartbeatConfig holds the settings for heartbeats sent to an external
+// monitoring service acting as a dead man's switch (such as
+// healthchecks.io), which alerts if the heartbeats stop because the agent
+// has died. Heartbeats are enabled if these settings are present in the
+// config. The URL may contain secret references, as for the API key.
+type HeartbeatConfig struct {
+	URL      string   `json:"url"`
+	Interval Duration `json:"interval,omitempty"`
+	Timeout  Duration `json:"timeout,omitempty"`
+}
+
+// Validate checks the heartbeat settings, returning the resolved URL.
+func (config *HeartbeatConfig) Validate() (resolvedURL string, err error) {
+	resolvedURL, err = ResolveSecret(config.URL)
+	if err != nil {
+		err = errors.New("cannot resolve heartbeat URL: " + err.Error())
+		return
+	}
+	parsed, err := url.Parse(resolvedURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") ||
+		parsed.Host == "" {
+		err = errors.New("heartbeat URL must be an absolute HTTP(S) URL")
+		return
+	}
+	if config.Interval != 0 && time.Duration(config.Interval) <
+		MinHeartbeatInterval {
+		err = errors.New("heartbeat interval must be at least " +
+			MinHeartbeatInterval.String())
+	} else if config.Timeout < 0 {
+		err = errors.New("heartbeat timeout cannot be negative")
+	}
+	return
+}
+
+// #######################################################################
+// Heartbeat
+// #######################################################################
+
+// Heartbeat sends a request to a URL at a regular interval whilst the
+// agent is running.
+type Heartbeat struct {
+	config   HeartbeatConfig
+	url      string
+	interval time.Duration
+	client   *http.Client
+	cancel   context.CancelFunc
+	// Whether the last heartbeat failed, so that only changes are logged.
+	failing bool
+}
+
+// StartHeartbeat validates the heartbeat settings and starts sending
+// heartbeats, the first of them immediately.
+func StartHeartbeat(config HeartbeatConfig) (heartbeat *Heartbeat,
+	err error) {
+	resolvedURL, err := config.Validate()
+	if err != nil {
+		return
+	}
+	interval := time.Duration(config.Interval)
+	if interval == 0 {
+		interval = DefaultHeartbeatInterval
+	}
+	timeout := time.Duration(config.Timeout)
+	if timeout == 0 {
+		timeout = DefaultHeartbeatTimeout
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	heartbeat = &Heartbeat{
+		config:   config,
+		url:      resolvedURL,
+		interval: interval,
+		client:   &http.Client{Timeout: timeout},
+		cancel:   cancel,
+	}
+	go heartbeat.run(ctx)
+	logrus.Info("Sending heartbeats every " + heartbeat.interval.String() +
+		".")
+	return
+}
+
+// Stop stops sending heartbeats.
+func (heartbeat *Heartbeat) Stop() {
+	heartbeat.cancel()
+}
+
+// run sends heartbeats at the configured interval until cancelled.
+func (heartbeat *Heartbeat) run(ctx context.Context) {
+	ticker := time.NewTicker(heartbeat.interval)
+	defer ticker.Stop()
+	for {
+		heartbeat.send(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// send sends a single heartbeat, logging whenever heartbeats start or
+// stop failing; the URL is not logged, as it may contain a secret.
+func (heartbeat *Heartbeat) send(ctx context.Context) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		heartbeat.url, nil)
+	if err != nil {
+		return
+	}
+	request.Header.Set("User-Agent", AppIdentifier+"/"+VersionString)
+	response, err := heartbeat.client.Do(request)
+	if err == nil {
+		_, _ = io.Copy(io.Discard, response.Body)
+		_ = response.Body.Close()
+		if response.StatusCode >= 300 {
+			err = errors.New("HTTP status " + response.Status)
+		}
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil && !heartbeat.failing {
+		logrus.Warn("Failed to send heartbeat: " + err.Error())
+	} else if err == nil && heartbeat.failing {
+		logrus.Info("Heartbeats are being sent successfully again.")
+	}
+	heartbeat.failing = err != nil
+}
+
+// UpdateHeartbeat starts, restarts or stops sending heartbeats according
+// to the heartbeat settings of the agent.
+func (agent *FeedbackAgent) UpdateHeartbeat() {
+	if agent.heartbeat != nil {
+		if agent.Heartbeat != nil && agent.heartbeat.config == *agent.Heartbeat {
+			return
+		}
+		agent.heartbeat.Stop()
+		agent.heartbeat = nil
+		if agent.Heartbeat == nil {
+			logrus.Info("Stopped sending heartbeats.")
+			return
+		}
+	}
+	if agent.Heartbeat == nil {
+		return
+	}
+	heartbeat, err := StartHeartbeat(*agent.Heartbeat)
+	if err != nil {
+		logrus.Error("Failed to start heartbeats: " + err.Error())
+		return
+	}
+	agent.heartbeat = heartbeat
+}
+
+// StopHeartbeat stops sending heartbeats when the agent shuts down,
+// leaving the heartbeat setting unchanged.
+func (agent *FeedbackAgent) StopHeartbeat() {
+	if agent.heartbeat != nil {
+		agent.heartbeat.Stop()
+		agent.heartbeat = nil
+		logrus.Info("Stopped sending heartbeats.")
+	}
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,348 @@
+// history.go
+// Observation History of System Monitors and Graph Rendering
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Default number of observations kept in the history of each monitor.
+	MetricHistorySize = 720
+	// Largest number of observations which a monitor may keep.
+	MaxMetricHistorySize = 86400
+	// Maximum number of characters in a rendered sparkline; longer
+	// histories are averaged into this many buckets.
+	SparklineWidth = 60
+	// Dimensions of a rendered PNG history graph, in pixels.
+	HistoryGraphWidth  = 600
+	HistoryGraphHeight = 200
+)
+
+// Supported output formats for the 'get history' action.
+const (
+	HistoryFormatJSON      = "json"
+	HistoryFormatSparkline = "sparkline"
+	HistoryFormatCSV       = "csv"
+	HistoryFormatPNG       = "png"
+)
+
+// #######################################################################
+// MetricHistory
+// #######################################################################
+
+// MetricHistory stores the most recent observations of a monitor in a
+// fixed-size ring, oldest first when read. Observations older than the
+// retention period (if any) are not returned, even if there is room for
+// them.
+type MetricHistory struct {
+	points    []HistoryPoint
+	count     int
+	next      int
+	retention time.Duration
+	mutex     sync.Mutex
+}
+
+// NewMetricHistory creates a history holding up to a number of
+// observations, which are kept for a retention period if non-zero.
+func NewMetricHistory(size int, retention time.Duration) *MetricHistory {
+	return &MetricHistory{
+		points:    make([]HistoryPoint, max(size, 1)),
+		retention: retention,
+	}
+}
+
+// Add records a new observation at the given time.
+func (history *MetricHistory) Add(at time.Time, value float64) {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	history.points[history.next] = HistoryPoint{Time: at, Value: value}
+	history.next = (history.next + 1) % len(history.points)
+	if history.count < len(history.points) {
+		history.count++
+	}
+}
+
+// Points returns a copy of the stored observations within the retention
+// period, oldest first.
+func (history *MetricHistory) Points() (points []HistoryPoint) {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	size := len(history.points)
+	points = make([]HistoryPoint, 0, history.count)
+	start := (history.next - history.count + size) % size
+	var cutoff time.Time
+	if history.retention > 0 {
+		cutoff = time.Now().Add(-history.retention)
+	}
+	for i := 0; i < history.count; i++ {
+		point := history.points[(start+i)%size]
+		if !point.Time.Before(cutoff) {
+			points = append(points, point)
+		}
+	}
+	return
+}
+
+// resize returns this history if it already has the given size and
+// retention period, or otherwise a new history with these settings holding
+// as many of the most recent observations as will fit, so that a monitor
+// does not lose its history when its settings are edited.
+func (history *MetricHistory) resize(size int, retention time.Duration) (
+	resized *MetricHistory) {
+	if history != nil && len(history.points) == size &&
+		history.retention == retention {
+		return history
+	}
+	resized = NewMetricHistory(size, retention)
+	if history == nil {
+		return
+	}
+	for _, point := range history.Points() {
+		resized.Add(point.Time, point.Value)
+	}
+	return
+}
+
+// configureHistory validates the history settings of this SystemMonitor
+// and sizes its history accordingly. If only a retention period is given,
+// the history is sized to hold the observations taken within it. The
+// caller must hold the mutex.
+func (monitor *SystemMonitor) configureHistory() (err error) {
+	if monitor.HistorySize < 0 || monitor.HistoryAge < 0 {
+		err = errors.New("history size and retention cannot be negative")
+		return
+	} else if monitor.HistorySize > MaxMetricHistorySize {
+		err = errors.New("history size cannot exceed " +
+			strconv.Itoa(MaxMetricHistorySize) + " observations")
+		return
+	}
+	retention := time.Duration(monitor.HistoryAge) * time.Second
+	size := monitor.HistorySize
+	if size == 0 && retention > 0 {
+		interval := max(monitor.Interval, monitor.SysMetric.GetMinInterval(), 1)
+		size = min(int(retention/(time.Duration(interval)*
+			time.Millisecond))+1, MaxMetricHistorySize)
+	} else if size == 0 {
+		size = MetricHistorySize
+	}
+	monitor.history = monitor.history.resize(size, retention)
+	return
+}
+
+// GetHistory returns the observation history of the named monitor, or
+// the reported availability history of the named responder, over a period
+// up to now (or all that is held if zero). If the history store is
+// enabled, the history is read from it across the period (limited to its
+// retention) and averaged into at most MetricHistorySize points;
+// otherwise, only the recent observations of monitors held in memory are
+// available.
+func (agent *FeedbackAgent) GetHistory(name string, period time.Duration) (
+	points []HistoryPoint, err error) {
+	serviceType := "monitor"
+	monitor, isMonitor := agent.Monitors[name]
+	if !isMonitor {
+		if _, isResponder := agent.Responders[name]; !isResponder {
+			err = errors.New("no monitor or responder named '" + name + "'")
+			return
+		}
+		serviceType = "responder"
+	}
+	var store *HistoryStore
+	if agent.historyStore != nil {
+		store = agent.historyStore.Load()
+	}
+	if period <= 0 && store != nil {
+		period = store.retention
+	}
+	since := time.Now().Add(-period)
+	if store != nil {
+		points, err = store.Query(historySeriesName(serviceType, name),
+			since)
+		points = downsampleHistory(points, MetricHistorySize)
+	} else if isMonitor && monitor.history != nil {
+		points = monitor.history.Points()
+		if period > 0 {
+			first, _ := slices.BinarySearchFunc(points, since,
+				func(point HistoryPoint, at time.Time) int {
+					return point.Time.Compare(at)
+				})
+			points = points[first:]
+		}
+	} else if !isMonitor {
+		err = errors.New("the history of responders is only recorded " +
+			"when the history store is enabled")
+	}
+	return
+}
+
+// #######################################################################
+// Rendering
+// #######################################################################
+
+// historyRange returns the smallest and largest values in a history.
+func historyRange(points []HistoryPoint) (low float64, high float64) {
+	for i, point := range points {
+		if i == 0 || point.Value < low {
+			low = point.Value
+		}
+		if i == 0 || point.Value > high {
+			high = point.Value
+		}
+	}
+	return
+}
+
+// RenderSparkline renders a history as a single line of block characters
+// scaled between its smallest and largest values, followed by a summary.
+func RenderSparkline(name string, points []HistoryPoint) string {
+	if len(points) == 0 {
+		return name + ": no observations recorded"
+	}
+	blocks := []rune("▁▂▃▄▅▆▇█")
+	// Average the observations into buckets if there are too many.
+	buckets := len(points)
+	if buckets > SparklineWidth {
+		buckets = SparklineWidth
+	}
+	values := make([]float64, buckets)
+	counts := make([]int, buckets)
+	for i, point := range points {
+		bucket := i * buckets / len(points)
+		values[bucket] += point.Value
+		counts[bucket]++
+	}
+	for i := range values {
+		values[i] /= float64(counts[i])
+	}
+	low, high := historyRange(points)
+	line := strings.Builder{}
+	for _, value := range values {
+		level := 0
+		if high > low {
+			level = int((value - low) / (high - low) * float64(len(blocks)-1))
+		}
+		line.WriteRune(blocks[level])
+	}
+	span := points[len(points)-1].Time.Sub(points[0].Time).Truncate(time.Second)
+	return name + ": " + line.String() + " min " + formatHistoryValue(low) +
+		", max " + formatHistoryValue(high) + ", last " +
+		formatHistoryValue(points[len(points)-1].Value) + " (" +
+		strconv.Itoa(len(points)) + " samples over " + span.String() + ")"
+}
+
+// RenderHistoryCSV renders a history as CSV with a header row.
+func RenderHistoryCSV(points []HistoryPoint) string {
+	output := strings.Builder{}
+	output.WriteString("time,value\n")
+	for _, point := range points {
+		output.WriteString(point.Time.Format(time.RFC3339Nano) + "," +
+			formatHistoryValue(point.Value) + "\n")
+	}
+	return output.String()
+}
+
+// RenderHistoryPNG renders a history as a line graph in PNG format, scaled
+// from zero to the largest value, with grid lines at each quarter.
+func RenderHistoryPNG(points []HistoryPoint) (data []byte, err error) {
+	if len(points) == 0 {
+		err = errors.New("no observations recorded")
+		return
+	}
+	graph := image.NewRGBA(image.Rect(0, 0, HistoryGraphWidth,
+		HistoryGraphHeight))
+	background := color.RGBA{255, 255, 255, 255}
+	grid := color.RGBA{220, 220, 220, 255}
+	line := color.RGBA{30, 90, 200, 255}
+	for x := 0; x < HistoryGraphWidth; x++ {
+		for y := 0; y < HistoryGraphHeight; y++ {
+			graph.Set(x, y, background)
+		}
+	}
+	for quarter := 1; quarter < 4; quarter++ {
+		y := HistoryGraphHeight * quarter / 4
+		for x := 0; x < HistoryGraphWidth; x++ {
+			graph.Set(x, y, grid)
+		}
+	}
+	_, high := historyRange(points)
+	if high <= 0 {
+		high = 1
+	}
+	// Plot each observation, joining it to the previous one.
+	plotX := func(i int) int {
+		if len(points) == 1 {
+			return 0
+		}
+		return i * (HistoryGraphWidth - 1) / (len(points) - 1)
+	}
+	plotY := func(value float64) int {
+		scaled := math.Max(value, 0) / high * float64(HistoryGraphHeight-1)
+		return HistoryGraphHeight - 1 - int(scaled)
+	}
+	lastX, lastY := plotX(0), plotY(points[0].Value)
+	for i, point := range points {
+		x, y := plotX(i), plotY(point.Value)
+		drawLine(graph, lastX, lastY, x, y, line)
+		lastX, lastY = x, y
+	}
+	buffer := bytes.Buffer{}
+	err = png.Encode(&buffer, graph)
+	data = buffer.Bytes()
+	return
+}
+
+// drawLine draws a straight line between two points of an image.
+func drawLine(img *image.RGBA, x0 int, y0 int, x1 int, y1 int,
+	c color.Color) {
+	dx, dy := x1-x0, y1-y0
+	steps := max(abs(dx), abs(dy), 1)
+	for step := 0; step <= steps; step++ {
+		img.Set(x0+dx*step/steps, y0+dy*step/steps, c)
+	}
+}
+
+// abs returns the absolute value of an integer.
+func abs(value int) int {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
+
+// formatHistoryValue formats a history value without trailing zeros.
+func formatHistoryValue(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,363 @@
+// historystore.go
+// Persistent Storage of Monitor and Responder History
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Default number of days of history retained by the history store.
+	DefaultHistoryRetentionDays = 7
+	// Directory within the config directory used if none is configured.
+	DefaultHistoryDirName = "history"
+	// Extension of the append-only files holding each history series.
+	HistoryFileExtension = ".hist"
+	// Minimum time (ms) between observations recorded for a series, so
+	// that frequent feedback requests do not flood the store.
+	HistoryRecordInterval = 1000
+	// Time (minutes) between compactions of the history files.
+	HistoryCompactInterval = 60
+)
+
+// HistoryStoreConfig holds the settings of the persistent history store.
+// The store is enabled if these settings are present in the config.
+type HistoryStoreConfig struct {
+	Directory     string `json:"directory,omitempty"`
+	RetentionDays int    `json:"retention-days,omitempty"`
+}
+
+// Validate checks that the history store settings are within range.
+func (config *HistoryStoreConfig) Validate() (err error) {
+	if config.RetentionDays < 0 {
+		err = errors.New("history retention cannot be negative")
+	} else if config.Directory != "" && !filepath.IsAbs(config.Directory) {
+		err = errors.New("history directory '" + config.Directory +
+			"' is not an absolute path")
+	}
+	return
+}
+
+// #######################################################################
+// HistoryStore
+// #######################################################################
+
+// HistoryStore records the observations of each monitor and the reported
+// availability of each responder to disk, so that history is retained
+// across restarts of the agent. Each series is held in an append-only
+// text file of timestamped values, which is periodically compacted to
+// remove observations older than the retention period.
+type HistoryStore struct {
+	config     HistoryStoreConfig
+	dir        string
+	retention  time.Duration
+	files      map[string]*os.File
+	lastRecord map[string]time.Time
+	failed     map[string]bool
+	closed     bool
+	stopSignal chan bool
+	mutex      sync.Mutex
+}
+
+// OpenHistoryStore opens the history store in the configured directory,
+// compacting any existing history and then periodically thereafter.
+func OpenHistoryStore(config HistoryStoreConfig, configDir string) (
+	store *HistoryStore, err error) {
+	err = config.Validate()
+	if err != nil {
+		return
+	}
+	store = &HistoryStore{
+		config:     config,
+		dir:        config.Directory,
+		files:      make(map[string]*os.File),
+		lastRecord: make(map[string]time.Time),
+		failed:     make(map[string]bool),
+		stopSignal: make(chan bool),
+	}
+	if store.dir == "" {
+		store.dir = path.Join(configDir, DefaultHistoryDirName)
+	}
+	days := config.RetentionDays
+	if days == 0 {
+		days = DefaultHistoryRetentionDays
+	}
+	store.retention = time.Duration(days) * 24 * time.Hour
+	err = CreateDirectoryIfMissing(store.dir)
+	if err != nil {
+		return
+	}
+	store.Compact()
+	go store.run()
+	logrus.Info("Recording history to '" + store.dir + "' for " +
+		strconv.Itoa(days) + " days.")
+	return
+}
+
+// Close stops the history store and closes its files.
+func (store *HistoryStore) Close() {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.closed {
+		return
+	}
+	store.closed = true
+	close(store.stopSignal)
+	for series, file := range store.files {
+		_ = file.Close()
+		delete(store.files, series)
+	}
+}
+
+// run compacts the history files at regular intervals until closed.
+func (store *HistoryStore) run() {
+	ticker := time.NewTicker(HistoryCompactInterval * time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-store.stopSignal:
+			return
+		case <-ticker.C:
+			store.Compact()
+		}
+	}
+}
+
+// historySeriesName returns the name of the series for a service.
+func historySeriesName(serviceType string, name string) string {
+	return serviceType + "-" + name
+}
+
+// seriesPath returns the path of the file holding a series.
+func (store *HistoryStore) seriesPath(series string) string {
+	return path.Join(store.dir, series+HistoryFileExtension)
+}
+
+// Record appends an observation to a series, unless one was recorded
+// within the minimum record interval. A series which cannot be written is
+// reported once and then skipped.
+func (store *HistoryStore) Record(series string, at time.Time, value float64) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.closed || store.failed[series] ||
+		at.Sub(store.lastRecord[series]) < HistoryRecordInterval*time.Millisecond {
+		return
+	}
+	store.lastRecord[series] = at
+	file, open := store.files[series]
+	var err error
+	if !open {
+		file, err = os.OpenFile(store.seriesPath(series),
+			os.O_APPEND|os.O_CREATE|os.O_WRONLY, DefaultFilePermissions)
+		if err == nil {
+			store.files[series] = file
+		}
+	}
+	if err == nil {
+		_, err = file.WriteString(strconv.FormatInt(at.UnixMilli(), 10) + "," +
+			strconv.FormatFloat(value, 'f', -1, 64) + "\n")
+	}
+	if err != nil {
+		store.failed[series] = true
+		logrus.Error("Failed to record history for '" + series +
+			"'; history for it will not be recorded: " + err.Error())
+	}
+}
+
+// Query returns the stored observations of a series since a given time,
+// oldest first.
+func (store *HistoryStore) Query(series string, since time.Time) (
+	points []HistoryPoint, err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	points, err = readHistoryFile(store.seriesPath(series), since)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return
+}
+
+// Compact rewrites each history file without the observations older than
+// the retention period, removing any files left empty.
+func (store *HistoryStore) Compact() {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	matches, _ := filepath.Glob(path.Join(store.dir, "*"+HistoryFileExtension))
+	cutoff := time.Now().Add(-store.retention)
+	for _, filePath := range matches {
+		series := strings.TrimSuffix(path.Base(filePath), HistoryFileExtension)
+		points, err := readHistoryFile(filePath, cutoff)
+		if err != nil {
+			logrus.Warn("Failed to compact history file '" + filePath +
+				"': " + err.Error())
+			continue
+		}
+		// Close the file so that it is reopened after being replaced.
+		if file, open := store.files[series]; open {
+			_ = file.Close()
+			delete(store.files, series)
+		}
+		if len(points) == 0 {
+			_ = os.Remove(filePath)
+			continue
+		}
+		output := strings.Builder{}
+		for _, point := range points {
+			output.WriteString(strconv.FormatInt(point.Time.UnixMilli(), 10) +
+				"," + strconv.FormatFloat(point.Value, 'f', -1, 64) + "\n")
+		}
+		err = WriteFileAtomic(filePath, []byte(output.String()))
+		if err != nil {
+			logrus.Warn("Failed to compact history file '" + filePath +
+				"': " + err.Error())
+		}
+	}
+}
+
+// readHistoryFile reads the observations in a history file since a given
+// time. Any malformed lines, such as one left partially written by a
+// crash, are skipped.
+func readHistoryFile(filePath string, since time.Time) (
+	points []HistoryPoint, err error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		timeText, valueText, found := strings.Cut(scanner.Text(), ",")
+		if !found {
+			continue
+		}
+		millis, timeErr := strconv.ParseInt(timeText, 10, 64)
+		value, valueErr := strconv.ParseFloat(valueText, 64)
+		if timeErr != nil || valueErr != nil {
+			continue
+		}
+		at := time.UnixMilli(millis)
+		if !at.Before(since) {
+			points = append(points, HistoryPoint{Time: at, Value: value})
+		}
+	}
+	err = scanner.Err()
+	return
+}
+
+// #######################################################################
+// Agent Integration
+// #######################################################################
+
+// UpdateHistoryStore opens, reopens or closes the history store according
+// to the history-store setting of the agent.
+func (agent *FeedbackAgent) UpdateHistoryStore() {
+	if agent.historyStore == nil {
+		return
+	}
+	current := agent.historyStore.Load()
+	if current != nil {
+		if agent.HistoryStore != nil && current.config == *agent.HistoryStore {
+			return
+		}
+		agent.historyStore.Store(nil)
+		current.Close()
+		if agent.HistoryStore == nil {
+			logrus.Info("Stopped recording history.")
+			return
+		}
+	}
+	if agent.HistoryStore == nil {
+		return
+	}
+	store, err := OpenHistoryStore(*agent.HistoryStore, agent.configDir)
+	if err != nil {
+		logrus.Error("Failed to open the history store: " + err.Error())
+		return
+	}
+	agent.historyStore.Store(store)
+}
+
+// StopHistoryStore closes the history store when the agent shuts down,
+// leaving the history-store setting unchanged.
+func (agent *FeedbackAgent) StopHistoryStore() {
+	if agent.historyStore == nil {
+		return
+	}
+	if current := agent.historyStore.Swap(nil); current != nil {
+		current.Close()
+		logrus.Info("Stopped recording history.")
+	}
+}
+
+// recordHistory records an observation for a service in the history
+// store and by the recorder, if they are enabled.
+func (agent *FeedbackAgent) recordHistory(serviceType string, name string,
+	at time.Time, value float64) {
+	if agent == nil {
+		return
+	}
+	if agent.historyStore != nil {
+		if store := agent.historyStore.Load(); store != nil {
+			store.Record(historySeriesName(serviceType, name), at, value)
+		}
+	}
+	if agent.recorder != nil {
+		if recorder := agent.recorder.Load(); recorder != nil {
+			recorder.Record(serviceType, name, at, value)
+		}
+	}
+}
+
+// downsampleHistory averages a history into at most the given number of
+// points, each covering an equal number of observations.
+func downsampleHistory(points []HistoryPoint, limit int) []HistoryPoint {
+	if len(points) <= limit {
+		return points
+	}
+	result := make([]HistoryPoint, 0, limit)
+	for bucket := 0; bucket < limit; bucket++ {
+		start := bucket * len(points) / limit
+		end := (bucket + 1) * len(points) / limit
+		sum := 0.0
+		for _, point := range points[start:end] {
+			sum += point.Value
+		}
+		result = append(result, HistoryPoint{
+			Time:  points[end-1].Time,
+			Value: sum / float64(end-start),
+		})
+	}
+	return result
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,123 @@
+// hooks.go
+// Hook Scripts Run When the Agent Starts and Stops
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Default time allowed for a hook script to complete.
+	DefaultHookTimeout = 30 * time.Second
+	// Time allowed after a hook script is killed for any processes it
+	// started to release its output.
+	HookWaitDelay = 2 * time.Second
+	// Names of the hooks, as given to the scripts in the environment.
+	HookPostStart = "post-start"
+	HookPreStop   = "pre-stop"
+)
+
+// HookConfig holds the scripts run when the agent has started and is about
+// to stop, so that other components can be quiesced or external systems
+// notified at these transitions. The post-start script runs once all
+// services are running, and the pre-stop script before any are stopped, so
+// the agent is still responding to health checks whilst it runs. Scripts
+// with relative paths are found in the config directory, and are killed if
+// they do not complete within the timeout.
+type HookConfig struct {
+	PostStart string   `json:"post-start,omitempty"`
+	PreStop   string   `json:"pre-stop,omitempty"`
+	Timeout   Duration `json:"timeout,omitempty"`
+}
+
+// Validate checks the hook settings.
+func (config *HookConfig) Validate() (err error) {
+	if config.Timeout < 0 {
+		err = errors.New("hook timeout cannot be negative")
+	}
+	return
+}
+
+// RunHook runs the script for a hook, if one is configured. A hook which
+// fails is logged, but does not prevent the agent from starting or
+// stopping.
+func (agent *FeedbackAgent) RunHook(hook string) {
+	if agent.Hooks == nil {
+		return
+	}
+	script := agent.Hooks.PostStart
+	if hook == HookPreStop {
+		script = agent.Hooks.PreStop
+	}
+	script = strings.TrimSpace(script)
+	if script == "" {
+		return
+	}
+	if !filepath.IsAbs(script) {
+		script = filepath.Join(agent.configDir, script)
+	}
+	timeout := time.Duration(agent.Hooks.Timeout)
+	if timeout == 0 {
+		timeout = DefaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	command := PlatformScriptCommand(ctx, script)
+	command.WaitDelay = HookWaitDelay
+	command.Env = append(os.Environ(),
+		"LBFEEDBACK_HOOK="+hook,
+		"LBFEEDBACK_INSTANCE="+agent.options.Instance,
+		"LBFEEDBACK_CONFIG_DIR="+agent.configDir,
+		"LBFEEDBACK_PID="+strconv.Itoa(os.Getpid()),
+	)
+	logrus.Info("Running " + hook + " hook '" + script + "'.")
+	started := time.Now()
+	output, err := command.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = errors.New("timed out after " + timeout.String())
+	} else if exitErr, ok := err.(*exec.ExitError); ok &&
+		len(exitErr.Stderr) > 0 {
+		err = errors.New(err.Error() + ": " +
+			strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	if text := strings.TrimSpace(string(output)); text != "" {
+		logrus.Debug("Output of " + hook + " hook: " + text)
+	}
+	if err != nil {
+		logrus.Warn("The " + hook + " hook failed: " + err.Error())
+		return
+	}
+	logrus.Info("The " + hook + " hook completed in " +
+		time.Since(started).Round(time.Millisecond).String() + ".")
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
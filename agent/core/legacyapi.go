@@ -0,0 +1,124 @@
+// legacyapi.go
+// Deprecation of the Insecure Legacy API Protocol
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"errors"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Phases of the deprecation of the insecure legacy API protocol
+// ('http-api'), of which the current phase is set by LegacyAPIPhase. In
+// either phase, running the agent with '--allow-insecure-api' keeps a
+// legacy API Responder, but only permits read-only actions through it.
+const (
+	// Legacy API Responders in a configuration file are migrated to the
+	// HTTPS API protocol with a warning, and the file is saved, after
+	// which a self-signed certificate is generated as for any HTTPS API.
+	LegacyAPIPhaseMigrate = "migrate"
+	// Legacy API Responders are refused.
+	LegacyAPIPhaseRefuse = "refuse"
+)
+
+// readOnlyAPIActions lists the API actions permitted through a legacy API
+// Responder, none of which change the agent.
+var readOnlyAPIActions = map[string]bool{
+	"status":   true,
+	"get":      true,
+	"validate": true,
+	"export":   true,
+}
+
+// insecureAPIAllowed returns whether the agent has been run with the
+// override for the insecure legacy API protocol.
+func (agent *FeedbackAgent) insecureAPIAllowed() bool {
+	return agent != nil && agent.options.AllowInsecureAPI
+}
+
+// migrateLegacyAPI applies the current deprecation phase to a Responder
+// being loaded from a configuration file, returning whether it has been
+// migrated to the HTTPS API protocol, or an error if it is refused.
+func (agent *FeedbackAgent) migrateLegacyAPI(fbr *FeedbackResponder) (
+	migrated bool, err error) {
+	if fbr.ProtocolName != ProtocolLegacyAPI || agent.insecureAPIAllowed() {
+		return
+	}
+	if LegacyAPIPhase == LegacyAPIPhaseMigrate {
+		fbr.ProtocolName = ProtocolSecureAPI
+		migrated = true
+		return
+	}
+	err = errors.New("the insecure legacy API protocol '" +
+		ProtocolLegacyAPI + "' is no longer supported; change the protocol " +
+		"to '" + ProtocolSecureAPI + "', or run the agent with '--" +
+		FlagAllowInsecureAPI + "' for read-only access")
+	return
+}
+
+// checkLegacyAPI is called when a Responder is initialised, returning an
+// error if it uses the legacy API protocol without the override, such as
+// when one is added through the API, and otherwise warning that it is
+// insecure and read-only.
+func (fbr *FeedbackResponder) checkLegacyAPI() (err error) {
+	if fbr.ProtocolName != ProtocolLegacyAPI {
+		return
+	}
+	if !fbr.ParentAgent.insecureAPIAllowed() {
+		err = errors.New("the insecure legacy API protocol '" +
+			ProtocolLegacyAPI + "' requires the agent to be run with '--" +
+			FlagAllowInsecureAPI + "'; use '" + ProtocolSecureAPI + "' instead")
+		return
+	}
+	logrus.Warn(fbr.getLogHead() + "is using the insecure legacy API " +
+		"protocol '" + ProtocolLegacyAPI + "', which is deprecated; only " +
+		"read-only actions are permitted. Change its protocol to '" +
+		ProtocolSecureAPI + "' to restore full access.")
+	return
+}
+
+// logLegacyAPIMigration warns that a Responder has been migrated from the
+// legacy API protocol, as its clients must now use HTTPS.
+func logLegacyAPIMigration(name string) {
+	logrus.Warn("Responder '" + name + "' used the insecure legacy API " +
+		"protocol '" + ProtocolLegacyAPI + "', which is deprecated, and has " +
+		"been migrated to '" + ProtocolSecureAPI + "' with a self-signed " +
+		"certificate; clients must now connect using HTTPS. To keep the " +
+		"legacy protocol temporarily (read-only), restore it in the " +
+		"configuration and run the agent with '--" + FlagAllowInsecureAPI +
+		"'.")
+}
+
+// authoriseReadOnlyRequest returns an error if a request received through
+// a legacy API Responder is not a read-only action.
+func authoriseReadOnlyRequest(request *APIRequest) (err error) {
+	if !request.readOnly || readOnlyAPIActions[request.Action] {
+		return
+	}
+	err = errors.New("action '" + request.Action + "' is not permitted " +
+		"through the insecure legacy API, which is read-only; use the " +
+		"HTTPS API (protocol '" + ProtocolSecureAPI + "')")
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,181 @@
+// limiter.go
+// Connection and Request Rate Limiting for Feedback Responders
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Idle period after which the rate state for a client is discarded.
+	LimiterClientIdleExpiry = time.Minute
+	// Number of tracked clients above which idle entries are pruned.
+	LimiterPruneThreshold = 1024
+)
+
+// LimitResult describes the outcome of a [ConnectionLimiter] check.
+type LimitResult int
+
+const (
+	LimitAccepted LimitResult = iota
+	LimitConnectionsExceeded
+	LimitRateExceeded
+)
+
+// ConnectionLimiter enforces a maximum number of concurrent connections
+// for a responder and a maximum request rate for each client IP address,
+// using a token bucket per client. A limit of zero disables that limit.
+type ConnectionLimiter struct {
+	maxConnections int
+	maxRate        int
+	active         int
+	clients        map[string]*clientBucket
+	accepted       uint64
+	rejectedConn   uint64
+	rejectedRate   uint64
+	mutex          sync.Mutex
+}
+
+// clientBucket holds the token bucket state for a single client address.
+type clientBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// LimiterStats provides a snapshot of the counters in a [ConnectionLimiter].
+type LimiterStats struct {
+	Active            int    `json:"active"`
+	Accepted          uint64 `json:"accepted"`
+	RejectedConnLimit uint64 `json:"rejected-connection-limit"`
+	RejectedRateLimit uint64 `json:"rejected-rate-limit"`
+}
+
+// NewConnectionLimiter creates a new limiter with the specified limits.
+func NewConnectionLimiter(maxConnections int, maxRate int) *ConnectionLimiter {
+	limiter := &ConnectionLimiter{
+		clients: make(map[string]*clientBucket),
+	}
+	limiter.Configure(maxConnections, maxRate)
+	return limiter
+}
+
+// Configure changes the limits for this limiter without resetting counters.
+func (l *ConnectionLimiter) Configure(maxConnections int, maxRate int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.maxConnections = maxConnections
+	l.maxRate = maxRate
+}
+
+// Acquire checks a new connection or request from a remote address
+// (in "host:port" form) against the limits. If it is accepted, the caller
+// must call Release() once it has been handled.
+func (l *ConnectionLimiter) Acquire(remoteAddr string) (result LimitResult) {
+	now := time.Now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.maxConnections > 0 && l.active >= l.maxConnections {
+		l.rejectedConn++
+		result = LimitConnectionsExceeded
+		return
+	}
+	if l.maxRate > 0 {
+		host, _, err := net.SplitHostPort(remoteAddr)
+		if err != nil {
+			host = remoteAddr
+		}
+		bucket, exists := l.clients[host]
+		if !exists {
+			if len(l.clients) >= LimiterPruneThreshold {
+				l.pruneClients(now)
+			}
+			bucket = &clientBucket{tokens: float64(l.maxRate)}
+			l.clients[host] = bucket
+		} else {
+			// Refill the bucket in proportion to the time elapsed.
+			elapsed := now.Sub(bucket.lastSeen).Seconds()
+			bucket.tokens += elapsed * float64(l.maxRate)
+			if bucket.tokens > float64(l.maxRate) {
+				bucket.tokens = float64(l.maxRate)
+			}
+		}
+		bucket.lastSeen = now
+		if bucket.tokens < 1 {
+			l.rejectedRate++
+			result = LimitRateExceeded
+			return
+		}
+		bucket.tokens--
+	}
+	l.active++
+	l.accepted++
+	result = LimitAccepted
+	return
+}
+
+// Release marks a previously accepted connection or request as complete.
+func (l *ConnectionLimiter) Release() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.active > 0 {
+		l.active--
+	}
+}
+
+// Stats returns a snapshot of the counters for this limiter.
+func (l *ConnectionLimiter) Stats() LimiterStats {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return LimiterStats{
+		Active:            l.active,
+		Accepted:          l.accepted,
+		RejectedConnLimit: l.rejectedConn,
+		RejectedRateLimit: l.rejectedRate,
+	}
+}
+
+// pruneClients discards the rate state of clients that have been idle for
+// longer than the expiry period. The caller must hold the mutex.
+func (l *ConnectionLimiter) pruneClients(now time.Time) {
+	for host, bucket := range l.clients {
+		if now.Sub(bucket.lastSeen) > LimiterClientIdleExpiry {
+			delete(l.clients, host)
+		}
+	}
+}
+
+// LimitResultToString converts a [LimitResult] into a descriptive string.
+func LimitResultToString(result LimitResult) string {
+	switch result {
+	case LimitConnectionsExceeded:
+		return "connection limit reached"
+	case LimitRateExceeded:
+		return "request rate limit exceeded"
+	default:
+		return "accepted"
+	}
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
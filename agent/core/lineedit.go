@@ -0,0 +1,247 @@
+// lineedit.go
+// Line Editor for the Interactive Shell
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Control keys handled by the line editor.
+const (
+	keyCtrlA     = 1
+	keyCtrlC     = 3
+	keyCtrlD     = 4
+	keyCtrlE     = 5
+	keyBackspace = 8
+	keyTab       = 9
+	keyCtrlK     = 11
+	keyCtrlL     = 12
+	keyCtrlU     = 21
+	keyEscape    = 27
+	keyDelete    = 127
+)
+
+// lineEditor reads a line from a terminal in raw mode, with the usual
+// editing keys, recall of the command history with the up and down arrow
+// keys, and completion of the current word with the tab key. Terminal
+// sequences are used to redraw the line, so it should not be wider than
+// the terminal.
+type lineEditor struct {
+	input    *bufio.Reader
+	output   io.Writer
+	prompt   string
+	history  []string
+	complete func(line string) (candidates []string, word string)
+
+	buffer []rune
+	cursor int
+	// Position in the history of the line being edited, and the new line
+	// being entered before the history was recalled.
+	historyIndex int
+	newLine      []rune
+}
+
+// readLine reads a line, returning io.EOF if Ctrl-D is pressed on an
+// empty line.
+func (editor *lineEditor) readLine() (line string, err error) {
+	restore, err := makeRawTerminal(os.Stdin)
+	if err != nil {
+		return
+	}
+	defer restore()
+	editor.historyIndex = len(editor.history)
+	editor.redraw()
+	for {
+		var r rune
+		r, _, err = editor.input.ReadRune()
+		if err != nil {
+			return
+		}
+		switch r {
+		case '\r', '\n':
+			editor.write("\r\n")
+			return string(editor.buffer), nil
+		case keyCtrlC:
+			// Abandon the line, as in a shell.
+			editor.write("^C\r\n")
+			editor.buffer, editor.cursor = nil, 0
+			editor.historyIndex = len(editor.history)
+		case keyCtrlD:
+			if len(editor.buffer) == 0 {
+				editor.write("\r\n")
+				return "", io.EOF
+			}
+			editor.deleteAt(editor.cursor)
+		case keyBackspace, keyDelete:
+			if editor.cursor > 0 {
+				editor.cursor--
+				editor.deleteAt(editor.cursor)
+			}
+		case keyCtrlA:
+			editor.cursor = 0
+		case keyCtrlE:
+			editor.cursor = len(editor.buffer)
+		case keyCtrlK:
+			editor.buffer = editor.buffer[:editor.cursor]
+		case keyCtrlU:
+			editor.buffer = append([]rune{}, editor.buffer[editor.cursor:]...)
+			editor.cursor = 0
+		case keyCtrlL:
+			editor.write("\x1b[H\x1b[2J")
+		case keyTab:
+			editor.completeWord()
+		case keyEscape:
+			editor.handleEscape()
+		default:
+			if r >= ' ' {
+				editor.insert([]rune{r})
+			}
+		}
+		editor.redraw()
+	}
+}
+
+// handleEscape handles the terminal sequence sent by a cursor key.
+func (editor *lineEditor) handleEscape() {
+	introducer, _, err := editor.input.ReadRune()
+	if err != nil || (introducer != '[' && introducer != 'O') {
+		return
+	}
+	// Parameters (e.g. '3' in 'ESC [ 3 ~') precede the final character.
+	parameter := ""
+	final, _, err := editor.input.ReadRune()
+	for err == nil && final >= '0' && final <= '9' {
+		parameter += string(final)
+		final, _, err = editor.input.ReadRune()
+	}
+	if err != nil {
+		return
+	}
+	if final == '~' {
+		switch parameter {
+		case "1", "7":
+			final = 'H'
+		case "4", "8":
+			final = 'F'
+		case "3":
+			editor.deleteAt(editor.cursor)
+			return
+		}
+	}
+	switch final {
+	case 'A':
+		editor.recallHistory(-1)
+	case 'B':
+		editor.recallHistory(1)
+	case 'C':
+		editor.cursor = min(editor.cursor+1, len(editor.buffer))
+	case 'D':
+		editor.cursor = max(editor.cursor-1, 0)
+	case 'H':
+		editor.cursor = 0
+	case 'F':
+		editor.cursor = len(editor.buffer)
+	}
+}
+
+// recallHistory moves through the history in a direction, replacing the
+// line with the command recalled, or with the new line at the end.
+func (editor *lineEditor) recallHistory(direction int) {
+	index := editor.historyIndex + direction
+	if index < 0 || index > len(editor.history) {
+		return
+	}
+	if editor.historyIndex == len(editor.history) {
+		editor.newLine = editor.buffer
+	}
+	editor.historyIndex = index
+	if index == len(editor.history) {
+		editor.buffer = editor.newLine
+	} else {
+		editor.buffer = []rune(editor.history[index])
+	}
+	editor.cursor = len(editor.buffer)
+}
+
+// completeWord completes the word before the cursor. If there is a single
+// completion, it is inserted followed by a space; otherwise, the common
+// prefix of the completions is inserted, or if there is none, the
+// completions are listed.
+func (editor *lineEditor) completeWord() {
+	if editor.complete == nil {
+		return
+	}
+	candidates, word := editor.complete(string(editor.buffer[:editor.cursor]))
+	if len(candidates) == 0 {
+		editor.write("\a")
+		return
+	}
+	prefix := candidates[0]
+	for _, candidate := range candidates[1:] {
+		for !strings.HasPrefix(candidate, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	if len(candidates) == 1 {
+		editor.insert([]rune(strings.TrimPrefix(prefix, word) + " "))
+	} else if len(prefix) > len(word) {
+		editor.insert([]rune(strings.TrimPrefix(prefix, word)))
+	} else {
+		editor.write("\r\n" + strings.Join(candidates, "  ") + "\r\n")
+	}
+}
+
+// insert inserts text at the cursor.
+func (editor *lineEditor) insert(text []rune) {
+	buffer := append([]rune{}, editor.buffer[:editor.cursor]...)
+	buffer = append(buffer, text...)
+	editor.buffer = append(buffer, editor.buffer[editor.cursor:]...)
+	editor.cursor += len(text)
+}
+
+// deleteAt deletes the character at a position, if there is one.
+func (editor *lineEditor) deleteAt(position int) {
+	if position < len(editor.buffer) {
+		editor.buffer = append(editor.buffer[:position:position],
+			editor.buffer[position+1:]...)
+	}
+}
+
+// redraw redraws the prompt and line, placing the cursor.
+func (editor *lineEditor) redraw() {
+	text := "\r" + editor.prompt + string(editor.buffer) + "\x1b[K"
+	if back := len(editor.buffer) - editor.cursor; back > 0 {
+		text += "\x1b[" + strconv.Itoa(back) + "D"
+	}
+	editor.write(text)
+}
+
+func (editor *lineEditor) write(text string) {
+	_, _ = io.WriteString(editor.output, text)
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,340 @@
+// logging.go
+// Log Output Formatting and Destinations
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Timestamp formats used for log output.
+const (
+	LogTimestampFormat     = "2006-01-02 15:04:05"
+	ConsoleTimestampFormat = "15:04:05"
+)
+
+// Supported values for the agent log-format setting.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// Supported values for the agent log-targets setting, in addition to
+// the console output which is always enabled.
+const (
+	LogTargetFile     = "file"
+	LogTargetSyslog   = "syslog"
+	LogTargetJournald = "journald"
+
+	DefaultSyslogFacility = "daemon"
+)
+
+// Log levels which may be configured for the agent.
+const (
+	LogLevelDebug = "debug"
+	LogLevelInfo  = "info"
+	LogLevelWarn  = "warn"
+	LogLevelError = "error"
+
+	DefaultLogLevel = LogLevelInfo
+)
+
+// Names of the structured fields attached to log entries.
+const (
+	LogFieldResponder = "responder"
+	LogFieldMonitor   = "monitor"
+	LogFieldAction    = "action"
+	LogFieldType      = "type"
+	LogFieldTarget    = "target"
+	LogFieldRequest   = "request"
+	LogFieldScore     = "score"
+	LogFieldOnline    = "online"
+	LogFieldEvent     = "event"
+)
+
+// ANSI colour codes used for console log levels.
+const (
+	ansiReset  = "\x1b[0m"
+	ansiGrey   = "\x1b[90m"
+	ansiRed    = "\x1b[31m"
+	ansiYellow = "\x1b[33m"
+	ansiCyan   = "\x1b[36m"
+	ansiBold   = "\x1b[1m"
+)
+
+// #######################################################################
+// ConsoleFormatter
+// #######################################################################
+
+// ConsoleFormatter renders log entries as concise, human-friendly lines
+// for interactive use, optionally coloured by level. This is used only
+// for console output; log files retain the machine-readable format.
+type ConsoleFormatter struct {
+	EnableColor bool
+}
+
+// Format renders a single log entry for the console.
+func (f *ConsoleFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	var b bytes.Buffer
+	level := strings.ToUpper(entry.Level.String())
+	if len(level) > 5 {
+		level = level[:5]
+	}
+	timestamp := entry.Time.Format(ConsoleTimestampFormat)
+	if f.EnableColor {
+		b.WriteString(ansiGrey + timestamp + ansiReset + " " +
+			levelColor(entry.Level) + fmt.Sprintf("%-5s", level) + ansiReset +
+			" " + entry.Message)
+	} else {
+		b.WriteString(timestamp + " " + fmt.Sprintf("%-5s", level) +
+			" " + entry.Message)
+	}
+	// Append any structured fields in a stable order.
+	for _, field := range formatEntryFields(entry) {
+		if f.EnableColor {
+			field = ansiGrey + field + ansiReset
+		}
+		b.WriteString(" " + field)
+	}
+	b.WriteByte('\n')
+	return b.Bytes(), nil
+}
+
+// formatEntryFields returns the structured fields of a log entry as
+// "key=value" strings, sorted by key.
+func formatEntryFields(entry *logrus.Entry) (fields []string) {
+	keys := make([]string, 0, len(entry.Data))
+	for key := range entry.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fields = append(fields, key+"="+fmt.Sprint(entry.Data[key]))
+	}
+	return
+}
+
+// levelColor returns the ANSI colour sequence for a given log level.
+func levelColor(level logrus.Level) string {
+	switch level {
+	case logrus.DebugLevel, logrus.TraceLevel:
+		return ansiGrey
+	case logrus.InfoLevel:
+		return ansiCyan
+	case logrus.WarnLevel:
+		return ansiYellow
+	default:
+		return ansiBold + ansiRed
+	}
+}
+
+// IsColorTerminal returns whether console output should be coloured by
+// default: that is, if stdout is a terminal and NO_COLOR is not set.
+func IsColorTerminal() bool {
+	if _, set := os.LookupEnv("NO_COLOR"); set {
+		return false
+	}
+	info, err := os.Stdout.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// NewFileFormatter returns the machine-formatted logrus formatter used for
+// all non-console log destinations, for a given log format name.
+func NewFileFormatter(format string) logrus.Formatter {
+	if format == LogFormatJSON {
+		return &logrus.JSONFormatter{
+			TimestampFormat: time.RFC3339Nano,
+		}
+	}
+	return &logrus.TextFormatter{
+		TimestampFormat: LogTimestampFormat,
+		FullTimestamp:   true,
+		DisableColors:   true,
+	}
+}
+
+// ParseLogFormat validates and standardises a log format name, where an
+// empty string selects the default text format.
+func ParseLogFormat(format string) (result string, err error) {
+	result = strings.ToLower(strings.TrimSpace(format))
+	switch result {
+	case "":
+		result = LogFormatText
+	case LogFormatText, LogFormatJSON:
+	default:
+		err = errors.New("invalid log format '" + format + "'; must be '" +
+			LogFormatText + "' or '" + LogFormatJSON + "'")
+	}
+	return
+}
+
+// #######################################################################
+// MessageFormatter
+// #######################################################################
+
+// MessageFormatter renders only the message and structured fields of a
+// log entry, for destinations such as syslog which record the timestamp
+// and level themselves.
+type MessageFormatter struct{}
+
+// Format renders a single log entry without a timestamp or level.
+func (f *MessageFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	line := entry.Message
+	fields := formatEntryFields(entry)
+	if len(fields) > 0 {
+		line += " " + strings.Join(fields, " ")
+	}
+	return []byte(line), nil
+}
+
+// NewSyslogFormatter returns the formatter used for the message body of
+// syslog entries, for a given log format name.
+func NewSyslogFormatter(format string) logrus.Formatter {
+	if format == LogFormatJSON {
+		return &logrus.JSONFormatter{DisableTimestamp: true}
+	}
+	return &MessageFormatter{}
+}
+
+// LogLevelToSyslogSeverity maps a logrus level to the equivalent syslog
+// severity (RFC 5424), which is also used for journald priorities.
+func LogLevelToSyslogSeverity(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return 2 // crit
+	case logrus.ErrorLevel:
+		return 3 // err
+	case logrus.WarnLevel:
+		return 4 // warning
+	case logrus.InfoLevel:
+		return 6 // info
+	default:
+		return 7 // debug
+	}
+}
+
+// #######################################################################
+// Log Targets
+// #######################################################################
+
+// ParseLogTargets validates and standardises a list of log target names,
+// removing duplicates. An empty list selects the default file target.
+func ParseLogTargets(targets []string) (result []string, err error) {
+	seen := make(map[string]bool)
+	for _, target := range targets {
+		target = strings.ToLower(strings.TrimSpace(target))
+		switch target {
+		case LogTargetFile, LogTargetSyslog, LogTargetJournald:
+		default:
+			err = errors.New("invalid log target '" + target + "'; must be '" +
+				LogTargetFile + "', '" + LogTargetSyslog + "' or '" +
+				LogTargetJournald + "'")
+			return
+		}
+		if !seen[target] {
+			seen[target] = true
+			result = append(result, target)
+		}
+	}
+	if len(result) == 0 {
+		result = []string{LogTargetFile}
+	}
+	return
+}
+
+// ParseLogLevel validates and standardises a log level name, returning the
+// equivalent logrus level. An empty string selects the default level.
+func ParseLogLevel(name string) (result string, level logrus.Level, err error) {
+	result = strings.ToLower(strings.TrimSpace(name))
+	switch result {
+	case "":
+		result = DefaultLogLevel
+		level = logrus.InfoLevel
+	case LogLevelDebug:
+		level = logrus.DebugLevel
+	case LogLevelInfo:
+		level = logrus.InfoLevel
+	case LogLevelWarn, "warning":
+		result = LogLevelWarn
+		level = logrus.WarnLevel
+	case LogLevelError:
+		level = logrus.ErrorLevel
+	default:
+		err = errors.New("invalid log level '" + name + "'; must be '" +
+			LogLevelDebug + "', '" + LogLevelInfo + "', '" + LogLevelWarn +
+			"' or '" + LogLevelError + "'")
+	}
+	return
+}
+
+// #######################################################################
+// LogWriterHook
+// #######################################################################
+
+// LogWriterHook is a logrus hook that writes every log entry to an
+// additional destination using its own formatter, so that log files can
+// use a different format from the console.
+type LogWriterHook struct {
+	writer    io.Writer
+	formatter logrus.Formatter
+	mutex     sync.Mutex
+}
+
+// NewLogWriterHook creates a new hook writing to the given destination.
+func NewLogWriterHook(writer io.Writer, formatter logrus.Formatter) *LogWriterHook {
+	return &LogWriterHook{
+		writer:    writer,
+		formatter: formatter,
+	}
+}
+
+// Levels returns the log levels for which this hook fires (all of them).
+func (hook *LogWriterHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire formats and writes a log entry to the destination.
+func (hook *LogWriterHook) Fire(entry *logrus.Entry) (err error) {
+	line, err := hook.formatter.Format(entry)
+	if err != nil {
+		return
+	}
+	hook.mutex.Lock()
+	defer hook.mutex.Unlock()
+	_, err = hook.writer.Write(line)
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,210 @@
+//go:build linux || freebsd || netbsd || openbsd || darwin
+
+// logging_posix.go
+// Syslog and Journald Log Targets - POSIX Operating Systems
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/syslog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// JournaldSocketPath is the native protocol socket of systemd-journald.
+const JournaldSocketPath = "/run/systemd/journal/socket"
+
+// syslogFacilities maps facility names, as used in the agent config,
+// to their syslog priority values.
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// #######################################################################
+// SyslogHook
+// #######################################################################
+
+// SyslogHook is a logrus hook that sends every log entry to the local
+// syslog daemon, mapping log levels to syslog severities.
+type SyslogHook struct {
+	writer    *syslog.Writer
+	formatter logrus.Formatter
+}
+
+// PlatformNewSyslogHook connects to the local syslog daemon using the
+// named facility, returning a hook to send log entries to it.
+func PlatformNewSyslogHook(facility string,
+	formatter logrus.Formatter) (hook logrus.Hook, err error) {
+	facility = strings.ToLower(strings.TrimSpace(facility))
+	if facility == "" {
+		facility = DefaultSyslogFacility
+	}
+	priority, exists := syslogFacilities[facility]
+	if !exists {
+		err = errors.New("invalid syslog facility '" + facility + "'")
+		return
+	}
+	writer, err := syslog.New(priority|syslog.LOG_INFO, AppIdentifier)
+	if err != nil {
+		return
+	}
+	hook = &SyslogHook{
+		writer:    writer,
+		formatter: formatter,
+	}
+	return
+}
+
+// Levels returns the log levels for which this hook fires (all of them).
+func (hook *SyslogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire formats and sends a log entry to syslog at the mapped severity.
+func (hook *SyslogHook) Fire(entry *logrus.Entry) (err error) {
+	line, err := hook.formatter.Format(entry)
+	if err != nil {
+		return
+	}
+	message := strings.TrimSuffix(string(line), "\n")
+	switch LogLevelToSyslogSeverity(entry.Level) {
+	case 2:
+		err = hook.writer.Crit(message)
+	case 3:
+		err = hook.writer.Err(message)
+	case 4:
+		err = hook.writer.Warning(message)
+	case 6:
+		err = hook.writer.Info(message)
+	default:
+		err = hook.writer.Debug(message)
+	}
+	return
+}
+
+// #######################################################################
+// JournaldHook
+// #######################################################################
+
+// JournaldHook is a logrus hook that sends every log entry to
+// systemd-journald using its native protocol, so that the structured
+// fields of an entry are stored as journal fields (e.g. RESPONDER).
+type JournaldHook struct {
+	conn  *net.UnixConn
+	mutex sync.Mutex
+}
+
+// PlatformNewJournaldHook connects to the local journald socket,
+// returning a hook to send log entries to it.
+func PlatformNewJournaldHook() (hook logrus.Hook, err error) {
+	if _, err = os.Stat(JournaldSocketPath); err != nil {
+		err = errors.New("journald is not available: " + err.Error())
+		return
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{
+		Name: JournaldSocketPath,
+		Net:  "unixgram",
+	})
+	if err != nil {
+		return
+	}
+	hook = &JournaldHook{conn: conn}
+	return
+}
+
+// Levels returns the log levels for which this hook fires (all of them).
+func (hook *JournaldHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire sends a log entry to journald as a single datagram.
+func (hook *JournaldHook) Fire(entry *logrus.Entry) (err error) {
+	var b bytes.Buffer
+	writeJournalField(&b, "MESSAGE", entry.Message)
+	writeJournalField(&b, "PRIORITY",
+		fmt.Sprint(LogLevelToSyslogSeverity(entry.Level)))
+	writeJournalField(&b, "SYSLOG_IDENTIFIER", AppIdentifier)
+	for key, value := range entry.Data {
+		writeJournalField(&b, journalFieldName(key), fmt.Sprint(value))
+	}
+	hook.mutex.Lock()
+	defer hook.mutex.Unlock()
+	_, err = hook.conn.Write(b.Bytes())
+	return
+}
+
+// writeJournalField appends a field in the journald native protocol
+// format; values containing newlines use the length-prefixed encoding.
+func writeJournalField(b *bytes.Buffer, name string, value string) {
+	if !strings.Contains(value, "\n") {
+		b.WriteString(name + "=" + value + "\n")
+		return
+	}
+	b.WriteString(name + "\n")
+	_ = binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value + "\n")
+}
+
+// journalFieldName converts a log field name into a valid journal field
+// name, which may only contain upper case letters, digits and underscores
+// and must not start with an underscore or digit.
+func journalFieldName(key string) string {
+	name := []byte(strings.ToUpper(key))
+	for i, c := range name {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			name[i] = '_'
+		}
+	}
+	if len(name) == 0 || name[0] == '_' || (name[0] >= '0' && name[0] <= '9') {
+		return "FIELD_" + string(name)
+	}
+	return string(name)
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
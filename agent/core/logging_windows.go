@@ -0,0 +1,98 @@
+//go:build windows
+
+// logging_windows.go
+// Event Log Target - Windows
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// Event ID used for all entries written to the Windows Event Log.
+const EventLogEventID = 1
+
+// #######################################################################
+// EventLogHook
+// #######################################################################
+
+// EventLogHook is a logrus hook that sends every log entry to the Windows
+// Application Event Log, which takes the place of syslog on Windows.
+type EventLogHook struct {
+	log       *eventlog.Log
+	formatter logrus.Formatter
+}
+
+// PlatformNewSyslogHook opens the Windows Event Log under the event source
+// of the agent, returning a hook to send log entries to it. The event
+// source is registered when the agent is installed as a Windows Service;
+// the syslog facility does not apply on Windows and is ignored.
+func PlatformNewSyslogHook(facility string,
+	formatter logrus.Formatter) (hook logrus.Hook, err error) {
+	log, err := eventlog.Open(AppIdentifier)
+	if err != nil {
+		err = errors.New("cannot open the Windows Event Log: " + err.Error())
+		return
+	}
+	hook = &EventLogHook{
+		log:       log,
+		formatter: formatter,
+	}
+	return
+}
+
+// Levels returns the log levels for which this hook fires (all of them).
+func (hook *EventLogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire formats and sends a log entry to the Event Log as an error,
+// warning or information event according to its level.
+func (hook *EventLogHook) Fire(entry *logrus.Entry) (err error) {
+	line, err := hook.formatter.Format(entry)
+	if err != nil {
+		return
+	}
+	message := strings.TrimSuffix(string(line), "\n")
+	switch {
+	case entry.Level <= logrus.ErrorLevel:
+		err = hook.log.Error(EventLogEventID, message)
+	case entry.Level == logrus.WarnLevel:
+		err = hook.log.Warning(EventLogEventID, message)
+	default:
+		err = hook.log.Info(EventLogEventID, message)
+	}
+	return
+}
+
+// PlatformNewJournaldHook always fails, as journald is not available on
+// Windows.
+func PlatformNewJournaldHook() (hook logrus.Hook, err error) {
+	err = errors.New("journald is not available on Windows")
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,248 @@
+// logrotate.go
+// Size and Age Based Rotation of Log Files
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Defaults applied when no log rotation settings are configured.
+	DefaultLogMaxSizeMB  = 10
+	DefaultLogMaxBackups = 5
+
+	// Suffix format for rotated log files, which sorts chronologically.
+	LogRotationTimeFormat = "20060102-150405.000"
+	// Extension added to rotated log files when compressed.
+	LogCompressedExtension = ".gz"
+)
+
+// LogRotationConfig holds the log file rotation settings for the agent.
+// A value of zero for a limit disables that limit.
+type LogRotationConfig struct {
+	MaxSizeMB  int  `json:"max-size-mb"`
+	MaxBackups int  `json:"max-backups"`
+	MaxAgeDays int  `json:"max-age-days"`
+	Compress   bool `json:"compress"`
+}
+
+// DefaultLogRotation returns the default log rotation settings.
+func DefaultLogRotation() *LogRotationConfig {
+	return &LogRotationConfig{
+		MaxSizeMB:  DefaultLogMaxSizeMB,
+		MaxBackups: DefaultLogMaxBackups,
+	}
+}
+
+// Validate checks that the log rotation settings are within range.
+func (config *LogRotationConfig) Validate() (err error) {
+	if config.MaxSizeMB < 0 || config.MaxBackups < 0 || config.MaxAgeDays < 0 {
+		err = errors.New("log rotation limits cannot be negative")
+	}
+	return
+}
+
+// #######################################################################
+// RotatingLogFile
+// #######################################################################
+
+// RotatingLogFile is an io.Writer for a log file which is rotated once it
+// exceeds a maximum size. Rotated files are renamed with a timestamp
+// suffix, optionally compressed, and pruned by count and age.
+type RotatingLogFile struct {
+	path         string
+	config       LogRotationConfig
+	header       []byte
+	file         *os.File
+	size         int64
+	mutex        sync.Mutex
+	cleanupMutex sync.Mutex
+}
+
+// NewRotatingLogFile opens (or creates) the log file at the given path
+// with the specified rotation settings.
+func NewRotatingLogFile(path string,
+	config LogRotationConfig) (rlf *RotatingLogFile, err error) {
+	return newRotatingFile(path, config, nil)
+}
+
+// newRotatingFile opens a rotating file as for NewRotatingLogFile, with a
+// header (if any) written at the start of each new file.
+func newRotatingFile(path string, config LogRotationConfig, header []byte) (
+	rlf *RotatingLogFile, err error) {
+	err = config.Validate()
+	if err != nil {
+		return
+	}
+	rlf = &RotatingLogFile{
+		path:   path,
+		config: config,
+		header: header,
+	}
+	err = rlf.open()
+	if err != nil {
+		rlf = nil
+		return
+	}
+	// Apply the count and age limits to any existing rotated files.
+	go rlf.cleanup("")
+	return
+}
+
+// Write writes to the log file, rotating it first if the write would
+// take it over the maximum size.
+func (rlf *RotatingLogFile) Write(p []byte) (n int, err error) {
+	rlf.mutex.Lock()
+	defer rlf.mutex.Unlock()
+	maxSize := int64(rlf.config.MaxSizeMB) * 1024 * 1024
+	if maxSize > 0 && rlf.size > 0 && rlf.size+int64(len(p)) > maxSize {
+		err = rlf.rotate()
+		if err != nil {
+			return
+		}
+	}
+	n, err = rlf.file.Write(p)
+	rlf.size += int64(n)
+	return
+}
+
+// Close closes the current log file.
+func (rlf *RotatingLogFile) Close() (err error) {
+	rlf.mutex.Lock()
+	defer rlf.mutex.Unlock()
+	if rlf.file != nil {
+		err = rlf.file.Close()
+		rlf.file = nil
+	}
+	return
+}
+
+// open opens the log file for appending and records its current size,
+// writing the header if the file is new. The caller must hold the mutex (or have exclusive access).
+func (rlf *RotatingLogFile) open() (err error) {
+	file, err := PlatformOpenLogFile(rlf.path)
+	if err != nil {
+		return
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return
+	}
+	rlf.file = file
+	rlf.size = info.Size()
+	if rlf.size == 0 && len(rlf.header) > 0 {
+		var n int
+		n, err = file.Write(rlf.header)
+		rlf.size += int64(n)
+	}
+	return
+}
+
+// rotate renames the current log file with a timestamp suffix and opens
+// a new file in its place. The caller must hold the mutex.
+func (rlf *RotatingLogFile) rotate() (err error) {
+	err = rlf.file.Close()
+	if err != nil {
+		return
+	}
+	rotatedPath := rlf.path + "." + time.Now().Format(LogRotationTimeFormat)
+	err = os.Rename(rlf.path, rotatedPath)
+	if err != nil {
+		// Carry on logging to the existing file if the rename failed.
+		openErr := rlf.open()
+		err = errors.Join(err, openErr)
+		return
+	}
+	err = rlf.open()
+	if err != nil {
+		return
+	}
+	// Compression and pruning are done in the background so that
+	// logging is not blocked.
+	go rlf.cleanup(rotatedPath)
+	return
+}
+
+// cleanup compresses a newly rotated file (if enabled) and removes any
+// rotated files beyond the configured count and age limits.
+func (rlf *RotatingLogFile) cleanup(rotatedPath string) {
+	rlf.cleanupMutex.Lock()
+	defer rlf.cleanupMutex.Unlock()
+	if rotatedPath != "" && rlf.config.Compress {
+		if compressLogFile(rotatedPath) == nil {
+			_ = os.Remove(rotatedPath)
+		}
+	}
+	backups, err := filepath.Glob(rlf.path + ".*")
+	if err != nil {
+		return
+	}
+	// Timestamp suffixes sort oldest first; remove from the newest end.
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	cutoff := time.Now().AddDate(0, 0, -rlf.config.MaxAgeDays)
+	for index, backup := range backups {
+		expired := rlf.config.MaxBackups > 0 && index >= rlf.config.MaxBackups
+		if !expired && rlf.config.MaxAgeDays > 0 {
+			info, statErr := os.Stat(backup)
+			expired = statErr == nil && info.ModTime().Before(cutoff)
+		}
+		if expired {
+			_ = os.Remove(backup)
+		}
+	}
+}
+
+// compressLogFile writes a gzip-compressed copy of a file alongside it.
+func compressLogFile(path string) (err error) {
+	if strings.HasSuffix(path, LogCompressedExtension) {
+		return
+	}
+	source, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer source.Close()
+	dest, err := os.OpenFile(path+LogCompressedExtension,
+		os.O_CREATE|os.O_TRUNC|os.O_WRONLY, DefaultFilePermissions)
+	if err != nil {
+		return
+	}
+	writer := gzip.NewWriter(dest)
+	_, err = io.Copy(writer, source)
+	err = errors.Join(err, writer.Close(), dest.Close())
+	if err != nil {
+		_ = os.Remove(path + LogCompressedExtension)
+	}
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
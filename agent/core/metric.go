@@ -81,6 +81,8 @@ func NewMetric(metric string, params MetricParams, configPath string) (
 		mc = &DiskUsageMetric{}
 	case MetricTypeNetConnections:
 		mc = &NetConnectionsMetric{}
+	case MetricTypePeer:
+		mc = &PeerMetric{}
 	case MetricTypeScript:
 		// For security, the script path is not included with the
 		// [MetricParams] array so it can't be changed via the JSON
@@ -105,18 +107,46 @@ func NewMetric(metric string, params MetricParams, configPath string) (
 // #################################
 
 type CPUMetric struct {
-	SampleTime uint64
+	SampleTime   uint64
+	SamplingMode string
+	// In delta mode, the CPU times read by the previous sample.
+	lastTimes []cpu.TimesStat
 }
 
 const (
 	MetricTypeCPU          = "cpu"
 	ParamKeySampleTime     = "sampling-ms"
+	ParamKeySamplingMode   = "sampling-mode"
 	CPUMetricMinSampleTime = 500
 	CPUMetricDefaultMax    = 100
 	CPUMetricMinInterval   = 500
+
+	// In blocking mode (the default), each sample measures the CPU usage
+	// over the sample time, blocking the monitor while it does so.
+	CPUSamplingBlocking = "blocking"
+	// In delta mode, each sample measures the CPU usage since the
+	// previous sample from the CPU time counters, without blocking.
+	CPUSamplingDelta = "delta"
 )
 
 func (m *CPUMetric) Configure(params MetricParams) (err error) {
+	m.SamplingMode = strings.ToLower(strings.TrimSpace(
+		params[ParamKeySamplingMode]))
+	switch m.SamplingMode {
+	case "", CPUSamplingBlocking:
+		m.SamplingMode = CPUSamplingBlocking
+	case CPUSamplingDelta:
+		// The sample time does not apply; read the initial counters,
+		// against which the first sample is measured.
+		params[ParamKeySamplingMode] = m.SamplingMode
+		m.lastTimes, _ = cpu.Times(true)
+		return
+	default:
+		err = errors.New("invalid sampling mode '" + m.SamplingMode +
+			"'; use '" + CPUSamplingBlocking + "' or '" +
+			CPUSamplingDelta + "'")
+		return
+	}
 	defaultWarn := ""
 	defaultSampleTime := false
 	sampleTime, exists := params[ParamKeySampleTime]
@@ -149,6 +179,9 @@ func (m *CPUMetric) Configure(params MetricParams) (err error) {
 
 // GetLoad returns the current CPU metric for the host system.
 func (m *CPUMetric) GetLoad() (float64, error) {
+	if m.SamplingMode == CPUSamplingDelta {
+		return m.getDeltaLoad()
+	}
 	// Whilst the docs for gopsutil indicate that passing "false"
 	// to the cpu.Percent() function should result in an overall
 	// utilisation figure, it in fact seems to only reflect the
@@ -163,6 +196,34 @@ func (m *CPUMetric) GetLoad() (float64, error) {
 	}
 }
 
+// getDeltaLoad returns the CPU usage across all cores since the previous
+// sample, calculated from the busy and total CPU time counters.
+func (m *CPUMetric) getDeltaLoad() (load float64, err error) {
+	times, err := cpu.Times(true)
+	if err != nil {
+		return
+	}
+	previous := m.lastTimes
+	m.lastTimes = times
+	if len(previous) != len(times) {
+		err = errors.New("no previous CPU counters; " +
+			"the load will be available from the next sample")
+		return
+	}
+	var busy, total float64
+	for i := range times {
+		idle := times[i].Idle + times[i].Iowait
+		lastIdle := previous[i].Idle + previous[i].Iowait
+		total += times[i].Total() - previous[i].Total()
+		busy += (times[i].Total() - idle) - (previous[i].Total() - lastIdle)
+	}
+	if total <= 0 || busy < 0 {
+		return
+	}
+	load = min(busy/total*100, 100)
+	return
+}
+
 func (m *CPUMetric) GetDefaultMax() float64 {
 	return CPUMetricDefaultMax
 }
@@ -323,20 +384,38 @@ func (m *DiskUsageMetric) GetMinInterval() int {
 // NetConnectionsMetric
 // #################################
 
-type NetConnectionsMetric struct{}
+// NetConnectionsMetric counts the network connections of the system, or
+// if a local port is specified, only those to that port (such as of the
+// balanced service), excluding any listening sockets.
+type NetConnectionsMetric struct {
+	LocalPort uint32
+}
 
 const (
 	MetricTypeNetConnections  = "netconn"
+	ParamKeyLocalPort         = "local-port"
 	NetConnectionsDefaultMax  = 2000
 	NetConnectionsMinInterval = 3000
 )
 
-func (m *NetConnectionsMetric) Configure(_ MetricParams) (err error) {
+func (m *NetConnectionsMetric) Configure(params MetricParams) (err error) {
+	m.LocalPort = 0
+	value, exists := params[ParamKeyLocalPort]
+	if !exists {
+		return
+	}
+	port, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || port < 1 || port > 65535 {
+		err = errors.New("invalid local port '" + value + "'")
+		return
+	}
+	m.LocalPort = uint32(port)
+	params[ParamKeyLocalPort] = strconv.Itoa(port)
 	return
 }
 
 func (m *NetConnectionsMetric) GetLoad() (val float64, err error) {
-	intVal, err := PlatformGetConnectionCount()
+	intVal, err := PlatformGetConnectionCount(m.LocalPort)
 	if err != nil {
 		return
 	}
@@ -349,6 +428,9 @@ func (m *NetConnectionsMetric) GetMetricName() string {
 }
 
 func (m *NetConnectionsMetric) GetDescription() string {
+	if m.LocalPort != 0 {
+		return "netconn, local port " + strconv.Itoa(int(m.LocalPort))
+	}
 	return "netconn"
 }
 
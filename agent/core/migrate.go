@@ -0,0 +1,221 @@
+// migrate.go
+// Versioning and Migration of the Agent Configuration Schema
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// The version of the configuration schema written by this agent. This
+	// must be increased whenever a migration is added below.
+	CurrentConfigVersion = 3
+	// The version assumed for a configuration without a version field,
+	// as written by all agents before versioning was introduced.
+	UnversionedConfigVersion = 1
+	// Name of the JSON field holding the configuration schema version.
+	ConfigVersionField = "config-version"
+)
+
+// configMigration upgrades a generic JSON configuration object from the
+// previous schema version to the given version, returning a description
+// of each change made.
+type configMigration struct {
+	version int
+	migrate func(config map[string]any) (changes []string)
+}
+
+// configMigrations lists every schema migration in version order.
+var configMigrations = []configMigration{
+	{2, migrateThresholdEnabled},
+	{3, migrateDurationKeys},
+}
+
+// MigrateConfigJSON upgrades JSON configuration data written with any
+// earlier schema version to the current version, returning the migrated
+// data, the version it was originally written with and a description of
+// each change made. Data already at the current version, or written by a
+// newer agent, is returned unchanged.
+func MigrateConfigJSON(data []byte) (result []byte, fromVersion int,
+	changes []string, err error) {
+	result = data
+	config := make(map[string]any)
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err = decoder.Decode(&config)
+	if err != nil {
+		return
+	}
+	fromVersion = UnversionedConfigVersion
+	if value, exists := config[ConfigVersionField]; exists {
+		number, isNumber := value.(json.Number)
+		version, parseErr := strconv.Atoi(number.String())
+		if !isNumber || parseErr != nil || version < 1 {
+			err = errors.New("invalid " + ConfigVersionField + " value")
+			return
+		}
+		fromVersion = version
+	}
+	if fromVersion >= CurrentConfigVersion {
+		return
+	}
+	for _, migration := range configMigrations {
+		if migration.version <= fromVersion {
+			continue
+		}
+		for _, change := range migration.migrate(config) {
+			changes = append(changes, "v"+strconv.Itoa(migration.version-1)+
+				" to v"+strconv.Itoa(migration.version)+": "+change)
+		}
+	}
+	config[ConfigVersionField] = CurrentConfigVersion
+	result, err = json.Marshal(config)
+	return
+}
+
+// configServiceMap returns a map of named service objects from a generic
+// JSON configuration object, with the names in sorted order.
+func configServiceMap(config map[string]any, field string) (
+	services map[string]map[string]any, names []string) {
+	services = make(map[string]map[string]any)
+	entries, _ := config[field].(map[string]any)
+	for name, entry := range entries {
+		if service, isObject := entry.(map[string]any); isObject {
+			services[name] = service
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+// #######################################################################
+// Migrations
+// #######################################################################
+
+// migrateThresholdEnabled replaces the 'threshold-enabled' boolean used by
+// Responders before v5.4.0 with the equivalent 'threshold-mode' string.
+func migrateThresholdEnabled(config map[string]any) (changes []string) {
+	responders, names := configServiceMap(config, "responders")
+	for _, name := range names {
+		responder := responders[name]
+		value, exists := responder["threshold-enabled"]
+		if !exists {
+			continue
+		}
+		delete(responder, "threshold-enabled")
+		enabled, _ := value.(bool)
+		if _, hasMode := responder["threshold-mode"]; hasMode {
+			changes = append(changes, "responder '"+name+"': removed "+
+				"'threshold-enabled', as 'threshold-mode' is already set")
+			continue
+		}
+		mode := ThresholdStringNone
+		if enabled {
+			mode = ThresholdStringAny
+		}
+		responder["threshold-mode"] = mode
+		changes = append(changes, "responder '"+name+"': replaced "+
+			"'threshold-enabled' ("+strconv.FormatBool(enabled)+
+			") with 'threshold-mode' '"+mode+"'")
+	}
+	return
+}
+
+// durationKey describes a setting written as a number of seconds or
+// milliseconds by earlier versions, which is now a duration under a new
+// key.
+type durationKey struct {
+	section string
+	oldKey  string
+	newKey  string
+	unit    time.Duration
+}
+
+// durationKeys lists the settings of each section of the config which
+// became durations.
+var durationKeys = []durationKey{
+	{"heartbeat", "interval-s", "interval", time.Second},
+	{"heartbeat", "timeout-s", "timeout", time.Second},
+	{"metric-forwarder", "interval-s", "interval", time.Second},
+	{"opentelemetry", "interval-s", "interval", time.Second},
+	{"hooks", "timeout-s", "timeout", time.Second},
+	{"webhooks", "timeout-s", "timeout", time.Second},
+	{"cluster", "timeout-ms", "timeout", time.Millisecond},
+	{"email-alerts", "min-interval-s", "min-interval", time.Second},
+}
+
+// migrateDurationKeys replaces the intervals and timeouts written as
+// numbers of seconds or milliseconds by earlier versions with the
+// equivalent durations (e.g. '30s').
+func migrateDurationKeys(config map[string]any) (changes []string) {
+	for _, key := range durationKeys {
+		section, _ := config[key.section].(map[string]any)
+		if change := migrateDurationKey(section, key.oldKey, key.newKey,
+			key.unit); change != "" {
+			changes = append(changes, key.section+": "+change)
+		}
+	}
+	responders, names := configServiceMap(config, "responders")
+	for _, name := range names {
+		if change := migrateDurationKey(responders[name], "drain-timeout-ms",
+			"drain-timeout", time.Millisecond); change != "" {
+			changes = append(changes, "responder '"+name+"': "+change)
+		}
+	}
+	return
+}
+
+// migrateDurationKey replaces a setting given as a number of a unit with
+// the equivalent duration under a new key, returning a description of the
+// change, if any. A value which is not a number is discarded.
+func migrateDurationKey(settings map[string]any, oldKey string,
+	newKey string, unit time.Duration) (change string) {
+	value, exists := settings[oldKey]
+	if !exists {
+		return
+	}
+	delete(settings, oldKey)
+	if _, hasNew := settings[newKey]; hasNew {
+		change = "removed '" + oldKey + "', as '" + newKey + "' is already set"
+		return
+	}
+	number, _ := value.(json.Number)
+	count, err := number.Int64()
+	if err != nil {
+		change = "removed '" + oldKey + "', as its value is not a number"
+		return
+	}
+	duration := Duration(time.Duration(count) * unit)
+	settings[newKey] = duration.String()
+	change = "replaced '" + oldKey + "' (" + number.String() + ") with '" +
+		newKey + "' '" + duration.String() + "'"
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
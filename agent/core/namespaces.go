@@ -0,0 +1,273 @@
+// namespaces.go
+// Multi-Tenant API Namespaces
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"errors"
+)
+
+// Namespace defines a set of monitors and responders owned by one team on
+// a shared host, which may be managed through the API using a separate
+// API key. Requests made with a namespace key can only see and change the
+// services within that namespace, and cannot change agent-wide settings.
+type Namespace struct {
+	APIKey string `json:"api-key"`
+	apiKey string
+}
+
+// ValidateNamespaces standardises the names of a set of namespaces, and
+// checks that each has a distinct API key which is not the main API key.
+// Any reference to a secret in an API key is resolved.
+func ValidateNamespaces(namespaces map[string]*Namespace, mainKey string) (
+	result map[string]*Namespace, err error) {
+	result, _, err = NormaliseNameMap(namespaces, "namespace")
+	if err != nil {
+		return
+	}
+	keys := make(map[string]string)
+	for name, namespace := range result {
+		if namespace == nil || namespace.APIKey == "" {
+			err = errors.New("namespace '" + name + "' has no API key")
+			return
+		}
+		namespace.apiKey, err = ResolveSecret(namespace.APIKey)
+		if err != nil {
+			err = errors.New("namespace '" + name +
+				"': cannot resolve api-key: " + err.Error())
+			return
+		}
+		if namespace.apiKey == mainKey {
+			err = errors.New("namespace '" + name +
+				"' cannot use the main API key")
+			return
+		}
+		if other, exists := keys[namespace.apiKey]; exists {
+			err = errors.New("namespaces '" + other + "' and '" + name +
+				"' have the same API key")
+			return
+		}
+		keys[namespace.apiKey] = name
+	}
+	return
+}
+
+// GetNamespaceForKey returns the namespace which an API key belongs to.
+func (agent *FeedbackAgent) GetNamespaceForKey(key string) (name string,
+	exists bool) {
+	for name, namespace := range agent.Namespaces {
+		if key != "" && namespace.apiKey == key {
+			return name, true
+		}
+	}
+	return
+}
+
+// ParseNamespaceName validates a namespace name given in a request, which
+// must be defined in the agent configuration. An empty name removes a
+// service from any namespace.
+func (agent *FeedbackAgent) ParseNamespaceName(name string) (result string,
+	err error) {
+	if name == "" {
+		return
+	}
+	result, err = StandardiseNameIdentifier(name)
+	if err != nil {
+		return
+	}
+	if _, exists := agent.Namespaces[result]; !exists {
+		err = errors.New("namespace '" + result + "' does not exist")
+	}
+	return
+}
+
+// getRequestNamespace returns the namespace in which to place a service
+// being added or edited by an API request. Services created using a
+// namespace key always belong to that namespace.
+func (agent *FeedbackAgent) getRequestNamespace(request *APIRequest) (
+	namespace string, err error) {
+	if request.namespace != "" {
+		namespace = request.namespace
+	} else if request.Namespace != nil {
+		namespace, err = agent.ParseNamespaceName(*request.Namespace)
+	}
+	return
+}
+
+// ServiceInNamespace returns whether a named monitor or responder belongs
+// to the given namespace.
+func (agent *FeedbackAgent) ServiceInNamespace(serviceType string,
+	name string, namespace string) bool {
+	switch serviceType {
+	case "monitor":
+		monitor, exists := agent.Monitors[name]
+		return exists && monitor.Namespace == namespace
+	case "responder":
+		responder, exists := agent.Responders[name]
+		return exists && responder.Namespace == namespace
+	}
+	return false
+}
+
+// serviceExists returns whether a monitor or responder exists in any
+// namespace.
+func (agent *FeedbackAgent) serviceExists(serviceType string,
+	name string) (exists bool) {
+	switch serviceType {
+	case "monitor":
+		_, exists = agent.Monitors[name]
+	case "responder":
+		_, exists = agent.Responders[name]
+	}
+	return
+}
+
+// serviceVisible returns whether a monitor or responder exists within a
+// namespace, or at all if no namespace is given.
+func (agent *FeedbackAgent) serviceVisible(serviceType string, name string,
+	namespace string) bool {
+	if namespace != "" {
+		return agent.ServiceInNamespace(serviceType, name, namespace)
+	}
+	return agent.serviceExists(serviceType, name)
+}
+
+// authoriseNamespaceRequest checks that an API request made with a
+// namespace key only refers to services within that namespace, and does
+// not attempt any agent-wide actions.
+func (agent *FeedbackAgent) authoriseNamespaceRequest(request *APIRequest) (
+	err error) {
+	namespace := request.namespace
+	denied := errors.New("action not permitted for namespace '" +
+		namespace + "'")
+	if request.Namespace != nil && *request.Namespace != namespace {
+		err = errors.New("services cannot be moved out of namespace '" +
+			namespace + "'")
+		return
+	}
+	// Determine the responder or monitor which the request targets.
+	targetType := "responder"
+	switch request.Action {
+	case "add", "edit", "delete", "start", "stop", "restart", "upsert":
+		switch request.Type {
+		case "monitor":
+			targetType = "monitor"
+		case "responder", "source", "analysis":
+		default:
+			return denied
+		}
+	case "status":
+		return
+	case "apply":
+		// Each request in a batch is authorised individually.
+		if request.Type == ApplyTypeRequests {
+			return
+		}
+		return denied
+	case "get":
+		switch request.Type {
+		case "config", "events":
+			return
+		case "overrides":
+			if request.TargetName == "" {
+				return
+			}
+		case "headroom":
+			if request.TargetName == "" {
+				return
+			}
+		case "history":
+			if _, isMonitor := agent.Monitors[request.TargetName]; isMonitor {
+				targetType = "monitor"
+			}
+		case "feedback", "sources", "analysis", "simulate":
+		default:
+			return denied
+		}
+	case "set":
+		if request.Type != "commands" && request.Type != "cmd" &&
+			request.Type != "threshold" {
+			return denied
+		}
+	case "send", "force", "cancel":
+		if request.Type == "save-config" {
+			return denied
+		}
+		// Commands for all responders apply only within the namespace.
+		if request.TargetName == "" {
+			return
+		}
+	default:
+		return denied
+	}
+	// New services will be created within the namespace, including those
+	// created by an upsert.
+	isNew := request.Type == targetType && (request.Action == "add" ||
+		(request.Action == "upsert" &&
+			!agent.serviceExists(targetType, request.TargetName)))
+	if !isNew && !agent.ServiceInNamespace(targetType, request.TargetName,
+		namespace) {
+		err = errors.New(targetType + " '" + request.TargetName +
+			"' not found in namespace '" + namespace + "'")
+		return
+	}
+	// Feedback sources and analyses may only use monitors in the namespace.
+	var monitorNames []string
+	if request.SourceMonitorName != nil {
+		monitorNames = append(monitorNames, *request.SourceMonitorName)
+	}
+	if request.FeedbackSources != nil {
+		for name := range *request.FeedbackSources {
+			monitorNames = append(monitorNames, name)
+		}
+	}
+	for _, name := range monitorNames {
+		name, _ = StandardiseNameIdentifier(name)
+		if !agent.ServiceInNamespace("monitor", name, namespace) {
+			err = errors.New("monitor '" + name + "' not found in namespace '" +
+				namespace + "'")
+			return
+		}
+	}
+	return
+}
+
+// GetNamespaceConfig returns a view of the agent configuration containing
+// only the services within a namespace, without any agent-wide settings.
+func (agent *FeedbackAgent) GetNamespaceConfig(namespace string) (
+	config FeedbackAgent) {
+	config.Monitors = make(map[string]*SystemMonitor)
+	config.Responders = make(map[string]*FeedbackResponder)
+	for name, monitor := range agent.Monitors {
+		if monitor.Namespace == namespace {
+			config.Monitors[name] = monitor
+		}
+	}
+	for name, responder := range agent.Responders {
+		if responder.Namespace == namespace {
+			config.Responders[name] = responder
+		}
+	}
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,446 @@
+// openapi.go
+// OpenAPI Specification of the Feedback Agent API
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The OpenAPI specification is generated from the API request and response
+// types (by reflection of their JSON fields), the registry of CLI commands
+// (which documents the actions of the JSON action tree) and the table of
+// REST-style routes, so that it cannot drift out of step with the API. It
+// is served by API Responders without an API key, so that SDK generators
+// can fetch it, and can also be output by the CLI.
+
+const (
+	// Path on which API Responders serve the OpenAPI specification.
+	OpenAPIPath = "/openapi.json"
+	// Version of the OpenAPI specification format generated.
+	OpenAPIVersion = "3.0.3"
+)
+
+// openAPIObject is a JSON object within the specification.
+type openAPIObject = map[string]any
+
+// GenerateOpenAPISpec returns the OpenAPI specification of the agent API.
+func GenerateOpenAPISpec() (spec []byte, err error) {
+	gen := &openAPIGenerator{schemas: openAPIObject{}}
+	requestRef := gen.schemaFor(reflect.TypeOf(APIRequest{}))
+	responseRef := gen.schemaFor(reflect.TypeOf(APIResponse{}))
+	gen.describeActions()
+	paths := openAPIObject{}
+	paths["/"] = openAPIObject{
+		"post": openAPIObject{
+			"operationId": "callAPI",
+			"summary":     "Perform an action of the JSON API.",
+			"description": openAPIActionTreeDescription(),
+			// The key of the JSON API is given in the request itself.
+			"security": []any{},
+			"requestBody": openAPIObject{
+				"required": true,
+				"content":  openAPIJSONContent(requestRef),
+			},
+			"responses": openAPIObject{
+				"200": openAPIObject{
+					"description": "The response to the request, which " +
+						"reports whether it succeeded.",
+					"content": openAPIJSONContent(responseRef),
+				},
+			},
+		},
+	}
+	paths[OpenAPIPath] = openAPIObject{
+		"get": openAPIObject{
+			"operationId": "getOpenAPISpec",
+			"summary":     "Show this OpenAPI specification.",
+			"security":    []any{},
+			"responses": openAPIObject{
+				"200": openAPIObject{
+					"description": "The OpenAPI specification.",
+					"content":     openAPIJSONContent(openAPIObject{}),
+				},
+			},
+		},
+	}
+	paths[SubscribePath] = openAPISubscribePath()
+	paths[MetricsPath] = openAPIMetricsPath()
+	for _, route := range restRoutes {
+		gen.addRoute(paths, route, requestRef, responseRef)
+	}
+	spec, err = json.MarshalIndent(openAPIObject{
+		"openapi": OpenAPIVersion,
+		"info": openAPIObject{
+			"title": "Loadbalancer.org Feedback Agent API",
+			"description": "Manages the System Monitors and Feedback " +
+				"Responders of a Feedback Agent. Requests other than to " +
+				"the JSON API at '/' are authenticated by the API key " +
+				"given in an X-API-Key header or as a bearer token.",
+			"version": VersionString,
+			"license": openAPIObject{
+				"name": "GPL-3.0-or-later",
+				"url":  "https://www.gnu.org/licenses/gpl-3.0.html",
+			},
+		},
+		"security": []any{
+			openAPIObject{"apiKey": []any{}},
+			openAPIObject{"bearer": []any{}},
+		},
+		"paths": paths,
+		"components": openAPIObject{
+			"schemas": gen.schemas,
+			"securitySchemes": openAPIObject{
+				"apiKey": openAPIObject{
+					"type": "apiKey",
+					"in":   "header",
+					"name": "X-API-Key",
+				},
+				"bearer": openAPIObject{
+					"type":   "http",
+					"scheme": "bearer",
+				},
+			},
+		},
+	}, "", "    ")
+	if err == nil {
+		spec = append(spec, '\n')
+	}
+	return
+}
+
+// handleOpenAPI serves the OpenAPI specification.
+func (pc *HTTPConnector) handleOpenAPI(w http.ResponseWriter,
+	_ *http.Request) {
+	spec, err := GenerateOpenAPISpec()
+	if err != nil {
+		http.Error(w, "failed to generate OpenAPI specification: "+
+			err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(spec)
+}
+
+// openAPIJSONContent returns the content of a JSON request or response
+// body with a schema.
+func openAPIJSONContent(schema any) openAPIObject {
+	return openAPIObject{
+		"application/json": openAPIObject{"schema": schema},
+	}
+}
+
+// openAPISubscribePath returns the description of the subscription path.
+func openAPISubscribePath() openAPIObject {
+	list := openAPIObject{"type": "string"}
+	query := func(name string, description string, schema any) any {
+		return openAPIObject{
+			"name":        name,
+			"in":          "query",
+			"description": description,
+			"schema":      schema,
+		}
+	}
+	return openAPIObject{
+		"get": openAPIObject{
+			"operationId": "subscribe",
+			"summary": "Stream updates to metrics and the state of " +
+				"Responders as Server-Sent Events.",
+			"parameters": []any{
+				query("types", "Comma-separated types of update to send "+
+					"(all if omitted).", list),
+				query("monitors", "Comma-separated monitors to include "+
+					"(all if omitted).", list),
+				query("responders", "Comma-separated Responders to "+
+					"include (all if omitted).", list),
+				query("interval-ms", "Interval at which the services are "+
+					"polled for updates.", openAPIObject{
+					"type":    "integer",
+					"minimum": MinSubscribeInterval,
+					"default": DefaultSubscribeInterval,
+				}),
+				query("key", "API key, if not given in a header.", list),
+			},
+			"responses": openAPIObject{
+				"200": openAPIObject{
+					"description": "A stream of events, each named by " +
+						"its type with the update as JSON data.",
+					"content": openAPIObject{
+						"text/event-stream": openAPIObject{
+							"schema": openAPIObject{"type": "string"},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// openAPIMetricsPath returns the description of the Prometheus endpoint.
+func openAPIMetricsPath() openAPIObject {
+	return openAPIObject{
+		"get": openAPIObject{
+			"operationId": "metrics",
+			"summary": "Show the internal metrics of the Agent in the " +
+				"Prometheus text exposition format.",
+			"responses": openAPIObject{
+				"200": openAPIObject{
+					"description": "The metrics of the Agent.",
+					"content": openAPIObject{
+						"text/plain": openAPIObject{
+							"schema": openAPIObject{"type": "string"},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// #######################################################################
+// Generator
+// #######################################################################
+
+// openAPIGenerator builds the schemas of the types used by the API, each
+// named struct type becoming a component referenced wherever it is used.
+type openAPIGenerator struct {
+	schemas openAPIObject
+}
+
+var (
+	openAPITimeType = reflect.TypeOf(time.Time{})
+	openAPIRawType  = reflect.TypeOf(json.RawMessage{})
+)
+
+// schemaFor returns the schema of a type, or a reference to it.
+func (gen *openAPIGenerator) schemaFor(t reflect.Type) (schema any) {
+	switch t {
+	case openAPITimeType:
+		return openAPIObject{"type": "string", "format": "date-time"}
+	case openAPIRawType:
+		return openAPIObject{}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return gen.schemaFor(t.Elem())
+	case reflect.Struct:
+		if t.Name() == "" {
+			return gen.objectSchema(t)
+		}
+		ref := openAPIObject{"$ref": "#/components/schemas/" + t.Name()}
+		if _, exists := gen.schemas[t.Name()]; !exists {
+			// The entry is reserved first, so that a type which refers
+			// to itself does not recurse endlessly.
+			gen.schemas[t.Name()] = openAPIObject{}
+			gen.schemas[t.Name()] = gen.objectSchema(t)
+		}
+		return ref
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return openAPIObject{"type": "string", "format": "byte"}
+		}
+		return openAPIObject{"type": "array", "items": gen.schemaFor(t.Elem())}
+	case reflect.Map:
+		return openAPIObject{
+			"type":                 "object",
+			"additionalProperties": gen.schemaFor(t.Elem()),
+		}
+	case reflect.String:
+		return openAPIObject{"type": "string"}
+	case reflect.Bool:
+		return openAPIObject{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return openAPIObject{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return openAPIObject{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return openAPIObject{"type": "number"}
+	}
+	// Any other type (e.g. an interface) may hold any JSON value.
+	return openAPIObject{}
+}
+
+// objectSchema returns the schema of a struct type from its JSON fields,
+// including those of any embedded structs.
+func (gen *openAPIGenerator) objectSchema(t reflect.Type) openAPIObject {
+	properties := openAPIObject{}
+	gen.addProperties(t, properties)
+	return openAPIObject{"type": "object", "properties": properties}
+}
+
+func (gen *openAPIGenerator) addProperties(t reflect.Type,
+	properties openAPIObject) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" || (!field.IsExported() && !field.Anonymous) {
+			continue
+		}
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Pointer {
+			fieldType = fieldType.Elem()
+		}
+		if field.Anonymous && name == "" && fieldType.Kind() == reflect.Struct {
+			gen.addProperties(fieldType, properties)
+			continue
+		} else if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = gen.schemaFor(field.Type)
+	}
+}
+
+// describeActions adds the actions and types of the JSON action tree to
+// the schema of the API request.
+func (gen *openAPIGenerator) describeActions() {
+	request, ok := gen.schemas["APIRequest"].(openAPIObject)
+	if !ok {
+		return
+	}
+	properties := request["properties"].(openAPIObject)
+	var actions, types []string
+	seen := make(map[string]bool)
+	for _, cmd := range CLICommands {
+		if cmd.Local {
+			continue
+		}
+		actions = append(actions, cmd.Action)
+		for _, name := range cmd.TypeNames() {
+			if !seen[name] {
+				seen[name] = true
+				types = append(types, name)
+			}
+		}
+	}
+	sort.Strings(types)
+	properties["action"] = openAPIObject{"type": "string", "enum": actions}
+	properties["type"] = openAPIObject{
+		"type": "string",
+		"enum": types,
+		"description": "Type to which the action applies, as listed for " +
+			"each action in the description of the JSON API.",
+	}
+}
+
+// openAPIActionTreeDescription describes the actions of the JSON action
+// tree and the types to which each applies.
+func openAPIActionTreeDescription() string {
+	var b strings.Builder
+	b.WriteString("Performs the action given in the request on the type " +
+		"given, authenticated by the API key within it. The actions and " +
+		"their types are:\n\n")
+	for _, cmd := range CLICommands {
+		if cmd.Local {
+			continue
+		}
+		b.WriteString("- `" + cmd.Action + "`")
+		if len(cmd.Types) > 0 {
+			b.WriteString(" (" + strings.Join(cmd.TypeNames(), ", ") + ")")
+		}
+		b.WriteString(": " + cmd.Summary + "\n")
+	}
+	return b.String()
+}
+
+// addRoute adds a REST-style route to the paths of the specification.
+func (gen *openAPIGenerator) addRoute(paths openAPIObject, route restRoute,
+	requestRef any, responseRef any) {
+	operationID := strings.ToLower(route.method)
+	var parameters []any
+	for _, segment := range strings.Split(strings.Trim(route.pattern, "/"),
+		"/") {
+		name := strings.Trim(segment, "{}")
+		if name != segment {
+			schema := openAPIObject{"type": "string"}
+			if enum := restActionNames(route.pattern); name == "action" &&
+				enum != nil {
+				schema["enum"] = enum
+			}
+			parameters = append(parameters, openAPIObject{
+				"name":     name,
+				"in":       "path",
+				"required": true,
+				"schema":   schema,
+			})
+		}
+		if name != "" {
+			operationID += strings.ToUpper(name[:1]) + name[1:]
+		}
+	}
+	resultRef := responseRef
+	if route.result != nil {
+		resultRef = gen.schemaFor(reflect.TypeOf(route.result))
+	}
+	responses := openAPIObject{
+		"default": openAPIObject{
+			"description": "The request failed, as described by the " +
+				"response.",
+			"content": openAPIJSONContent(responseRef),
+		},
+	}
+	if route.method == http.MethodDelete {
+		responses["204"] = openAPIObject{"description": "Deleted."}
+	} else {
+		responses["200"] = openAPIObject{
+			"description": "Succeeded.",
+			"content":     openAPIJSONContent(resultRef),
+		}
+	}
+	if route.method == http.MethodPut && route.result != nil {
+		responses["201"] = openAPIObject{
+			"description": "Created.",
+			"content":     openAPIJSONContent(resultRef),
+		}
+	}
+	operation := openAPIObject{
+		"operationId": operationID,
+		"summary":     route.summary,
+		"responses":   responses,
+	}
+	if parameters != nil {
+		operation["parameters"] = parameters
+	}
+	if route.method == http.MethodPut || route.method == http.MethodPatch ||
+		route.method == http.MethodPost {
+		operation["requestBody"] = openAPIObject{
+			"description": "Settings for the request, as in the JSON API.",
+			"content":     openAPIJSONContent(requestRef),
+		}
+	}
+	path, exists := paths[route.pattern].(openAPIObject)
+	if !exists {
+		path = openAPIObject{}
+		paths[route.pattern] = path
+	}
+	path[strings.ToLower(route.method)] = operation
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
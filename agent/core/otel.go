@@ -0,0 +1,507 @@
+// otel.go
+// Export of Traces and Metrics to OpenTelemetry
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The agent can export to an OpenTelemetry collector (or any backend which
+// accepts OTLP over HTTP), so that changes in the weights reported by the
+// agent can be correlated with traces from the applications on the same
+// host. Spans are recorded for each API request and each feedback
+// response, and at each interval the latest value of each monitor, the
+// availability of each Responder and their request counts are exported as
+// metrics. These are sent in the OTLP/HTTP JSON encoding to the '/v1/traces'
+// and '/v1/metrics' paths of the configured endpoint, so that no OTel SDK
+// is required.
+
+const (
+	// Default and minimum intervals between exports.
+	DefaultOTelInterval = 10 * time.Second
+	MinOTelInterval     = time.Second
+	// Default service name given to the exported resource.
+	DefaultOTelServiceName = "lbfeedback"
+	// Time allowed for each export request.
+	OTelExportTimeout = 10 * time.Second
+	// Largest number of spans held between exports; further spans are
+	// dropped until the next export.
+	MaxOTelBufferedSpans = 4096
+	// Paths of the OTLP/HTTP endpoints for traces and metrics.
+	OTelTracesPath  = "/v1/traces"
+	OTelMetricsPath = "/v1/metrics"
+)
+
+// Kinds and status codes of spans, as defined by OTLP.
+const (
+	otelSpanKindServer = 2
+	otelStatusOK       = 1
+	otelStatusError    = 2
+)
+
+// OTelConfig holds the settings for exporting to OpenTelemetry, which is
+// enabled if these settings are present in the config. The endpoint is
+// the base URL of the OTLP/HTTP receiver (e.g. 'http://collector:4318');
+// it and the values of any headers (e.g. for authentication) may contain
+// secret references, as for the API key.
+type OTelConfig struct {
+	Endpoint    string            `json:"endpoint"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	ServiceName string            `json:"service-name,omitempty"`
+	Interval    Duration          `json:"interval,omitempty"`
+}
+
+// Validate checks the OpenTelemetry settings, returning the resolved
+// endpoint and headers.
+func (config *OTelConfig) Validate() (endpoint string,
+	headers map[string]string, err error) {
+	endpoint, err = ResolveSecret(config.Endpoint)
+	if err != nil {
+		err = errors.New("cannot resolve OpenTelemetry endpoint: " +
+			err.Error())
+		return
+	}
+	parsed, err := url.Parse(endpoint)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") ||
+		parsed.Host == "" {
+		err = errors.New("OpenTelemetry endpoint must be an absolute " +
+			"HTTP(S) URL")
+		return
+	}
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	if config.Interval != 0 && time.Duration(config.Interval) <
+		MinOTelInterval {
+		err = errors.New("OpenTelemetry interval must be at least " +
+			MinOTelInterval.String())
+		return
+	}
+	headers = make(map[string]string)
+	for name, value := range config.Headers {
+		headers[name], err = ResolveSecret(value)
+		if err != nil {
+			err = errors.New("cannot resolve OpenTelemetry header '" +
+				name + "': " + err.Error())
+			return
+		}
+	}
+	return
+}
+
+// #######################################################################
+// Spans
+// #######################################################################
+
+// otelSpan is a span being recorded; all of its methods do nothing if it
+// is nil, which is the case when exporting is disabled.
+type otelSpan struct {
+	exporter   *OTelExporter
+	name       string
+	kind       int
+	start      time.Time
+	attributes []otelAttribute
+}
+
+// otelAttribute is an attribute of a span, metric point or resource.
+type otelAttribute struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+// newOTelAttribute returns an attribute with a string, integer, float or
+// boolean value.
+func newOTelAttribute(key string, value any) (attribute otelAttribute) {
+	attribute.Key = key
+	switch typed := value.(type) {
+	case int:
+		// Integers are encoded as strings, as for all 64-bit values.
+		attribute.Value = map[string]any{"intValue": strconv.Itoa(typed)}
+	case float64:
+		attribute.Value = map[string]any{"doubleValue": typed}
+	case bool:
+		attribute.Value = map[string]any{"boolValue": typed}
+	default:
+		attribute.Value = map[string]any{"stringValue": typed}
+	}
+	return
+}
+
+// startSpan starts recording a span, returning nil if exporting is
+// disabled.
+func (agent *FeedbackAgent) startSpan(name string, kind int) *otelSpan {
+	if agent == nil || agent.otel == nil {
+		return nil
+	}
+	exporter := agent.otel.Load()
+	if exporter == nil {
+		return nil
+	}
+	return &otelSpan{
+		exporter: exporter,
+		name:     name,
+		kind:     kind,
+		start:    time.Now(),
+	}
+}
+
+// setName changes the name of the span.
+func (span *otelSpan) setName(name string) {
+	if span != nil {
+		span.name = name
+	}
+}
+
+// setAttribute adds an attribute to the span.
+func (span *otelSpan) setAttribute(key string, value any) {
+	if span != nil {
+		span.attributes = append(span.attributes,
+			newOTelAttribute(key, value))
+	}
+}
+
+// end completes the span, with an error status if an error is given, and
+// queues it for export.
+func (span *otelSpan) end(err error) {
+	if span == nil {
+		return
+	}
+	traceID := make([]byte, 16)
+	spanID := make([]byte, 8)
+	_, _ = rand.Read(traceID)
+	_, _ = rand.Read(spanID)
+	status := map[string]any{"code": otelStatusOK}
+	if err != nil {
+		status = map[string]any{"code": otelStatusError,
+			"message": err.Error()}
+	}
+	span.exporter.queueSpan(map[string]any{
+		"traceId":           hex.EncodeToString(traceID),
+		"spanId":            hex.EncodeToString(spanID),
+		"name":              span.name,
+		"kind":              span.kind,
+		"startTimeUnixNano": strconv.FormatInt(span.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(time.Now().UnixNano(), 10),
+		"attributes":        span.attributes,
+		"status":            status,
+	})
+}
+
+// #######################################################################
+// Exporter
+// #######################################################################
+
+// OTelExporter sends spans and metrics to an OTLP/HTTP endpoint at a
+// regular interval.
+type OTelExporter struct {
+	config   OTelConfig
+	agent    *FeedbackAgent
+	endpoint string
+	headers  map[string]string
+	interval time.Duration
+	resource map[string]any
+	scope    map[string]any
+	client   *http.Client
+	cancel   context.CancelFunc
+	spans    []map[string]any
+	dropped  int
+	mutex    sync.Mutex
+	// Whether the last export failed, so that only changes are logged.
+	failing bool
+}
+
+// StartOTelExporter validates the OpenTelemetry settings and starts
+// exporting.
+func (agent *FeedbackAgent) StartOTelExporter(config OTelConfig) (
+	exporter *OTelExporter, err error) {
+	endpoint, headers, err := config.Validate()
+	if err != nil {
+		return
+	}
+	interval := time.Duration(config.Interval)
+	if interval == 0 {
+		interval = DefaultOTelInterval
+	}
+	serviceName := config.ServiceName
+	if serviceName == "" {
+		serviceName = DefaultOTelServiceName
+	}
+	host, _ := os.Hostname()
+	resourceAttributes := []otelAttribute{
+		newOTelAttribute("service.name", serviceName),
+		newOTelAttribute("service.version", VersionString),
+		newOTelAttribute("host.name", host),
+	}
+	if agent.options.Instance != "" {
+		resourceAttributes = append(resourceAttributes,
+			newOTelAttribute("service.instance.id", agent.options.Instance))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	exporter = &OTelExporter{
+		config:   config,
+		agent:    agent,
+		endpoint: endpoint,
+		headers:  headers,
+		interval: interval,
+		resource: map[string]any{"attributes": resourceAttributes},
+		scope: map[string]any{
+			"name":    AppIdentifier,
+			"version": VersionString,
+		},
+		client: &http.Client{Timeout: OTelExportTimeout},
+		cancel: cancel,
+	}
+	go exporter.run(ctx)
+	logrus.Info("Exporting to OpenTelemetry every " +
+		exporter.interval.String() + ".")
+	return
+}
+
+// Stop stops exporting; any spans not yet exported are discarded.
+func (exporter *OTelExporter) Stop() {
+	exporter.cancel()
+}
+
+// queueSpan adds a completed span to those awaiting export.
+func (exporter *OTelExporter) queueSpan(span map[string]any) {
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+	if len(exporter.spans) >= MaxOTelBufferedSpans {
+		exporter.dropped++
+		return
+	}
+	exporter.spans = append(exporter.spans, span)
+}
+
+// run exports at the configured interval until cancelled.
+func (exporter *OTelExporter) run(ctx context.Context) {
+	ticker := time.NewTicker(exporter.interval)
+	defer ticker.Stop()
+	start := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		exporter.mutex.Lock()
+		spans, dropped := exporter.spans, exporter.dropped
+		exporter.spans, exporter.dropped = nil, 0
+		exporter.mutex.Unlock()
+		if dropped > 0 {
+			logrus.Warn("Dropped " + strconv.Itoa(dropped) + " OpenTelemetry " +
+				"spans, as too many were recorded between exports.")
+		}
+		var err error
+		if len(spans) > 0 {
+			err = exporter.post(ctx, OTelTracesPath, map[string]any{
+				"resourceSpans": []any{map[string]any{
+					"resource": exporter.resource,
+					"scopeSpans": []any{map[string]any{
+						"scope": exporter.scope,
+						"spans": spans,
+					}},
+				}},
+			})
+		}
+		err = errors.Join(err, exporter.post(ctx, OTelMetricsPath,
+			map[string]any{
+				"resourceMetrics": []any{map[string]any{
+					"resource": exporter.resource,
+					"scopeMetrics": []any{map[string]any{
+						"scope":   exporter.scope,
+						"metrics": exporter.collectMetrics(start),
+					}},
+				}},
+			}))
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil && !exporter.failing {
+			logrus.Warn("Failed to export to OpenTelemetry: " + err.Error())
+		} else if err == nil && exporter.failing {
+			logrus.Info("Exporting to OpenTelemetry successfully again.")
+		}
+		exporter.failing = err != nil
+	}
+}
+
+// collectMetrics returns the current metrics of the agent in OTLP form;
+// the request counts are cumulative since the exporter started.
+func (exporter *OTelExporter) collectMetrics(start time.Time) []any {
+	agent := exporter.agent
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	startTime := strconv.FormatInt(start.UnixNano(), 10)
+	var values, availability, requests []any
+	monitors, responders := agent.servicesSnapshot()
+	for _, name := range sortedKeys(monitors) {
+		monitor := monitors[name]
+		value, at := monitor.latestSample()
+		if at.IsZero() {
+			continue
+		}
+		values = append(values, map[string]any{
+			"attributes": []otelAttribute{
+				newOTelAttribute("monitor", name),
+				newOTelAttribute("metric_type", monitor.MetricType),
+			},
+			"timeUnixNano": strconv.FormatInt(at.UnixNano(), 10),
+			"asInt":        strconv.FormatInt(value, 10),
+		})
+	}
+	stats := agent.GetAgentStats()
+	for _, name := range sortedKeys(responders) {
+		responder := responders[name]
+		attributes := []otelAttribute{newOTelAttribute("responder", name)}
+		requests = append(requests, map[string]any{
+			"attributes":        attributes,
+			"startTimeUnixNano": startTime,
+			"timeUnixNano":      now,
+			"asInt": strconv.FormatUint(
+				stats.Responders[name].Requests, 10),
+		})
+		if responder.IsAPI() {
+			continue
+		}
+		score, _, _ := responder.getFeedbackState()
+		availability = append(availability, map[string]any{
+			"attributes":   attributes,
+			"timeUnixNano": now,
+			"asInt":        strconv.Itoa(score),
+		})
+	}
+	gauge := func(name string, description string, unit string,
+		points []any) map[string]any {
+		return map[string]any{
+			"name":        name,
+			"description": description,
+			"unit":        unit,
+			"gauge":       map[string]any{"dataPoints": points},
+		}
+	}
+	return []any{
+		gauge("lbfeedback.monitor.value",
+			"Latest value sampled by each monitor.", "1", values),
+		gauge("lbfeedback.responder.availability",
+			"Availability score reported by each Responder.", "%",
+			availability),
+		map[string]any{
+			"name":        "lbfeedback.responder.requests",
+			"description": "Requests answered by each Responder.",
+			"unit":        "{request}",
+			"sum": map[string]any{
+				// Cumulative temporality.
+				"aggregationTemporality": 2,
+				"isMonotonic":            true,
+				"dataPoints":             requests,
+			},
+		},
+	}
+}
+
+// post sends an OTLP request body as JSON to a path of the endpoint.
+func (exporter *OTelExporter) post(ctx context.Context, path string,
+	body map[string]any) (err error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		exporter.endpoint+path, bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", AppIdentifier+"/"+VersionString)
+	for name, value := range exporter.headers {
+		request.Header.Set(name, value)
+	}
+	response, err := exporter.client.Do(request)
+	if err != nil {
+		return
+	}
+	_, _ = io.Copy(io.Discard, response.Body)
+	_ = response.Body.Close()
+	if response.StatusCode >= 300 {
+		err = errors.New(path + ": HTTP status " + response.Status)
+	}
+	return
+}
+
+// UpdateOTelExporter starts, restarts or stops exporting to OpenTelemetry
+// according to the opentelemetry setting of the agent.
+func (agent *FeedbackAgent) UpdateOTelExporter() {
+	if agent.otel == nil {
+		return
+	}
+	current := agent.otel.Load()
+	if current != nil {
+		if agent.OTel != nil && reflect.DeepEqual(current.config, *agent.OTel) {
+			return
+		}
+		agent.otel.Store(nil)
+		current.Stop()
+		if agent.OTel == nil {
+			logrus.Info("Stopped exporting to OpenTelemetry.")
+			return
+		}
+	}
+	if agent.OTel == nil {
+		return
+	}
+	exporter, err := agent.StartOTelExporter(*agent.OTel)
+	if err != nil {
+		logrus.Error("Failed to start exporting to OpenTelemetry: " +
+			err.Error())
+		return
+	}
+	agent.otel.Store(exporter)
+}
+
+// StopOTelExporter stops exporting to OpenTelemetry when the agent shuts
+// down, leaving the opentelemetry setting unchanged.
+func (agent *FeedbackAgent) StopOTelExporter() {
+	if agent.otel == nil {
+		return
+	}
+	if current := agent.otel.Swap(nil); current != nil {
+		current.Stop()
+		logrus.Info("Stopped exporting to OpenTelemetry.")
+	}
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,604 @@
+// output.go
+// Machine-Readable Output Formats for the CLI Client
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode"
+)
+
+// By default, the CLI client prints the banner, the response from the
+// agent as indented JSON and a summary of the outcome. For scripts, the
+// '-output' flag instead selects one of the formats below, in which only
+// the response is written to stdout:
+//
+//   - json: the response as indented JSON, without the request.
+//   - yaml: the same as YAML, with the fields in the same order.
+//   - table: the content of the response as a table with a header row, or
+//     a key/value table for a single object. The service status is shown
+//     as the same summary table given by 'status' without an output flag.
+//   - raw: the JSON exactly as received from the agent.
+//
+// Errors in the client are reported in a response of the same form for
+// json and yaml, with the 'error-name' 'client-error' or 'connection-error';
+// for table and raw, they are written to stderr. Whatever the format, the
+// exit status of the client is one of those below.
+
+const (
+	OutputFormatJSON  = "json"
+	OutputFormatYAML  = "yaml"
+	OutputFormatTable = "table"
+	OutputFormatRaw   = "raw"
+)
+
+const (
+	// Exit status if the agent reported that the request failed.
+	ExitStatusFailed = 2
+	// Exit status if the agent could not be reached.
+	ExitStatusUnreachable = 3
+)
+
+// Fields of the API response which describe the response itself rather
+// than its content, and so are omitted from tables.
+var responseEnvelopeFields = map[string]bool{
+	"service": true, "version": true, "id": true, "tag": true,
+	"request": true, "success": true, "error-name": true, "message": true,
+	"etag": true, "not-modified": true, "config-diverged": true,
+}
+
+// UnreachableError is returned by the CLI client if the agent could not
+// be reached.
+type UnreachableError struct {
+	Err error
+}
+
+func (err *UnreachableError) Error() string {
+	return err.Err.Error() + "\nThe CLI Client failed to establish " +
+		"an HTTP connection to the Agent." +
+		"\nPlease check that the Agent is running and able to " +
+		"accept API requests"
+}
+
+func (err *UnreachableError) Unwrap() error {
+	return err.Err
+}
+
+// ParseOutputFormat validates the name of a CLI output format.
+func ParseOutputFormat(format string) (parsed string, err error) {
+	parsed = strings.ToLower(strings.TrimSpace(format))
+	switch parsed {
+	case OutputFormatJSON, OutputFormatYAML, OutputFormatTable,
+		OutputFormatRaw:
+	default:
+		err = errors.New("invalid output format '" + format + "'")
+	}
+	return
+}
+
+// findCLIOutputFormat returns the value of the output flag in CLI
+// arguments, if any, which is required before they are parsed so that
+// the banner can be omitted.
+func findCLIOutputFormat(args []string) string {
+	for i, arg := range args {
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name != FlagOutput {
+			continue
+		}
+		if hasValue {
+			return value
+		}
+		if i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// CLIExitStatus returns the exit status of the CLI client for the outcome
+// of a request.
+func CLIExitStatus(response *APIResponse, err error) int {
+	var unreachable *UnreachableError
+	switch {
+	case errors.As(err, &unreachable):
+		return ExitStatusUnreachable
+	case err != nil:
+		return ExitStatusError
+	case response == nil || !response.Success:
+		return ExitStatusFailed
+	}
+	return ExitStatusNormal
+}
+
+// WriteCLIOutput writes the outcome of a request in an output format,
+// writing errors to the error writer where the format has no place for
+// them. The raw JSON received is used for the raw format, if available.
+func WriteCLIOutput(stdout io.Writer, stderr io.Writer, format string,
+	response *APIResponse, responseJSON string, err error) {
+	if err != nil {
+		if format != OutputFormatJSON && format != OutputFormatYAML {
+			_, _ = io.WriteString(stderr, "Error: "+err.Error()+".\n")
+			return
+		}
+		response = &APIResponse{
+			APIName: AppIdentifier,
+			Version: VersionString,
+			Error:   "client-error",
+			Message: err.Error(),
+		}
+		var unreachable *UnreachableError
+		if errors.As(err, &unreachable) {
+			response.Error = "connection-error"
+			response.Message = unreachable.Err.Error()
+		}
+		responseJSON = ""
+	}
+	response.Request = nil
+	response.ID = nil
+	if format == OutputFormatRaw && responseJSON != "" {
+		_, _ = io.WriteString(stdout, strings.TrimSpace(responseJSON)+"\n")
+		return
+	}
+	responseBytes, err := json.MarshalIndent(response, "", "    ")
+	if err != nil {
+		_, _ = io.WriteString(stderr, "Error: Failed to format response: "+
+			err.Error()+".\n")
+		return
+	}
+	switch format {
+	case OutputFormatJSON, OutputFormatRaw:
+		_, _ = stdout.Write(append(responseBytes, '\n'))
+		return
+	}
+	value, err := decodeOrderedJSON(responseBytes)
+	if err != nil {
+		_, _ = io.WriteString(stderr, "Error: Failed to format response: "+
+			err.Error()+".\n")
+		return
+	}
+	if format == OutputFormatYAML {
+		var b strings.Builder
+		writeYAML(&b, value, 0)
+		_, _ = io.WriteString(stdout, b.String())
+		return
+	}
+	if !response.Success {
+		_, _ = io.WriteString(stderr, "Error: "+response.Message+".\n")
+		return
+	}
+	if response.ServiceStatus != nil {
+		writeStatusTable(stdout, response.ServiceStatus)
+		return
+	}
+	writeResponseTables(stdout, value.(orderedObject), response.Message)
+}
+
+// #######################################################################
+// Ordered JSON
+// #######################################################################
+
+// orderedObject is a JSON object decoded with its fields in order, so
+// that the output follows the order of the API schema.
+type orderedObject []orderedField
+
+type orderedField struct {
+	key   string
+	value any
+}
+
+// decodeOrderedJSON decodes JSON into values of the types orderedObject,
+// []any, string, json.Number, bool or nil.
+func decodeOrderedJSON(data []byte) (value any, err error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decodeOrderedValue(decoder)
+}
+
+func decodeOrderedValue(decoder *json.Decoder) (value any, err error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return
+	}
+	delim, isDelim := token.(json.Delim)
+	if !isDelim {
+		return token, nil
+	}
+	switch delim {
+	case '{':
+		object := orderedObject{}
+		for decoder.More() {
+			var keyToken json.Token
+			keyToken, err = decoder.Token()
+			if err != nil {
+				return
+			}
+			var fieldValue any
+			fieldValue, err = decodeOrderedValue(decoder)
+			if err != nil {
+				return
+			}
+			object = append(object, orderedField{keyToken.(string), fieldValue})
+		}
+		value = object
+	case '[':
+		array := []any{}
+		for decoder.More() {
+			var item any
+			item, err = decodeOrderedValue(decoder)
+			if err != nil {
+				return
+			}
+			array = append(array, item)
+		}
+		value = array
+	}
+	// Consume the closing delimiter.
+	_, err = decoder.Token()
+	return
+}
+
+// formatScalar formats a decoded JSON scalar as text, or any other value
+// as compact JSON.
+func formatScalar(value any) string {
+	switch typed := value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return typed
+	case json.Number:
+		return typed.String()
+	case bool:
+		return strconv.FormatBool(typed)
+	case orderedObject:
+		parts := make([]string, len(typed))
+		for i, field := range typed {
+			parts[i] = strconv.Quote(field.key) + ":" + formatJSONValue(field.value)
+		}
+		return "{" + strings.Join(parts, ",") + "}"
+	case []any:
+		parts := make([]string, len(typed))
+		for i, item := range typed {
+			parts[i] = formatJSONValue(item)
+		}
+		return "[" + strings.Join(parts, ",") + "]"
+	}
+	return ""
+}
+
+// formatJSONValue formats a decoded JSON value as compact JSON.
+func formatJSONValue(value any) string {
+	if text, isString := value.(string); isString {
+		return strconv.Quote(text)
+	}
+	return formatScalar(value)
+}
+
+// isScalar returns whether a decoded JSON value is neither an object nor
+// an array.
+func isScalar(value any) bool {
+	switch value.(type) {
+	case orderedObject, []any:
+		return false
+	}
+	return true
+}
+
+// #######################################################################
+// YAML
+// #######################################################################
+
+// writeYAML writes a decoded JSON value as YAML at an indentation level.
+func writeYAML(b *strings.Builder, value any, indent int) {
+	pad := strings.Repeat(" ", indent)
+	switch typed := value.(type) {
+	case orderedObject:
+		if len(typed) == 0 {
+			b.WriteString(pad + "{}\n")
+		}
+		for _, field := range typed {
+			b.WriteString(pad + yamlString(field.key) + ":")
+			writeYAMLChild(b, field.value, indent+2)
+		}
+	case []any:
+		if len(typed) == 0 {
+			b.WriteString(pad + "[]\n")
+		}
+		for _, item := range typed {
+			if isScalar(item) || isEmptyCollection(item) {
+				b.WriteString(pad + "-")
+				writeYAMLChild(b, item, indent+2)
+				continue
+			}
+			// The first line of a collection follows the dash.
+			var child strings.Builder
+			writeYAML(&child, item, indent+2)
+			b.WriteString(pad + "- " + child.String()[indent+2:])
+		}
+	default:
+		b.WriteString(pad + yamlScalar(value) + "\n")
+	}
+}
+
+// writeYAMLChild writes the value of a field or list item, following the
+// key or dash if it is a scalar or an empty collection, or otherwise on
+// the lines after it.
+func writeYAMLChild(b *strings.Builder, value any, indent int) {
+	switch {
+	case isScalar(value):
+		b.WriteString(" " + yamlScalar(value) + "\n")
+	case isEmptyCollection(value):
+		b.WriteString(" " + formatScalar(value) + "\n")
+	default:
+		b.WriteString("\n")
+		writeYAML(b, value, indent)
+	}
+}
+
+func isEmptyCollection(value any) bool {
+	switch typed := value.(type) {
+	case orderedObject:
+		return len(typed) == 0
+	case []any:
+		return len(typed) == 0
+	}
+	return false
+}
+
+// yamlScalar formats a decoded JSON scalar as YAML.
+func yamlScalar(value any) string {
+	if text, isString := value.(string); isString {
+		return yamlString(text)
+	}
+	return formatScalar(value)
+}
+
+// yamlString formats a string as YAML, quoting it unless it is a simple
+// word or phrase which cannot be read as any other type.
+func yamlString(text string) string {
+	plain := text != "" && unicode.IsLetter(rune(text[0])) &&
+		!strings.HasSuffix(text, " ")
+	for _, r := range text {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) &&
+			!strings.ContainsRune(" -_./@", r) {
+			plain = false
+			break
+		}
+	}
+	switch strings.ToLower(text) {
+	case "true", "false", "yes", "no", "on", "off", "y", "n", "null":
+		plain = false
+	}
+	if plain {
+		return text
+	}
+	return strconv.Quote(text)
+}
+
+// #######################################################################
+// Tables
+// #######################################################################
+
+// writeResponseTables writes the content of a response as tables, each
+// headed by the name of its field if there are several, or the message of
+// the response if it has no content.
+func writeResponseTables(w io.Writer, response orderedObject,
+	message string) {
+	var content orderedObject
+	for _, field := range response {
+		if !responseEnvelopeFields[field.key] {
+			content = append(content, field)
+		}
+	}
+	if len(content) == 0 {
+		_, _ = io.WriteString(w, message+"\n")
+		return
+	}
+	for i, field := range content {
+		if len(content) > 1 {
+			if i > 0 {
+				_, _ = io.WriteString(w, "\n")
+			}
+			_, _ = io.WriteString(w, strings.ToUpper(field.key)+":\n")
+		}
+		writeTable(w, field.value)
+	}
+}
+
+// writeTable writes a decoded JSON value as a table: a list of objects
+// with a column for each field, a map of objects with a name column
+// followed by a column for each field, or otherwise a key/value table of
+// the fields of an object, flattened into dotted paths.
+func writeTable(w io.Writer, value any) {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	defer table.Flush()
+	writeRow := func(cells []string) {
+		_, _ = io.WriteString(table, strings.Join(cells, "\t")+"\n")
+	}
+	var rows []orderedObject
+	var names []string
+	switch typed := value.(type) {
+	case []any:
+		for _, item := range typed {
+			object, isObject := item.(orderedObject)
+			if !isObject {
+				writeRow([]string{formatScalar(item)})
+				continue
+			}
+			rows = append(rows, flattenObject(object, ""))
+		}
+	case orderedObject:
+		for _, field := range typed {
+			object, isObject := field.value.(orderedObject)
+			if !isObject {
+				rows = nil
+				break
+			}
+			names = append(names, field.key)
+			rows = append(rows, flattenObject(object, ""))
+		}
+		if rows == nil {
+			writeRow([]string{"KEY", "VALUE"})
+			for _, field := range flattenObject(typed, "") {
+				writeRow([]string{field.key, formatScalar(field.value)})
+			}
+			return
+		}
+	default:
+		writeRow([]string{formatScalar(value)})
+		return
+	}
+	if len(rows) == 0 {
+		return
+	}
+	// The columns are the fields of all of the rows, in the order first
+	// seen.
+	var columns []string
+	seen := make(map[string]bool)
+	for _, row := range rows {
+		for _, field := range row {
+			if !seen[field.key] {
+				seen[field.key] = true
+				columns = append(columns, field.key)
+			}
+		}
+	}
+	var header []string
+	if names != nil {
+		header = append(header, "NAME")
+	}
+	for _, column := range columns {
+		header = append(header, strings.ToUpper(column))
+	}
+	writeRow(header)
+	for i, row := range rows {
+		values := make(map[string]string)
+		for _, field := range row {
+			values[field.key] = formatScalar(field.value)
+		}
+		var cells []string
+		if names != nil {
+			cells = append(cells, names[i])
+		}
+		for _, column := range columns {
+			cells = append(cells, values[column])
+		}
+		writeRow(cells)
+	}
+}
+
+// writeStatusTable writes the status of services as a summary table, with
+// a row for each Responder and then each Monitor in order of name. Fields
+// which do not apply to a service, or are not yet known, are shown as '-'.
+func writeStatusTable(w io.Writer, status []APIServiceStatus) {
+	services := slices.Clone(status)
+	slices.SortStableFunc(services, func(a, b APIServiceStatus) int {
+		if a.ServiceType != b.ServiceType {
+			if a.ServiceType == "responder" {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.ServiceName, b.ServiceName)
+	})
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	defer table.Flush()
+	writeRow := func(cells ...string) {
+		_, _ = io.WriteString(table, strings.Join(cells, "\t")+"\n")
+	}
+	orNone := func(value string) string {
+		if value == "" {
+			return "-"
+		}
+		return value
+	}
+	writeRow("TYPE", "NAME", "STATUS", "ADDRESS", "UPTIME", "RESTARTS",
+		"AVAILABILITY", "STATE", "LAST SAMPLE", "VALUE", "LAST ERROR")
+	now := time.Now()
+	for _, service := range services {
+		state := service.ServiceStatus
+		if supervisor := service.Supervisor; supervisor != nil &&
+			service.ServiceStatus != "running" {
+			if supervisor.GaveUp {
+				state += " (gave up)"
+			} else if supervisor.NextRestart != nil {
+				state += " (restart in " + supervisor.NextRestart.Sub(now).
+					Round(time.Second).String() + ")"
+			}
+		}
+		if service.Stale {
+			state += " (stale)"
+		}
+		var uptime, availability, commandState, lastSample, value string
+		if service.UptimeSeconds > 0 {
+			uptime = (time.Duration(service.UptimeSeconds) *
+				time.Second).String()
+		}
+		if service.Availability != nil {
+			availability = strconv.Itoa(*service.Availability) + "%"
+		}
+		if service.CommandState != "" {
+			commandState = service.CommandState
+			if service.Forced {
+				commandState += " (forced)"
+			}
+		}
+		if service.LastSample != nil {
+			lastSample = now.Sub(*service.LastSample).Round(time.Second).
+				String() + " ago"
+		}
+		if service.LastValue != nil {
+			value = strconv.FormatInt(*service.LastValue, 10)
+		}
+		writeRow(service.ServiceType, service.ServiceName, state,
+			orNone(service.Address), orNone(uptime),
+			strconv.Itoa(service.RestartCount), orNone(availability),
+			orNone(commandState), orNone(lastSample), orNone(value),
+			orNone(service.LastError))
+	}
+}
+
+// flattenObject flattens the nested objects within an object into fields
+// with dotted paths; lists are left as values.
+func flattenObject(object orderedObject, prefix string) (
+	flattened orderedObject) {
+	for _, field := range object {
+		if nested, isObject := field.value.(orderedObject); isObject &&
+			len(nested) > 0 {
+			flattened = append(flattened,
+				flattenObject(nested, prefix+field.key+".")...)
+			continue
+		}
+		flattened = append(flattened,
+			orderedField{prefix + field.key, field.value})
+	}
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,243 @@
+// overrides.go
+// Forced Command State Overrides with Scheduled Expiry
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// Forced command states (e.g. 'force maint') normally persist until they
+// are cancelled, or are interrupted by the threshold once the command
+// interval has passed (see HandleFeedback). An override may instead be
+// given a duration, for which the threshold cannot interrupt it, after
+// which it expires and the Responder returns to threshold-driven
+// behaviour. Expiry is applied when the Responder next handles a health
+// check or when the overrides are listed, so that it survives the
+// Responder being replaced by a copy of itself.
+
+// Types of event raised by forced overrides.
+const (
+	EventTypeOverrideExpired   = "override-expired"
+	EventTypeOverrideCancelled = "override-cancelled"
+)
+
+const (
+	// Maximum duration of a forced override.
+	MaxOverrideDuration = 30 * 24 * time.Hour
+)
+
+// ForcedOverride describes a forced command state which is active on a
+// Responder.
+type ForcedOverride struct {
+	Responder string     `json:"responder"`
+	State     string     `json:"state"`
+	Since     time.Time  `json:"since"`
+	Expires   *time.Time `json:"expires,omitempty"`
+	Remaining string     `json:"remaining,omitempty"`
+}
+
+// ParseOverrideDuration parses the duration of a forced override (e.g.
+// '2h'), where an empty string is no duration, so the override persists
+// until it is cancelled.
+func ParseOverrideDuration(value string) (duration time.Duration, err error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return
+	}
+	duration, err = time.ParseDuration(value)
+	if err != nil || duration <= 0 || duration > MaxOverrideDuration {
+		err = errors.New("invalid override duration '" + value +
+			"'; must be positive and at most " +
+			MaxOverrideDuration.String() + ", e.g. '2h'")
+	}
+	return
+}
+
+// overrideStateName returns the name of a forced command state, as used
+// by the 'force' and 'send' actions.
+func overrideStateName(online bool, mask int) string {
+	switch {
+	case mask&HAPEnumMaintenance&HAPMaskCommand != 0:
+		return "maint"
+	case mask&HAPEnumDrain&HAPMaskCommand != 0:
+		return "drain"
+	case online:
+		return "online"
+	}
+	return "offline"
+}
+
+// ForceCommandState forces a command state on this FeedbackResponder, which
+// expires after a duration if it is positive.
+func (fbr *FeedbackResponder) ForceCommandState(isOnline bool,
+	overrideMask int, duration time.Duration) {
+	fbr.mutex.Lock()
+	fbr.setCommandState(isOnline, true, overrideMask)
+	message := "forced state '" + overrideStateName(isOnline, overrideMask) +
+		"' has been set"
+	if duration > 0 {
+		fbr.forceExpiry = fbr.forceSince.Add(duration)
+		message += " for " + duration.String()
+	}
+	fbr.mutex.Unlock()
+	// Raise the event once the mutex is released, so that health checks
+	// are not held up by notifications.
+	fbr.raiseOverrideEvent(EventTypeStateForced, message+".")
+}
+
+// getOverride returns the forced override active on this Responder, if
+// any, after expiring it if its duration has passed. Flap tests are not
+// treated as overrides. The caller must hold the mutex.
+func (fbr *FeedbackResponder) getOverride(at time.Time) (
+	override *ForcedOverride) {
+	fbr.expireOverride(at)
+	if !fbr.forceCommandState || fbr.flapStop != nil {
+		return
+	}
+	override = &ForcedOverride{
+		Responder: fbr.ResponderName,
+		State:     overrideStateName(fbr.onlineState, fbr.overrideMask),
+		Since:     fbr.forceSince,
+	}
+	if !fbr.forceExpiry.IsZero() {
+		expires := fbr.forceExpiry
+		override.Expires = &expires
+		override.Remaining = expires.Sub(at).Round(time.Second).String()
+	}
+	return
+}
+
+// expireOverride ends the forced override on this Responder if its
+// duration has passed at a given time, returning whether it did so. The
+// caller must hold the mutex.
+func (fbr *FeedbackResponder) expireOverride(at time.Time) (expired bool) {
+	if !fbr.forceCommandState || fbr.forceExpiry.IsZero() ||
+		at.Before(fbr.forceExpiry) {
+		return
+	}
+	state := overrideStateName(fbr.onlineState, fbr.overrideMask)
+	fbr.endOverride()
+	fbr.raiseOverrideEvent(EventTypeOverrideExpired, "forced state '"+
+		state+"' has expired; returning to threshold-driven behaviour.")
+	return true
+}
+
+// CancelOverride ends the forced override on this Responder immediately,
+// returning whether there was one to cancel.
+func (fbr *FeedbackResponder) CancelOverride() (cancelled bool) {
+	fbr.mutex.Lock()
+	defer fbr.mutex.Unlock()
+	override := fbr.getOverride(time.Now())
+	if override == nil {
+		return
+	}
+	fbr.endOverride()
+	fbr.raiseOverrideEvent(EventTypeOverrideCancelled, "forced state '"+
+		override.State+"' has been cancelled; returning to "+
+		"threshold-driven behaviour.")
+	return true
+}
+
+// endOverride returns this Responder from a forced command state to the
+// state given by its threshold, or to online if it has none, sending the
+// commands for that state for the command interval. The caller must hold
+// the mutex.
+func (fbr *FeedbackResponder) endOverride() {
+	online, actionMask := true, HAPEnumNone
+	if fbr.thresholdModeEnum != ThresholdModeNone {
+		_, online, actionMask, _ = fbr.evaluateAvailability(nil)
+	}
+	fbr.setCommandState(online, false, actionMask)
+}
+
+// raiseOverrideEvent raises an informational event for a forced override.
+func (fbr *FeedbackResponder) raiseOverrideEvent(eventType string,
+	message string) {
+	if fbr.ParentAgent == nil {
+		return
+	}
+	fbr.ParentAgent.RaiseEvent(AgentEvent{
+		Type:        eventType,
+		Level:       LogLevelInfo,
+		ServiceType: "responder",
+		ServiceName: fbr.ResponderName,
+		Message:     fbr.getLogHead() + message,
+	})
+}
+
+// #######################################################################
+// API Handlers
+// #######################################################################
+
+// APIHandleGetOverrides returns the forced overrides active on a Responder,
+// or on all Responders (within a namespace, if given) if no name is given.
+func (agent *FeedbackAgent) APIHandleGetOverrides(name string,
+	namespace string) (overrides []ForcedOverride, err error) {
+	targets, err := agent.selectResponders(name, namespace)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for _, name := range sortedKeys(targets) {
+		res := targets[name]
+		res.mutex.Lock()
+		override := res.getOverride(now)
+		res.mutex.Unlock()
+		if override != nil {
+			overrides = append(overrides, *override)
+		}
+	}
+	return
+}
+
+// APIHandleCancelOverride cancels the forced override on a Responder, or
+// on all Responders (within a namespace, if given) if no name is given,
+// returning a description of the outcome.
+func (agent *FeedbackAgent) APIHandleCancelOverride(name string,
+	namespace string) (output string, err error) {
+	targets, err := agent.selectResponders(name, namespace)
+	if err != nil {
+		return
+	}
+	var cancelled []string
+	for _, name := range sortedKeys(targets) {
+		if targets[name].CancelOverride() {
+			cancelled = append(cancelled, name)
+		}
+	}
+	if len(cancelled) == 0 {
+		if strings.TrimSpace(name) != "" {
+			err = errors.New("responder '" + strings.TrimSpace(name) +
+				"' has no forced override")
+			return
+		}
+		output = "no forced overrides to cancel"
+		return
+	}
+	output = "cancelled forced override on: " + strings.Join(cancelled, ", ")
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
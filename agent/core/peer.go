@@ -0,0 +1,184 @@
+// peer.go
+// Peer Reachability Metric for Agent-to-Agent Health Checking
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// #################################
+// PeerMetric
+// #################################
+
+// PeerMetric checks that the TCP Feedback Responders of other agents (its
+// peers) can be reached and respond with feedback, reporting the
+// percentage of peers which cannot. Groups of agents on the same service
+// network can each monitor the others, so that a server which has lost
+// connectivity to the network, but whose local metrics look perfect, is
+// deweighted. In a group of three or more, such a server finds all of its
+// peers unreachable, whereas each of the others finds only it unreachable,
+// so a source threshold can distinguish the two.
+type PeerMetric struct {
+	Peers   []string
+	Timeout time.Duration
+	// The peers which could not be reached in the previous sample, so
+	// that only changes are logged.
+	unreachable map[string]bool
+}
+
+const (
+	MetricTypePeer        = "peer"
+	ParamKeyPeers         = "peers"
+	ParamKeyPeerTimeout   = "peer-timeout-ms"
+	PeerDefaultPort       = "3333"
+	PeerDefaultTimeout    = 1000
+	PeerPollDelay         = 200 * time.Millisecond
+	PeerMetricDefaultMax  = 100
+	PeerMetricMinInterval = 1000
+)
+
+func (m *PeerMetric) Configure(params MetricParams) (err error) {
+	peerList, err := GetParamValueString(ParamKeyPeers, params)
+	if err != nil {
+		return
+	}
+	m.Peers = nil
+	for _, peer := range strings.Split(peerList, ",") {
+		peer = strings.TrimSpace(peer)
+		if peer == "" {
+			continue
+		}
+		// Peers are given as 'host[:port]', using the default port of a
+		// TCP Responder if none is specified.
+		_, _, splitErr := net.SplitHostPort(peer)
+		if splitErr != nil {
+			peer = net.JoinHostPort(strings.Trim(peer, "[]"), PeerDefaultPort)
+		}
+		m.Peers = append(m.Peers, peer)
+	}
+	if len(m.Peers) == 0 {
+		err = errors.New("no peers specified")
+		return
+	}
+	params[ParamKeyPeers] = strings.Join(m.Peers, ",")
+	timeout := PeerDefaultTimeout
+	if value, exists := params[ParamKeyPeerTimeout]; exists {
+		timeout, err = strconv.Atoi(value)
+		if err != nil || timeout <= 0 {
+			err = errors.New("invalid peer timeout '" + value + "'")
+			return
+		}
+	}
+	m.Timeout = time.Duration(timeout) * time.Millisecond
+	m.unreachable = make(map[string]bool)
+	return
+}
+
+// GetLoad checks each peer concurrently, returning the percentage which
+// could not be reached.
+func (m *PeerMetric) GetLoad() (val float64, err error) {
+	failures := make([]error, len(m.Peers))
+	var wg sync.WaitGroup
+	for i, peer := range m.Peers {
+		wg.Add(1)
+		go func(i int, peer string) {
+			defer wg.Done()
+			failures[i] = checkPeer(peer, m.Timeout)
+		}(i, peer)
+	}
+	wg.Wait()
+	unreachable := 0
+	for i, peer := range m.Peers {
+		failed := failures[i] != nil
+		if failed {
+			unreachable++
+		}
+		if failed && !m.unreachable[peer] {
+			logrus.Warn("Metric type '" + MetricTypePeer + "': peer " + peer +
+				" is unreachable: " + failures[i].Error())
+		} else if !failed && m.unreachable[peer] {
+			logrus.Info("Metric type '" + MetricTypePeer + "': peer " + peer +
+				" is reachable again.")
+		}
+		m.unreachable[peer] = failed
+	}
+	val = 100 * float64(unreachable) / float64(len(m.Peers))
+	return
+}
+
+// checkPeer connects to the TCP Feedback Responder of a peer, checking
+// that it responds with feedback within a timeout.
+func checkPeer(peer string, timeout time.Duration) (err error) {
+	conn, err := net.DialTimeout("tcp", peer, timeout)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(timeout)
+	// A peer normally responds as soon as it is connected to, but one in
+	// keep-alive mode only responds to a poll, which is sent if there is
+	// no response at first. The poll is not sent straight away, as a peer
+	// which closes the connection without reading it would reset it.
+	_ = conn.SetDeadline(time.Now().Add(min(timeout/2, PeerPollDelay)))
+	reader := bufio.NewReader(conn)
+	response, err := reader.ReadString('\n')
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() && response == "" {
+		_ = conn.SetDeadline(deadline)
+		_, err = conn.Write([]byte("\n"))
+		if err != nil {
+			return
+		}
+		response, err = reader.ReadString('\n')
+	}
+	if err == nil && !strings.Contains(response, "%") {
+		err = errors.New("invalid feedback response")
+	}
+	return
+}
+
+func (m *PeerMetric) GetMetricName() string {
+	return MetricTypePeer
+}
+
+func (m *PeerMetric) GetDescription() string {
+	return "peer, peers '" + strings.Join(m.Peers, ",") + "'"
+}
+
+func (m *PeerMetric) GetDefaultMax() float64 {
+	return PeerMetricDefaultMax
+}
+
+func (m *PeerMetric) GetMinInterval() int {
+	return PeerMetricMinInterval
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
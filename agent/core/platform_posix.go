@@ -25,6 +25,7 @@
 package agent
 
 import (
+	"context"
 	"fmt"
 	"io/fs"
 	"os"
@@ -34,6 +35,7 @@ import (
 	"syscall"
 
 	"github.com/shirou/gopsutil/v3/net"
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -77,28 +79,69 @@ func PlatformPrintRunInstructions() {
 
 func PlatformExecuteScript(fullPath string) (out string, err error) {
 	var bytes []byte
-	bytes, err = exec.Command("bash", "-c", fullPath).Output()
+	bytes, err = PlatformScriptCommand(context.Background(), fullPath).Output()
 	out = string(bytes)
 	return
 }
 
+// PlatformScriptCommand prepares a command to run a script, which is
+// killed if the context is done before it completes. The script runs in
+// its own process group, so that any processes it has started are killed
+// along with it.
+func PlatformScriptCommand(ctx context.Context, fullPath string) (
+	command *exec.Cmd) {
+	command = exec.CommandContext(ctx, "bash", "-c", fullPath)
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	command.Cancel = func() error {
+		return syscall.Kill(-command.Process.Pid, syscall.SIGKILL)
+	}
+	return
+}
+
 func PlatformOpenLogFile(fullPath string) (file *os.File, err error) {
 	file, err = os.OpenFile(fullPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY,
 		DefaultFilePermissions)
 	return
 }
 
-func PlatformGetConnectionCount() (val int, err error) {
+// PlatformGetConnectionCount returns the number of network connections,
+// or if a local port is given, of those to that port which are not
+// listening sockets.
+func PlatformGetConnectionCount(localPort uint32) (val int, err error) {
 	connList, err := net.Connections("all")
 	if err != nil {
 		return
 	}
-	val = len(connList)
+	if localPort == 0 {
+		val = len(connList)
+		return
+	}
+	for _, conn := range connList {
+		if conn.Laddr.Port == localPort && conn.Status != "LISTEN" {
+			val++
+		}
+	}
 	return
 }
 
 func PlatformPrintHelpMessage() {
-	fmt.Println(HelpText)
+	fmt.Println(GenerateHelpText())
+}
+
+// PlatformSupportsReusePort is whether listeners can share a port with
+// SO_REUSEPORT, as required for zero-downtime handover between Responders.
+const PlatformSupportsReusePort = true
+
+// PlatformSetReusePort enables SO_REUSEPORT on a socket before it is bound.
+func PlatformSetReusePort(conn syscall.RawConn) (err error) {
+	controlErr := conn.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET,
+			unix.SO_REUSEPORT, 1)
+	})
+	if controlErr != nil {
+		err = controlErr
+	}
+	return
 }
 
 // -------------------------------------------------------------------
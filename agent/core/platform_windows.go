@@ -0,0 +1,428 @@
+//go:build windows
+
+// platform_windows.go
+// Platform-Specific Code - Windows
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/net"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const (
+	DefaultDirPermissions  fs.FileMode = 0755
+	DefaultFilePermissions fs.FileMode = 0644
+
+	ExitStatusNormal = 0
+	ExitStatusError  = 1
+
+	// Display name and description of the agent as a Windows Service.
+	WindowsServiceDisplayName = "Loadbalancer.org Feedback Agent"
+	WindowsServiceDescription = "Reports server availability to " +
+		"HAProxy agent checks for Loadbalancer.org appliances."
+	// Time (seconds) to wait for the service to stop when requested.
+	WindowsServiceStopTimeout = 30
+	// Delay (seconds) before the service is restarted after a failure.
+	WindowsServiceRestartDelay = 5
+)
+
+// Platform specific paths, under ProgramData.
+
+var (
+	DefaultConfigDir = filepath.Join(programDataDir(),
+		"LoadBalancer.org", AppIdentifier)
+	DefaultLogDir = filepath.Join(DefaultConfigDir, "logs")
+)
+
+// The agent running under the Windows Service Control Manager, passed to
+// the service handler once its signals have been configured.
+var (
+	runningAsService bool
+	serviceAgent     = make(chan *FeedbackAgent, 1)
+)
+
+// programDataDir returns the ProgramData directory of the system.
+func programDataDir() string {
+	dir := os.Getenv("ProgramData")
+	if dir == "" {
+		dir = `C:\ProgramData`
+	}
+	return dir
+}
+
+func PlatformMain() (exitStatus int) {
+	action := ""
+	if len(os.Args) > 1 {
+		action = strings.TrimSpace(os.Args[1])
+	}
+	switch action {
+	case "run-agent":
+		// We are in the agent daemon personality, either under the
+		// Service Control Manager or interactively.
+		isService, err := svc.IsWindowsService()
+		if err == nil && isService {
+			exitStatus = runWindowsService()
+		} else {
+			exitStatus = LaunchAgentService()
+		}
+	case "install-service", "uninstall-service", "start-service",
+		"stop-service":
+		exitStatus = controlWindowsService(action)
+	default:
+		// We are in the API client personality.
+		exitStatus = RunClientCLI()
+	}
+	return
+}
+
+func (agent *FeedbackAgent) PlatformConfigureSignals() {
+	agent.systemSignals = make(chan os.Signal, 1)
+	agent.restartSignal = syscall.SIGHUP
+	agent.quitSignal = syscall.SIGQUIT
+	signal.Notify(agent.systemSignals, os.Interrupt, syscall.SIGTERM)
+	if runningAsService {
+		serviceAgent <- agent
+	}
+}
+
+func PlatformPrintRunInstructions() {
+	fmt.Println("To run the Agent interactively, use the 'run-agent' " +
+		"command. \n" +
+		"  To run it as a Windows Service, use 'install-service' (with any \n" +
+		"  'run-agent' options), then 'start-service'; 'stop-service' and \n" +
+		"  'uninstall-service' stop and remove it.")
+}
+
+// PlatformExecuteScript runs a script, using PowerShell for '.ps1' scripts
+// and the command interpreter for batch files. Any other file is run
+// directly as an executable.
+func PlatformExecuteScript(fullPath string) (out string, err error) {
+	var bytes []byte
+	bytes, err = PlatformScriptCommand(context.Background(), fullPath).Output()
+	out = string(bytes)
+	return
+}
+
+// PlatformScriptCommand prepares a command to run a script as for
+// PlatformExecuteScript, which is killed if the context is done before it
+// completes.
+func PlatformScriptCommand(ctx context.Context, fullPath string) (
+	command *exec.Cmd) {
+	switch strings.ToLower(filepath.Ext(fullPath)) {
+	case ".ps1":
+		command = exec.CommandContext(ctx, "powershell.exe", "-NoProfile",
+			"-NonInteractive", "-ExecutionPolicy", "Bypass", "-File", fullPath)
+	case ".bat", ".cmd":
+		command = exec.CommandContext(ctx, "cmd.exe", "/C", fullPath)
+	default:
+		command = exec.CommandContext(ctx, fullPath)
+	}
+	return
+}
+
+func PlatformOpenLogFile(fullPath string) (file *os.File, err error) {
+	file, err = os.OpenFile(fullPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY,
+		DefaultFilePermissions)
+	return
+}
+
+// PlatformGetConnectionCount returns the number of network connections,
+// or if a local port is given, of those to that port which are not
+// listening sockets.
+func PlatformGetConnectionCount(localPort uint32) (val int, err error) {
+	connList, err := net.Connections("all")
+	if err != nil {
+		return
+	}
+	if localPort == 0 {
+		val = len(connList)
+		return
+	}
+	for _, conn := range connList {
+		if conn.Laddr.Port == localPort && conn.Status != "LISTEN" {
+			val++
+		}
+	}
+	return
+}
+
+func PlatformPrintHelpMessage() {
+	fmt.Println(GenerateHelpText())
+}
+
+// PlatformSupportsReusePort is whether listeners can share a port with
+// SO_REUSEPORT, which Windows does not support.
+const PlatformSupportsReusePort = false
+
+// PlatformSetReusePort is not supported on Windows.
+func PlatformSetReusePort(_ syscall.RawConn) (err error) {
+	return errors.New("SO_REUSEPORT is not supported on Windows")
+}
+
+// #######################################################################
+// Windows Service
+// #######################################################################
+
+// windowsService handles requests from the Service Control Manager for
+// the agent running as a Windows Service.
+type windowsService struct{}
+
+// runWindowsService runs the agent under the Service Control Manager,
+// returning once the service has stopped.
+func runWindowsService() (exitStatus int) {
+	runningAsService = true
+	name := AppIdentifier
+	options, err := ParseAgentArguments(os.Args[2:])
+	if err == nil && options.Instance != "" {
+		name = windowsServiceName(options.Instance)
+	}
+	err = svc.Run(name, &windowsService{})
+	if err != nil {
+		exitStatus = ExitStatusError
+	}
+	return
+}
+
+// Execute runs the agent, translating stop and shutdown requests from the
+// Service Control Manager into a quit signal, and parameter change
+// requests (e.g. 'sc control lbfeedback paramchange') into a reload of the
+// configuration.
+func (service *windowsService) Execute(args []string,
+	requests <-chan svc.ChangeRequest, status chan<- svc.Status) (
+	svcSpecificEC bool, exitCode uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	exitStatus := make(chan int, 1)
+	go func() {
+		exitStatus <- LaunchAgentService()
+	}()
+	// Wait for the agent to configure its signals, unless it fails first.
+	var agent *FeedbackAgent
+	select {
+	case agent = <-serviceAgent:
+	case result := <-exitStatus:
+		return result != ExitStatusNormal, uint32(result)
+	}
+	status <- svc.Status{
+		State: svc.Running,
+		Accepts: svc.AcceptStop | svc.AcceptShutdown |
+			svc.AcceptParamChange,
+	}
+	for {
+		select {
+		case result := <-exitStatus:
+			return result != ExitStatusNormal, uint32(result)
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				status <- request.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				agent.SelfSignalQuit()
+			case svc.ParamChange:
+				agent.systemSignals <- agent.restartSignal
+			}
+		}
+	}
+}
+
+// windowsServiceName returns the name of the Windows Service for an agent
+// instance.
+func windowsServiceName(instance string) string {
+	if instance == "" {
+		return AppIdentifier
+	}
+	return AppIdentifier + "-" + instance
+}
+
+// controlWindowsService performs a Windows Service management action,
+// taking the same options as 'run-agent' to select the instance.
+func controlWindowsService(action string) (exitStatus int) {
+	fmt.Println(ShellBanner)
+	options, err := ParseAgentArguments(os.Args[2:])
+	if err == nil {
+		name := windowsServiceName(options.Instance)
+		switch action {
+		case "install-service":
+			err = installWindowsService(name, options.Instance, os.Args[2:])
+		case "uninstall-service":
+			err = uninstallWindowsService(name, options.Instance)
+		case "start-service":
+			err = startWindowsService(name)
+		case "stop-service":
+			err = stopWindowsService(name)
+		}
+	}
+	if err != nil {
+		fmt.Println("Error: " + err.Error() + ".")
+		exitStatus = ExitStatusError
+		return
+	}
+	fmt.Println("The operation was successful.")
+	exitStatus = ExitStatusNormal
+	return
+}
+
+// installWindowsService registers the agent as an automatically started
+// Windows Service, which is restarted if it fails, and registers its
+// source for the Windows Event Log.
+func installWindowsService(name string, instance string,
+	args []string) (err error) {
+	exePath, err := os.Executable()
+	if err != nil {
+		return
+	}
+	manager, err := mgr.Connect()
+	if err != nil {
+		return
+	}
+	defer manager.Disconnect()
+	existing, err := manager.OpenService(name)
+	if err == nil {
+		existing.Close()
+		err = errors.New("service '" + name + "' is already installed")
+		return
+	}
+	displayName := WindowsServiceDisplayName
+	if instance != "" {
+		displayName += " (" + instance + ")"
+	}
+	service, err := manager.CreateService(name, exePath, mgr.Config{
+		DisplayName: displayName,
+		Description: WindowsServiceDescription,
+		StartType:   mgr.StartAutomatic,
+	}, append([]string{"run-agent"}, args...)...)
+	if err != nil {
+		return
+	}
+	defer service.Close()
+	err = service.SetRecoveryActions([]mgr.RecoveryAction{
+		{
+			Type:  mgr.ServiceRestart,
+			Delay: WindowsServiceRestartDelay * time.Second,
+		},
+	}, uint32((24 * time.Hour).Seconds()))
+	if err != nil {
+		return
+	}
+	// The event source is shared by all instances, so it may already exist.
+	sourceErr := eventlog.InstallAsEventCreate(AppIdentifier,
+		eventlog.Error|eventlog.Warning|eventlog.Info)
+	if sourceErr != nil && !strings.Contains(sourceErr.Error(), "exists") {
+		fmt.Println("Warning: cannot register the Event Log source: " +
+			sourceErr.Error() + ".")
+	}
+	fmt.Println("Installed service '" + name + "'.")
+	return
+}
+
+// uninstallWindowsService removes the Windows Service of the agent,
+// removing the Event Log source along with the default instance.
+func uninstallWindowsService(name string, instance string) (err error) {
+	manager, err := mgr.Connect()
+	if err != nil {
+		return
+	}
+	defer manager.Disconnect()
+	service, err := manager.OpenService(name)
+	if err != nil {
+		err = errors.New("service '" + name + "' is not installed")
+		return
+	}
+	defer service.Close()
+	err = service.Delete()
+	if err != nil {
+		return
+	}
+	if instance == "" {
+		_ = eventlog.Remove(AppIdentifier)
+	}
+	fmt.Println("Uninstalled service '" + name + "'.")
+	return
+}
+
+// startWindowsService starts the installed Windows Service of the agent.
+func startWindowsService(name string) (err error) {
+	manager, err := mgr.Connect()
+	if err != nil {
+		return
+	}
+	defer manager.Disconnect()
+	service, err := manager.OpenService(name)
+	if err != nil {
+		err = errors.New("service '" + name + "' is not installed")
+		return
+	}
+	defer service.Close()
+	err = service.Start()
+	return
+}
+
+// stopWindowsService stops the Windows Service of the agent, waiting for
+// it to stop.
+func stopWindowsService(name string) (err error) {
+	manager, err := mgr.Connect()
+	if err != nil {
+		return
+	}
+	defer manager.Disconnect()
+	service, err := manager.OpenService(name)
+	if err != nil {
+		err = errors.New("service '" + name + "' is not installed")
+		return
+	}
+	defer service.Close()
+	status, err := service.Control(svc.Stop)
+	if err != nil {
+		return
+	}
+	deadline := time.Now().Add(WindowsServiceStopTimeout * time.Second)
+	for status.State != svc.Stopped {
+		if time.Now().After(deadline) {
+			err = errors.New("timed out waiting for service '" + name +
+				"' to stop")
+			return
+		}
+		time.Sleep(500 * time.Millisecond)
+		status, err = service.Query()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,209 @@
+// profile.go
+// Export and Import of Tuning Profiles
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"maps"
+)
+
+// The version of the tuning profile format written by this agent.
+const TuningProfileVersion = 1
+
+// TuningProfile holds the tuning of the Monitors and Responders of an
+// agent, without any host-specific settings such as listen addresses, so
+// that a tuning proven on one server can be applied to others.
+type TuningProfile struct {
+	ProfileVersion int                          `json:"profile-version"`
+	Monitors       map[string]*MonitorProfile   `json:"monitors,omitempty"`
+	Responders     map[string]*ResponderProfile `json:"responders,omitempty"`
+}
+
+// MonitorProfile holds the tuning of a single Monitor.
+type MonitorProfile struct {
+	MetricType    string       `json:"metric-type"`
+	Interval      int          `json:"interval-ms,omitempty"`
+	Params        MetricParams `json:"metric-config,omitempty"`
+	SmartShape    bool         `json:"smart-shape,omitempty"`
+	AnomalyZScore float64      `json:"anomaly-z-score,omitempty"`
+}
+
+// ResponderProfile holds the tuning of a single Responder: its feedback
+// sources and their significances, and its thresholds and commands.
+type ResponderProfile struct {
+	FeedbackSources   map[string]*FeedbackSource `json:"feedback-sources"`
+	HAProxyCommands   string                     `json:"haproxy-commands,omitempty"`
+	CommandInterval   int                        `json:"command-interval,omitempty"`
+	ThresholdScore    int                        `json:"global-threshold,omitempty"`
+	ThresholdMode     string                     `json:"threshold-mode,omitempty"`
+	ThresholdSchedule []ThresholdWindow          `json:"threshold-schedule,omitempty"`
+}
+
+// ExportTuningProfile builds a tuning profile from the named Responder and
+// the Monitors it uses, or from all Responders with feedback sources and
+// all Monitors if no name is given.
+func (agent *FeedbackAgent) ExportTuningProfile(name string) (
+	profile *TuningProfile, err error) {
+	responders := agent.Responders
+	if name != "" {
+		var responder *FeedbackResponder
+		responder, err = agent.GetResponderByName(name)
+		if err != nil {
+			return
+		}
+		responders = map[string]*FeedbackResponder{name: responder}
+	}
+	profile = &TuningProfile{
+		ProfileVersion: TuningProfileVersion,
+		Monitors:       make(map[string]*MonitorProfile),
+		Responders:     make(map[string]*ResponderProfile),
+	}
+	for responderName, responder := range responders {
+		if len(responder.FeedbackSources) == 0 {
+			continue
+		}
+		sources := make(map[string]*FeedbackSource)
+		for sourceName, source := range responder.FeedbackSources {
+			sources[sourceName] = &FeedbackSource{
+				Significance:    source.Significance,
+				MaxValue:        source.MaxValue,
+				Threshold:       source.Threshold,
+				RawThreshold:    source.RawThreshold,
+				ThresholdAction: source.ThresholdAction,
+			}
+			if name != "" {
+				profile.addMonitor(sourceName, agent.Monitors[sourceName])
+			}
+		}
+		profile.Responders[responderName] = &ResponderProfile{
+			FeedbackSources:   sources,
+			HAProxyCommands:   responder.HAProxyCommands,
+			CommandInterval:   responder.CommandInterval,
+			ThresholdScore:    responder.ThresholdScore,
+			ThresholdMode:     responder.ThresholdModeName,
+			ThresholdSchedule: responder.ThresholdSchedule,
+		}
+	}
+	if name == "" {
+		for monitorName, monitor := range agent.Monitors {
+			profile.addMonitor(monitorName, monitor)
+		}
+	}
+	return
+}
+
+// addMonitor adds the tuning of a Monitor to a profile.
+func (profile *TuningProfile) addMonitor(name string, monitor *SystemMonitor) {
+	if monitor == nil {
+		return
+	}
+	profile.Monitors[name] = &MonitorProfile{
+		MetricType:    monitor.MetricType,
+		Interval:      monitor.Interval,
+		Params:        maps.Clone(monitor.Params),
+		SmartShape:    monitor.SmartShape,
+		AnomalyZScore: monitor.AnomalyZScore,
+	}
+}
+
+// ImportTuningProfile applies a tuning profile to this agent. Monitors in
+// the profile are added or replaced, and the tuning of Responders in the
+// profile is applied to the existing Responders of the same name; new
+// Responders cannot be created, as a profile holds no listen addresses.
+// The resulting configuration is validated before being saved, and is
+// then applied by reloading it, so that only changed services restart.
+func (agent *FeedbackAgent) ImportTuningProfile(data []byte) (
+	summary ReloadSummary, err error) {
+	profile := TuningProfile{}
+	err = json.Unmarshal(data, &profile)
+	if err != nil {
+		err = errors.New("invalid tuning profile: " + err.Error())
+		return
+	}
+	if profile.ProfileVersion > TuningProfileVersion {
+		err = errors.New("tuning profile version is newer than supported")
+		return
+	}
+	// Build the new configuration from a copy of the current one.
+	current, err := agent.ConfigToJSON()
+	if err != nil {
+		return
+	}
+	merged := FeedbackAgent{}
+	err = json.Unmarshal(current, &merged)
+	if err != nil {
+		return
+	}
+	monitors, _, err := NormaliseNameMap(profile.Monitors, "monitor")
+	if err != nil {
+		return
+	}
+	for name, tuning := range monitors {
+		monitor, exists := merged.Monitors[name]
+		if !exists {
+			monitor = &SystemMonitor{}
+			merged.Monitors[name] = monitor
+		}
+		monitor.MetricType = tuning.MetricType
+		monitor.Interval = tuning.Interval
+		monitor.Params = tuning.Params
+		monitor.SmartShape = tuning.SmartShape
+		monitor.AnomalyZScore = tuning.AnomalyZScore
+	}
+	responders, _, err := NormaliseNameMap(profile.Responders, "responder")
+	if err != nil {
+		return
+	}
+	for name, tuning := range responders {
+		responder, exists := merged.Responders[name]
+		if !exists {
+			err = errors.New("responder '" + name + "' does not exist; " +
+				"tuning profiles can only be applied to existing Responders")
+			return
+		}
+		responder.FeedbackSources = tuning.FeedbackSources
+		responder.HAProxyCommands = tuning.HAProxyCommands
+		responder.CommandInterval = tuning.CommandInterval
+		responder.ThresholdScore = tuning.ThresholdScore
+		responder.ThresholdModeName = tuning.ThresholdMode
+		responder.ThresholdSchedule = tuning.ThresholdSchedule
+	}
+	output, err := merged.ConfigToJSON()
+	if err != nil {
+		return
+	}
+	validation := agent.ValidateConfigJSON(output)
+	if !validation.Valid {
+		issue := validation.Errors[0]
+		if issue.Service != "" {
+			issue.Message = issue.Service + ": " + issue.Message
+		}
+		err = errors.New("tuning profile cannot be applied: " + issue.Message)
+		return
+	}
+	summary, err = agent.ApplyConfigData(output)
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,294 @@
+// prometheus.go
+// Prometheus Endpoint for the Internal Metrics of the Agent
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The internal metrics of the agent (see stats.go) are served by API
+// Responders in the Prometheus text exposition format, so that the agent
+// can be scraped directly. As with the rest of the API, the API key must be
+// given, either in an X-API-Key header or as a bearer token (which can be
+// set using 'authorization' in the Prometheus scrape config).
+
+const (
+	// Path at which API Responders serve metrics to Prometheus.
+	MetricsPath = "/metrics"
+	// Content type of the Prometheus text exposition format.
+	PrometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+	// Prefix of the names of all metrics.
+	PrometheusPrefix = "lbfeedback_"
+)
+
+// PrometheusForcedStates lists the states which may be forced on a
+// Responder, each given as a series of the forced state metric.
+var PrometheusForcedStates = []string{"online", "offline", "drain", "maint"}
+
+// handleMetrics serves the internal metrics of the agent to Prometheus.
+func (pc *HTTPConnector) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	response, _ := pc.responder.ParentAgent.ProcessAPIRequest(&APIRequest{
+		Action: "get",
+		Type:   "stats",
+		APIKey: getHeaderAPIKey(r.Header),
+	}, nil)
+	if !response.Success {
+		status := http.StatusForbidden
+		if response.Error == "bad-api-key" {
+			status = http.StatusUnauthorized
+		}
+		http.Error(w, response.Message, status)
+		return
+	}
+	w.Header().Set("Content-Type", PrometheusContentType)
+	_, err := w.Write([]byte(FormatPrometheusMetrics(response.Stats)))
+	if err != nil {
+		pc.responder.stats.addError()
+	}
+}
+
+// FormatPrometheusMetrics renders the internal metrics of the agent in the
+// Prometheus text exposition format.
+func FormatPrometheusMetrics(stats *AgentStats) string {
+	out := &prometheusWriter{}
+	out.family("info", "gauge", "Build information of the agent.")
+	out.sample("info", prometheusLabels("version", VersionString), 1)
+	out.metric("uptime_seconds", "gauge",
+		"Time since the agent started.", stats.UptimeSeconds)
+	out.metric("goroutines", "gauge",
+		"Number of goroutines in the agent.", float64(stats.Goroutines))
+	out.metric("memory_alloc_bytes", "gauge",
+		"Bytes of allocated heap objects.", float64(stats.MemoryAlloc))
+	out.metric("memory_sys_bytes", "gauge",
+		"Bytes of memory obtained from the OS.", float64(stats.MemorySys))
+	out.metric("heap_objects", "gauge",
+		"Number of allocated heap objects.", float64(stats.HeapObjects))
+	out.metric("gc_cycles_total", "counter",
+		"Number of completed garbage collection cycles.",
+		float64(stats.GCCycles))
+	out.metric("gc_pause_seconds_total", "counter",
+		"Total time paused for garbage collection.", stats.GCPauseSeconds)
+	out.metric("panics_total", "counter",
+		"Panics recovered within Responders and monitors.",
+		float64(stats.Panics))
+
+	responders := make([]string, 0, len(stats.Responders))
+	for name := range stats.Responders {
+		responders = append(responders, name)
+	}
+	sort.Strings(responders)
+	responderMetric := func(name string, metricType string, help string,
+		value func(stats ResponderStats) float64) {
+		out.family(name, metricType, help)
+		for _, responder := range responders {
+			out.sample(name, prometheusLabels("responder", responder),
+				value(stats.Responders[responder]))
+		}
+	}
+	responderMetric("responder_requests_total", "counter",
+		"Requests answered by each Responder.",
+		func(stats ResponderStats) float64 { return float64(stats.Requests) })
+	responderMetric("responder_errors_total", "counter",
+		"Requests which a Responder failed to answer.",
+		func(stats ResponderStats) float64 { return float64(stats.Errors) })
+	responderMetric("responder_connections_active", "gauge",
+		"Connections or requests currently being handled.",
+		func(stats ResponderStats) float64 {
+			return float64(stats.Connections.Active)
+		})
+	responderMetric("responder_connections_accepted_total", "counter",
+		"Connections or requests accepted within the limits.",
+		func(stats ResponderStats) float64 {
+			return float64(stats.Connections.Accepted)
+		})
+	out.family("responder_connections_rejected_total", "counter",
+		"Connections or requests rejected by the limits.")
+	for _, responder := range responders {
+		connections := stats.Responders[responder].Connections
+		out.sample("responder_connections_rejected_total",
+			prometheusLabels("responder", responder, "reason",
+				"connection-limit"), float64(connections.RejectedConnLimit))
+		out.sample("responder_connections_rejected_total",
+			prometheusLabels("responder", responder, "reason",
+				"rate-limit"), float64(connections.RejectedRateLimit))
+	}
+	out.family("responder_latency_seconds", "histogram",
+		"Time taken to answer requests.")
+	for _, responder := range responders {
+		responderStats := stats.Responders[responder]
+		for _, bucket := range responderStats.LatencyBuckets {
+			out.sample("responder_latency_seconds_bucket",
+				prometheusLabels("responder", responder, "le",
+					formatPrometheusValue(bucket.UpperBound)),
+				float64(bucket.Count))
+		}
+		out.sample("responder_latency_seconds_bucket",
+			prometheusLabels("responder", responder, "le", "+Inf"),
+			float64(responderStats.Requests))
+		out.sample("responder_latency_seconds_sum",
+			prometheusLabels("responder", responder),
+			responderStats.LatencySeconds)
+		out.sample("responder_latency_seconds_count",
+			prometheusLabels("responder", responder),
+			float64(responderStats.Requests))
+	}
+
+	// The command state of each Responder other than the API, as gauges
+	// on which alerts may be raised, e.g. when a Responder has been held
+	// offline by its thresholds for some time.
+	var stateful []string
+	for _, responder := range responders {
+		if stats.Responders[responder].State != nil {
+			stateful = append(stateful, responder)
+		}
+	}
+	stateMetric := func(name string, help string,
+		value func(state *ResponderState) bool) {
+		out.family(name, "gauge", help)
+		for _, responder := range stateful {
+			out.sample(name, prometheusLabels("responder", responder),
+				prometheusBool(value(stats.Responders[responder].State)))
+		}
+	}
+	stateMetric("responder_online",
+		"Whether each Responder is online (1) or offline (0).",
+		func(state *ResponderState) bool { return state.Online })
+	stateMetric("responder_threshold_breached",
+		"Whether the thresholds of each Responder (or the failure policy "+
+			"of a stale source) take it offline.",
+		func(state *ResponderState) bool { return state.ThresholdBreached })
+	stateMetric("responder_forced",
+		"Whether a state is forced on each Responder, overriding its "+
+			"thresholds.",
+		func(state *ResponderState) bool { return state.ForcedState != "" })
+	out.family("responder_forced_state", "gauge",
+		"The state forced on each Responder (1), if any.")
+	for _, responder := range stateful {
+		forced := stats.Responders[responder].State.ForcedState
+		for _, name := range PrometheusForcedStates {
+			out.sample("responder_forced_state",
+				prometheusLabels("responder", responder, "state", name),
+				prometheusBool(forced == name))
+		}
+	}
+	out.family("responder_source_threshold_breached", "gauge",
+		"Whether each source of a Responder has breached its thresholds.")
+	for _, responder := range stateful {
+		breaches := stats.Responders[responder].State.SourcesBreached
+		sources := make([]string, 0, len(breaches))
+		for source := range breaches {
+			sources = append(sources, source)
+		}
+		sort.Strings(sources)
+		for _, source := range sources {
+			out.sample("responder_source_threshold_breached",
+				prometheusLabels("responder", responder, "source", source),
+				prometheusBool(breaches[source]))
+		}
+	}
+
+	monitors := make([]string, 0, len(stats.Monitors))
+	for name := range stats.Monitors {
+		monitors = append(monitors, name)
+	}
+	sort.Strings(monitors)
+	out.family("monitor_samples_total", "counter",
+		"Samples taken successfully by each monitor.")
+	for _, monitor := range monitors {
+		out.sample("monitor_samples_total", prometheusLabels("monitor", monitor),
+			float64(stats.Monitors[monitor].Samples))
+	}
+	out.family("monitor_sample_failures_total", "counter",
+		"Attempts by each monitor to take a sample which failed.")
+	for _, monitor := range monitors {
+		out.sample("monitor_sample_failures_total",
+			prometheusLabels("monitor", monitor),
+			float64(stats.Monitors[monitor].SampleFailures))
+	}
+	return out.String()
+}
+
+// #######################################################################
+// Exposition Format
+// #######################################################################
+
+// prometheusWriter builds metrics in the Prometheus text exposition format.
+type prometheusWriter struct {
+	strings.Builder
+}
+
+// family writes the help and type of a metric family.
+func (out *prometheusWriter) family(name string, metricType string,
+	help string) {
+	out.WriteString("# HELP " + PrometheusPrefix + name + " " + help + "\n")
+	out.WriteString("# TYPE " + PrometheusPrefix + name + " " + metricType +
+		"\n")
+}
+
+// sample writes a single sample of a metric.
+func (out *prometheusWriter) sample(name string, labels string,
+	value float64) {
+	out.WriteString(PrometheusPrefix + name + labels + " " +
+		formatPrometheusValue(value) + "\n")
+}
+
+// metric writes a metric family with a single unlabelled sample.
+func (out *prometheusWriter) metric(name string, metricType string,
+	help string, value float64) {
+	out.family(name, metricType, help)
+	out.sample(name, "", value)
+}
+
+// prometheusLabels formats pairs of label names and values.
+func prometheusLabels(pairs ...string) string {
+	labels := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		labels = append(labels, pairs[i]+"=\""+
+			escapePrometheusLabel(pairs[i+1])+"\"")
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+// escapePrometheusLabel escapes a label value, as required by the format.
+func escapePrometheusLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).
+		Replace(value)
+}
+
+// formatPrometheusValue formats a sample value in its shortest form.
+func formatPrometheusValue(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// prometheusBool returns the value of a boolean metric.
+func prometheusBool(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,276 @@
+// reconcile.go
+// Desired-State Reconciliation of the Agent Configuration
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+)
+
+// The 'put config' action replaces the whole configuration of the agent
+// with a desired configuration, so that tools such as Terraform or Ansible
+// can manage an agent idempotently by always sending its complete desired
+// state. The agent compares the desired configuration with the running one,
+// and reports each difference as a change (adding, editing or deleting a
+// monitor, responder, feedback source or agent setting), listed in the
+// order in which they can be made: monitors are added before the responders
+// which use them, and responders are deleted before their monitors. The
+// configuration is validated in full before anything is changed, and is
+// then saved and applied as for a reload, so that only the services which
+// have changed are restarted. If nothing has changed, nothing is saved or
+// restarted, so the same configuration can safely be put repeatedly.
+//
+// The main API key and those of any namespaces are hidden by 'get config',
+// so if these are omitted from the desired configuration, the current keys
+// are kept.
+
+// Actions and types reported for each change made by 'put config'.
+const (
+	ConfigChangeAdd     = "add"
+	ConfigChangeEdit    = "edit"
+	ConfigChangeDelete  = "delete"
+	ConfigChangeSetting = "setting"
+)
+
+// ConfigChange describes a single difference between the running and the
+// desired configuration; the Responder is given for a feedback source.
+type ConfigChange struct {
+	Action    string `json:"action"`
+	Type      string `json:"type"`
+	Name      string `json:"name"`
+	Responder string `json:"responder,omitempty"`
+}
+
+// configMastheadFields lists the top-level fields of the configuration
+// which describe the file rather than being settings of the agent.
+var configMastheadFields = []string{"service-name", "version",
+	"config-version", "monitors", "responders"}
+
+// APIHandlePutConfig replaces the configuration of the agent with a desired
+// configuration, returning the changes made, along with the changes made to
+// the running services.
+func (agent *FeedbackAgent) APIHandlePutConfig(request *APIRequest) (
+	changes []ConfigChange, summary ReloadSummary, err error) {
+	if len(request.Config) == 0 {
+		err = errors.New("no configuration specified")
+		return
+	}
+	changes, summary, err = agent.putConfigData(request.Config)
+	return
+}
+
+// putConfigData replaces the configuration of the agent with desired
+// configuration data, as for 'put config'.
+func (agent *FeedbackAgent) putConfigData(desired []byte) (
+	changes []ConfigChange, summary ReloadSummary, err error) {
+	data, err := agent.keepHiddenKeys(desired)
+	if err != nil {
+		err = errors.New("invalid configuration: " + err.Error())
+		return
+	}
+	validation := agent.ValidateConfigJSON(data)
+	if !validation.Valid {
+		issue := validation.Errors[0]
+		if issue.Service != "" {
+			issue.Message = issue.Service + ": " + issue.Message
+		}
+		err = errors.New("configuration cannot be applied: " + issue.Message)
+		return
+	}
+	staged := FeedbackAgent{
+		configDir: agent.configDir,
+		options:   agent.options,
+	}
+	staged.InitialiseServiceMaps()
+	err = staged.JSONToConfig(data)
+	if err != nil {
+		return
+	}
+	changes, err = agent.diffConfig(&staged)
+	if err != nil || len(changes) == 0 {
+		return
+	}
+	output, err := staged.ConfigToJSON()
+	if err != nil {
+		return
+	}
+	summary, err = agent.ApplyConfigData(output)
+	return
+}
+
+// keepHiddenKeys adds the current main API key and namespace keys to a
+// desired configuration wherever these have been omitted.
+func (agent *FeedbackAgent) keepHiddenKeys(data []byte) (
+	result []byte, err error) {
+	config := make(map[string]json.RawMessage)
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return
+	}
+	var apiKey string
+	_ = json.Unmarshal(config["api-key"], &apiKey)
+	if apiKey == "" {
+		config["api-key"], err = json.Marshal(agent.APIKey)
+		if err != nil {
+			return
+		}
+	}
+	if len(config["namespaces"]) > 0 {
+		var namespaces map[string]*Namespace
+		err = json.Unmarshal(config["namespaces"], &namespaces)
+		if err != nil {
+			return
+		}
+		for name, namespace := range namespaces {
+			current, exists := agent.Namespaces[name]
+			if namespace != nil && namespace.APIKey == "" && exists {
+				namespace.APIKey = current.APIKey
+			}
+		}
+		config["namespaces"], err = json.Marshal(namespaces)
+		if err != nil {
+			return
+		}
+	}
+	result, err = json.Marshal(config)
+	return
+}
+
+// diffConfig returns the changes required to make the running
+// configuration match that of a staged agent, in dependency order.
+func (agent *FeedbackAgent) diffConfig(staged *FeedbackAgent) (
+	changes []ConfigChange, err error) {
+	// Agent settings are compared as they would be saved.
+	current, err := configFieldMap(agent)
+	if err != nil {
+		return
+	}
+	desired, err := configFieldMap(staged)
+	if err != nil {
+		return
+	}
+	for _, name := range sortedKeys(current) {
+		if _, exists := desired[name]; !exists {
+			changes = append(changes, ConfigChange{ConfigChangeDelete,
+				ConfigChangeSetting, name, ""})
+		}
+	}
+	for _, name := range sortedKeys(desired) {
+		if _, exists := current[name]; !exists {
+			changes = append(changes, ConfigChange{ConfigChangeAdd,
+				ConfigChangeSetting, name, ""})
+		} else if !configJSONEqual(current[name], desired[name]) {
+			changes = append(changes, ConfigChange{ConfigChangeEdit,
+				ConfigChangeSetting, name, ""})
+		}
+	}
+	// Monitors are added and edited before the Responders using them.
+	var deletedMonitors []ConfigChange
+	for _, name := range sortedKeys(staged.Monitors) {
+		monitor, exists := agent.Monitors[name]
+		if !exists {
+			changes = append(changes, ConfigChange{ConfigChangeAdd,
+				"monitor", name, ""})
+		} else if !configJSONEqual(monitor, staged.Monitors[name]) {
+			changes = append(changes, ConfigChange{ConfigChangeEdit,
+				"monitor", name, ""})
+		}
+	}
+	for _, name := range sortedKeys(agent.Monitors) {
+		if _, exists := staged.Monitors[name]; !exists {
+			deletedMonitors = append(deletedMonitors, ConfigChange{
+				ConfigChangeDelete, "monitor", name, ""})
+		}
+	}
+	for _, name := range sortedKeys(staged.Responders) {
+		responder, exists := agent.Responders[name]
+		if !exists {
+			changes = append(changes, ConfigChange{ConfigChangeAdd,
+				"responder", name, ""})
+			continue
+		}
+		changes = append(changes,
+			diffResponder(name, responder, staged.Responders[name])...)
+	}
+	// Responders are deleted before the monitors which they use.
+	for _, name := range sortedKeys(agent.Responders) {
+		if _, exists := staged.Responders[name]; !exists {
+			changes = append(changes, ConfigChange{ConfigChangeDelete,
+				"responder", name, ""})
+		}
+	}
+	changes = append(changes, deletedMonitors...)
+	return
+}
+
+// diffResponder returns the changes to the settings and feedback sources
+// of a Responder required to match another.
+func diffResponder(name string, current *FeedbackResponder,
+	desired *FeedbackResponder) (changes []ConfigChange) {
+	currentCopy := current.Copy()
+	desiredCopy := desired.Copy()
+	for _, copied := range []*FeedbackResponder{&currentCopy, &desiredCopy} {
+		copied.FeedbackSources = nil
+	}
+	if !configJSONEqual(&currentCopy, &desiredCopy) {
+		changes = append(changes, ConfigChange{ConfigChangeEdit,
+			"responder", name, ""})
+	}
+	for _, source := range sortedKeys(desired.FeedbackSources) {
+		existing, exists := current.FeedbackSources[source]
+		if !exists {
+			changes = append(changes, ConfigChange{ConfigChangeAdd,
+				"source", source, name})
+		} else if !configJSONEqual(existing, desired.FeedbackSources[source]) {
+			changes = append(changes, ConfigChange{ConfigChangeEdit,
+				"source", source, name})
+		}
+	}
+	for _, source := range sortedKeys(current.FeedbackSources) {
+		if _, exists := desired.FeedbackSources[source]; !exists {
+			changes = append(changes, ConfigChange{ConfigChangeDelete,
+				"source", source, name})
+		}
+	}
+	return
+}
+
+// configFieldMap returns the agent settings of a configuration as they
+// would be saved, keyed by field name.
+func configFieldMap(agent *FeedbackAgent) (fields map[string]any,
+	err error) {
+	data, err := agent.ConfigToJSON()
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &fields)
+	for name := range fields {
+		if slices.Contains(configMastheadFields, name) {
+			delete(fields, name)
+		}
+	}
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,259 @@
+// recorder.go
+// Recording of Observations to Rolling Files for Offline Analysis
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"encoding/csv"
+	"errors"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The recorder writes every sample taken by each monitor, and the
+// availability reported by each Responder, to a single rolling file in
+// CSV or SQL format, so that the behaviour of the weights can be analysed
+// offline against real traffic (e.g. in a spreadsheet or with pandas). This
+// differs from the history store, which keeps a series per service for
+// 'get history' queries. The file is rotated in the same way as the log
+// file, and rotated files are removed once beyond the count or age limits.
+//
+// The SQL format writes statements in the SQLite dialect rather than a
+// database file, so that the agent needs no database driver; each file can
+// be loaded with e.g. 'sqlite3 history.db < recorder.sql'.
+
+const (
+	// Supported recorder file formats.
+	RecorderFormatCSV = "csv"
+	RecorderFormatSQL = "sql"
+	// Defaults applied when the recorder limits are not configured.
+	DefaultRecorderMaxSizeMB     = 64
+	DefaultRecorderMaxFiles      = 10
+	DefaultRecorderRetentionDays = 7
+	// Base name of the recorder file within the config directory, if no
+	// path is configured, to which the format is added as an extension.
+	DefaultRecorderFileName = "recorder"
+	// Name of the table to which the SQL format inserts observations.
+	RecorderSQLTable = "observations"
+)
+
+// RecorderConfig holds the settings for the recorder, which is enabled if
+// these settings are present in the config.
+type RecorderConfig struct {
+	Format        string `json:"format,omitempty"`
+	Path          string `json:"path,omitempty"`
+	MaxSizeMB     int    `json:"max-size-mb,omitempty"`
+	MaxFiles      int    `json:"max-files,omitempty"`
+	RetentionDays int    `json:"retention-days,omitempty"`
+	Compress      bool   `json:"compress,omitempty"`
+}
+
+// Validate checks that the recorder settings are valid.
+func (config *RecorderConfig) Validate() (err error) {
+	format := strings.ToLower(config.Format)
+	if format != "" && format != RecorderFormatCSV &&
+		format != RecorderFormatSQL {
+		err = errors.New("invalid recorder format '" + config.Format +
+			"'; must be '" + RecorderFormatCSV + "' or '" +
+			RecorderFormatSQL + "'")
+	} else if config.MaxSizeMB < 0 || config.MaxFiles < 0 ||
+		config.RetentionDays < 0 {
+		err = errors.New("recorder limits cannot be negative")
+	} else if config.Path != "" && !filepath.IsAbs(config.Path) {
+		err = errors.New("recorder path '" + config.Path +
+			"' is not an absolute path")
+	}
+	return
+}
+
+// #######################################################################
+// Recorder
+// #######################################################################
+
+// Recorder writes observations to a rolling file.
+type Recorder struct {
+	config     RecorderConfig
+	format     string
+	file       *RotatingLogFile
+	lastRecord map[string]time.Time
+	failed     bool
+	mutex      sync.Mutex
+}
+
+// OpenRecorder validates the recorder settings and opens the file to
+// which observations are recorded.
+func OpenRecorder(config RecorderConfig, configDir string) (
+	recorder *Recorder, err error) {
+	err = config.Validate()
+	if err != nil {
+		return
+	}
+	recorder = &Recorder{
+		config:     config,
+		format:     strings.ToLower(config.Format),
+		lastRecord: make(map[string]time.Time),
+	}
+	if recorder.format == "" {
+		recorder.format = RecorderFormatCSV
+	}
+	filePath := config.Path
+	if filePath == "" {
+		filePath = path.Join(configDir,
+			DefaultRecorderFileName+"."+recorder.format)
+	}
+	rotation := LogRotationConfig{
+		MaxSizeMB:  config.MaxSizeMB,
+		MaxBackups: config.MaxFiles,
+		MaxAgeDays: config.RetentionDays,
+		Compress:   config.Compress,
+	}
+	if rotation.MaxSizeMB == 0 {
+		rotation.MaxSizeMB = DefaultRecorderMaxSizeMB
+	}
+	if rotation.MaxBackups == 0 {
+		rotation.MaxBackups = DefaultRecorderMaxFiles
+	}
+	if rotation.MaxAgeDays == 0 {
+		rotation.MaxAgeDays = DefaultRecorderRetentionDays
+	}
+	header := "time,type,name,value\n"
+	if recorder.format == RecorderFormatSQL {
+		header = "CREATE TABLE IF NOT EXISTS " + RecorderSQLTable +
+			" (time TEXT NOT NULL, type TEXT NOT NULL, name TEXT NOT NULL, " +
+			"value REAL NOT NULL);\n"
+	}
+	err = CreateDirectoryIfMissing(path.Dir(filePath))
+	if err != nil {
+		return
+	}
+	recorder.file, err = newRotatingFile(filePath, rotation, []byte(header))
+	if err != nil {
+		return
+	}
+	logrus.Info("Recording observations to '" + filePath + "' (" +
+		recorder.format + ").")
+	return
+}
+
+// Close closes the recorder file.
+func (recorder *Recorder) Close() {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	_ = recorder.file.Close()
+}
+
+// Record writes an observation for a service. The availability of a
+// Responder is calculated for each feedback request, so it is recorded at
+// most once in each history record interval. If the file cannot be
+// written, this is reported once, until a write succeeds again.
+func (recorder *Recorder) Record(serviceType string, name string,
+	at time.Time, value float64) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	if serviceType == "responder" {
+		series := historySeriesName(serviceType, name)
+		if at.Sub(recorder.lastRecord[series]) <
+			HistoryRecordInterval*time.Millisecond {
+			return
+		}
+		recorder.lastRecord[series] = at
+	}
+	timeText := at.UTC().Format(time.RFC3339Nano)
+	valueText := strconv.FormatFloat(value, 'f', -1, 64)
+	var err error
+	if recorder.format == RecorderFormatSQL {
+		quote := func(text string) string {
+			return "'" + strings.ReplaceAll(text, "'", "''") + "'"
+		}
+		_, err = recorder.file.Write([]byte("INSERT INTO " +
+			RecorderSQLTable + " VALUES (" + quote(timeText) + ", " +
+			quote(serviceType) + ", " + quote(name) + ", " + valueText +
+			");\n"))
+	} else {
+		writer := csv.NewWriter(recorder.file)
+		err = writer.Write([]string{timeText, serviceType, name, valueText})
+		if err == nil {
+			writer.Flush()
+			err = writer.Error()
+		}
+	}
+	if err != nil && !recorder.failed {
+		logrus.Error("Failed to record an observation; further failures " +
+			"will not be logged: " + err.Error())
+	} else if err == nil && recorder.failed {
+		logrus.Info("Observations are being recorded successfully again.")
+	}
+	recorder.failed = err != nil
+}
+
+// #######################################################################
+// Agent Integration
+// #######################################################################
+
+// UpdateRecorder opens, reopens or closes the recorder according to the
+// recorder setting of the agent.
+func (agent *FeedbackAgent) UpdateRecorder() {
+	if agent.recorder == nil {
+		return
+	}
+	current := agent.recorder.Load()
+	if current != nil {
+		if agent.Recorder != nil && current.config == *agent.Recorder {
+			return
+		}
+		agent.recorder.Store(nil)
+		current.Close()
+		if agent.Recorder == nil {
+			logrus.Info("Stopped recording observations.")
+			return
+		}
+	}
+	if agent.Recorder == nil {
+		return
+	}
+	recorder, err := OpenRecorder(*agent.Recorder, agent.configDir)
+	if err != nil {
+		logrus.Error("Failed to open the recorder: " + err.Error())
+		return
+	}
+	agent.recorder.Store(recorder)
+}
+
+// StopRecorder closes the recorder when the agent shuts down, leaving the
+// recorder setting unchanged.
+func (agent *FeedbackAgent) StopRecorder() {
+	if agent.recorder == nil {
+		return
+	}
+	if current := agent.recorder.Swap(nil); current != nil {
+		current.Close()
+		logrus.Info("Stopped recording observations.")
+	}
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,292 @@
+// reload.go
+// Hot Reloading of the Agent Configuration
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ReloadSummary records the changes made to the running services by a
+// configuration reload.
+type ReloadSummary struct {
+	Started   []string
+	Restarted []string
+	Stopped   []string
+	Unchanged []string
+}
+
+// String describes the changes in a reload summary for logging.
+func (summary *ReloadSummary) String() string {
+	return strconv.Itoa(len(summary.Started)) + " started, " +
+		strconv.Itoa(len(summary.Restarted)) + " restarted, " +
+		strconv.Itoa(len(summary.Stopped)) + " stopped, " +
+		strconv.Itoa(len(summary.Unchanged)) + " unchanged"
+}
+
+// ReloadConfig reloads the JSON configuration file from disk and applies
+// it to the running agent. The new configuration is fully validated first;
+// if it is invalid, the running configuration is left untouched. Only the
+// services whose configuration has changed are restarted, so that any
+// unchanged Responders keep listening throughout the reload.
+func (agent *FeedbackAgent) ReloadConfig() (summary ReloadSummary, err error) {
+	logrus.Info("Reloading the Feedback Agent configuration.")
+	data, err := os.ReadFile(path.Join(agent.configDir, ConfigFileName))
+	if err != nil {
+		err = errors.New("configuration not reloaded: " + err.Error())
+		logrus.Error(err.Error())
+		return
+	}
+	summary, err = agent.reloadConfigData(data, true)
+	return
+}
+
+// restoreConfig restores the running configuration to an earlier one
+// obtained from ConfigToJSON (e.g. to roll back a failed batch of
+// changes), in the same way as a reload but without reference to the
+// config file.
+func (agent *FeedbackAgent) restoreConfig(data []byte) (
+	summary ReloadSummary, err error) {
+	logrus.Info("Restoring the previous running configuration.")
+	summary, err = agent.reloadConfigData(data, false)
+	return
+}
+
+// reloadConfigData applies JSON configuration data to the running agent,
+// either read from the config file or an earlier running configuration.
+func (agent *FeedbackAgent) reloadConfigData(data []byte, fromFile bool) (
+	summary ReloadSummary, err error) {
+	// Load and validate the new configuration into a staging agent.
+	staged := FeedbackAgent{
+		configDir: agent.configDir,
+		options:   agent.options,
+	}
+	staged.InitialiseServiceMaps()
+	err = staged.JSONToConfig(data)
+	if err != nil {
+		err = errors.New("configuration not reloaded: " + err.Error())
+		logrus.Error(err.Error())
+		return
+	}
+	// Any unsaved changes to the running configuration are discarded.
+	if fromFile {
+		agent.recordConfigFile(data)
+	}
+	agent.applyReloadedSettings(&staged)
+
+	// Determine which monitors have changed, and stop any which have
+	// been removed or changed before the Responders using them.
+	changedMonitors := make(map[string]bool)
+	for name, monitor := range agent.Monitors {
+		newMonitor, exists := staged.Monitors[name]
+		if exists && configJSONEqual(monitor, newMonitor) {
+			continue
+		}
+		changedMonitors[name] = true
+	}
+	// Stop any Responders which have been removed or changed, except for
+	// those which will hand over to their replacements once started.
+	changedResponders := make(map[string]bool)
+	handovers := make(map[string]*FeedbackResponder)
+	for name, responder := range agent.Responders {
+		newResponder, exists := staged.Responders[name]
+		if exists && responderConfigEqual(responder, newResponder) {
+			continue
+		}
+		changedResponders[name] = true
+		agent.endSignificanceAnalysis(name)
+		if exists && canHandOver(responder, newResponder) {
+			handovers[name] = responder
+		} else if responder.IsRunning() {
+			err = errors.Join(err, responder.Stop())
+		}
+		agent.removeResponder(name)
+		if !exists {
+			summary.Stopped = append(summary.Stopped, "responder '"+name+"'")
+		}
+	}
+	// Replace any removed or changed monitors.
+	for name := range changedMonitors {
+		err = errors.Join(err, agent.Monitors[name].Stop())
+		agent.removeMonitor(name)
+		if _, exists := staged.Monitors[name]; !exists {
+			summary.Stopped = append(summary.Stopped, "monitor '"+name+"'")
+		}
+	}
+	for name, monitor := range staged.Monitors {
+		_, running := agent.Monitors[name]
+		if running {
+			summary.Unchanged = append(summary.Unchanged, "monitor '"+name+"'")
+			continue
+		}
+		monitor.ParentAgent = agent
+		agent.setMonitor(name, monitor)
+		err = errors.Join(err, monitor.Start())
+		if changedMonitors[name] {
+			summary.Restarted = append(summary.Restarted, "monitor '"+name+"'")
+		} else {
+			summary.Started = append(summary.Started, "monitor '"+name+"'")
+		}
+	}
+	// Start any new or changed Responders, reattaching them to this agent.
+	for name, responder := range staged.Responders {
+		if _, running := agent.Responders[name]; running {
+			continue
+		}
+		responder.ParentAgent = agent
+		// The original of a Responder being handed over is kept in place,
+		// and running, unless its replacement starts successfully.
+		original, handover := handovers[name]
+		if handover {
+			agent.setResponder(name, original)
+		}
+		startErr := responder.Initialise()
+		if startErr == nil && handover {
+			startErr = agent.replaceResponder(name, original, responder)
+		} else if startErr == nil {
+			agent.setResponder(name, responder)
+			startErr = responder.Start()
+		}
+		if handover && agent.Responders[name] == original {
+			// The original remains, so reattach any replaced monitors.
+			startErr = errors.Join(startErr, original.initialiseSources())
+		}
+		err = errors.Join(err, startErr)
+		if changedResponders[name] {
+			summary.Restarted = append(summary.Restarted, "responder '"+name+"'")
+		} else {
+			summary.Started = append(summary.Started, "responder '"+name+"'")
+		}
+	}
+	// Unchanged Responders keep running, but must have their sources
+	// reattached if any of the monitors they use were replaced.
+	for name, responder := range agent.Responders {
+		if changedResponders[name] {
+			continue
+		}
+		summary.Unchanged = append(summary.Unchanged, "responder '"+name+"'")
+		for sourceName := range responder.FeedbackSources {
+			if changedMonitors[sourceName] {
+				err = errors.Join(err, responder.initialiseSources())
+				break
+			}
+		}
+	}
+	// Save any corrections made to the config whilst loading it.
+	if fromFile && staged.unsavedChanges {
+		_, saveErr := agent.SaveAgentConfigToPaths()
+		err = errors.Join(err, saveErr)
+	}
+	slices.Sort(summary.Unchanged)
+	if err != nil {
+		logrus.Error("Error whilst reloading configuration: " + err.Error())
+	}
+	logrus.Info("Configuration reloaded: " + summary.String() + ".")
+	if fromFile {
+		agent.recordConfigChange("Configuration reloaded from file: " +
+			summary.String() + ".")
+	} else {
+		agent.recordConfigChange("Previous running configuration " +
+			"restored: " + summary.String() + ".")
+	}
+	return
+}
+
+// applyReloadedSettings applies the agent-wide settings from a reloaded
+// configuration. The log destinations and format are only set up when the
+// agent launches, so changes to these are reported as requiring a restart.
+func (agent *FeedbackAgent) applyReloadedSettings(staged *FeedbackAgent) {
+	agent.APIKey = staged.APIKey
+	agent.apiKey = staged.apiKey
+	agent.WatchConfig = staged.WatchConfig
+	agent.ConfigBackups = staged.ConfigBackups
+	agent.EnableTests = staged.EnableTests
+	agent.APIDisabled = staged.APIDisabled
+	agent.disabledActions = staged.disabledActions
+	if !agent.EnableTests {
+		agent.StopAllFlapTests()
+	}
+	agent.HistoryStore = staged.HistoryStore
+	agent.Recorder = staged.Recorder
+	agent.Heartbeat = staged.Heartbeat
+	agent.Forwarder = staged.Forwarder
+	agent.Webhooks = staged.Webhooks
+	agent.EmailAlerts = staged.EmailAlerts
+	agent.Events = staged.Events
+	agent.OTel = staged.OTel
+	agent.DebugListener = staged.DebugListener
+	agent.Cluster = staged.Cluster
+	agent.Hooks = staged.Hooks
+	agent.Supervisor = staged.Supervisor
+	agent.Namespaces = staged.Namespaces
+	agent.UpdateConfigWatcher()
+	agent.UpdateEventLog()
+	agent.UpdateHistoryStore()
+	agent.UpdateRecorder()
+	agent.UpdateHeartbeat()
+	agent.UpdateForwarder()
+	agent.UpdateWebhooks()
+	agent.UpdateEmailNotifier()
+	agent.UpdateOTelExporter()
+	agent.UpdateDebugListener()
+	agent.UpdateCluster()
+	if staged.LogLevel != agent.LogLevel {
+		err := agent.SetLogLevel(staged.LogLevel)
+		if err != nil {
+			logrus.Warn(err.Error() + "; log level unchanged.")
+		}
+	}
+	if staged.LogDir != agent.LogDir ||
+		staged.LogFormat != agent.LogFormat ||
+		staged.SyslogFacility != agent.SyslogFacility ||
+		!slices.Equal(staged.LogTargets, agent.LogTargets) ||
+		!configJSONEqual(staged.LogRotation, agent.LogRotation) {
+		logrus.Warn("Changes to the log destinations or format will take " +
+			"effect when the Feedback Agent is next launched.")
+	}
+}
+
+// responderConfigEqual returns whether two Responders have the same
+// configuration.
+func responderConfigEqual(a *FeedbackResponder, b *FeedbackResponder) bool {
+	copyA := a.Copy()
+	copyB := b.Copy()
+	return configJSONEqual(&copyA, &copyB)
+}
+
+// configJSONEqual returns whether two configuration objects produce the
+// same JSON, and are therefore configured identically.
+func configJSONEqual(a any, b any) bool {
+	jsonA, errA := json.Marshal(a)
+	jsonB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(jsonA, jsonB)
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -23,13 +23,19 @@
 package agent
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math"
 	"net"
+	"net/http"
+	"net/netip"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -48,25 +54,63 @@ type FeedbackResponder struct {
 	ListenIPAddress       string                     `json:"ip"`
 	ListenPort            string                     `json:"port"`
 	FeedbackSources       map[string]*FeedbackSource `json:"feedback-sources,omitempty"`
-	RequestTimeout        time.Duration              `json:"request-timeout,omitempty"`
-	ResponseTimeout       time.Duration              `json:"response-timeout,omitempty"`
+	RequestTimeout        Duration                   `json:"request-timeout,omitempty"`
+	ResponseTimeout       Duration                   `json:"response-timeout,omitempty"`
+	IdleTimeout           Duration                   `json:"idle-timeout,omitempty"`
 	HAProxyCommands       string                     `json:"haproxy-commands,omitempty"`
 	CommandInterval       int                        `json:"command-interval,omitempty"`
 	ThresholdScore        int                        `json:"global-threshold,omitempty"`
 	ThresholdModeName     string                     `json:"threshold-mode,omitempty"`
+	ThresholdSchedule     []ThresholdWindow          `json:"threshold-schedule,omitempty"`
 	EnableOfflineInterval bool                       `json:"enable-offline-interval,omitempty"`
 	LogStateChanges       bool                       `json:"log-state-changes,omitempty"`
+	AllowedCIDRs          []string                   `json:"allowed-cidrs,omitempty"`
+	MaxConnections        int                        `json:"max-connections,omitempty"`
+	MaxRequestRate        int                        `json:"max-request-rate,omitempty"`
+	DrainTimeout          Duration                   `json:"drain-timeout,omitempty"`
+	CacheFeedback         bool                       `json:"cache-feedback,omitempty"`
+	KeepAlive             bool                       `json:"keep-alive,omitempty"`
+	ReusePort             bool                       `json:"reuse-port,omitempty"`
+	FeedbackFormat        string                     `json:"feedback-format,omitempty"`
+	Aggregation           string                     `json:"aggregation,omitempty"`
+	AggregationExpression string                     `json:"aggregation-expression,omitempty"`
+	WeightCurve           string                     `json:"weight-curve,omitempty"`
+	WeightCurveFactor     float64                    `json:"weight-curve-factor,omitempty"`
+	WeightPoints          []WeightPoint              `json:"weight-points,omitempty"`
+	MinWeight             int                        `json:"min-weight,omitempty"`
+	MaxWeight             int                        `json:"max-weight,omitempty"`
+	DrainMonitor          string                     `json:"drain-monitor,omitempty"`
+	ResponseTemplate      string                     `json:"response-template,omitempty"`
+	StatusCodes           bool                       `json:"status-codes,omitempty"`
+	Routes                []FeedbackRoute            `json:"routes,omitempty"`
+	Listener              string                     `json:"listener,omitempty"`
+	MatchPath             string                     `json:"match-path,omitempty"`
+	MatchHost             string                     `json:"match-host,omitempty"`
+	MatchToken            string                     `json:"match-token,omitempty"`
+	AccessLog             *AccessLogConfig           `json:"access-log,omitempty"`
+	SNMP                  *SNMPConfig                `json:"snmp,omitempty"`
+	Namespace             string                     `json:"namespace,omitempty"`
 
 	// -- Exported configuration fields.
 	ResponderName string            `json:"-"`
 	Connector     ProtocolConnector `json:"-"`
 	LastError     error             `json:"-"`
 	ParentAgent   *FeedbackAgent    `json:"-"`
+	// The port assigned by the OS when ListenPort is "0" (ephemeral),
+	// which is reported in the service status and the runtime file.
+	BoundPort string `json:"-"`
+	// The effective HAProxy commands sent when online and offline, which
+	// are reported in the service status.
+	OnlineCommands  string `json:"-"`
+	OfflineCommands string `json:"-"`
 
 	// -- Internal configuration fields.
-	runState      bool
-	mutex         *sync.Mutex
-	statusChannel chan int
+	runState bool
+	mutex    *sync.Mutex
+	// Cancels the context of the running worker, which closes the done
+	// channel once it has stopped.
+	cancel context.CancelFunc
+	done   chan struct{}
 
 	// The last command state (online or offline) seen.
 	onlineState bool
@@ -84,8 +128,52 @@ type FeedbackResponder struct {
 	// within the "up" threshold range?
 	forceCommandState bool
 
+	// When the current forced command state was set, and when it expires
+	// (if it was forced for a duration; otherwise zero).
+	forceSince  time.Time
+	forceExpiry time.Time
+
 	// Currently configured threshold mode (from string).
 	thresholdModeEnum ThresholdMode
+
+	// The parsed aggregation expression, if the aggregation is 'expression'.
+	aggregationExpr *loadExpression
+
+	// The parsed response template, if any.
+	responseTemplate *template.Template
+
+	// The sampling state of the access log, if enabled.
+	accessSampler *accessSampler
+
+	// The threshold schedule window last applied, if any.
+	activeWindow string
+
+	// Parsed networks from AllowedCIDRs; if empty, all clients are allowed.
+	allowedNetworks []*net.IPNet
+
+	// Enforces MaxConnections and MaxRequestRate for the connectors.
+	limiter *ConnectionLimiter
+
+	// Closed to cancel the running flap test, if any.
+	flapStop chan struct{}
+
+	// The last feedback response, if CacheFeedback is enabled.
+	cache *feedbackCache
+
+	// Request metrics, shared with any replacement made by an edit.
+	stats *requestStats
+
+	// When this responder was last started and the number of times it
+	// has been restarted (including when replaced by an edit), and when
+	// a response was last served (Unix time in ns, accessed atomically as
+	// responses do not hold the mutex throughout).
+	startTime    time.Time
+	restartCount int
+	lastResponse int64
+
+	// Whether this responder is being stopped as its replacement has
+	// started, in which case it briefly continues to accept connections.
+	handingOver bool
 }
 
 // -- Constants for threshold functionality.
@@ -113,13 +201,18 @@ var thresholdStringToMode = map[string]ThresholdMode{
 }
 
 // FeedbackSource defines a source mapping for a FeedbackResponder to a
-// SystemMonitor with a specified significance and maximum value.
+// SystemMonitor with a specified significance and maximum value. An optional
+// threshold action gives the HAProxy commands to send when this source
+// breaches its threshold, in place of the offline commands of the responder.
 type FeedbackSource struct {
 	Significance         float64        `json:"significance"`
 	MaxValue             int64          `json:"max-value"`
 	Threshold            int64          `json:"source-threshold,omitempty"`
+	RawThreshold         int64          `json:"raw-threshold,omitempty"`
+	ThresholdAction      string         `json:"threshold-action,omitempty"`
 	Monitor              *SystemMonitor `json:"-"`
 	RelativeSignificance float64        `json:"-"`
+	actionMask           int
 }
 
 const (
@@ -130,6 +223,13 @@ const (
 	// to be the most conservative value.
 
 	DefaultCommandInterval = 10
+
+	// Default time for which in-flight requests are allowed to complete
+	// when a responder is stopped, if not configured.
+	DefaultDrainTimeout = 5 * time.Second
+	// Time to wait for the worker of a responder to stop once its
+	// connections have been drained.
+	ResponderStopTimeout = 5 * time.Second
 )
 
 // -- Constants for HAProxy command handling.
@@ -212,6 +312,18 @@ var commandEnumOrder = []int{
 	HAPEnumStopped,
 }
 
+// HAProxy commands which set the same aspect of the server state, of which
+// only one may be sent in the same state (online or offline): the
+// operational state, and the administrative state.
+var (
+	hapOperationalCommands = []int{
+		HAPEnumUp, HAPEnumDown, HAPEnumFail, HAPEnumStopped,
+	}
+	hapAdminCommands = []int{
+		HAPEnumReady, HAPEnumDrain, HAPEnumMaintenance,
+	}
+)
+
 // NewResponder creates a new FeedbackResponder object. This constructor must
 // be used when creating a new responder object.
 func NewResponder(name string, sources map[string]*FeedbackSource,
@@ -254,33 +366,109 @@ func (fbr *FeedbackResponder) Initialise() (err error) {
 		fbr.FeedbackSources = make(map[string]*FeedbackSource)
 	}
 	// -- Process/validate parameters.
-	if fbr.ProtocolName == ProtocolLegacyAPI {
-		alertMsg := "Insecure legacy plaintext HTTP API transport specified in configuration."
-		if ForceAPISecure {
-			fbr.ProtocolName = ProtocolSecureAPI
-			alertMsg += " Forcing to HTTPS mode."
-		}
-		logrus.Warn(alertMsg)
+	err = fbr.checkLegacyAPI()
+	if err != nil {
+		return
 	}
 	fbr.Connector, err = NewFeedbackConnector(fbr.ProtocolName)
 	if err != nil {
 		return
 	}
-	fbr.ListenIPAddress, err = ParseIPAddress(fbr.ListenIPAddress)
+	// A virtual responder shares the listener of another, so has no
+	// address of its own.
+	err = fbr.configureVirtual()
+	if err != nil {
+		return
+	}
+	if !fbr.isVirtual() {
+		fbr.ListenIPAddress, err = ParseIPAddress(fbr.ListenIPAddress)
+		if err != nil {
+			return
+		}
+		fbr.ListenPort, err = ParseNetworkPort(fbr.ListenPort)
+		if err != nil {
+			return
+		}
+	}
+	if fbr.DrainTimeout < 0 {
+		err = errors.New("invalid drain timeout; cannot be negative")
+		return
+	}
+	err = fbr.checkTimeouts()
+	if err != nil {
+		return
+	}
+	if fbr.KeepAlive && fbr.ProtocolName != ProtocolTCP {
+		err = errors.New("keep-alive is only supported by TCP responders")
+		return
+	}
+	if fbr.ReusePort && !PlatformSupportsReusePort {
+		err = errors.New("reuse-port is not supported on this platform")
+		return
+	}
+	err = fbr.configureFeedbackFormat()
+	if err != nil {
+		return
+	}
+	err = fbr.configureAggregation()
+	if err != nil {
+		return
+	}
+	err = fbr.configureRoutes()
 	if err != nil {
 		return
 	}
-	fbr.ListenPort, err = ParseNetworkPort(fbr.ListenPort)
+	err = fbr.configureWeightCurve()
+	if err != nil {
+		return
+	}
+	err = fbr.configureDrainMonitor()
+	if err != nil {
+		return
+	}
+	err = fbr.configureAccessLog()
+	if err != nil {
+		return
+	}
+	if fbr.SNMP != nil {
+		if fbr.ProtocolName != ProtocolSNMP {
+			err = errors.New("SNMP settings are only supported by SNMP " +
+				"responders")
+			return
+		}
+		err = fbr.SNMP.Validate(fbr.ResponderName)
+		if err != nil {
+			return
+		}
+	}
+	// Copy the schedule, as it is shared with the original by Copy().
+	fbr.ThresholdSchedule = slices.Clone(fbr.ThresholdSchedule)
+	err = ValidateThresholdSchedule(fbr.ThresholdSchedule)
+	if err != nil {
+		return
+	}
+	fbr.activeWindow = ""
+	fbr.cache = &feedbackCache{}
+	if fbr.stats == nil {
+		fbr.stats = newRequestStats()
+	}
+	fbr.AllowedCIDRs, fbr.allowedNetworks, err = ParseCIDRList(fbr.AllowedCIDRs)
+	if err != nil {
+		return
+	}
+	err = fbr.configureLimiter()
 	if err != nil {
 		return
 	}
 	// Skip source/command initialisation if this is an API responder, or it
 	// has no feedback sources defined.
-	if fbr.ProtocolName == ProtocolSecureAPI || len(fbr.FeedbackSources) < 1 {
+	if fbr.IsAPI() || len(fbr.FeedbackSources) < 1 {
 		return
 	}
-	// This requires unlocking the mutex, and then locking again due to our defer.
+	// This requires unlocking the mutex, and then locking again (on any
+	// return path) before the deferred unlock above.
 	fbr.mutex.Unlock()
+	defer fbr.mutex.Lock()
 	err = fbr.initialiseSources()
 	if err != nil {
 		return
@@ -294,10 +482,6 @@ func (fbr *FeedbackResponder) Initialise() (err error) {
 		return
 	}
 	err = fbr.ConfigureThresholdMode(fbr.ThresholdModeName)
-	if err != nil {
-		return
-	}
-	fbr.mutex.Lock()
 	return
 }
 
@@ -337,6 +521,13 @@ func (fbr *FeedbackResponder) ConfigureInterval(interval int) (err error) {
 func (fbr *FeedbackResponder) initialiseSources() (err error) {
 	fbr.mutex.Lock()
 	defer fbr.mutex.Unlock()
+	fbr.cache.invalidate()
+	// Standardise the monitor names used as source keys, in case these
+	// were supplied in a different case from the monitor names.
+	fbr.FeedbackSources, _, err = NormaliseNameMap(fbr.FeedbackSources, "source")
+	if err != nil {
+		return
+	}
 	// Initialise monitors specified for this responder.
 	totalSignificance := 0.0
 	for key, source := range fbr.FeedbackSources {
@@ -371,6 +562,20 @@ func (fbr *FeedbackResponder) initialiseSources() (err error) {
 			)
 			return
 		}
+		if source.RawThreshold < 0 {
+			err = errors.New(
+				"'" + key + "': raw threshold out of range: " +
+					"cannot be negative",
+			)
+			return
+		}
+		source.actionMask, err = ParseThresholdAction(source.ThresholdAction)
+		if err != nil {
+			err = errors.New("'" + key + "': " + err.Error())
+			return
+		}
+		source.ThresholdAction = fbr.CommandMaskToString(source.actionMask,
+			HAPMaskCommand, HAPOfflineFlag)
 		source.Monitor = monitor
 		// Add this significance to the total so that we can calculate
 		// the fraction that each monitor represents of the total significance
@@ -379,34 +584,32 @@ func (fbr *FeedbackResponder) initialiseSources() (err error) {
 		// Log details of this source so the user can see what's configured
 		// when the agent is configured.
 	}
-	logrus.Info(fbr.getLogHead() + ": calculating relative significances, " +
+	fbr.logger().Info(fbr.getLogHead() + ": calculating relative significances, " +
 		"total " + fmt.Sprintf("%.2f", totalSignificance) + ".")
 
 	// Set the scaled significance for each source monitor, i.e. the fraction
 	// of the total significance values specified that each monitor represents.
 	for key, source := range fbr.FeedbackSources {
 		source.RelativeSignificance = source.Significance / totalSignificance
-		logrus.Info("Responder '" + fbr.ResponderName +
-			"': name '" + key + "', type '" +
-			source.Monitor.MetricType + "': " +
-			fmt.Sprintf("%.2f", source.Significance) +
-			" -> relative " +
-			fmt.Sprintf("%.2f", source.RelativeSignificance) + ".",
+		fbr.logger().WithField(LogFieldMonitor, key).Info(
+			"Responder '" + fbr.ResponderName + "': name '" + key + "', type '" +
+				source.Monitor.MetricType + "': " +
+				fmt.Sprintf("%.2f", source.Significance) +
+				" -> relative " +
+				fmt.Sprintf("%.2f", source.RelativeSignificance) + ".",
 		)
 	}
 	return
 }
 
 func (fbr *FeedbackResponder) AddFeedbackSource(name string,
-	significance *float64, maxValue *int64, threshold *int) (err error) {
+	significance *float64, maxValue *int64, threshold *int,
+	rawThreshold *int64, action *string) (err error) {
 	fbr.mutex.Lock()
 	defer fbr.mutex.Unlock()
-	name = strings.TrimSpace(name)
-	if name == "" {
-		err = errors.New(
-			fbr.getLogHead() +
-				": empty monitor name",
-		)
+	name, err = StandardiseNameIdentifier(name)
+	if err != nil {
+		err = errors.New(fbr.getLogHead() + ": monitor " + err.Error())
 		return
 	}
 	mon, exists := fbr.ParentAgent.Monitors[name]
@@ -445,6 +648,12 @@ func (fbr *FeedbackResponder) AddFeedbackSource(name string,
 		MaxValue:     metricMax,
 		Threshold:    int64(thresholdValue),
 	}
+	if rawThreshold != nil {
+		newSource.RawThreshold = *rawThreshold
+	}
+	if action != nil {
+		newSource.ThresholdAction = *action
+	}
 	fbr.FeedbackSources[name] = &newSource
 	fbr.mutex.Unlock()
 	// The initialiseSources() method of the responder also handles validation
@@ -459,9 +668,11 @@ func (fbr *FeedbackResponder) AddFeedbackSource(name string,
 }
 
 func (fbr *FeedbackResponder) EditFeedbackSource(name string, significance *float64,
-	maxValue *int64, threshold *int) (err error) {
+	maxValue *int64, threshold *int, rawThreshold *int64, action *string) (
+	changed bool, err error) {
 	fbr.mutex.Lock()
 	defer fbr.mutex.Unlock()
+	name = strings.ToLower(strings.TrimSpace(name))
 	source, exists := fbr.FeedbackSources[name]
 	if !exists {
 		err = errors.New(
@@ -481,6 +692,16 @@ func (fbr *FeedbackResponder) EditFeedbackSource(name string, significance *floa
 	if threshold != nil {
 		source.Threshold = int64(*threshold)
 	}
+	if rawThreshold != nil {
+		source.RawThreshold = *rawThreshold
+	}
+	if action != nil {
+		source.ThresholdAction = *action
+	}
+	if *source == unedited {
+		return
+	}
+	changed = true
 	fbr.FeedbackSources[name] = source
 	fbr.mutex.Unlock()
 	err = fbr.initialiseSources()
@@ -495,6 +716,7 @@ func (fbr *FeedbackResponder) EditFeedbackSource(name string, significance *floa
 func (fbr *FeedbackResponder) DeleteFeedbackSource(name string) (err error) {
 	fbr.mutex.Lock()
 	defer fbr.mutex.Unlock()
+	name = strings.ToLower(strings.TrimSpace(name))
 	_, exists := fbr.FeedbackSources[name]
 	if !exists {
 		err = errors.New(
@@ -504,6 +726,14 @@ func (fbr *FeedbackResponder) DeleteFeedbackSource(name string) (err error) {
 		)
 		return
 	}
+	err = fbr.checkAggregationSource(name)
+	if err != nil {
+		return
+	}
+	err = fbr.checkRouteSource(name)
+	if err != nil {
+		return
+	}
 	delete(fbr.FeedbackSources, name)
 	fbr.mutex.Unlock()
 	err = fbr.initialiseSources()
@@ -548,17 +778,30 @@ func (fbr *FeedbackResponder) setHAPCommandMask(commands string,
 			changeMask |= enum
 		}
 	}
+	if err != nil {
+		return
+	}
 	// Mask off the enum flags (as we don't want these in the field)
 	changeMask &= HAPMaskCommand
 	// If setting these commands, OR the change mask into the current
 	// command mask, otherwise AND NOT to unset them.
+	newMask := fbr.configCommandMask
 	if replace {
-		fbr.configCommandMask = changeMask
+		newMask = changeMask
 	} else if !unset {
-		fbr.configCommandMask |= changeMask
+		newMask |= changeMask
 	} else {
-		fbr.configCommandMask &= ^changeMask
+		newMask &= ^changeMask
 	}
+	// Reject any contradictory combination before applying it.
+	err = CheckCommandConflicts(newMask)
+	if err != nil {
+		return
+	}
+	fbr.configCommandMask = newMask
+	fbr.cache.invalidate()
+	fbr.OnlineCommands = fbr.GenerateCommandString(true, newMask)
+	fbr.OfflineCommands = fbr.GenerateCommandString(false, newMask)
 	// Convert the resulting command mask back to a string so that the
 	// JSON configuration reflects this new state.
 	if commands == HAPConfigNone || commands == HAPConfigDefault {
@@ -573,6 +816,127 @@ func (fbr *FeedbackResponder) setHAPCommandMask(commands string,
 	return
 }
 
+// commandsInGroup returns the commands of a group which are enabled in a
+// command mask for the specified state (online or offline).
+func commandsInGroup(commandMask int, group []int, state int) (
+	commands []string) {
+	for _, enum := range group {
+		if enum&state > 0 && enum&commandMask == enum&HAPMaskCommand {
+			commands = append(commands, enumToCommand[enum])
+		}
+	}
+	return
+}
+
+// CheckCommandConflicts returns an error if a command mask would send
+// contradictory HAProxy commands in the same state, such as both 'drain'
+// and 'maint' when offline, which would leave the resulting server state
+// dependent upon the order in which HAProxy applies them.
+func CheckCommandConflicts(commandMask int) (err error) {
+	for _, state := range []int{HAPOnlineFlag, HAPOfflineFlag} {
+		stateName := "online"
+		if state == HAPOfflineFlag {
+			stateName = "offline"
+		}
+		operational := commandsInGroup(commandMask, hapOperationalCommands, state)
+		admin := commandsInGroup(commandMask, hapAdminCommands, state)
+		if len(operational) > 1 {
+			err = errors.New("conflicting " + stateName + " HAProxy commands '" +
+				strings.Join(operational, " ") + "'; only one operational " +
+				"state can be set at a time")
+		} else if len(admin) > 1 {
+			err = errors.New("conflicting " + stateName + " HAProxy commands '" +
+				strings.Join(admin, " ") + "'; only one administrative " +
+				"state can be set at a time")
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// thresholdActionSeverity lists the offline HAProxy commands in descending
+// order of severity, to choose between the actions of several sources which
+// have breached their thresholds at the same time.
+var thresholdActionSeverity = []int{
+	HAPEnumMaintenance, HAPEnumStopped, HAPEnumFail, HAPEnumDown, HAPEnumDrain,
+}
+
+// ParseThresholdAction translates the threshold action of a FeedbackSource,
+// a list of the offline HAProxy commands to send when the source breaches its
+// threshold, into a command mask. An empty action gives an empty mask, under
+// which the offline commands of the responder apply.
+func ParseThresholdAction(action string) (mask int, err error) {
+	trimmed := RemoveExtraSpaces(strings.ToLower(action))
+	if trimmed == "" || trimmed == HAPConfigNone {
+		return
+	}
+	for _, command := range strings.Split(trimmed, " ") {
+		enum, exists := commandToEnum[command]
+		if !exists || enum&HAPOfflineFlag == 0 {
+			err = errors.New("invalid threshold action '" + command +
+				"': must be one or more of '" + HAPCommandDown + "', '" +
+				HAPCommandDrain + "', '" + HAPCommandFail + "', '" +
+				HAPCommandMaintenance + "' or '" + HAPCommandStopped + "'")
+			return
+		}
+		mask |= enum
+	}
+	err = CheckCommandConflicts(mask & HAPMaskCommand)
+	mask &= HAPMaskCommand
+	return
+}
+
+// thresholdActionRank returns the severity of a threshold action mask, where
+// a lower rank is more severe; an empty mask ranks below any action.
+func thresholdActionRank(mask int) (rank int) {
+	for rank = range thresholdActionSeverity {
+		if mask&thresholdActionSeverity[rank]&HAPMaskCommand != 0 {
+			return
+		}
+	}
+	return len(thresholdActionSeverity)
+}
+
+// CommandWarnings returns descriptions of any HAProxy commands configured
+// for this FeedbackResponder which, whilst valid, are unlikely to have the
+// intended effect, such as an offline state that is never reversed when
+// the responder comes back online.
+func (fbr *FeedbackResponder) CommandWarnings() (warnings []string) {
+	fbr.mutex.Lock()
+	defer fbr.mutex.Unlock()
+	return fbr.commandWarnings()
+}
+
+// commandWarnings implements CommandWarnings(); the caller must hold the
+// mutex.
+func (fbr *FeedbackResponder) commandWarnings() (warnings []string) {
+	mask := fbr.configCommandMask
+	offlineOperational := commandsInGroup(mask, hapOperationalCommands,
+		HAPOfflineFlag)
+	offlineAdmin := commandsInGroup(mask, hapAdminCommands, HAPOfflineFlag)
+	if len(offlineOperational) > 0 && len(offlineAdmin) > 0 {
+		warnings = append(warnings, "offline commands '"+
+			fbr.GenerateCommandString(false, mask)+"' both take the server "+
+			"out of service and change its administrative state; '"+
+			offlineOperational[0]+"' stops all traffic at once, so '"+
+			offlineAdmin[0]+"' has no further effect")
+	}
+	if len(offlineOperational) > 0 && mask&HAPEnumUp&HAPMaskCommand == 0 {
+		warnings = append(warnings, "offline command '"+
+			offlineOperational[0]+"' is never reversed, as '"+HAPCommandUp+
+			"' is not an online command; the server will not return to "+
+			"service")
+	}
+	if len(offlineAdmin) > 0 && mask&HAPEnumReady&HAPMaskCommand == 0 {
+		warnings = append(warnings, "offline command '"+offlineAdmin[0]+
+			"' is never reversed, as '"+HAPCommandReady+"' is not an "+
+			"online command; the server will not return to service")
+	}
+	return
+}
+
 // Copy copies this FeedbackResponder into a new object.
 func (fbr *FeedbackResponder) Copy() (copy FeedbackResponder) {
 	fbr.mutex.Lock()
@@ -580,16 +944,21 @@ func (fbr *FeedbackResponder) Copy() (copy FeedbackResponder) {
 	copy = *fbr
 	copy.mutex = &sync.Mutex{}
 	copy.runState = false
+	copy.cancel = nil
+	copy.done = nil
+	copy.flapStop = nil
+	copy.cache = nil
 	return
 }
 
 // ParseNetworkPort parses a network port into a sanitised version, returning
-// an error if it cannot be parsed.
+// an error if it cannot be parsed. Port 0 requests an ephemeral port which
+// is assigned by the OS when the listener is bound.
 func ParseNetworkPort(port string) (result string, err error) {
 	// Validate and sanitise port
 	var parsedPort int
 	parsedPort, err = strconv.Atoi(strings.TrimSpace(port))
-	if err != nil || parsedPort < 1 || parsedPort > 65535 {
+	if err != nil || parsedPort < 0 || parsedPort > 65535 {
 		err = errors.New("invalid port '" + port + "'")
 		return
 	}
@@ -597,57 +966,268 @@ func ParseNetworkPort(port string) (result string, err error) {
 	return
 }
 
+// ParseIPAddress validates and sanitises the listen address(es) of a
+// Responder, which is either '*' for all addresses or a comma-separated
+// list of IP addresses and hostnames; IPv6 addresses may include a zone
+// (e.g. 'fe80::1%eth0') for link-local addresses. A hostname is resolved
+// each time the Responder starts, to listen on each of its addresses.
 func ParseIPAddress(ip string) (result string, err error) {
-	// Validate and sanitise IP address
+	addresses, err := ParseListenAddresses(ip)
+	if err != nil {
+		return
+	}
+	result = strings.Join(addresses, ",")
+	if result == "" {
+		result = "*"
+	}
+	return
+}
+
+// ParseListenAddresses parses a listen address specification as for
+// ParseIPAddress, returning each of the addresses to listen on, which is
+// a single empty address for the wildcard.
+func ParseListenAddresses(ip string) (addresses []string, err error) {
 	ip = strings.TrimSpace(ip)
 	// Handle a wildcard IP address specification
 	if ip == "*" {
-		result = "*"
+		addresses = []string{""}
 		return
 	}
-	// Otherwise, try to parse it
-	parsedIP := net.ParseIP(strings.TrimSpace(fmt.Sprint(ip)))
-	if parsedIP == nil {
-		err = errors.New(
-			"invalid IP address '" + ip +
-				"' specified; use 'any' (CLI) or '*' (API) to listen on all IPs",
-		)
+	for _, entry := range strings.Split(ip, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "*" {
+			err = errors.New("the wildcard address '*' cannot be " +
+				"combined with other addresses")
+			return
+		}
+		// Otherwise, try to parse it; IPv6 addresses may be bracketed.
+		var address string
+		parsedIP, parseErr := netip.ParseAddr(
+			strings.TrimSuffix(strings.TrimPrefix(entry, "["), "]"))
+		if parseErr == nil {
+			address = parsedIP.Unmap().String()
+		} else if IsValidHostname(entry) {
+			address = strings.ToLower(strings.TrimSuffix(entry, "."))
+		} else {
+			err = errors.New(
+				"invalid IP address or hostname '" + entry +
+					"' specified; use 'any' (CLI) or '*' (API) to listen on all IPs",
+			)
+			return
+		}
+		if slices.Contains(addresses, address) {
+			err = errors.New("IP address '" + address +
+				"' is specified more than once")
+			return
+		}
+		addresses = append(addresses, address)
+	}
+	return
+}
+
+// IsValidHostname returns whether a name is a valid DNS hostname, which
+// consists of dot-separated labels of letters, digits and hyphens, and is
+// not entirely numeric (so that it cannot be mistaken for an IP address).
+func IsValidHostname(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	numeric := true
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' ||
+			label[len(label)-1] == '-' {
+			return false
+		}
+		for _, char := range label {
+			switch {
+			case char >= '0' && char <= '9':
+			case (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') ||
+				char == '-':
+				numeric = false
+			default:
+				return false
+			}
+		}
+	}
+	return !numeric
+}
+
+// ListenAddresses returns each of the addresses that this Responder
+// listens on as configured, which is a single empty address for the
+// wildcard; these may include hostnames.
+func (fbr *FeedbackResponder) ListenAddresses() (addresses []string) {
+	addresses, err := ParseListenAddresses(fbr.ListenIPAddress)
+	if err != nil || len(addresses) == 0 {
+		addresses = []string{""}
+	}
+	return
+}
+
+// ParseCIDRList validates and sanitises a list of CIDR network ranges,
+// returning the parsed networks. Bare IP addresses are accepted and are
+// treated as a single-host range (/32 for IPv4, /128 for IPv6).
+func ParseCIDRList(list []string) (result []string, networks []*net.IPNet,
+	err error) {
+	for _, entry := range list {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				err = errors.New("invalid allowed address '" + entry + "'")
+				return
+			}
+			if ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		var network *net.IPNet
+		_, network, err = net.ParseCIDR(entry)
+		if err != nil {
+			err = errors.New("invalid allowed CIDR range '" + entry + "'")
+			return
+		}
+		result = append(result, network.String())
+		networks = append(networks, network)
+	}
+	return
+}
+
+// configureLimiter validates the connection limits for this responder and
+// creates or reconfigures its limiter. The caller must hold the mutex.
+func (fbr *FeedbackResponder) configureLimiter() (err error) {
+	if fbr.MaxConnections < 0 {
+		err = errors.New("invalid maximum connections; cannot be negative")
+		return
+	}
+	if fbr.MaxRequestRate < 0 {
+		err = errors.New("invalid maximum request rate; cannot be negative")
 		return
 	}
-	result = parsedIP.String()
+	if fbr.limiter == nil {
+		fbr.limiter = NewConnectionLimiter(fbr.MaxConnections, fbr.MaxRequestRate)
+	} else {
+		fbr.limiter.Configure(fbr.MaxConnections, fbr.MaxRequestRate)
+	}
 	return
 }
 
+// ErrClientNotAllowed is returned by AcquireConnection() for a client
+// outside the allowed CIDR ranges of a responder.
+var ErrClientNotAllowed = errors.New("client not in allowed ranges")
+
+// AcquireConnection checks a new client connection or request against the
+// allowed ranges and limits for this responder, returning a non-nil error
+// if it is refused. If successful, ReleaseConnection() must be called once
+// it is complete.
+func (fbr *FeedbackResponder) AcquireConnection(remoteAddr string) (err error) {
+	if !fbr.IsClientAllowed(remoteAddr) {
+		err = ErrClientNotAllowed
+		return
+	}
+	result := fbr.limiter.Acquire(remoteAddr)
+	if result != LimitAccepted {
+		err = errors.New(LimitResultToString(result))
+	}
+	return
+}
+
+// ReleaseConnection marks a connection or request accepted by
+// AcquireConnection() as complete.
+func (fbr *FeedbackResponder) ReleaseConnection() {
+	fbr.limiter.Release()
+}
+
+// GetConnectionStats returns the current connection counters.
+func (fbr *FeedbackResponder) GetConnectionStats() LimiterStats {
+	return fbr.limiter.Stats()
+}
+
+// IsClientAllowed checks a remote client address (in "host:port" form, as
+// provided by the net and net/http packages) against the allowed CIDR
+// ranges for this FeedbackResponder. If no ranges are configured, then all
+// clients are allowed.
+func (fbr *FeedbackResponder) IsClientAllowed(remoteAddr string) bool {
+	fbr.mutex.Lock()
+	networks := fbr.allowedNetworks
+	fbr.mutex.Unlock()
+	if len(networks) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	// Strip any IPv6 zone identifier before parsing.
+	host, _, _ = strings.Cut(host, "%")
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // Start starts the FeedbackResponder service, returning an error in the event
 // of failure, by launching the main code of the service as a goroutine.
 func (fbr *FeedbackResponder) Start() (err error) {
 	fbr.mutex.Lock()
 	defer fbr.mutex.Unlock()
 	logLine := fbr.getLogHead()
-	if len(fbr.FeedbackSources) < 1 &&
-		fbr.ProtocolName != ProtocolSecureAPI &&
-		fbr.ProtocolName != ProtocolLegacyAPI {
-		logrus.Warn(
+	if len(fbr.FeedbackSources) < 1 && !fbr.IsAPI() {
+		fbr.logger().Warn(
 			"Warning: " + logLine +
 				"currently has no monitor sources configured.",
 		)
 	}
+	for _, warning := range fbr.commandWarnings() {
+		fbr.logger().Warn("Warning: " + logLine + warning + ".")
+	}
 	// Create a new channel for us to know when the worker has initialised or failed.
-	initChannel := make(chan int)
-	// Launch the worker goroutine for this FeedbackResponder.
-	go fbr.run(initChannel)
+	initChannel := make(chan int, 1)
+	// Launch the worker goroutine for this FeedbackResponder, which runs
+	// until its context is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go fbr.run(ctx, initChannel, done)
 	fbr.mutex.Unlock()
 	// Wait on a result from the initialisation channel.
 	result := <-initChannel
 	fbr.mutex.Lock()
 	// Log the appropriate status.
 	if result == ServiceStateRunning && fbr.LastError == nil {
+		fbr.cancel = cancel
+		fbr.done = done
 		logLine += "has started (" + strings.ToUpper(fbr.ProtocolName) +
-			" on " + fbr.ListenIPAddress + ":" + fbr.ListenPort + ")."
-		logrus.Info(logLine)
+			" on " + fbr.describeListenAddresses() + ")."
+		fbr.logger().Info(logLine)
+		fbr.ParentAgent.recordServiceEvent(EventTypeServiceStarted,
+			"responder", fbr.ResponderName, logLine)
 	} else {
+		// If the listener failed as soon as it started, wait for the
+		// worker to stop, so that the responder is no longer running when
+		// this returns. The worker hands itself to the supervisor to
+		// retry, as the failure may be transient (e.g. the port is still
+		// in use by another process).
+		if result == ServiceStateRunning {
+			fbr.mutex.Unlock()
+			<-done
+			fbr.mutex.Lock()
+		}
+		cancel()
 		logLine += "failed to start, error: " + fbr.LastError.Error()
-		logrus.Error(logLine)
+		fbr.logger().Error(logLine)
+		fbr.ParentAgent.recordServiceEvent(EventTypeServiceFailed,
+			"responder", fbr.ResponderName, logLine)
 	}
 	// Return whatever the shared field holds for the worker error.
 	err = fbr.LastError
@@ -666,20 +1246,38 @@ func (fbr *FeedbackResponder) Restart() (err error) {
 	return
 }
 
-// Stop stops the service from running.
+// Stop stops the service from running, by cancelling the context of its
+// worker and waiting for it to drain its connections and stop. An error is
+// returned if the worker does not stop within the drain timeout plus the
+// stop timeout, rather than waiting indefinitely.
 func (fbr *FeedbackResponder) Stop() (err error) {
-	if fbr.IsRunning() {
-		fbr.mutex.Lock()
-		err = fbr.Connector.Close()
+	// Cancel any flap test, which fails harmlessly if none is running.
+	_ = fbr.StopFlapTest()
+	fbr.mutex.Lock()
+	if !fbr.runState || fbr.cancel == nil {
 		fbr.mutex.Unlock()
-		// Check for a successful stopped reply
-		// $$ TO DO: Implement sleep/timeout using select
-		for <-fbr.statusChannel != ServiceStateStopped {
-			// Wait on channel
-			// $$ TO DO: Avoid blocking in the event of malfunction.
-		}
-	} else {
 		err = errors.New("responder is not running")
+		return
+	}
+	cancel, done := fbr.cancel, fbr.done
+	fbr.cancel = nil
+	deadline := fbr.getDrainTimeout() + ResponderStopTimeout
+	fbr.mutex.Unlock()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(deadline):
+		err = errors.New("timed out waiting for responder to stop")
+	}
+	return
+}
+
+// getDrainTimeout returns the time for which in-flight requests are
+// allowed to complete when this FeedbackResponder is stopped.
+func (fbr *FeedbackResponder) getDrainTimeout() (timeout time.Duration) {
+	timeout = time.Duration(fbr.DrainTimeout)
+	if timeout == 0 {
+		timeout = DefaultDrainTimeout
 	}
 	return
 }
@@ -693,47 +1291,181 @@ func (fbr *FeedbackResponder) IsRunning() (state bool) {
 }
 
 // run is the function to call when the service starts; e.g.
-// the worker thread invoked using 'go'.
-func (fbr *FeedbackResponder) run(initChannel chan int) {
-	if initChannel == nil {
-		logrus.Error("FeedbackResponder: run: fatal: invalid channel")
-		return
-	}
+// the worker thread invoked using 'go'. It reports its initial state on
+// the init channel, and closes the done channel once it has stopped.
+func (fbr *FeedbackResponder) run(ctx context.Context, initChannel chan int,
+	done chan struct{}) {
 	// Start by obtaining the mutex lock before doing anything else.
 	fbr.mutex.Lock()
 	// Deferred actions to always perform when this worker
 	// goroutine terminates.
+	announced := false
 	defer func() {
-		// Handle if we exited due to a panic.
-		if recover() != nil {
-			fbr.LastError = errors.New("fatal error")
+		// Handle if we exited due to a panic, which is reported and
+		// (if we were running) handed to the supervisor to restart us.
+		if r := recover(); r != nil {
+			fbr.runState = false
+			fbr.BoundPort = ""
+			fbr.LastError = fbr.ParentAgent.reportPanic(LogFieldResponder,
+				fbr.ResponderName, r)
+			if !announced {
+				initChannel <- ServiceStateFailed
+			} else if ctx.Err() == nil {
+				fbr.ParentAgent.serviceFailed(LogFieldResponder,
+					fbr.ResponderName, fbr.startTime, fbr.LastError)
+			}
 		}
 		// Release the mutex and signal that we've stopped.
 		fbr.mutex.Unlock()
-		initChannel <- ServiceStateStopped
+		close(done)
 	}()
 	// Check to see if we're already in a run state
 	if fbr.runState {
 		fbr.LastError = errors.New("already running")
+		initChannel <- ServiceStateFailed
 		return
 	}
 	// -- Prepare to go into a running state.
 	fbr.LastError = nil
-	fbr.statusChannel = initChannel
 	fbr.runState = true
+	fbr.handingOver = false
+	if !fbr.startTime.IsZero() {
+		fbr.restartCount++
+	}
+	fbr.startTime = time.Now()
+	connector := fbr.Connector
+	drainTimeout := fbr.getDrainTimeout()
+	drainMonitor := fbr.DrainMonitor
 	fbr.mutex.Unlock()
 	// Initialise the current command state of the responder.
 	fbr.SetCommandState(true, false, HAPEnumNone)
+	// Once the context is cancelled, stop accepting new connections and
+	// allow those in flight to complete; the mutex must not be held, as
+	// responses require it.
+	listening := make(chan struct{})
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		select {
+		case <-ctx.Done():
+			fbr.mutex.Lock()
+			handingOver := fbr.handingOver
+			fbr.mutex.Unlock()
+			if handingOver {
+				time.Sleep(HandoverDrainDelay)
+			}
+			drainErr := connector.Shutdown(drainTimeout)
+			if drainErr != nil {
+				fbr.logger().Warn(fbr.getLogHead() +
+					"was not stopped cleanly: " + drainErr.Error() + ".")
+			}
+		case <-listening:
+		}
+	}()
+	// Watch for the completion of any drain, if a monitor is set for this.
+	if drainMonitor != "" {
+		go fbr.watchDrain(ctx, drainMonitor)
+	}
 	// -- We are now running.
 	// Announce that we are now running to whatever called us.
-	fbr.statusChannel <- ServiceStateRunning
+	initChannel <- ServiceStateRunning
+	announced = true
 	// Call the Listen() method of the protocol connector, which
-	// will block here until it quits.
-	fbr.LastError = fbr.Connector.Listen(fbr)
+	// will block here until it quits, and then wait for any drain.
+	fbr.LastError = fbr.listen(connector)
+	close(listening)
+	<-drained
 	// -- Go to a non-running state.
 	fbr.mutex.Lock()
 	fbr.runState = false
-	logrus.Info(fbr.getLogHead() + "has stopped.")
+	fbr.BoundPort = ""
+	// Closing the listener is the normal way of stopping, not an error.
+	if errors.Is(fbr.LastError, net.ErrClosed) ||
+		errors.Is(fbr.LastError, http.ErrServerClosed) {
+		fbr.LastError = nil
+	}
+	fbr.logger().Info(fbr.getLogHead() + "has stopped.")
+	fbr.ParentAgent.recordServiceEvent(EventTypeServiceStopped, "responder",
+		fbr.ResponderName, fbr.getLogHead()+"has stopped.")
+	// If we weren't asked to stop, the listener has failed, so hand over
+	// to the supervisor to restart us.
+	if ctx.Err() == nil {
+		fbr.ParentAgent.serviceFailed(LogFieldResponder, fbr.ResponderName,
+			fbr.startTime, fbr.LastError)
+	}
+}
+
+// listen calls the Listen() method of a protocol connector, reporting a
+// panic within it as an error, after shutting the connector down so that
+// its listeners are released before the worker is restarted.
+func (fbr *FeedbackResponder) listen(connector ProtocolConnector) (err error) {
+	if !PanicDebug {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fbr.ParentAgent.reportPanic(LogFieldResponder,
+					fbr.ResponderName, r)
+				_ = connector.Shutdown(0)
+			}
+		}()
+	}
+	err = connector.Listen(fbr)
+	return
+}
+
+// SetBoundAddress is called by a ProtocolConnector once its listener has
+// been bound, to record the port assigned by the OS if an ephemeral port
+// (port 0) was requested.
+func (fbr *FeedbackResponder) SetBoundAddress(addr net.Addr) {
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return
+	}
+	fbr.mutex.Lock()
+	defer fbr.mutex.Unlock()
+	if fbr.ListenPort != "0" {
+		return
+	}
+	fbr.BoundPort = port
+	fbr.logger().Info(fbr.getLogHead() + "was assigned ephemeral port " +
+		port + ".")
+}
+
+// GetActivePort returns the port that this FeedbackResponder is listening
+// on, which is the assigned port if an ephemeral port was requested.
+func (fbr *FeedbackResponder) GetActivePort() (port string) {
+	fbr.mutex.Lock()
+	defer fbr.mutex.Unlock()
+	port = fbr.ListenPort
+	if fbr.BoundPort != "" {
+		port = fbr.BoundPort
+	}
+	return
+}
+
+// describeListenAddresses returns the addresses that this Responder
+// listens on, in the form 'host:port' and separated by commas. The caller
+// must hold the mutex.
+func (fbr *FeedbackResponder) describeListenAddresses() string {
+	if fbr.isVirtual() {
+		return "the listener of responder '" + fbr.Listener + "'"
+	}
+	port := fbr.ListenPort
+	if fbr.BoundPort != "" {
+		port = fbr.BoundPort
+	}
+	addresses := fbr.ListenAddresses()
+	for i, address := range addresses {
+		if address == "" {
+			address = "*"
+		}
+		addresses[i] = net.JoinHostPort(address, port)
+	}
+	return strings.Join(addresses, ", ")
+}
+
+// logger returns a log entry tagged with the name of this FeedbackResponder.
+func (fbr *FeedbackResponder) logger() *logrus.Entry {
+	return logrus.WithField(LogFieldResponder, fbr.ResponderName)
 }
 
 // getLogHead is a utility function for the start of log entries for this FeedbackResponder.
@@ -745,10 +1477,22 @@ func (fbr *FeedbackResponder) getLogHead() string {
 func (fbr *FeedbackResponder) SetCommandState(isOnline bool, force bool, overrideMask int) {
 	fbr.mutex.Lock()
 	defer fbr.mutex.Unlock()
+	fbr.setCommandState(isOnline, force, overrideMask)
+}
+
+// setCommandState sets the command state, replacing any forced override
+// and its expiry. The caller must hold the mutex.
+func (fbr *FeedbackResponder) setCommandState(isOnline bool, force bool, overrideMask int) {
 	fbr.onlineState = isOnline
 	fbr.forceCommandState = force
 	fbr.overrideMask = overrideMask & HAPMaskCommand
+	fbr.forceSince = time.Time{}
+	fbr.forceExpiry = time.Time{}
+	if force {
+		fbr.forceSince = time.Now()
+	}
 	fbr.resetStateExpiry()
+	fbr.cache.invalidate()
 }
 
 // resetStateExpiry resets the current command state expiry only.
@@ -767,6 +1511,7 @@ func (fbr *FeedbackResponder) ConfigureThresholdValue(threshold int) (err error)
 	fbr.mutex.Lock()
 	defer fbr.mutex.Unlock()
 	fbr.ThresholdScore = threshold
+	fbr.cache.invalidate()
 	return
 }
 
@@ -776,6 +1521,18 @@ func (fbr *FeedbackResponder) ConfigureThresholdValue(threshold int) (err error)
 // given metric, adjusted by a relative significance score (scaled proportion
 // of the total significance for all monitors attached to this responder).
 func (fbr *FeedbackResponder) GetAvailabilityState() (availability int, online bool, logText string) {
+	availability, online, _, logText = fbr.evaluateAvailability(nil)
+	return
+}
+
+// evaluateAvailability calculates the availability state as described for
+// GetAvailabilityState(), also returning the threshold action of the most
+// severe source to have breached its threshold (or an empty mask if none of
+// these has an action configured). If a map of breaches is given, whether
+// each source has breached its thresholds is recorded in it by name.
+func (fbr *FeedbackResponder) evaluateAvailability(
+	breaches map[string]bool) (availability int, online bool, actionMask int,
+	logText string) {
 	// Calculate the overall total load across all monitors by scaling
 	// against their maximum value, and then their relative significance.
 	// Formula:
@@ -791,45 +1548,113 @@ func (fbr *FeedbackResponder) GetAvailabilityState() (availability int, online b
 	// The sum of all load values from each source, multiplied by the relative significance.
 	overallLoad := 0
 	metricLog, anyLog, overallLog := "", "", ""
+	// The threshold may vary according to the schedule, if configured.
+	threshold := fbr.currentThreshold()
+	// The load of each source by name, for any other aggregation function.
+	loads := make(map[string]float64, len(fbr.FeedbackSources))
 	// Process the current load values for all feedback sources.
-	for _, source := range fbr.FeedbackSources {
+	for name, source := range fbr.FeedbackSources {
 		// Get source load and add into the overall load scaled by its significance.
 		sourceLoad := getSourceLoad(source)
+		breached := false
 		// Check to see if any per-source thresholds have been exceeded, if enabled.
 		if fbr.isMetricThresholdEnabled() {
 			exceeded, msg := fbr.getThresholdStatus("metric: source '"+
 				source.Monitor.Name+"'",
 				int(source.Threshold), sourceLoad)
 			if exceeded {
-				online = false
+				breached = true
 			}
 			metricLog += msg + "\n"
+			// Check the raw value of the source against its raw threshold,
+			// if one is set, independently of the max value scaling.
+			if source.RawThreshold > 0 {
+				exceeded, msg = getRawThresholdStatus("metric: source '"+
+					source.Monitor.Name+"'", source.RawThreshold,
+					source.Monitor.StatsModel.GetResult())
+				if exceeded {
+					breached = true
+				}
+				metricLog += msg + "\n"
+			}
 		}
 		// Check if we are looking for any threshold value, and if it has been exceeded.
 		if fbr.isAnyThresholdEnabled() {
 			exceeded, msg := fbr.getThresholdStatus("any: source '"+
 				source.Monitor.Name+"'",
-				fbr.ThresholdScore, sourceLoad)
+				threshold, sourceLoad)
 			if exceeded {
-				online = false
+				breached = true
 			}
 			anyLog += msg + "\n"
 		}
+		// The failure policy of the monitor, if its data is stale, may take
+		// the Responder offline regardless of the thresholds.
+		if source.Monitor.failurePolicy() == FailurePolicyOffline {
+			online = false
+			metricLog += "stale: source '" + source.Monitor.Name +
+				"': data is stale; failure policy is offline\n"
+		}
+		if breaches != nil {
+			breaches[name] = breached
+		}
+		// A breach by this source applies its own threshold action, if it
+		// is more severe than that of any other source breached so far.
+		if breached {
+			online = false
+			if source.actionMask != HAPEnumNone &&
+				thresholdActionRank(source.actionMask) <
+					thresholdActionRank(actionMask) {
+				actionMask = source.actionMask
+			}
+		}
 		// Add this source's load to the overall load, scaled by the significance.
 		overallLoad += int(float64(sourceLoad) * source.RelativeSignificance)
+		loads[name] = float64(sourceLoad)
+	}
+	// Replace the weighted mean if another aggregation function is set.
+	if fbr.Aggregation != "" {
+		aggregated, msg := fbr.aggregateLoad(loads)
+		overallLoad = int(math.Round(aggregated))
+		overallLog += msg + "\n"
 	}
 	// Check the overall threshold, if applicable.
 	if fbr.isOverallThresholdEnabled() {
 		exceeded, msg := fbr.getThresholdStatus("overall",
-			fbr.ThresholdScore, overallLoad)
+			threshold, overallLoad)
 		if exceeded {
 			online = false
 		}
 		overallLog += msg + "\n"
 	}
 	logText = anyLog + metricLog + overallLog
-	// Invert the overall load percentage to give the availability.
-	availability = 100 - overallLoad
+	// Map the overall load percentage to the availability using the weight
+	// curve, which by default simply inverts it.
+	availability = fbr.mapWeight(overallLoad)
+	return
+}
+
+// currentThreshold returns the threshold which currently applies to this
+// FeedbackResponder, logging whenever the schedule changes it. The caller
+// must hold the mutex.
+func (fbr *FeedbackResponder) currentThreshold() (threshold int) {
+	threshold, window := fbr.EffectiveThreshold(time.Now())
+	if len(fbr.ThresholdSchedule) == 0 {
+		return
+	}
+	active := ""
+	if window != nil {
+		active = window.String()
+	}
+	if active != fbr.activeWindow {
+		fbr.activeWindow = active
+		source := "global threshold"
+		if window != nil {
+			source = "schedule window '" + active + "'"
+		}
+		fbr.logger().Info(fbr.getLogHead() + "threshold is now " +
+			strconv.Itoa(threshold) + "% (" + source + ").")
+	}
 	return
 }
 
@@ -862,6 +1687,9 @@ func getSourceLoad(source *FeedbackSource) (load int) {
 	} else if load < 0 {
 		load = 0
 	}
+	// Replace the load if the data of the monitor is stale, according to
+	// its failure policy.
+	load = applyFailurePolicy(source, load)
 	return
 }
 
@@ -886,34 +1714,122 @@ func (fbr *FeedbackResponder) getThresholdStatus(name string, threshold int, loa
 	return
 }
 
+// getRawThresholdStatus compares the raw value of a source against its raw
+// threshold, which is exceeded if the value is greater than it.
+func getRawThresholdStatus(name string, threshold int64, value int64) (
+	exceeded bool, msg string) {
+	msg = name + ": raw value (" + strconv.FormatInt(value, 10) + ") "
+	if value > threshold {
+		msg += "has exceeded"
+		exceeded = true
+	} else {
+		msg += "is within"
+	}
+	msg += " raw threshold (" + strconv.FormatInt(threshold, 10) + ")"
+	return
+}
+
 // HandleFeedback generates a feedback string for this FeedbackResponder.
 // It also changes the current online state as of the last query so that
 // a command is sent for a specified period of time from the first request.
-func (fbr *FeedbackResponder) HandleFeedback() (feedback string) {
+// If CacheFeedback is enabled, the response is reused until a source
+// monitor may have taken a new sample; history is then only recorded when
+// the response is recalculated. The state from which the response was
+// produced is also returned.
+func (fbr *FeedbackResponder) HandleFeedback() (feedback string,
+	state FeedbackState) {
 	timestamp := time.Now()
+	// If caching is enabled, serve the last response until it expires,
+	// without taking the mutex.
+	if fbr.CacheFeedback {
+		var cached bool
+		feedback, state, cached = fbr.cache.get(timestamp)
+		if cached {
+			return
+		}
+	}
 	fbr.mutex.Lock()
 	defer fbr.mutex.Unlock()
-	availability, thresholdState, logMessage := fbr.GetAvailabilityState()
-	feedback = strconv.Itoa(availability) + "%"
+	availability, commands, send := fbr.updateFeedbackState(timestamp)
+	state = FeedbackState{Availability: availability, Online: fbr.onlineState}
+
+	// A response template, if set, replaces the default response.
+	if fbr.responseTemplate != nil {
+		var err error
+		feedback, err = fbr.formatTemplate(timestamp, availability,
+			commands, send)
+		if err == nil {
+			if fbr.CacheFeedback {
+				fbr.cache.set(feedback, state, fbr.getCacheExpiry(timestamp))
+			}
+			return
+		}
+		fbr.logger().Error(fbr.getLogHead() + "failed to execute the " +
+			"response template: " + err.Error())
+	}
+
+	feedback = fbr.formatFeedback(fbr.FeedbackFormat, availability, commands,
+		send)
+	if fbr.CacheFeedback {
+		fbr.cache.set(feedback, state, fbr.getCacheExpiry(timestamp))
+	}
+	return
+}
+
+// updateFeedbackState evaluates the availability of this FeedbackResponder
+// for a feedback request at a given time, changing its command state if
+// required, and returns the availability along with the HAProxy commands
+// for the current state and whether these are to be sent in the response.
+// The caller must hold the mutex.
+func (fbr *FeedbackResponder) updateFeedbackState(timestamp time.Time) (
+	availability int, commands string, send bool) {
+	availability, thresholdState, actionMask, logMessage :=
+		fbr.evaluateAvailability(nil)
+	fbr.ParentAgent.recordHistory("responder", fbr.ResponderName, timestamp,
+		float64(availability))
+
+	// A forced override given a duration ends once that has passed.
+	fbr.expireOverride(timestamp)
 
 	// First, work out if we should change state based on the threshold.
 	// We do so if the threshold is enabled, the current threshold state
 	// has changed, and we aren't in a forced command that hasn't yet
-	// expired.
+	// expired (or been forced for a duration) or a flap test.
 	if ((fbr.thresholdModeEnum != ThresholdModeNone) &&
-		(thresholdState != fbr.onlineState)) &&
-		(!fbr.forceCommandState || (timestamp.After(fbr.stateExpiry) &&
+		(thresholdState != fbr.onlineState)) && fbr.flapStop == nil &&
+		(!fbr.forceCommandState || (fbr.forceExpiry.IsZero() &&
+			timestamp.After(fbr.stateExpiry) &&
 			(fbr.onlineState || fbr.EnableOfflineInterval))) {
 		// SetHACommandState() is used by external code, so it
 		// locks and unlocks the responder mutex itself. This means
 		// we need to release the mutex first before calling it
 		// and locking again for the final defer.
 		fbr.mutex.Unlock()
-		fbr.SetCommandState(thresholdState, false, HAPEnumNone)
+		fbr.SetCommandState(thresholdState, false, actionMask)
+		fbr.recordThresholdCrossed(availability, thresholdState)
 		if fbr.LogStateChanges {
-			logrus.Info(fbr.getLogHead() + "has changed threshold state:\n" + logMessage)
+			fbr.logger().WithFields(logrus.Fields{
+				LogFieldScore:  availability,
+				LogFieldOnline: thresholdState,
+			}).Info(fbr.getLogHead() + "has changed threshold state:\n" + logMessage)
 		}
 		fbr.mutex.Lock()
+	} else if fbr.thresholdModeEnum != ThresholdModeNone && !thresholdState &&
+		!fbr.onlineState && !fbr.forceCommandState && fbr.flapStop == nil &&
+		actionMask != fbr.overrideMask {
+		// While offline by threshold, the set of breached sources may
+		// change, such as when a more severe source also breaches, so
+		// send the commands for the action which now applies.
+		fbr.setCommandState(false, false, actionMask)
+		if fbr.LogStateChanges {
+			action := fbr.CommandMaskToString(actionMask, HAPMaskCommand,
+				HAPOfflineFlag)
+			if action == "" {
+				action = HAPConfigDefault
+			}
+			fbr.logger().Info(fbr.getLogHead() + "has changed threshold " +
+				"action to '" + action + "':\n" + logMessage)
+		}
 	}
 
 	// Next, work out whether we send a command for the current state
@@ -929,36 +1845,141 @@ func (fbr *FeedbackResponder) HandleFeedback() (feedback string) {
 		} else {
 			mask = fbr.configCommandMask
 		}
-		feedback = fbr.GenerateCommandString(fbr.onlineState, mask) +
-			" " + feedback
+		commands = fbr.GenerateCommandString(fbr.onlineState, mask)
+		send = true
 	}
-	// The HAProxy specs call for a final newline to be sent.
-	feedback += "\n"
 	return
 }
 
+// FeedbackState is the availability and command state from which a
+// feedback response was produced, which HTTP(S) Responders may also give
+// as the status of the response.
+type FeedbackState struct {
+	Availability int
+	Online       bool
+}
+
 // GetResponse gets a string response from this FeedbackResponder, which will depend
 // on its configuration and what it is supposed to do.
 func (fbr *FeedbackResponder) GetResponse(request string) (response string,
 	quitAfter bool) {
-	if !PanicDebug {
-		defer func() {
-			err := recover()
-			if err != nil {
-				logrus.Error("An internal error occurred during a " +
-					"response:\n   " + fmt.Sprint(err),
-				)
+	response, _, quitAfter = fbr.respond(request, nil, false)
+	return
+}
+
+// GetHTTPResponse gets the feedback of this FeedbackResponder for an
+// HTTP(S) request, for one of its routes if given, and as a JSON report if
+// requested, along with the state from which it was produced.
+func (fbr *FeedbackResponder) GetHTTPResponse(request string,
+	route *FeedbackRoute, asJSON bool) (response string,
+	state FeedbackState) {
+	response, state, _ = fbr.respond(request, route, asJSON)
+	return
+}
+
+// respond answers a request to this FeedbackResponder, giving its feedback
+// for a route if given, or as a JSON report if requested, and recording the
+// request metrics. The state is not given for the API.
+func (fbr *FeedbackResponder) respond(request string, route *FeedbackRoute,
+	asJSON bool) (
+	response string, state FeedbackState, quitAfter bool) {
+	// Count the request once answered; this is deferred before recovering
+	// so that it sees whether a panic occurred.
+	started := time.Now()
+	failed := true
+	var span *otelSpan
+	if !fbr.IsAPI() {
+		span = fbr.ParentAgent.startSpan("feedback", otelSpanKindServer)
+	}
+	defer func() {
+		fbr.stats.record(time.Since(started), failed)
+		if span != nil {
+			span.setAttribute("lbfeedback.responder", fbr.ResponderName)
+			span.setAttribute("lbfeedback.protocol", fbr.ProtocolName)
+			span.setAttribute("lbfeedback.feedback",
+				strings.TrimSpace(response))
+			var err error
+			if failed {
+				err = errors.New("internal error")
 			}
-		}()
+			span.end(err)
+		}
+	}()
+	if !PanicDebug {
+		defer fbr.recoverPanic(nil)
 	}
 	if fbr.ProtocolName == ProtocolSecureAPI || fbr.ProtocolName == ProtocolLegacyAPI {
-		response, _, quitAfter = fbr.ParentAgent.ReceiveAPIRequest(request)
+		response, _, quitAfter = fbr.ParentAgent.receiveAPIRequest(request,
+			fbr.ProtocolName == ProtocolLegacyAPI)
+	} else if route != nil {
+		response, state = fbr.HandleRouteFeedback(route, asJSON)
+	} else if asJSON {
+		response, state = fbr.HandleFeedbackJSON()
 	} else {
-		response = fbr.HandleFeedback()
+		response, state = fbr.HandleFeedback()
 	}
+	fbr.markResponded()
+	failed = false
 	return
 }
 
+// IsAPI returns whether this FeedbackResponder serves the API (over JSON
+// or gRPC) rather than feedback.
+func (fbr *FeedbackResponder) IsAPI() bool {
+	return fbr.ProtocolName == ProtocolSecureAPI ||
+		fbr.ProtocolName == ProtocolLegacyAPI ||
+		fbr.ProtocolName == ProtocolGRPC
+}
+
+// markResponded records the time at which this FeedbackResponder last
+// answered a request, for the service status.
+func (fbr *FeedbackResponder) markResponded() {
+	atomic.StoreInt64(&fbr.lastResponse, time.Now().UnixNano())
+}
+
+// fillServiceStatus adds the details of the running state of this
+// FeedbackResponder to its entry in the service status.
+func (fbr *FeedbackResponder) fillServiceStatus(status *APIServiceStatus) {
+	fbr.mutex.Lock()
+	defer fbr.mutex.Unlock()
+	if fbr.LastError != nil {
+		status.LastError = fbr.LastError.Error()
+	}
+	if !fbr.startTime.IsZero() {
+		startTime := fbr.startTime
+		status.StartTime = &startTime
+		if fbr.runState {
+			status.UptimeSeconds = int64(time.Since(startTime).Seconds())
+		}
+	}
+	status.RestartCount = fbr.restartCount
+	if last := atomic.LoadInt64(&fbr.lastResponse); last != 0 {
+		lastResponse := time.Unix(0, last)
+		status.LastResponse = &lastResponse
+	}
+	if fbr.isVirtual() {
+		status.Address = "via " + fbr.Listener
+	} else {
+		status.Address = fbr.describeListenAddresses()
+	}
+	if fbr.IsAPI() {
+		return
+	}
+	availability, _, _ := fbr.GetAvailabilityState()
+	status.Availability = &availability
+	status.CommandState = "online"
+	if !fbr.onlineState {
+		mask := fbr.configCommandMask
+		if fbr.overrideMask != HAPEnumNone {
+			mask = fbr.overrideMask
+		}
+		status.CommandState = overrideStateName(false, mask)
+	}
+	status.Forced = fbr.forceCommandState
+	status.OnlineCommands = fbr.OnlineCommands
+	status.OfflineCommands = fbr.OfflineCommands
+}
+
 // GenerateCommandString generates an HAProxy command string based on the current
 // command mask and a specified online state.
 func (fbr *FeedbackResponder) GenerateCommandString(online bool, currentMask int) (
@@ -997,8 +2018,7 @@ func (fbr *FeedbackResponder) ConfigureThresholdMode(name string) (err error) {
 		// Set to default if no threshold string is currently configured.
 		name = ThresholdStringNone
 	}
-	if (fbr.ProtocolName == ProtocolSecureAPI || fbr.ProtocolName == ProtocolLegacyAPI) &&
-		name != ThresholdStringNone {
+	if fbr.IsAPI() && name != ThresholdStringNone {
 		err = errors.New("no threshold mode other than '" + ThresholdStringNone +
 			"' is valid for an API responder")
 		return
@@ -1010,5 +2030,6 @@ func (fbr *FeedbackResponder) ConfigureThresholdMode(name string) (err error) {
 	}
 	fbr.thresholdModeEnum = mode
 	fbr.ThresholdModeName = name
+	fbr.cache.invalidate()
 	return
 }
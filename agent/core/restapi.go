@@ -0,0 +1,710 @@
+// restapi.go
+// REST-Style Routes for the Feedback Agent API
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Besides the JSON action tree (where every request is POSTed to the root),
+// API Responders serve REST-style routes beneath RESTPathPrefix, which map
+// a method and path onto the same actions, for ease of use with standard
+// HTTP tooling. Settings are given in the body as in the JSON API (e.g.
+// '{"metric-type": "cpu"}'), and the API key in an X-API-Key header or as
+// a bearer token.
+//
+//	GET    /v1/status, /v1/info, /v1/config, /v1/events, /v1/headroom
+//	PUT    /v1/config                                (desired state)
+//	POST   /v1/config/{reload|rollback|validate|save}
+//	GET    /v1/{monitors|responders}[/{name}]
+//	PUT    /v1/{monitors|responders}/{name}          (create or update)
+//	PATCH  /v1/{monitors|responders}/{name}          (update)
+//	DELETE /v1/{monitors|responders}/{name}
+//	POST   /v1/{monitors|responders}/{name}/actions/{action}
+//	GET    /v1/responders/{name}/{feedback|headroom|simulate}
+//	PUT    /v1/responders/{name}/{threshold|commands}
+//	GET    /v1/responders/{name}/sources[/{monitor}]
+//	PUT    /v1/responders/{name}/sources/{monitor}
+//	DELETE /v1/responders/{name}/sources/{monitor}
+//	POST   /v1/actions/{action}                      (all Responders)
+//
+// Monitors and Responders are returned as their configuration, and other
+// requests as the usual API response. Failures are always returned as an
+// API response, with the HTTP status reflecting the cause.
+
+const (
+	// Prefix of the paths of the REST-style API routes.
+	RESTPathPrefix = "/v1/"
+)
+
+// restActions maps the actions that can be performed on a Responder
+// through the REST-style routes onto the action and type of the
+// equivalent API request.
+var restActions = map[string][2]string{
+	"start":        {"start", "responder"},
+	"stop":         {"stop", "responder"},
+	"restart":      {"restart", "responder"},
+	"drain":        {"force", "drain"},
+	"halt":         {"force", "halt"},
+	"online":       {"force", "online"},
+	"send-online":  {"send", "online"},
+	"send-offline": {"send", "offline"},
+	"cancel":       {"cancel", "override"},
+}
+
+// Actions on the configuration and on monitors accepted by the REST-style
+// routes.
+var (
+	restConfigActions  = []string{"reload", "rollback", "validate", "save"}
+	restMonitorActions = []string{"start", "stop", "restart"}
+)
+
+// restActionNames returns the actions accepted by a route with an action
+// parameter, or nil if it has none.
+func restActionNames(pattern string) (names []string) {
+	switch pattern {
+	case "/v1/config/{action}":
+		return restConfigActions
+	case "/v1/monitors/{name}/actions/{action}":
+		return restMonitorActions
+	case "/v1/responders/{name}/actions/{action}", "/v1/actions/{action}":
+		for name, mapped := range restActions {
+			// Services can only be started or stopped individually.
+			if mapped[1] != "responder" || !strings.HasPrefix(pattern,
+				"/v1/actions/") {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+	}
+	return
+}
+
+// restRoute maps a method and path onto a handler. Each segment of the
+// pattern given in braces (e.g. "{name}") matches any single segment of the
+// path, the values of which are passed to the handler in order. The summary
+// and result (a value of the type returned on success, or nil for an API
+// response) document the route in the OpenAPI specification.
+type restRoute struct {
+	method  string
+	pattern string
+	summary string
+	result  any
+	handle  func(call *restCall)
+}
+
+var restRoutes = buildRESTRoutes()
+
+// buildRESTRoutes returns the table of REST-style routes.
+func buildRESTRoutes() (routes []restRoute) {
+	routes = []restRoute{
+		{http.MethodGet, "/v1/status",
+			"Show the running status of all services.", nil,
+			func(call *restCall) {
+				call.respond(call.newRequest("status", "", ""))
+			}},
+		{http.MethodGet, "/v1/config",
+			"Show the current Agent configuration.", nil,
+			func(call *restCall) {
+				call.respond(call.newRequest("get", "config", ""))
+			}},
+		{http.MethodPut, "/v1/config",
+			"Replace the configuration, applying only the differences.", nil,
+			(*restCall).putConfig},
+		{http.MethodPost, "/v1/config/{action}",
+			"Reload, roll back, validate or save the configuration.", nil,
+			(*restCall).configAction},
+		{http.MethodPost, "/v1/actions/{action}",
+			"Perform an action on all Responders.", nil,
+			func(call *restCall) {
+				call.responderAction("", call.args[0])
+			}},
+		{http.MethodGet, "/v1/info",
+			"Show build and runtime details of the running Agent.", nil,
+			func(call *restCall) {
+				call.respond(call.newRequest("get", "info", ""))
+			}},
+		{http.MethodGet, "/v1/stats",
+			"Show the internal metrics of the Agent.", nil,
+			func(call *restCall) {
+				call.respond(call.newRequest("get", "stats", ""))
+			}},
+		{http.MethodGet, "/v1/cluster",
+			"Show the combined status of the agents in the cluster.", nil,
+			func(call *restCall) {
+				call.respond(call.newRequest("get", "cluster", ""))
+			}},
+		{http.MethodGet, "/v1/events",
+			"Show recorded events, filtered by the query parameters 'name', " +
+				"'since', 'until', 'event-types' and 'limit'.", nil,
+			(*restCall).getEvents},
+		{http.MethodGet, "/v1/overrides",
+			"Show the forced states active on all Responders.", nil,
+			func(call *restCall) {
+				call.respond(call.newRequest("get", "overrides", ""))
+			}},
+		{http.MethodGet, "/v1/headroom",
+			"Show the estimated load headroom of all Responders.", nil,
+			func(call *restCall) {
+				call.respond(call.newRequest("get", "headroom", ""))
+			}},
+	}
+	routes = append(routes, serviceRoutes("monitor", "System Monitor",
+		map[string]*SystemMonitor{}, &SystemMonitor{})...)
+	routes = append(routes, serviceRoutes("responder", "Feedback Responder",
+		map[string]*FeedbackResponder{}, &FeedbackResponder{})...)
+	routes = append(routes, []restRoute{
+		{http.MethodPost, "/v1/monitors/{name}/actions/{action}",
+			"Start, stop or restart a System Monitor.", nil,
+			(*restCall).monitorAction},
+		{http.MethodPost, "/v1/responders/{name}/actions/{action}",
+			"Perform an action on a Feedback Responder.", nil,
+			func(call *restCall) {
+				call.responderAction(call.args[0], call.args[1])
+			}},
+		{http.MethodGet, "/v1/responders/{name}/feedback",
+			"Show the current feedback response of a Responder.", nil,
+			func(call *restCall) {
+				call.respond(call.newRequest("get", "feedback", call.args[0]))
+			}},
+		{http.MethodGet, "/v1/responders/{name}/headroom",
+			"Show the estimated load headroom of a Responder.", nil,
+			func(call *restCall) {
+				call.respond(call.newRequest("get", "headroom", call.args[0]))
+			}},
+		{http.MethodGet, "/v1/responders/{name}/simulate",
+			"Simulate the feedback of a Responder for the source values " +
+				"in the query parameter 'values', or recorded at the time " +
+				"in 'at'.", nil,
+			(*restCall).simulate},
+		{http.MethodPut, "/v1/responders/{name}/threshold",
+			"Set the threshold mode and score of a Responder.", nil,
+			func(call *restCall) {
+				call.respond(call.newRequest("set", "threshold", call.args[0]))
+			}},
+		{http.MethodPut, "/v1/responders/{name}/commands",
+			"Set the HAProxy commands of a Responder.", nil,
+			func(call *restCall) {
+				call.respond(call.newRequest("set", "commands", call.args[0]))
+			}},
+		{http.MethodGet, "/v1/responders/{name}/sources",
+			"Show the Feedback Sources of a Responder.",
+			map[string]*FeedbackSource{},
+			func(call *restCall) {
+				call.sendSources(call.args[0], "", http.StatusOK)
+			}},
+		{http.MethodGet, "/v1/responders/{name}/sources/{monitor}",
+			"Show a Feedback Source of a Responder.", &FeedbackSource{},
+			func(call *restCall) {
+				call.sendSources(call.args[0], call.args[1], http.StatusOK)
+			}},
+		{http.MethodPut, "/v1/responders/{name}/sources/{monitor}",
+			"Create or edit a Feedback Source of a Responder.",
+			&FeedbackSource{}, (*restCall).upsertSource},
+		{http.MethodDelete, "/v1/responders/{name}/sources/{monitor}",
+			"Detach a Feedback Source from a Responder.", nil,
+			(*restCall).deleteSource},
+	}...)
+	return
+}
+
+// serviceRoutes returns the routes for the collection of monitors or
+// Responders.
+func serviceRoutes(serviceType string, title string, collection any,
+	item any) []restRoute {
+	path := "/v1/" + serviceType + "s"
+	return []restRoute{
+		{http.MethodGet, path, "List each " + title + ".", collection,
+			func(call *restCall) {
+				call.sendServices(serviceType)
+			}},
+		{http.MethodGet, path + "/{name}", "Show a " + title + ".", item,
+			func(call *restCall) {
+				call.sendService(serviceType, call.args[0], http.StatusOK)
+			}},
+		{http.MethodPut, path + "/{name}",
+			"Create a " + title + ", or edit it to match if it exists.", item,
+			func(call *restCall) {
+				call.changeService("upsert", serviceType)
+			}},
+		{http.MethodPatch, path + "/{name}", "Edit a " + title + ".", item,
+			func(call *restCall) {
+				call.changeService("edit", serviceType)
+			}},
+		{http.MethodDelete, path + "/{name}", "Delete a " + title + ".", nil,
+			func(call *restCall) {
+				call.deleteService(serviceType)
+			}},
+	}
+}
+
+// match returns whether a path matches the pattern of this route, along
+// with the values of any parameter segments.
+func (route *restRoute) match(segments []string) (args []string,
+	matched bool) {
+	pattern := strings.Split(strings.Trim(route.pattern, "/"), "/")
+	if len(pattern) != len(segments) {
+		return
+	}
+	for i, part := range pattern {
+		if strings.HasPrefix(part, "{") {
+			args = append(args, segments[i])
+		} else if part != segments[i] {
+			return
+		}
+	}
+	matched = true
+	return
+}
+
+// #######################################################################
+// Handling Requests
+// #######################################################################
+
+// restCall holds the state of a single request to a REST-style route.
+type restCall struct {
+	agent    *FeedbackAgent
+	writer   http.ResponseWriter
+	request  *http.Request
+	apiKey   string
+	readOnly bool
+	// Values of the wildcard segments of the route.
+	args []string
+	// Body of the request, holding any settings.
+	body []byte
+	// The monitor or Responder to which the request refers, if any, so
+	// that a failure can be reported as not found if it does not exist.
+	serviceType string
+	serviceName string
+}
+
+// handleREST routes a request to the REST-style API by its method and path.
+func (pc *HTTPConnector) handleREST(w http.ResponseWriter, r *http.Request) {
+	call := &restCall{
+		agent:    pc.responder.ParentAgent,
+		writer:   w,
+		request:  r,
+		apiKey:   getHeaderAPIKey(r.Header),
+		readOnly: pc.responder.ProtocolName == ProtocolLegacyAPI,
+	}
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	var allowed []string
+	var handler func(call *restCall)
+	for i := range restRoutes {
+		args, matched := restRoutes[i].match(segments)
+		if !matched {
+			continue
+		} else if restRoutes[i].method != r.Method {
+			allowed = append(allowed, restRoutes[i].method)
+			continue
+		}
+		call.args = args
+		handler = restRoutes[i].handle
+		break
+	}
+	if handler == nil {
+		if len(allowed) > 0 {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			call.writeError(http.StatusMethodNotAllowed, "bad-method",
+				"method "+r.Method+" is not allowed for "+r.URL.Path)
+		} else {
+			call.writeError(http.StatusNotFound, "bad-route",
+				"no API route for "+r.URL.Path)
+		}
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		pc.responder.logger().Error("failed to read HTTP request body: " +
+			err.Error())
+		return
+	}
+	call.body = body
+	handler(call)
+}
+
+// newRequest returns an API request for an action, with any settings given
+// in the body of the request; if these cannot be read, the error is sent
+// and nil is returned.
+func (call *restCall) newRequest(action string, actionType string,
+	name string) (request *APIRequest) {
+	request = &APIRequest{}
+	if len(strings.TrimSpace(string(call.body))) > 0 {
+		err := json.Unmarshal(call.body, request)
+		if err != nil {
+			response, _ := call.agent.ProcessAPIRequest(request, err)
+			call.writeJSON(http.StatusBadRequest, response)
+			return nil
+		}
+	}
+	request.Action = action
+	request.Type = actionType
+	request.TargetName = name
+	if call.apiKey != "" {
+		request.APIKey = call.apiKey
+	}
+	if tag := call.request.Header.Get("If-None-Match"); tag != "" {
+		request.IfNoneMatch = &tag
+	}
+	request.readOnly = call.readOnly
+	return
+}
+
+// process processes an API request, returning the HTTP status for its
+// response; if the request failed, the response is sent.
+func (call *restCall) process(request *APIRequest) (response *APIResponse,
+	status int) {
+	response, _ = call.agent.ProcessAPIRequest(request, nil)
+	status = http.StatusOK
+	if !response.Success {
+		switch response.Error {
+		case "bad-api-key":
+			status = http.StatusUnauthorized
+		case "api-error":
+			status = http.StatusUnprocessableEntity
+			// Report services which do not exist (or are outside of the
+			// namespace of the key) as not found.
+			if call.serviceType != "" && request.Action != "upsert" &&
+				!call.agent.serviceVisible(call.serviceType,
+					strings.ToLower(call.serviceName), request.namespace) {
+				status = http.StatusNotFound
+			}
+		default:
+			status = http.StatusBadRequest
+		}
+		call.writeJSON(status, response)
+	}
+	return
+}
+
+// respond processes an API request and sends its response.
+func (call *restCall) respond(request *APIRequest) {
+	if request == nil {
+		return
+	}
+	// Any other service named by a request is a Responder.
+	if request.TargetName != "" && call.serviceType == "" {
+		call.serviceType = "responder"
+		call.serviceName = request.TargetName
+	}
+	response, status := call.process(request)
+	if !response.Success {
+		return
+	}
+	if response.ETag != "" {
+		call.writer.Header().Set("ETag", response.ETag)
+	}
+	if response.NotModified {
+		call.writer.WriteHeader(http.StatusNotModified)
+		return
+	}
+	call.writeJSON(status, response)
+}
+
+// writeJSON sends content as JSON with an HTTP status.
+func (call *restCall) writeJSON(status int, content any) {
+	output, err := json.MarshalIndent(content, "", "    ")
+	if err != nil {
+		call.writeError(http.StatusInternalServerError, "api-error",
+			"failed to marshal response: "+err.Error())
+		return
+	}
+	call.writer.Header().Set("Content-Type", "application/json")
+	call.writer.WriteHeader(status)
+	_, _ = call.writer.Write(append(output, '\n'))
+}
+
+// writeError sends an API response reporting an error which occurred
+// before the request reached the agent.
+func (call *restCall) writeError(status int, name string, message string) {
+	output, _ := json.MarshalIndent(&APIResponse{
+		APIName: AppIdentifier,
+		Version: VersionString,
+		Error:   name,
+		Message: message,
+	}, "", "    ")
+	call.writer.Header().Set("Content-Type", "application/json")
+	call.writer.WriteHeader(status)
+	_, _ = call.writer.Write(append(output, '\n'))
+}
+
+// #######################################################################
+// Routes
+// #######################################################################
+
+// configAction reloads, rolls back, validates or saves the configuration.
+func (call *restCall) configAction() {
+	action := call.args[0]
+	switch {
+	case action == "save":
+		call.respond(call.newRequest("force", "save-config", ""))
+	case slices.Contains(restConfigActions, action):
+		call.respond(call.newRequest(action, "config", ""))
+	default:
+		call.writeError(http.StatusNotFound, "bad-route",
+			"unknown config action '"+action+"'")
+	}
+}
+
+// putConfig replaces the configuration with the desired configuration in
+// the body, which is not itself an API request.
+func (call *restCall) putConfig() {
+	body := call.body
+	call.body = nil
+	request := call.newRequest("put", "config", "")
+	request.Config = body
+	call.respond(request)
+}
+
+// monitorAction starts, stops or restarts a monitor.
+func (call *restCall) monitorAction() {
+	name, action := call.args[0], call.args[1]
+	if !slices.Contains(restMonitorActions, action) {
+		call.writeError(http.StatusNotFound, "bad-route",
+			"unknown monitor action '"+action+"'")
+		return
+	}
+	call.serviceType, call.serviceName = "monitor", name
+	call.respond(call.newRequest(action, "monitor", name))
+}
+
+// responderAction performs an action on a Responder, or on all Responders
+// if no name is given (for those actions which permit this).
+func (call *restCall) responderAction(name string, action string) {
+	mapped, exists := restActions[action]
+	if !exists || (name == "" && mapped[1] == "responder") {
+		call.writeError(http.StatusNotFound, "bad-route",
+			"unknown responder action '"+action+"'")
+		return
+	}
+	call.respond(call.newRequest(mapped[0], mapped[1], name))
+}
+
+// getEvents sends the recorded events selected by the query parameters of
+// the call.
+func (call *restCall) getEvents() {
+	query := call.request.URL.Query()
+	request := call.newRequest("get", "events", query.Get("name"))
+	if request == nil {
+		return
+	}
+	for name, field := range map[string]**string{
+		FlagSince:      &request.Since,
+		FlagUntil:      &request.Until,
+		FlagEventTypes: &request.EventTypes,
+	} {
+		if value := query.Get(name); value != "" {
+			*field = &value
+		}
+	}
+	if value := query.Get(FlagLimit); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil {
+			call.writeError(http.StatusBadRequest, "bad-query",
+				"invalid limit '"+value+"'")
+			return
+		}
+		request.Limit = &limit
+	}
+	call.respond(request)
+}
+
+// simulate sends the simulated feedback of a Responder for the source
+// values and time given as query parameters.
+func (call *restCall) simulate() {
+	query := call.request.URL.Query()
+	request := call.newRequest("get", "simulate", call.args[0])
+	if request == nil {
+		return
+	}
+	for name, field := range map[string]**string{
+		FlagValues: &request.Values,
+		FlagAt:     &request.At,
+	} {
+		if value := query.Get(name); value != "" {
+			*field = &value
+		}
+	}
+	call.respond(request)
+}
+
+// getConfig returns the configuration of the agent as visible to the API
+// key of the call; if the request fails, the error is sent and nil is
+// returned.
+func (call *restCall) getConfig() (config *FeedbackAgent) {
+	request := call.newRequest("get", "config", "")
+	if request == nil {
+		return
+	}
+	// The configuration is always returned in full.
+	request.IfNoneMatch = nil
+	response, _ := call.process(request)
+	config = response.AgentConfig
+	return
+}
+
+// sendServices sends the configuration of each monitor or Responder.
+func (call *restCall) sendServices(serviceType string) {
+	config := call.getConfig()
+	if config == nil {
+		return
+	}
+	if serviceType == "monitor" {
+		call.writeJSON(http.StatusOK, config.Monitors)
+	} else {
+		call.writeJSON(http.StatusOK, config.Responders)
+	}
+}
+
+// sendService sends the configuration of a monitor or Responder.
+func (call *restCall) sendService(serviceType string, name string,
+	status int) {
+	config := call.getConfig()
+	if config == nil {
+		return
+	}
+	name, _ = StandardiseNameIdentifier(name)
+	var service any
+	switch serviceType {
+	case "monitor":
+		if monitor, exists := config.Monitors[name]; exists {
+			service = monitor
+		}
+	case "responder":
+		if responder, exists := config.Responders[name]; exists {
+			service = responder
+		}
+	}
+	if service == nil {
+		call.writeError(http.StatusNotFound, "not-found",
+			serviceType+" '"+name+"' does not exist")
+		return
+	}
+	call.writeJSON(status, service)
+}
+
+// changeService creates or edits a monitor or Responder with the settings
+// given, sending its resulting configuration.
+func (call *restCall) changeService(action string, serviceType string) {
+	name := call.args[0]
+	request := call.newRequest(action, serviceType, name)
+	if request == nil {
+		return
+	}
+	call.serviceType, call.serviceName = serviceType, name
+	response, _ := call.process(request)
+	if !response.Success {
+		return
+	}
+	status := http.StatusOK
+	if response.UpsertResult == UpsertCreated {
+		status = http.StatusCreated
+		call.writer.Header().Set("Location", call.request.URL.Path)
+	}
+	call.sendService(serviceType, name, status)
+}
+
+// deleteService deletes a monitor or Responder.
+func (call *restCall) deleteService(serviceType string) {
+	name := call.args[0]
+	request := call.newRequest("delete", serviceType, name)
+	if request == nil {
+		return
+	}
+	call.serviceType, call.serviceName = serviceType, name
+	response, _ := call.process(request)
+	if response.Success {
+		call.writer.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// sendSources sends the Feedback Sources of a Responder, or a single
+// source if a monitor is named.
+func (call *restCall) sendSources(name string, monitor string, status int) {
+	request := call.newRequest("get", "sources", name)
+	if request == nil {
+		return
+	}
+	call.serviceType, call.serviceName = "responder", name
+	response, _ := call.process(request)
+	if !response.Success {
+		return
+	}
+	if monitor == "" {
+		call.writeJSON(status, response.FeedbackSources)
+		return
+	}
+	monitor = strings.ToLower(monitor)
+	source, exists := response.FeedbackSources[monitor]
+	if !exists {
+		call.writeError(http.StatusNotFound, "not-found", "responder '"+
+			name+"' has no source '"+monitor+"'")
+		return
+	}
+	call.writeJSON(status, source)
+}
+
+// upsertSource creates or edits a Feedback Source of a Responder with the
+// settings given, sending the resulting source.
+func (call *restCall) upsertSource() {
+	name, monitor := call.args[0], call.args[1]
+	request := call.newRequest("upsert", "source", name)
+	if request == nil {
+		return
+	}
+	request.SourceMonitorName = &monitor
+	call.serviceType, call.serviceName = "responder", name
+	response, _ := call.process(request)
+	if !response.Success {
+		return
+	}
+	status := http.StatusOK
+	if response.UpsertResult == UpsertCreated {
+		status = http.StatusCreated
+		call.writer.Header().Set("Location", call.request.URL.Path)
+	}
+	call.sendSources(name, monitor, status)
+}
+
+// deleteSource deletes a Feedback Source of a Responder.
+func (call *restCall) deleteSource() {
+	name, monitor := call.args[0], call.args[1]
+	request := call.newRequest("delete", "source", name)
+	if request == nil {
+		return
+	}
+	request.SourceMonitorName = &monitor
+	call.serviceType, call.serviceName = "responder", name
+	response, _ := call.process(request)
+	if response.Success {
+		call.writer.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
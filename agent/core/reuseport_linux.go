@@ -0,0 +1,59 @@
+//go:build linux
+
+// reuseport_linux.go
+// Steering of Connections between SO_REUSEPORT Listeners - Linux
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// steerReusePort attaches a program to the SO_REUSEPORT group of a bound
+// socket which directs new connections (or datagrams) to the second socket
+// in the group, which is the replacement during a handover. This ensures
+// that the listener being replaced receives no new connections, and so can
+// accept those already queued before it is closed, rather than them being
+// reset. When only one socket is in the group, the kernel falls back to
+// its normal selection.
+func steerReusePort(socket syscall.Conn) (err error) {
+	conn, err := socket.SyscallConn()
+	if err != nil {
+		return
+	}
+	program := []unix.SockFilter{{Code: unix.BPF_RET | unix.BPF_K, K: 1}}
+	controlErr := conn.Control(func(fd uintptr) {
+		err = unix.SetsockoptSockFprog(int(fd), unix.SOL_SOCKET,
+			unix.SO_ATTACH_REUSEPORT_CBPF, &unix.SockFprog{
+				Len:    uint16(len(program)),
+				Filter: &program[0],
+			})
+	})
+	if controlErr != nil {
+		err = controlErr
+	}
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,38 @@
+//go:build !linux
+
+// reuseport_other.go
+// Steering of Connections between SO_REUSEPORT Listeners - Other Platforms
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"syscall"
+)
+
+// steerReusePort is only supported on Linux; elsewhere, the listener being
+// replaced during a handover may still receive new connections until it
+// is closed.
+func steerReusePort(_ syscall.Conn) (err error) {
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
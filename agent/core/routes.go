@@ -0,0 +1,273 @@
+// routes.go
+// Per-URL Routes for HTTP Responders
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"errors"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+	"time"
+)
+
+// An HTTP(S) Responder may serve several views of its feedback from one
+// listener, each at its own path (e.g. '/feedback/cpu' or '/healthz'),
+// rather than requiring a Responder and port for each view. A route may
+// restrict its view to a subset of the sources of the Responder, and may
+// give it in another feedback format.
+//
+// A route covering all sources answers exactly as the Responder itself,
+// sending any HAProxy commands as its state changes. A route covering a
+// subset of the sources only reports the availability of those sources,
+// combined and mapped to a weight as configured for the Responder, and
+// does not affect its command state; the 'weight' and JSON formats still
+// give the state of the Responder. Requests for any other path receive
+// the default feedback of the Responder.
+//
+// In the CLI, routes are given as a comma-separated list in the form
+// 'path[=source+source][:format]', e.g. '/feedback/cpu=cpu:weight,/healthz'.
+
+// FeedbackRoute is a path served by an HTTP(S) FeedbackResponder, with the
+// sources and feedback format of its view; no sources means all sources.
+type FeedbackRoute struct {
+	Path           string   `json:"path"`
+	Sources        []string `json:"sources,omitempty"`
+	FeedbackFormat string   `json:"feedback-format,omitempty"`
+}
+
+// ParseRoutes parses a list of routes in the CLI format, or 'none' for an
+// empty list, which clears the routes of a Responder.
+func ParseRoutes(text string) (routes []FeedbackRoute, err error) {
+	routes = []FeedbackRoute{}
+	if strings.EqualFold(strings.TrimSpace(text), "none") {
+		return
+	}
+	for _, entry := range strings.Split(text, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		route := FeedbackRoute{}
+		entry, route.FeedbackFormat, _ = strings.Cut(entry, ":")
+		path, sources, found := strings.Cut(entry, "=")
+		route.Path = strings.TrimSpace(path)
+		if found {
+			for _, source := range strings.Split(sources, "+") {
+				route.Sources = append(route.Sources, strings.TrimSpace(source))
+			}
+		}
+		routes = append(routes, route)
+	}
+	return
+}
+
+// configureRoutes validates and normalises the routes of this
+// FeedbackResponder, which must refer to its own sources. The caller must
+// hold the mutex.
+func (fbr *FeedbackResponder) configureRoutes() (err error) {
+	if len(fbr.Routes) == 0 {
+		fbr.Routes = nil
+		return
+	}
+	if fbr.ProtocolName != ProtocolHTTP && fbr.ProtocolName != ProtocolHTTPS {
+		err = errors.New("routes are only supported by HTTP(S) responders")
+		return
+	}
+	// Copy the routes, as they are shared with the original by Copy().
+	routes := make([]FeedbackRoute, 0, len(fbr.Routes))
+	paths := make(map[string]bool, len(fbr.Routes))
+	for _, route := range fbr.Routes {
+		route.Path = strings.TrimSpace(route.Path)
+		if !strings.HasPrefix(route.Path, "/") {
+			err = errors.New("invalid route path '" + route.Path +
+				"'; must begin with '/'")
+			return
+		}
+		if paths[route.Path] {
+			err = errors.New("duplicate route path '" + route.Path + "'")
+			return
+		}
+		paths[route.Path] = true
+		route.FeedbackFormat, err = ParseFeedbackFormat(route.FeedbackFormat)
+		if err != nil {
+			err = errors.New("route '" + route.Path + "': " + err.Error())
+			return
+		}
+		if route.FeedbackFormat == FeedbackFormatHAProxy {
+			route.FeedbackFormat = ""
+		}
+		route.Sources, err = fbr.normaliseRouteSources(route.Sources)
+		if err != nil {
+			err = errors.New("route '" + route.Path + "': " + err.Error())
+			return
+		}
+		routes = append(routes, route)
+	}
+	fbr.Routes = routes
+	return
+}
+
+// normaliseRouteSources returns the names of the sources of a route in
+// standard form, checking that each is a source of this FeedbackResponder
+// and that any aggregation expression can be evaluated from them. The
+// caller must hold the mutex.
+func (fbr *FeedbackResponder) normaliseRouteSources(names []string) (
+	sources []string, err error) {
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, exists := fbr.FeedbackSources[name]; !exists {
+			err = errors.New("'" + name + "' is not a source of this " +
+				"responder")
+			return
+		}
+		if !slices.Contains(sources, name) {
+			sources = append(sources, name)
+		}
+	}
+	if len(sources) == 0 || fbr.aggregationExpr == nil {
+		return
+	}
+	for _, name := range fbr.aggregationExpr.sources {
+		if !slices.Contains(sources, name) {
+			err = errors.New("source '" + name + "' is referred to by the " +
+				"aggregation expression, so must be included")
+			return
+		}
+	}
+	return
+}
+
+// checkRouteSource returns an error if a source is in the view of a route
+// of this FeedbackResponder, and so cannot be removed. The caller must
+// hold the mutex.
+func (fbr *FeedbackResponder) checkRouteSource(name string) (err error) {
+	for _, route := range fbr.Routes {
+		if slices.Contains(route.Sources, name) {
+			err = errors.New(fbr.getLogHead() + ": source '" + name +
+				"' is used by route '" + route.Path + "'")
+			return
+		}
+	}
+	return
+}
+
+// findRoute returns the route of this FeedbackResponder for a request path,
+// or nil if there is none.
+func (fbr *FeedbackResponder) findRoute(path string) *FeedbackRoute {
+	for i := range fbr.Routes {
+		if fbr.Routes[i].Path == path {
+			return &fbr.Routes[i]
+		}
+	}
+	return nil
+}
+
+// HandleRouteFeedback answers a feedback request for a route of this
+// FeedbackResponder, as a JSON report if requested or otherwise in the
+// feedback format of the route, along with the state of the route from
+// which it was produced.
+func (fbr *FeedbackResponder) HandleRouteFeedback(route *FeedbackRoute,
+	asJSON bool) (feedback string, state FeedbackState) {
+	timestamp := time.Now()
+	fbr.mutex.Lock()
+	defer fbr.mutex.Unlock()
+	var availability int
+	var commands string
+	var send bool
+	if len(route.Sources) == 0 {
+		availability, commands, send = fbr.updateFeedbackState(timestamp)
+		state = FeedbackState{Availability: availability,
+			Online: fbr.onlineState}
+	} else {
+		availability = fbr.routeAvailability(route)
+		state = FeedbackState{Availability: availability,
+			Online: fbr.routeOnline(route)}
+	}
+	if !asJSON {
+		feedback = fbr.formatFeedback(route.FeedbackFormat, availability,
+			commands, send)
+		return
+	}
+	report := fbr.newFeedbackReport(timestamp, availability, commands, send)
+	if len(route.Sources) > 0 {
+		maps.DeleteFunc(report.Sources,
+			func(name string, _ FeedbackSourceLoad) bool {
+				return !slices.Contains(route.Sources, name)
+			})
+	}
+	feedback = fbr.encodeFeedbackReport(report)
+	return
+}
+
+// routeAvailability returns the availability of the sources of a route,
+// combined as for the overall load of this FeedbackResponder, but with the
+// significance of each relative to the sources of the route alone. The
+// caller must hold the mutex.
+func (fbr *FeedbackResponder) routeAvailability(route *FeedbackRoute) (
+	availability int) {
+	loads := make(map[string]float64, len(route.Sources))
+	significance := 0.0
+	for _, name := range route.Sources {
+		if source := fbr.FeedbackSources[name]; source != nil {
+			loads[name] = float64(getSourceLoad(source))
+			significance += source.Significance
+		}
+	}
+	// Scale each load as for the overall load of the Responder.
+	overallLoad := 0
+	for name, load := range loads {
+		if significance > 0 {
+			relative := fbr.FeedbackSources[name].Significance / significance
+			overallLoad += int(load * relative)
+		}
+	}
+	if fbr.Aggregation != "" {
+		aggregated, _ := fbr.aggregateLoad(loads)
+		overallLoad = int(math.Round(aggregated))
+	}
+	availability = fbr.mapWeight(overallLoad)
+	return
+}
+
+// routeOnline returns whether a route is online, which is the case unless
+// any of its sources has breached its thresholds (or is stale, with the
+// offline failure policy), or the Responder has been forced offline. The
+// caller must hold the mutex.
+func (fbr *FeedbackResponder) routeOnline(route *FeedbackRoute) bool {
+	if fbr.forceCommandState && !fbr.onlineState {
+		return false
+	}
+	breaches := make(map[string]bool, len(fbr.FeedbackSources))
+	fbr.evaluateAvailability(breaches)
+	for _, name := range route.Sources {
+		source := fbr.FeedbackSources[name]
+		if breaches[name] || (source != nil &&
+			source.Monitor.failurePolicy() == FailurePolicyOffline) {
+			return false
+		}
+	}
+	return true
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
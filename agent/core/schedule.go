@@ -0,0 +1,225 @@
+// schedule.go
+// Time-Varying Threshold Schedules for Feedback Responders
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format of the start and end times of a threshold window.
+const ScheduleTimeFormat = "15:04"
+
+// scheduleDays maps the day names used in threshold windows to weekdays.
+var scheduleDays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// ThresholdWindow defines a threshold score which applies in place of the
+// global threshold of a Responder during a window of local time, on the
+// specified days of the week (or every day if none are specified). A window
+// whose end is before its start spans midnight, and belongs to the day on
+// which it starts.
+type ThresholdWindow struct {
+	Days      []string `json:"days,omitempty"`
+	Start     string   `json:"start"`
+	End       string   `json:"end"`
+	Threshold int      `json:"threshold"`
+
+	// Parsed start and end times (minutes after midnight) and days.
+	startMinute int
+	endMinute   int
+	weekdays    map[time.Weekday]bool
+}
+
+// Validate checks and parses the settings of a threshold window.
+func (window *ThresholdWindow) Validate() (err error) {
+	start, err := time.Parse(ScheduleTimeFormat, strings.TrimSpace(window.Start))
+	if err != nil {
+		err = errors.New("invalid start time '" + window.Start + "'; use HH:MM")
+		return
+	}
+	end, err := time.Parse(ScheduleTimeFormat, strings.TrimSpace(window.End))
+	if err != nil {
+		err = errors.New("invalid end time '" + window.End + "'; use HH:MM")
+		return
+	}
+	if start.Equal(end) {
+		err = errors.New("window " + window.String() + " has no duration")
+		return
+	}
+	if window.Threshold < 0 || window.Threshold > 100 {
+		err = errors.New("window " + window.String() +
+			": threshold must be between 0 and 100")
+		return
+	}
+	window.Start = start.Format(ScheduleTimeFormat)
+	window.End = end.Format(ScheduleTimeFormat)
+	window.startMinute = start.Hour()*60 + start.Minute()
+	window.endMinute = end.Hour()*60 + end.Minute()
+	weekdays := make(map[time.Weekday]bool)
+	var days []string
+	for _, day := range window.Days {
+		day = strings.ToLower(strings.TrimSpace(day))
+		weekday, exists := scheduleDays[day]
+		if !exists {
+			err = errors.New("invalid day '" + day + "'; use mon, tue, wed, " +
+				"thu, fri, sat or sun")
+			return
+		}
+		days = append(days, day)
+		weekdays[weekday] = true
+	}
+	window.Days = days
+	window.weekdays = weekdays
+	return
+}
+
+// Contains returns whether a time falls within this window.
+func (window *ThresholdWindow) Contains(at time.Time) bool {
+	minute := at.Hour()*60 + at.Minute()
+	day := at.Weekday()
+	if window.startMinute < window.endMinute {
+		return minute >= window.startMinute && minute < window.endMinute &&
+			window.appliesOn(day)
+	}
+	// The window spans midnight; after midnight, it belongs to the window
+	// which started on the previous day.
+	if minute >= window.startMinute {
+		return window.appliesOn(day)
+	}
+	return minute < window.endMinute && window.appliesOn((day+6)%7)
+}
+
+// appliesOn returns whether the window applies on a day of the week.
+func (window *ThresholdWindow) appliesOn(day time.Weekday) bool {
+	return len(window.weekdays) == 0 || window.weekdays[day]
+}
+
+// String describes a threshold window in the format used by the CLI.
+func (window *ThresholdWindow) String() (text string) {
+	if len(window.Days) > 0 {
+		text = strings.Join(window.Days, ",") + " "
+	}
+	return text + window.Start + "-" + window.End + "=" +
+		strconv.Itoa(window.Threshold)
+}
+
+// ValidateThresholdSchedule checks and parses each window of a schedule.
+func ValidateThresholdSchedule(schedule []ThresholdWindow) (err error) {
+	for i := range schedule {
+		err = schedule[i].Validate()
+		if err != nil {
+			err = errors.New("threshold schedule: " + err.Error())
+			return
+		}
+	}
+	return
+}
+
+// ParseThresholdSchedule parses a threshold schedule from the format used
+// by the CLI, which is a list of windows separated by semicolons, each in
+// the form '[days ]HH:MM-HH:MM=threshold', where the optional days are
+// separated by commas; e.g. "mon,tue,wed,thu,fri 08:00-18:00=20;
+// 22:00-06:00=80". The value 'none' gives an empty schedule.
+func ParseThresholdSchedule(text string) (schedule []ThresholdWindow,
+	err error) {
+	schedule = []ThresholdWindow{}
+	if strings.EqualFold(strings.TrimSpace(text), "none") {
+		return
+	}
+	for _, entry := range strings.Split(text, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		window := ThresholdWindow{}
+		fields := strings.Fields(entry)
+		if len(fields) > 2 {
+			err = errors.New("invalid schedule window '" + entry + "'")
+			return
+		}
+		if len(fields) == 2 {
+			window.Days = strings.Split(fields[0], ",")
+		}
+		span, threshold, found := strings.Cut(fields[len(fields)-1], "=")
+		window.Start, window.End, _ = strings.Cut(span, "-")
+		if found {
+			window.Threshold, err = strconv.Atoi(threshold)
+		}
+		if !found || err != nil {
+			err = errors.New("invalid schedule window '" + entry +
+				"'; use '[days ]HH:MM-HH:MM=threshold'")
+			return
+		}
+		err = window.Validate()
+		if err != nil {
+			return
+		}
+		schedule = append(schedule, window)
+	}
+	return
+}
+
+// EffectiveThreshold returns the threshold score which applies to this
+// FeedbackResponder at a given time: that of the first window of its
+// schedule containing the time, or else its global threshold. The caller
+// must hold the mutex.
+func (fbr *FeedbackResponder) EffectiveThreshold(at time.Time) (
+	threshold int, window *ThresholdWindow) {
+	for i := range fbr.ThresholdSchedule {
+		if fbr.ThresholdSchedule[i].Contains(at) {
+			window = &fbr.ThresholdSchedule[i]
+			threshold = window.Threshold
+			return
+		}
+	}
+	threshold = fbr.ThresholdScore
+	return
+}
+
+// ConfigureThresholdSchedule sets the threshold schedule of this
+// FeedbackResponder, returning an error (and leaving the schedule
+// unchanged) if it is invalid.
+func (fbr *FeedbackResponder) ConfigureThresholdSchedule(
+	schedule []ThresholdWindow) (err error) {
+	err = ValidateThresholdSchedule(schedule)
+	if err != nil {
+		return
+	}
+	fbr.mutex.Lock()
+	defer fbr.mutex.Unlock()
+	fbr.ThresholdSchedule = schedule
+	fbr.cache.invalidate()
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,96 @@
+// sdnotify.go
+// Service Readiness and Watchdog Notifications to systemd
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Notification states sent to systemd, as per sd_notify(3).
+const (
+	SdNotifyReady     = "READY=1"
+	SdNotifyReloading = "RELOADING=1"
+	SdNotifyStopping  = "STOPPING=1"
+	SdNotifyWatchdog  = "WATCHDOG=1"
+)
+
+// SdNotify sends a state notification to the service manager if the agent
+// was started by systemd with Type=notify, returning whether it was sent.
+// It does nothing if the NOTIFY_SOCKET environment variable is not set.
+func SdNotify(state string) (sent bool, err error) {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return
+	}
+	// A leading '@' denotes a socket in the abstract namespace.
+	if strings.HasPrefix(socketPath, "@") {
+		socketPath = "\x00" + socketPath[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{
+		Name: socketPath,
+		Net:  "unixgram",
+	})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	sent = err == nil
+	return
+}
+
+// SdWatchdogInterval returns the interval at which watchdog keepalives
+// must be sent to systemd, which is half of the configured WatchdogSec, or
+// zero if the watchdog is not enabled for this process.
+func SdWatchdogInterval() (interval time.Duration) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	// The watchdog applies only to the process given, if one is set.
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" &&
+		pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	interval = time.Duration(usec) * time.Microsecond / 2
+	return
+}
+
+// sdNotify sends a state notification to systemd, logging any failure.
+func (agent *FeedbackAgent) sdNotify(state string) {
+	sent, err := SdNotify(state)
+	if err != nil {
+		logrus.Warn("Failed to notify systemd of state '" + state + "': " +
+			err.Error())
+	} else if sent && state != SdNotifyWatchdog {
+		logrus.Debug("Notified systemd of state '" + state + "'.")
+	}
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,93 @@
+// secrets.go
+// Substitution of Environment Variables and Files in Secret Config Values
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// SecretFilePrefix marks a config value which is read from a file.
+const SecretFilePrefix = "file:"
+
+// secretEnvPattern matches a reference to an environment variable.
+var secretEnvPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// ResolveSecret resolves any references within a secret config value,
+// such as an API key, so that the secret itself need not be stored in the
+// JSON configuration file. The reference is kept in the configuration, and
+// only the resolved value is used at runtime.
+//
+// References to environment variables, in the form ${NAME}, are replaced
+// by their values. A value then beginning with 'file:' is replaced by the
+// contents of the file at the path that follows, without any trailing
+// whitespace; e.g. 'file:${CREDENTIALS_DIRECTORY}/api-key' for a systemd
+// credential. Any other value is returned unchanged.
+func ResolveSecret(value string) (resolved string, err error) {
+	resolved = secretEnvPattern.ReplaceAllStringFunc(value,
+		func(reference string) string {
+			name := secretEnvPattern.FindStringSubmatch(reference)[1]
+			envValue, exists := os.LookupEnv(name)
+			if !exists && err == nil {
+				err = errors.New("environment variable '" + name +
+					"' is not set")
+			}
+			return envValue
+		})
+	if err != nil {
+		return
+	}
+	if !strings.HasPrefix(resolved, SecretFilePrefix) {
+		return
+	}
+	filePath := strings.TrimPrefix(resolved, SecretFilePrefix)
+	if !filepath.IsAbs(filePath) {
+		err = errors.New("secret file path '" + filePath + "' is not absolute")
+		return
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		err = errors.New("cannot read secret file: " + err.Error())
+		return
+	}
+	resolved = strings.TrimRight(string(data), " \t\r\n")
+	if resolved == "" {
+		err = errors.New("secret file '" + filePath + "' is empty")
+	}
+	return
+}
+
+// resolveAPIKey resolves the API key of the agent from its configured
+// value, which may be a reference to an environment variable or file.
+func (agent *FeedbackAgent) resolveAPIKey() (err error) {
+	agent.apiKey, err = ResolveSecret(agent.APIKey)
+	if err != nil {
+		err = errors.New("cannot resolve api-key: " + err.Error())
+	}
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,342 @@
+// shell.go
+// Interactive CLI Shell
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// The 'shell' action opens an interactive prompt at which CLI commands are
+// entered without the program name, e.g. 'force drain -name default', for
+// a session of several commands. The API key is checked once when the
+// shell opens, and the same connection to the agent is then reused for
+// each command. Command history is kept in a file in the home directory
+// of the user, and may be recalled with the up and down arrow keys; the
+// tab key completes actions, types, flags and their values, including the
+// names of the services, which are fetched from the agent as required.
+//
+// If the input is not a terminal, commands are read a line at a time
+// without any prompt, so that a script of commands may be piped in.
+
+const (
+	// Prompt shown for each command in the shell.
+	ShellPrompt = AppIdentifier + "> "
+	// Name of the file in the home directory holding the command history.
+	ShellHistoryFileName = ".lbfeedback_history"
+	// Maximum number of commands retained in the history.
+	MaxShellHistory = 1000
+)
+
+// Shell is an interactive session with the API of an agent.
+type Shell struct {
+	client      *APIClient
+	input       *bufio.Reader
+	interactive bool
+	history     []string
+	historyPath string
+}
+
+// RunShell runs the interactive shell until the user exits, with the
+// agent targeted by CLI arguments in the same way as for other actions.
+func RunShell(argv []string) (status int) {
+	request, options, err := ParseArgumentsToRequest("shell", "", argv)
+	if err == nil {
+		shell := &Shell{input: bufio.NewReader(os.Stdin)}
+		err = shell.connect(&request, options.Instance)
+		if err == nil {
+			shell.run()
+			return ExitStatusNormal
+		}
+	}
+	println("Error: " + err.Error() + ".")
+	return ExitStatusError
+}
+
+// connect creates the client for the session, checking that the agent can
+// be reached and accepts the API key.
+func (shell *Shell) connect(request *APIRequest, instance string) (
+	err error) {
+	shell.client, err = NewCLIAPIClient(request, instance)
+	if err != nil {
+		return
+	}
+	response, _, err := shell.client.Send(context.Background(),
+		&APIRequest{Action: "get", Type: "info"})
+	if err != nil {
+		return
+	}
+	if !response.Success {
+		return errors.New(response.Message)
+	}
+	// The terminal is only used if it can be put into raw mode.
+	restore, rawErr := makeRawTerminal(os.Stdin)
+	if rawErr == nil {
+		restore()
+		shell.interactive = true
+		shell.loadHistory()
+		fmt.Println("Connected to the Feedback Agent v" + response.Version +
+			" at " + shell.client.URL + ".\nEnter 'help' for a list of " +
+			"actions, or 'exit' to quit.")
+	}
+	return
+}
+
+// run reads and executes commands until the user exits or the input ends.
+func (shell *Shell) run() {
+	defer shell.saveHistory()
+	for {
+		line, err := shell.readLine()
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		shell.addHistory(line)
+		if shell.execute(line) {
+			return
+		}
+	}
+}
+
+// readLine reads a command, using the line editor if interactive.
+func (shell *Shell) readLine() (line string, err error) {
+	if shell.interactive {
+		editor := lineEditor{
+			input:    shell.input,
+			output:   os.Stdout,
+			prompt:   ShellPrompt,
+			history:  shell.history,
+			complete: shell.complete,
+		}
+		return editor.readLine()
+	}
+	line, err = shell.input.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	return
+}
+
+// execute executes a command, returning whether the shell should exit.
+func (shell *Shell) execute(line string) (exit bool) {
+	args, err := SplitShellWords(line)
+	if err != nil {
+		println("Error: " + err.Error() + ".")
+		return
+	}
+	switch args[0] {
+	case "exit", "quit":
+		return true
+	case "help":
+		if len(args) < 2 {
+			fmt.Println(GenerateHelpText())
+			return
+		}
+		helpText, err := GenerateCommandHelpText(args[1])
+		if err != nil {
+			println("Error: " + err.Error() + ".")
+			return
+		}
+		fmt.Println(helpText)
+		return
+	}
+	response, responseJSON, format, err := shell.send(SplitCLIArguments(args))
+	if format != "" {
+		WriteCLIOutput(os.Stdout, os.Stderr, format, response, responseJSON,
+			err)
+		return
+	}
+	if err != nil {
+		println("Error: " + err.Error() + ".")
+		return
+	}
+	PrintAPIResponse(response)
+	return
+}
+
+// send parses a command and sends it to the agent, returning the response
+// and the output format requested for it, if any.
+func (shell *Shell) send(actionName string, actionType string,
+	argv []string) (response *APIResponse, responseJSON string,
+	format string, err error) {
+	command, err := GetCLICommand(actionName)
+	if err != nil {
+		return
+	}
+	if command.Local {
+		err = errors.New("action '" + actionName +
+			"' cannot be used in the shell")
+		return
+	}
+	request, options, err := ParseArgumentsToRequest(actionName, actionType,
+		argv)
+	if err != nil {
+		return
+	}
+	if request.OutputFormat != nil {
+		format = *request.OutputFormat
+	}
+	if options.Instance != "" || request.RemoteHost != nil ||
+		request.RemotePort != nil || request.RemoteKey != nil ||
+		request.RemoteCAFile != nil || request.RemoteInsecure != nil {
+		err = errors.New("the agent cannot be changed within the shell; " +
+			"exit and open a new shell for the other agent")
+		return
+	}
+	if request.FleetHosts != nil {
+		response, err = CLIHandleFleetAction(&request)
+		return
+	}
+	response, responseJSON, err = CLISendRequest(shell.client, &request)
+	return
+}
+
+// #######################################################################
+// Command History
+// #######################################################################
+
+// loadHistory loads the command history from the history file, if any.
+func (shell *Shell) loadHistory() {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return
+	}
+	shell.historyPath = path.Join(home, ShellHistoryFileName)
+	data, err := os.ReadFile(shell.historyPath)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			shell.history = append(shell.history, line)
+		}
+	}
+	if len(shell.history) > MaxShellHistory {
+		shell.history = shell.history[len(shell.history)-MaxShellHistory:]
+	}
+}
+
+// addHistory adds a command to the history, unless it repeats the last.
+func (shell *Shell) addHistory(line string) {
+	if len(shell.history) > 0 && shell.history[len(shell.history)-1] == line {
+		return
+	}
+	shell.history = append(shell.history, line)
+	if len(shell.history) > MaxShellHistory {
+		shell.history = shell.history[1:]
+	}
+}
+
+// saveHistory saves the command history to the history file; as commands
+// may contain secrets, it is readable only by the user.
+func (shell *Shell) saveHistory() {
+	if shell.historyPath == "" {
+		return
+	}
+	data := strings.Join(shell.history, "\n") + "\n"
+	_ = os.WriteFile(shell.historyPath, []byte(data), 0600)
+}
+
+// #######################################################################
+// Completion
+// #######################################################################
+
+// complete returns the possible completions of the last word in a partial
+// command, along with that word.
+func (shell *Shell) complete(line string) (candidates []string,
+	word string) {
+	words := strings.Fields(line)
+	if len(words) > 0 && !strings.HasSuffix(line, " ") {
+		word = words[len(words)-1]
+		words = words[:len(words)-1]
+	}
+	actions := []string{"help", "exit", "quit"}
+	for _, command := range CLICommands {
+		if !command.Local {
+			actions = append(actions, command.Action)
+		}
+	}
+	candidates = CompleteCLIWord(words, word, actions,
+		func(serviceType string) []string {
+			return fetchServiceNames(shell.client, serviceType)
+		})
+	return
+}
+
+// #######################################################################
+// Command Parsing
+// #######################################################################
+
+// SplitShellWords splits a command into words at whitespace, other than
+// within single or double quotes; a backslash escapes the next character,
+// other than within single quotes.
+func SplitShellWords(line string) (words []string, err error) {
+	var word strings.Builder
+	inWord, escaped := false, false
+	quote := rune(0)
+	for _, r := range line {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		err = errors.New("unterminated quote or escape")
+		return
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
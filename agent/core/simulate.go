@@ -0,0 +1,254 @@
+// simulate.go
+// Dry-Run Feedback Simulation for Feedback Responders
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A simulation evaluates a copy of a Responder whose sources are given
+// hypothetical values, or the values recorded by their monitors at a past
+// time, so that significances and thresholds can be tuned without waiting
+// for real load. The copy is detached from the agent, so nothing it does
+// is recorded, and the state of the Responder itself is left unchanged.
+
+// #######################################################################
+// Simulation
+// #######################################################################
+
+// Simulate returns the feedback this FeedbackResponder would give if the
+// named sources had the given raw values; any other sources keep their
+// current values.
+func (fbr *FeedbackResponder) Simulate(values map[string]float64) (
+	result SimulationResult) {
+	fbr.mutex.Lock()
+	defer fbr.mutex.Unlock()
+	result = SimulationResult{
+		Responder: fbr.ResponderName,
+		Sources:   make(map[string]SimulatedSource, len(fbr.FeedbackSources)),
+	}
+	if fbr.forceCommandState {
+		result.ForcedState = overrideStateName(fbr.onlineState, fbr.overrideMask)
+	}
+	sim := *fbr
+	sim.mutex = &sync.Mutex{}
+	sim.ParentAgent = nil
+	sim.cache = nil
+	sim.FeedbackSources = make(map[string]*FeedbackSource,
+		len(fbr.FeedbackSources))
+	now := time.Now()
+	for name, source := range fbr.FeedbackSources {
+		if source.Monitor == nil {
+			continue
+		}
+		simSource := *source
+		monitor := source.Monitor.Copy()
+		monitor.mutex = &sync.Mutex{}
+		if value, given := values[name]; given {
+			monitor.StatsModel = &StatisticsModel{
+				LastResult: int64(math.Round(value)),
+			}
+			monitor.LastError = nil
+			monitor.lastSample = now
+			monitor.isStale = false
+		}
+		simSource.Monitor = &monitor
+		sim.FeedbackSources[name] = &simSource
+	}
+	breaches := make(map[string]bool, len(sim.FeedbackSources))
+	availability, online, actionMask, logText := sim.evaluateAvailability(
+		breaches)
+	// Without a threshold, the state is never changed by the load.
+	if sim.thresholdModeEnum == ThresholdModeNone {
+		online = true
+		actionMask = HAPEnumNone
+	}
+	mask := sim.configCommandMask
+	if !online && actionMask != HAPEnumNone {
+		mask = actionMask
+	}
+	sim.onlineState = online
+	sim.overrideMask = HAPEnumNone
+	if !online {
+		sim.overrideMask = actionMask
+	}
+	result.Availability = availability
+	result.Online = online
+	result.Commands = sim.GenerateCommandString(online, mask)
+	result.Feedback = strings.TrimSuffix(sim.formatFeedback(sim.FeedbackFormat,
+		availability, result.Commands, true), "\n")
+	for name, source := range sim.FeedbackSources {
+		_, given := values[name]
+		result.Sources[name] = SimulatedSource{
+			Value:     source.Monitor.StatsModel.GetResult(),
+			Load:      getSourceLoad(source),
+			Breached:  breaches[name],
+			Simulated: given,
+		}
+	}
+	for _, line := range strings.Split(logText, "\n") {
+		if line != "" {
+			result.Evaluation = append(result.Evaluation, line)
+		}
+	}
+	sort.Strings(result.Evaluation)
+	return
+}
+
+// parseSimulatedValues parses a list of comma-separated 'source=value'
+// pairs, as given for the 'get simulate' action.
+func parseSimulatedValues(list string) (values map[string]float64,
+	err error) {
+	values = make(map[string]float64)
+	for _, pair := range strings.Split(list, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, value, found := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !found || name == "" {
+			err = errors.New("invalid source value '" + pair +
+				"'; must be 'source=value'")
+			return
+		}
+		var number float64
+		number, err = strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+			err = errors.New("invalid value '" + value + "' for source '" +
+				name + "'")
+			return
+		}
+		values[name] = number
+	}
+	return
+}
+
+// historyValueAt returns the last value recorded by the named monitor at
+// or before a given time, from the history store if enabled, or otherwise
+// from its recent history held in memory.
+func (agent *FeedbackAgent) historyValueAt(name string, at time.Time) (
+	value float64, found bool, err error) {
+	var points []HistoryPoint
+	var store *HistoryStore
+	if agent.historyStore != nil {
+		store = agent.historyStore.Load()
+	}
+	if store != nil {
+		points, err = store.Query(historySeriesName("monitor", name),
+			time.Time{})
+		if err != nil {
+			return
+		}
+	} else if monitor := agent.Monitors[name]; monitor != nil &&
+		monitor.history != nil {
+		points = monitor.history.Points()
+	}
+	// Points are held oldest first.
+	for i := len(points) - 1; i >= 0; i-- {
+		if !points[i].Time.After(at) {
+			value = points[i].Value
+			found = true
+			return
+		}
+	}
+	return
+}
+
+// APIHandleSimulate handles the 'get simulate' action, simulating the
+// feedback of the named Responder for the source values given in the
+// request, with any other sources taking their recorded values at the
+// time given, if any, or otherwise their current values.
+func (agent *FeedbackAgent) APIHandleSimulate(request *APIRequest) (
+	result *SimulationResult, err error) {
+	responder, err := agent.GetResponderByName(request.TargetName)
+	if err != nil {
+		return
+	}
+	given := request.Values != nil && strings.TrimSpace(*request.Values) != ""
+	hasTime := request.At != nil && strings.TrimSpace(*request.At) != ""
+	if !given && !hasTime {
+		err = errors.New("no source values or time specified to simulate")
+		return
+	}
+	values := make(map[string]float64)
+	if given {
+		values, err = parseSimulatedValues(*request.Values)
+		if err != nil {
+			return
+		}
+	}
+	responder.mutex.Lock()
+	sources := make(map[string]string, len(responder.FeedbackSources))
+	for name, source := range responder.FeedbackSources {
+		if source.Monitor != nil {
+			sources[name] = source.Monitor.Name
+		}
+	}
+	responder.mutex.Unlock()
+	for name := range values {
+		if _, exists := sources[name]; !exists {
+			err = errors.New("responder '" + responder.ResponderName +
+				"' has no source named '" + name + "'")
+			return
+		}
+	}
+	var at time.Time
+	if hasTime {
+		at, err = ParseEventTime(*request.At, time.Now())
+		if err != nil {
+			return
+		}
+		for name, monitorName := range sources {
+			if _, exists := values[name]; exists {
+				continue
+			}
+			value, found, queryErr := agent.historyValueAt(monitorName, at)
+			if queryErr != nil {
+				err = errors.New("failed to read the history of monitor '" +
+					monitorName + "': " + queryErr.Error())
+				return
+			}
+			if !found {
+				err = errors.New("no recorded value for monitor '" +
+					monitorName + "' at " + at.Format(time.RFC3339))
+				return
+			}
+			values[name] = value
+		}
+	}
+	simulation := responder.Simulate(values)
+	if hasTime {
+		simulation.At = &at
+	}
+	result = &simulation
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
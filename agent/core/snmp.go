@@ -0,0 +1,764 @@
+// snmp.go
+// SNMP Responder Exposing Feedback Values
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// OID subtree under which the values of an SNMP Responder are exposed
+	// by default, which is the experimental subtree of the Net-SNMP
+	// enterprise; a subtree of the enterprise of the organisation running
+	// the agent should be configured where one is available.
+	DefaultSNMPBaseOID = "1.3.6.1.4.1.8072.9999.9999"
+	// Maximum size of an SNMP message, as limited by UDP.
+	MaxSNMPMessageSize = 65507
+	// Maximum number of variable bindings returned for a GetBulk request.
+	MaxSNMPBulkVarBinds = 1024
+	// Name of the file in the config directory holding the number of times
+	// an SNMP engine has been started, which SNMPv3 requires to increase.
+	SNMPEngineBootsFileName = "snmp-engine-boots"
+)
+
+// SNMP message versions, PDU types and error statuses (RFC 3416).
+const (
+	snmpVersion2c = 1
+	snmpVersion3  = 3
+
+	snmpGetRequest     byte = 0xa0
+	snmpGetNextRequest byte = 0xa1
+	snmpResponse       byte = 0xa2
+	snmpSetRequest     byte = 0xa3
+	snmpGetBulkRequest byte = 0xa5
+	snmpReport         byte = 0xa8
+
+	snmpErrorTooBig      = 1
+	snmpErrorNotWritable = 17
+
+	// Allowance for the parts of a message other than its PDU, when
+	// limiting the size of a response.
+	snmpMessageOverhead = 256
+	// Enterprise number of Net-SNMP, used in the engine ID if the base
+	// OID is not within an enterprise subtree.
+	snmpNetSNMPEnterprise = 8072
+)
+
+// OIDs of the objects exposed by an SNMP Responder, from the system group
+// (RFC 3418) and under the base OID.
+var (
+	oidSysDescr    = snmpOID{1, 3, 6, 1, 2, 1, 1, 1, 0}
+	oidSysObjectID = snmpOID{1, 3, 6, 1, 2, 1, 1, 2, 0}
+	oidSysUpTime   = snmpOID{1, 3, 6, 1, 2, 1, 1, 3, 0}
+	oidSysName     = snmpOID{1, 3, 6, 1, 2, 1, 1, 5, 0}
+	oidEnterprises = snmpOID{1, 3, 6, 1, 4, 1}
+)
+
+// Arcs of the objects under the base OID, as described for SNMPConfig.
+const (
+	snmpArcResponderName = 1
+	snmpArcAvailability  = 2
+	snmpArcOnline        = 3
+	snmpArcFeedback      = 4
+	snmpArcSourceTable   = 5
+	snmpArcSourceName    = 1
+	snmpArcSourceLoad    = 2
+	snmpArcSourceValue   = 3
+)
+
+// #######################################################################
+// Configuration
+// #######################################################################
+
+// SNMPConfig holds the settings of an SNMP Responder. SNMPv2c requests are
+// accepted with the community, if one is set, and SNMPv3 requests from the
+// users configured. The community and passphrases may contain secret
+// references, as for the API key. The engine ID (hex) is generated from
+// the host and Responder names if not set.
+//
+// The values of the Responder are exposed under the base OID:
+//
+//	.1.0      responder name (OCTET STRING)
+//	.2.0      availability score, percent (INTEGER)
+//	.3.0      online state; 1 online, 2 offline (INTEGER)
+//	.4.0      feedback response, as sent to HAProxy (OCTET STRING)
+//	.5.1.1.n  source name (OCTET STRING)
+//	.5.1.2.n  source load, percent (Gauge32)
+//	.5.1.3.n  source raw metric value (CounterBasedGauge64)
+//
+// where the sources are numbered from 1 in order of name.
+type SNMPConfig struct {
+	Community string     `json:"community,omitempty"`
+	Users     []SNMPUser `json:"users,omitempty"`
+	BaseOID   string     `json:"base-oid,omitempty"`
+	EngineID  string     `json:"engine-id,omitempty"`
+}
+
+// SNMPUser is an SNMPv3 user, with its authentication protocol ('md5',
+// 'sha' or 'sha256') and privacy protocol ('des' or 'aes'), neither of
+// which is used if not set. Privacy requires authentication, and the
+// passphrases must be at least 8 characters.
+type SNMPUser struct {
+	Name           string `json:"name"`
+	AuthProtocol   string `json:"auth-protocol,omitempty"`
+	AuthPassphrase string `json:"auth-passphrase,omitempty"`
+	PrivProtocol   string `json:"priv-protocol,omitempty"`
+	PrivPassphrase string `json:"priv-passphrase,omitempty"`
+}
+
+// snmpSettings holds the resolved settings of an SNMP Responder.
+type snmpSettings struct {
+	community string
+	users     map[string]*snmpUSMUser
+	baseOID   snmpOID
+	engineID  []byte
+}
+
+// Validate checks the SNMP settings of a Responder.
+func (config *SNMPConfig) Validate(responderName string) (err error) {
+	_, err = config.resolve(responderName)
+	return
+}
+
+// resolve validates the SNMP settings of a Responder, resolving any secret
+// references and deriving the keys of the users.
+func (config *SNMPConfig) resolve(responderName string) (
+	settings *snmpSettings, err error) {
+	settings = &snmpSettings{users: make(map[string]*snmpUSMUser)}
+	baseOID := config.BaseOID
+	if baseOID == "" {
+		baseOID = DefaultSNMPBaseOID
+	}
+	settings.baseOID, err = parseSNMPOID(baseOID)
+	if err != nil {
+		err = errors.New("invalid SNMP base OID: " + err.Error())
+		return
+	}
+	if config.EngineID != "" {
+		settings.engineID, err = hex.DecodeString(
+			strings.TrimPrefix(strings.ToLower(config.EngineID), "0x"))
+		if err != nil || len(settings.engineID) < 5 ||
+			len(settings.engineID) > 32 {
+			err = errors.New("the SNMP engine ID must be 5 to 32 bytes " +
+				"in hex")
+			return
+		}
+	} else {
+		settings.engineID = defaultSNMPEngineID(settings.baseOID,
+			responderName)
+	}
+	settings.community, err = ResolveSecret(config.Community)
+	if err != nil {
+		err = errors.New("cannot resolve SNMP community: " + err.Error())
+		return
+	}
+	for _, user := range config.Users {
+		if user.Name == "" || len(user.Name) > 32 {
+			err = errors.New("SNMP user names must be 1 to 32 characters")
+			return
+		}
+		if _, exists := settings.users[user.Name]; exists {
+			err = errors.New("SNMP user '" + user.Name +
+				"' is specified more than once")
+			return
+		}
+		var usmUser *snmpUSMUser
+		usmUser, err = newSNMPUSMUser(user, settings.engineID)
+		if err != nil {
+			err = errors.New("SNMP user '" + user.Name + "': " + err.Error())
+			return
+		}
+		settings.users[user.Name] = usmUser
+	}
+	if settings.community == "" && len(settings.users) == 0 {
+		err = errors.New("no SNMP community or users configured")
+	}
+	return
+}
+
+// mergeSNMPConfig returns SNMP settings with those set in an update (e.g.
+// from an edit request) replacing the existing settings.
+func mergeSNMPConfig(config *SNMPConfig, update *SNMPConfig) *SNMPConfig {
+	var merged SNMPConfig
+	if config != nil {
+		merged = *config
+	}
+	if update.Community != "" {
+		merged.Community = update.Community
+	}
+	if update.Users != nil {
+		merged.Users = update.Users
+	}
+	if update.BaseOID != "" {
+		merged.BaseOID = update.BaseOID
+	}
+	if update.EngineID != "" {
+		merged.EngineID = update.EngineID
+	}
+	return &merged
+}
+
+// ParseSNMPUsers parses a list of SNMPv3 users in the format used by the
+// CLI, which is separated by commas, each in the form
+// 'name[:auth-protocol:auth-passphrase[:priv-protocol:priv-passphrase]]';
+// e.g. 'monitor:sha:secret-1:aes:secret-2'.
+func ParseSNMPUsers(text string) (users []SNMPUser, err error) {
+	for _, entry := range strings.Split(text, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		fields := strings.Split(entry, ":")
+		if len(fields) != 1 && len(fields) != 3 && len(fields) != 5 {
+			err = errors.New("invalid SNMP user '" + fields[0] + "'; use " +
+				"'name[:auth-protocol:auth-passphrase[:priv-protocol:" +
+				"priv-passphrase]]'")
+			return
+		}
+		user := SNMPUser{Name: fields[0]}
+		if len(fields) >= 3 {
+			user.AuthProtocol, user.AuthPassphrase = fields[1], fields[2]
+		}
+		if len(fields) == 5 {
+			user.PrivProtocol, user.PrivPassphrase = fields[3], fields[4]
+		}
+		users = append(users, user)
+	}
+	return
+}
+
+// defaultSNMPEngineID generates an engine ID (RFC 3411) for a Responder
+// which is stable across restarts, from the enterprise of the base OID and
+// a hash of the host and Responder names.
+func defaultSNMPEngineID(baseOID snmpOID, responderName string) []byte {
+	enterprise := uint32(snmpNetSNMPEnterprise)
+	if len(baseOID) > len(oidEnterprises) &&
+		baseOID[:len(oidEnterprises)].compare(oidEnterprises) == 0 {
+		enterprise = baseOID[len(oidEnterprises)]
+	}
+	hostname, _ := os.Hostname()
+	hash := sha256.Sum256([]byte(hostname + "/" + responderName))
+	engineID := binary.BigEndian.AppendUint32(nil, enterprise|0x80000000)
+	// Format 5 denotes an engine ID of arbitrary octets.
+	engineID = append(engineID, 5)
+	return append(engineID, hash[:8]...)
+}
+
+// Serialises updates to the file holding the number of engine boots.
+var snmpEngineBootsMutex sync.Mutex
+
+// nextSNMPEngineBoots increments and returns the number of times an SNMP
+// engine has been started, which is held in the config directory so that
+// it increases across restarts of the agent.
+func (agent *FeedbackAgent) nextSNMPEngineBoots() (boots int32) {
+	boots = 1
+	if agent == nil || agent.configDir == "" {
+		return
+	}
+	snmpEngineBootsMutex.Lock()
+	defer snmpEngineBootsMutex.Unlock()
+	filePath := path.Join(agent.configDir, SNMPEngineBootsFileName)
+	data, err := os.ReadFile(filePath)
+	if err == nil {
+		previous, parseErr := strconv.ParseInt(
+			strings.TrimSpace(string(data)), 10, 32)
+		if parseErr == nil && previous > 0 && previous < math.MaxInt32-1 {
+			boots = int32(previous) + 1
+		}
+	}
+	err = WriteFileAtomic(filePath, []byte(strconv.Itoa(int(boots))+"\n"))
+	if err != nil {
+		logrus.Warn("Failed to save the number of SNMP engine boots: " +
+			err.Error())
+	}
+	return
+}
+
+// #######################################################################
+// SNMPConnector
+// #######################################################################
+
+// SNMPConnector answers SNMP requests over UDP for the values of a
+// Responder. Each request generates a feedback response, as for the other
+// protocols, so that the state of the Responder is updated.
+type SNMPConnector struct {
+	responder   *FeedbackResponder
+	settings    *snmpSettings
+	conns       []net.PacketConn
+	engineBoots int32
+	startTime   time.Time
+	// Salt for encryption, incremented for each encrypted message.
+	salt atomic.Uint64
+	// Counters reported in Report PDUs, indexed by USM statistic.
+	usmStats [usmStatsCount]atomic.Uint32
+	closing  bool
+	stopped  chan struct{}
+	mutex    sync.Mutex
+}
+
+func (pc *SNMPConnector) Listen(fbr *FeedbackResponder) (err error) {
+	pc.mutex.Lock()
+	pc.responder = fbr
+	pc.closing = false
+	pc.stopped = nil
+	pc.mutex.Unlock()
+	if fbr.SNMP == nil {
+		err = errors.New("no SNMP settings configured")
+		return
+	}
+	settings, err := fbr.SNMP.resolve(fbr.ResponderName)
+	if err != nil {
+		return
+	}
+	conns, err := listenPacketOnAddresses(fbr)
+	if err != nil {
+		pc.responder.logger().Error("SNMP error: " + err.Error())
+		return
+	}
+	pc.mutex.Lock()
+	if pc.closing {
+		pc.mutex.Unlock()
+		closeListeners(conns)
+		return
+	}
+	pc.settings = settings
+	pc.conns = conns
+	pc.engineBoots = fbr.ParentAgent.nextSNMPEngineBoots()
+	pc.startTime = time.Now()
+	var salt [8]byte
+	_, _ = rand.Read(salt[:])
+	pc.salt.Store(binary.BigEndian.Uint64(salt[:]))
+	stopped := make(chan struct{})
+	pc.stopped = stopped
+	pc.mutex.Unlock()
+	// Serve each additional address in its own goroutine, and the first
+	// address in this one, until all have stopped.
+	var wg sync.WaitGroup
+	for _, conn := range conns[1:] {
+		wg.Add(1)
+		go func(conn net.PacketConn) {
+			defer wg.Done()
+			pc.serve(conn)
+		}(conn)
+	}
+	pc.serve(conns[0])
+	wg.Wait()
+	closeListeners(conns)
+	close(stopped)
+	return
+}
+
+// isClosing returns whether the connector is shutting down.
+func (pc *SNMPConnector) isClosing() bool {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	return pc.closing
+}
+
+// serve answers the requests received on a socket until the connector is
+// shut down.
+func (pc *SNMPConnector) serve(conn net.PacketConn) {
+	buffer := make([]byte, MaxSNMPMessageSize)
+	for {
+		length, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if pc.isClosing() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			time.Sleep(MinAcceptRetryDelay)
+			continue
+		}
+		// Silently drop any requests from clients outside the allowed
+		// ranges, or exceeding the request limits.
+		limitErr := pc.responder.AcquireConnection(addr.String())
+		if limitErr != nil {
+			pc.responder.logger().Debug(pc.responder.getLogHead() +
+				"dropped SNMP request from " + addr.String() + ": " +
+				limitErr.Error())
+			continue
+		}
+		started := time.Now()
+		response := pc.handleMessage(buffer[:length])
+		pc.responder.ReleaseConnection()
+		if response == nil {
+			continue
+		}
+		pc.responder.stats.record(time.Since(started), false)
+		_, err = conn.WriteTo(response, addr)
+		if err != nil && !pc.isClosing() {
+			pc.responder.stats.addError()
+			pc.responder.logger().Error("Error responding to SNMP " +
+				"request: " + err.Error())
+		}
+	}
+}
+
+// Shutdown stops reading requests, allowing any being answered to
+// complete within the drain timeout.
+func (pc *SNMPConnector) Shutdown(drainTimeout time.Duration) (err error) {
+	pc.mutex.Lock()
+	pc.closing = true
+	conns := pc.conns
+	stopped := pc.stopped
+	pc.mutex.Unlock()
+	// Interrupt reading rather than closing the sockets, so that any
+	// response being sent is not lost.
+	for _, conn := range conns {
+		_ = conn.SetReadDeadline(time.Now())
+	}
+	if stopped == nil {
+		return
+	}
+	select {
+	case <-stopped:
+	case <-time.After(drainTimeout):
+		closeListeners(conns)
+		err = errors.New("in-flight SNMP requests did not complete " +
+			"within the drain timeout and were abandoned")
+	}
+	return
+}
+
+// handleMessage answers an SNMP message, returning the encoded response,
+// or nil if none should be sent.
+func (pc *SNMPConnector) handleMessage(data []byte) (response []byte) {
+	message, err := (&berDecoder{data: data}).expect(berSequence)
+	if err != nil {
+		return
+	}
+	fields := newBERDecoder(message)
+	version, err := fields.readInteger()
+	if err != nil {
+		return
+	}
+	switch version {
+	case snmpVersion2c:
+		response = pc.handleCommunityMessage(fields)
+	case snmpVersion3:
+		response = pc.handleUSMMessage(data, fields)
+	}
+	return
+}
+
+// handleCommunityMessage answers an SNMPv2c message, which is ignored if
+// it does not have the configured community.
+func (pc *SNMPConnector) handleCommunityMessage(fields *berDecoder) (
+	response []byte) {
+	community, err := fields.readOctetString()
+	if err != nil || pc.settings.community == "" ||
+		subtle.ConstantTimeCompare(community,
+			[]byte(pc.settings.community)) != 1 {
+		return
+	}
+	pduValue, err := fields.next()
+	if err != nil {
+		return
+	}
+	request, err := decodeSNMPPDU(pduValue)
+	if err != nil {
+		return
+	}
+	pdu, ok := pc.processPDU(request,
+		MaxSNMPMessageSize-len(community)-snmpMessageOverhead)
+	if !ok {
+		return
+	}
+	response = berEncode(berSequence, berInt(snmpVersion2c),
+		berOctets(community), pdu)
+	return
+}
+
+// #######################################################################
+// PDUs
+// #######################################################################
+
+// snmpPDU is an SNMP protocol data unit.
+type snmpPDU struct {
+	pduType   byte
+	requestID int64
+	// The error status and index, or for GetBulk requests, the number of
+	// non-repeaters and maximum repetitions.
+	errorStatus int64
+	errorIndex  int64
+	varBinds    []snmpVarBind
+}
+
+// snmpVarBind is a variable binding of an OID to an encoded value.
+type snmpVarBind struct {
+	oid   snmpOID
+	value []byte
+}
+
+// decodeSNMPPDU decodes a PDU, ignoring the values of its bindings.
+func decodeSNMPPDU(value berValue) (pdu snmpPDU, err error) {
+	pdu.pduType = value.tag
+	fields := newBERDecoder(value)
+	pdu.requestID, err = fields.readInteger()
+	if err != nil {
+		return
+	}
+	pdu.errorStatus, err = fields.readInteger()
+	if err != nil {
+		return
+	}
+	pdu.errorIndex, err = fields.readInteger()
+	if err != nil {
+		return
+	}
+	list, err := fields.expect(berSequence)
+	if err != nil {
+		return
+	}
+	bindings := newBERDecoder(list)
+	for bindings.more() {
+		var binding berValue
+		binding, err = bindings.expect(berSequence)
+		if err != nil {
+			return
+		}
+		var oid snmpOID
+		oid, err = newBERDecoder(binding).readOID()
+		if err != nil {
+			return
+		}
+		pdu.varBinds = append(pdu.varBinds, snmpVarBind{oid: oid})
+	}
+	return
+}
+
+// encode encodes the PDU.
+func (pdu *snmpPDU) encode() []byte {
+	bindings := make([][]byte, len(pdu.varBinds))
+	for i, binding := range pdu.varBinds {
+		bindings[i] = berEncode(berSequence, berOIDValue(binding.oid),
+			binding.value)
+	}
+	return berEncode(pdu.pduType, berInt(pdu.requestID),
+		berInt(pdu.errorStatus), berInt(pdu.errorIndex),
+		berEncode(berSequence, bindings...))
+}
+
+// processPDU answers a request PDU, returning the encoded response PDU,
+// which is limited to a maximum size; ok is false if no response should
+// be sent.
+func (pc *SNMPConnector) processPDU(request snmpPDU, maxSize int) (
+	encoded []byte, ok bool) {
+	response := snmpPDU{pduType: snmpResponse, requestID: request.requestID}
+	switch request.pduType {
+	case snmpGetRequest, snmpGetNextRequest, snmpGetBulkRequest:
+		view := pc.buildView()
+		response.varBinds = view.lookup(request)
+	case snmpSetRequest:
+		response.varBinds = request.varBinds
+		for i := range response.varBinds {
+			response.varBinds[i].value = berEncode(berNull)
+		}
+		response.errorStatus = snmpErrorNotWritable
+		response.errorIndex = 1
+	default:
+		return
+	}
+	ok = true
+	encoded = response.encode()
+	for len(encoded) > maxSize {
+		if request.pduType == snmpGetBulkRequest && len(response.varBinds) > 1 {
+			// Responses to GetBulk requests are truncated to fit.
+			response.varBinds = response.varBinds[:len(response.varBinds)/2]
+		} else {
+			response.varBinds = nil
+			response.errorStatus = snmpErrorTooBig
+			response.errorIndex = 0
+		}
+		encoded = response.encode()
+	}
+	return
+}
+
+// #######################################################################
+// Object View
+// #######################################################################
+
+// snmpView is the set of objects exposed, sorted by OID.
+type snmpView []snmpVarBind
+
+// snmpSourceStatus holds the values exposed for a feedback source.
+type snmpSourceStatus struct {
+	name  string
+	load  int
+	value int64
+}
+
+// getSNMPStatus returns the values of this FeedbackResponder exposed over
+// SNMP, with its sources in order of name.
+func (fbr *FeedbackResponder) getSNMPStatus() (availability int, online bool,
+	sources []snmpSourceStatus) {
+	fbr.mutex.Lock()
+	defer fbr.mutex.Unlock()
+	availability, _, _ = fbr.GetAvailabilityState()
+	online = fbr.onlineState
+	for _, name := range sortedKeys(fbr.FeedbackSources) {
+		source := fbr.FeedbackSources[name]
+		if source.Monitor == nil {
+			continue
+		}
+		sources = append(sources, snmpSourceStatus{
+			name:  name,
+			load:  getSourceLoad(source),
+			value: source.Monitor.StatsModel.GetResult(),
+		})
+	}
+	return
+}
+
+// buildView gathers the current values of the Responder.
+func (pc *SNMPConnector) buildView() (view snmpView) {
+	fbr := pc.responder
+	feedback, _ := fbr.HandleFeedback()
+	feedback = strings.TrimSpace(feedback)
+	fbr.markResponded()
+	availability, online, sources := fbr.getSNMPStatus()
+	base := pc.settings.baseOID
+	hostname, _ := os.Hostname()
+	upTime := time.Since(pc.startTime) / (10 * time.Millisecond)
+	onlineValue := int64(2)
+	if online {
+		onlineValue = 1
+	}
+	view = snmpView{
+		{oidSysDescr, berOctets([]byte(ApplicationName + " v" + VersionString))},
+		{oidSysObjectID, berOIDValue(base)},
+		{oidSysUpTime, berUnsigned(berTimeTicks, uint64(uint32(upTime)))},
+		{oidSysName, berOctets([]byte(hostname))},
+		{base.append(snmpArcResponderName, 0), berOctets([]byte(fbr.ResponderName))},
+		{base.append(snmpArcAvailability, 0), berInt(int64(availability))},
+		{base.append(snmpArcOnline, 0), berInt(onlineValue)},
+		{base.append(snmpArcFeedback, 0), berOctets([]byte(feedback))},
+	}
+	table := base.append(snmpArcSourceTable, 1)
+	for i, source := range sources {
+		index := uint32(i + 1)
+		view = append(view,
+			snmpVarBind{table.append(snmpArcSourceName, index),
+				berOctets([]byte(source.name))},
+			snmpVarBind{table.append(snmpArcSourceLoad, index),
+				berUnsigned(berGauge32, uint64(source.load))},
+			snmpVarBind{table.append(snmpArcSourceValue, index),
+				berUnsigned(berCounter64, uint64(max(source.value, 0)))},
+		)
+	}
+	sort.Slice(view, func(i, j int) bool {
+		return view[i].oid.compare(view[j].oid) < 0
+	})
+	return
+}
+
+// get returns the binding for an OID in a Get request.
+func (view snmpView) get(oid snmpOID) snmpVarBind {
+	i := sort.Search(len(view), func(i int) bool {
+		return view[i].oid.compare(oid) >= 0
+	})
+	if i < len(view) && view[i].oid.compare(oid) == 0 {
+		return view[i]
+	}
+	// Distinguish a missing instance of an object which exists.
+	for _, binding := range view {
+		if len(oid) > 0 && binding.oid[:len(binding.oid)-1].compare(
+			oid[:len(oid)-1]) == 0 {
+			return snmpVarBind{oid, berEncode(berNoSuchInstance)}
+		}
+	}
+	return snmpVarBind{oid, berEncode(berNoSuchObject)}
+}
+
+// getNext returns the binding following an OID in a GetNext request.
+func (view snmpView) getNext(oid snmpOID) snmpVarBind {
+	i := sort.Search(len(view), func(i int) bool {
+		return view[i].oid.compare(oid) > 0
+	})
+	if i < len(view) {
+		return view[i]
+	}
+	return snmpVarBind{oid, berEncode(berEndOfMibView)}
+}
+
+// lookup returns the bindings answering a Get, GetNext or GetBulk request.
+func (view snmpView) lookup(request snmpPDU) (bindings []snmpVarBind) {
+	switch request.pduType {
+	case snmpGetRequest:
+		for _, binding := range request.varBinds {
+			bindings = append(bindings, view.get(binding.oid))
+		}
+	case snmpGetNextRequest:
+		for _, binding := range request.varBinds {
+			bindings = append(bindings, view.getNext(binding.oid))
+		}
+	case snmpGetBulkRequest:
+		nonRepeaters := int(min(max(request.errorStatus, 0),
+			int64(len(request.varBinds))))
+		repetitions := int(min(max(request.errorIndex, 0),
+			MaxSNMPBulkVarBinds))
+		for _, binding := range request.varBinds[:nonRepeaters] {
+			bindings = append(bindings, view.getNext(binding.oid))
+		}
+		repeaters := request.varBinds[nonRepeaters:]
+		last := make([]snmpOID, len(repeaters))
+		for i, binding := range repeaters {
+			last[i] = binding.oid
+		}
+		for repetition := 0; repetition < repetitions && len(repeaters) > 0 &&
+			len(bindings) < MaxSNMPBulkVarBinds; repetition++ {
+			ended := true
+			for i := range repeaters {
+				next := view.getNext(last[i])
+				if next.value[0] != berEndOfMibView {
+					ended = false
+				}
+				last[i] = next.oid
+				bindings = append(bindings, next)
+			}
+			if ended {
+				break
+			}
+		}
+	}
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
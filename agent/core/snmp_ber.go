@@ -0,0 +1,341 @@
+// snmp_ber.go
+// BER Encoding and Decoding of SNMP Messages
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// ASN.1 BER tags of the types used within SNMP messages.
+const (
+	berInteger        byte = 0x02
+	berOctetString    byte = 0x04
+	berNull           byte = 0x05
+	berOID            byte = 0x06
+	berSequence       byte = 0x30
+	berCounter32      byte = 0x41
+	berGauge32        byte = 0x42
+	berTimeTicks      byte = 0x43
+	berCounter64      byte = 0x46
+	berNoSuchObject   byte = 0x80
+	berNoSuchInstance byte = 0x81
+	berEndOfMibView   byte = 0x82
+)
+
+var errBERMalformed = errors.New("malformed BER encoding")
+
+// #######################################################################
+// Object Identifiers
+// #######################################################################
+
+// snmpOID is an SNMP object identifier.
+type snmpOID []uint32
+
+// parseSNMPOID parses an OID in dotted notation, with or without a leading
+// dot; e.g. '1.3.6.1.4.1'.
+func parseSNMPOID(text string) (oid snmpOID, err error) {
+	text = strings.TrimPrefix(strings.TrimSpace(text), ".")
+	for _, arc := range strings.Split(text, ".") {
+		value, parseErr := strconv.ParseUint(arc, 10, 32)
+		if parseErr != nil {
+			err = errors.New("invalid OID '" + text + "'")
+			return
+		}
+		oid = append(oid, uint32(value))
+	}
+	if len(oid) < 2 || oid[0] > 2 || (oid[0] < 2 && oid[1] >= 40) {
+		err = errors.New("invalid OID '" + text + "'")
+	}
+	return
+}
+
+// String returns the OID in dotted notation.
+func (oid snmpOID) String() string {
+	arcs := make([]string, len(oid))
+	for i, arc := range oid {
+		arcs[i] = strconv.FormatUint(uint64(arc), 10)
+	}
+	return strings.Join(arcs, ".")
+}
+
+// compare returns -1, 0 or 1 as this OID sorts before, equal to or after
+// another in lexicographical order.
+func (oid snmpOID) compare(other snmpOID) int {
+	for i := 0; i < len(oid) && i < len(other); i++ {
+		if oid[i] != other[i] {
+			if oid[i] < other[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(oid) < len(other):
+		return -1
+	case len(oid) > len(other):
+		return 1
+	}
+	return 0
+}
+
+// append returns a new OID with further arcs appended to this one.
+func (oid snmpOID) append(arcs ...uint32) snmpOID {
+	result := make(snmpOID, 0, len(oid)+len(arcs))
+	return append(append(result, oid...), arcs...)
+}
+
+// #######################################################################
+// Decoding
+// #######################################################################
+
+// berValue is a decoded BER element, holding the position of its content
+// within the message so that it can be located there (e.g. to verify an
+// authentication digest).
+type berValue struct {
+	tag     byte
+	content []byte
+	offset  int
+}
+
+// berDecoder reads the successive elements within the content of a BER
+// element.
+type berDecoder struct {
+	data   []byte
+	pos    int
+	offset int
+}
+
+// newBERDecoder creates a decoder for the elements within a BER element.
+func newBERDecoder(value berValue) *berDecoder {
+	return &berDecoder{data: value.content, offset: value.offset}
+}
+
+// more returns whether any elements remain to be read.
+func (decoder *berDecoder) more() bool {
+	return decoder.pos < len(decoder.data)
+}
+
+// next reads the next element.
+func (decoder *berDecoder) next() (value berValue, err error) {
+	data := decoder.data[decoder.pos:]
+	if len(data) < 2 {
+		err = errBERMalformed
+		return
+	}
+	value.tag = data[0]
+	length := int(data[1])
+	header := 2
+	if length&0x80 != 0 {
+		count := length & 0x7f
+		if count == 0 || count > 3 || len(data) < header+count {
+			err = errBERMalformed
+			return
+		}
+		length = 0
+		for _, b := range data[header : header+count] {
+			length = length<<8 | int(b)
+		}
+		header += count
+	}
+	if length > len(data)-header {
+		err = errBERMalformed
+		return
+	}
+	value.content = data[header : header+length]
+	value.offset = decoder.offset + decoder.pos + header
+	decoder.pos += header + length
+	return
+}
+
+// expect reads the next element, which must have a given tag.
+func (decoder *berDecoder) expect(tag byte) (value berValue, err error) {
+	value, err = decoder.next()
+	if err == nil && value.tag != tag {
+		err = errBERMalformed
+	}
+	return
+}
+
+// readInteger reads an INTEGER element.
+func (decoder *berDecoder) readInteger() (number int64, err error) {
+	value, err := decoder.expect(berInteger)
+	if err != nil {
+		return
+	}
+	number, err = decodeBERInteger(value.content)
+	return
+}
+
+// readOctetString reads an OCTET STRING element.
+func (decoder *berDecoder) readOctetString() (octets []byte, err error) {
+	value, err := decoder.expect(berOctetString)
+	octets = value.content
+	return
+}
+
+// readOID reads an OBJECT IDENTIFIER element.
+func (decoder *berDecoder) readOID() (oid snmpOID, err error) {
+	value, err := decoder.expect(berOID)
+	if err != nil {
+		return
+	}
+	oid, err = decodeBEROID(value.content)
+	return
+}
+
+// decodeBERInteger decodes the content of a signed INTEGER element.
+func decodeBERInteger(content []byte) (number int64, err error) {
+	if len(content) == 0 || len(content) > 8 {
+		err = errBERMalformed
+		return
+	}
+	// Sign-extend from the first byte.
+	number = int64(int8(content[0]))
+	for _, b := range content[1:] {
+		number = number<<8 | int64(b)
+	}
+	return
+}
+
+// decodeBEROID decodes the content of an OBJECT IDENTIFIER element.
+func decodeBEROID(content []byte) (oid snmpOID, err error) {
+	if len(content) == 0 {
+		err = errBERMalformed
+		return
+	}
+	var arc uint64
+	for i, b := range content {
+		arc = arc<<7 | uint64(b&0x7f)
+		if arc > 0xffffffff {
+			err = errBERMalformed
+			return
+		}
+		if b&0x80 != 0 {
+			if i == len(content)-1 {
+				err = errBERMalformed
+				return
+			}
+			continue
+		}
+		if len(oid) == 0 {
+			// The first two arcs are combined in the first subidentifier.
+			first := min(arc/40, 2)
+			oid = append(oid, uint32(first), uint32(arc-first*40))
+		} else {
+			oid = append(oid, uint32(arc))
+		}
+		arc = 0
+	}
+	return
+}
+
+// #######################################################################
+// Encoding
+// #######################################################################
+
+// berEncode encodes a BER element with a tag and content, which is the
+// concatenation of any number of parts (e.g. the elements of a SEQUENCE).
+func berEncode(tag byte, parts ...[]byte) []byte {
+	length := 0
+	for _, part := range parts {
+		length += len(part)
+	}
+	encoded := make([]byte, 0, berHeaderLength(length)+length)
+	encoded = append(encoded, tag)
+	encoded = append(encoded, berLength(length)...)
+	for _, part := range parts {
+		encoded = append(encoded, part...)
+	}
+	return encoded
+}
+
+// berLength encodes the length of the content of an element.
+func berLength(length int) []byte {
+	if length < 0x80 {
+		return []byte{byte(length)}
+	}
+	var octets []byte
+	for ; length > 0; length >>= 8 {
+		octets = append([]byte{byte(length)}, octets...)
+	}
+	return append([]byte{0x80 | byte(len(octets))}, octets...)
+}
+
+// berHeaderLength returns the length of the tag and length of an element
+// with content of a given length.
+func berHeaderLength(length int) int {
+	return 1 + len(berLength(length))
+}
+
+// berInt encodes a signed INTEGER element.
+func berInt(number int64) []byte {
+	content := []byte{byte(number)}
+	for number >>= 8; ; number >>= 8 {
+		// Stop once the remaining bytes are only sign extension.
+		if (number == 0 && content[0]&0x80 == 0) ||
+			(number == -1 && content[0]&0x80 != 0) {
+			break
+		}
+		content = append([]byte{byte(number)}, content...)
+	}
+	return berEncode(berInteger, content)
+}
+
+// berUnsigned encodes an unsigned integer element with an application tag,
+// such as a Counter32 or Gauge32.
+func berUnsigned(tag byte, number uint64) []byte {
+	content := []byte{byte(number)}
+	for number >>= 8; number > 0; number >>= 8 {
+		content = append([]byte{byte(number)}, content...)
+	}
+	if content[0]&0x80 != 0 {
+		content = append([]byte{0}, content...)
+	}
+	return berEncode(tag, content)
+}
+
+// berOctets encodes an OCTET STRING element.
+func berOctets(octets []byte) []byte {
+	return berEncode(berOctetString, octets)
+}
+
+// berOIDValue encodes an OBJECT IDENTIFIER element.
+func berOIDValue(oid snmpOID) []byte {
+	var content []byte
+	arcs := []uint32(oid)
+	if len(arcs) >= 2 {
+		arcs = append([]uint32{arcs[0]*40 + arcs[1]}, arcs[2:]...)
+	}
+	for _, arc := range arcs {
+		encoded := []byte{byte(arc & 0x7f)}
+		for arc >>= 7; arc > 0; arc >>= 7 {
+			encoded = append([]byte{byte(arc&0x7f) | 0x80}, encoded...)
+		}
+		content = append(content, encoded...)
+	}
+	return berEncode(berOID, content)
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
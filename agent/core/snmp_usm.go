@@ -0,0 +1,482 @@
+// snmp_usm.go
+// SNMPv3 User-Based Security Model for the SNMP Responder
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"strings"
+	"time"
+)
+
+// Message flags, security model and timeliness of the USM (RFC 3414).
+const (
+	snmpFlagAuth       byte = 0x01
+	snmpFlagPriv       byte = 0x02
+	snmpFlagReportable byte = 0x04
+
+	snmpSecurityModelUSM = 3
+	// Minimum maximum message size which an SNMP engine must accept.
+	snmpMinMessageSize = 484
+	// Window (seconds) within which the engine time of an authenticated
+	// message must fall.
+	snmpTimeWindow = 150
+	// Length of the passphrase expansion from which keys are derived.
+	snmpKeyExpansionLength = 1048576
+)
+
+// USM statistics, reported in Report PDUs under usmStats.
+const (
+	usmStatsUnsupportedSecLevels = iota + 1
+	usmStatsNotInTimeWindows
+	usmStatsUnknownUserNames
+	usmStatsUnknownEngineIDs
+	usmStatsWrongDigests
+	usmStatsDecryptionErrors
+	usmStatsCount = usmStatsDecryptionErrors
+)
+
+var oidUSMStats = snmpOID{1, 3, 6, 1, 6, 3, 15, 1, 1}
+
+// snmpUSMUser is an SNMPv3 user with its keys localised to the engine.
+type snmpUSMUser struct {
+	name         string
+	authHash     func() hash.Hash
+	authLength   int
+	authKey      []byte
+	privProtocol string
+	privKey      []byte
+}
+
+// newSNMPUSMUser resolves the passphrases of a user and derives its keys
+// for an engine.
+func newSNMPUSMUser(user SNMPUser, engineID []byte) (
+	usmUser *snmpUSMUser, err error) {
+	usmUser = &snmpUSMUser{name: user.Name}
+	switch strings.ToLower(user.AuthProtocol) {
+	case "":
+	case "md5":
+		usmUser.authHash, usmUser.authLength = md5.New, 12
+	case "sha":
+		usmUser.authHash, usmUser.authLength = sha1.New, 12
+	case "sha256":
+		usmUser.authHash, usmUser.authLength = sha256.New, 24
+	default:
+		err = errors.New("unknown authentication protocol '" +
+			user.AuthProtocol + "'; use md5, sha or sha256")
+		return
+	}
+	usmUser.privProtocol = strings.ToLower(user.PrivProtocol)
+	switch usmUser.privProtocol {
+	case "", "des", "aes":
+	default:
+		err = errors.New("unknown privacy protocol '" + user.PrivProtocol +
+			"'; use des or aes")
+		return
+	}
+	if usmUser.privProtocol != "" && usmUser.authHash == nil {
+		err = errors.New("privacy requires an authentication protocol")
+		return
+	}
+	if usmUser.authHash != nil {
+		usmUser.authKey, err = usmUser.deriveKey(user.AuthPassphrase,
+			engineID)
+		if err != nil {
+			err = errors.New("authentication " + err.Error())
+			return
+		}
+	}
+	if usmUser.privProtocol != "" {
+		usmUser.privKey, err = usmUser.deriveKey(user.PrivPassphrase,
+			engineID)
+		if err != nil {
+			err = errors.New("privacy " + err.Error())
+		}
+	}
+	return
+}
+
+// deriveKey resolves a passphrase and derives the key localised to an
+// engine from it, using the authentication hash of the user (RFC 3414,
+// A.2).
+func (user *snmpUSMUser) deriveKey(passphrase string, engineID []byte) (
+	key []byte, err error) {
+	passphrase, err = ResolveSecret(passphrase)
+	if err != nil {
+		err = errors.New("passphrase cannot be resolved: " + err.Error())
+		return
+	}
+	if len(passphrase) < 8 {
+		err = errors.New("passphrase must be at least 8 characters")
+		return
+	}
+	digest := user.authHash()
+	chunk := make([]byte, 64)
+	for i := 0; i < snmpKeyExpansionLength; i += len(chunk) {
+		for j := range chunk {
+			chunk[j] = passphrase[(i+j)%len(passphrase)]
+		}
+		digest.Write(chunk)
+	}
+	key = digest.Sum(nil)
+	digest.Reset()
+	digest.Write(key)
+	digest.Write(engineID)
+	digest.Write(key)
+	key = digest.Sum(nil)
+	return
+}
+
+// authenticate returns the digest of a whole message, in which the
+// authentication parameters are zeroed.
+func (user *snmpUSMUser) authenticate(message []byte) []byte {
+	mac := hmac.New(user.authHash, user.authKey)
+	mac.Write(message)
+	return mac.Sum(nil)[:user.authLength]
+}
+
+// encrypt encrypts a scoped PDU with DES-CBC (RFC 3414) or AES-128-CFB
+// (RFC 3826), returning the privacy parameters (salt) used.
+func (user *snmpUSMUser) encrypt(plaintext []byte, boots int32,
+	engineTime int32, salt uint64) (ciphertext []byte, privParams []byte,
+	err error) {
+	privParams = make([]byte, 8)
+	switch user.privProtocol {
+	case "des":
+		binary.BigEndian.PutUint32(privParams, uint32(boots))
+		binary.BigEndian.PutUint32(privParams[4:], uint32(salt))
+		var block cipher.Block
+		block, err = des.NewCipher(user.privKey[:8])
+		if err != nil {
+			return
+		}
+		padding := (des.BlockSize - len(plaintext)%des.BlockSize) %
+			des.BlockSize
+		ciphertext = append(bytes.Clone(plaintext), make([]byte, padding)...)
+		cipher.NewCBCEncrypter(block, user.desIV(privParams)).CryptBlocks(
+			ciphertext, ciphertext)
+	case "aes":
+		binary.BigEndian.PutUint64(privParams, salt)
+		var block cipher.Block
+		block, err = aes.NewCipher(user.privKey[:16])
+		if err != nil {
+			return
+		}
+		ciphertext = make([]byte, len(plaintext))
+		cipher.NewCFBEncrypter(block, aesIV(boots, engineTime,
+			privParams)).XORKeyStream(ciphertext, plaintext)
+	}
+	return
+}
+
+// decrypt decrypts an encrypted scoped PDU, given the privacy parameters
+// and the engine boots and time of its message.
+func (user *snmpUSMUser) decrypt(ciphertext []byte, privParams []byte,
+	boots int32, engineTime int32) (plaintext []byte, err error) {
+	if len(privParams) != 8 {
+		err = errors.New("invalid privacy parameters")
+		return
+	}
+	plaintext = make([]byte, len(ciphertext))
+	switch user.privProtocol {
+	case "des":
+		if len(ciphertext)%des.BlockSize != 0 {
+			err = errors.New("invalid encrypted data length")
+			return
+		}
+		var block cipher.Block
+		block, err = des.NewCipher(user.privKey[:8])
+		if err != nil {
+			return
+		}
+		cipher.NewCBCDecrypter(block, user.desIV(privParams)).CryptBlocks(
+			plaintext, ciphertext)
+	case "aes":
+		var block cipher.Block
+		block, err = aes.NewCipher(user.privKey[:16])
+		if err != nil {
+			return
+		}
+		cipher.NewCFBDecrypter(block, aesIV(boots, engineTime,
+			privParams)).XORKeyStream(plaintext, ciphertext)
+	}
+	return
+}
+
+// desIV returns the DES initialisation vector for a salt, which is the
+// pre-IV from the privacy key combined with the salt.
+func (user *snmpUSMUser) desIV(salt []byte) (iv []byte) {
+	iv = make([]byte, des.BlockSize)
+	for i := range iv {
+		iv[i] = user.privKey[8+i] ^ salt[i]
+	}
+	return
+}
+
+// aesIV returns the AES initialisation vector for the engine boots and
+// time of a message and a salt.
+func aesIV(boots int32, engineTime int32, salt []byte) (iv []byte) {
+	iv = binary.BigEndian.AppendUint32(nil, uint32(boots))
+	iv = binary.BigEndian.AppendUint32(iv, uint32(engineTime))
+	return append(iv, salt...)
+}
+
+// #######################################################################
+// SNMPv3 Messages
+// #######################################################################
+
+// engineTime returns the number of seconds since the SNMP engine started.
+func (pc *SNMPConnector) engineTime() int32 {
+	return int32(time.Since(pc.startTime).Seconds())
+}
+
+// handleUSMMessage answers an SNMPv3 message, sending a Report PDU for
+// any security failure if the request is reportable. The whole message is
+// required, as its digest covers it.
+func (pc *SNMPConnector) handleUSMMessage(data []byte, fields *berDecoder) (
+	response []byte) {
+	header, err := fields.expect(berSequence)
+	if err != nil {
+		return
+	}
+	headerFields := newBERDecoder(header)
+	msgID, err := headerFields.readInteger()
+	if err != nil {
+		return
+	}
+	maxSize, err := headerFields.readInteger()
+	if err != nil || maxSize < snmpMinMessageSize {
+		return
+	}
+	flagOctets, err := headerFields.readOctetString()
+	if err != nil || len(flagOctets) != 1 {
+		return
+	}
+	securityModel, err := headerFields.readInteger()
+	if err != nil || securityModel != snmpSecurityModelUSM {
+		return
+	}
+	securityOctets, err := fields.expect(berOctetString)
+	if err != nil {
+		return
+	}
+	security, err := newBERDecoder(securityOctets).expect(berSequence)
+	if err != nil {
+		return
+	}
+	securityFields := newBERDecoder(security)
+	engineID, err := securityFields.readOctetString()
+	if err != nil {
+		return
+	}
+	boots, err := securityFields.readInteger()
+	if err != nil {
+		return
+	}
+	messageTime, err := securityFields.readInteger()
+	if err != nil {
+		return
+	}
+	userName, err := securityFields.readOctetString()
+	if err != nil {
+		return
+	}
+	authParams, err := securityFields.expect(berOctetString)
+	if err != nil {
+		return
+	}
+	privParams, err := securityFields.readOctetString()
+	if err != nil {
+		return
+	}
+	msgData, err := fields.next()
+	if err != nil {
+		return
+	}
+	flags := flagOctets[0]
+	auth := flags&snmpFlagAuth != 0
+	priv := flags&snmpFlagPriv != 0
+	if priv && !auth {
+		return
+	}
+	// The request ID can only be given in a report if the scoped PDU is
+	// not encrypted.
+	requestID := int64(0)
+	if msgData.tag == berSequence {
+		scoped := newBERDecoder(msgData)
+		_, _ = scoped.next()
+		_, _ = scoped.next()
+		if pduValue, pduErr := scoped.next(); pduErr == nil {
+			requestID, _ = newBERDecoder(pduValue).readInteger()
+		}
+	}
+	report := func(statistic int, user *snmpUSMUser) []byte {
+		count := pc.usmStats[statistic-1].Add(1)
+		if flags&snmpFlagReportable == 0 {
+			return nil
+		}
+		pdu := snmpPDU{
+			pduType:   snmpReport,
+			requestID: requestID,
+			varBinds: []snmpVarBind{{
+				oid:   oidUSMStats.append(uint32(statistic), 0),
+				value: berUnsigned(berCounter32, uint64(count)),
+			}},
+		}
+		// Reports are authenticated only once the user is known to have
+		// the correct key.
+		reportFlags := byte(0)
+		if user != nil {
+			reportFlags = snmpFlagAuth
+		}
+		message, _ := pc.encodeUSMMessage(msgID, reportFlags, user, userName,
+			nil, pdu.encode())
+		return message
+	}
+	settings := pc.settings
+	if !bytes.Equal(engineID, settings.engineID) {
+		return report(usmStatsUnknownEngineIDs, nil)
+	}
+	user, exists := settings.users[string(userName)]
+	if !exists {
+		return report(usmStatsUnknownUserNames, nil)
+	}
+	if auth != (user.authHash != nil) || priv != (user.privProtocol != "") {
+		return report(usmStatsUnsupportedSecLevels, nil)
+	}
+	if auth {
+		if len(authParams.content) != user.authLength {
+			return report(usmStatsWrongDigests, nil)
+		}
+		unsigned := bytes.Clone(data)
+		clear(unsigned[authParams.offset : authParams.offset+user.authLength])
+		if !hmac.Equal(authParams.content, user.authenticate(unsigned)) {
+			return report(usmStatsWrongDigests, nil)
+		}
+		timeDifference := messageTime - int64(pc.engineTime())
+		if boots != int64(pc.engineBoots) || timeDifference > snmpTimeWindow ||
+			timeDifference < -snmpTimeWindow {
+			return report(usmStatsNotInTimeWindows, user)
+		}
+	}
+	scopedPDU := msgData
+	if priv {
+		if msgData.tag != berOctetString {
+			return
+		}
+		plaintext, decryptErr := user.decrypt(msgData.content, privParams,
+			int32(boots), int32(messageTime))
+		if decryptErr == nil {
+			scopedPDU, decryptErr = (&berDecoder{data: plaintext}).expect(
+				berSequence)
+		}
+		if decryptErr != nil {
+			return report(usmStatsDecryptionErrors, nil)
+		}
+	} else if msgData.tag != berSequence {
+		return
+	}
+	scoped := newBERDecoder(scopedPDU)
+	_, err = scoped.readOctetString()
+	if err != nil {
+		return
+	}
+	contextName, err := scoped.readOctetString()
+	if err != nil {
+		return
+	}
+	pduValue, err := scoped.next()
+	if err != nil {
+		return
+	}
+	request, err := decodeSNMPPDU(pduValue)
+	if err != nil {
+		return
+	}
+	pdu, ok := pc.processPDU(request,
+		int(min(maxSize, MaxSNMPMessageSize))-snmpMessageOverhead)
+	if !ok {
+		return
+	}
+	response, err = pc.encodeUSMMessage(msgID, flags&(snmpFlagAuth|
+		snmpFlagPriv), user, userName, contextName, pdu)
+	if err != nil {
+		pc.responder.logger().Error("Error encoding SNMP response: " +
+			err.Error())
+	}
+	return
+}
+
+// encodeUSMMessage encodes an SNMPv3 message containing a PDU, encrypting
+// and authenticating it as the flags require.
+func (pc *SNMPConnector) encodeUSMMessage(msgID int64, flags byte,
+	user *snmpUSMUser, userName []byte, contextName []byte, pdu []byte) (
+	message []byte, err error) {
+	engineID := pc.settings.engineID
+	boots, engineTime := pc.engineBoots, pc.engineTime()
+	msgData := berEncode(berSequence, berOctets(engineID),
+		berOctets(contextName), pdu)
+	var privParams []byte
+	if flags&snmpFlagPriv != 0 {
+		var encrypted []byte
+		encrypted, privParams, err = user.encrypt(msgData, boots, engineTime,
+			pc.salt.Add(1))
+		if err != nil {
+			return
+		}
+		msgData = berOctets(encrypted)
+	}
+	var authParams []byte
+	if flags&snmpFlagAuth != 0 {
+		authParams = make([]byte, user.authLength)
+	}
+	privField := berOctets(privParams)
+	security := berEncode(berSequence, berOctets(engineID),
+		berInt(int64(boots)), berInt(int64(engineTime)),
+		berOctets(userName), berOctets(authParams), privField)
+	securityField := berOctets(security)
+	header := berEncode(berSequence, berInt(msgID),
+		berInt(MaxSNMPMessageSize), berOctets([]byte{flags}),
+		berInt(snmpSecurityModelUSM))
+	message = berEncode(berSequence, berInt(snmpVersion3), header,
+		securityField, msgData)
+	if flags&snmpFlagAuth == 0 {
+		return
+	}
+	// The authentication parameters are followed only by the privacy
+	// parameters and the scoped PDU, so their position is known.
+	offset := len(message) - len(msgData) - len(privField) - len(authParams)
+	copy(message[offset:], user.authenticate(message))
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
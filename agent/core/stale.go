@@ -0,0 +1,156 @@
+// stale.go
+// Failure Policies for Stale or Failing Monitors
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// By default, a Responder keeps using the last value sampled by a Monitor
+// however long ago it was taken, so a metric that has stopped working
+// (e.g. a script which now fails) silently keeps reporting its last value.
+// A Monitor may instead be given a failure policy, which applies whilst
+// its data is stale: when its last attempt to sample failed, or when it
+// has not taken a sample for longer than its stale-after time (if set).
+// Its load is then reported by each Responder using it as a source as 0%
+// or 100%, or the Responder is forced offline.
+
+// #################################
+// FAILURE POLICIES
+// #################################
+
+const (
+	// Keep reporting the last value sampled (the default).
+	FailurePolicyHold = "hold"
+	// Report the load of the source as 0% or 100%.
+	FailurePolicyZeroLoad = "zero-load"
+	FailurePolicyFullLoad = "full-load"
+	// Take the Responder offline, as if its threshold was exceeded.
+	FailurePolicyOffline = "offline"
+)
+
+// FailurePolicies lists the valid failure policies of a Monitor.
+var FailurePolicies = []string{FailurePolicyHold, FailurePolicyZeroLoad,
+	FailurePolicyFullLoad, FailurePolicyOffline}
+
+// ParseFailurePolicy validates the name of a failure policy, returning
+// its standard form, which is empty for the default.
+func ParseFailurePolicy(name string) (policy string, err error) {
+	policy = strings.ToLower(strings.TrimSpace(name))
+	switch policy {
+	case FailurePolicyHold:
+		policy = ""
+	case "", FailurePolicyZeroLoad, FailurePolicyFullLoad,
+		FailurePolicyOffline:
+	default:
+		err = errors.New("invalid failure policy '" + name + "'; use '" +
+			strings.Join(FailurePolicies, "', '") + "'")
+	}
+	return
+}
+
+// configureFailurePolicy validates the failure policy and stale-after time
+// of this SystemMonitor. The caller must hold the mutex.
+func (monitor *SystemMonitor) configureFailurePolicy() (err error) {
+	monitor.FailurePolicy, err = ParseFailurePolicy(monitor.FailurePolicy)
+	if err != nil {
+		return
+	}
+	if monitor.StaleAfter < 0 {
+		err = errors.New("stale-after time cannot be negative")
+	}
+	return
+}
+
+// failurePolicy returns the failure policy which currently applies to the
+// data of this SystemMonitor, which is empty unless the data is stale and
+// a policy other than the default is set. Changes in whether the data is
+// stale are logged.
+func (monitor *SystemMonitor) failurePolicy() (policy string) {
+	if monitor.mutex == nil {
+		return
+	}
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	if monitor.FailurePolicy == "" {
+		return
+	}
+	reason := monitor.staleReason(time.Now())
+	if (reason != "") != monitor.isStale {
+		monitor.isStale = reason != ""
+		if monitor.isStale {
+			monitor.logger().Warn(monitor.getLogHead() + "data is stale (" +
+				reason + "); applying failure policy '" +
+				monitor.FailurePolicy + "'.")
+		} else {
+			monitor.logger().Info(monitor.getLogHead() +
+				"data is no longer stale; failure policy cleared.")
+		}
+	}
+	if monitor.isStale {
+		policy = monitor.FailurePolicy
+	}
+	return
+}
+
+// staleReason returns why the data of this SystemMonitor is stale as of a
+// given time, or an empty string if it is not. The caller must hold the
+// mutex.
+func (monitor *SystemMonitor) staleReason(now time.Time) string {
+	if monitor.LastError != nil {
+		return "last sample failed"
+	}
+	if monitor.StaleAfter <= 0 {
+		return ""
+	}
+	// Before the first sample, the data is measured from when the monitor
+	// was started.
+	since := monitor.lastSample
+	if since.IsZero() {
+		since = monitor.startTime
+	}
+	if since.IsZero() || now.Sub(since) <=
+		time.Duration(monitor.StaleAfter)*time.Millisecond {
+		return ""
+	}
+	return "no sample for " + strconv.Itoa(monitor.StaleAfter) + "ms"
+}
+
+// applyFailurePolicy returns the load of a source as reported by a
+// Responder, given the load calculated from its latest value; a policy
+// forcing the Responder offline is applied by evaluateAvailability().
+func applyFailurePolicy(source *FeedbackSource, load int) (result int) {
+	result = load
+	switch source.Monitor.failurePolicy() {
+	case FailurePolicyZeroLoad:
+		result = 0
+	case FailurePolicyFullLoad:
+		result = 100
+	}
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
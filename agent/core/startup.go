@@ -0,0 +1,193 @@
+// startup.go
+// Machine-Readable Startup Report
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// When the agent is run with '--json-startup' (e.g. by an orchestration
+// system which parses its output), the banner and console log output are
+// suppressed, and a single line of JSON describing the outcome of startup
+// is printed instead once it has completed or failed. Logging continues
+// to the configured log targets as usual.
+
+// Outcomes reported by a startup report.
+const (
+	StartupStatusStarted = "started"
+	StartupStatusFailed  = "failed"
+)
+
+// StartupReport describes what was started by the agent.
+type StartupReport struct {
+	Status     string           `json:"status"`
+	Version    string           `json:"version"`
+	PID        int              `json:"pid"`
+	Instance   string           `json:"instance,omitempty"`
+	ConfigPath string           `json:"config-path"`
+	Monitors   []StartupService `json:"monitors"`
+	Responders []StartupService `json:"responders"`
+	Warnings   []string         `json:"warnings,omitempty"`
+	Errors     []string         `json:"errors,omitempty"`
+}
+
+// StartupService describes a monitor or Responder in a startup report,
+// including where a Responder is listening.
+type StartupService struct {
+	Name      string   `json:"name"`
+	Type      string   `json:"type"`
+	Running   bool     `json:"running"`
+	Addresses []string `json:"addresses,omitempty"`
+	Port      string   `json:"port,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// startupLogHook collects the warnings and errors logged during startup
+// for the startup report.
+type startupLogHook struct {
+	mutex    sync.Mutex
+	active   bool
+	warnings []string
+	errors   []string
+}
+
+// Levels returns the log levels collected by this hook.
+func (hook *startupLogHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.WarnLevel, logrus.ErrorLevel,
+		logrus.FatalLevel, logrus.PanicLevel}
+}
+
+// Fire records a warning or error, until the report has been printed.
+func (hook *startupLogHook) Fire(entry *logrus.Entry) (err error) {
+	hook.mutex.Lock()
+	defer hook.mutex.Unlock()
+	if !hook.active {
+		return
+	}
+	if entry.Level == logrus.WarnLevel {
+		hook.warnings = append(hook.warnings, entry.Message)
+	} else {
+		hook.errors = append(hook.errors, entry.Message)
+	}
+	return
+}
+
+// beginStartupReport starts collecting the warnings and errors for the
+// startup report, if one has been requested.
+func (agent *FeedbackAgent) beginStartupReport() {
+	if !agent.options.JSONStartup {
+		return
+	}
+	agent.startupLog = &startupLogHook{active: true}
+	logrus.AddHook(agent.startupLog)
+}
+
+// printStartupReport prints the startup report, if one has been requested.
+func (agent *FeedbackAgent) printStartupReport(started bool) {
+	if agent.startupLog == nil {
+		return
+	}
+	report := StartupReport{
+		Status:     StartupStatusFailed,
+		Version:    VersionString,
+		PID:        os.Getpid(),
+		Instance:   agent.options.Instance,
+		ConfigPath: path.Join(agent.configDir, ConfigFileName),
+		Monitors:   []StartupService{},
+		Responders: []StartupService{},
+	}
+	if started {
+		report.Status = StartupStatusStarted
+	}
+	// Services are only listed once they have been initialised, which they
+	// may not have been if the config could not be loaded.
+	for name, monitor := range agent.Monitors {
+		if monitor.mutex == nil {
+			continue
+		}
+		monitor.mutex.Lock()
+		service := StartupService{
+			Name:    name,
+			Type:    monitor.MetricType,
+			Running: monitor.runState,
+		}
+		if monitor.LastError != nil {
+			service.Error = monitor.LastError.Error()
+		}
+		monitor.mutex.Unlock()
+		report.Monitors = append(report.Monitors, service)
+	}
+	for name, responder := range agent.Responders {
+		if responder.mutex == nil {
+			continue
+		}
+		addresses := responder.ListenAddresses()
+		for i, address := range addresses {
+			if address == "" {
+				addresses[i] = "*"
+			}
+		}
+		port := responder.GetActivePort()
+		responder.mutex.Lock()
+		// A Responder which has failed to start may not yet have
+		// finished stopping.
+		service := StartupService{
+			Name:      name,
+			Type:      responder.ProtocolName,
+			Running:   responder.runState && responder.LastError == nil,
+			Addresses: addresses,
+			Port:      port,
+		}
+		if responder.LastError != nil {
+			service.Error = responder.LastError.Error()
+		}
+		responder.mutex.Unlock()
+		report.Responders = append(report.Responders, service)
+	}
+	for _, services := range [][]StartupService{report.Monitors,
+		report.Responders} {
+		sort.Slice(services, func(i, j int) bool {
+			return services[i].Name < services[j].Name
+		})
+	}
+	hook := agent.startupLog
+	hook.mutex.Lock()
+	hook.active = false
+	report.Warnings = hook.warnings
+	report.Errors = hook.errors
+	hook.mutex.Unlock()
+	output, err := json.Marshal(report)
+	if err != nil {
+		return
+	}
+	fmt.Println(string(output))
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -122,6 +122,61 @@ func (model *StatisticsModel) ClearModel() {
 	model.ZSampleCount = 0
 }
 
+// ModelState holds the learned state of a statistics model (as cleared by
+// ClearModel), so that it can be carried over to another agent.
+type ModelState struct {
+	XLastValue    float64 `json:"x-last-value"`
+	XCount        uint64  `json:"x-count"`
+	XReportedLoad float64 `json:"x-reported-load"`
+	XStdDev       float64 `json:"x-std-dev"`
+	ZScoreValue   float64 `json:"z-score"`
+	XSum          float64 `json:"x-sum"`
+	XSquaredSum   float64 `json:"x-squared-sum"`
+	XMin          float64 `json:"x-min"`
+	XMax          float64 `json:"x-max"`
+	ZScoreSum     float64 `json:"z-score-sum"`
+	ZScoreMean    float64 `json:"z-score-mean"`
+	ZSampleCount  uint64  `json:"z-sample-count"`
+	LastResult    int64   `json:"last-result"`
+}
+
+// State returns the learned state of this statistics model.
+func (model *StatisticsModel) State() ModelState {
+	return ModelState{
+		XLastValue:    model.XLastValue,
+		XCount:        model.XCount,
+		XReportedLoad: model.XReportedLoad,
+		XStdDev:       model.XStdDev,
+		ZScoreValue:   model.ZScoreValue,
+		XSum:          model.XSum,
+		XSquaredSum:   model.XSquaredSum,
+		XMin:          model.XMin,
+		XMax:          model.XMax,
+		ZScoreSum:     model.ZScoreSum,
+		ZScoreMean:    model.ZScoreMean,
+		ZSampleCount:  model.ZSampleCount,
+		LastResult:    model.LastResult,
+	}
+}
+
+// RestoreState replaces the learned state of this statistics model,
+// keeping its configuration parameters.
+func (model *StatisticsModel) RestoreState(state ModelState) {
+	model.XLastValue = state.XLastValue
+	model.XCount = state.XCount
+	model.XReportedLoad = state.XReportedLoad
+	model.XStdDev = state.XStdDev
+	model.ZScoreValue = state.ZScoreValue
+	model.XSum = state.XSum
+	model.XSquaredSum = state.XSquaredSum
+	model.XMin = state.XMin
+	model.XMax = state.XMax
+	model.ZScoreSum = state.ZScoreSum
+	model.ZScoreMean = state.ZScoreMean
+	model.ZSampleCount = state.ZSampleCount
+	model.LastResult = state.LastResult
+}
+
 // NewValue observes a new value in the set into the statistics model
 // by adding it into the sum values and recalculating the Z-scores,
 // min-max values, mean and standard deviation.
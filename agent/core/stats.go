@@ -0,0 +1,242 @@
+// stats.go
+// Internal Metrics of the Feedback Agent
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// The agent keeps its own metrics, so that it is possible to see whether
+// the agent itself is struggling: the requests answered by each Responder
+// and how long they took, failures in answering them or in sampling
+// metrics, and the resource usage of the process. These are returned by
+// the 'get stats' API action, and served to Prometheus by API Responders.
+
+// LatencyBuckets are the upper bounds (seconds) of the buckets into which
+// response latencies are counted.
+var LatencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025,
+	0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// AgentStats holds the internal metrics of the agent.
+type AgentStats struct {
+	UptimeSeconds  float64                   `json:"uptime-seconds"`
+	Goroutines     int                       `json:"goroutines"`
+	MemoryAlloc    uint64                    `json:"memory-alloc-bytes"`
+	MemorySys      uint64                    `json:"memory-sys-bytes"`
+	HeapObjects    uint64                    `json:"heap-objects"`
+	GCCycles       uint32                    `json:"gc-cycles"`
+	GCPauseSeconds float64                   `json:"gc-pause-seconds"`
+	Panics         uint64                    `json:"panics"`
+	Responders     map[string]ResponderStats `json:"responders"`
+	Monitors       map[string]MonitorStats   `json:"monitors"`
+}
+
+// ResponderStats holds the request metrics of a Responder. Requests are
+// counted once answered (for keep-alive connections, once per poll), and
+// errors are requests which could not be answered due to an internal
+// error, or whose response could not be delivered.
+type ResponderStats struct {
+	Requests       uint64          `json:"requests"`
+	Errors         uint64          `json:"errors"`
+	Connections    LimiterStats    `json:"connections"`
+	LatencyMean    float64         `json:"latency-mean-ms"`
+	LatencyMax     float64         `json:"latency-max-ms"`
+	LatencySeconds float64         `json:"latency-total-seconds"`
+	LatencyBuckets []LatencyBucket `json:"latency-buckets"`
+	State          *ResponderState `json:"state,omitempty"`
+}
+
+// ResponderState holds the command state of a Responder for alerting:
+// whether it is online, whether its thresholds currently take it offline
+// (including the failure policy of a stale source), the state forced on
+// it (if any) and whether each source has breached its thresholds. This
+// is not given for API Responders.
+type ResponderState struct {
+	Online            bool            `json:"online"`
+	ThresholdBreached bool            `json:"threshold-breached"`
+	ForcedState       string          `json:"forced-state,omitempty"`
+	SourcesBreached   map[string]bool `json:"sources-breached,omitempty"`
+}
+
+// LatencyBucket gives the number of requests answered within a latency.
+type LatencyBucket struct {
+	UpperBound float64 `json:"le-seconds"`
+	Count      uint64  `json:"count"`
+}
+
+// MonitorStats holds the sampling metrics of a monitor.
+type MonitorStats struct {
+	Samples        uint64 `json:"samples"`
+	SampleFailures uint64 `json:"sample-failures"`
+}
+
+// #######################################################################
+// Request Metrics
+// #######################################################################
+
+// requestStats accumulates the request metrics of a Responder. It is kept
+// when the Responder is replaced by an edit, so that the counts continue.
+type requestStats struct {
+	mutex      sync.Mutex
+	requests   uint64
+	errors     uint64
+	latencySum time.Duration
+	latencyMax time.Duration
+	// Count of requests in each bucket (not cumulative), the last being
+	// for those exceeding the largest bound.
+	buckets []uint64
+}
+
+func newRequestStats() *requestStats {
+	return &requestStats{buckets: make([]uint64, len(LatencyBuckets)+1)}
+}
+
+// record counts a request answered after a latency, which may have failed.
+func (stats *requestStats) record(latency time.Duration, failed bool) {
+	if stats == nil {
+		return
+	}
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	stats.requests++
+	if failed {
+		stats.errors++
+	}
+	stats.latencySum += latency
+	stats.latencyMax = max(stats.latencyMax, latency)
+	bucket := len(LatencyBuckets)
+	for i, bound := range LatencyBuckets {
+		if latency.Seconds() <= bound {
+			bucket = i
+			break
+		}
+	}
+	stats.buckets[bucket]++
+}
+
+// addError counts an error in delivering a response which has already
+// been counted as a request.
+func (stats *requestStats) addError() {
+	if stats == nil {
+		return
+	}
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	stats.errors++
+}
+
+// snapshot returns the current request metrics, with cumulative buckets.
+func (stats *requestStats) snapshot() (result ResponderStats) {
+	result.LatencyBuckets = make([]LatencyBucket, len(LatencyBuckets))
+	if stats == nil {
+		return
+	}
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	result.Requests = stats.requests
+	result.Errors = stats.errors
+	result.LatencySeconds = stats.latencySum.Seconds()
+	result.LatencyMax = float64(stats.latencyMax) / float64(time.Millisecond)
+	if stats.requests > 0 {
+		result.LatencyMean = float64(stats.latencySum) /
+			float64(stats.requests) / float64(time.Millisecond)
+	}
+	total := uint64(0)
+	for i, bound := range LatencyBuckets {
+		total += stats.buckets[i]
+		result.LatencyBuckets[i] = LatencyBucket{bound, total}
+	}
+	return
+}
+
+// #######################################################################
+// Agent Metrics
+// #######################################################################
+
+// GetAgentStats returns the internal metrics of the agent.
+func (agent *FeedbackAgent) GetAgentStats() (stats *AgentStats) {
+	var memory runtime.MemStats
+	runtime.ReadMemStats(&memory)
+	stats = &AgentStats{
+		UptimeSeconds:  time.Since(agent.startTime).Seconds(),
+		Goroutines:     runtime.NumGoroutine(),
+		MemoryAlloc:    memory.Alloc,
+		MemorySys:      memory.Sys,
+		HeapObjects:    memory.HeapObjects,
+		GCCycles:       memory.NumGC,
+		GCPauseSeconds: time.Duration(memory.PauseTotalNs).Seconds(),
+		Responders:     make(map[string]ResponderStats),
+		Monitors:       make(map[string]MonitorStats),
+	}
+	if agent.panics != nil {
+		stats.Panics = agent.panics.Load()
+	}
+	monitors, responders := agent.servicesSnapshot()
+	for name, responder := range responders {
+		responderStats := responder.stats.snapshot()
+		responderStats.Connections = responder.GetConnectionStats()
+		responderStats.State = responder.getState()
+		stats.Responders[name] = responderStats
+	}
+	for name, monitor := range monitors {
+		stats.Monitors[name] = monitor.getStats()
+	}
+	return
+}
+
+// getState returns the command state of this FeedbackResponder, or nil if
+// it is an API Responder.
+func (fbr *FeedbackResponder) getState() (state *ResponderState) {
+	if fbr.IsAPI() {
+		return
+	}
+	fbr.mutex.Lock()
+	defer fbr.mutex.Unlock()
+	state = &ResponderState{
+		Online:          fbr.onlineState,
+		SourcesBreached: make(map[string]bool, len(fbr.FeedbackSources)),
+	}
+	_, online, _, _ := fbr.evaluateAvailability(state.SourcesBreached)
+	state.ThresholdBreached = !online
+	if fbr.forceCommandState {
+		state.ForcedState = overrideStateName(fbr.onlineState,
+			fbr.overrideMask)
+	}
+	return
+}
+
+// getStats returns the sampling metrics of this SystemMonitor.
+func (monitor *SystemMonitor) getStats() (stats MonitorStats) {
+	if monitor.mutex == nil {
+		return
+	}
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	stats.Samples = monitor.samples
+	stats.SampleFailures = monitor.sampleFailures
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
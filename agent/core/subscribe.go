@@ -0,0 +1,362 @@
+// subscribe.go
+// Streaming of Live Metric and State Updates
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Subscribers are sent an initial update for each service, followed by
+// further updates as metrics are sampled and the feedback of Responders
+// changes. These are gathered by polling the services at an interval,
+// which is fine-grained enough for a dashboard, and avoids adding any
+// overhead to the services themselves.
+
+// Types of update sent to subscribers.
+const (
+	// A new sample taken by a monitor.
+	UpdateTypeMetric = "metric"
+	// A change in the availability score of a Responder.
+	UpdateTypeAvailability = "availability"
+	// A change in the command state (online or offline) of a Responder.
+	UpdateTypeState = "state"
+	// An event raised within the agent.
+	UpdateTypeEvent = "event"
+)
+
+const (
+	// Path of the API on which subscriptions are made.
+	SubscribePath = "/subscribe"
+	// Default and minimum intervals at which subscriptions poll the
+	// services for updates (ms).
+	DefaultSubscribeInterval = 1000
+	MinSubscribeInterval     = 100
+	// Interval at which a comment is sent to an idle subscriber, so that
+	// proxies do not time out the connection.
+	SubscribeKeepAliveInterval = 15 * time.Second
+)
+
+// SubscriptionUpdate is an update sent to a subscriber.
+type SubscriptionUpdate struct {
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	Monitor    string    `json:"monitor,omitempty"`
+	MetricType string    `json:"metric-type,omitempty"`
+	Value      *int64    `json:"value,omitempty"`
+	Responder  string    `json:"responder,omitempty"`
+	// The availability score of a Responder, and its command state.
+	Availability *int        `json:"availability,omitempty"`
+	Online       *bool       `json:"online,omitempty"`
+	Forced       bool        `json:"forced,omitempty"`
+	Event        *AgentEvent `json:"event,omitempty"`
+}
+
+// Subscription tracks the updates already sent to a subscriber, so that
+// only changes are sent.
+type Subscription struct {
+	agent     *FeedbackAgent
+	namespace string
+	// The types of update and the services subscribed to; all are
+	// included if these are empty.
+	types      []string
+	monitors   []string
+	responders []string
+	// The last sample time of each monitor, and the last availability and
+	// command state of each Responder, which have been sent.
+	samples      map[string]time.Time
+	availability map[string]int
+	states       map[string]string
+	eventsSince  time.Time
+}
+
+// NewSubscription creates a subscription to updates from the services of
+// an agent within a namespace, if one is given. Only updates of the given
+// types, and from the named monitors and Responders, are included, unless
+// these are empty.
+func (agent *FeedbackAgent) NewSubscription(namespace string, types []string,
+	monitors []string, responders []string) (sub *Subscription, err error) {
+	for _, updateType := range types {
+		switch updateType {
+		case UpdateTypeMetric, UpdateTypeAvailability, UpdateTypeState,
+			UpdateTypeEvent:
+		default:
+			err = errors.New("invalid update type '" + updateType + "'")
+			return
+		}
+	}
+	sub = &Subscription{
+		agent:        agent,
+		namespace:    namespace,
+		types:        types,
+		samples:      make(map[string]time.Time),
+		availability: make(map[string]int),
+		states:       make(map[string]string),
+		eventsSince:  time.Now(),
+	}
+	for _, name := range monitors {
+		name, err = StandardiseNameIdentifier(name)
+		if err != nil {
+			return
+		}
+		sub.monitors = append(sub.monitors, name)
+	}
+	for _, name := range responders {
+		name, err = StandardiseNameIdentifier(name)
+		if err != nil {
+			return
+		}
+		sub.responders = append(sub.responders, name)
+	}
+	return
+}
+
+// wants returns whether updates of a type are included in the subscription.
+func (sub *Subscription) wants(updateType string) bool {
+	return len(sub.types) == 0 || slices.Contains(sub.types, updateType)
+}
+
+// includes returns whether a service is included in the subscription.
+func (sub *Subscription) includes(serviceType string, name string,
+	namespace string) bool {
+	if sub.namespace != "" && namespace != sub.namespace {
+		return false
+	}
+	switch serviceType {
+	case "monitor":
+		return len(sub.monitors) == 0 || slices.Contains(sub.monitors, name)
+	case "responder":
+		return len(sub.responders) == 0 || slices.Contains(sub.responders, name)
+	}
+	return false
+}
+
+// Poll returns the updates since the subscription was last polled.
+func (sub *Subscription) Poll() (updates []SubscriptionUpdate) {
+	now := time.Now()
+	monitors, responders := sub.agent.servicesSnapshot()
+	if sub.wants(UpdateTypeMetric) {
+		for _, name := range sortedKeys(monitors) {
+			monitor := monitors[name]
+			if !sub.includes("monitor", name, monitor.Namespace) {
+				continue
+			}
+			value, sampleTime := monitor.latestSample()
+			if sampleTime.IsZero() || !sampleTime.After(sub.samples[name]) {
+				continue
+			}
+			sub.samples[name] = sampleTime
+			updates = append(updates, SubscriptionUpdate{
+				Type:       UpdateTypeMetric,
+				Time:       sampleTime,
+				Monitor:    name,
+				MetricType: monitor.MetricType,
+				Value:      &value,
+			})
+		}
+	}
+	if sub.wants(UpdateTypeAvailability) || sub.wants(UpdateTypeState) {
+		for _, name := range sortedKeys(responders) {
+			responder := responders[name]
+			if responder.IsAPI() ||
+				!sub.includes("responder", name, responder.Namespace) {
+				continue
+			}
+			updates = append(updates, sub.pollResponder(name, responder,
+				now)...)
+		}
+	}
+	if sub.wants(UpdateTypeEvent) {
+		for _, event := range sub.agent.RecentEvents(sub.namespace) {
+			if !event.Time.After(sub.eventsSince) ||
+				(event.ServiceType != "" && !sub.includes(event.ServiceType,
+					event.ServiceName, sub.namespace)) {
+				continue
+			}
+			sub.eventsSince = event.Time
+			event := event
+			updates = append(updates, SubscriptionUpdate{
+				Type:  UpdateTypeEvent,
+				Time:  event.Time,
+				Event: &event,
+			})
+		}
+	}
+	return
+}
+
+// pollResponder returns any changes in the availability score and command
+// state of a Responder.
+func (sub *Subscription) pollResponder(name string,
+	responder *FeedbackResponder, now time.Time) (
+	updates []SubscriptionUpdate) {
+	availability, online, forced := responder.getFeedbackState()
+	last, sent := sub.availability[name]
+	if sub.wants(UpdateTypeAvailability) && (!sent || availability != last) {
+		sub.availability[name] = availability
+		updates = append(updates, SubscriptionUpdate{
+			Type:         UpdateTypeAvailability,
+			Time:         now,
+			Responder:    name,
+			Availability: &availability,
+		})
+	}
+	state := strconv.FormatBool(online) + "," + strconv.FormatBool(forced)
+	if sub.wants(UpdateTypeState) && state != sub.states[name] {
+		sub.states[name] = state
+		updates = append(updates, SubscriptionUpdate{
+			Type:      UpdateTypeState,
+			Time:      now,
+			Responder: name,
+			Online:    &online,
+			Forced:    forced,
+		})
+	}
+	return
+}
+
+// getFeedbackState returns the current availability score and command
+// state of this FeedbackResponder, without affecting its feedback.
+func (fbr *FeedbackResponder) getFeedbackState() (availability int,
+	online bool, forced bool) {
+	fbr.mutex.Lock()
+	defer fbr.mutex.Unlock()
+	availability, _, _ = fbr.GetAvailabilityState()
+	online = fbr.onlineState
+	forced = fbr.forceCommandState
+	return
+}
+
+// #######################################################################
+// Server-Sent Events
+// #######################################################################
+
+// handleSubscribe streams updates to a subscriber as Server-Sent Events,
+// each named by the type of update with the update as JSON data, until
+// the client disconnects or the Responder is stopped. The API key is given
+// in the 'X-API-Key' header or the 'key' query parameter (as browsers
+// cannot add headers to an EventSource), and the subscription is limited
+// by the query parameters 'types', 'monitors' and 'responders' (each a
+// comma-separated list), and polled at the interval 'interval-ms'.
+func (pc *HTTPConnector) handleSubscribe(w http.ResponseWriter,
+	r *http.Request) {
+	query := r.URL.Query()
+	key := r.Header.Get("X-Api-Key")
+	if key == "" {
+		key = query.Get("key")
+	}
+	// Authorise the subscription as a request for the status, which
+	// determines the namespace of the key.
+	agent := pc.responder.ParentAgent
+	request := &APIRequest{Action: "status", APIKey: key}
+	request.readOnly = pc.responder.ProtocolName == ProtocolLegacyAPI
+	response, _ := agent.ProcessAPIRequest(request, nil)
+	if !response.Success {
+		status := http.StatusForbidden
+		if response.Error == "bad-api-key" {
+			status = http.StatusUnauthorized
+		}
+		http.Error(w, response.Message, status)
+		return
+	}
+	interval := DefaultSubscribeInterval
+	if value := query.Get("interval-ms"); value != "" {
+		var err error
+		interval, err = strconv.Atoi(value)
+		if err != nil || interval < MinSubscribeInterval {
+			http.Error(w, "interval-ms must be an integer of at least "+
+				strconv.Itoa(MinSubscribeInterval), http.StatusBadRequest)
+			return
+		}
+	}
+	sub, err := agent.NewSubscription(request.namespace,
+		splitQueryList(query.Get("types")),
+		splitQueryList(query.Get("monitors")),
+		splitQueryList(query.Get("responders")))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Streams are not subject to the response timeout of the Responder.
+	controller := http.NewResponseController(w)
+	err = controller.SetWriteDeadline(time.Time{})
+	if err != nil {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	pc.responder.logger().Debug(pc.responder.getLogHead() +
+		"subscription started by " + r.RemoteAddr)
+	ticker := time.NewTicker(time.Duration(interval) * time.Millisecond)
+	defer ticker.Stop()
+	lastWrite := time.Now()
+	for {
+		var output strings.Builder
+		for _, update := range sub.Poll() {
+			data, _ := json.Marshal(update)
+			output.WriteString("event: " + update.Type + "\ndata: " +
+				string(data) + "\n\n")
+		}
+		if output.Len() == 0 && time.Since(lastWrite) >= SubscribeKeepAliveInterval {
+			output.WriteString(": keep-alive\n\n")
+		}
+		if output.Len() > 0 {
+			_, err = w.Write([]byte(output.String()))
+			if err == nil {
+				err = controller.Flush()
+			}
+			if err != nil {
+				return
+			}
+			lastWrite = time.Now()
+			pc.responder.markResponded()
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-pc.stopping:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// splitQueryList splits a comma-separated list given in a query parameter.
+func splitQueryList(value string) (list []string) {
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
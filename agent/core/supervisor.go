@@ -0,0 +1,367 @@
+// supervisor.go
+// Automatic Restarts of Failed Services
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// A Responder stops unexpectedly when its listener fails (e.g. when its
+// address cannot be bound, perhaps only briefly whilst another process
+// releases it), and a Monitor stops if its metric panics (see crash.go).
+// Rather than leaving such a service down until it is manually restarted,
+// the supervisor restarts it after a delay which doubles with each
+// consecutive failure, up to a maximum, and gives up after a maximum number
+// of attempts. A service which runs for longer than the stable period before
+// failing again has its count of failures reset. Services that are stopped
+// on request, by a reload or on shutdown are not restarted.
+
+// #################################
+// SUPERVISOR CONFIGURATION
+// #################################
+
+const (
+	DefaultRestartInitialDelay = Duration(time.Second)
+	DefaultRestartMaxDelay     = Duration(time.Minute)
+	DefaultRestartMaxRetries   = 10
+	// The time for which a restarted service must run before failing
+	// again for its previous failures to be forgotten.
+	RestartStablePeriod = 5 * time.Minute
+)
+
+// SupervisorConfig holds the restart policy for failed services; any
+// setting which is not specified takes its default value.
+type SupervisorConfig struct {
+	Disabled     bool     `json:"disabled,omitempty"`
+	InitialDelay Duration `json:"initial-delay,omitempty"`
+	MaxDelay     Duration `json:"max-delay,omitempty"`
+	MaxRetries   int      `json:"max-retries,omitempty"`
+}
+
+// Validate checks the supervisor settings.
+func (config *SupervisorConfig) Validate() (err error) {
+	if config.InitialDelay < 0 || config.MaxDelay < 0 {
+		err = errors.New("supervisor restart delays cannot be negative")
+	} else if config.MaxRetries < 0 {
+		err = errors.New("supervisor maximum retries cannot be negative")
+	} else if config.InitialDelay > 0 && config.MaxDelay > 0 &&
+		config.MaxDelay < config.InitialDelay {
+		err = errors.New("supervisor maximum delay cannot be less than " +
+			"the initial delay")
+	}
+	return
+}
+
+// policy returns the restart policy, applying defaults for any settings
+// which have not been specified; a nil config gives the default policy.
+func (config *SupervisorConfig) policy() (enabled bool, initialDelay,
+	maxDelay time.Duration, maxRetries int) {
+	enabled = true
+	initialDelay = time.Duration(DefaultRestartInitialDelay)
+	maxDelay = time.Duration(DefaultRestartMaxDelay)
+	maxRetries = DefaultRestartMaxRetries
+	if config == nil {
+		return
+	}
+	enabled = !config.Disabled
+	if config.InitialDelay > 0 {
+		initialDelay = time.Duration(config.InitialDelay)
+	}
+	if config.MaxDelay > 0 {
+		maxDelay = time.Duration(config.MaxDelay)
+	}
+	maxDelay = max(maxDelay, initialDelay)
+	if config.MaxRetries > 0 {
+		maxRetries = config.MaxRetries
+	}
+	return
+}
+
+// #################################
+// SUPERVISOR
+// #################################
+
+// SupervisorStatus is the state of a service which has failed, as shown in
+// the service status.
+type SupervisorStatus struct {
+	Failures    int        `json:"failures"`
+	LastFailure time.Time  `json:"last-failure"`
+	LastError   string     `json:"last-error,omitempty"`
+	NextRestart *time.Time `json:"next-restart,omitempty"`
+	GaveUp      bool       `json:"gave-up,omitempty"`
+}
+
+// supervisedService tracks the failures of a single service.
+type supervisedService struct {
+	failures    int
+	lastFailure time.Time
+	lastError   string
+	nextRestart time.Time
+	gaveUp      bool
+	timer       *time.Timer
+}
+
+// serviceSupervisor restarts the failed services of a FeedbackAgent.
+// Restarts are due on timers, but are handed to the event loop of the
+// agent to be performed, so that the services are not started whilst it
+// is reloading the configuration.
+type serviceSupervisor struct {
+	mutex    sync.Mutex
+	agent    *FeedbackAgent
+	services map[string]*supervisedService
+	stopped  bool
+	restarts chan supervisedRestart
+	done     chan struct{}
+}
+
+// supervisedRestart identifies a service which is due to be restarted.
+type supervisedRestart struct {
+	serviceType string
+	name        string
+}
+
+// newServiceSupervisor creates the supervisor for an agent.
+func newServiceSupervisor(agent *FeedbackAgent) *serviceSupervisor {
+	return &serviceSupervisor{
+		agent:    agent,
+		services: make(map[string]*supervisedService),
+		restarts: make(chan supervisedRestart),
+		done:     make(chan struct{}),
+	}
+}
+
+// supervisorKey returns the key under which a service is supervised,
+// which is also used as the start of its log entries.
+func supervisorKey(serviceType string, name string) string {
+	if serviceType == LogFieldMonitor {
+		return "Monitor '" + name + "'"
+	}
+	return "Responder '" + name + "'"
+}
+
+// serviceFailed is called by a Responder or Monitor which has stopped
+// without being asked to, when started at the given time, and schedules it
+// to be restarted according to the restart policy of the agent.
+func (agent *FeedbackAgent) serviceFailed(serviceType string, name string,
+	started time.Time, cause error) {
+	if agent == nil || agent.supervisor == nil {
+		return
+	}
+	agent.supervisor.failed(serviceType, name, started, cause)
+}
+
+// failed records the failure of a service and schedules its restart.
+func (supervisor *serviceSupervisor) failed(serviceType string,
+	name string, started time.Time, cause error) {
+	enabled, initialDelay, maxDelay, maxRetries :=
+		supervisor.agent.Supervisor.policy()
+	key := supervisorKey(serviceType, name)
+	message := "failed"
+	if cause != nil {
+		message += ": " + cause.Error()
+	}
+	supervisor.mutex.Lock()
+	defer supervisor.mutex.Unlock()
+	if supervisor.stopped {
+		return
+	}
+	service := supervisor.services[key]
+	if service == nil {
+		service = &supervisedService{}
+		supervisor.services[key] = service
+	}
+	// Forget any failures before a long period of stable running.
+	if time.Since(started) >= RestartStablePeriod {
+		service.failures = 0
+	}
+	if service.timer != nil {
+		service.timer.Stop()
+		service.timer = nil
+	}
+	service.failures++
+	service.lastFailure = time.Now()
+	service.lastError = message
+	service.nextRestart = time.Time{}
+	service.gaveUp = false
+	logger := logrus.WithField(serviceType, name)
+	switch {
+	case !enabled:
+		message = key + " " + message +
+			"; automatic restarts are disabled."
+		logger.Error(message)
+	case service.failures > maxRetries:
+		service.gaveUp = true
+		message = key + " " + message + "; giving up after " +
+			strconv.Itoa(maxRetries) + " restart attempts."
+		logger.Error(message)
+	default:
+		// Double the delay with each consecutive failure.
+		delay := initialDelay
+		for i := 1; i < service.failures && delay < maxDelay; i++ {
+			delay *= 2
+		}
+		delay = min(delay, maxDelay)
+		service.nextRestart = service.lastFailure.Add(delay)
+		service.timer = time.AfterFunc(delay, func() {
+			supervisor.requestRestart(serviceType, name)
+		})
+		message = key + " " + message + "; restarting in " +
+			delay.String() + " (attempt " + strconv.Itoa(service.failures) +
+			" of " + strconv.Itoa(maxRetries) + ")."
+		logger.Warn(message)
+	}
+	supervisor.agent.recordServiceEvent(EventTypeServiceFailed, serviceType,
+		name, message)
+}
+
+// requestRestart hands a service which is due to be restarted to the event
+// loop of the agent, unless the supervisor is stopped first.
+func (supervisor *serviceSupervisor) requestRestart(serviceType string,
+	name string) {
+	select {
+	case supervisor.restarts <- supervisedRestart{serviceType, name}:
+	case <-supervisor.done:
+	}
+}
+
+// restart restarts a failed service, unless it has since been deleted, or
+// started by other means. A failure to start counts as another failure,
+// which a Responder reports itself. This is called from the event loop of
+// the agent.
+func (supervisor *serviceSupervisor) restart(serviceType string,
+	name string) {
+	key := supervisorKey(serviceType, name)
+	supervisor.mutex.Lock()
+	service := supervisor.services[key]
+	if supervisor.stopped || service == nil {
+		supervisor.mutex.Unlock()
+		return
+	}
+	service.timer = nil
+	service.nextRestart = time.Time{}
+	attempt := service.failures
+	supervisor.mutex.Unlock()
+	monitors, responders := supervisor.agent.servicesSnapshot()
+	var err error
+	switch serviceType {
+	case LogFieldResponder:
+		responder, exists := responders[name]
+		if !exists || responder == nil {
+			supervisor.forget(serviceType, name)
+			return
+		}
+		if responder.IsRunning() {
+			return
+		}
+		err = responder.Start()
+	case LogFieldMonitor:
+		monitor, exists := monitors[name]
+		if !exists || monitor == nil {
+			supervisor.forget(serviceType, name)
+			return
+		}
+		if monitor.IsRunning() {
+			return
+		}
+		err = monitor.Start()
+		if err != nil {
+			supervisor.failed(serviceType, name, time.Now(), err)
+		}
+	}
+	if err != nil {
+		return
+	}
+	logrus.WithField(serviceType, name).Info(key + " restarted (attempt " +
+		strconv.Itoa(attempt) + ").")
+}
+
+// forget discards the failures of a service, e.g. once it is deleted,
+// cancelling any pending restart.
+func (supervisor *serviceSupervisor) forget(serviceType string,
+	name string) {
+	if supervisor == nil {
+		return
+	}
+	key := supervisorKey(serviceType, name)
+	supervisor.mutex.Lock()
+	defer supervisor.mutex.Unlock()
+	if service := supervisor.services[key]; service != nil &&
+		service.timer != nil {
+		service.timer.Stop()
+	}
+	delete(supervisor.services, key)
+}
+
+// Stop cancels all pending restarts, and prevents any more from being
+// scheduled; this is called when the agent is shutting down.
+func (supervisor *serviceSupervisor) Stop() {
+	if supervisor == nil {
+		return
+	}
+	supervisor.mutex.Lock()
+	defer supervisor.mutex.Unlock()
+	if supervisor.stopped {
+		return
+	}
+	supervisor.stopped = true
+	close(supervisor.done)
+	for _, service := range supervisor.services {
+		if service.timer != nil {
+			service.timer.Stop()
+			service.timer = nil
+		}
+	}
+}
+
+// status returns the supervisor state of a service, or nil if it has not
+// failed.
+func (supervisor *serviceSupervisor) status(serviceType string,
+	name string) (status *SupervisorStatus) {
+	if supervisor == nil {
+		return
+	}
+	supervisor.mutex.Lock()
+	defer supervisor.mutex.Unlock()
+	service := supervisor.services[supervisorKey(serviceType, name)]
+	if service == nil {
+		return
+	}
+	status = &SupervisorStatus{
+		Failures:    service.failures,
+		LastFailure: service.lastFailure,
+		LastError:   service.lastError,
+		GaveUp:      service.gaveUp,
+	}
+	if !service.nextRestart.IsZero() {
+		nextRestart := service.nextRestart
+		status.NextRestart = &nextRestart
+	}
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
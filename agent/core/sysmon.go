@@ -23,7 +23,9 @@
 package agent
 
 import (
+	"context"
 	"errors"
+	"math"
 	"strconv"
 	"sync"
 	"time"
@@ -41,33 +43,56 @@ type SystemMonitor struct {
 	Interval      int              `json:"interval-ms,omitempty"`
 	Params        MetricParams     `json:"metric-config,omitempty"`
 	SmartShape    bool             `json:"smart-shape,omitempty"`
+	AnomalyZScore float64          `json:"anomaly-z-score,omitempty"`
+	HistorySize   int              `json:"history-size,omitempty"`
+	HistoryAge    int              `json:"history-retention-s,omitempty"`
+	FailurePolicy string           `json:"failure-policy,omitempty"`
+	StaleAfter    int              `json:"stale-after-ms,omitempty"`
+	Namespace     string           `json:"namespace,omitempty"`
 	FilePath      string           `json:"-"`
 	StatsModel    *StatisticsModel `json:"-"`
 	SysMetric     SystemMetric     `json:"-"`
 	LastError     error            `json:"-"`
-	signalChannel chan int
-	statusChannel chan int
+	ParentAgent   *FeedbackAgent   `json:"-"`
+	cancel        context.CancelFunc
+	done          chan struct{}
 	runState      bool
 	isInitialised bool
+	isAnomalous   bool
+	isStale       bool
+	trend         *LoadTrend
+	history       *MetricHistory
 	mutex         *sync.Mutex
+	// When this monitor was last started, the number of times it has been
+	// restarted (including when replaced by an edit), and when a sample
+	// was last taken successfully.
+	startTime    time.Time
+	restartCount int
+	lastSample   time.Time
+	// Number of samples taken, and of attempts which failed.
+	samples        uint64
+	sampleFailures uint64
 }
 
 const (
-	MonitorWaitInterval = 100
+	// Time (ms) to wait for the worker of a monitor to stop, which may
+	// be part-way through taking a sample.
+	MonitorStopTimeout = 5000
+	// Minimum observations in the statistics model before anomalies
+	// are reported, so that the model has learned typical behaviour.
+	MinAnomalyObservations = 10
 )
 
 func NewSystemMonitor(name string, metric string, interval int,
 	params MetricParams, filePath string, shaping bool) (
 	mon *SystemMonitor, err error) {
 	mon = &SystemMonitor{
-		Name:          name,
-		Interval:      interval,
-		MetricType:    metric,
-		Params:        params,
-		FilePath:      filePath,
-		signalChannel: make(chan int),
-		statusChannel: make(chan int),
-		SmartShape:    shaping,
+		Name:       name,
+		Interval:   interval,
+		MetricType: metric,
+		Params:     params,
+		FilePath:   filePath,
+		SmartShape: shaping,
 	}
 	err = mon.Initialise()
 	return
@@ -77,6 +102,8 @@ func (monitor *SystemMonitor) Copy() (copy SystemMonitor) {
 	copy = *monitor
 	copy.mutex = nil
 	copy.runState = false
+	copy.cancel = nil
+	copy.done = nil
 	return
 }
 
@@ -93,9 +120,23 @@ func (monitor *SystemMonitor) Initialise() (err error) {
 		monitor.StatsModel = &StatisticsModel{}
 		monitor.StatsModel.SetDefaultParams()
 	}
+	if monitor.trend == nil {
+		monitor.trend = &LoadTrend{}
+	}
 	monitor.StatsModel.ShapingEnabled = monitor.SmartShape
+	if monitor.AnomalyZScore < 0 {
+		err = errors.New("failed to initialise monitor '" +
+			monitor.Name + "': anomaly Z-score cannot be negative")
+		return
+	}
 	monitor.SysMetric, err = NewMetric(monitor.MetricType,
 		monitor.Params, monitor.FilePath)
+	if err == nil {
+		err = monitor.configureHistory()
+	}
+	if err == nil {
+		err = monitor.configureFailurePolicy()
+	}
 	if err != nil {
 		err = errors.New("failed to initialise monitor '" +
 			monitor.Name + "': " + err.Error())
@@ -108,42 +149,57 @@ func (monitor *SystemMonitor) Initialise() (err error) {
 // Start launches this SystemMonitor as a goroutine, returning any errors
 // that occurred during the initial setup.
 func (monitor *SystemMonitor) Start() (err error) {
-	// Try and launch the goroutine and wait for whether it succeeded or not.
-	initChannel := make(chan int)
-	go monitor.run(initChannel)
+	// Try and launch the goroutine and wait for whether it succeeded or
+	// not; it runs until its context is cancelled.
+	initChannel := make(chan int, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go monitor.run(ctx, initChannel, done)
 	status := <-initChannel
 	// Lock the mutex to avoid a race condition with the goroutine
 	// itself and with Stop(), and the other state change functions.
 	monitor.mutex.Lock()
 	defer monitor.mutex.Unlock()
 	if status == ServiceStateRunning && monitor.LastError == nil {
-		logrus.Info(monitor.getLogHead() + "has started (" +
+		logLine := monitor.getLogHead() + "has started (" +
 			monitor.SysMetric.GetDescription() +
-			", interval " + strconv.Itoa(monitor.Interval) + "ms).")
-		// As this has been a successful start, the init channel
-		// now becomes this Monitor's output channel. (Again, we
-		// currently have the mutex, remember.)
-		monitor.statusChannel = initChannel
+			", interval " + strconv.Itoa(monitor.Interval) + "ms)."
+		monitor.logger().Info(logLine)
+		monitor.ParentAgent.recordServiceEvent(EventTypeServiceStarted,
+			LogFieldMonitor, monitor.Name, logLine)
+		// As this has been a successful start, keep the means to stop
+		// the worker. (Again, we currently have the mutex, remember.)
+		monitor.cancel = cancel
+		monitor.done = done
+	} else {
+		cancel()
 	}
 	return monitor.LastError
 }
 
-// Stop stops this SystemMonitor service.
+// Stop stops this SystemMonitor service by cancelling the context of its
+// worker, returning an error if it does not stop within the timeout rather
+// than waiting indefinitely.
 func (monitor *SystemMonitor) Stop() (err error) {
 	// Capture the running status within a lock cycle to prevent
 	// a possible race condition with Start().
-	if monitor.IsRunning() {
-		stopped := false
-		for !stopped {
-			// Send the child goroutine a quit message
-			monitor.signalChannel <- ServiceStateStopped
-			// Check for a successful stopped reply
-			if <-monitor.statusChannel == ServiceStateStopped {
-				logrus.Info(monitor.getLogHead() +
-					"has stopped.")
-				stopped = true
-			}
-		}
+	monitor.mutex.Lock()
+	if !monitor.runState || monitor.cancel == nil {
+		monitor.mutex.Unlock()
+		return
+	}
+	cancel, done := monitor.cancel, monitor.done
+	monitor.cancel = nil
+	monitor.mutex.Unlock()
+	cancel()
+	select {
+	case <-done:
+		monitor.logger().Info(monitor.getLogHead() + "has stopped.")
+		monitor.ParentAgent.recordServiceEvent(EventTypeServiceStopped,
+			LogFieldMonitor, monitor.Name, monitor.getLogHead()+"has stopped.")
+	case <-time.After(MonitorStopTimeout * time.Millisecond):
+		err = errors.New("timed out waiting for monitor '" + monitor.Name +
+			"' to stop")
 	}
 	return
 }
@@ -165,8 +221,11 @@ func (monitor *SystemMonitor) IsRunning() (state bool) {
 	return
 }
 
-// The main worker function for the [SystemMonitor] type.
-func (monitor *SystemMonitor) run(initChannel chan int) {
+// The main worker function for the [SystemMonitor] type, which reports its
+// initial state on the init channel and runs until its context is
+// cancelled, closing the done channel once it has stopped.
+func (monitor *SystemMonitor) run(ctx context.Context, initChannel chan int,
+	done chan struct{}) {
 	// Lock the mutex straight away on first launch.
 	monitor.mutex.Lock()
 	defer monitor.mutex.Unlock()
@@ -187,74 +246,117 @@ func (monitor *SystemMonitor) run(initChannel chan int) {
 	// functions will touch this until they get the lock.
 	monitor.runState = true
 	monitor.LastError = nil
-	monitor.signalChannel = make(chan int)
+	if !monitor.startTime.IsZero() {
+		monitor.restartCount++
+	}
+	monitor.startTime = time.Now()
+	monitor.isAnomalous = false
+	monitor.isStale = false
+	monitor.trend.Reset()
 	initChannel <- ServiceStateRunning
+	// Signal that we've stopped once the loop exits; the mutex is still
+	// held at this point, and is released by the earlier deferral.
+	defer close(done)
 	metricFailed := false
-	timeWaited := 0
-	for monitor.runState {
+	// Sample the metric each time the ticker fires, waiting on it with the
+	// mutex unlocked; a stop request is handled as soon as the context is
+	// cancelled, however long the sampling interval.
+	ticker := time.NewTicker(time.Duration(monitor.Interval) *
+		time.Millisecond)
+	defer ticker.Stop()
+	for {
+		monitor.mutex.Unlock()
 		select {
-		case msg := <-monitor.signalChannel:
-			if msg == ServiceStateStopped {
-				// Exit the run loop if we catch the signal to
-				// tell us to stop.
-				monitor.runState = false
-			} else {
-				logrus.Error("monitor caught unknown signal, ignoring: " +
-					strconv.Itoa(msg))
-			}
-		default:
-			// So that we don't stall a service state change where a long
-			// sampling interval has been set for this monitor, we sleep
-			// for a constant, short wait interval and keep a timer to find
-			// out how long we've waited so far. Then, we perform the
-			// (possibly resource-hungry) metric sampling only when the
-			// longer monitor interval is exceeded. This allows start, stop
-			// and restart operations to take place without blocking.
-			if timeWaited >= monitor.Interval {
-				timeWaited = 0
-				// As we are still running, get a sample from our
-				// metric and pass it to the stats model, waiting
-				// for the required poll interval before iterating.
-				value, err := monitor.getMetricSample()
-				if err == nil {
-					monitor.StatsModel.NewValue(value)
-					if monitor.LastError != nil && metricFailed {
-						logrus.Info(monitor.getLogHead() +
-							"sampling has now succeeded; error cleared.")
-						metricFailed = false
-						monitor.LastError = nil
-					}
-				} else if monitor.LastError == nil {
-					logrus.Error(monitor.getLogHead() +
-						"failed to sample metric: " +
-						err.Error())
-					logrus.Warn("The above error will be logged only once.")
-					metricFailed = true
-					monitor.LastError = err
-				}
+		case <-ctx.Done():
+		case <-ticker.C:
+		}
+		monitor.mutex.Lock()
+		if ctx.Err() != nil {
+			// Exit the run loop once our context is cancelled.
+			monitor.runState = false
+			return
+		}
+		// As we are still running, get a sample from our metric and
+		// pass it to the stats model. The mutex is released while
+		// sampling, which may take some time, so that we can still
+		// be stopped.
+		monitor.mutex.Unlock()
+		value, err := monitor.getMetricSample()
+		monitor.mutex.Lock()
+		var panicErr *PanicError
+		if errors.As(err, &panicErr) {
+			// The metric is now in an unknown state, so stop and hand
+			// over to the supervisor to restart us.
+			monitor.runState = false
+			monitor.LastError = err
+			monitor.logger().Error(monitor.getLogHead() + "has stopped: " +
+				err.Error() + ".")
+			monitor.ParentAgent.serviceFailed(LogFieldMonitor, monitor.Name,
+				monitor.startTime, err)
+			return
+		}
+		if err == nil {
+			now := time.Now()
+			monitor.samples++
+			monitor.lastSample = now
+			monitor.StatsModel.NewValue(value)
+			monitor.history.Add(now, float64(value))
+			monitor.ParentAgent.recordHistory("monitor", monitor.Name,
+				now, float64(value))
+			monitor.trend.Add(now,
+				float64(monitor.StatsModel.GetResult()))
+			monitor.checkForAnomaly(value)
+			if monitor.LastError != nil && metricFailed {
+				monitor.logger().Info(monitor.getLogHead() +
+					"sampling has now succeeded; error cleared.")
+				metricFailed = false
+				monitor.LastError = nil
+				monitor.recordSamplingEvent(EventTypeSampleRecovered, nil)
 			}
-			// Unlock the mutex during the wait, and lock
-			// after it has concluded as we are resuming.
-			monitor.mutex.Unlock()
-			time.Sleep(time.Duration(MonitorWaitInterval *
-				int(time.Millisecond)))
-			monitor.mutex.Lock()
-			// Increment the timer by the period that we just waited.
-			timeWaited += MonitorWaitInterval
+		} else {
+			monitor.sampleFailures++
+		}
+		if err != nil && monitor.LastError == nil {
+			monitor.logger().Error(monitor.getLogHead() +
+				"failed to sample metric: " +
+				err.Error())
+			monitor.logger().Warn("The above error will be logged only once.")
+			metricFailed = true
+			monitor.LastError = err
+			monitor.recordSamplingEvent(EventTypeSampleFailed, err)
 		}
 	}
-	monitor.sendStoppedStatus()
 }
 
-func (monitor *SystemMonitor) sendStoppedStatus() {
-	// Announce that we've now stopped on the status channel.
-	monitor.statusChannel <- ServiceStateStopped
+// fillServiceStatus adds the details of the running state of this
+// SystemMonitor to its entry in the service status.
+func (monitor *SystemMonitor) fillServiceStatus(status *APIServiceStatus) {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	if monitor.LastError != nil {
+		status.LastError = monitor.LastError.Error()
+	}
+	if !monitor.startTime.IsZero() {
+		startTime := monitor.startTime
+		status.StartTime = &startTime
+		if monitor.runState {
+			status.UptimeSeconds = int64(time.Since(startTime).Seconds())
+		}
+	}
+	status.RestartCount = monitor.restartCount
+	if !monitor.lastSample.IsZero() {
+		lastValue := monitor.StatsModel.GetResult()
+		status.LastValue = &lastValue
+		lastSample := monitor.lastSample
+		status.LastSample = &lastSample
+	}
+	status.Stale = monitor.staleReason(time.Now()) != ""
 }
 
 func (monitor *SystemMonitor) enforceInterval() {
 	minInterval := monitor.SysMetric.GetMinInterval()
 	if monitor.Interval < minInterval {
-		logrus.Warn(
+		monitor.logger().Warn(
 			monitor.getLogHead() +
 				"unspecified or invalid sampling interval; using minimum of " +
 				strconv.Itoa(minInterval) +
@@ -264,6 +366,11 @@ func (monitor *SystemMonitor) enforceInterval() {
 	}
 }
 
+// logger returns a log entry tagged with the name of this SystemMonitor.
+func (monitor *SystemMonitor) logger() *logrus.Entry {
+	return logrus.WithField(LogFieldMonitor, monitor.Name)
+}
+
 // Generates the head of a log message.
 func (monitor *SystemMonitor) getLogHead() string {
 	return "System Metric Monitor '" + monitor.Name + "' "
@@ -271,10 +378,57 @@ func (monitor *SystemMonitor) getLogHead() string {
 
 // Gets a sample from the metric that this thread is measuring.
 func (monitor *SystemMonitor) getMetricSample() (value float64, err error) {
+	// Report a panic within the metric as an error, so that the worker
+	// can stop cleanly.
+	if !PanicDebug {
+		defer func() {
+			if r := recover(); r != nil {
+				value, err = 0, monitor.ParentAgent.reportPanic(
+					LogFieldMonitor, monitor.Name, r)
+			}
+		}()
+	}
 	value, err = monitor.SysMetric.GetLoad()
 	return
 }
 
+// checkForAnomaly raises an advisory event when an observation deviates
+// from the mean learned by the statistics model by more than the anomaly
+// Z-score configured for this monitor, and another when it returns to
+// within this range. The served feedback is not affected.
+func (monitor *SystemMonitor) checkForAnomaly(value float64) {
+	model := monitor.StatsModel
+	if monitor.AnomalyZScore <= 0 || monitor.ParentAgent == nil ||
+		model.XCount < MinAnomalyObservations {
+		return
+	}
+	anomalous := math.Abs(model.ZScoreValue) >= monitor.AnomalyZScore
+	if anomalous == monitor.isAnomalous {
+		return
+	}
+	monitor.isAnomalous = anomalous
+	event := AgentEvent{
+		Type:        EventTypeAnomaly,
+		ServiceType: LogFieldMonitor,
+		ServiceName: monitor.Name,
+		Fields: map[string]any{
+			EventFieldValue:  value,
+			EventFieldMean:   math.Round(model.XSum/float64(model.XCount)*100) / 100,
+			EventFieldZScore: math.Round(model.ZScoreValue*100) / 100,
+		},
+	}
+	if anomalous {
+		event.Message = monitor.getLogHead() + "observed an anomalous value " +
+			"(Z-score " + strconv.FormatFloat(model.ZScoreValue, 'f', 2, 64) +
+			"); feedback is unaffected."
+	} else {
+		event.Type = EventTypeAnomalyCleared
+		event.Level = LogLevelInfo
+		event.Message = monitor.getLogHead() + "has returned to its usual range."
+	}
+	monitor.ParentAgent.RaiseEvent(event)
+}
+
 // CurrentValue returns the current raw value for this monitor thread.
 func (monitor *SystemMonitor) CurrentValue() (result int64) {
 	monitor.mutex.Lock()
@@ -283,6 +437,17 @@ func (monitor *SystemMonitor) CurrentValue() (result int64) {
 	return result
 }
 
+// latestSample returns the current value for this monitor along with the
+// time at which its last sample was taken, which is zero if it has not
+// yet taken one.
+func (monitor *SystemMonitor) latestSample() (value int64, at time.Time) {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	value = monitor.StatsModel.GetResult()
+	at = monitor.lastSample
+	return
+}
+
 // -------------------------------------------------------------------
 // END OF FILE
 // -------------------------------------------------------------------
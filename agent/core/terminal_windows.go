@@ -0,0 +1,68 @@
+//go:build windows
+
+// terminal_windows.go
+// Raw Terminal Mode for the Interactive Shell - Windows
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// makeRawTerminal puts a console into raw mode, in which input is read a
+// key at a time without being echoed, and in which terminal sequences are
+// used for the cursor keys and for output, returning a function which
+// restores the previous modes. An error is returned if the file is not a
+// console.
+func makeRawTerminal(file *os.File) (restore func(), err error) {
+	input := windows.Handle(file.Fd())
+	output := windows.Handle(os.Stdout.Fd())
+	var inputMode, outputMode uint32
+	err = windows.GetConsoleMode(input, &inputMode)
+	if err != nil {
+		return
+	}
+	rawMode := inputMode &^ (windows.ENABLE_ECHO_INPUT |
+		windows.ENABLE_PROCESSED_INPUT | windows.ENABLE_LINE_INPUT)
+	rawMode |= windows.ENABLE_VIRTUAL_TERMINAL_INPUT
+	err = windows.SetConsoleMode(input, rawMode)
+	if err != nil {
+		return
+	}
+	// Output is left unchanged if it is not a console.
+	outputErr := windows.GetConsoleMode(output, &outputMode)
+	if outputErr == nil {
+		_ = windows.SetConsoleMode(output,
+			outputMode|windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING)
+	}
+	restore = func() {
+		_ = windows.SetConsoleMode(input, inputMode)
+		if outputErr == nil {
+			_ = windows.SetConsoleMode(output, outputMode)
+		}
+	}
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
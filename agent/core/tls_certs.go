@@ -33,11 +33,19 @@ import (
 	"errors"
 	"math/big"
 	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
 	"time"
 )
 
-func CreateNewTLSCertificate(ipList []net.IP, validFor time.Duration) (cert *tls.Certificate,
-	validTo time.Time, err error) {
+// CreateNewTLSCertificate generates a self-signed certificate valid for a
+// period, with the given IP addresses and DNS names as its subject
+// alternative names.
+func CreateNewTLSCertificate(ipList []net.IP, dnsNames []string,
+	validFor time.Duration) (cert *tls.Certificate, validTo time.Time,
+	err error) {
 	// Generate a random serial 128-bit serial number for the cert.
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
@@ -51,6 +59,7 @@ func CreateNewTLSCertificate(ipList []net.IP, validFor time.Duration) (cert *tls
 	template := x509.Certificate{
 		SerialNumber: serialNumber,
 		IPAddresses:  ipList,
+		DNSNames:     dnsNames,
 		Subject: pkix.Name{
 			Organization: []string{"Loadbalancer.org Limited"},
 		},
@@ -95,3 +104,55 @@ func CreateNewTLSCertificate(ipList []net.IP, validFor time.Duration) (cert *tls
 	cert = &certObject
 	return
 }
+
+// CertificateSubjects returns the IP addresses and DNS names by which a
+// client may reach a server listening on the given addresses, for the
+// subject alternative names of its certificate. A wildcard (empty or
+// unspecified) address is reachable by any address of the host, along with
+// its hostname and 'localhost'; a hostname is included along with each
+// of the addresses to which it resolves. Zones are not part of an address
+// in a certificate, so are removed.
+func CertificateSubjects(addresses []string) (ipList []net.IP,
+	dnsNames []string) {
+	addIP := func(ip net.IP) {
+		for _, existing := range ipList {
+			if existing.Equal(ip) {
+				return
+			}
+		}
+		ipList = append(ipList, ip)
+	}
+	addName := func(name string) {
+		name = strings.ToLower(name)
+		if IsValidHostname(name) && !slices.Contains(dnsNames, name) {
+			dnsNames = append(dnsNames, name)
+		}
+	}
+	for _, address := range addresses {
+		parsed, err := netip.ParseAddr(address)
+		switch {
+		case address == "" || (err == nil && parsed.IsUnspecified()):
+			interfaceAddrs, _ := net.InterfaceAddrs()
+			for _, interfaceAddr := range interfaceAddrs {
+				if network, ok := interfaceAddr.(*net.IPNet); ok {
+					addIP(network.IP)
+				}
+			}
+			addIP(net.IPv4(127, 0, 0, 1))
+			addIP(net.IPv6loopback)
+			addName("localhost")
+			if hostname, err := os.Hostname(); err == nil {
+				addName(hostname)
+			}
+		case err == nil:
+			addIP(net.IP(parsed.WithZone("").AsSlice()))
+		default:
+			addName(address)
+			resolved, _ := net.LookupIP(address)
+			for _, ip := range resolved {
+				addIP(ip)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,353 @@
+// tuning.go
+// Significance Analysis for Feedback Sources
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Default and minimum sampling intervals for a significance analysis.
+	DefaultAnalysisInterval = 1000
+	MinAnalysisInterval     = 100
+	// Number of samples required before significances are suggested.
+	MinAnalysisSamples = 30
+)
+
+// SignificanceAnalysis observes the load of each Feedback Source of a
+// Responder alongside a target signal from another System Monitor (such
+// as a script measuring response latency), and calculates the correlation
+// between each source and the target so that significance values can be
+// chosen empirically.
+type SignificanceAnalysis struct {
+	responder  *FeedbackResponder
+	target     *SystemMonitor
+	interval   int
+	startTime  time.Time
+	samples    int
+	sources    map[string]*correlationSums
+	stopSignal chan bool
+	runState   bool
+	mutex      sync.Mutex
+}
+
+// correlationSums holds the running sums needed to calculate the Pearson
+// correlation coefficient between a source (x) and the target (y).
+type correlationSums struct {
+	n, sumX, sumY, sumXX, sumYY, sumXY float64
+}
+
+// add records a new pair of observations.
+func (sums *correlationSums) add(x float64, y float64) {
+	sums.n++
+	sums.sumX += x
+	sums.sumY += y
+	sums.sumXX += x * x
+	sums.sumYY += y * y
+	sums.sumXY += x * y
+}
+
+// correlation returns the Pearson correlation coefficient for the
+// observations so far. If either series has not varied, the correlation
+// is undefined and valid is false.
+func (sums *correlationSums) correlation() (r float64, valid bool) {
+	covariance := sums.n*sums.sumXY - sums.sumX*sums.sumY
+	varianceX := sums.n*sums.sumXX - sums.sumX*sums.sumX
+	varianceY := sums.n*sums.sumYY - sums.sumY*sums.sumY
+	if varianceX <= 0 || varianceY <= 0 {
+		return
+	}
+	r = covariance / math.Sqrt(varianceX*varianceY)
+	// Guard against rounding taking the result out of range.
+	r = math.Max(-1, math.Min(1, r))
+	valid = true
+	return
+}
+
+// NewSignificanceAnalysis creates a new analysis of the sources of a
+// Responder against a target monitor, sampled at the given interval (ms).
+func NewSignificanceAnalysis(responder *FeedbackResponder,
+	target *SystemMonitor, interval int) (analysis *SignificanceAnalysis,
+	err error) {
+	if interval == 0 {
+		interval = DefaultAnalysisInterval
+	} else if interval < MinAnalysisInterval {
+		err = errors.New("analysis interval must be at least " +
+			strconv.Itoa(MinAnalysisInterval) + "ms")
+		return
+	}
+	if len(responder.FeedbackSources) == 0 {
+		err = errors.New("responder '" + responder.ResponderName +
+			"' has no feedback sources to analyse")
+		return
+	}
+	analysis = &SignificanceAnalysis{
+		responder: responder,
+		target:    target,
+		interval:  interval,
+		sources:   make(map[string]*correlationSums),
+	}
+	return
+}
+
+// Start launches the sampling goroutine for this analysis.
+func (analysis *SignificanceAnalysis) Start() {
+	analysis.mutex.Lock()
+	defer analysis.mutex.Unlock()
+	if analysis.runState {
+		return
+	}
+	analysis.runState = true
+	analysis.startTime = time.Now()
+	analysis.stopSignal = make(chan bool)
+	go analysis.run(analysis.stopSignal)
+	logrus.Info("Significance analysis for Feedback Responder '" +
+		analysis.responder.ResponderName + "' has started against monitor '" +
+		analysis.target.Name + "' (interval " +
+		strconv.Itoa(analysis.interval) + "ms).")
+}
+
+// Stop ends sampling for this analysis; the results remain available.
+func (analysis *SignificanceAnalysis) Stop() {
+	analysis.mutex.Lock()
+	defer analysis.mutex.Unlock()
+	if !analysis.runState {
+		return
+	}
+	analysis.runState = false
+	close(analysis.stopSignal)
+	logrus.Info("Significance analysis for Feedback Responder '" +
+		analysis.responder.ResponderName + "' has stopped after " +
+		strconv.Itoa(analysis.samples) + " samples.")
+}
+
+// IsRunning returns whether this analysis is currently sampling.
+func (analysis *SignificanceAnalysis) IsRunning() bool {
+	analysis.mutex.Lock()
+	defer analysis.mutex.Unlock()
+	return analysis.runState
+}
+
+// run samples the sources and target at each interval until stopped.
+func (analysis *SignificanceAnalysis) run(stopSignal chan bool) {
+	ticker := time.NewTicker(time.Duration(analysis.interval) *
+		time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopSignal:
+			return
+		case <-ticker.C:
+			analysis.sample()
+		}
+	}
+}
+
+// sample records the current load of each source against the target.
+// Samples are skipped whilst the target monitor has no observations.
+func (analysis *SignificanceAnalysis) sample() {
+	if !analysis.target.IsRunning() ||
+		!analysis.target.StatsModel.HasObservations() {
+		return
+	}
+	targetValue := float64(analysis.target.CurrentValue())
+	// The sources of the responder may be edited whilst this runs, so
+	// their loads are read under its mutex.
+	responder := analysis.responder
+	responder.mutex.Lock()
+	loads := make(map[string]int, len(responder.FeedbackSources))
+	for name, source := range responder.FeedbackSources {
+		if source.Monitor != nil {
+			loads[name] = getSourceLoad(source)
+		}
+	}
+	responder.mutex.Unlock()
+	analysis.mutex.Lock()
+	defer analysis.mutex.Unlock()
+	for name, load := range loads {
+		sums, exists := analysis.sources[name]
+		if !exists {
+			sums = &correlationSums{}
+			analysis.sources[name] = sums
+		}
+		sums.add(float64(load), targetValue)
+	}
+	analysis.samples++
+}
+
+// Report generates the current results of this analysis. Suggested
+// significances are scaled so that the source most strongly correlated
+// with the target has a significance of 1.0; sources which are not
+// positively correlated are given a significance of zero.
+func (analysis *SignificanceAnalysis) Report() (report *SignificanceReport) {
+	responder := analysis.responder
+	responder.mutex.Lock()
+	significances := make(map[string]float64, len(responder.FeedbackSources))
+	for name, source := range responder.FeedbackSources {
+		significances[name] = source.Significance
+	}
+	responder.mutex.Unlock()
+	analysis.mutex.Lock()
+	defer analysis.mutex.Unlock()
+	report = &SignificanceReport{
+		Responder:     analysis.responder.ResponderName,
+		TargetMonitor: analysis.target.Name,
+		Running:       analysis.runState,
+		StartTime:     analysis.startTime,
+		Interval:      analysis.interval,
+		Samples:       analysis.samples,
+		Sources:       make(map[string]*SourceCorrelation),
+	}
+	maxCorrelation := 0.0
+	anyValid := false
+	for name, sums := range analysis.sources {
+		result := &SourceCorrelation{Samples: int(sums.n)}
+		if significance, exists := significances[name]; exists {
+			result.CurrentSignificance = significance
+		}
+		r, valid := sums.correlation()
+		if valid {
+			r = math.Round(r*1000) / 1000
+			result.Correlation = &r
+			anyValid = true
+			maxCorrelation = math.Max(maxCorrelation, r)
+		}
+		report.Sources[name] = result
+	}
+	switch {
+	case analysis.samples < MinAnalysisSamples:
+		report.Message = "collecting samples; significances will be " +
+			"suggested after " + strconv.Itoa(MinAnalysisSamples) + " samples"
+	case !anyValid:
+		report.Message = "the sources and target have not varied enough " +
+			"to calculate correlations"
+	case maxCorrelation <= 0:
+		report.Message = "no source is positively correlated with the " +
+			"target; significances cannot be suggested"
+	default:
+		for _, result := range report.Sources {
+			suggested := 0.0
+			if result.Correlation != nil && *result.Correlation > 0 {
+				suggested = math.Round(*result.Correlation/maxCorrelation*100) / 100
+			}
+			result.SuggestedSignificance = &suggested
+		}
+	}
+	return
+}
+
+// #######################################################################
+// Agent Analysis Management
+// #######################################################################
+
+// StartSignificanceAnalysis begins a new significance analysis for a
+// Responder against a target monitor, replacing any previous results.
+func (agent *FeedbackAgent) StartSignificanceAnalysis(responderName string,
+	targetName string, interval int) (err error) {
+	responder, err := agent.GetResponderByName(responderName)
+	if err != nil {
+		return
+	}
+	target, err := agent.GetMonitorByName(targetName)
+	if err != nil {
+		return
+	}
+	agent.analysisMutex.Lock()
+	defer agent.analysisMutex.Unlock()
+	if existing, exists := agent.analyses[responderName]; exists &&
+		existing.IsRunning() {
+		err = errors.New("an analysis is already running for responder '" +
+			responderName + "'")
+		return
+	}
+	analysis, err := NewSignificanceAnalysis(responder, target, interval)
+	if err != nil {
+		return
+	}
+	if agent.analyses == nil {
+		agent.analyses = make(map[string]*SignificanceAnalysis)
+	}
+	agent.analyses[responderName] = analysis
+	analysis.Start()
+	return
+}
+
+// StopSignificanceAnalysis stops the running analysis for a Responder.
+func (agent *FeedbackAgent) StopSignificanceAnalysis(responderName string) (
+	err error) {
+	analysis, err := agent.getSignificanceAnalysis(responderName)
+	if err != nil {
+		return
+	}
+	if !analysis.IsRunning() {
+		err = errors.New("the analysis for responder '" + responderName +
+			"' is not running")
+		return
+	}
+	analysis.Stop()
+	return
+}
+
+// GetSignificanceReport returns the results of the most recent analysis
+// for a Responder, whether or not it is still running.
+func (agent *FeedbackAgent) GetSignificanceReport(responderName string) (
+	report *SignificanceReport, err error) {
+	analysis, err := agent.getSignificanceAnalysis(responderName)
+	if err != nil {
+		return
+	}
+	report = analysis.Report()
+	return
+}
+
+// endSignificanceAnalysis stops any analysis for a Responder which is being
+// removed or replaced, as its results would no longer be meaningful.
+func (agent *FeedbackAgent) endSignificanceAnalysis(responderName string) {
+	agent.analysisMutex.Lock()
+	defer agent.analysisMutex.Unlock()
+	if analysis, exists := agent.analyses[responderName]; exists {
+		analysis.Stop()
+		delete(agent.analyses, responderName)
+	}
+}
+
+// getSignificanceAnalysis finds the analysis for a Responder.
+func (agent *FeedbackAgent) getSignificanceAnalysis(responderName string) (
+	analysis *SignificanceAnalysis, err error) {
+	agent.analysisMutex.Lock()
+	defer agent.analysisMutex.Unlock()
+	analysis, exists := agent.analyses[responderName]
+	if !exists {
+		err = errors.New("no analysis has been started for responder '" +
+			responderName + "'")
+	}
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,121 @@
+// upsert.go
+// Idempotent Creation and Editing of Services
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// Results reported for an upsert request.
+const (
+	UpsertCreated   = "created"
+	UpsertUpdated   = "updated"
+	UpsertUnchanged = "unchanged"
+)
+
+// APIHandleUpsert processes an API request to create a monitor, responder
+// or source if it does not exist, or otherwise to edit it to match the
+// request, returning which of these occurred. An upsert which would change
+// nothing leaves the service running untouched, so that provisioning tools
+// can safely repeat the same request.
+func (agent *FeedbackAgent) APIHandleUpsert(request *APIRequest) (
+	result string, err error) {
+	exists := false
+	changed := false
+	switch request.Type {
+	case "monitor":
+		_, exists = agent.Monitors[request.TargetName]
+		if exists {
+			changed, err = agent.APIEditMonitor(request)
+		} else {
+			err = agent.APIAddMonitor(request)
+		}
+	case "responder":
+		_, exists = agent.Responders[request.TargetName]
+		if exists {
+			changed, err = agent.APIEditResponder(request)
+		} else {
+			if request.FeedbackSources == nil {
+				err = errors.New("no feedback sources specified")
+				return
+			}
+			err = agent.APIAddResponder(request)
+		}
+	case "source":
+		var res *FeedbackResponder
+		res, err = agent.GetResponderByName(request.TargetName)
+		if err != nil {
+			return
+		}
+		if request.SourceMonitorName == nil {
+			err = errors.New("no source monitor specified")
+			return
+		}
+		name := strings.ToLower(strings.TrimSpace(*request.SourceMonitorName))
+		_, exists = res.FeedbackSources[name]
+		if exists {
+			changed, err = res.EditFeedbackSource(name,
+				request.SourceSignificance, request.SourceMaxValue,
+				request.ThresholdScore, request.SourceRawThreshold,
+				request.SourceAction)
+		} else {
+			err = res.AddFeedbackSource(name,
+				request.SourceSignificance, request.SourceMaxValue,
+				request.ThresholdScore, request.SourceRawThreshold,
+				request.SourceAction)
+		}
+		if err == nil && (changed || !exists) {
+			agent.unsavedChanges = true
+		}
+	default:
+		err = errors.New("cannot upsert type '" + request.Type + "'")
+	}
+	if err != nil {
+		return
+	}
+	switch {
+	case !exists:
+		result = UpsertCreated
+	case changed:
+		result = UpsertUpdated
+	default:
+		result = UpsertUnchanged
+	}
+	return
+}
+
+// sameServiceConfig returns whether two services have the same
+// configuration, as saved to the configuration file.
+func sameServiceConfig(old any, new any) bool {
+	oldJSON, err := json.Marshal(old)
+	if err != nil {
+		return false
+	}
+	newJSON, err := json.Marshal(new)
+	return err == nil && bytes.Equal(oldJSON, newJSON)
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -27,6 +27,9 @@ import (
 	"encoding/hex"
 	"errors"
 	"log"
+	"path"
+	"runtime/debug"
+	"strconv"
 	"strings"
 )
 
@@ -113,15 +116,112 @@ func PointerHandleBoolString(input *string) (output *bool) {
 	return
 }
 
-// StandardiseNameIdentifier validates and standardises an object name identifier.
+// StandardiseNameIdentifier validates and standardises an object name
+// identifier. Names are case-insensitive and are stored in lower case; they
+// must begin with a letter or digit (so they cannot be mistaken for a CLI
+// flag) and may otherwise only contain letters, digits, '-', '_' and '.'.
 func StandardiseNameIdentifier(in string) (out string, err error) {
 	// Sanitise the name string
 	str := strings.ToLower(strings.TrimSpace(in))
-	// If it's empty, return an error, otherwise return the string
+	// If it's empty, return an error, otherwise validate the string
 	if str == "" {
 		err = errors.New("name not specified")
-	} else {
-		out = str
+		return
+	}
+	if len(str) > MaxNameLength {
+		err = errors.New("name '" + in + "' is too long; the maximum is " +
+			strconv.Itoa(MaxNameLength) + " characters")
+		return
+	}
+	for i, c := range str {
+		isAlphanumeric := (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9')
+		if i == 0 && !isAlphanumeric {
+			err = errors.New("name '" + in + "' must begin with a letter or digit")
+			return
+		}
+		if !isAlphanumeric && c != '-' && c != '_' && c != '.' {
+			err = errors.New("name '" + in + "' is invalid; only letters, " +
+				"digits, '-', '_' and '.' may be used")
+			return
+		}
+	}
+	out = str
+	return
+}
+
+// NormaliseNameMap returns a copy of a map of named services with each key
+// standardised by [StandardiseNameIdentifier], reporting whether any key was
+// changed. An error is returned for an invalid name, or if two keys differ
+// only by case (and would therefore refer to the same service).
+func NormaliseNameMap[T any](in map[string]T, kind string) (
+	out map[string]T, renamed bool, err error) {
+	if in == nil {
+		return
+	}
+	out = make(map[string]T, len(in))
+	for key, value := range in {
+		var name string
+		name, err = StandardiseNameIdentifier(key)
+		if err != nil {
+			err = errors.New("invalid " + kind + ": " + err.Error())
+			return
+		}
+		if _, exists := out[name]; exists {
+			err = errors.New("duplicate " + kind + " name '" + name +
+				"' (names are not case-sensitive)")
+			return
+		}
+		if name != key {
+			renamed = true
+		}
+		out[name] = value
+	}
+	return
+}
+
+// ParseInstanceName standardises the name of an agent instance, which is
+// used as a directory name.
+func ParseInstanceName(in string) (out string, err error) {
+	out, err = StandardiseNameIdentifier(in)
+	if err != nil {
+		err = errors.New("invalid instance: " + err.Error())
+	}
+	return
+}
+
+// InstanceDir returns the directory for a named agent instance within a
+// base directory, or the base directory itself for the default instance.
+func InstanceDir(baseDir string, instance string) string {
+	if instance == "" {
+		return baseDir
+	}
+	return path.Join(baseDir, InstancesDirName, instance)
+}
+
+// GetBuildRevision returns the source revision and commit time of this binary,
+// preferring a value set at link time in BuildCommit over the VCS revision
+// embedded by the Go toolchain.
+func GetBuildRevision() (revision string, commitTime string) {
+	revision = BuildCommit
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	modified := false
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if revision == "" {
+				revision = setting.Value
+			}
+		case "vcs.time":
+			commitTime = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if modified && BuildCommit == "" && revision != "" {
+		revision += "-modified"
 	}
 	return
 }
@@ -129,3 +229,25 @@ func StandardiseNameIdentifier(in string) (out string, err error) {
 func StringAddr(s string) *string {
 	return &s
 }
+
+// WrapText word-wraps a string so that no line exceeds the specified
+// width, indenting every line by the specified number of spaces.
+func WrapText(text string, indent int, width int) string {
+	prefix := strings.Repeat(" ", indent)
+	words := strings.Fields(text)
+	if len(words) == 0 {
+		return prefix
+	}
+	var lines []string
+	line := prefix + words[0]
+	for _, word := range words[1:] {
+		if len(line)+1+len(word) > width {
+			lines = append(lines, line)
+			line = prefix + word
+		} else {
+			line += " " + word
+		}
+	}
+	lines = append(lines, line)
+	return strings.Join(lines, "\n")
+}
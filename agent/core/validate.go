@@ -0,0 +1,286 @@
+// validate.go
+// Dry-Run Validation of Agent Configurations
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strconv"
+)
+
+// ValidateConfigJSON performs a dry run of loading a candidate agent
+// configuration, initialising each of its monitors and responders in an
+// isolated agent without starting them (so no sockets are bound), and
+// reports every problem found rather than stopping at the first one.
+// Nothing is applied to the running agent.
+func (agent *FeedbackAgent) ValidateConfigJSON(data []byte) (
+	result *ConfigValidation) {
+	result, _ = agent.stageConfigJSON(data)
+	return
+}
+
+// stageConfigJSON validates a candidate agent configuration as for
+// ValidateConfigJSON, also returning the staging agent holding the
+// services which were initialised, or nil if the JSON could not be parsed.
+func (agent *FeedbackAgent) stageConfigJSON(data []byte) (
+	result *ConfigValidation, staged *FeedbackAgent) {
+	result = &ConfigValidation{}
+	data, fromVersion, changes, err := MigrateConfigJSON(data)
+	if err != nil {
+		result.addError("", "JSON configuration is invalid: "+err.Error())
+		return
+	}
+	if fromVersion > CurrentConfigVersion {
+		result.addWarning("", "config version "+strconv.Itoa(fromVersion)+
+			" is newer than supported by this agent")
+	}
+	for _, change := range changes {
+		result.addWarning("", "will be migrated from "+change)
+	}
+	parsed := FeedbackAgent{}
+	err = json.Unmarshal(data, &parsed)
+	if err != nil {
+		result.addError("", "JSON configuration is invalid: "+err.Error())
+		return
+	}
+	// Report any fields which are not recognised, such as misspellings.
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&FeedbackAgent{}); err != nil {
+		result.addWarning("", err.Error())
+	}
+	mainKey := result.validateAgentSettings(&parsed)
+
+	// Initialise the services within a staging agent that is never run.
+	staged = &FeedbackAgent{
+		configDir: agent.configDir,
+		options:   agent.options,
+	}
+	staged.InitialiseServiceMaps()
+	staged.Namespaces, err = ValidateNamespaces(parsed.Namespaces, mainKey)
+	if err != nil {
+		result.addError("", err.Error())
+	}
+	monitors, renamed, err := NormaliseNameMap(parsed.Monitors, "monitor")
+	if err != nil {
+		result.addError("", err.Error())
+	} else if renamed {
+		result.addWarning("", "monitor names will be converted to lower case")
+	}
+	for _, name := range sortedKeys(monitors) {
+		monitor := monitors[name]
+		monitor.Name = name
+		err = staged.AddMonitorObject(monitor)
+		if err != nil {
+			result.addError("monitor '"+name+"'", err.Error())
+		}
+	}
+	responders, renamed, err := NormaliseNameMap(parsed.Responders, "responder")
+	if err != nil {
+		result.addError("", err.Error())
+	} else if renamed {
+		result.addWarning("", "responder names will be converted to lower case")
+	}
+	usedMonitors := make(map[string]bool)
+	for _, name := range sortedKeys(responders) {
+		service := "responder '" + name + "'"
+		responder := responders[name]
+		responder.ResponderName = name
+		responder.FeedbackSources, renamed, err = NormaliseNameMap(
+			responder.FeedbackSources, "source in "+service)
+		if err != nil {
+			result.addError(service, err.Error())
+			continue
+		} else if renamed {
+			result.addWarning(service, "source names will be converted to lower case")
+		}
+		for sourceName := range responder.FeedbackSources {
+			usedMonitors[sourceName] = true
+		}
+		var migrated bool
+		migrated, err = staged.migrateLegacyAPI(responder)
+		if err != nil {
+			result.addError(service, err.Error())
+			continue
+		} else if migrated {
+			result.addWarning(service, "the insecure legacy API protocol '"+
+				ProtocolLegacyAPI+"' will be migrated to '"+ProtocolSecureAPI+"'")
+		}
+		err = staged.AddResponderObject(responder)
+		if err != nil {
+			result.addError(service, err.Error())
+			continue
+		}
+		if !responder.IsAPI() && len(responder.FeedbackSources) == 0 {
+			result.addWarning(service, "no feedback sources are configured")
+		}
+		for _, warning := range responder.CommandWarnings() {
+			result.addWarning(service, warning)
+		}
+		if responder.ProtocolName == ProtocolSNMP && responder.SNMP == nil {
+			result.addError(service, "no SNMP settings configured")
+		}
+		// Check that no two responders would listen on the same address,
+		// against those staged before this one so that each collision is
+		// reported once.
+		err = responder.checkListenCollision(staged.Responders)
+		if err != nil {
+			result.addError(service, err.Error())
+		}
+	}
+	// Check that each virtual responder can share the listener of another.
+	for _, name := range sortedKeys(staged.Responders) {
+		err = staged.checkListener(staged.Responders[name])
+		if err != nil {
+			result.addError("responder '"+name+"'", err.Error())
+		}
+	}
+	for _, name := range sortedKeys(staged.Monitors) {
+		if !usedMonitors[name] {
+			result.addWarning("monitor '"+name+"'",
+				"not used as a feedback source by any responder")
+		}
+	}
+	result.Valid = len(result.Errors) == 0
+	return
+}
+
+// validateAgentSettings checks the agent-wide settings of a candidate
+// configuration, returning its resolved API key.
+func (result *ConfigValidation) validateAgentSettings(parsed *FeedbackAgent) (
+	apiKey string) {
+	if _, err := ParseLogFormat(parsed.LogFormat); err != nil {
+		result.addError("", err.Error())
+	}
+	if _, _, err := ParseLogLevel(parsed.LogLevel); err != nil {
+		result.addError("", err.Error())
+	}
+	if _, err := ParseLogTargets(parsed.LogTargets); err != nil {
+		result.addError("", err.Error())
+	}
+	if parsed.LogRotation != nil {
+		if err := parsed.LogRotation.Validate(); err != nil {
+			result.addError("", err.Error())
+		}
+	}
+	if _, err := ParseDisabledActions(parsed.APIDisabled); err != nil {
+		result.addError("", err.Error())
+	}
+	if parsed.HistoryStore != nil {
+		if err := parsed.HistoryStore.Validate(); err != nil {
+			result.addError("", err.Error())
+		}
+	}
+	if parsed.Recorder != nil {
+		if err := parsed.Recorder.Validate(); err != nil {
+			result.addError("", err.Error())
+		}
+	}
+	if parsed.Heartbeat != nil {
+		if _, err := parsed.Heartbeat.Validate(); err != nil {
+			result.addError("", err.Error())
+		}
+	}
+	if parsed.Forwarder != nil {
+		if _, _, err := parsed.Forwarder.Validate(); err != nil {
+			result.addError("", err.Error())
+		}
+	}
+	if parsed.Webhooks != nil {
+		if _, _, err := parsed.Webhooks.Validate(); err != nil {
+			result.addError("", err.Error())
+		}
+	}
+	if parsed.Events != nil {
+		if err := parsed.Events.Validate(); err != nil {
+			result.addError("", err.Error())
+		}
+	}
+	if parsed.EmailAlerts != nil {
+		if _, _, err := parsed.EmailAlerts.Validate(); err != nil {
+			result.addError("", err.Error())
+		}
+	}
+	if parsed.OTel != nil {
+		if _, _, err := parsed.OTel.Validate(); err != nil {
+			result.addError("", err.Error())
+		}
+	}
+	if parsed.DebugListener != nil {
+		if _, err := parsed.DebugListener.Validate(); err != nil {
+			result.addError("", err.Error())
+		}
+	}
+	if parsed.Cluster != nil {
+		if _, err := parsed.Cluster.Validate(); err != nil {
+			result.addError("", err.Error())
+		}
+	}
+	if parsed.Hooks != nil {
+		if err := parsed.Hooks.Validate(); err != nil {
+			result.addError("", err.Error())
+		}
+	}
+	if parsed.Supervisor != nil {
+		if err := parsed.Supervisor.Validate(); err != nil {
+			result.addError("", err.Error())
+		}
+	}
+	apiKey, err := ResolveSecret(parsed.APIKey)
+	if err != nil {
+		result.addError("", "cannot resolve api-key: "+err.Error())
+	} else if apiKey == "" {
+		result.addWarning("", "no API key is set; all API requests will be refused")
+	}
+	return
+}
+
+// addError records a problem which would prevent the config being loaded.
+func (result *ConfigValidation) addError(service string, message string) {
+	result.Errors = append(result.Errors, ConfigIssue{
+		Service: service,
+		Message: message,
+	})
+}
+
+// addWarning records a problem which would not prevent the config being
+// loaded, but which may not be intended.
+func (result *ConfigValidation) addWarning(service string, message string) {
+	result.Warnings = append(result.Warnings, ConfigIssue{
+		Service: service,
+		Message: message,
+	})
+}
+
+// sortedKeys returns the keys of a map of services in sorted order, so
+// that validation results are reported consistently.
+func sortedKeys[T any](services map[string]T) (keys []string) {
+	for key := range services {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
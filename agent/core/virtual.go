@@ -0,0 +1,377 @@
+// virtual.go
+// Virtual Responders Sharing a Listener
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A virtual Responder has its own sources, thresholds and commands, but
+// no listener of its own; instead, it shares the listener of another TCP
+// or HTTP(S) Responder, which hands it the requests that it selects. This
+// allows one server hosting several services to report a different weight
+// for each from a single port. A virtual Responder selects requests by:
+//
+//   - HTTP(S): the request path, which must be the match path or begin
+//     with it followed by '/', and/or the Host header (without any port).
+//   - TCP: the first token of the request line, as sent by the 'agent-send'
+//     option of HAProxy (e.g. 'agent-send "mail\n"').
+//
+// Requests selected by no virtual Responder are answered by the Responder
+// owning the listener, whose client restrictions and limits apply to all
+// requests. If several virtual Responders select a request, the first by
+// name answers it.
+//
+// A TCP listener with virtual Responders selecting by token waits briefly
+// for the request line before answering, unless keep-alive is enabled, in
+// which case each poll is selected by its own first token.
+
+// Time for which a TCP listener with virtual Responders waits for the
+// request line used to select one.
+const VirtualTokenTimeout = 250 * time.Millisecond
+
+// virtualRegistry holds the running virtual Responders of an agent by the
+// name of the Responder whose listener they share.
+type virtualRegistry struct {
+	mutex     sync.Mutex
+	listeners map[string]map[string]*FeedbackResponder
+}
+
+// register adds a running virtual Responder to the registry, replacing any
+// previous Responder of the same name.
+func (registry *virtualRegistry) register(fbr *FeedbackResponder) {
+	if registry == nil {
+		return
+	}
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if registry.listeners == nil {
+		registry.listeners = make(map[string]map[string]*FeedbackResponder)
+	}
+	virtuals := registry.listeners[fbr.Listener]
+	if virtuals == nil {
+		virtuals = make(map[string]*FeedbackResponder)
+		registry.listeners[fbr.Listener] = virtuals
+	}
+	virtuals[fbr.ResponderName] = fbr
+}
+
+// unregister removes a virtual Responder from the registry once it has
+// stopped, unless it has already been replaced.
+func (registry *virtualRegistry) unregister(fbr *FeedbackResponder) {
+	if registry == nil {
+		return
+	}
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	virtuals := registry.listeners[fbr.Listener]
+	if virtuals[fbr.ResponderName] == fbr {
+		delete(virtuals, fbr.ResponderName)
+	}
+}
+
+// selectResponder returns the first virtual Responder by name sharing the
+// listener of a Responder which selects a request, or nil if there is none.
+func (registry *virtualRegistry) selectResponder(host *FeedbackResponder,
+	path string, hostName string, token string) *FeedbackResponder {
+	if registry == nil {
+		return nil
+	}
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	virtuals := registry.listeners[host.ResponderName]
+	for _, name := range sortedKeys(virtuals) {
+		virtual := virtuals[name]
+		if virtual.ProtocolName == host.ProtocolName &&
+			virtual.matchesRequest(path, hostName, token) {
+			return virtual
+		}
+	}
+	return nil
+}
+
+// hasTokens returns whether any virtual Responder sharing the listener of
+// a Responder selects requests by token.
+func (registry *virtualRegistry) hasTokens(host *FeedbackResponder) bool {
+	if registry == nil {
+		return false
+	}
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	for _, virtual := range registry.listeners[host.ResponderName] {
+		if virtual.MatchToken != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// isVirtual returns whether this FeedbackResponder shares the listener of
+// another, rather than having its own.
+func (fbr *FeedbackResponder) isVirtual() bool {
+	return fbr.Listener != ""
+}
+
+// configureVirtual validates the listener and selection of this
+// FeedbackResponder if it is virtual, and replaces its connector with one
+// that answers the requests it is handed. The caller must hold the mutex.
+func (fbr *FeedbackResponder) configureVirtual() (err error) {
+	if !fbr.isVirtual() {
+		if fbr.MatchPath != "" || fbr.MatchHost != "" ||
+			fbr.MatchToken != "" {
+			err = errors.New("request matching is only supported by " +
+				"virtual responders, which have a listener set")
+		}
+		return
+	}
+	fbr.Listener, err = StandardiseNameIdentifier(fbr.Listener)
+	if err != nil {
+		return
+	}
+	if fbr.Listener == fbr.ResponderName {
+		err = errors.New("a responder cannot share its own listener")
+		return
+	}
+	fbr.MatchPath = strings.TrimSpace(fbr.MatchPath)
+	fbr.MatchHost = strings.ToLower(strings.TrimSpace(fbr.MatchHost))
+	fbr.MatchToken = strings.ToLower(strings.TrimSpace(fbr.MatchToken))
+	switch fbr.ProtocolName {
+	case ProtocolTCP:
+		if fbr.MatchToken == "" || fbr.MatchPath != "" || fbr.MatchHost != "" {
+			err = errors.New("virtual TCP responders must match a token " +
+				"only")
+			return
+		}
+		if strings.ContainsAny(fbr.MatchToken, " \t") {
+			err = errors.New("invalid match token '" + fbr.MatchToken +
+				"'; cannot contain spaces")
+			return
+		}
+	case ProtocolHTTP, ProtocolHTTPS:
+		if fbr.MatchToken != "" || (fbr.MatchPath == "" &&
+			fbr.MatchHost == "") {
+			err = errors.New("virtual HTTP(S) responders must match a path " +
+				"and/or host")
+			return
+		}
+		if fbr.MatchPath != "" && !strings.HasPrefix(fbr.MatchPath, "/") {
+			err = errors.New("invalid match path '" + fbr.MatchPath +
+				"'; must begin with '/'")
+			return
+		}
+		fbr.MatchPath = strings.TrimSuffix(fbr.MatchPath, "/")
+		if fbr.MatchPath == "" && fbr.MatchHost == "" {
+			err = errors.New("the match path '/' matches all requests")
+			return
+		}
+	default:
+		err = errors.New("virtual responders are only supported by TCP " +
+			"and HTTP(S)")
+		return
+	}
+	// The client restrictions and limits of the listener apply.
+	if fbr.KeepAlive || fbr.ReusePort || len(fbr.AllowedCIDRs) > 0 ||
+		fbr.MaxConnections > 0 || fbr.MaxRequestRate > 0 {
+		err = errors.New("virtual responders use the connection settings " +
+			"of their listener")
+		return
+	}
+	fbr.ListenIPAddress = ""
+	fbr.ListenPort = ""
+	fbr.Connector = &VirtualConnector{}
+	return
+}
+
+// matchesRequest returns whether a request is selected by this virtual
+// FeedbackResponder.
+func (fbr *FeedbackResponder) matchesRequest(path string, hostName string,
+	token string) bool {
+	if fbr.MatchToken != "" && fbr.MatchToken != token {
+		return false
+	}
+	if fbr.MatchHost != "" && fbr.MatchHost != hostName {
+		return false
+	}
+	if fbr.MatchPath != "" && path != fbr.MatchPath &&
+		!strings.HasPrefix(path, fbr.MatchPath+"/") {
+		return false
+	}
+	return true
+}
+
+// selectHTTPResponder returns the virtual Responder sharing the listener
+// of this FeedbackResponder selected by an HTTP request, or this
+// FeedbackResponder if there is none.
+func (fbr *FeedbackResponder) selectHTTPResponder(
+	r *http.Request) *FeedbackResponder {
+	hostName, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		hostName = r.Host
+	}
+	hostName = strings.ToLower(strings.TrimSuffix(hostName, "."))
+	virtual := fbr.ParentAgent.virtuals.selectResponder(fbr, r.URL.Path,
+		hostName, "")
+	if virtual != nil {
+		return virtual
+	}
+	return fbr
+}
+
+// selectTCPResponder returns the virtual Responder sharing the listener of
+// this FeedbackResponder selected by the first token of a TCP request
+// line, or this FeedbackResponder if there is none.
+func (fbr *FeedbackResponder) selectTCPResponder(
+	line []byte) *FeedbackResponder {
+	fields := strings.Fields(string(line))
+	if len(fields) == 0 {
+		return fbr
+	}
+	virtual := fbr.ParentAgent.virtuals.selectResponder(fbr, "", "",
+		strings.ToLower(fields[0]))
+	if virtual != nil {
+		return virtual
+	}
+	return fbr
+}
+
+// readVirtualToken reads the request line of a TCP connection, used to
+// select a virtual Responder, waiting only briefly (for up to the timeout
+// given) as most clients send nothing before reading the feedback.
+func readVirtualToken(c net.Conn, timeout time.Duration) (line []byte) {
+	_ = c.SetReadDeadline(time.Now().Add(timeout))
+	reader := bufio.NewReaderSize(c, MaxTCPPollLength)
+	line, _ = reader.ReadSlice('\n')
+	return slices.Clone(line)
+}
+
+// setVirtual applies the listener and request matching given by an API
+// request to this FeedbackResponder, leaving any not given unchanged; the
+// result is validated when the FeedbackResponder is next initialised.
+func (fbr *FeedbackResponder) setVirtual(request *APIRequest) {
+	if request.Listener != nil {
+		fbr.Listener = *request.Listener
+	}
+	if request.MatchPath != nil {
+		fbr.MatchPath = *request.MatchPath
+	}
+	if request.MatchHost != nil {
+		fbr.MatchHost = *request.MatchHost
+	}
+	if request.MatchToken != nil {
+		fbr.MatchToken = *request.MatchToken
+	}
+}
+
+// checkListener returns an error if a virtual Responder does not share the
+// listener of an existing, non-virtual Responder of the same protocol, or
+// if the listener of a Responder is shared but it could no longer serve
+// those sharing it.
+func (agent *FeedbackAgent) checkListener(fbr *FeedbackResponder) (
+	err error) {
+	virtuals := agent.virtualResponders(fbr.ResponderName)
+	for _, name := range virtuals {
+		if fbr.isVirtual() ||
+			agent.Responders[name].ProtocolName != fbr.ProtocolName {
+			err = errors.New("the listener of responder '" +
+				fbr.ResponderName + "' is shared by '" + name +
+				"', so it must remain a " + strings.ToUpper(
+				agent.Responders[name].ProtocolName) + " responder")
+			return
+		}
+	}
+	if !fbr.isVirtual() {
+		return
+	}
+	host, exists := agent.Responders[fbr.Listener]
+	if !exists {
+		err = errors.New("listener responder '" + fbr.Listener +
+			"' not found")
+		return
+	}
+	if host.isVirtual() {
+		err = errors.New("responder '" + fbr.Listener + "' is virtual, so " +
+			"has no listener to share")
+		return
+	}
+	if host.ProtocolName != fbr.ProtocolName {
+		err = errors.New("responder '" + fbr.Listener + "' uses the " +
+			"protocol '" + host.ProtocolName + "', not '" +
+			fbr.ProtocolName + "'")
+	}
+	return
+}
+
+// virtualResponders returns the names of the Responders sharing the
+// listener of a Responder.
+func (agent *FeedbackAgent) virtualResponders(name string) (names []string) {
+	for _, other := range sortedKeys(agent.Responders) {
+		if agent.Responders[other].Listener == name {
+			names = append(names, other)
+		}
+	}
+	return
+}
+
+// #################################
+// VirtualConnector
+// #################################
+
+// VirtualConnector is the ProtocolConnector of a virtual Responder, which
+// registers it with the agent while it runs, rather than binding a
+// listener of its own.
+type VirtualConnector struct {
+	stop    chan struct{}
+	closing bool
+	mutex   sync.Mutex
+}
+
+func (pc *VirtualConnector) Listen(fbr *FeedbackResponder) (err error) {
+	pc.mutex.Lock()
+	pc.stop = make(chan struct{})
+	pc.closing = false
+	stop := pc.stop
+	pc.mutex.Unlock()
+	fbr.ParentAgent.virtuals.register(fbr)
+	<-stop
+	fbr.ParentAgent.virtuals.unregister(fbr)
+	return
+}
+
+func (pc *VirtualConnector) Shutdown(_ time.Duration) (err error) {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	if pc.stop != nil && !pc.closing {
+		pc.closing = true
+		close(pc.stop)
+	}
+	return
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
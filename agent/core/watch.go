@@ -0,0 +1,319 @@
+// watch.go
+// Continuously Updating CLI Views of Status and Feedback
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// The 'watch' action shows a continuously updating view of the values of
+// the monitors and the availability and command state of the Responders,
+// along with any events raised, until interrupted with Ctrl-C. It uses a
+// subscription to the agent (see subscribe.go), so the view is updated as
+// soon as anything changes, rather than polling with separate requests;
+// if the subscription fails, it is made again after a delay.
+//
+// 'watch status' shows every service, and 'watch feedback -name <name>'
+// shows a single Responder and the monitors which are its sources. If the
+// output is a terminal, the view is redrawn in place; otherwise, a line is
+// written for each update, so that the output can be logged.
+
+const (
+	// Default interval at which the view is refreshed (ms).
+	DefaultWatchInterval = 1000
+	// Delay before subscribing again after the subscription fails.
+	WatchRetryDelay = 2 * time.Second
+	// Number of recent events shown in the view.
+	WatchRecentEvents = 5
+)
+
+// watchView holds the latest state of the services being watched.
+type watchView struct {
+	mutex      sync.Mutex
+	title      string
+	url        string
+	monitors   map[string]SubscriptionUpdate
+	responders map[string]*watchResponder
+	events     []AgentEvent
+	status     string
+	changed    bool
+	// Whether the view is redrawn in place, rather than written a line
+	// at a time.
+	redraw bool
+}
+
+// watchResponder holds the latest availability and command state of a
+// Responder.
+type watchResponder struct {
+	availability *int
+	online       *bool
+	forced       bool
+}
+
+// RunWatch runs the 'watch' action until interrupted.
+func RunWatch(argv []string) (status int) {
+	actionType := ""
+	if len(argv) > 0 && !strings.HasPrefix(argv[0], "-") {
+		actionType, argv = argv[0], argv[1:]
+	}
+	err := runWatch(actionType, argv)
+	if err != nil {
+		println("Error: " + err.Error() + ".")
+		return CLIExitStatus(nil, err)
+	}
+	return ExitStatusNormal
+}
+
+func runWatch(actionType string, argv []string) (err error) {
+	request, options, err := ParseArgumentsToRequest("watch", actionType,
+		argv)
+	if err != nil {
+		return
+	}
+	client, err := NewCLIAPIClient(&request, options.Instance)
+	if err != nil {
+		return
+	}
+	interval := DefaultWatchInterval
+	if request.MetricInterval != nil {
+		interval = *request.MetricInterval
+		if interval < MinSubscribeInterval {
+			return errors.New("the watch interval must be at least " +
+				strconv.Itoa(MinSubscribeInterval) + "ms")
+		}
+	}
+	query := url.Values{"interval-ms": {strconv.Itoa(interval)}}
+	title := "status"
+	if actionType == "feedback" {
+		if request.TargetName == "" {
+			return errors.New("no responder name specified")
+		}
+		// The sources of the Responder determine the monitors shown.
+		var response *APIResponse
+		response, _, err = CLISendRequest(client, &APIRequest{
+			Action:     "get",
+			Type:       "sources",
+			TargetName: request.TargetName,
+		})
+		if err != nil {
+			return
+		}
+		if !response.Success {
+			return errors.New(response.Message)
+		}
+		monitors := make([]string, 0, len(response.FeedbackSources))
+		for name := range response.FeedbackSources {
+			monitors = append(monitors, name)
+		}
+		query.Set("responders", request.TargetName)
+		query.Set("monitors", strings.Join(monitors, ","))
+		title = "feedback for '" + request.TargetName + "'"
+	}
+	view := &watchView{
+		title:      title,
+		url:        client.URL,
+		monitors:   make(map[string]SubscriptionUpdate),
+		responders: make(map[string]*watchResponder),
+		status:     "connecting",
+		redraw:     isTerminal(os.Stdout),
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if view.redraw {
+		go view.render(ctx, os.Stdout, time.Duration(interval)*time.Millisecond)
+	}
+	for ctx.Err() == nil {
+		view.setStatus("connected")
+		subscribeErr := client.Subscribe(ctx, query, view.apply)
+		if subscribeErr == nil {
+			break
+		}
+		view.setStatus(subscribeErr.Error() + "; retrying")
+		select {
+		case <-ctx.Done():
+		case <-time.After(WatchRetryDelay):
+		}
+	}
+	return
+}
+
+// isTerminal returns whether a file is a terminal.
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// apply applies an update to the view.
+func (view *watchView) apply(update SubscriptionUpdate) {
+	view.mutex.Lock()
+	defer view.mutex.Unlock()
+	view.changed = true
+	switch update.Type {
+	case UpdateTypeMetric:
+		view.monitors[update.Monitor] = update
+	case UpdateTypeAvailability, UpdateTypeState:
+		responder := view.responders[update.Responder]
+		if responder == nil {
+			responder = &watchResponder{}
+			view.responders[update.Responder] = responder
+		}
+		if update.Availability != nil {
+			responder.availability = update.Availability
+		}
+		if update.Online != nil {
+			responder.online = update.Online
+			responder.forced = update.Forced
+		}
+	case UpdateTypeEvent:
+		if update.Event != nil {
+			view.events = append(view.events, *update.Event)
+			if len(view.events) > WatchRecentEvents {
+				view.events = view.events[1:]
+			}
+		}
+	}
+	if !view.redraw {
+		fmt.Println(formatWatchUpdate(update))
+	}
+}
+
+// setStatus sets the status of the subscription shown in the view.
+func (view *watchView) setStatus(status string) {
+	view.mutex.Lock()
+	defer view.mutex.Unlock()
+	if status != view.status && !view.redraw {
+		fmt.Println(time.Now().Format(time.TimeOnly) + " " + status)
+	}
+	view.status = status
+	view.changed = true
+}
+
+// render redraws the view in place at an interval whenever it has
+// changed, until the context is cancelled.
+func (view *watchView) render(ctx context.Context, output io.Writer,
+	interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		view.mutex.Lock()
+		if view.changed {
+			view.changed = false
+			// Move to the top left and clear the screen before drawing.
+			_, _ = io.WriteString(output, "\x1b[H\x1b[2J"+view.format())
+		}
+		view.mutex.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// format formats the view; the caller must hold the mutex.
+func (view *watchView) format() string {
+	var b strings.Builder
+	b.WriteString("Watching " + view.title + " at " + view.url + " (" +
+		view.status + ")    " + time.Now().Format(time.DateTime) + "\n\n")
+	table := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	if len(view.monitors) > 0 {
+		_, _ = io.WriteString(table, "MONITOR\tTYPE\tVALUE\tSAMPLED\n")
+		for _, name := range sortedKeys(view.monitors) {
+			update := view.monitors[name]
+			_, _ = io.WriteString(table, name+"\t"+update.MetricType+"\t"+
+				strconv.FormatInt(*update.Value, 10)+"\t"+
+				update.Time.Local().Format(time.TimeOnly)+"\n")
+		}
+		_, _ = io.WriteString(table, "\n")
+	}
+	if len(view.responders) > 0 {
+		_, _ = io.WriteString(table, "RESPONDER\tAVAILABILITY\tSTATE\n")
+		for _, name := range sortedKeys(view.responders) {
+			responder := view.responders[name]
+			availability := "-"
+			if responder.availability != nil {
+				availability = strconv.Itoa(*responder.availability) + "%"
+			}
+			_, _ = io.WriteString(table, name+"\t"+availability+"\t"+
+				formatCommandState(responder.online, responder.forced)+"\n")
+		}
+	}
+	_ = table.Flush()
+	if len(view.events) > 0 {
+		b.WriteString("\nRECENT EVENTS\n")
+		for _, event := range view.events {
+			b.WriteString(event.Time.Local().Format(time.TimeOnly) + " " +
+				event.Level + " " + event.Message + "\n")
+		}
+	}
+	b.WriteString("\nPress Ctrl-C to stop watching.\n")
+	return b.String()
+}
+
+// formatCommandState describes the command state of a Responder.
+func formatCommandState(online *bool, forced bool) (state string) {
+	switch {
+	case online == nil:
+		return "-"
+	case *online:
+		state = "online"
+	default:
+		state = "offline"
+	}
+	if forced {
+		state += " (forced)"
+	}
+	return
+}
+
+// formatWatchUpdate formats an update as a single line.
+func formatWatchUpdate(update SubscriptionUpdate) string {
+	line := update.Time.Local().Format(time.TimeOnly) + " "
+	switch update.Type {
+	case UpdateTypeMetric:
+		line += "monitor " + update.Monitor + " = " +
+			strconv.FormatInt(*update.Value, 10)
+	case UpdateTypeAvailability:
+		line += "responder " + update.Responder + " availability " +
+			strconv.Itoa(*update.Availability) + "%"
+	case UpdateTypeState:
+		line += "responder " + update.Responder + " " +
+			formatCommandState(update.Online, update.Forced)
+	case UpdateTypeEvent:
+		line += "event " + update.Event.Level + " " + update.Event.Message
+	}
+	return line
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,386 @@
+// webhooks.go
+// Webhook Notifications of State Transitions
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Webhooks post a JSON payload to each configured URL whenever an event is
+// recorded within the agent, including state transitions: a Responder
+// crossing its threshold, a command state being forced, or a monitor
+// starting or ceasing to fail to sample. The payload holds the event, along with the host name and a
+// 'text' summary (so that it can be posted directly to a Slack incoming
+// webhook), e.g.
+//
+//	{"host": "web1", "text": "[web1] Responder 'default' has crossed
+//	its threshold and is now offline.", "time": "...",
+//	"type": "threshold-crossed", "level": "warn", ...}
+//
+// If a secret is configured, each payload is signed with HMAC-SHA256, the
+// hex digest of which is sent in the X-LBFeedback-Signature header as
+// 'sha256=<digest>'. Deliveries are queued, so that services are never
+// delayed by a slow endpoint, and retried with increasing delays.
+
+const (
+	// Default and maximum number of further attempts made to deliver each
+	// notification, and the delay before the first of these, which is
+	// doubled for each subsequent attempt.
+	DefaultWebhookRetries = 3
+	MaxWebhookRetries     = 10
+	WebhookRetryDelay     = time.Second
+	// Default time allowed for each delivery.
+	DefaultWebhookTimeout = 10 * time.Second
+	// Number of notifications queued for delivery before further
+	// notifications are dropped.
+	WebhookQueueSize = 256
+	// Header holding the signature of the payload.
+	WebhookSignatureHeader = "X-LBFeedback-Signature"
+)
+
+// notifiableEventTypes lists the types of event which may be selected for
+// webhook notifications.
+var notifiableEventTypes = []string{
+	EventTypeThresholdCrossed, EventTypeStateForced, EventTypeSampleFailed,
+	EventTypeSampleRecovered, EventTypeOverrideExpired,
+	EventTypeOverrideCancelled, EventTypeFlapTest, EventTypeAnomaly,
+	EventTypeAnomalyCleared, EventTypeReplicationFailed,
+	EventTypeConfigDiverged, EventTypeServiceStarted, EventTypeServiceStopped,
+	EventTypeServiceFailed, EventTypeConfigChanged, EventTypeDrainComplete,
+}
+
+// WebhookConfig holds the settings for webhook notifications, which are
+// enabled if these settings are present in the config. If no event types
+// are given, all are sent. The URLs and secret may contain secret
+// references, as for the API key.
+type WebhookConfig struct {
+	URLs    []string `json:"urls"`
+	Secret  string   `json:"secret,omitempty"`
+	Events  []string `json:"events,omitempty"`
+	Retries *int     `json:"retries,omitempty"`
+	Timeout Duration `json:"timeout,omitempty"`
+}
+
+// Validate checks the webhook settings, returning the resolved URLs and
+// secret.
+func (config *WebhookConfig) Validate() (resolvedURLs []string,
+	secret string, err error) {
+	if len(config.URLs) == 0 {
+		err = errors.New("no webhook URLs specified")
+		return
+	}
+	for _, webhookURL := range config.URLs {
+		var resolved string
+		resolved, err = ResolveSecret(webhookURL)
+		if err != nil {
+			err = errors.New("cannot resolve webhook URL: " + err.Error())
+			return
+		}
+		parsed, parseErr := url.Parse(resolved)
+		if parseErr != nil || (parsed.Scheme != "http" &&
+			parsed.Scheme != "https") || parsed.Host == "" {
+			err = errors.New("webhook URLs must be absolute HTTP(S) URLs")
+			return
+		}
+		resolvedURLs = append(resolvedURLs, resolved)
+	}
+	for _, eventType := range config.Events {
+		if !slices.Contains(notifiableEventTypes, eventType) {
+			err = errors.New("invalid webhook event type '" + eventType +
+				"'; must be one of: " + strings.Join(notifiableEventTypes, ", "))
+			return
+		}
+	}
+	if config.Retries != nil && (*config.Retries < 0 ||
+		*config.Retries > MaxWebhookRetries) {
+		err = errors.New("webhook retries must be from 0 to " +
+			strconv.Itoa(MaxWebhookRetries))
+		return
+	} else if config.Timeout < 0 {
+		err = errors.New("webhook timeout cannot be negative")
+		return
+	}
+	secret, err = ResolveSecret(config.Secret)
+	if err != nil {
+		err = errors.New("cannot resolve webhook secret: " + err.Error())
+	}
+	return
+}
+
+// #######################################################################
+// Notifier
+// #######################################################################
+
+// WebhookPayload is the JSON body posted to each webhook.
+type WebhookPayload struct {
+	Host string `json:"host"`
+	Text string `json:"text"`
+	AgentEvent
+}
+
+// WebhookNotifier delivers notifications to the configured webhooks whilst
+// the agent is running.
+type WebhookNotifier struct {
+	config  WebhookConfig
+	urls    []string
+	secret  string
+	retries int
+	host    string
+	client  *http.Client
+	queue   chan AgentEvent
+	cancel  context.CancelFunc
+	done    chan struct{}
+	// Whether the last delivery to each URL failed, so that only changes
+	// are logged.
+	failing map[string]bool
+}
+
+// StartWebhookNotifier validates the webhook settings and starts
+// delivering notifications.
+func StartWebhookNotifier(config WebhookConfig) (notifier *WebhookNotifier,
+	err error) {
+	resolvedURLs, secret, err := config.Validate()
+	if err != nil {
+		return
+	}
+	retries := DefaultWebhookRetries
+	if config.Retries != nil {
+		retries = *config.Retries
+	}
+	timeout := time.Duration(config.Timeout)
+	if timeout == 0 {
+		timeout = DefaultWebhookTimeout
+	}
+	host, _ := os.Hostname()
+	ctx, cancel := context.WithCancel(context.Background())
+	notifier = &WebhookNotifier{
+		config:  config,
+		urls:    resolvedURLs,
+		secret:  secret,
+		retries: retries,
+		host:    host,
+		client:  &http.Client{Timeout: timeout},
+		queue:   make(chan AgentEvent, WebhookQueueSize),
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		failing: make(map[string]bool),
+	}
+	go notifier.run(ctx)
+	logrus.Info("Sending webhook notifications to " +
+		strconv.Itoa(len(resolvedURLs)) + " URL(s).")
+	return
+}
+
+// Stop stops delivering notifications, abandoning any still queued.
+func (notifier *WebhookNotifier) Stop() {
+	notifier.cancel()
+	<-notifier.done
+}
+
+// Notify queues an event for delivery, if its type is selected; if the
+// queue is full, the event is dropped, so this never blocks.
+func (notifier *WebhookNotifier) Notify(event AgentEvent) {
+	if len(notifier.config.Events) > 0 &&
+		!slices.Contains(notifier.config.Events, event.Type) {
+		return
+	}
+	select {
+	case notifier.queue <- event:
+	default:
+		logrus.Warn("The webhook queue is full; dropped notification: " +
+			event.Message)
+	}
+}
+
+// run delivers queued notifications until cancelled.
+func (notifier *WebhookNotifier) run(ctx context.Context) {
+	defer close(notifier.done)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-notifier.queue:
+			notifier.deliver(ctx, event)
+		}
+	}
+}
+
+// deliver posts an event to each webhook concurrently, retrying failed
+// deliveries.
+func (notifier *WebhookNotifier) deliver(ctx context.Context,
+	event AgentEvent) {
+	prefix := ""
+	if notifier.host != "" {
+		prefix = "[" + notifier.host + "] "
+	}
+	body, err := json.Marshal(WebhookPayload{
+		Host:       notifier.host,
+		Text:       prefix + event.Message,
+		AgentEvent: event,
+	})
+	if err != nil {
+		return
+	}
+	signature := ""
+	if notifier.secret != "" {
+		mac := hmac.New(sha256.New, []byte(notifier.secret))
+		mac.Write(body)
+		signature = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	var wait sync.WaitGroup
+	results := make([]error, len(notifier.urls))
+	for i, webhookURL := range notifier.urls {
+		i, webhookURL := i, webhookURL
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			results[i] = notifier.post(ctx, webhookURL, body, signature)
+		}()
+	}
+	wait.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+	// URLs are not logged, as they may contain a secret.
+	for i, webhookURL := range notifier.urls {
+		err := results[i]
+		target := "webhook " + strconv.Itoa(i+1)
+		if err != nil && !notifier.failing[webhookURL] {
+			logrus.Warn("Failed to deliver a notification to " + target +
+				": " + err.Error())
+		} else if err == nil && notifier.failing[webhookURL] {
+			logrus.Info("Notifications are being delivered to " + target +
+				" successfully again.")
+		}
+		notifier.failing[webhookURL] = err != nil
+	}
+}
+
+// post posts a payload to a webhook, retrying if it fails.
+func (notifier *WebhookNotifier) post(ctx context.Context, webhookURL string,
+	body []byte, signature string) (err error) {
+	delay := WebhookRetryDelay
+	for attempt := 0; ; attempt++ {
+		err = notifier.postOnce(ctx, webhookURL, body, signature)
+		if err == nil || attempt >= notifier.retries {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// postOnce makes a single attempt to post a payload to a webhook.
+func (notifier *WebhookNotifier) postOnce(ctx context.Context,
+	webhookURL string, body []byte, signature string) (err error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", AppIdentifier+"/"+VersionString)
+	if signature != "" {
+		request.Header.Set(WebhookSignatureHeader, signature)
+	}
+	response, err := notifier.client.Do(request)
+	if err != nil {
+		// The URL is removed from the error, as it may contain a secret.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return
+	}
+	_, _ = io.Copy(io.Discard, response.Body)
+	_ = response.Body.Close()
+	if response.StatusCode >= 300 {
+		err = errors.New("HTTP status " + response.Status)
+	}
+	return
+}
+
+// UpdateWebhooks starts, restarts or stops delivering webhook
+// notifications according to the webhooks setting of the agent.
+func (agent *FeedbackAgent) UpdateWebhooks() {
+	if agent.webhooks == nil {
+		return
+	}
+	current := agent.webhooks.Load()
+	if current != nil {
+		if agent.Webhooks != nil &&
+			configJSONEqual(current.config, *agent.Webhooks) {
+			return
+		}
+		agent.webhooks.Store(nil)
+		current.Stop()
+		if agent.Webhooks == nil {
+			logrus.Info("Stopped sending webhook notifications.")
+			return
+		}
+	}
+	if agent.Webhooks == nil {
+		return
+	}
+	notifier, err := StartWebhookNotifier(*agent.Webhooks)
+	if err != nil {
+		logrus.Error("Failed to start webhook notifications: " + err.Error())
+		return
+	}
+	agent.webhooks.Store(notifier)
+}
+
+// StopWebhooks stops sending webhook notifications when the agent shuts
+// down, leaving the webhooks setting unchanged.
+func (agent *FeedbackAgent) StopWebhooks() {
+	if agent.webhooks == nil {
+		return
+	}
+	if current := agent.webhooks.Swap(nil); current != nil {
+		current.Stop()
+		logrus.Info("Stopped sending webhook notifications.")
+	}
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------
@@ -0,0 +1,296 @@
+// weightcurve.go
+// Mapping of Load to Reported Weight
+//
+// Project:     Loadbalancer.org Feedback Agent v5
+//
+// Copyright (C) 2025 Loadbalancer.org Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package agent
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The availability reported by a Feedback Responder is, by default, simply
+// the inverse of its overall load (100% - load), which under-penalises a
+// heavily loaded server: at 80% load it still reports a weight of 20%. A
+// Responder may instead map its load to the reported weight using one of
+// the following curves:
+//
+//   - 'exponential': the weight falls away exponentially with the load,
+//     scaled to give 100% when idle and 0% when fully loaded. The curve
+//     factor sets its steepness (3 by default, giving 4% at 80% load).
+//   - 'step': the weight is that of the last of a table of load=weight
+//     points whose load has been reached, or 100% below the first point.
+//   - 'breakpoints': the weight is interpolated linearly between a list of
+//     load=weight points, which are joined to 100% when idle and 0% when
+//     fully loaded unless these are given.
+//
+// The curve only changes the reported weight; thresholds still apply to
+// the load itself. The resulting weight may then be clamped between a floor
+// (min-weight), so that a load balancer never starves a server of traffic
+// entirely, and a ceiling (max-weight).
+
+// Curves mapping the load of a Responder to its reported weight.
+const (
+	WeightCurveLinear      = "linear"
+	WeightCurveExponential = "exponential"
+	WeightCurveStep        = "step"
+	WeightCurveBreakpoints = "breakpoints"
+
+	// Default and maximum steepness of the 'exponential' curve.
+	DefaultWeightCurveFactor = 3.0
+	MaxWeightCurveFactor     = 20.0
+)
+
+// WeightPoint maps a load to a reported weight, both as percentages, for
+// the 'step' and 'breakpoints' curves.
+type WeightPoint struct {
+	Load   int `json:"load"`
+	Weight int `json:"weight"`
+}
+
+// ParseWeightCurve validates and standardises the name of a weight curve,
+// an empty name being the default 'linear' curve.
+func ParseWeightCurve(name string) (result string, err error) {
+	result = strings.ToLower(strings.TrimSpace(name))
+	switch result {
+	case "":
+		result = WeightCurveLinear
+	case WeightCurveLinear, WeightCurveExponential, WeightCurveStep,
+		WeightCurveBreakpoints:
+	default:
+		err = errors.New("invalid weight curve '" + name + "'; must be '" +
+			WeightCurveLinear + "', '" + WeightCurveExponential + "', '" +
+			WeightCurveStep + "' or '" + WeightCurveBreakpoints + "'")
+	}
+	return
+}
+
+// ParseWeightPoints parses weight points from the CLI format, a list of
+// 'load=weight' pairs separated by commas (e.g. '50=80,80=20,95=0'), or
+// 'none' for an empty list.
+func ParseWeightPoints(text string) (points []WeightPoint, err error) {
+	points = []WeightPoint{}
+	if strings.EqualFold(strings.TrimSpace(text), "none") {
+		return
+	}
+	for _, entry := range strings.Split(text, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		point := WeightPoint{}
+		load, weight, found := strings.Cut(entry, "=")
+		if found {
+			point.Load, err = strconv.Atoi(strings.TrimSpace(load))
+		}
+		if found && err == nil {
+			point.Weight, err = strconv.Atoi(strings.TrimSpace(weight))
+		}
+		if !found || err != nil {
+			err = errors.New("invalid weight point '" + entry +
+				"'; use 'load=weight'")
+			return
+		}
+		points = append(points, point)
+	}
+	err = ValidateWeightPoints(points)
+	return
+}
+
+// ValidateWeightPoints returns an error if any load or weight of a list of
+// weight points is outside 0-100%, or the loads are not in ascending order.
+func ValidateWeightPoints(points []WeightPoint) (err error) {
+	for i, point := range points {
+		if point.Load < 0 || point.Load > 100 || point.Weight < 0 ||
+			point.Weight > 100 {
+			err = errors.New("invalid weight point " +
+				strconv.Itoa(point.Load) + "=" + strconv.Itoa(point.Weight) +
+				"; the load and weight must be between 0 and 100")
+			return
+		}
+		if i > 0 && point.Load <= points[i-1].Load {
+			err = errors.New("the loads of weight points must be in " +
+				"ascending order")
+			return
+		}
+	}
+	return
+}
+
+// configureWeightCurve validates the weight curve of this FeedbackResponder
+// along with its factor or points, as required by the curve. The caller
+// must hold the mutex.
+func (fbr *FeedbackResponder) configureWeightCurve() (err error) {
+	curve, err := ParseWeightCurve(fbr.WeightCurve)
+	if err != nil {
+		return
+	}
+	// Copy the points, as they are shared with the original by Copy().
+	fbr.WeightPoints = slices.Clone(fbr.WeightPoints)
+	err = ValidateWeightPoints(fbr.WeightPoints)
+	if err != nil {
+		return
+	}
+	usesPoints := curve == WeightCurveStep || curve == WeightCurveBreakpoints
+	if usesPoints && len(fbr.WeightPoints) == 0 {
+		err = errors.New("the '" + curve + "' weight curve requires weight " +
+			"points")
+		return
+	}
+	if !usesPoints && len(fbr.WeightPoints) > 0 {
+		err = errors.New("weight points are only used by the '" +
+			WeightCurveStep + "' and '" + WeightCurveBreakpoints +
+			"' weight curves")
+		return
+	}
+	if curve != WeightCurveExponential && fbr.WeightCurveFactor != 0 {
+		err = errors.New("a weight curve factor is only used by the '" +
+			WeightCurveExponential + "' weight curve")
+		return
+	}
+	if fbr.WeightCurveFactor < 0 ||
+		fbr.WeightCurveFactor > MaxWeightCurveFactor {
+		err = errors.New("invalid weight curve factor; must be greater " +
+			"than 0, up to " + strconv.FormatFloat(MaxWeightCurveFactor, 'f',
+			-1, 64))
+		return
+	}
+	// The default curve is left unset in the config.
+	if curve == WeightCurveLinear {
+		curve = ""
+	}
+	fbr.WeightCurve = curve
+	err = fbr.validateWeightLimits()
+	return
+}
+
+// validateWeightLimits returns an error if the floor or ceiling on the
+// weight reported by this FeedbackResponder is outside 0-100%, or the floor
+// is above the ceiling. A ceiling of 0 is disabled.
+func (fbr *FeedbackResponder) validateWeightLimits() (err error) {
+	if fbr.MinWeight < 0 || fbr.MinWeight > 100 {
+		err = errors.New("invalid min weight; must be between 0 and 100")
+	} else if fbr.MaxWeight < 0 || fbr.MaxWeight > 100 {
+		err = errors.New("invalid max weight; must be between 0 and 100 " +
+			"(0 to disable)")
+	} else if fbr.MaxWeight > 0 && fbr.MinWeight > fbr.MaxWeight {
+		err = errors.New("the min weight (" + strconv.Itoa(fbr.MinWeight) +
+			") cannot be above the max weight (" +
+			strconv.Itoa(fbr.MaxWeight) + ")")
+	}
+	return
+}
+
+// setWeightCurve applies the weight curve, factor and points given by an
+// API request to this FeedbackResponder, any of which may be nil to leave
+// it unchanged. Setting a curve which does not use the existing factor or
+// points clears them; the result is validated when the FeedbackResponder is
+// next initialised.
+func (fbr *FeedbackResponder) setWeightCurve(curve *string, factor *float64,
+	points *[]WeightPoint) {
+	if curve != nil {
+		fbr.WeightCurve = *curve
+		name := strings.ToLower(strings.TrimSpace(*curve))
+		if factor == nil && name != WeightCurveExponential {
+			fbr.WeightCurveFactor = 0
+		}
+		if points == nil && name != WeightCurveStep &&
+			name != WeightCurveBreakpoints {
+			fbr.WeightPoints = nil
+		}
+	}
+	if factor != nil {
+		fbr.WeightCurveFactor = *factor
+	}
+	if points != nil {
+		fbr.WeightPoints = *points
+	}
+}
+
+// mapWeight returns the weight reported by this FeedbackResponder for an
+// overall load, using its weight curve and then clamping the result to its
+// floor and ceiling, if set. The caller must hold the mutex.
+func (fbr *FeedbackResponder) mapWeight(load int) (weight int) {
+	weight = max(fbr.curveWeight(load), fbr.MinWeight)
+	if fbr.MaxWeight > 0 {
+		weight = min(weight, fbr.MaxWeight)
+	}
+	return
+}
+
+// curveWeight returns the weight for an overall load given by the weight
+// curve of this FeedbackResponder. The caller must hold the mutex.
+func (fbr *FeedbackResponder) curveWeight(load int) (weight int) {
+	load = min(max(load, 0), 100)
+	switch fbr.WeightCurve {
+	case WeightCurveExponential:
+		factor := fbr.WeightCurveFactor
+		if factor == 0 {
+			factor = DefaultWeightCurveFactor
+		}
+		floor := math.Exp(-factor)
+		scaled := (math.Exp(-factor*float64(load)/100) - floor) / (1 - floor)
+		weight = int(math.Round(scaled * 100))
+	case WeightCurveStep:
+		weight = 100
+		for _, point := range fbr.WeightPoints {
+			if load < point.Load {
+				break
+			}
+			weight = point.Weight
+		}
+	case WeightCurveBreakpoints:
+		weight = interpolateWeight(fbr.WeightPoints, load)
+	default:
+		weight = 100 - load
+	}
+	return
+}
+
+// interpolateWeight returns the weight for a load by linear interpolation
+// between weight points in ascending order of load, joined to a weight of
+// 100% at no load and 0% at full load unless these are included.
+func interpolateWeight(points []WeightPoint, load int) (weight int) {
+	previous := WeightPoint{Load: 0, Weight: 100}
+	last := WeightPoint{Load: 100, Weight: 0}
+	for i := 0; i <= len(points); i++ {
+		point := last
+		if i < len(points) {
+			point = points[i]
+		}
+		if load <= point.Load {
+			if point.Load == previous.Load {
+				return point.Weight
+			}
+			fraction := float64(load-previous.Load) /
+				float64(point.Load-previous.Load)
+			return int(math.Round(float64(previous.Weight) +
+				fraction*float64(point.Weight-previous.Weight)))
+		}
+		previous = point
+	}
+	return previous.Weight
+}
+
+// -------------------------------------------------------------------
+// END OF FILE
+// -------------------------------------------------------------------